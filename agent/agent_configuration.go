@@ -1,5 +1,7 @@
 package agent
 
+import "time"
+
 // AgentConfiguration is the run-time configuration for an agent that
 // has been loaded from the config file and command-line params
 type AgentConfiguration struct {
@@ -11,26 +13,79 @@ type AgentConfiguration struct {
 	GitMirrorsLockTimeout      int
 	GitMirrorsSkipUpdate       bool
 	PluginsPath                string
+	CheckoutType               string
+	CheckoutPathTemplate       string
 	GitCloneFlags              string
 	GitCloneMirrorFlags        string
 	GitCleanFlags              string
 	GitFetchFlags              string
+	GitSSHHosts                []string
+	GitSSHConfig               string
+	GitHTTPSFallback           bool
+	GitCredentialHelper        string
 	GitSubmodules              bool
 	SSHKeyscan                 bool
+	SSHStrictHostKeys          bool
+	SSHVerifyHostKeysWithDNS   bool
 	CommandEval                bool
 	PluginsEnabled             bool
 	PluginValidation           bool
+	IsolatePlugins             bool
+	PluginsSharedEnv           []string
 	LocalHooksEnabled          bool
 	RunInPty                   bool
 	TimestampLines             bool
 	HealthCheckAddr            string
 	DisconnectAfterJob         bool
 	DisconnectAfterIdleTimeout int
-	CancelGracePeriod          int
+	CancelGracePeriod          time.Duration
+	CancelArtifactGracePeriod  int
 	EnableJobLogTmpfile        bool
+	NoLogStreaming             bool
+	LogLineMaxLength           int
+	LogLinePolicy              string
 	Shell                      string
+	WSLDistribution            string
+	MacOSKeychain              string
+	MacOSKeychainPasswordFile  string
+	MacOSProvisioningProfiles  string
+	DiskMinFreeSpace           uint64
+	DiskCleanupCheckouts       bool
+	ClockSkewThreshold         int
+	ReregisterAttempts         int
+	CacheAffinity              int
+	MaintenanceTasks           []string
+	MaintenanceWindows         []string
+	MaintenanceTimezone        string
+	InfraFailureExitStatus     int
+	InfraFailureAnnotate       bool
+	TransferConcurrency        int
+	TransferBandwidth          int64
+	ArtifactMaxTotalSize       uint64
+	ArtifactMaxFiles           int
+	ArtifactMaxFileSize        uint64
+	ArtifactQuotaPolicy        string
+	ArtifactURLSigner          string
+	SpoolPath                  string
+	SpoolMaxAge                time.Duration
+	SpoolMaxSize               int64
 	Profile                    string
 	RedactedVars               []string
+	EnvPolicyAllow             []string
+	EnvSchemaPath              string
+	ToolsPath                  string
+	ToolMirrors                []string
+	ToolChecksums              string
+	JobTmpPath                 string
+	JobTmpfsSize               uint64
+	GPUs                       []GPU
+	GPUsPerJob                 int
+	AllowedJobExperiments      []string
 	AcquireJob                 string
+	AcceptJobs                 []string
+	ReadinessChecks            []string
+	ReadinessTimeout           time.Duration
+	ProxyPAC                   string
+	DNSCache                   bool
 	TracingBackend             string
 }
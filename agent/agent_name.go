@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+// The placeholders that agent names can use, and what they're replaced with
+var agentNamePlaceholders = map[string]string{
+	"%hostname":     "the host's name",
+	"%spawn":        "the index of each agent the agent spawns",
+	"%pid":          "the agent's process ID",
+	"%random":       "a random hex string",
+	"%instance-id":  "the EC2 or GCE instance ID",
+	"%zone":         "the EC2 availability zone or GCE zone",
+	"%container-id": "the ID of the container the agent runs in",
+	"%queue":        "the agent's queue",
+}
+
+// AgentNamePlaceholders describes the placeholders agent names can use
+func AgentNamePlaceholders() string {
+	var names []string
+	for name := range agentNamePlaceholders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// ExpandAgentName replaces the placeholders in the name of the agent with the
+// given spawn index with their values. A % that isn't one of the placeholders
+// is left as it is, and it returns an error if the name has a placeholder that
+// doesn't have a value on this host.
+func ExpandAgentName(name string, tags []string, spawn int) (string, error) {
+	return expandAgentName(name, func(placeholder string) (string, error) {
+		switch placeholder {
+		case "%spawn":
+			return strconv.Itoa(spawn), nil
+		case "%hostname":
+			return os.Hostname()
+		case "%pid":
+			return strconv.Itoa(os.Getpid()), nil
+		case "%random":
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(rand.Reader, b); err != nil {
+				return "", err
+			}
+			return hex.EncodeToString(b), nil
+		case "%instance-id":
+			return cloudInstanceID()
+		case "%zone":
+			return cloudZone()
+		case "%container-id":
+			return containerID()
+		case "%queue":
+			return queueFromTags(tags), nil
+		}
+		return "", fmt.Errorf("%s isn't a placeholder", placeholder)
+	})
+}
+
+// expandAgentName replaces the placeholders in name with what lookup returns
+// for them. Each placeholder is only looked up once.
+func expandAgentName(name string, lookup func(placeholder string) (string, error)) (string, error) {
+	// The longest placeholders are matched first, so %zone doesn't match
+	// part of a longer one
+	var placeholders []string
+	for p := range agentNamePlaceholders {
+		placeholders = append(placeholders, p)
+	}
+	sort.Slice(placeholders, func(i, j int) bool { return len(placeholders[i]) > len(placeholders[j]) })
+
+	values := map[string]string{}
+
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		if name[i] != '%' {
+			b.WriteByte(name[i])
+			i++
+			continue
+		}
+
+		var placeholder string
+		for _, p := range placeholders {
+			if strings.HasPrefix(name[i:], p) {
+				placeholder = p
+				break
+			}
+		}
+
+		if placeholder == "" {
+			b.WriteByte('%')
+			i++
+			continue
+		}
+
+		value, ok := values[placeholder]
+		if !ok {
+			var err error
+			if value, err = lookup(placeholder); err != nil {
+				return "", fmt.Errorf("Couldn't find a value for %s in the agent name %q: %w", placeholder, name, err)
+			}
+			values[placeholder] = value
+		}
+
+		b.WriteString(value)
+		i += len(placeholder)
+	}
+
+	return b.String(), nil
+}
+
+// queueFromTags returns the queue in the agent's tags, which is "default" if
+// it doesn't have one
+func queueFromTags(tags []string) string {
+	for _, tag := range tags {
+		if k, v, ok := strings.Cut(tag, "="); ok && strings.TrimSpace(k) == "queue" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return "default"
+}
+
+// cloudInstanceID returns the ID of the EC2 or GCE instance the agent is on
+func cloudInstanceID() (string, error) {
+	if c, err := newAWSClient(); err == nil && c.Available() {
+		return c.GetMetadata("instance-id")
+	}
+	if metadata.OnGCE() {
+		return metadata.InstanceID()
+	}
+	return "", errors.New("The agent isn't running on EC2 or GCE")
+}
+
+// cloudZone returns the EC2 availability zone or GCE zone the agent is in
+func cloudZone() (string, error) {
+	if c, err := newAWSClient(); err == nil && c.Available() {
+		return c.GetMetadata("placement/availability-zone")
+	}
+	if metadata.OnGCE() {
+		return metadata.Zone()
+	}
+	return "", errors.New("The agent isn't running on EC2 or GCE")
+}
+
+// Where container IDs turn up in the agent's cgroups, or with cgroups v2, in
+// the mounts the container runtime makes for it
+var containerIDPatterns = map[string]*regexp.Regexp{
+	"/proc/self/cgroup":    regexp.MustCompile(`([0-9a-f]{64})`),
+	"/proc/self/mountinfo": regexp.MustCompile(`/containers/([0-9a-f]{64})/`),
+}
+
+// containerID returns the short ID of the container the agent is running in
+func containerID() (string, error) {
+	for _, path := range []string{"/proc/self/cgroup", "/proc/self/mountinfo"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		id := findContainerID(f, containerIDPatterns[path])
+		f.Close()
+
+		if id != "" {
+			return id, nil
+		}
+	}
+	return "", errors.New("The agent isn't running in a container")
+}
+
+// findContainerID returns the short ID of the first container ID that the
+// pattern finds in r
+func findContainerID(r io.Reader, pattern *regexp.Regexp) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if m := pattern.FindStringSubmatch(scanner.Text()); m != nil {
+			return m[1][:12]
+		}
+	}
+	return ""
+}
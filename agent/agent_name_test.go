@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandAgentName(t *testing.T) {
+	t.Parallel()
+
+	lookups := map[string]int{}
+	lookup := func(placeholder string) (string, error) {
+		lookups[placeholder]++
+		switch placeholder {
+		case "%instance-id":
+			return "i-1234", nil
+		case "%zone":
+			return "us-east-1a", nil
+		case "%container-id":
+			return "", errors.New("not in a container")
+		}
+		return strings.TrimPrefix(placeholder, "%"), nil
+	}
+
+	name, err := expandAgentName("%queue-%instance-id-%zone-%spawn-%instance-id", lookup)
+	require.NoError(t, err)
+	assert.Equal(t, "queue-i-1234-us-east-1a-spawn-i-1234", name)
+	assert.Equal(t, 1, lookups["%instance-id"])
+
+	name, err = expandAgentName("100% agent", lookup)
+	require.NoError(t, err)
+	assert.Equal(t, "100% agent", name)
+
+	// Unknown placeholders are left as they are
+	name, err = expandAgentName("agent-%instance-%n", lookup)
+	require.NoError(t, err)
+	assert.Equal(t, "agent-%instance-%n", name)
+
+	_, err = expandAgentName("agent-%container-id", lookup)
+	assert.EqualError(t, err, `Couldn't find a value for %container-id in the agent name "agent-%container-id": not in a container`)
+}
+
+func TestExpandAgentNameForEachSpawn(t *testing.T) {
+	t.Parallel()
+
+	first, err := ExpandAgentName("agent-%spawn-%random-%queue", []string{"queue=deploy"}, 1)
+	require.NoError(t, err)
+	second, err := ExpandAgentName("agent-%spawn-%random-%queue", []string{"queue=deploy"}, 2)
+	require.NoError(t, err)
+
+	assert.Regexp(t, `^agent-1-[0-9a-f]{8}-deploy$`, first)
+	assert.Regexp(t, `^agent-2-[0-9a-f]{8}-deploy$`, second)
+	assert.NotEqual(t, first[len("agent-1-"):], second[len("agent-2-"):])
+}
+
+func TestQueueFromTags(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "default", queueFromTags(nil))
+	assert.Equal(t, "default", queueFromTags([]string{"os=linux"}))
+	assert.Equal(t, "deploy", queueFromTags([]string{"os=linux", "queue = deploy"}))
+}
+
+func TestFindContainerID(t *testing.T) {
+	t.Parallel()
+
+	id := strings.Repeat("0123456789abcdef", 4)
+
+	cgroup := "12:pids:/docker/" + id + "\n0::/\n"
+	assert.Equal(t, "0123456789ab", findContainerID(strings.NewReader(cgroup), containerIDPatterns["/proc/self/cgroup"]))
+
+	mountinfo := "600 500 0:50 / / rw - overlay overlay rw,lowerdir=/var/lib/docker/overlay2/" + strings.Repeat("f", 64) + "/diff\n" +
+		"610 600 254:1 /var/lib/docker/containers/" + id + "/hostname /etc/hostname rw - ext4 /dev/vda1 rw\n"
+	assert.Equal(t, "0123456789ab", findContainerID(strings.NewReader(mountinfo), containerIDPatterns["/proc/self/mountinfo"]))
+
+	assert.Equal(t, "", findContainerID(strings.NewReader("0::/init.scope\n"), containerIDPatterns["/proc/self/cgroup"]))
+}
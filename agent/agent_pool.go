@@ -1,12 +1,53 @@
 package agent
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"sync"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
 )
 
 // AgentPool manages multiple parallel AgentWorkers
 type AgentPool struct {
-	workers []*AgentWorker
+	// The workers, which can change while the pool runs when the spawn count
+	// is reloaded
+	workersMutex sync.Mutex
+	workers      []*AgentWorker
+
+	// What the workers share, which workers spawned once the pool has
+	// started are given too
+	idleMonitor        *IdleMonitor
+	maintenance        *maintenanceScheduler
+	maintenanceWindows []*MaintenanceWindow
+	readinessChecks    []ReadinessCheck
+	gpus               *GPUAllocator
+	transfers          *TransferScheduler
+
+	// The first error from the workers, closed once they've all stopped,
+	// and how many are still running
+	started bool
+	errs    chan error
+	running int
+
+	// The workers whose registrations have been handed over to a new agent,
+	// which stop without disconnecting
+	handoverMutex sync.Mutex
+	handedOver    map[*AgentWorker]bool
+
+	// Whether the pool has been asked to stop gracefully, however it was
+	// asked, so another drain escalates to canceling jobs, and whether it's
+	// been asked to stop at all
+	stopMutex sync.Mutex
+	draining  bool
+	stopped   bool
+
+	// Registers agents when the spawn count goes up, and makes sure only
+	// one reload runs at a time
+	reloadMutex sync.Mutex
+	spawner     func(index int) (*AgentWorker, error)
 }
 
 // NewAgentPool returns a new AgentPool
@@ -18,32 +59,160 @@ func NewAgentPool(workers []*AgentWorker) *AgentPool {
 
 // Start kicks off the parallel AgentWorkers and waits for them to finish
 func (r *AgentPool) Start() error {
-	var wg sync.WaitGroup
-	var spawn int = len(r.workers)
-	var errs = make(chan error, spawn)
+	workers := r.Workers()
+
+	// Run maintenance tasks when none of the workers are running jobs
+	var maintenance *maintenanceScheduler
+	if len(workers) > 0 {
+		conf := workers[0].agentConfiguration
+		if len(conf.MaintenanceTasks) > 0 && conf.AcquireJob == "" {
+			tasks, err := ParseMaintenanceTasks(conf.MaintenanceTasks)
+			if err != nil {
+				return err
+			}
+
+			maintenance = newMaintenanceScheduler(workers[0].logger, conf.HooksPath, tasks)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go maintenance.Run(ctx)
+		}
+	}
+
+	// Stop accepting jobs in maintenance windows
+	var maintenanceWindows []*MaintenanceWindow
+	if len(workers) > 0 {
+		conf := workers[0].agentConfiguration
+		if len(conf.MaintenanceWindows) > 0 && conf.AcquireJob == "" {
+			windows, err := ParseMaintenanceWindows(conf.MaintenanceWindows, conf.MaintenanceTimezone)
+			if err != nil {
+				return err
+			}
+
+			maintenanceWindows = windows
+		}
+	}
+
+	// Check the host is ready before accepting each job
+	var readinessChecks []ReadinessCheck
+	if len(workers) > 0 {
+		checks, err := ParseReadinessChecks(workers[0].agentConfiguration.ReadinessChecks)
+		if err != nil {
+			return err
+		}
+
+		readinessChecks = checks
+	}
+
+	// Give each job its own GPUs, locked across the agents on the host
+	var gpus *GPUAllocator
+	if len(workers) > 0 {
+		conf := workers[0].agentConfiguration
+		if conf.GPUsPerJob > 0 && conf.AcquireJob == "" {
+			allocator, err := NewGPUAllocator(filepath.Join(os.TempDir(), "buildkite-agent-gpus"), conf.GPUs, conf.GPUsPerJob)
+			if err != nil {
+				return err
+			}
+
+			gpus = allocator
+		}
+	}
+
+	// Share transfer slots between the workers and the jobs they run
+	var transfers *TransferScheduler
+	if len(workers) > 0 {
+		conf := workers[0].agentConfiguration
+		if conf.TransferConcurrency > 0 {
+			dir, err := os.MkdirTemp("", "buildkite-transfers-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+
+			transfers = NewTransferScheduler(dir, conf.TransferConcurrency, conf.TransferBandwidth)
+		}
+	}
+
+	r.workersMutex.Lock()
+
+	r.maintenance = maintenance
+	r.maintenanceWindows = maintenanceWindows
+	r.readinessChecks = readinessChecks
+	r.gpus = gpus
+	r.transfers = transfers
 
 	// Co-ordinate idle state across agents
-	idleMonitor := NewIdleMonitor(len(r.workers))
+	r.idleMonitor = NewIdleMonitor(len(r.workers))
 
 	// Spawn goroutines for each parallel worker
+	r.started = true
+	r.errs = make(chan error, 1)
+	errs := r.errs
+	if len(r.workers) == 0 {
+		close(errs)
+	}
 	for _, worker := range r.workers {
-		wg.Add(1)
+		r.startWorker(worker)
+	}
 
-		go func(worker *AgentWorker) {
-			defer wg.Done()
+	r.workersMutex.Unlock()
 
-			if err := r.runWorker(worker, idleMonitor); err != nil {
-				errs <- err
-			}
-		}(worker)
-	}
+	return <-errs
+}
+
+// startWorker gives a worker what the pool's workers share and runs it. The
+// pool's workers mutex must be held.
+func (r *AgentPool) startWorker(worker *AgentWorker) {
+	worker.maintenance = r.maintenance
+	worker.maintenanceWindows = r.maintenanceWindows
+	worker.readinessChecks = r.readinessChecks
+	worker.gpus = r.gpus
+	worker.transfers = r.transfers
+
+	r.running++
 
 	go func() {
-		wg.Wait()
-		close(errs)
+		if err := r.runWorker(worker, r.idleMonitor); err != nil {
+			// Only the first error is returned from Start
+			select {
+			case r.errs <- err:
+			default:
+			}
+		}
+
+		r.workersMutex.Lock()
+		defer r.workersMutex.Unlock()
+
+		r.removeWorker(worker)
+		r.running--
+		if r.running == 0 {
+			close(r.errs)
+		}
 	}()
+}
 
-	return <-errs
+// removeWorker takes a worker that's stopped out of the pool. The pool's
+// workers mutex must be held.
+func (r *AgentPool) removeWorker(worker *AgentWorker) {
+	for i, w := range r.workers {
+		if w == worker {
+			r.workers = append(r.workers[:i:i], r.workers[i+1:]...)
+			break
+		}
+	}
+
+	if worker.agent != nil {
+		r.idleMonitor.MarkBusy(worker.agent.UUID)
+	}
+	r.idleMonitor.SetTotalAgents(len(r.workers))
+}
+
+// Workers returns the pool's workers
+func (r *AgentPool) Workers() []*AgentWorker {
+	r.workersMutex.Lock()
+	defer r.workersMutex.Unlock()
+
+	return append([]*AgentWorker(nil), r.workers...)
 }
 
 func (r *AgentPool) runWorker(worker *AgentWorker, im *IdleMonitor) error {
@@ -51,15 +220,148 @@ func (r *AgentPool) runWorker(worker *AgentWorker, im *IdleMonitor) error {
 	if err := worker.Connect(); err != nil {
 		return err
 	}
-	// Ensure the worker is disconnected at the end of this function.
-	defer worker.Disconnect()
+	// Ensure the worker is disconnected at the end of this function, unless
+	// another agent has taken over its registration
+	defer func() {
+		if !r.isHandedOver(worker) {
+			worker.Disconnect()
+		}
+	}()
 
 	// Starts the agent worker and wait for it to finish.
 	return worker.Start(im)
 }
 
 func (r *AgentPool) Stop(graceful bool) {
-	for _, worker := range r.workers {
+	r.stopMutex.Lock()
+	r.stopped = true
+	if graceful {
+		r.draining = true
+	}
+	r.stopMutex.Unlock()
+
+	for _, worker := range r.Workers() {
 		worker.Stop(graceful)
 	}
 }
+
+// HandleSignal does what a signal's action asks of the pool's workers. The
+// second drain cancels running jobs, whether the first came from a signal, the
+// control socket or a handover.
+func (r *AgentPool) HandleSignal(l logger.Logger, action SignalAction) {
+	switch action {
+	case SignalActionCancel:
+		l.Info("Canceling running jobs and stopping the agent(s)")
+		r.Stop(false)
+
+	case SignalActionDrain:
+		r.stopMutex.Lock()
+		draining := r.draining
+		r.stopMutex.Unlock()
+
+		if draining {
+			l.Info("Forcefully stopping running jobs and stopping the agent(s)")
+			r.Stop(false)
+		} else {
+			l.Info("Stopping the agent(s) once running jobs finish, send again to forcefully kill the agent(s)")
+			r.Stop(true)
+		}
+
+	case SignalActionDump:
+		for _, worker := range r.Workers() {
+			worker.logState()
+		}
+	}
+}
+
+// RunningJobs returns the jobs being run by the pool's workers
+func (r *AgentPool) RunningJobs() []RunningJob {
+	jobs := []RunningJob{}
+
+	for _, worker := range r.Workers() {
+		if job := worker.RunningJob(); job != nil {
+			jobs = append(jobs, RunningJob{
+				Agent:     worker.agent.Name,
+				ID:        job.ID,
+				Pipeline:  job.Env["BUILDKITE_PIPELINE_SLUG"],
+				Label:     job.Env["BUILDKITE_LABEL"],
+				StartedAt: job.StartedAt,
+			})
+		}
+	}
+
+	return jobs
+}
+
+// CancelJob cancels the job with the given ID, returning false if none of the
+// pool's workers are running it
+func (r *AgentPool) CancelJob(jobID string) bool {
+	for _, worker := range r.Workers() {
+		if worker.CancelJob(jobID) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetScheduling changes the priority and weight the pool's workers report to
+// Buildkite
+func (r *AgentPool) SetScheduling(req ControlSchedulingRequest) {
+	for _, worker := range r.Workers() {
+		worker.SetScheduling(req)
+	}
+}
+
+// SetLogLevel changes the log level of the pool's workers and the jobs they run
+func (r *AgentPool) SetLogLevel(level logger.Level) {
+	for _, worker := range r.Workers() {
+		worker.logger.SetLevel(level)
+	}
+}
+
+// Registrations returns the registrations of up to n of the pool's workers,
+// for handing over to a new agent
+func (r *AgentPool) Registrations(n int) []*api.AgentRegisterResponse {
+	registrations := []*api.AgentRegisterResponse{}
+
+	for _, worker := range r.Workers() {
+		if len(registrations) >= n {
+			break
+		}
+		registrations = append(registrations, worker.agent)
+	}
+
+	return registrations
+}
+
+// HandOver stops the pool once running jobs have finished, leaving the first
+// n workers connected because a new agent has taken over their registrations
+func (r *AgentPool) HandOver(n int) {
+	r.handoverMutex.Lock()
+	if r.handedOver == nil {
+		r.handedOver = map[*AgentWorker]bool{}
+	}
+	for i, worker := range r.Workers() {
+		if i < n {
+			r.handedOver[worker] = true
+		}
+	}
+	r.handoverMutex.Unlock()
+
+	r.Stop(true)
+}
+
+// HandedOver returns whether the pool has handed over to a new agent
+func (r *AgentPool) HandedOver() bool {
+	r.handoverMutex.Lock()
+	defer r.handoverMutex.Unlock()
+
+	return r.handedOver != nil
+}
+
+func (r *AgentPool) isHandedOver(worker *AgentWorker) bool {
+	r.handoverMutex.Lock()
+	defer r.handoverMutex.Unlock()
+
+	return r.handedOver[worker]
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// ReloadConfig is the settings that can change while the pool is running,
+// when the agent's configuration is loaded again. Settings that are nil, or a
+// spawn count of zero, are left alone.
+type ReloadConfig struct {
+	// The tags to report to Buildkite from the next ping
+	Tags []string
+
+	// The priority to report to Buildkite from the next ping
+	Priority *int
+
+	// The log level of the workers and the jobs they run
+	LogLevel *logger.Level
+
+	// How many workers to run. Extra workers stop once their jobs finish.
+	Spawn int
+}
+
+// SetSpawner sets how the pool registers workers when the spawn count goes
+// up, which can't happen without one
+func (r *AgentPool) SetSpawner(spawner func(index int) (*AgentWorker, error)) {
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+
+	r.spawner = spawner
+}
+
+// Reload applies settings from the agent's reloaded configuration to the
+// pool's workers, without stopping running jobs
+func (r *AgentPool) Reload(l logger.Logger, conf ReloadConfig) error {
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+
+	if conf.LogLevel != nil {
+		r.SetLogLevel(*conf.LogLevel)
+	}
+
+	if conf.Tags != nil {
+		for _, worker := range r.Workers() {
+			worker.SetTags(conf.Tags)
+		}
+	}
+
+	if conf.Priority != nil {
+		r.SetScheduling(ControlSchedulingRequest{Priority: conf.Priority})
+	}
+
+	if conf.Spawn > 0 {
+		return r.scale(l, conf.Spawn)
+	}
+
+	return nil
+}
+
+// scale spawns or stops workers until there are the given number of them.
+// Workers that are stopped finish their jobs first, and the workers with the
+// highest spawn indexes are stopped first.
+func (r *AgentPool) scale(l logger.Logger, spawn int) error {
+	if r.isStopped() {
+		return errors.New("The agent is stopping, so the spawn count can't change")
+	}
+
+	r.workersMutex.Lock()
+	started := r.started
+	var active []*AgentWorker
+	used := map[int]bool{}
+	for _, worker := range r.workers {
+		used[worker.spawnIndex] = true
+		if !worker.isStopping() {
+			active = append(active, worker)
+		}
+	}
+	r.workersMutex.Unlock()
+
+	if !started {
+		return errors.New("The agents haven't started yet, so the spawn count can't change")
+	}
+
+	// Stop the extra workers, from the last one spawned
+	sort.Slice(active, func(i, j int) bool { return active[i].spawnIndex < active[j].spawnIndex })
+	for len(active) > spawn {
+		worker := active[len(active)-1]
+		active = active[:len(active)-1]
+
+		l.Info("Stopping agent %s once its job finishes, to spawn %d agent(s)", worker.agent.Name, spawn)
+		worker.Stop(true)
+	}
+
+	if len(active) < spawn && r.spawner == nil {
+		return fmt.Errorf("Spawning more agents isn't supported, so there are still %d agent(s)", len(active))
+	}
+
+	// Spawn the missing workers, reusing the lowest free spawn indexes
+	for index := 1; len(active) < spawn; index++ {
+		if used[index] {
+			continue
+		}
+
+		worker, err := r.spawner(index)
+		if err != nil {
+			return fmt.Errorf("Failed to spawn agent %d: %v", index, err)
+		}
+		used[index] = true
+		active = append(active, worker)
+
+		// The pool could have been stopped while the worker registered,
+		// in which case it's disconnected without running
+		r.workersMutex.Lock()
+		if r.running == 0 || r.isStopped() {
+			r.workersMutex.Unlock()
+			worker.Disconnect()
+			return errors.New("The agent stopped while spawning agents")
+		}
+		r.workers = append(r.workers, worker)
+		r.idleMonitor.SetTotalAgents(len(r.workers))
+		r.startWorker(worker)
+		r.workersMutex.Unlock()
+	}
+
+	return nil
+}
+
+func (r *AgentPool) isStopped() bool {
+	r.stopMutex.Lock()
+	defer r.stopMutex.Unlock()
+
+	return r.stopped
+}
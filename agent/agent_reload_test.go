@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"io"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newReloadTestPool(spawn int) *AgentPool {
+	var workers []*AgentWorker
+	for i := 1; i <= spawn; i++ {
+		l := logger.NewConsoleLogger(logger.NewTextPrinter(io.Discard), func(int) {})
+		l.SetLevel(logger.NOTICE)
+
+		workers = append(workers, &AgentWorker{
+			logger:          l,
+			agent:           &api.AgentRegisterResponse{Name: "llama"},
+			stop:            make(chan struct{}),
+			spawnIndex:      i,
+			registerRequest: api.AgentRegisterRequest{Tags: []string{"queue=default"}},
+		})
+	}
+	return NewAgentPool(workers)
+}
+
+func TestAgentPoolReload(t *testing.T) {
+	t.Parallel()
+
+	pool := newReloadTestPool(3)
+	pool.started = true
+	pool.idleMonitor = NewIdleMonitor(3)
+
+	priority := 5
+	level := logger.INFO
+	require.NoError(t, pool.Reload(logger.Discard, ReloadConfig{
+		Tags:     []string{"queue=deploy", "os=linux"},
+		Priority: &priority,
+		LogLevel: &level,
+		Spawn:    1,
+	}))
+
+	for _, worker := range pool.workers {
+		opts := worker.pingOptions()
+		assert.Equal(t, []string{"queue=deploy", "os=linux"}, opts.Tags)
+		assert.Equal(t, "5", opts.Priority)
+		assert.Equal(t, []string{"queue=deploy", "os=linux"}, worker.registerRequest.Tags)
+		assert.Equal(t, logger.INFO, worker.logger.Level())
+	}
+
+	// The agents spawned last are stopped once their jobs finish
+	assert.False(t, pool.workers[0].isStopping())
+	assert.True(t, pool.workers[1].isStopping())
+	assert.True(t, pool.workers[2].isStopping())
+
+	err := pool.Reload(logger.Discard, ReloadConfig{Spawn: 2})
+	assert.EqualError(t, err, "Spawning more agents isn't supported, so there are still 1 agent(s)")
+}
+
+func TestAgentPoolReloadSpawnNeedsStartedPool(t *testing.T) {
+	t.Parallel()
+
+	pool := newReloadTestPool(2)
+	err := pool.Reload(logger.Discard, ReloadConfig{Spawn: 1})
+	assert.EqualError(t, err, "The agents haven't started yet, so the spawn count can't change")
+
+	pool.Stop(true)
+	err = pool.Reload(logger.Discard, ReloadConfig{Spawn: 1})
+	assert.EqualError(t, err, "The agent is stopping, so the spawn count can't change")
+}
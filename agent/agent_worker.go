@@ -2,8 +2,10 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
@@ -12,7 +14,7 @@ import (
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/metrics"
 	"github.com/buildkite/agent/v3/process"
-	"github.com/buildkite/roko"
+	"github.com/buildkite/agent/v3/retry"
 )
 
 type AgentWorkerConfig struct {
@@ -30,6 +32,10 @@ type AgentWorkerConfig struct {
 
 	// The configuration of the agent from the CLI
 	AgentConfiguration AgentConfiguration
+
+	// The request the agent was registered with, used to register it again
+	// if its session is revoked
+	RegisterRequest api.AgentRegisterRequest
 }
 
 type agentStats struct {
@@ -42,12 +48,52 @@ type agentStats struct {
 	lastHeartbeatError error
 }
 
+// agentScheduling is the priority, weight and tags an agent has been given
+// since it registered, which it reports to Buildkite when it pings
+type agentScheduling struct {
+	sync.Mutex
+	priority string
+	weight   int
+	tags     []string
+}
+
 type AgentWorker struct {
 	stats agentStats
 
+	// Changes to the agent's priority, weight and tags made while it's
+	// running
+	scheduling agentScheduling
+
+	// Runs maintenance tasks between jobs, shared by the agent's workers
+	maintenance *maintenanceScheduler
+
+	// When the agent doesn't accept jobs, and when the maintenance window
+	// it's in ends, if it's in one
+	maintenanceWindows   []*MaintenanceWindow
+	maintenanceWindowEnd time.Time
+
+	// What the host has to pass before the agent accepts a job
+	readinessChecks []ReadinessCheck
+
+	// Limits artifact and log transfers, shared by the agent's workers
+	transfers *TransferScheduler
+
+	// Gives jobs their own GPUs, shared by the agent's workers, and the GPUs
+	// this worker has for its next job
+	gpus          *GPUAllocator
+	gpuAllocation *GPUAllocation
+
+	// Keeps the results of jobs that couldn't be sent to Buildkite, or nil
+	spool *resultSpool
+
 	// The API Client used when this agent is communicating with the API
 	apiClient APIClient
 
+	// The API Client with the registration token, and the request the agent
+	// was registered with, for registering again
+	registerClient  APIClient
+	registerRequest api.AgentRegisterRequest
+
 	// The logger instance to use
 	logger logger.Logger
 
@@ -83,21 +129,49 @@ type AgentWorker struct {
 	// When this worker runs a job, we'll store an instance of the
 	// JobRunner here
 	jobRunner *JobRunner
+
+	// Checks API responses for a skewed system clock
+	clockSkew *ClockSkewMonitor
+
+	// The pipelines this agent has built recently, which it prefers jobs
+	// from. Nil unless cache affinity is enabled.
+	recentPipelines *recentPipelines
 }
 
 // Creates the agent worker and initializes its API Client
 func NewAgentWorker(l logger.Logger, a *api.AgentRegisterResponse, m *metrics.Collector, apiClient APIClient, c AgentWorkerConfig) *AgentWorker {
+	var clockSkewMetrics *metrics.Scope
+	if m != nil {
+		clockSkewMetrics = m.Scope(metrics.Tags{"agent_name": a.Name})
+	}
+
+	var recent *recentPipelines
+	if n := c.AgentConfiguration.CacheAffinity; n > 0 {
+		recent = newRecentPipelines(n, filepath.Join(c.AgentConfiguration.BuildPath, dirForAgentName(a.Name)))
+	}
+
+	var spool *resultSpool
+	if path := c.AgentConfiguration.SpoolPath; path != "" {
+		spool = newResultSpool(l, path, a.UUID, c.AgentConfiguration.SpoolMaxAge, c.AgentConfiguration.SpoolMaxSize)
+	}
+
 	return &AgentWorker{
 		logger:             l,
 		agent:              a,
 		metricsCollector:   m,
 		apiClient:          apiClient.FromAgentRegisterResponse(a),
+		registerClient:     apiClient,
+		registerRequest:    c.RegisterRequest,
 		debug:              c.Debug,
 		debugHTTP:          c.DebugHTTP,
 		agentConfiguration: c.AgentConfiguration,
 		stop:               make(chan struct{}),
 		cancelSig:          c.CancelSignal,
 		spawnIndex:         c.SpawnIndex,
+		clockSkew: NewClockSkewMonitor(l, clockSkewMetrics,
+			time.Duration(c.AgentConfiguration.ClockSkewThreshold)*time.Second),
+		recentPipelines: recent,
+		spool:           spool,
 	}
 }
 
@@ -117,22 +191,12 @@ func (a *AgentWorker) Start(idleMonitor *IdleMonitor) error {
 	heartbeatCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Register our worker specific health check handler
-	http.HandleFunc("/agent/"+strconv.Itoa(a.spawnIndex), func(w http.ResponseWriter, r *http.Request) {
-		a.stats.Lock()
-		defer a.stats.Unlock()
-
-		if a.stats.lastHeartbeatError != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "ERROR: last heartbeat failed: %v. last successful was %v ago", a.stats.lastHeartbeatError, time.Since(a.stats.lastHeartbeat))
-		} else {
-			if a.stats.lastHeartbeat.IsZero() {
-				fmt.Fprintf(w, "OK: no heartbeat yet")
-			} else {
-				fmt.Fprintf(w, "OK: last heartbeat successful %v ago", time.Since(a.stats.lastHeartbeat))
-			}
-		}
-	})
+	// Register our worker specific health check handler. It's only served if
+	// there's a health check server, and registering it twice panics, which
+	// could happen when the agent is embedded and run more than once.
+	if a.agentConfiguration.HealthCheckAddr != "" {
+		a.registerHealthCheckHandler()
+	}
 
 	// Setup and start the heartbeater
 	heartbeatInterval := time.Second * time.Duration(a.agent.HeartbeatInterval)
@@ -144,11 +208,12 @@ func (a *AgentWorker) Start(idleMonitor *IdleMonitor) error {
 				if err != nil {
 					// Get the last heartbeat time to the nearest microsecond
 					a.stats.Lock()
+					l := a.logger.WithFields(logger.EventField(logger.EventAgentHeartbeatFailed))
 					if a.stats.lastHeartbeat.IsZero() {
-						a.logger.Error("Failed to heartbeat %s. Will try again in %s. (No heartbeat yet)",
+						l.Error("Failed to heartbeat %s. Will try again in %s. (No heartbeat yet)",
 							err, heartbeatInterval)
 					} else {
-						a.logger.Error("Failed to heartbeat %s. Will try again in %s. (Last successful was %v ago)",
+						l.Error("Failed to heartbeat %s. Will try again in %s. (Last successful was %v ago)",
 							err, heartbeatInterval, time.Since(a.stats.lastHeartbeat))
 					}
 					a.stats.Unlock()
@@ -176,6 +241,26 @@ func (a *AgentWorker) Start(idleMonitor *IdleMonitor) error {
 	}
 }
 
+// registerHealthCheckHandler adds a handler to the health check server that
+// reports whether the agent's heartbeats are working
+func (a *AgentWorker) registerHealthCheckHandler() {
+	http.HandleFunc("/agent/"+strconv.Itoa(a.spawnIndex), func(w http.ResponseWriter, r *http.Request) {
+		a.stats.Lock()
+		defer a.stats.Unlock()
+
+		if a.stats.lastHeartbeatError != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "ERROR: last heartbeat failed: %v. last successful was %v ago", a.stats.lastHeartbeatError, time.Since(a.stats.lastHeartbeat))
+		} else {
+			if a.stats.lastHeartbeat.IsZero() {
+				fmt.Fprintf(w, "OK: no heartbeat yet")
+			} else {
+				fmt.Fprintf(w, "OK: last heartbeat successful %v ago", time.Since(a.stats.lastHeartbeat))
+			}
+		}
+	})
+}
+
 func (a *AgentWorker) startPingLoop(idleMonitor *IdleMonitor) error {
 	// Create the ticker
 	pingInterval := time.Second * time.Duration(a.agent.PingInterval)
@@ -185,11 +270,33 @@ func (a *AgentWorker) startPingLoop(idleMonitor *IdleMonitor) error {
 	lastActionTime := time.Now()
 	a.logger.Info("Waiting for work...")
 
+	defer a.releaseGPUs()
+
 	// Continue this loop until the closing of the stop channel signals termination
 	for {
-		if !a.stopping {
+		// Workers don't look for jobs in maintenance windows, without GPUs
+		// free to run them on, or while maintenance is waiting to run
+		if a.inMaintenanceWindow() {
+			// The agent wasn't idle, it was refusing jobs
+			lastActionTime = time.Now()
+		} else if !a.stopping && a.allocateGPUs() && a.maintenance.acquire() {
+			// Buildkite won't give the agent more work until the jobs it
+			// has spooled are finished
+			if a.spool != nil {
+				a.spool.Deliver(a.apiClient)
+			}
+
 			job, err := a.Ping()
-			if err != nil {
+			if job == nil {
+				a.maintenance.release(false)
+			}
+
+			var revoked *sessionRevokedError
+			if errors.As(err, &revoked) {
+				if err := a.Reregister(revoked); err != nil {
+					return err
+				}
+			} else if err != nil {
 				a.logger.Warn("%v", err)
 			} else if job != nil {
 				// Let other agents know this agent is now busy and
@@ -197,7 +304,11 @@ func (a *AgentWorker) startPingLoop(idleMonitor *IdleMonitor) error {
 				idleMonitor.MarkBusy(a.agent.UUID)
 
 				// Runs the job, only errors if something goes wrong
-				if runErr := a.AcceptAndRunJob(job); runErr != nil {
+				runErr := a.AcceptAndRunJob(job)
+				a.releaseGPUs()
+				a.maintenance.release(runErr == nil)
+
+				if runErr != nil {
 					a.logger.Error("%v", runErr)
 				} else {
 					if a.agentConfiguration.DisconnectAfterJob {
@@ -252,6 +363,43 @@ func (a *AgentWorker) startPingLoop(idleMonitor *IdleMonitor) error {
 	}
 }
 
+// allocateGPUs gives the worker GPUs for its next job, if jobs get their own,
+// returning false if there aren't enough free. The worker keeps them until
+// it's run a job on them.
+func (a *AgentWorker) allocateGPUs() bool {
+	if a.gpus == nil || a.gpuAllocation != nil {
+		return true
+	}
+
+	allocation, err := a.gpus.tryAllocate()
+	if err != nil {
+		a.logger.Warn("%v", err)
+	}
+	a.gpuAllocation = allocation
+	return allocation != nil
+}
+
+// releaseGPUs frees the GPUs the worker was given for a job
+func (a *AgentWorker) releaseGPUs() {
+	a.gpuAllocation.Release()
+	a.gpuAllocation = nil
+}
+
+// inMaintenanceWindow returns whether the agent is in one of its maintenance
+// windows, logging when it starts and stops accepting jobs because of them
+func (a *AgentWorker) inMaintenanceWindow() bool {
+	end, ok := maintenanceWindowEnd(a.maintenanceWindows, time.Now())
+	switch {
+	case ok && !end.Equal(a.maintenanceWindowEnd):
+		a.logger.Info("In a maintenance window until %s, not accepting jobs", end.Format(time.RFC3339))
+	case !ok && !a.maintenanceWindowEnd.IsZero():
+		a.logger.Info("The maintenance window has ended, waiting for work...")
+	}
+
+	a.maintenanceWindowEnd = end
+	return ok
+}
+
 // Stops the agent from accepting new work and cancels any current work it's
 // running
 func (a *AgentWorker) Stop(graceful bool) {
@@ -303,21 +451,100 @@ func (a *AgentWorker) Stop(graceful bool) {
 	a.stopping = true
 }
 
+// isStopping returns whether the agent has been asked to stop
+func (a *AgentWorker) isStopping() bool {
+	a.stopMutex.Lock()
+	defer a.stopMutex.Unlock()
+
+	return a.stopping
+}
+
+// logState logs what the worker is doing, for working out why an agent is
+// stuck without stopping it
+func (a *AgentWorker) logState() {
+	a.stopMutex.Lock()
+	stopping := a.stopping
+	a.stopMutex.Unlock()
+
+	job := a.RunningJob()
+
+	state := "idle"
+	if job != nil {
+		state = "running"
+	}
+	if stopping {
+		state = "stopping"
+	}
+
+	l := a.logger.WithFields(
+		logger.StringField("agent", a.agent.Name),
+		logger.StringField("state", state),
+	)
+
+	if job != nil {
+		l.WithFields(
+			logger.StringField("job", job.ID),
+			logger.StringField("pipeline", job.Env["BUILDKITE_PIPELINE_SLUG"]),
+			logger.StringField("started_at", job.StartedAt),
+		).Info("Running job %s", job.ID)
+		return
+	}
+
+	l.Info("Not running a job")
+}
+
+// RunningJob returns the job the agent is running, or nil if it's idle
+func (a *AgentWorker) RunningJob() *api.Job {
+	if jr := a.jobRunner; jr != nil {
+		return jr.job
+	}
+	return nil
+}
+
+// CancelJob cancels the job the agent is running, if it has the given ID.
+// It returns false if the agent isn't running that job.
+func (a *AgentWorker) CancelJob(jobID string) bool {
+	jr := a.jobRunner
+	if jr == nil || jr.job.ID != jobID {
+		return false
+	}
+
+	a.logger.Info("Canceling job %s from the control socket", jobID)
+
+	// Cancel blocks for the grace period, so don't hold up the caller
+	go func() {
+		if err := jr.Cancel(); err != nil {
+			a.logger.Error("Unexpected error canceling job (err: %s)", err)
+		}
+	}()
+
+	return true
+}
+
 // Connects the agent to the Buildkite Agent API, retrying up to 30 times if it
 // fails.
 func (a *AgentWorker) Connect() error {
 	a.logger.Info("Connecting to Buildkite...")
 
-	return roko.NewRetrier(
-		roko.WithMaxAttempts(10),
-		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).Do(func(r *roko.Retrier) error {
-		_, err := a.apiClient.Connect()
+	err := retry.NewRetrier(
+		retry.WithMaxAttempts(10),
+		retry.WithStrategy(retry.Constant(5*time.Second)),
+	).Do(func(r *retry.Retrier) error {
+		sent := time.Now()
+		resp, err := a.apiClient.Connect()
 		if err != nil {
 			a.logger.Warn("%s (%s)", err, r)
 		}
+		a.clockSkew.Observe(resp, sent, time.Now())
 		return err
 	})
+	if err != nil {
+		a.logger.WithFields(logger.EventField(logger.EventAgentConnectFailed)).Error("Failed to connect to Buildkite (%v)", err)
+	} else {
+		a.logger.WithFields(logger.EventField(logger.EventAgentConnected)).Info("Connected to Buildkite")
+	}
+
+	return err
 }
 
 // Performs a heatbeat
@@ -326,11 +553,14 @@ func (a *AgentWorker) Heartbeat() error {
 	var err error
 
 	// Retry the heartbeat a few times
-	err = roko.NewRetrier(
-		roko.WithMaxAttempts(10),
-		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).Do(func(r *roko.Retrier) error {
-		beat, _, err = a.apiClient.Heartbeat()
+	err = retry.NewRetrier(
+		retry.WithMaxAttempts(10),
+		retry.WithStrategy(retry.Constant(5*time.Second)),
+	).Do(func(r *retry.Retrier) error {
+		var resp *api.Response
+		sent := time.Now()
+		beat, resp, err = a.apiClient.Heartbeat()
+		a.clockSkew.Observe(resp, sent, time.Now())
 		if err != nil {
 			a.logger.Warn("%s (%s)", err, r)
 		}
@@ -356,8 +586,16 @@ func (a *AgentWorker) Heartbeat() error {
 // Performs a ping that checks Buildkite for a job or action to take
 // Returns a job, or nil if none is found
 func (a *AgentWorker) Ping() (*api.Job, error) {
-	ping, _, err := a.apiClient.Ping()
+	sent := time.Now()
+	ping, resp, err := a.apiClient.Ping(a.pingOptions())
+	a.clockSkew.Observe(resp, sent, time.Now())
 	if err != nil {
+		// Buildkite doesn't know who we are any more, so pinging again
+		// won't help
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil, &sessionRevokedError{err: err}
+		}
+
 		// Get the last ping time to the nearest microsecond
 		a.stats.Lock()
 		defer a.stats.Unlock()
@@ -382,7 +620,7 @@ func (a *AgentWorker) Ping() (*api.Job, error) {
 
 		// Before switching to the new one, do a ping test to make sure it's
 		// valid. If it is, switch and carry on, otherwise ignore the switch
-		newPing, _, err := newAPIClient.Ping()
+		newPing, _, err := newAPIClient.Ping(a.pingOptions())
 		if err != nil {
 			a.logger.Warn("Failed to ping the new endpoint %s - ignoring switch for now (%s)", ping.Endpoint, err)
 		} else {
@@ -412,6 +650,120 @@ func (a *AgentWorker) Ping() (*api.Job, error) {
 	return ping.Job, nil
 }
 
+// pingOptions returns what to tell Buildkite about the agent when pinging
+func (a *AgentWorker) pingOptions() *api.PingOptions {
+	a.scheduling.Lock()
+	defer a.scheduling.Unlock()
+
+	return &api.PingOptions{
+		RecentPipelines: a.recentPipelines.List(),
+		Priority:        a.scheduling.priority,
+		Weight:          a.scheduling.weight,
+		Tags:            a.scheduling.tags,
+	}
+}
+
+// SetScheduling changes the priority and weight the agent reports to
+// Buildkite, which take effect from the next ping. The registration request
+// is updated too, so they stick if the agent has to register again.
+func (a *AgentWorker) SetScheduling(req ControlSchedulingRequest) {
+	a.scheduling.Lock()
+	defer a.scheduling.Unlock()
+
+	if req.Priority != nil {
+		a.scheduling.priority = strconv.Itoa(*req.Priority)
+		a.registerRequest.Priority = a.scheduling.priority
+	}
+	if req.Weight != nil {
+		a.scheduling.weight = *req.Weight
+		a.registerRequest.Weight = a.scheduling.weight
+	}
+}
+
+// SetTags changes the tags the agent reports to Buildkite, which take effect
+// from the next ping, and that it registers with if it has to register again
+func (a *AgentWorker) SetTags(tags []string) {
+	a.scheduling.Lock()
+	defer a.scheduling.Unlock()
+
+	a.scheduling.tags = tags
+	a.registerRequest.Tags = tags
+}
+
+// sessionRevokedError is returned by Ping when Buildkite rejects the agent's
+// access token, which happens when the agent is deleted or its token is
+// revoked, rather than because of a network problem
+type sessionRevokedError struct {
+	err error
+}
+
+func (e *sessionRevokedError) Error() string {
+	return fmt.Sprintf("Buildkite rejected the agent's session: %v", e.err)
+}
+
+func (e *sessionRevokedError) Unwrap() error {
+	return e.err
+}
+
+// Reregister registers the agent with Buildkite again after its session has
+// been revoked, and switches over to the new session. It gives up after the
+// configured number of attempts, or straight away if re-registering is
+// disabled.
+func (a *AgentWorker) Reregister(revoked *sessionRevokedError) error {
+	// This is logged as an error with its own metric so it stands out from
+	// the warnings about failing to reach Buildkite
+	a.logger.WithFields(logger.EventField(logger.EventAgentSessionRevoked)).Error("The agent's session was revoked (%v)", revoked.err)
+	a.metrics.Count("agent.session_revoked", 1)
+
+	attempts := a.agentConfiguration.ReregisterAttempts
+	if attempts <= 0 || a.registerClient == nil {
+		return fmt.Errorf("%v, and re-registering is disabled", revoked)
+	}
+
+	a.logger.Info("Re-registering agent with Buildkite...")
+
+	// The priority and weight could be changed from the control socket, and
+	// the tags by reloading the configuration
+	a.scheduling.Lock()
+	req := a.registerRequest
+	a.scheduling.Unlock()
+
+	var registered *api.AgentRegisterResponse
+	err := retry.NewRetrier(
+		retry.WithMaxAttempts(attempts),
+		retry.WithStrategy(retry.Exponential(5*time.Second, time.Minute)),
+	).Do(func(r *retry.Retrier) error {
+		var resp *api.Response
+		var err error
+		registered, resp, err = a.registerClient.Register(&req)
+		if err != nil {
+			// The registration token has been revoked too
+			if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+				r.Break()
+			}
+			a.logger.Warn("Failed to re-register: %s (%s)", err, r)
+		}
+		return err
+	})
+	if err != nil {
+		a.metrics.Count("agent.reregister.failed", 1)
+		return fmt.Errorf("%v, and re-registering failed: %v", revoked, err)
+	}
+
+	client := a.registerClient.FromAgentRegisterResponse(registered)
+	if _, err := client.Connect(); err != nil {
+		a.metrics.Count("agent.reregister.failed", 1)
+		return fmt.Errorf("%v, and connecting after re-registering failed: %v", revoked, err)
+	}
+
+	a.logger.Info("Re-registered agent \"%s\" (was %s, now %s)", registered.Name, a.agent.UUID, registered.UUID)
+	a.metrics.Count("agent.reregister.success", 1)
+
+	a.apiClient = client
+	a.agent = registered
+	return nil
+}
+
 // Attempts to acquire a job and run it, only returns an error if something
 // goes wrong
 func (a *AgentWorker) AcquireAndRunJob(jobId string) error {
@@ -420,10 +772,10 @@ func (a *AgentWorker) AcquireAndRunJob(jobId string) error {
 	// Acquire the job using the ID we were provided. We'll retry as best
 	// we can on non 422 error.
 	var acquiredJob *api.Job
-	err := roko.NewRetrier(
-		roko.WithMaxAttempts(10),
-		roko.WithStrategy(roko.Constant(3*time.Second)),
-	).Do(func(r *roko.Retrier) error {
+	err := retry.NewRetrier(
+		retry.WithMaxAttempts(10),
+		retry.WithStrategy(retry.Constant(3*time.Second)),
+	).Do(func(r *retry.Retrier) error {
 		// If this agent has been asked to stop, don't even bother
 		// doing any retry checks and just bail.
 		if a.stopping {
@@ -454,6 +806,12 @@ func (a *AgentWorker) AcquireAndRunJob(jobId string) error {
 		return fmt.Errorf("Failed to acquire job: %v", err)
 	}
 
+	// An acquired job is already this agent's, so one that doesn't meet the
+	// filters can't be left for another agent, only not run
+	if ok, reason := a.acceptsJob(acquiredJob); !ok {
+		return fmt.Errorf("Not running acquired job %s because %s", acquiredJob.ID, reason)
+	}
+
 	// Now that we've acquired the job, lets' run it
 	return a.RunJob(acquiredJob)
 }
@@ -462,14 +820,34 @@ func (a *AgentWorker) AcquireAndRunJob(jobId string) error {
 func (a *AgentWorker) AcceptAndRunJob(job *api.Job) error {
 	a.logger.Info("Assigned job %s. Accepting...", job.ID)
 
+	// Jobs that don't meet the accept-jobs filters are left for another agent
+	if ok, reason := a.acceptsJob(job); !ok {
+		a.requeueJob(job, "filtered")
+		return fmt.Errorf("Refused job %s because %s", job.ID, reason)
+	}
+
+	// A host that isn't ready for jobs refuses them, rather than running
+	// them to fail
+	if err := a.waitUntilReady(job); err != nil {
+		a.requeueJob(job, "not_ready")
+		return fmt.Errorf("Refused job %s: %v", job.ID, err)
+	}
+
+	// The job-assigned hook gets a chance to refuse the job before it's
+	// accepted, which leaves it for Buildkite to give to another agent
+	if err := a.executeJobHook(jobAssignedHook, job, nil); err != nil {
+		a.requeueJob(job, "refused")
+		return fmt.Errorf("Refused job %s: %v", job.ID, err)
+	}
+
 	// Accept the job. We'll retry on connection related issues, but if
 	// Buildkite returns a 422 or 500 for example, we'll just bail out,
 	// re-ping, and try the whole process again.
 	var accepted *api.Job
-	err := roko.NewRetrier(
-		roko.WithMaxAttempts(30),
-		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).Do(func(r *roko.Retrier) error {
+	err := retry.NewRetrier(
+		retry.WithMaxAttempts(30),
+		retry.WithStrategy(retry.Constant(5*time.Second)),
+	).Do(func(r *retry.Retrier) error {
 		var err error
 		accepted, _, err = a.apiClient.AcceptJob(job)
 		if err != nil {
@@ -486,9 +864,14 @@ func (a *AgentWorker) AcceptAndRunJob(job *api.Job) error {
 
 	// If `accepted` is nil, then the job was never accepted
 	if accepted == nil {
+		a.requeueJob(job, "accept_failed")
 		return fmt.Errorf("Failed to accept job: %v", err)
 	}
 
+	if err := a.executeJobHook(jobAcceptedHook, accepted, nil); err != nil {
+		a.logger.Error("%v", err)
+	}
+
 	// Now that we've accepted the job, lets' run it
 	return a.RunJob(accepted)
 }
@@ -506,6 +889,9 @@ func (a *AgentWorker) RunJob(job *api.Job) error {
 		a.jobRunner = nil
 	}()
 
+	// Whatever happens, the job will have warmed up the pipeline's checkout
+	defer a.recentPipelines.Add(job.Env[`BUILDKITE_ORGANIZATION_SLUG`], job.Env[`BUILDKITE_PIPELINE_SLUG`])
+
 	// Now that we've got a job to do, we can start it.
 	var err error
 	a.jobRunner, err = NewJobRunner(a.logger, jobMetricsScope, a.agent, job, a.apiClient, JobRunnerConfig{
@@ -513,6 +899,9 @@ func (a *AgentWorker) RunJob(job *api.Job) error {
 		DebugHTTP:          a.debugHTTP,
 		CancelSignal:       a.cancelSig,
 		AgentConfiguration: a.agentConfiguration,
+		Transfers:          a.transfers,
+		GPUs:               a.gpuAllocation,
+		Spool:              a.spool,
 	})
 
 	// Was there an error creating the job runner?
@@ -535,7 +924,9 @@ func (a *AgentWorker) Disconnect() error {
 
 	_, err := a.apiClient.Disconnect()
 	if err != nil {
-		a.logger.Warn("There was an error sending the disconnect API call to Buildkite. If this agent still appears online, you may have to manually stop it (%s)", err)
+		a.logger.WithFields(logger.EventField(logger.EventAgentDisconnectFailed)).Warn("There was an error sending the disconnect API call to Buildkite. If this agent still appears online, you may have to manually stop it (%s)", err)
+	} else {
+		a.logger.WithFields(logger.EventField(logger.EventAgentDisconnected)).Info("Disconnected")
 	}
 
 	return err
@@ -560,6 +951,14 @@ func (i *IdleMonitor) Idle() bool {
 	return len(i.idle) == i.totalAgents
 }
 
+// SetTotalAgents changes how many agents have to be idle for all of them to
+// be, when agents are spawned or stopped while the others run
+func (i *IdleMonitor) SetTotalAgents(totalAgents int) {
+	i.Lock()
+	defer i.Unlock()
+	i.totalAgents = totalAgents
+}
+
 func (i *IdleMonitor) MarkIdle(agentUUID string) {
 	i.Lock()
 	defer i.Unlock()
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentWorkerReregistersWhenSessionIsRevoked(t *testing.T) {
+	var mu sync.Mutex
+	var registrations int
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch req.URL.Path {
+		case "/register":
+			registrations++
+			fmt.Fprintf(rw, `{"id":"agent-%d","name":"agent","access_token":"token-%d"}`, registrations, registrations)
+
+		case "/connect":
+			fmt.Fprint(rw, `{}`)
+
+		case "/ping":
+			// Only the latest session is still valid
+			if req.Header.Get("Authorization") != fmt.Sprintf("Token token-%d", registrations) {
+				http.Error(rw, `{"message":"Unauthorized"}`, http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(rw, `{}`)
+
+		default:
+			t.Errorf("Unknown endpoint %s %s", req.Method, req.URL.Path)
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+	worker := NewAgentWorker(logger.Discard, &api.AgentRegisterResponse{UUID: "agent-0", AccessToken: "revoked"}, nil, client, AgentWorkerConfig{
+		AgentConfiguration: AgentConfiguration{ReregisterAttempts: 1},
+		RegisterRequest:    api.AgentRegisterRequest{Name: "agent"},
+	})
+	worker.metrics = metrics.NewCollector(logger.Discard, metrics.CollectorConfig{}).Scope(metrics.Tags{})
+
+	_, err := worker.Ping()
+	var revoked *sessionRevokedError
+	require.ErrorAs(t, err, &revoked)
+
+	require.NoError(t, worker.Reregister(revoked))
+	assert.Equal(t, "agent-1", worker.agent.UUID)
+
+	_, err = worker.Ping()
+	assert.NoError(t, err)
+}
+
+func TestAgentWorkerReregisterDisabled(t *testing.T) {
+	worker := NewAgentWorker(logger.Discard, &api.AgentRegisterResponse{}, nil, api.NewClient(logger.Discard, api.Config{}), AgentWorkerConfig{})
+	worker.metrics = metrics.NewCollector(logger.Discard, metrics.CollectorConfig{}).Scope(metrics.Tags{})
+
+	err := worker.Reregister(&sessionRevokedError{err: fmt.Errorf("401 Unauthorized")})
+	assert.EqualError(t, err, "Buildkite rejected the agent's session: 401 Unauthorized, and re-registering is disabled")
+}
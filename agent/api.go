@@ -20,11 +20,13 @@ type APIClient interface {
 	FinishJob(*api.Job) (*api.Response, error)
 	FromAgentRegisterResponse(*api.AgentRegisterResponse) *api.Client
 	FromPing(*api.Ping) *api.Client
+	GetBuild(string) (*api.Build, *api.Response, error)
 	GetJobState(string) (*api.JobState, *api.Response, error)
 	GetMetaData(string, string) (*api.MetaData, *api.Response, error)
+	GetStepJobs(string) ([]*api.StepJob, *api.Response, error)
 	Heartbeat() (*api.Heartbeat, *api.Response, error)
 	MetaDataKeys(string) ([]string, *api.Response, error)
-	Ping() (*api.Ping, *api.Response, error)
+	Ping(*api.PingOptions) (*api.Ping, *api.Response, error)
 	Register(*api.AgentRegisterRequest) (*api.AgentRegisterResponse, *api.Response, error)
 	SaveHeaderTimes(string, *api.HeaderTimes) (*api.Response, error)
 	SearchArtifacts(string, *api.ArtifactSearchOptions) ([]*api.Artifact, *api.Response, error)
@@ -32,6 +34,7 @@ type APIClient interface {
 	StartJob(*api.Job) (*api.Response, error)
 	StepExport(string, *api.StepExportRequest) (*api.StepExportResponse, *api.Response, error)
 	StepUpdate(string, *api.StepUpdate) (*api.Response, error)
+	StreamChunks(string) (*api.ChunkStream, error)
 	UpdateArtifacts(string, map[string]string) (*api.Response, error)
 	UploadChunk(string, *api.Chunk) (*api.Response, error)
 	UploadPipeline(string, *api.Pipeline) (*api.Response, error)
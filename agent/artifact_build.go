@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"fmt"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// How many triggering builds to look through for a pipeline's build
+const maxTriggerDepth = 10
+
+// ArtifactBuildSelector picks the build to download artifacts from, starting
+// from a build and following the builds that triggered it
+type ArtifactBuildSelector struct {
+	// The build to start from
+	BuildID string
+
+	// Use the build that triggered the starting build
+	FromTriggeredBuild bool
+
+	// Use the closest build of this pipeline, from the starting build (or the
+	// build that triggered it) up through the builds that triggered them
+	Pipeline string
+
+	// What the job knows about its own build, which saves asking Buildkite
+	// when the starting build is the job's
+	JobBuildID            string
+	JobPipelineSlug       string
+	TriggeredFromBuildID  string
+	TriggeredFromPipeline string
+}
+
+// ResolveArtifactBuild returns the ID of the build the selector picks
+func ResolveArtifactBuild(apiClient APIClient, s ArtifactBuildSelector) (string, error) {
+	if !s.FromTriggeredBuild && s.Pipeline == "" {
+		return s.BuildID, nil
+	}
+
+	build, err := s.build(apiClient, s.BuildID)
+	if err != nil {
+		return "", err
+	}
+
+	if s.FromTriggeredBuild {
+		if build.TriggeredFrom == nil {
+			return "", fmt.Errorf("Build %s wasn't triggered by another build", build.ID)
+		}
+		if build, err = s.build(apiClient, build.TriggeredFrom.BuildID); err != nil {
+			return "", err
+		}
+	}
+
+	if s.Pipeline == "" {
+		return build.ID, nil
+	}
+
+	for i := 0; i < maxTriggerDepth; i++ {
+		if build.PipelineSlug == s.Pipeline {
+			return build.ID, nil
+		}
+		if build.TriggeredFrom == nil {
+			break
+		}
+		if build, err = s.build(apiClient, build.TriggeredFrom.BuildID); err != nil {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("No build of pipeline %q triggered build %s", s.Pipeline, s.BuildID)
+}
+
+// build returns a build and the build that triggered it, from the job's
+// environment if it's the job's build
+func (s ArtifactBuildSelector) build(apiClient APIClient, id string) (*api.Build, error) {
+	if id == s.JobBuildID && s.JobPipelineSlug != "" {
+		build := &api.Build{ID: id, PipelineSlug: s.JobPipelineSlug}
+		if s.TriggeredFromBuildID != "" {
+			build.TriggeredFrom = &api.BuildTrigger{
+				BuildID:      s.TriggeredFromBuildID,
+				PipelineSlug: s.TriggeredFromPipeline,
+			}
+		}
+		return build, nil
+	}
+
+	build, _, err := apiClient.GetBuild(id)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get build %s: %v", id, err)
+	}
+	return build, nil
+}
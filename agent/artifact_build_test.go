@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveArtifactBuild(t *testing.T) {
+	t.Parallel()
+
+	// deploy was triggered by release, which was triggered by app
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/builds/release-build":
+			fmt.Fprint(rw, `{"id":"release-build","pipeline_slug":"release","triggered_from":{"build_id":"app-build","pipeline_slug":"app"}}`)
+		case "/builds/app-build":
+			fmt.Fprint(rw, `{"id":"app-build","pipeline_slug":"app"}`)
+		default:
+			http.Error(rw, `{"message":"Not found"}`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+
+	job := ArtifactBuildSelector{
+		BuildID:               "deploy-build",
+		JobBuildID:            "deploy-build",
+		JobPipelineSlug:       "deploy",
+		TriggeredFromBuildID:  "release-build",
+		TriggeredFromPipeline: "release",
+	}
+
+	for _, tc := range []struct {
+		name               string
+		fromTriggeredBuild bool
+		pipeline           string
+		expected           string
+		err                string
+	}{
+		{name: "build", expected: "deploy-build"},
+		{name: "triggered build", fromTriggeredBuild: true, expected: "release-build"},
+		{name: "own pipeline", pipeline: "deploy", expected: "deploy-build"},
+		{name: "pipeline", pipeline: "app", expected: "app-build"},
+		{name: "pipeline from triggered build", fromTriggeredBuild: true, pipeline: "release", expected: "release-build"},
+		{name: "unknown pipeline", pipeline: "docs", err: `No build of pipeline "docs" triggered build deploy-build`},
+	} {
+		s := job
+		s.FromTriggeredBuild = tc.fromTriggeredBuild
+		s.Pipeline = tc.pipeline
+
+		buildID, err := ResolveArtifactBuild(client, s)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, buildID, tc.name)
+	}
+
+	// Builds that weren't triggered have nothing to download from
+	_, err := ResolveArtifactBuild(client, ArtifactBuildSelector{BuildID: "app-build", FromTriggeredBuild: true})
+	assert.EqualError(t, err, "Build app-build wasn't triggered by another build")
+}
@@ -3,7 +3,6 @@ package agent
 import (
 	"errors"
 	"fmt"
-	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -31,6 +30,14 @@ type ArtifactDownloaderConfig struct {
 
 	// Whether to show HTTP debugging
 	DebugHTTP bool
+
+	// Limits downloads along with the agent's other transfers
+	Transfers *TransferScheduler
+
+	// Signs the URLs of artifacts to download them from, instead of
+	// downloading them from where they were uploaded to with the agent's
+	// own credentials
+	URLSigner *ArtifactURLSigner
 }
 
 type ArtifactDownloader struct {
@@ -79,6 +86,7 @@ func (a *ArtifactDownloader) Download() error {
 	} else {
 		a.logger.Info("Found %d artifacts. Starting to download to: %s", artifactCount, downloadDestination)
 
+		engine := newTransferEngine(a.logger, a.conf.Transfers, a.conf.DebugHTTP)
 		p := pool.New(pool.MaxConcurrencyLimit)
 		errors := []error{}
 
@@ -97,40 +105,9 @@ func (a *ArtifactDownloader) Download() error {
 					path = strings.Replace(path, `\`, `/`, -1)
 				}
 
-				// Handle downloading from S3, GS, or RT
-				if strings.HasPrefix(artifact.UploadDestination, "s3://") {
-					err = NewS3Downloader(a.logger, S3DownloaderConfig{
-						Path:        path,
-						Bucket:      artifact.UploadDestination,
-						Destination: downloadDestination,
-						Retries:     5,
-						DebugHTTP:   a.conf.DebugHTTP,
-					}).Start()
-				} else if strings.HasPrefix(artifact.UploadDestination, "gs://") {
-					err = NewGSDownloader(a.logger, GSDownloaderConfig{
-						Path:        path,
-						Bucket:      artifact.UploadDestination,
-						Destination: downloadDestination,
-						Retries:     5,
-						DebugHTTP:   a.conf.DebugHTTP,
-					}).Start()
-				} else if strings.HasPrefix(artifact.UploadDestination, "rt://") {
-					err = NewArtifactoryDownloader(a.logger, ArtifactoryDownloaderConfig{
-						Path:        path,
-						Repository:  artifact.UploadDestination,
-						Destination: downloadDestination,
-						Retries:     5,
-						DebugHTTP:   a.conf.DebugHTTP,
-					}).Start()
-				} else {
-					err = NewDownload(a.logger, http.DefaultClient, DownloadConfig{
-						URL:         artifact.URL,
-						Path:        path,
-						Destination: downloadDestination,
-						Retries:     5,
-						DebugHTTP:   a.conf.DebugHTTP,
-					}).Start()
-				}
+				// Handle downloading from a signed URL, S3, GS, or RT,
+				// along with the agent's other transfers
+				err = engine.download(artifact, path, downloadDestination, a.conf.URLSigner)
 
 				// If the downloaded encountered an error, lock
 				// the pool, collect it, then unlock the pool
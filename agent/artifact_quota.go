@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/dustin/go-humanize"
+	"github.com/gofrs/flock"
+)
+
+// The environment variables that pass the agent's artifact quota to the
+// `buildkite-agent artifact upload` commands jobs run
+const (
+	artifactQuotaPathEnv    = "BUILDKITE_ARTIFACT_QUOTA_PATH"
+	artifactMaxTotalSizeEnv = "BUILDKITE_ARTIFACT_MAX_TOTAL_SIZE"
+	artifactMaxFilesEnv     = "BUILDKITE_ARTIFACT_MAX_FILES"
+	artifactMaxFileSizeEnv  = "BUILDKITE_ARTIFACT_MAX_FILE_SIZE"
+	artifactQuotaPolicyEnv  = "BUILDKITE_ARTIFACT_QUOTA_POLICY"
+)
+
+// What happens to uploads that would take a job over its artifact quota
+const (
+	// The upload fails without uploading anything
+	ArtifactQuotaFail = "fail"
+
+	// The artifacts that fit are uploaded, and the rest are skipped
+	ArtifactQuotaTruncate = "truncate"
+)
+
+// ArtifactQuota limits the artifacts a job can upload, across all of its
+// uploads. Zero limits aren't enforced.
+type ArtifactQuota struct {
+	// Where what the job has uploaded so far is kept
+	Path string
+
+	MaxTotalSize uint64
+	MaxFiles     int
+	MaxFileSize  uint64
+
+	// Either ArtifactQuotaFail or ArtifactQuotaTruncate
+	Policy string
+}
+
+// artifactQuotaUsage is what a job has uploaded so far
+type artifactQuotaUsage struct {
+	Files int    `json:"files"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// ValidateArtifactQuotaPolicy checks that a quota policy is one there is
+func ValidateArtifactQuotaPolicy(policy string) error {
+	switch policy {
+	case ArtifactQuotaFail, ArtifactQuotaTruncate:
+		return nil
+	}
+	return fmt.Errorf("The artifact quota policy must be %q or %q, not %q", ArtifactQuotaFail, ArtifactQuotaTruncate, policy)
+}
+
+// ArtifactQuotaFromEnv returns the artifact quota of the job being run, or nil
+// if it doesn't have one
+func ArtifactQuotaFromEnv() *ArtifactQuota {
+	path := os.Getenv(artifactQuotaPathEnv)
+	if path == "" {
+		return nil
+	}
+
+	q := &ArtifactQuota{Path: path, Policy: os.Getenv(artifactQuotaPolicyEnv)}
+	q.MaxTotalSize, _ = strconv.ParseUint(os.Getenv(artifactMaxTotalSizeEnv), 10, 64)
+	q.MaxFiles, _ = strconv.Atoi(os.Getenv(artifactMaxFilesEnv))
+	q.MaxFileSize, _ = strconv.ParseUint(os.Getenv(artifactMaxFileSizeEnv), 10, 64)
+	return q
+}
+
+// Env returns the environment that gives a job the quota
+func (q *ArtifactQuota) Env() map[string]string {
+	if q == nil {
+		return nil
+	}
+
+	return map[string]string{
+		artifactQuotaPathEnv:    q.Path,
+		artifactMaxTotalSizeEnv: strconv.FormatUint(q.MaxTotalSize, 10),
+		artifactMaxFilesEnv:     strconv.Itoa(q.MaxFiles),
+		artifactMaxFileSizeEnv:  strconv.FormatUint(q.MaxFileSize, 10),
+		artifactQuotaPolicyEnv:  q.Policy,
+	}
+}
+
+// Apply returns the artifacts that fit in what's left of the quota, and counts
+// them towards it. With the fail policy, it returns an error if any of them
+// don't fit, and none of them count.
+func (q *ArtifactQuota) Apply(l logger.Logger, artifacts []*api.Artifact) ([]*api.Artifact, error) {
+	if q == nil {
+		return artifacts, nil
+	}
+
+	// Jobs can upload artifacts in parallel
+	lock := flock.New(q.Path + ".lock")
+	if err := lock.Lock(); err != nil {
+		return nil, fmt.Errorf("Failed to lock the artifact quota: %v", err)
+	}
+	defer lock.Unlock()
+
+	var usage artifactQuotaUsage
+	if data, err := os.ReadFile(q.Path); err == nil {
+		if err := json.Unmarshal(data, &usage); err != nil {
+			return nil, fmt.Errorf("Failed to read the artifact quota: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to read the artifact quota: %v", err)
+	}
+
+	var fit []*api.Artifact
+	for _, artifact := range artifacts {
+		if err := q.check(usage, artifact); err != nil {
+			if q.Policy != ArtifactQuotaTruncate {
+				return nil, err
+			}
+			l.Warn("Skipping artifact: %v", err)
+			continue
+		}
+
+		usage.Files++
+		usage.Bytes += uint64(artifact.FileSize)
+		fit = append(fit, artifact)
+	}
+
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(q.Path, data, 0600); err != nil {
+		return nil, fmt.Errorf("Failed to write the artifact quota: %v", err)
+	}
+
+	return fit, nil
+}
+
+// check returns an error if an artifact doesn't fit in what's left of the
+// quota
+func (q *ArtifactQuota) check(usage artifactQuotaUsage, artifact *api.Artifact) error {
+	size := uint64(artifact.FileSize)
+
+	switch {
+	case q.MaxFileSize > 0 && size > q.MaxFileSize:
+		return fmt.Errorf("%s is %s, which is over the job's artifact file size limit of %s",
+			artifact.Path, humanize.Bytes(size), humanize.Bytes(q.MaxFileSize))
+
+	case q.MaxFiles > 0 && usage.Files+1 > q.MaxFiles:
+		return fmt.Errorf("%s would take the job over its limit of %d artifacts",
+			artifact.Path, q.MaxFiles)
+
+	case q.MaxTotalSize > 0 && usage.Bytes+size > q.MaxTotalSize:
+		return fmt.Errorf("%s would take the job over its limit of %s of artifacts, with %s already uploaded",
+			artifact.Path, humanize.Bytes(q.MaxTotalSize), humanize.Bytes(usage.Bytes))
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func quotaArtifacts(sizes ...int64) []*api.Artifact {
+	var artifacts []*api.Artifact
+	for i, size := range sizes {
+		artifacts = append(artifacts, &api.Artifact{Path: string(rune('a' + i)), FileSize: size})
+	}
+	return artifacts
+}
+
+func artifactPaths(artifacts []*api.Artifact) []string {
+	var paths []string
+	for _, a := range artifacts {
+		paths = append(paths, a.Path)
+	}
+	return paths
+}
+
+func TestArtifactQuotaFailsWholeUpload(t *testing.T) {
+	t.Parallel()
+
+	q := &ArtifactQuota{
+		Path:         filepath.Join(t.TempDir(), "quota"),
+		MaxTotalSize: 100,
+		Policy:       ArtifactQuotaFail,
+	}
+
+	fit, err := q.Apply(logger.Discard, quotaArtifacts(40, 40))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, artifactPaths(fit))
+
+	// Nothing in an upload that doesn't fit counts towards the quota
+	_, err = q.Apply(logger.Discard, quotaArtifacts(10, 30))
+	assert.ErrorContains(t, err, "b would take the job over its limit of 100 B of artifacts")
+
+	fit, err = q.Apply(logger.Discard, quotaArtifacts(20))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, artifactPaths(fit))
+}
+
+func TestArtifactQuotaTruncatesUpload(t *testing.T) {
+	t.Parallel()
+
+	q := &ArtifactQuota{
+		Path:        filepath.Join(t.TempDir(), "quota"),
+		MaxFiles:    3,
+		MaxFileSize: 50,
+		Policy:      ArtifactQuotaTruncate,
+	}
+
+	fit, err := q.Apply(logger.Discard, quotaArtifacts(10, 60, 20))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, artifactPaths(fit))
+
+	fit, err = q.Apply(logger.Discard, quotaArtifacts(10, 10))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, artifactPaths(fit))
+}
+
+func TestArtifactQuotaEnv(t *testing.T) {
+	q := &ArtifactQuota{
+		Path:         "/tmp/quota",
+		MaxTotalSize: 1000,
+		MaxFiles:     10,
+		MaxFileSize:  100,
+		Policy:       ArtifactQuotaTruncate,
+	}
+
+	for k, v := range q.Env() {
+		t.Setenv(k, v)
+	}
+	assert.Equal(t, q, ArtifactQuotaFromEnv())
+
+	var none *ArtifactQuota
+	fit, err := none.Apply(logger.Discard, quotaArtifacts(10))
+	require.NoError(t, err)
+	assert.Len(t, fit, 1)
+}
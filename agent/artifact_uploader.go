@@ -3,7 +3,6 @@ package agent
 import (
 	"crypto/sha1"
 	"crypto/sha256"
-	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -18,13 +17,18 @@ import (
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/mime"
 	"github.com/buildkite/agent/v3/pool"
-	"github.com/buildkite/roko"
+	"github.com/buildkite/agent/v3/retry"
+	"github.com/buildkite/agent/v3/utils"
 	zglob "github.com/mattn/go-zglob"
 )
 
 const (
 	ArtifactPathDelimiter    = ";"
 	ArtifactFallbackMimeType = "binary/octet-stream"
+
+	// How long a file has to go unchanged while following before it's
+	// considered finished, unless the config says otherwise
+	DefaultArtifactFollowSettle = 2 * time.Second
 )
 
 type ArtifactUploaderConfig struct {
@@ -45,6 +49,22 @@ type ArtifactUploaderConfig struct {
 
 	// Whether to follow symbolic links when resolving globs
 	FollowSymlinks bool
+
+	// Limits uploads along with the agent's other transfers
+	Transfers *TransferScheduler
+
+	// Limits what the job can upload across all of its uploads
+	Quota *ArtifactQuota
+
+	// How long Follow watches the paths for files, or until FollowUntil
+	// exists if it's 0
+	Follow time.Duration
+
+	// A file that Follow stops watching the paths once it exists
+	FollowUntil string
+
+	// How long a file has to go unchanged before Follow uploads it
+	FollowSettle time.Duration
 }
 
 type ArtifactUploader struct {
@@ -56,6 +76,9 @@ type ArtifactUploader struct {
 
 	// The APIClient that will be used when uploading jobs
 	apiClient APIClient
+
+	// How often Follow looks for new files
+	followInterval time.Duration
 }
 
 func NewArtifactUploader(l logger.Logger, ac APIClient, c ArtifactUploaderConfig) *ArtifactUploader {
@@ -63,6 +86,8 @@ func NewArtifactUploader(l logger.Logger, ac APIClient, c ArtifactUploaderConfig
 		logger:    l,
 		apiClient: ac,
 		conf:      c,
+
+		followInterval: time.Second,
 	}
 }
 
@@ -78,15 +103,155 @@ func (a *ArtifactUploader) Upload() error {
 	} else {
 		a.logger.Info("Found %d files that match \"%s\"", len(artifacts), a.conf.Paths)
 
-		err := a.upload(artifacts)
+		if err := a.uploadWithinQuota(artifacts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// followedFile is what Follow last saw of a file that hasn't been uploaded
+type followedFile struct {
+	size    int64
+	modTime time.Time
+
+	// When the file was first seen the way it is now
+	since time.Time
+}
+
+// Follow watches the paths for the configured period, or until the
+// FollowUntil file exists, uploading files as they appear once they've gone
+// unchanged for FollowSettle, like screenshots written during a test run. Once
+// it stops watching, the files that haven't been uploaded yet are uploaded
+// the way they are. Each file is only uploaded once, so changes to a file
+// after it's been uploaded are ignored.
+func (a *ArtifactUploader) Follow() error {
+	return a.follow(a.uploadWithinQuota)
+}
+
+func (a *ArtifactUploader) follow(upload func([]*api.Artifact) error) error {
+	settle := a.conf.FollowSettle
+	if settle <= 0 {
+		settle = DefaultArtifactFollowSettle
+	}
+
+	var deadline time.Time
+	if a.conf.Follow > 0 {
+		deadline = time.Now().Add(a.conf.Follow)
+	}
+
+	// The sentinel isn't uploaded, even if it matches the paths
+	var untilPath string
+	if a.conf.FollowUntil != "" {
+		var err error
+		untilPath, err = filepath.Abs(utils.NativeWSLPath(a.conf.FollowUntil))
 		if err != nil {
 			return err
 		}
 	}
 
+	if untilPath != "" && deadline.IsZero() {
+		a.logger.Info("Following \"%s\" until %s exists", a.conf.Paths, a.conf.FollowUntil)
+	} else {
+		a.logger.Info("Following \"%s\" for %v", a.conf.Paths, a.conf.Follow)
+	}
+
+	files := make(map[string]followedFile)
+	uploaded := make(map[string]bool)
+	failed := false
+
+	for {
+		// Whether this is the last look, which uploads everything left
+		done := !deadline.IsZero() && !time.Now().Before(deadline)
+		if untilPath != "" {
+			if _, err := os.Stat(untilPath); err == nil {
+				a.logger.Debug("Found %s, stopping following", a.conf.FollowUntil)
+				done = true
+			}
+		}
+
+		paths, err := a.glob(true)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		var ready []*api.Artifact
+		for _, p := range paths {
+			if uploaded[p.absolutePath] || p.absolutePath == untilPath {
+				continue
+			}
+
+			// The file may have been removed since the glob found it
+			info, err := os.Stat(p.absolutePath)
+			if err != nil {
+				delete(files, p.absolutePath)
+				continue
+			}
+
+			file, seen := files[p.absolutePath]
+			if !seen || file.size != info.Size() || !file.modTime.Equal(info.ModTime()) {
+				file = followedFile{size: info.Size(), modTime: info.ModTime(), since: now}
+				files[p.absolutePath] = file
+			}
+			if !done && (!seen || now.Sub(file.since) < settle) {
+				continue
+			}
+
+			artifact, err := a.build(p.path, p.absolutePath, p.globPath)
+			if err != nil {
+				return err
+			}
+			ready = append(ready, artifact)
+		}
+
+		if len(ready) > 0 {
+			for _, artifact := range ready {
+				uploaded[artifact.AbsolutePath] = true
+				delete(files, artifact.AbsolutePath)
+			}
+
+			a.logger.Info("Found %d more files that match \"%s\"", len(ready), a.conf.Paths)
+
+			// Keep following after a failed upload, the files written
+			// later may still make it
+			if err := upload(ready); err != nil {
+				a.logger.Error("%s", err)
+				failed = true
+			}
+		}
+
+		if done {
+			break
+		}
+		time.Sleep(a.followInterval)
+	}
+
+	if len(uploaded) == 0 {
+		a.logger.Info("No files matched paths: %s", a.conf.Paths)
+	}
+	if failed {
+		return fmt.Errorf("There were errors with uploading some of the artifacts")
+	}
+
 	return nil
 }
 
+// uploadWithinQuota uploads the artifacts that fit in the job's artifact quota
+func (a *ArtifactUploader) uploadWithinQuota(artifacts []*api.Artifact) error {
+	artifacts, err := a.conf.Quota.Apply(a.logger, artifacts)
+	if err != nil {
+		return err
+	}
+	if len(artifacts) == 0 {
+		a.logger.Warn("None of the files fit in the job's artifact quota")
+		return nil
+	}
+
+	return a.upload(artifacts)
+}
+
 func isDir(path string) bool {
 	fi, err := os.Stat(path)
 	if err != nil {
@@ -96,6 +261,34 @@ func isDir(path string) bool {
 }
 
 func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
+	paths, err := a.glob(false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range paths {
+		// Build an artifact object using the paths we have.
+		artifact, err := a.build(p.path, p.absolutePath, p.globPath)
+		if err != nil {
+			return nil, err
+		}
+
+		artifacts = append(artifacts, artifact)
+	}
+
+	return artifacts, nil
+}
+
+// artifactPath is a file that matched the paths to upload
+type artifactPath struct {
+	path         string
+	absolutePath string
+	globPath     string
+}
+
+// glob returns the files that match the paths to upload. Following logs
+// paths that don't exist yet at debug level, since they're looked for again.
+func (a *ArtifactUploader) glob(following bool) (paths []artifactPath, err error) {
 	wd, err := os.Getwd()
 	if err != nil {
 		return nil, err
@@ -110,6 +303,10 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 			continue
 		}
 
+		// Commands on the other side of the WSL boundary will give us paths
+		// in their own style
+		globPath = utils.NativeWSLPath(globPath)
+
 		a.logger.Debug("Searching for %s", globPath)
 
 		// Resolve the globs (with * and ** in them), if it's a non-globbed path and doesn't exists
@@ -121,7 +318,11 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 		}
 		files, err := globfunc(globPath)
 		if err == os.ErrNotExist {
-			a.logger.Info("File not found: %s", globPath)
+			if following {
+				a.logger.Debug("File not found: %s", globPath)
+			} else {
+				a.logger.Info("File not found: %s", globPath)
+			}
 			continue
 		} else if err != nil {
 			return nil, err
@@ -170,17 +371,11 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 				path = filepath.ToSlash(path)
 			}
 
-			// Build an artifact object using the paths we have.
-			artifact, err := a.build(path, absolutePath, globPath)
-			if err != nil {
-				return nil, err
-			}
-
-			artifacts = append(artifacts, artifact)
+			paths = append(paths, artifactPath{path: path, absolutePath: absolutePath, globPath: globPath})
 		}
 	}
 
-	return artifacts, nil
+	return paths, nil
 }
 
 func (a *ArtifactUploader) build(path string, absolutePath string, globPath string) (*api.Artifact, error) {
@@ -230,44 +425,20 @@ func (a *ArtifactUploader) build(path string, absolutePath string, globPath stri
 }
 
 func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
-	var uploader Uploader
-	var err error
+	engine := newTransferEngine(a.logger, a.conf.Transfers, a.conf.DebugHTTP)
 
 	// Determine what uploader to use
-	if a.conf.Destination != "" {
-		if strings.HasPrefix(a.conf.Destination, "s3://") {
-			uploader, err = NewS3Uploader(a.logger, S3UploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.conf.DebugHTTP,
-			})
-		} else if strings.HasPrefix(a.conf.Destination, "gs://") {
-			uploader, err = NewGSUploader(a.logger, GSUploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.conf.DebugHTTP,
-			})
-		} else if strings.HasPrefix(a.conf.Destination, "rt://") {
-			uploader, err = NewArtifactoryUploader(a.logger, ArtifactoryUploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.conf.DebugHTTP,
-			})
-		} else {
-			return errors.New(fmt.Sprintf("Invalid upload destination: '%v'. Only s3://, gs:// or rt:// upload destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?", a.conf.Destination))
-		}
+	uploader, err := engine.uploader(a.conf.Destination)
+	if err != nil {
+		return err
+	}
 
+	if a.conf.Destination != "" {
 		a.logger.Info("Uploading to %q, using your agent configuration", a.conf.Destination)
 	} else {
-		uploader = NewFormUploader(a.logger, FormUploaderConfig{
-			DebugHTTP: a.conf.DebugHTTP,
-		})
-
 		a.logger.Info("Uploading to default Buildkite artifact storage")
 	}
 
-	// Check if creation caused an error
-	if err != nil {
-		return fmt.Errorf("Error creating uploader: %v", err)
-	}
-
 	// Set the URLs of the artifacts based on the uploader
 	for _, artifact := range artifacts {
 		artifact.URL = uploader.URL(artifact)
@@ -326,10 +497,10 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 				}
 
 				// Update the states of the artifacts in bulk.
-				err = roko.NewRetrier(
-					roko.WithMaxAttempts(10),
-					roko.WithStrategy(roko.Constant(5*time.Second)),
-				).Do(func(r *roko.Retrier) error {
+				err = retry.NewRetrier(
+					retry.WithMaxAttempts(10),
+					retry.WithStrategy(retry.Constant(5*time.Second)),
+				).Do(func(r *retry.Retrier) error {
 					_, err = a.apiClient.UpdateArtifacts(a.conf.JobID, statesToUpload)
 					if err != nil {
 						a.logger.Warn("%s (%s)", err, r)
@@ -369,19 +540,8 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 			a.logger.Info("Uploading artifact %s %s (%d bytes)", artifact.ID, artifact.Path, artifact.FileSize)
 
 			// Upload the artifact and then set the state depending
-			// on whether or not it passed. We'll retry the upload
-			// a couple of times before giving up.
-			err = roko.NewRetrier(
-				roko.WithMaxAttempts(10),
-				roko.WithStrategy(roko.Constant(5*time.Second)),
-			).Do(func(r *roko.Retrier) error {
-				err := uploader.Upload(artifact)
-				if err != nil {
-					a.logger.Warn("%s (%s)", err, r)
-				}
-
-				return err
-			})
+			// on whether or not it passed
+			err = engine.upload(uploader, artifact)
 
 			var state string
 
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/experiments"
@@ -309,3 +310,89 @@ func TestCollectWithDuplicateMatchesFollowingSymlinks(t *testing.T) {
 		paths,
 	)
 }
+
+func TestFollow(t *testing.T) {
+	dir := t.TempDir()
+	done := filepath.Join(dir, "done.png")
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:        filepath.Join(dir, "*.png"),
+		FollowUntil:  done,
+		FollowSettle: 200 * time.Millisecond,
+	})
+	uploader.followInterval = 10 * time.Millisecond
+
+	batches := make(chan []string, 10)
+	result := make(chan error)
+	go func() {
+		result <- uploader.follow(func(artifacts []*api.Artifact) error {
+			var names []string
+			for _, a := range artifacts {
+				names = append(names, filepath.Base(a.Path))
+			}
+			batches <- names
+			return nil
+		})
+	}()
+
+	// A file that's been written is uploaded once it's settled
+	if err := os.WriteFile(filepath.Join(dir, "first.png"), []byte("alpacas"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case names := <-batches:
+		assert.Equal(t, []string{"first.png"}, names)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for first.png to be uploaded")
+	}
+
+	// One that's still being written isn't
+	f, err := os.Create(filepath.Join(dir, "second.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(f, "llama %d\n", i)
+		time.Sleep(20 * time.Millisecond)
+	}
+	f.Close()
+	select {
+	case names := <-batches:
+		t.Fatalf("Uploaded %v while second.png was being written", names)
+	default:
+	}
+
+	// Until following stops, when it's uploaded the way it is
+	if err := os.WriteFile(done, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for following to stop")
+	}
+	close(batches)
+
+	var rest []string
+	for names := range batches {
+		rest = append(rest, names...)
+	}
+	assert.Equal(t, []string{"second.png"}, rest)
+}
+
+func TestFollowStopsAfterThePeriod(t *testing.T) {
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:  filepath.Join(t.TempDir(), "*.png"),
+		Follow: 50 * time.Millisecond,
+	})
+	uploader.followInterval = 10 * time.Millisecond
+
+	start := time.Now()
+	err := uploader.follow(func(artifacts []*api.Artifact) error {
+		t.Errorf("Uploaded %d artifacts, expected none", len(artifacts))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/shellwords"
+)
+
+// The environment variable that hands the signer to artifact download
+const artifactURLSignerEnv = "BUILDKITE_ARTIFACT_URL_SIGNER"
+
+// How long the signer has to sign each artifact's URL
+const artifactURLSignerTimeout = 30 * time.Second
+
+// ArtifactURLSigner gets pre-signed URLs for artifacts from an operator's own
+// signer, so that artifacts in storage the agent doesn't know about can be
+// downloaded without credentials for it on every agent. The signer is either
+// an http:// or https:// endpoint that artifacts are POSTed to, or a command
+// that's given the artifact on stdin. Either way, the artifact is JSON and the
+// signer responds with a SignedArtifactURL as JSON.
+type ArtifactURLSigner struct {
+	// The signer's endpoint or command
+	Signer string
+
+	// The HTTP client to call an endpoint with
+	Client *http.Client
+}
+
+// SignedArtifactURL is where to download an artifact from
+type SignedArtifactURL struct {
+	URL string `json:"url"`
+
+	// Any headers the download needs, like an authorization header
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Sign gets a pre-signed URL for an artifact
+func (s *ArtifactURLSigner) Sign(artifact *api.Artifact) (SignedArtifactURL, error) {
+	body, err := json.Marshal(artifact)
+	if err != nil {
+		return SignedArtifactURL{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), artifactURLSignerTimeout)
+	defer cancel()
+
+	var out []byte
+	if s.isEndpoint() {
+		out, err = s.post(ctx, body)
+	} else {
+		out, err = s.exec(ctx, body)
+	}
+	if err != nil {
+		return SignedArtifactURL{}, fmt.Errorf("Failed to sign the URL of %s: %v", artifact.Path, err)
+	}
+
+	var signed SignedArtifactURL
+	if err := json.Unmarshal(out, &signed); err != nil {
+		return SignedArtifactURL{}, fmt.Errorf("The URL signer's response for %s isn't valid: %v", artifact.Path, err)
+	}
+	if signed.URL == "" {
+		return SignedArtifactURL{}, fmt.Errorf("The URL signer didn't give a URL for %s", artifact.Path)
+	}
+	return signed, nil
+}
+
+func (s *ArtifactURLSigner) isEndpoint() bool {
+	return strings.HasPrefix(s.Signer, "http://") || strings.HasPrefix(s.Signer, "https://")
+}
+
+func (s *ArtifactURLSigner) post(ctx context.Context, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Signer, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s responded %s: %s", s.Signer, resp.Status, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+func (s *ArtifactURLSigner) exec(ctx context.Context, body []byte) ([]byte, error) {
+	args, err := shellwords.Split(s.Signer)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("no command given")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s failed: %v: %s", args[0], err, msg)
+		}
+		return nil, fmt.Errorf("%s failed: %v", args[0], err)
+	}
+	return out, nil
+}
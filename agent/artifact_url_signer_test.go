@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactURLSignerEndpoint(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var artifact api.Artifact
+		if err := json.NewDecoder(req.Body).Decode(&artifact); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if artifact.Path == "missing.txt" {
+			http.Error(rw, "no such artifact", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(SignedArtifactURL{
+			URL:     "https://storage.example.com/" + artifact.Path + "?signature=abc",
+			Headers: map[string]string{"X-Tenant": "builds"},
+		})
+	}))
+	defer server.Close()
+
+	signer := &ArtifactURLSigner{Signer: server.URL}
+
+	signed, err := signer.Sign(&api.Artifact{Path: "pkg/app.tar.gz"})
+	require.NoError(t, err)
+	assert.Equal(t, SignedArtifactURL{
+		URL:     "https://storage.example.com/pkg/app.tar.gz?signature=abc",
+		Headers: map[string]string{"X-Tenant": "builds"},
+	}, signed)
+
+	_, err = signer.Sign(&api.Artifact{Path: "missing.txt"})
+	assert.ErrorContains(t, err, "404 Not Found: no such artifact")
+}
+
+func TestArtifactURLSignerCommand(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The signer script is a shell script")
+	}
+
+	script := filepath.Join(t.TempDir(), "sign")
+	require.NoError(t, os.WriteFile(script, []byte(`#!/bin/sh
+if grep -q '"path":"bad.txt"' ; then
+  echo "can't sign bad.txt" >&2
+  exit 1
+fi
+echo '{"url": "https://storage.example.com/signed"}'
+`), 0o755))
+
+	signer := &ArtifactURLSigner{Signer: script}
+
+	signed, err := signer.Sign(&api.Artifact{Path: "good.txt"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://storage.example.com/signed", signed.URL)
+
+	_, err = signer.Sign(&api.Artifact{Path: "bad.txt"})
+	assert.ErrorContains(t, err, "can't sign bad.txt")
+}
+
+func TestArtifactURLSignerNeedsURL(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	_, err := (&ArtifactURLSigner{Signer: server.URL}).Sign(&api.Artifact{Path: "a.txt"})
+	assert.ErrorContains(t, err, "didn't give a URL for a.txt")
+}
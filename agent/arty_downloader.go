@@ -2,10 +2,8 @@ package agent
 
 import (
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"path"
 	"path/filepath"
 	"strings"
@@ -47,12 +45,20 @@ func NewArtifactoryDownloader(l logger.Logger, c ArtifactoryDownloaderConfig) *A
 }
 
 func (d ArtifactoryDownloader) Start() error {
-	// Pull environment variables
-	stringURL := os.Getenv("BUILDKITE_ARTIFACTORY_URL")
-	username := os.Getenv("BUILDKITE_ARTIFACTORY_USER")
-	password := os.Getenv("BUILDKITE_ARTIFACTORY_PASSWORD")
-	if stringURL == "" || username == "" || password == "" {
-		return errors.New("Must set BUILDKITE_ARTIFACTORY_URL, BUILDKITE_ARTIFACTORY_USER, BUILDKITE_ARTIFACTORY_PASSWORD when using rt:// path")
+	client, conf, err := d.request()
+	if err != nil {
+		return err
+	}
+
+	return NewDownload(d.logger, client, conf).Start()
+}
+
+// request returns the client and the config for downloading the file from
+// the Artifactory instance, authenticated with the user from the environment
+func (d ArtifactoryDownloader) request() (*http.Client, DownloadConfig, error) {
+	stringURL, username, password, err := artifactoryCredentials()
+	if err != nil {
+		return nil, DownloadConfig{}, err
 	}
 
 	// create full URL
@@ -68,14 +74,14 @@ func (d ArtifactoryDownloader) Start() error {
 	}
 
 	// We can now cheat and pass the URL onto our regular downloader
-	return NewDownload(d.logger, http.DefaultClient, DownloadConfig{
+	return http.DefaultClient, DownloadConfig{
 		URL:         fullURL,
 		Path:        d.conf.Path,
 		Destination: d.conf.Destination,
 		Retries:     d.conf.Retries,
 		Headers:     headers,
 		DebugHTTP:   d.conf.DebugHTTP,
-	}).Start()
+	}, nil
 }
 
 func (d ArtifactoryDownloader) RepositoryFileLocation() string {
@@ -87,17 +93,13 @@ func (d ArtifactoryDownloader) RepositoryFileLocation() string {
 }
 
 func (d ArtifactoryDownloader) RepositoryPath() string {
-	return strings.Join(d.destinationParts()[1:len(d.destinationParts())], "/")
+	_, repositoryPath := splitStorageDestination(d.conf.Repository, "rt")
+	return repositoryPath
 }
 
 func (d ArtifactoryDownloader) RepositoryName() string {
-	return d.destinationParts()[0]
-}
-
-func (d ArtifactoryDownloader) destinationParts() []string {
-	trimmed := strings.TrimPrefix(d.conf.Repository, "rt://")
-
-	return strings.Split(trimmed, "/")
+	name, _ := splitStorageDestination(d.conf.Repository, "rt")
+	return name
 }
 
 func getBasicAuthHeader(username, password string) string {
@@ -5,7 +5,6 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -58,12 +57,9 @@ type ArtifactoryUploader struct {
 
 func NewArtifactoryUploader(l logger.Logger, c ArtifactoryUploaderConfig) (*ArtifactoryUploader, error) {
 	repo, path := ParseArtifactoryDestination(c.Destination)
-	stringURL := os.Getenv("BUILDKITE_ARTIFACTORY_URL")
-	username := os.Getenv("BUILDKITE_ARTIFACTORY_USER")
-	password := os.Getenv("BUILDKITE_ARTIFACTORY_PASSWORD")
-	// authentication is not set
-	if stringURL == "" || username == "" || password == "" {
-		return nil, errors.New("Must set BUILDKITE_ARTIFACTORY_URL, BUILDKITE_ARTIFACTORY_USER, BUILDKITE_ARTIFACTORY_PASSWORD when using rt:// path")
+	stringURL, username, password, err := artifactoryCredentials()
+	if err != nil {
+		return nil, err
 	}
 
 	parsedURL, err := url.Parse(stringURL)
@@ -83,10 +79,7 @@ func NewArtifactoryUploader(l logger.Logger, c ArtifactoryUploaderConfig) (*Arti
 }
 
 func ParseArtifactoryDestination(destination string) (repo string, path string) {
-	parts := strings.Split(strings.TrimPrefix(string(destination), "rt://"), "/")
-	path = strings.Join(parts[1:len(parts)], "/")
-	repo = parts[0]
-	return
+	return splitStorageDestination(destination, "rt")
 }
 
 func (u *ArtifactoryUploader) URL(artifact *api.Artifact) string {
@@ -102,10 +95,11 @@ func (u *ArtifactoryUploader) URL(artifact *api.Artifact) string {
 func (u *ArtifactoryUploader) Upload(artifact *api.Artifact) error {
 	// Open file from filesystem
 	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
-	f, err := os.Open(artifact.AbsolutePath)
+	f, err := openArtifact(u.logger, artifact)
 	if err != nil {
 		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
+	defer f.Close()
 
 	// Upload the file to Artifactory.
 	u.logger.Debug("Uploading \"%s\" to `%s`", artifact.Path, u.URL(artifact))
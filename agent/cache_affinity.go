@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// recentPipelines keeps track of the pipelines an agent has built most
+// recently, so it can ask Buildkite for jobs that will find warm git mirrors,
+// checkouts and caches instead of starting cold
+type recentPipelines struct {
+	mu   sync.Mutex
+	max  int
+	list []string
+}
+
+// newRecentPipelines returns a tracker for up to max pipelines, seeded from
+// the checkouts already in the agent's build path so a restarted agent still
+// prefers the pipelines it has on disk
+func newRecentPipelines(max int, agentBuildPath string) *recentPipelines {
+	r := &recentPipelines{max: max}
+
+	// Oldest first, so the most recently used end up at the front
+	for _, dir := range checkoutDirsByLastUse(agentBuildPath) {
+		r.add(filepath.Base(filepath.Dir(dir)) + "/" + filepath.Base(dir))
+	}
+
+	return r
+}
+
+// Add records a build of a pipeline
+func (r *recentPipelines) Add(org, pipeline string) {
+	if r == nil || org == "" || pipeline == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.add(org + "/" + pipeline)
+}
+
+func (r *recentPipelines) add(slug string) {
+	list := []string{slug}
+	for _, s := range r.list {
+		if s != slug && len(list) < r.max {
+			list = append(list, s)
+		}
+	}
+	r.list = list
+}
+
+// List returns the recent pipelines as "org/pipeline", most recent first
+func (r *recentPipelines) List() []string {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.list...)
+}
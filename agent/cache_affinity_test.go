@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecentPipelines(t *testing.T) {
+	r := newRecentPipelines(3, filepath.Join(t.TempDir(), "nope"))
+	assert.Empty(t, r.List())
+
+	r.Add("acme", "web")
+	r.Add("acme", "api")
+	r.Add("acme", "web")
+	r.Add("acme", "docs")
+	r.Add("acme", "ios")
+	r.Add("", "ignored")
+
+	assert.Equal(t, []string{"acme/ios", "acme/docs", "acme/web"}, r.List())
+
+	var disabled *recentPipelines
+	disabled.Add("acme", "web")
+	assert.Nil(t, disabled.List())
+}
+
+func TestRecentPipelinesSeededFromCheckouts(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	ages := map[string]time.Duration{
+		"acme/old":     9 * time.Hour,
+		"acme/new":     1 * time.Hour,
+		"other/middle": 5 * time.Hour,
+	}
+
+	for pipeline, age := range ages {
+		path := filepath.Join(dir, pipeline)
+		require.NoError(t, os.MkdirAll(path, 0o755))
+		mtime := now.Add(-age)
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+
+	r := newRecentPipelines(2, dir)
+	assert.Equal(t, []string{"acme/new", "other/middle"}, r.List())
+}
+
+func TestAgentWorkerPingsWithRecentPipelines(t *testing.T) {
+	var query string
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		query = req.URL.RawQuery
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+	worker := NewAgentWorker(logger.Discard, &api.AgentRegisterResponse{Name: "agent", AccessToken: "alpacas"}, nil, client, AgentWorkerConfig{
+		AgentConfiguration: AgentConfiguration{CacheAffinity: 5, BuildPath: t.TempDir()},
+	})
+
+	_, err := worker.Ping()
+	require.NoError(t, err)
+	assert.Equal(t, "", query)
+
+	worker.recentPipelines.Add("acme", "web")
+	worker.recentPipelines.Add("acme", "api")
+
+	_, err = worker.Ping()
+	require.NoError(t, err)
+	assert.Equal(t, "recent_pipelines=acme%2Fapi%2Cacme%2Fweb", query)
+}
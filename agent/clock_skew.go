@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
+)
+
+// How often to repeat the warning while the clock stays skewed
+const clockSkewWarningInterval = 15 * time.Minute
+
+// ClockSkew estimates how far ahead of the API's clock the local clock is,
+// using the Date header of a response to a request sent and received at the
+// given local times. The Date header only has a precision of a second, and
+// the response could have been generated any time during the round trip, so
+// the estimate is returned along with how far off it might be.
+func ClockSkew(resp *api.Response, sent, received time.Time) (skew, uncertainty time.Duration, ok bool) {
+	if resp == nil || resp.Response == nil {
+		return 0, 0, false
+	}
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	roundTrip := received.Sub(sent)
+	midpoint := sent.Add(roundTrip / 2)
+
+	// The server truncates to the second, so on average it's half a second
+	// behind what it was
+	serverTime := date.Add(500 * time.Millisecond)
+
+	return midpoint.Sub(serverTime), roundTrip/2 + 500*time.Millisecond, true
+}
+
+// ClockSkewMonitor checks responses from the API for clock skew, and warns
+// when it's more than a threshold. Skewed clocks break things like signed
+// artifact URLs, OIDC tokens and the ordering of log output in ways that are
+// hard to figure out from the errors alone.
+type ClockSkewMonitor struct {
+	logger    logger.Logger
+	metrics   *metrics.Scope
+	threshold time.Duration
+
+	mu         sync.Mutex
+	skewed     bool
+	lastWarned time.Time
+}
+
+// NewClockSkewMonitor returns a monitor that warns when the clock is off by
+// more than threshold. A threshold of zero disables it.
+func NewClockSkewMonitor(l logger.Logger, m *metrics.Scope, threshold time.Duration) *ClockSkewMonitor {
+	return &ClockSkewMonitor{
+		logger:    l,
+		metrics:   m,
+		threshold: threshold,
+	}
+}
+
+// Observe checks the clock skew of a response, returning the estimated skew
+func (c *ClockSkewMonitor) Observe(resp *api.Response, sent, received time.Time) time.Duration {
+	if c == nil || c.threshold <= 0 {
+		return 0
+	}
+
+	skew, uncertainty, ok := ClockSkew(resp, sent, received)
+	if !ok {
+		return 0
+	}
+
+	if c.metrics != nil {
+		c.metrics.Gauge("clock.skew", skew.Seconds())
+	}
+
+	// Only count it as skewed if it is even in the best case
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+	skewed := abs-uncertainty > c.threshold
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case skewed && (!c.skewed || received.Sub(c.lastWarned) >= clockSkewWarningInterval):
+		direction := "ahead of"
+		if skew < 0 {
+			direction = "behind"
+		}
+		c.logger.Warn("The system clock is about %v %s Buildkite's, which is more than the %v allowed. "+
+			"This can cause problems with artifact uploads, OIDC tokens and log timestamps. "+
+			"Check that the clock is being synchronised, for example with NTP.",
+			abs.Round(time.Second), direction, c.threshold)
+		c.lastWarned = received
+
+	case !skewed && c.skewed:
+		c.logger.Info("The system clock is back within %v of Buildkite's", c.threshold)
+	}
+
+	c.skewed = skewed
+	return skew
+}
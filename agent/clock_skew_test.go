@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func responseWithDate(date time.Time) *api.Response {
+	return &api.Response{Response: &http.Response{
+		Header: http.Header{"Date": []string{date.UTC().Format(http.TimeFormat)}},
+	}}
+}
+
+func TestClockSkew(t *testing.T) {
+	server := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	sent := server.Add(time.Minute)
+	received := sent.Add(200 * time.Millisecond)
+
+	skew, uncertainty, ok := ClockSkew(responseWithDate(server), sent, received)
+	require.True(t, ok)
+	assert.Equal(t, time.Minute-400*time.Millisecond, skew)
+	assert.Equal(t, 600*time.Millisecond, uncertainty)
+
+	_, _, ok = ClockSkew(&api.Response{Response: &http.Response{Header: http.Header{}}}, sent, received)
+	assert.False(t, ok)
+
+	_, _, ok = ClockSkew(nil, sent, received)
+	assert.False(t, ok)
+}
+
+func TestClockSkewMonitorWarnsOnceUntilFixed(t *testing.T) {
+	l := logger.NewBuffer()
+	monitor := NewClockSkewMonitor(l, nil, 30*time.Second)
+
+	server := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	now := server.Add(-2*time.Minute + 500*time.Millisecond)
+
+	monitor.Observe(responseWithDate(server), now, now)
+	monitor.Observe(responseWithDate(server), now.Add(time.Second), now.Add(time.Second))
+
+	require.Len(t, l.Messages, 1)
+	assert.Contains(t, l.Messages[0], "[warn] The system clock is about 2m0s behind Buildkite's")
+
+	// Warned again after a while
+	later := now.Add(clockSkewWarningInterval)
+	monitor.Observe(responseWithDate(later.Add(2*time.Minute)), later, later)
+	assert.Len(t, l.Messages, 2)
+
+	// Back in sync
+	monitor.Observe(responseWithDate(later), later, later)
+	require.Len(t, l.Messages, 3)
+	assert.Contains(t, l.Messages[2], "[info] The system clock is back within 30s")
+}
+
+func TestClockSkewMonitorIgnoresSkewWithinUncertainty(t *testing.T) {
+	l := logger.NewBuffer()
+	monitor := NewClockSkewMonitor(l, nil, time.Second)
+
+	server := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	// A slow request can't tell us much
+	monitor.Observe(responseWithDate(server), server, server.Add(10*time.Second))
+	assert.Empty(t, l.Messages)
+}
+
+func TestClockSkewMonitorDisabled(t *testing.T) {
+	l := logger.NewBuffer()
+	monitor := NewClockSkewMonitor(l, nil, 0)
+
+	server := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), monitor.Observe(responseWithDate(server), server.Add(time.Hour), server.Add(time.Hour)))
+	assert.Empty(t, l.Messages)
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ControlClient talks to the ControlServer of a running agent
+type ControlClient struct {
+	client *http.Client
+}
+
+// NewControlClient returns a ControlClient that connects to the control
+// socket at the given path
+func NewControlClient(path string) *ControlClient {
+	return &ControlClient{
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return controlDial(ctx, path)
+				},
+			},
+		},
+	}
+}
+
+// RunningJobs lists the jobs the agent is running
+func (c *ControlClient) RunningJobs() ([]RunningJob, error) {
+	var jobs []RunningJob
+	err := c.do(http.MethodGet, "/jobs", nil, &jobs)
+	return jobs, err
+}
+
+// CancelJob asks the agent to cancel the job with the given ID
+func (c *ControlClient) CancelJob(jobID string) (string, error) {
+	return c.message(http.MethodPost, "/jobs/"+url.PathEscape(jobID)+"/cancel", nil)
+}
+
+// SetDebug turns debug logging on or off
+func (c *ControlClient) SetDebug(enabled bool) (string, error) {
+	return c.message(http.MethodPost, "/debug", ControlDebugRequest{Enabled: enabled})
+}
+
+// SetScheduling changes the priority and weight the agents report to
+// Buildkite
+func (c *ControlClient) SetScheduling(req ControlSchedulingRequest) (string, error) {
+	return c.message(http.MethodPost, "/scheduling", req)
+}
+
+// Drain asks the agent to stop once its running jobs have finished
+func (c *ControlClient) Drain() (string, error) {
+	return c.message(http.MethodPost, "/drain", nil)
+}
+
+func (c *ControlClient) message(method, path string, body interface{}) (string, error) {
+	var resp ControlResponse
+	err := c.do(method, path, body, &resp)
+	return resp.Message, err
+}
+
+func (c *ControlClient) do(method, path string, body interface{}, v interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	// The host is ignored, since we always dial the control socket
+	req, err := http.NewRequest(method, "http://agent"+path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp ControlResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Message == "" {
+			return fmt.Errorf("Control request failed with %s", resp.Status)
+		}
+		return fmt.Errorf("%s", errResp.Message)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
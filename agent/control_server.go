@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// RunningJob describes a job that an agent in the pool is running
+type RunningJob struct {
+	Agent     string `json:"agent"`
+	ID        string `json:"id"`
+	Pipeline  string `json:"pipeline"`
+	Label     string `json:"label"`
+	StartedAt string `json:"started_at"`
+}
+
+// ControlDebugRequest is the body of a request to toggle debug logging
+type ControlDebugRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ControlSchedulingRequest is the body of a request to change how Buildkite
+// schedules jobs onto the agents. Settings that are nil are left alone.
+type ControlSchedulingRequest struct {
+	Priority *int `json:"priority,omitempty"`
+	Weight   *int `json:"weight,omitempty"`
+}
+
+// ControlResponse is the body of responses to control requests that don't
+// return anything else
+type ControlResponse struct {
+	Message string `json:"message"`
+}
+
+// ControlServer serves a small HTTP API on a local socket that lets operators
+// manage a running agent without signals
+type ControlServer struct {
+	logger logger.Logger
+	pool   *AgentPool
+	path   string
+
+	listener net.Listener
+	server   *http.Server
+
+	// Listeners handed over to a new agent along with the control socket
+	handover handoverListeners
+
+	// The level to go back to when debug logging is turned off
+	levelMutex    sync.Mutex
+	originalLevel logger.Level
+}
+
+// NewControlServer returns a ControlServer for the pool that will listen on
+// the given unix socket path (or named pipe on Windows)
+func NewControlServer(l logger.Logger, pool *AgentPool, path string) *ControlServer {
+	s := &ControlServer{
+		logger:        l,
+		pool:          pool,
+		path:          path,
+		originalLevel: l.Level(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", s.handleJobs)
+	mux.HandleFunc("/jobs/", s.handleCancelJob)
+	mux.HandleFunc("/debug", s.handleDebug)
+	mux.HandleFunc("/drain", s.handleDrain)
+	mux.HandleFunc("/scheduling", s.handleScheduling)
+	mux.HandleFunc("/handover", s.handleHandover)
+	s.server = &http.Server{Handler: mux}
+
+	return s
+}
+
+// Start listens on the control socket and serves requests in the background
+func (s *ControlServer) Start() error {
+	listener, err := controlListen(s.path)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on control socket %s: %v", s.path, err)
+	}
+
+	s.StartWithListener(listener)
+	return nil
+}
+
+// StartWithListener serves requests in the background on a control socket
+// that's already listening, like one handed over from another agent
+func (s *ControlServer) StartWithListener(listener net.Listener) {
+	s.listener = listener
+
+	s.logger.Notice("Listening for control requests on %s", s.path)
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("Control socket server failed: %v", err)
+		}
+	}()
+}
+
+// Stop closes the control socket
+func (s *ControlServer) Stop() error {
+	return s.server.Close()
+}
+
+func (s *ControlServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		controlError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	controlJSON(w, http.StatusOK, s.pool.RunningJobs())
+}
+
+func (s *ControlServer) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	jobID, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	if !ok || action != "cancel" || jobID == "" {
+		controlError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		controlError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !s.pool.CancelJob(jobID) {
+		controlError(w, http.StatusNotFound, fmt.Sprintf("Job %s isn't running on this agent", jobID))
+		return
+	}
+
+	controlJSON(w, http.StatusAccepted, ControlResponse{Message: fmt.Sprintf("Canceling job %s", jobID)})
+}
+
+func (s *ControlServer) handleDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		controlError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req ControlDebugRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		controlError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	s.levelMutex.Lock()
+	defer s.levelMutex.Unlock()
+
+	level := s.originalLevel
+	if req.Enabled {
+		level = logger.DEBUG
+	}
+
+	s.logger.SetLevel(level)
+	s.pool.SetLogLevel(level)
+	s.logger.Notice("Log level set to %s from the control socket", level)
+
+	controlJSON(w, http.StatusOK, ControlResponse{Message: fmt.Sprintf("Log level set to %s", level)})
+}
+
+func (s *ControlServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		controlError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	s.logger.Notice("Draining agents from the control socket")
+	s.pool.Stop(true)
+
+	controlJSON(w, http.StatusAccepted, ControlResponse{Message: "Draining, agents will stop once their jobs finish"})
+}
+
+func (s *ControlServer) handleScheduling(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		controlError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req ControlSchedulingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		controlError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	if req.Weight != nil && *req.Weight < 1 {
+		controlError(w, http.StatusBadRequest, "The weight must be at least 1")
+		return
+	}
+
+	var changes []string
+	if req.Priority != nil {
+		changes = append(changes, fmt.Sprintf("priority to %d", *req.Priority))
+	}
+	if req.Weight != nil {
+		changes = append(changes, fmt.Sprintf("weight to %d", *req.Weight))
+	}
+	if len(changes) == 0 {
+		controlError(w, http.StatusBadRequest, "Nothing to change")
+		return
+	}
+
+	s.pool.SetScheduling(req)
+	s.logger.Notice("Set %s from the control socket", strings.Join(changes, " and "))
+
+	controlJSON(w, http.StatusOK, ControlResponse{Message: fmt.Sprintf("Set %s, which Buildkite will use from the next ping", strings.Join(changes, " and "))})
+}
+
+func controlJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func controlError(w http.ResponseWriter, status int, message string) {
+	controlJSON(w, status, ControlResponse{Message: message})
+}
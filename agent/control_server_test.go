@@ -0,0 +1,140 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestControlServer(t *testing.T) (*ControlServer, *AgentPool, *ControlClient) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "control-socket")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	l := logger.NewConsoleLogger(logger.NewTextPrinter(ioutil.Discard), func(int) {})
+	l.SetLevel(logger.INFO)
+
+	busy := &AgentWorker{
+		logger: l.WithFields(logger.StringField("agent", "busy")),
+		agent:  &api.AgentRegisterResponse{Name: "busy"},
+		stop:   make(chan struct{}),
+	}
+	busy.jobRunner = &JobRunner{
+		logger: busy.logger,
+		job: &api.Job{
+			ID:        "job-1",
+			StartedAt: "2022-07-01T00:00:00Z",
+			Env: map[string]string{
+				"BUILDKITE_PIPELINE_SLUG": "my-pipeline",
+				"BUILDKITE_LABEL":         ":hammer: Build",
+			},
+		},
+	}
+	idle := &AgentWorker{
+		logger: l.WithFields(logger.StringField("agent", "idle")),
+		agent:  &api.AgentRegisterResponse{Name: "idle"},
+		stop:   make(chan struct{}),
+	}
+
+	pool := NewAgentPool([]*AgentWorker{busy, idle})
+
+	path := filepath.Join(dir, "agent.sock")
+	server := NewControlServer(l, pool, path)
+	require.NoError(t, server.Start())
+	t.Cleanup(func() { server.Stop() })
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	return server, pool, NewControlClient(path)
+}
+
+func TestControlServerListsRunningJobs(t *testing.T) {
+	_, _, client := newTestControlServer(t)
+
+	jobs, err := client.RunningJobs()
+	require.NoError(t, err)
+	assert.Equal(t, []RunningJob{{
+		Agent:     "busy",
+		ID:        "job-1",
+		Pipeline:  "my-pipeline",
+		Label:     ":hammer: Build",
+		StartedAt: "2022-07-01T00:00:00Z",
+	}}, jobs)
+}
+
+func TestControlServerCancelsJobs(t *testing.T) {
+	_, _, client := newTestControlServer(t)
+
+	message, err := client.CancelJob("job-1")
+	require.NoError(t, err)
+	assert.Equal(t, "Canceling job job-1", message)
+
+	_, err = client.CancelJob("job-2")
+	assert.EqualError(t, err, "Job job-2 isn't running on this agent")
+}
+
+func TestControlServerTogglesDebugLogging(t *testing.T) {
+	server, pool, client := newTestControlServer(t)
+
+	_, err := client.SetDebug(true)
+	require.NoError(t, err)
+	assert.Equal(t, logger.DEBUG, server.logger.Level())
+	for _, worker := range pool.workers {
+		assert.Equal(t, logger.DEBUG, worker.logger.Level())
+	}
+
+	_, err = client.SetDebug(false)
+	require.NoError(t, err)
+	assert.Equal(t, logger.INFO, server.logger.Level())
+	for _, worker := range pool.workers {
+		assert.Equal(t, logger.INFO, worker.logger.Level())
+	}
+}
+
+func TestControlServerDrains(t *testing.T) {
+	_, pool, client := newTestControlServer(t)
+
+	_, err := client.Drain()
+	require.NoError(t, err)
+
+	for _, worker := range pool.workers {
+		assert.True(t, worker.stopping)
+	}
+}
+
+func TestControlServerSetsScheduling(t *testing.T) {
+	_, pool, client := newTestControlServer(t)
+
+	priority, weight := 10, 2
+	_, err := client.SetScheduling(ControlSchedulingRequest{Priority: &priority})
+	require.NoError(t, err)
+	_, err = client.SetScheduling(ControlSchedulingRequest{Weight: &weight})
+	require.NoError(t, err)
+
+	for _, worker := range pool.workers {
+		opts := worker.pingOptions()
+		assert.Equal(t, "10", opts.Priority)
+		assert.Equal(t, 2, opts.Weight)
+		assert.Equal(t, "10", worker.registerRequest.Priority)
+	}
+
+	zero := 0
+	_, err = client.SetScheduling(ControlSchedulingRequest{Weight: &zero})
+	assert.EqualError(t, err, "The weight must be at least 1")
+
+	_, err = client.SetScheduling(ControlSchedulingRequest{})
+	assert.EqualError(t, err, "Nothing to change")
+}
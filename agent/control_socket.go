@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"context"
+	"net"
+	"os"
+)
+
+// controlListen listens on a unix socket that only the agent's user can
+// connect to, replacing any stale socket left behind by a previous agent
+func controlListen(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func controlDial(ctx context.Context, path string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", path)
+}
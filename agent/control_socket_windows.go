@@ -0,0 +1,22 @@
+package agent
+
+import (
+	"context"
+	"net"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// Only allow SYSTEM, administrators and the owner of the pipe to connect
+const controlPipeSecurityDescriptor = "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GA;;;OW)"
+
+// controlListen listens on a named pipe, e.g. \\.\pipe\buildkite-agent
+func controlListen(path string) (net.Listener, error) {
+	return winio.ListenPipe(path, &winio.PipeConfig{
+		SecurityDescriptor: controlPipeSecurityDescriptor,
+	})
+}
+
+func controlDial(ctx context.Context, path string) (net.Conn, error) {
+	return winio.DialPipeContext(ctx, path)
+}
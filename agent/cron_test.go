@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2022, time.June, 15, 10, 17, 30, 0, time.UTC)
+
+	for _, tc := range []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2022, time.June, 15, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2022, time.June, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2022, time.June, 16, 3, 0, 0, 0, time.UTC)},
+		{"30 2 * * 1-5", time.Date(2022, time.June, 16, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2022, time.June, 19, 0, 0, 0, 0, time.UTC)},
+		{"0,45 10 * * *", time.Date(2022, time.June, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2022, time.June, 15, 11, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2022, time.June, 19, 0, 0, 0, 0, time.UTC)},
+		// Either the day of the month or the day of the week
+		{"0 0 20 * 5", time.Date(2022, time.June, 17, 0, 0, 0, 0, time.UTC)},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			s, err := parseCronSchedule(tc.spec)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, s.Next(from))
+		})
+	}
+}
+
+func TestCronScheduleNeverMatches(t *testing.T) {
+	s, err := parseCronSchedule("0 0 30 2 *")
+	require.NoError(t, err)
+	assert.True(t, s.Next(time.Now()).IsZero())
+}
+
+func TestParseCronScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@sometimes",
+	} {
+		_, err := parseCronSchedule(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,204 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/hook"
+	"github.com/buildkite/agent/v3/system"
+	"github.com/dustin/go-humanize"
+)
+
+// lowDiskPath is a path without enough free space for a job
+type lowDiskPath struct {
+	path string
+	free uint64
+}
+
+// checkDiskSpace makes sure the build, plugins and temp paths each have at
+// least the configured amount of free space before the job starts. If they
+// don't, it runs the disk-cleanup hook and evicts old checkouts (if enabled)
+// then checks again, returning an error explaining why the job can't run if
+// there still isn't enough.
+func (r *JobRunner) checkDiskSpace() error {
+	min := r.conf.AgentConfiguration.DiskMinFreeSpace
+	if min == 0 {
+		return nil
+	}
+
+	low := r.lowDiskPaths(min)
+	if len(low) == 0 {
+		return nil
+	}
+
+	for _, l := range low {
+		r.logger.Warn("[JobRunner] Only %s free in %s, which is less than %s", humanize.Bytes(l.free), l.path, humanize.Bytes(min))
+	}
+
+	if hookPath, _ := hook.Find(r.conf.AgentConfiguration.HooksPath, "disk-cleanup"); hookPath != "" {
+		if err := r.executeDiskCleanupHook(hookPath, low); err != nil {
+			r.logger.Error("[JobRunner] disk-cleanup hook failed: %v", err)
+		}
+	}
+
+	if r.conf.AgentConfiguration.DiskCleanupCheckouts {
+		r.evictCheckouts(min)
+	}
+
+	low = r.lowDiskPaths(min)
+	if len(low) == 0 {
+		r.logger.Info("[JobRunner] Freed up enough disk space to run the job")
+		return nil
+	}
+
+	var reasons []string
+	for _, l := range low {
+		reasons = append(reasons, fmt.Sprintf("%s has %s free", l.path, humanize.Bytes(l.free)))
+	}
+
+	return fmt.Errorf("Not enough free disk space to run the job, even after cleaning up: %s, but at least %s is needed",
+		strings.Join(reasons, ", "), humanize.Bytes(min))
+}
+
+// lowDiskPaths returns the paths the job uses that have less than min bytes
+// free. Paths that can't be checked are skipped with a warning, since that
+// shouldn't stop jobs from running.
+func (r *JobRunner) lowDiskPaths(min uint64) []lowDiskPath {
+	var low []lowDiskPath
+	seen := map[string]bool{}
+
+	for _, path := range []string{
+		r.conf.AgentConfiguration.BuildPath,
+		r.conf.AgentConfiguration.PluginsPath,
+		os.TempDir(),
+	} {
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		free, err := system.DiskFree(existingParent(path))
+		if err != nil {
+			r.logger.Warn("[JobRunner] Couldn't check free disk space in %s: %v", path, err)
+			continue
+		}
+
+		if free < min {
+			low = append(low, lowDiskPath{path: path, free: free})
+		}
+	}
+
+	return low
+}
+
+func (r *JobRunner) executeDiskCleanupHook(hookPath string, low []lowDiskPath) error {
+	r.logger.Info("[JobRunner] Running disk-cleanup hook %q", hookPath)
+
+	sh, err := shell.New()
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for _, l := range low {
+		paths = append(paths, l.path)
+	}
+
+	// Let the hook know what needs cleaning up
+	sh.Env.Set("BUILDKITE_DISK_LOW_PATHS", strings.Join(paths, string(os.PathListSeparator)))
+	sh.Env.Set("BUILDKITE_DISK_MIN_FREE_SPACE", fmt.Sprintf("%d", r.conf.AgentConfiguration.DiskMinFreeSpace))
+
+	sh.Writer = LogWriter{
+		l: r.logger,
+	}
+
+	return sh.RunWithoutPrompt(hookPath)
+}
+
+// evictCheckouts removes this agent's pipeline checkouts, least recently
+// used first, until the build path has min bytes free or there are none left
+func (r *JobRunner) evictCheckouts(min uint64) {
+	buildPath := r.conf.AgentConfiguration.BuildPath
+	if buildPath == "" {
+		return
+	}
+
+	checkouts := checkoutDirsByLastUse(filepath.Join(buildPath, dirForAgentName(r.agent.Name)))
+
+	for _, dir := range checkouts {
+		free, err := system.DiskFree(existingParent(buildPath))
+		if err != nil || free >= min {
+			return
+		}
+
+		r.logger.Info("[JobRunner] Removing old checkout %s to free up disk space", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			r.logger.Warn("[JobRunner] Failed to remove %s: %v", dir, err)
+		}
+	}
+}
+
+// checkoutDirsByLastUse returns the pipeline checkouts in an agent's build
+// directory, which are laid out as <org>/<pipeline>, oldest first
+func checkoutDirsByLastUse(agentBuildPath string) []string {
+	type checkout struct {
+		path    string
+		modTime int64
+	}
+	var checkouts []checkout
+
+	orgs, _ := ioutil.ReadDir(agentBuildPath)
+	for _, org := range orgs {
+		if !org.IsDir() {
+			continue
+		}
+
+		pipelines, _ := ioutil.ReadDir(filepath.Join(agentBuildPath, org.Name()))
+		for _, pipeline := range pipelines {
+			if !pipeline.IsDir() {
+				continue
+			}
+			checkouts = append(checkouts, checkout{
+				path:    filepath.Join(agentBuildPath, org.Name(), pipeline.Name()),
+				modTime: pipeline.ModTime().UnixNano(),
+			})
+		}
+	}
+
+	sort.SliceStable(checkouts, func(i, j int) bool {
+		return checkouts[i].modTime < checkouts[j].modTime
+	})
+
+	dirs := make([]string, 0, len(checkouts))
+	for _, c := range checkouts {
+		dirs = append(dirs, c.path)
+	}
+	return dirs
+}
+
+// existingParent returns the closest directory to path that exists, since
+// the build path won't exist before the first job
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// dirForAgentName is the directory an agent's checkouts go in within the
+// build path. This must match how the bootstrap names it.
+func dirForAgentName(agentName string) string {
+	return regexp.MustCompile("[[:^alnum:]]").ReplaceAllString(agentName, "-")
+}
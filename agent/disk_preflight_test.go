@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckoutDirsByLastUse(t *testing.T) {
+	dir := t.TempDir()
+
+	now := time.Now()
+	for checkout, age := range map[string]time.Duration{
+		"org/newest":       time.Minute,
+		"other-org/oldest": 3 * time.Hour,
+		"org/middle":       time.Hour,
+	} {
+		path := filepath.Join(dir, checkout)
+		require.NoError(t, os.MkdirAll(path, 0o755))
+
+		mtime := now.Add(-age)
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+
+	// Files at either level aren't checkouts
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "lockfile"), nil, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "org", "lockfile"), nil, 0o644))
+
+	assert.Equal(t, []string{
+		filepath.Join(dir, "other-org", "oldest"),
+		filepath.Join(dir, "org", "middle"),
+		filepath.Join(dir, "org", "newest"),
+	}, checkoutDirsByLastUse(dir))
+}
+
+func TestCheckoutDirsByLastUseWithMissingDir(t *testing.T) {
+	assert.Empty(t, checkoutDirsByLastUse(filepath.Join(t.TempDir(), "nope")))
+}
+
+func TestExistingParent(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.Equal(t, dir, existingParent(dir))
+	assert.Equal(t, dir, existingParent(filepath.Join(dir, "builds", "not", "yet")))
+}
+
+func TestDirForAgentName(t *testing.T) {
+	assert.Equal(t, "My-Agent-1", dirForAgentName("My Agent.1"))
+}
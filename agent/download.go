@@ -1,7 +1,10 @@
 package agent
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"net/http/httputil"
@@ -11,7 +14,7 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/logger"
-	"github.com/buildkite/roko"
+	"github.com/buildkite/agent/v3/retry"
 )
 
 type DownloadConfig struct {
@@ -30,6 +33,11 @@ type DownloadConfig struct {
 	// How many times should it retry the download before giving up
 	Retries int
 
+	// The SHA-1 and SHA-256 checksums the file should have, if they're
+	// known. The download is checked against the SHA-256 if there is one.
+	SHA1Sum   string
+	SHA256Sum string
+
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
 }
@@ -54,10 +62,10 @@ func NewDownload(l logger.Logger, client *http.Client, c DownloadConfig) *Downlo
 }
 
 func (d Download) Start() error {
-	return roko.NewRetrier(
-		roko.WithMaxAttempts(d.conf.Retries),
-		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).Do(func(r *roko.Retrier) error {
+	return retry.NewRetrier(
+		retry.WithMaxAttempts(d.conf.Retries),
+		retry.WithStrategy(retry.Constant(5*time.Second)),
+	).Do(func(r *retry.Retrier) error {
 		err := d.try()
 		if err != nil {
 			d.logger.Warn("Error trying to download %s (%s) %s", d.conf.URL, err, r)
@@ -146,17 +154,49 @@ func (d Download) try() error {
 	}
 	defer fileBuffer.Close()
 
-	// Copy the data to the file
-	bytes, err := io.Copy(fileBuffer, response.Body)
+	// Copy the data to the file, logging how it's going if it's big
+	progress := startTransferProgress(d.logger, "Downloading "+d.conf.Path, response.ContentLength)
+	defer progress.Stop()
+
+	var writer io.Writer = fileBuffer
+	hasher, algorithm, expected := d.checksum()
+	if hasher != nil {
+		writer = io.MultiWriter(fileBuffer, hasher)
+	}
+
+	bytes, err := io.Copy(writer, &progressReader{reader: response.Body, progress: progress})
 	if err != nil {
 		return fmt.Errorf("Error when copying data %s (%T: %v)", d.conf.URL, err, err)
 	}
 
+	// Make sure we got what was uploaded, and don't leave a corrupt file
+	// behind if we didn't
+	if hasher != nil {
+		if actual := fmt.Sprintf("%x", hasher.Sum(nil)); !strings.EqualFold(actual, expected) {
+			fileBuffer.Close()
+			os.Remove(targetFile)
+			return fmt.Errorf("Downloaded file %s has a %s checksum of %s instead of %s", d.conf.Path, algorithm, actual, expected)
+		}
+	}
+
 	d.logger.Info("Successfully downloaded \"%s\" %d bytes", d.conf.Path, bytes)
 
 	return nil
 }
 
+// checksum returns the hash to check the download with, which algorithm it
+// is, and the checksum the download should have. The hash is nil if the
+// checksum isn't known.
+func (d Download) checksum() (hash.Hash, string, string) {
+	if d.conf.SHA256Sum != "" {
+		return sha256.New(), "SHA-256", d.conf.SHA256Sum
+	}
+	if d.conf.SHA1Sum != "" {
+		return sha1.New(), "SHA-1", d.conf.SHA1Sum
+	}
+	return nil, "", ""
+}
+
 type downloadError struct {
 	s string
 }
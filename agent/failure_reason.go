@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Why a job failed. The bootstrap works out most of these, and the agent the
+// rest, and the reason is sent to Buildkite when the job finishes.
+const (
+	// The job's command exited with a non-zero status
+	FailureReasonCommand = "command_failed"
+
+	// A hook failed, other than a checkout or command hook
+	FailureReasonHook = "hook_failed"
+
+	// The job ran for longer than its timeout
+	FailureReasonTimeout = "timed_out"
+
+	// The job was cancelled
+	FailureReasonCancelled = "cancelled"
+
+	// The agent was stopped while it was running the job
+	FailureReasonAgentLost = "agent_lost"
+
+	// Artifacts couldn't be uploaded after the command
+	FailureReasonArtifactUpload = "artifact_upload_failed"
+
+	// The repository couldn't be checked out
+	FailureReasonCheckout = "checkout_failed"
+
+	// A plugin couldn't be checked out
+	FailureReasonPluginFetch = "plugin_fetch_failed"
+
+	// The disk filled up, or didn't have enough space to start the job
+	FailureReasonDiskFull = "disk_full"
+
+	// The job was killed by the out-of-memory killer, or killed when there
+	// was no way to tell whether it was
+	FailureReasonOOMKilled = "oom_killed"
+
+	// The job was killed, but not by the agent or the out-of-memory killer
+	FailureReasonKilled = "killed"
+
+	// The bootstrap couldn't be started
+	FailureReasonProcessStart = "process_start_failed"
+
+	// The job's environment didn't match its schema
+	FailureReasonEnvInvalid = "env_invalid"
+
+	// A plugin's configuration didn't match the schema in its plugin.yml, or
+	// the commands it needs weren't installed
+	FailureReasonPluginInvalid = "plugin_invalid"
+
+	// The commit or ref to build doesn't exist in the repository, usually
+	// because its branch was force-pushed or deleted. Retrying won't help,
+	// and BUILDKITE_GIT_SKIP_MISSING_REFS passes these jobs instead.
+	FailureReasonRefMissing = "ref_missing"
+
+	// The agent doesn't have a capability the step requires, like docker or
+	// enough GPUs, so it needs to run on another agent
+	FailureReasonCapabilityMissing = "capability_missing"
+)
+
+// IsInfraFailure returns whether a failure reason is because of the agent or
+// the host it's running on rather than the job's command. Jobs that fail like
+// this will often pass if they're retried.
+func IsInfraFailure(reason string) bool {
+	switch reason {
+	case FailureReasonCheckout, FailureReasonPluginFetch, FailureReasonDiskFull,
+		FailureReasonOOMKilled, FailureReasonKilled, FailureReasonProcessStart:
+		return true
+	}
+	return false
+}
+
+// JobFailure describes why a job failed. The bootstrap writes one to the file
+// in BUILDKITE_FAILURE_REASON_FILE so the agent can report it.
+type JobFailure struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// IsDiskFull returns whether an error is from running out of disk space
+func IsDiskFull(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "no space left on device")
+}
+
+// WriteJobFailure writes why a job failed to a file for the agent to read
+func WriteJobFailure(path string, failure JobFailure) error {
+	b, err := json.Marshal(failure)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// readJobFailure reads why the bootstrap said the job failed, which is nil if
+// it didn't say
+func readJobFailure(path string) (*JobFailure, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || (err == nil && len(b) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var failure JobFailure
+	if err := json.Unmarshal(b, &failure); err != nil {
+		return nil, fmt.Errorf("Invalid job failure in %s: %v", path, err)
+	}
+	if failure.Reason == "" {
+		return nil, nil
+	}
+	return &failure, nil
+}
+
+// KilledFailure says why what was killed (SIGKILL), the process with the
+// given PID, was, using what the watch found out about the out-of-memory
+// killer
+func KilledFailure(what string, pid int, watch *OOMWatch) *JobFailure {
+	evidence, checked := watch.Check(pid)
+	switch {
+	case evidence != "":
+		return &JobFailure{
+			Reason:  FailureReasonOOMKilled,
+			Message: fmt.Sprintf("The %s was killed by the out-of-memory killer, %s", what, evidence),
+		}
+	case checked:
+		return &JobFailure{
+			Reason:  FailureReasonKilled,
+			Message: fmt.Sprintf("The %s was killed (SIGKILL), but not by the out-of-memory killer", what),
+		}
+	default:
+		return &JobFailure{
+			Reason:  FailureReasonOOMKilled,
+			Message: fmt.Sprintf("The %s was killed (SIGKILL), most likely by the out-of-memory killer", what),
+		}
+	}
+}
+
+// isTimingOut returns whether a job state from Buildkite is for a job that's
+// being cancelled because it timed out
+func isTimingOut(state string) bool {
+	return state == "timing_out" || state == "timed_out"
+}
+
+// findFailure works out why the bootstrap finished with a failure, from what
+// the agent knows about the job and what the bootstrap said
+func (r *JobRunner) findFailure() *JobFailure {
+	switch {
+	case r.timedOut:
+		return &JobFailure{Reason: FailureReasonTimeout, Message: "The job ran for longer than its timeout"}
+	case r.stopped:
+		return &JobFailure{Reason: FailureReasonAgentLost, Message: "The agent was stopped while it was running the job"}
+	case r.cancelled:
+		return &JobFailure{Reason: FailureReasonCancelled, Message: "The job was cancelled"}
+	}
+
+	if ws := r.process.WaitStatus(); ws.Signaled() && ws.Signal() == syscall.SIGKILL {
+		return KilledFailure("bootstrap", r.process.Pid(), r.oomWatch)
+	}
+
+	failure, err := readJobFailure(r.failureReasonFile)
+	if err != nil {
+		r.logger.Warn("%v", err)
+	}
+
+	// Older bootstraps, and bootstraps that fail in ways they can't catch,
+	// won't say why
+	if failure == nil {
+		failure = &JobFailure{
+			Reason:  FailureReasonCommand,
+			Message: fmt.Sprintf("The bootstrap exited with status %d", r.process.WaitStatus().ExitStatus()),
+		}
+	}
+	return failure
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobFailureRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failure-reason")
+
+	failure, err := readJobFailure(path)
+	require.NoError(t, err)
+	assert.Nil(t, failure)
+
+	require.NoError(t, WriteJobFailure(path, JobFailure{Reason: FailureReasonCheckout, Message: "exit status 128"}))
+
+	failure, err = readJobFailure(path)
+	require.NoError(t, err)
+	assert.Equal(t, &JobFailure{Reason: FailureReasonCheckout, Message: "exit status 128"}, failure)
+}
+
+func TestIsDiskFull(t *testing.T) {
+	assert.True(t, IsDiskFull(errors.New("write /tmp/foo: No space left on device")))
+	assert.False(t, IsDiskFull(errors.New("exit status 1")))
+	assert.False(t, IsDiskFull(nil))
+}
+
+func TestInfraFailureAnnotation(t *testing.T) {
+	failure := &JobFailure{Reason: FailureReasonOOMKilled, Message: "Killed"}
+
+	assert.Equal(t, "**:hammer: Test** failed because of a problem with agent `agent-1`, not its command (`oom_killed`): Killed",
+		infraFailureAnnotation(":hammer: Test", "agent-1", failure))
+	assert.Equal(t, "**A job** failed because of a problem with agent `agent-1`, not its command (`oom_killed`): Killed",
+		infraFailureAnnotation("", "agent-1", failure))
+}
+
+func TestIsInfraFailure(t *testing.T) {
+	assert.True(t, IsInfraFailure(FailureReasonCheckout))
+	assert.True(t, IsInfraFailure(FailureReasonOOMKilled))
+	assert.True(t, IsInfraFailure(FailureReasonKilled))
+	assert.False(t, IsInfraFailure(FailureReasonCommand))
+	assert.False(t, IsInfraFailure(FailureReasonCancelled))
+	assert.False(t, IsInfraFailure(""))
+}
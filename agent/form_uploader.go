@@ -15,7 +15,6 @@ import (
 	// "net/http/httputil"
 	"errors"
 	"net/url"
-	"os"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
@@ -148,7 +147,7 @@ func createUploadRequest(l logger.Logger, artifact *api.Artifact) (*http.Request
 		}
 	}
 
-	fh, err := os.Open(artifact.AbsolutePath)
+	fh, err := openArtifact(l, artifact)
 	if err != nil {
 		return nil, err
 	}
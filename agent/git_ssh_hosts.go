@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GitSSHHost is how git should connect to a repository host over SSH, for
+// networks where the defaults don't work
+type GitSSHHost struct {
+	Host       string
+	Port       int
+	Identity   string
+	KnownHosts string
+}
+
+// ParseGitSSHHosts parses SSH settings for repository hosts in the form
+// "host port=2222 identity=/path/to/key known-hosts=/path/to/known_hosts",
+// where each of the settings is optional
+func ParseGitSSHHosts(specs []string) ([]GitSSHHost, error) {
+	var hosts []GitSSHHost
+	seen := map[string]bool{}
+
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Invalid git SSH host %q, expected a host followed by port=, identity= or known-hosts= settings", spec)
+		}
+
+		host := GitSSHHost{Host: fields[0]}
+		if seen[host.Host] {
+			return nil, fmt.Errorf("Git SSH host %q is defined more than once", host.Host)
+		}
+		seen[host.Host] = true
+
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok || value == "" {
+				return nil, fmt.Errorf("Invalid setting %q for git SSH host %q, expected key=value", field, host.Host)
+			}
+
+			switch key {
+			case "port":
+				port, err := strconv.Atoi(value)
+				if err != nil || port < 1 || port > 65535 {
+					return nil, fmt.Errorf("Invalid port %q for git SSH host %q", value, host.Host)
+				}
+				host.Port = port
+			case "identity":
+				host.Identity = value
+			case "known-hosts":
+				host.KnownHosts = value
+			default:
+				return nil, fmt.Errorf("Unknown setting %q for git SSH host %q", key, host.Host)
+			}
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
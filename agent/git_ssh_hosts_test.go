@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGitSSHHosts(t *testing.T) {
+	t.Parallel()
+
+	hosts, err := ParseGitSSHHosts([]string{
+		"github.com port=443 identity=/etc/buildkite-agent/github_key",
+		"git.internal known-hosts=/etc/buildkite-agent/known_hosts",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []GitSSHHost{
+		{Host: "github.com", Port: 443, Identity: "/etc/buildkite-agent/github_key"},
+		{Host: "git.internal", KnownHosts: "/etc/buildkite-agent/known_hosts"},
+	}, hosts)
+}
+
+func TestParseGitSSHHostsErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, specs := range [][]string{
+		{"github.com"},
+		{"github.com port"},
+		{"github.com port=ssh"},
+		{"github.com port=70000"},
+		{"github.com user=git"},
+		{"github.com port=22", "github.com port=443"},
+	} {
+		_, err := ParseGitSSHHosts(specs)
+		assert.Error(t, err, "%q", specs)
+	}
+}
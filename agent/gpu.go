@@ -0,0 +1,401 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/gofrs/flock"
+)
+
+// GPU is a GPU on the agent's host
+type GPU struct {
+	// Either "nvidia" or "amd"
+	Vendor string
+
+	// The GPU's index amongst the vendor's GPUs, like CUDA_VISIBLE_DEVICES
+	// and HIP_VISIBLE_DEVICES use
+	Index int
+
+	UUID   string
+	Model  string
+	Driver string
+
+	// The UUIDs of the GPU's MIG partitions, if it's been partitioned
+	MIGDevices []string
+}
+
+// How long to wait for nvidia-smi, which can hang on a broken driver
+var gpuDetectTimeout = 10 * time.Second
+
+// The root of sysfs, where AMD GPUs are found
+var gpuSysfsRoot = "/sys"
+
+// DetectGPUs finds the NVIDIA GPUs that nvidia-smi knows about, and the AMD
+// GPUs that the amdgpu driver has bound to. A host without GPUs has none,
+// rather than an error.
+func DetectGPUs(l logger.Logger) []GPU {
+	var gpus []GPU
+
+	if _, err := exec.LookPath("nvidia-smi"); err == nil {
+		nvidia, err := detectNVIDIAGPUs()
+		if err != nil {
+			l.Warn("Failed to detect NVIDIA GPUs: %v", err)
+		}
+		gpus = append(gpus, nvidia...)
+	}
+
+	amd, err := detectAMDGPUs(gpuSysfsRoot)
+	if err != nil {
+		l.Warn("Failed to detect AMD GPUs: %v", err)
+	}
+	gpus = append(gpus, amd...)
+
+	return gpus
+}
+
+// detectNVIDIAGPUs asks nvidia-smi for the host's GPUs and their MIG
+// partitions
+func detectNVIDIAGPUs() ([]GPU, error) {
+	query, err := nvidiaSMI("--query-gpu=index,uuid,name,driver_version", "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+
+	gpus, err := parseNVIDIAGPUs(strings.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := nvidiaSMI("-L")
+	if err != nil {
+		return nil, err
+	}
+
+	mig := parseNVIDIAMIGDevices(strings.NewReader(list))
+	for i := range gpus {
+		gpus[i].MIGDevices = mig[gpus[i].UUID]
+	}
+
+	return gpus, nil
+}
+
+func nvidiaSMI(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gpuDetectTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "nvidia-smi", args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("nvidia-smi %s failed: %v", strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
+
+// parseNVIDIAGPUs parses nvidia-smi's CSV of index, uuid, name and driver
+func parseNVIDIAGPUs(r io.Reader) ([]GPU, error) {
+	var gpus []GPU
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected nvidia-smi output %q", line)
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		index, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected nvidia-smi output %q", line)
+		}
+
+		gpus = append(gpus, GPU{
+			Vendor: "nvidia",
+			Index:  index,
+			UUID:   fields[1],
+			Model:  fields[2],
+			Driver: fields[3],
+		})
+	}
+
+	return gpus, scanner.Err()
+}
+
+var (
+	nvidiaGPUPattern = regexp.MustCompile(`^GPU \d+: .*\(UUID: (\S+)\)`)
+	nvidiaMIGPattern = regexp.MustCompile(`^\s+MIG .*\(UUID: (\S+)\)`)
+)
+
+// parseNVIDIAMIGDevices parses the output of `nvidia-smi -L` into the UUIDs of
+// the MIG partitions of each GPU, by the GPU's UUID
+func parseNVIDIAMIGDevices(r io.Reader) map[string][]string {
+	devices := map[string][]string{}
+
+	var gpu string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if m := nvidiaGPUPattern.FindStringSubmatch(scanner.Text()); m != nil {
+			gpu = m[1]
+		} else if m := nvidiaMIGPattern.FindStringSubmatch(scanner.Text()); m != nil && gpu != "" {
+			devices[gpu] = append(devices[gpu], m[1])
+		}
+	}
+
+	return devices
+}
+
+// detectAMDGPUs finds the GPUs the amdgpu driver has bound to in sysfs, in
+// the order HIP numbers them
+func detectAMDGPUs(root string) ([]GPU, error) {
+	cards, err := filepath.Glob(filepath.Join(root, "class", "drm", "card[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+
+	// card10 comes after card9
+	sort.Slice(cards, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(cards[i]), "card"))
+		b, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(cards[j]), "card"))
+		return a < b
+	})
+
+	driver := readSysfs(filepath.Join(root, "module", "amdgpu", "version"))
+
+	var gpus []GPU
+	for _, card := range cards {
+		// Connectors, like card0-DP-1, aren't GPUs
+		if strings.Contains(filepath.Base(card), "-") {
+			continue
+		}
+		if readSysfs(filepath.Join(card, "device", "vendor")) != "0x1002" {
+			continue
+		}
+
+		model := readSysfs(filepath.Join(card, "device", "product_name"))
+		if model == "" {
+			model = readSysfs(filepath.Join(card, "device", "device"))
+		}
+
+		gpus = append(gpus, GPU{
+			Vendor: "amd",
+			Index:  len(gpus),
+			UUID:   readSysfs(filepath.Join(card, "device", "unique_id")),
+			Model:  model,
+			Driver: driver,
+		})
+	}
+
+	return gpus, nil
+}
+
+func readSysfs(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// GPUTags returns the agent tags that describe the host's GPUs
+func GPUTags(gpus []GPU) []string {
+	if len(gpus) == 0 {
+		return []string{"gpu-count=0"}
+	}
+
+	tags := []string{
+		fmt.Sprintf("gpu-count=%d", len(gpus)),
+		fmt.Sprintf("gpu-vendor=%s", joinUnique(gpus, func(g GPU) string { return g.Vendor })),
+		fmt.Sprintf("gpu-model=%s", joinUnique(gpus, func(g GPU) string { return g.Model })),
+		fmt.Sprintf("gpu-driver=%s", joinUnique(gpus, func(g GPU) string { return g.Driver })),
+	}
+
+	mig := 0
+	for _, gpu := range gpus {
+		mig += len(gpu.MIGDevices)
+	}
+	if mig > 0 {
+		tags = append(tags, fmt.Sprintf("gpu-mig-devices=%d", mig))
+	}
+
+	return tags
+}
+
+// gpuEnv returns the environment that describes the host's GPUs to jobs
+func gpuEnv(gpus []GPU) map[string]string {
+	return map[string]string{
+		"BUILDKITE_AGENT_GPU_COUNT":  strconv.Itoa(len(gpus)),
+		"BUILDKITE_AGENT_GPU_VENDOR": joinUnique(gpus, func(g GPU) string { return g.Vendor }),
+		"BUILDKITE_AGENT_GPU_MODEL":  joinUnique(gpus, func(g GPU) string { return g.Model }),
+		"BUILDKITE_AGENT_GPU_DRIVER": joinUnique(gpus, func(g GPU) string { return g.Driver }),
+	}
+}
+
+// joinUnique joins the distinct values of a GPU field with semicolons, which
+// tags can't be split on
+func joinUnique(gpus []GPU, field func(GPU) string) string {
+	var values []string
+	seen := map[string]bool{}
+	for _, gpu := range gpus {
+		if v := field(gpu); v != "" && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	return strings.Join(values, ";")
+}
+
+// gpuDevice is a GPU, or a MIG partition of one, that a job can be given
+type gpuDevice struct {
+	vendor string
+
+	// What the device is called in CUDA_VISIBLE_DEVICES or
+	// HIP_VISIBLE_DEVICES
+	id string
+}
+
+// gpuDevices returns the devices jobs can be given, which are the MIG
+// partitions of partitioned GPUs, and the rest of the GPUs whole
+func gpuDevices(gpus []GPU) []gpuDevice {
+	var devices []gpuDevice
+	for _, gpu := range gpus {
+		if len(gpu.MIGDevices) > 0 {
+			for _, mig := range gpu.MIGDevices {
+				devices = append(devices, gpuDevice{vendor: gpu.Vendor, id: mig})
+			}
+			continue
+		}
+		devices = append(devices, gpuDevice{vendor: gpu.Vendor, id: strconv.Itoa(gpu.Index)})
+	}
+	return devices
+}
+
+// GPUAllocator gives jobs their own GPUs, so the agent's workers, or other
+// agents on the host, don't run jobs on the same ones. Each device is a file
+// lock in a directory shared by the agents on the host.
+type GPUAllocator struct {
+	path    string
+	devices []gpuDevice
+	perJob  int
+}
+
+// NewGPUAllocator returns an allocator that gives each job perJob of the
+// host's GPUs, with its locks in path
+func NewGPUAllocator(path string, gpus []GPU, perJob int) (*GPUAllocator, error) {
+	devices := gpuDevices(gpus)
+	if perJob > len(devices) {
+		return nil, fmt.Errorf("Jobs can't have %d GPUs each when the host only has %d", perJob, len(devices))
+	}
+
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return nil, err
+	}
+
+	return &GPUAllocator{
+		path:    path,
+		devices: devices,
+		perJob:  perJob,
+	}, nil
+}
+
+// GPUAllocation is the GPUs a job has been given
+type GPUAllocation struct {
+	devices []gpuDevice
+	locks   []*flock.Flock
+}
+
+// tryAllocate locks enough free devices for a job, or returns nil if there
+// aren't enough free. Workers allocate before they ask for a job, so they only
+// accept ones they have GPUs for, and release them once the job finishes.
+func (a *GPUAllocator) tryAllocate() (*GPUAllocation, error) {
+	allocation := &GPUAllocation{}
+
+	for _, device := range a.devices {
+		if len(allocation.devices) == a.perJob {
+			break
+		}
+
+		lock := flock.New(filepath.Join(a.path, gpuLockName(device)))
+		locked, err := lock.TryLock()
+		if err != nil {
+			allocation.Release()
+			return nil, fmt.Errorf("Failed to lock GPU %s: %v", device.id, err)
+		}
+		if locked {
+			allocation.devices = append(allocation.devices, device)
+			allocation.locks = append(allocation.locks, lock)
+		}
+	}
+
+	if len(allocation.devices) < a.perJob {
+		allocation.Release()
+		return nil, nil
+	}
+
+	return allocation, nil
+}
+
+func gpuLockName(device gpuDevice) string {
+	return fmt.Sprintf("%s-%s.lock", device.vendor, strings.ReplaceAll(device.id, "/", "-"))
+}
+
+// Release unlocks the job's GPUs
+func (g *GPUAllocation) Release() {
+	if g == nil {
+		return
+	}
+	for _, lock := range g.locks {
+		lock.Unlock()
+	}
+	g.locks = nil
+}
+
+// Env returns the environment that limits a job to its GPUs
+func (g *GPUAllocation) Env() map[string]string {
+	if g == nil {
+		return nil
+	}
+
+	var nvidia, amd []string
+	for _, device := range g.devices {
+		switch device.vendor {
+		case "nvidia":
+			nvidia = append(nvidia, device.id)
+		case "amd":
+			amd = append(amd, device.id)
+		}
+	}
+
+	env := map[string]string{}
+	if len(nvidia) > 0 {
+		env["CUDA_VISIBLE_DEVICES"] = strings.Join(nvidia, ",")
+		env["NVIDIA_VISIBLE_DEVICES"] = strings.Join(nvidia, ",")
+	}
+	if len(amd) > 0 {
+		env["HIP_VISIBLE_DEVICES"] = strings.Join(amd, ",")
+		env["ROCR_VISIBLE_DEVICES"] = strings.Join(amd, ",")
+	}
+
+	var all []string
+	for _, device := range g.devices {
+		all = append(all, device.id)
+	}
+	env["BUILDKITE_AGENT_GPUS"] = strings.Join(all, ",")
+
+	return env
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNVIDIAGPUs(t *testing.T) {
+	t.Parallel()
+
+	gpus, err := parseNVIDIAGPUs(strings.NewReader(
+		"0, GPU-5d5ba0d6, NVIDIA A100-SXM4-40GB, 515.65.01\n" +
+			"1, GPU-9e3c1b2a, NVIDIA A100-SXM4-40GB, 515.65.01\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []GPU{
+		{Vendor: "nvidia", Index: 0, UUID: "GPU-5d5ba0d6", Model: "NVIDIA A100-SXM4-40GB", Driver: "515.65.01"},
+		{Vendor: "nvidia", Index: 1, UUID: "GPU-9e3c1b2a", Model: "NVIDIA A100-SXM4-40GB", Driver: "515.65.01"},
+	}, gpus)
+
+	_, err = parseNVIDIAGPUs(strings.NewReader("No devices were found\n"))
+	assert.Error(t, err)
+}
+
+func TestParseNVIDIAMIGDevices(t *testing.T) {
+	t.Parallel()
+
+	devices := parseNVIDIAMIGDevices(strings.NewReader(
+		"GPU 0: NVIDIA A100-SXM4-40GB (UUID: GPU-5d5ba0d6)\n" +
+			"  MIG 3g.20gb     Device  0: (UUID: MIG-c6d4f1ef)\n" +
+			"  MIG 3g.20gb     Device  1: (UUID: MIG-0a2b4c6d)\n" +
+			"GPU 1: NVIDIA A100-SXM4-40GB (UUID: GPU-9e3c1b2a)\n"))
+	assert.Equal(t, map[string][]string{
+		"GPU-5d5ba0d6": {"MIG-c6d4f1ef", "MIG-0a2b4c6d"},
+	}, devices)
+}
+
+func TestDetectAMDGPUs(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	writeSysfs := func(path, content string) {
+		path = filepath.Join(root, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(t, os.WriteFile(path, []byte(content+"\n"), 0666))
+	}
+
+	writeSysfs("module/amdgpu/version", "5.18.2")
+	writeSysfs("class/drm/card0/device/vendor", "0x8086")
+	writeSysfs("class/drm/card1/device/vendor", "0x1002")
+	writeSysfs("class/drm/card1/device/product_name", "AMD Instinct MI210")
+	writeSysfs("class/drm/card1-DP-1/device/vendor", "0x1002")
+	writeSysfs("class/drm/card10/device/vendor", "0x1002")
+	writeSysfs("class/drm/card10/device/device", "0x740f")
+
+	gpus, err := detectAMDGPUs(root)
+	require.NoError(t, err)
+	assert.Equal(t, []GPU{
+		{Vendor: "amd", Index: 0, Model: "AMD Instinct MI210", Driver: "5.18.2"},
+		{Vendor: "amd", Index: 1, Model: "0x740f", Driver: "5.18.2"},
+	}, gpus)
+}
+
+func TestGPUTags(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{"gpu-count=0"}, GPUTags(nil))
+
+	assert.Equal(t, []string{
+		"gpu-count=2",
+		"gpu-vendor=nvidia",
+		"gpu-model=NVIDIA A100-SXM4-40GB",
+		"gpu-driver=515.65.01",
+		"gpu-mig-devices=2",
+	}, GPUTags([]GPU{
+		{Vendor: "nvidia", Index: 0, Model: "NVIDIA A100-SXM4-40GB", Driver: "515.65.01", MIGDevices: []string{"MIG-a", "MIG-b"}},
+		{Vendor: "nvidia", Index: 1, Model: "NVIDIA A100-SXM4-40GB", Driver: "515.65.01"},
+	}))
+}
+
+func TestGPUAllocator(t *testing.T) {
+	t.Parallel()
+
+	gpus := []GPU{
+		{Vendor: "nvidia", Index: 0, MIGDevices: []string{"MIG-a", "MIG-b"}},
+		{Vendor: "nvidia", Index: 1},
+	}
+
+	dir := t.TempDir()
+	a, err := NewGPUAllocator(dir, gpus, 2)
+	require.NoError(t, err)
+
+	// Another agent on the host shares the same locks
+	b, err := NewGPUAllocator(dir, gpus, 2)
+	require.NoError(t, err)
+
+	first, err := a.tryAllocate()
+	require.NoError(t, err)
+	require.NotNil(t, first)
+	assert.Equal(t, map[string]string{
+		"CUDA_VISIBLE_DEVICES":   "MIG-a,MIG-b",
+		"NVIDIA_VISIBLE_DEVICES": "MIG-a,MIG-b",
+		"BUILDKITE_AGENT_GPUS":   "MIG-a,MIG-b",
+	}, first.Env())
+
+	// Only one device is left, which isn't enough
+	second, err := b.tryAllocate()
+	require.NoError(t, err)
+	assert.Nil(t, second)
+
+	first.Release()
+
+	second, err = b.tryAllocate()
+	require.NoError(t, err)
+	require.NotNil(t, second)
+	second.Release()
+
+	_, err = NewGPUAllocator(dir, gpus, 4)
+	assert.EqualError(t, err, "Jobs can't have 4 GPUs each when the host only has 3")
+}
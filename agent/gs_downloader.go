@@ -3,7 +3,7 @@ package agent
 import (
 	"errors"
 	"fmt"
-	"strings"
+	"net/http"
 
 	"github.com/buildkite/agent/v3/logger"
 	storage "google.golang.org/api/storage/v1"
@@ -43,43 +43,46 @@ func NewGSDownloader(l logger.Logger, c GSDownloaderConfig) *GSDownloader {
 }
 
 func (d GSDownloader) Start() error {
+	client, conf, err := d.request()
+	if err != nil {
+		return err
+	}
+
+	return NewDownload(d.logger, client, conf).Start()
+}
+
+// request returns an authenticated client and the config for downloading
+// the file from the Google Cloud Storage API
+func (d GSDownloader) request() (*http.Client, DownloadConfig, error) {
 	client, err := newGoogleClient(storage.DevstorageReadOnlyScope)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Error creating Google Cloud Storage client: %v", err))
+		return nil, DownloadConfig{}, errors.New(fmt.Sprintf("Error creating Google Cloud Storage client: %v", err))
 	}
 
 	url := "https://www.googleapis.com/storage/v1/b/" + d.BucketName() + "/o/" + escape(d.BucketFileLocation()) + "?alt=media"
 
 	// We can now cheat and pass the URL onto our regular downloader
-	return NewDownload(d.logger, client, DownloadConfig{
+	return client, DownloadConfig{
 		URL:         url,
 		Path:        d.conf.Path,
 		Destination: d.conf.Destination,
 		Retries:     d.conf.Retries,
 		DebugHTTP:   d.conf.DebugHTTP,
-	}).Start()
+	}, nil
 }
 
 func (d GSDownloader) BucketFileLocation() string {
-	if d.BucketPath() != "" {
-		return strings.TrimSuffix(d.BucketPath(), "/") + "/" + strings.TrimPrefix(d.conf.Path, "/")
-	} else {
-		return d.conf.Path
-	}
+	return storageKey(d.BucketPath(), d.conf.Path)
 }
 
 func (d GSDownloader) BucketPath() string {
-	return strings.Join(d.destinationParts()[1:len(d.destinationParts())], "/")
+	_, path := splitStorageDestination(d.conf.Bucket, "gs")
+	return path
 }
 
 func (d GSDownloader) BucketName() string {
-	return d.destinationParts()[0]
-}
-
-func (d GSDownloader) destinationParts() []string {
-	trimmed := strings.TrimPrefix(d.conf.Bucket, "gs://")
-
-	return strings.Split(trimmed, "/")
+	name, _ := splitStorageDestination(d.conf.Bucket, "gs")
+	return name
 }
 
 func escape(s string) string {
@@ -65,10 +65,7 @@ func NewGSUploader(l logger.Logger, c GSUploaderConfig) (*GSUploader, error) {
 }
 
 func ParseGSDestination(destination string) (name string, path string) {
-	parts := strings.Split(strings.TrimPrefix(string(destination), "gs://"), "/")
-	path = strings.Join(parts[1:len(parts)], "/")
-	name = parts[0]
-	return
+	return splitStorageDestination(destination, "gs")
 }
 
 func clientFromJSON(data []byte, scope string) (*http.Client, error) {
@@ -145,10 +142,11 @@ func (u *GSUploader) Upload(artifact *api.Artifact) error {
 		ContentType:        artifact.ContentType,
 		ContentDisposition: u.contentDisposition(artifact),
 	}
-	file, err := os.Open(artifact.AbsolutePath)
+	file, err := openArtifact(u.logger, artifact)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Failed to open file \"%q\" (%v)", artifact.AbsolutePath, err))
 	}
+	defer file.Close()
 	call := u.service.Objects.Insert(u.BucketName, object)
 	if permission != "" {
 		call = call.PredefinedAcl(permission)
@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// The names of the listeners that are handed over to a new agent
+const (
+	HandoverControlListener     = "control"
+	HandoverHealthCheckListener = "health-check"
+)
+
+// HandoverRequest is the body of a request from a new agent to take over from
+// the running one
+type HandoverRequest struct {
+	// How many agents the new agent is going to run
+	Spawn int `json:"spawn"`
+}
+
+// handoverState is what the running agent sends to the new one. The
+// listeners themselves are sent alongside it, in the same order as their
+// names, where the platform supports it.
+type handoverState struct {
+	Agents    []*api.AgentRegisterResponse `json:"agents"`
+	Listeners []string                     `json:"listeners"`
+}
+
+// Handover is what a new agent takes over from a running one
+type Handover struct {
+	// The registrations of the running agent's workers, which the new agent
+	// uses instead of registering again so they keep their place
+	Agents []*api.AgentRegisterResponse
+
+	// The running agent's listeners, by name, so the control socket and
+	// health check carry on without a gap
+	Listeners map[string]net.Listener
+}
+
+// RequestHandover asks the agent with the control socket at path to hand its
+// registrations and listeners over to this process, and to stop once its
+// running jobs have finished without disconnecting from Buildkite
+func RequestHandover(ctx context.Context, path string, spawn int) (*Handover, error) {
+	conn, err := controlDial(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to control socket %s: %v", path, err)
+	}
+	defer conn.Close()
+
+	body, err := json.Marshal(HandoverRequest{Spawn: spawn})
+	if err != nil {
+		return nil, err
+	}
+
+	// The response isn't HTTP, since the running agent takes over the
+	// connection to pass its listeners along
+	req, err := http.NewRequest(http.MethodPost, "http://agent/handover", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	payload, files, err := receiveHandover(conn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to receive the handover: %v", err)
+	}
+
+	// Requests the running agent won't hand over for get a normal response
+	if bytes.HasPrefix(payload, []byte("HTTP/")) {
+		closeFiles(files)
+		return nil, handoverRefused(payload)
+	}
+
+	var state handoverState
+	if err := json.Unmarshal(payload, &state); err != nil {
+		closeFiles(files)
+		return nil, fmt.Errorf("Invalid handover from the running agent: %v", err)
+	}
+
+	handover := &Handover{
+		Agents:    state.Agents,
+		Listeners: map[string]net.Listener{},
+	}
+
+	if len(files) != len(state.Listeners) {
+		closeFiles(files)
+		return nil, fmt.Errorf("Expected %d listeners from the running agent, but got %d", len(state.Listeners), len(files))
+	}
+
+	for i, f := range files {
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to use the %s listener: %v", state.Listeners[i], err)
+		}
+		handover.Listeners[state.Listeners[i]] = ln
+	}
+
+	return handover, nil
+}
+
+// handoverListeners are the listeners the control server hands over to a
+// new agent along with its own
+type handoverListeners struct {
+	sync.Mutex
+	names     []string
+	listeners []net.Listener
+}
+
+// AddHandoverListener adds a listener, like the health check's, that's
+// handed over to a new agent, and closed once it has been
+func (s *ControlServer) AddHandoverListener(name string, ln net.Listener) {
+	s.handover.Lock()
+	defer s.handover.Unlock()
+
+	s.handover.names = append(s.handover.names, name)
+	s.handover.listeners = append(s.handover.listeners, ln)
+}
+
+func (s *ControlServer) handleHandover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		controlError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req HandoverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		controlError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		controlError(w, http.StatusInternalServerError, "The control socket doesn't support handovers")
+		return
+	}
+
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		s.logger.Error("Failed to take over the control connection for a handover: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	s.handover.Lock()
+	defer s.handover.Unlock()
+
+	state := handoverState{
+		Agents:    s.pool.Registrations(req.Spawn),
+		Listeners: []string{HandoverControlListener},
+	}
+	listeners := []net.Listener{s.listener}
+
+	state.Listeners = append(state.Listeners, s.handover.names...)
+	listeners = append(listeners, s.handover.listeners...)
+
+	if !handoverListenersSupported {
+		state.Listeners = nil
+		listeners = nil
+	}
+
+	payload, err := json.Marshal(state)
+	if err != nil {
+		s.logger.Error("Failed to hand over to a new agent: %v", err)
+		return
+	}
+
+	if err := sendHandover(conn, payload, listeners); err != nil {
+		s.logger.Error("Failed to hand over to a new agent: %v", err)
+		return
+	}
+
+	s.logger.Notice("Handed over %d agent(s) to a new agent, stopping once running jobs have finished", len(state.Agents))
+	s.pool.HandOver(len(state.Agents))
+
+	// The new agent has its own copies of the listeners, so these can be
+	// closed without removing the control socket
+	for _, ln := range listeners {
+		keepListenerPath(ln)
+	}
+	for _, ln := range s.handover.listeners {
+		ln.Close()
+	}
+	go s.server.Close()
+}
+
+// handoverRefused returns the error from a running agent that didn't hand
+// over
+func handoverRefused(payload []byte) error {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(payload)), nil)
+	if err != nil {
+		return fmt.Errorf("Invalid response from the running agent: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var errResp ControlResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Message == "" {
+		return fmt.Errorf("The running agent refused the handover with %s", resp.Status)
+	}
+	return fmt.Errorf("The running agent refused the handover: %s", errResp.Message)
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
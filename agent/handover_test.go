@@ -0,0 +1,90 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandoverPassesRegistrationsAndListeners(t *testing.T) {
+	server, pool, _ := newTestControlServer(t)
+
+	health, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server.AddHandoverListener(HandoverHealthCheckListener, health)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	handover, err := RequestHandover(ctx, server.path, 1)
+	require.NoError(t, err)
+
+	require.Len(t, handover.Agents, 1)
+	assert.Equal(t, "busy", handover.Agents[0].Name)
+
+	// The running agent stops, without disconnecting the handed over worker
+	require.Eventually(t, pool.HandedOver, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, pool.isHandedOver(pool.workers[0]))
+	assert.False(t, pool.isHandedOver(pool.workers[1]))
+	require.Eventually(t, func() bool {
+		for _, worker := range pool.workers {
+			worker.stopMutex.Lock()
+			stopping := worker.stopping
+			worker.stopMutex.Unlock()
+			if !stopping {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The control socket keeps working for the new agent
+	require.Contains(t, handover.Listeners, HandoverControlListener)
+	newServer := NewControlServer(server.logger, NewAgentPool(nil), server.path)
+	newServer.StartWithListener(handover.Listeners[HandoverControlListener])
+	t.Cleanup(func() { newServer.Stop() })
+
+	jobs, err := NewControlClient(server.path).RunningJobs()
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	// So does the health check, on the same address
+	require.Contains(t, handover.Listeners, HandoverHealthCheckListener)
+	healthListener := handover.Listeners[HandoverHealthCheckListener]
+	defer healthListener.Close()
+	go http.Serve(healthListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+
+	resp, err := http.Get("http://" + health.Addr().String())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "OK", string(body))
+}
+
+func TestHandoverOnlyPassesRegistrationsItHas(t *testing.T) {
+	server, _, _ := newTestControlServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	handover, err := RequestHandover(ctx, server.path, 5)
+	require.NoError(t, err)
+	defer handover.Listeners[HandoverControlListener].Close()
+
+	require.Len(t, handover.Agents, 2)
+	assert.Equal(t, "busy", handover.Agents[0].Name)
+	assert.Equal(t, "idle", handover.Agents[1].Name)
+}
@@ -0,0 +1,100 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Listeners are passed to the new agent over the control socket
+const handoverListenersSupported = true
+
+// The most listeners that can be handed over
+const maxHandoverListeners = 8
+
+// sendHandover sends the handover state, along with the listeners' file
+// descriptors, over the control socket connection
+func sendHandover(conn net.Conn, payload []byte, listeners []net.Listener) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("The control connection isn't a unix socket")
+	}
+
+	var fds []int
+	for _, ln := range listeners {
+		filer, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("Can't hand over a %T", ln)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fds = append(fds, int(f.Fd()))
+	}
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+
+	_, _, err := uc.WriteMsgUnix(payload, oob, nil)
+	return err
+}
+
+// receiveHandover reads the handover state and any listeners sent with it
+func receiveHandover(conn net.Conn) ([]byte, []*os.File, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, nil, fmt.Errorf("The control connection isn't a unix socket")
+	}
+
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, syscall.CmsgSpace(maxHandoverListeners*4))
+
+	n, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []*os.File
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, msg := range msgs {
+			fds, err := syscall.ParseUnixRights(&msg)
+			if err != nil {
+				closeFiles(files)
+				return nil, nil, err
+			}
+			for _, fd := range fds {
+				files = append(files, os.NewFile(uintptr(fd), "handover"))
+			}
+		}
+	}
+
+	// The state can be bigger than a single read
+	rest, err := io.ReadAll(uc)
+	if err != nil {
+		closeFiles(files)
+		return nil, nil, err
+	}
+
+	return append(buf[:n], rest...), files, nil
+}
+
+// keepListenerPath stops a unix socket listener removing its socket when it's
+// closed, since the new agent is using it
+func keepListenerPath(ln net.Listener) {
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+}
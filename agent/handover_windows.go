@@ -0,0 +1,23 @@
+package agent
+
+import (
+	"io"
+	"net"
+	"os"
+)
+
+// Named pipes can't be passed to another process, so the new agent listens
+// on the control socket itself once the running agent has closed it
+const handoverListenersSupported = false
+
+func sendHandover(conn net.Conn, payload []byte, _ []net.Listener) error {
+	_, err := conn.Write(payload)
+	return err
+}
+
+func receiveHandover(conn net.Conn) ([]byte, []*os.File, error) {
+	payload, err := io.ReadAll(conn)
+	return payload, nil, err
+}
+
+func keepListenerPath(net.Listener) {}
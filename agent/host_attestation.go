@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/buildkite/agent/v3/api"
+	"google.golang.org/api/idtoken"
+)
+
+const (
+	HostAttestationEC2 = "ec2"
+	HostAttestationGCP = "gcp"
+)
+
+// The audience GCP identity tokens are requested for
+const gcpAttestationAudience = "buildkite-agent"
+
+// FetchHostAttestation computes an attestation of the host from the given
+// source, either the EC2 or GCP instance identity document. The fingerprint is a hash of the parts of it that identify
+// the host, so it's the same every time the agent starts there.
+func FetchHostAttestation(source string) (*api.HostAttestation, error) {
+	var attestation *api.HostAttestation
+	var identity string
+	var err error
+
+	switch source {
+	case HostAttestationEC2:
+		attestation, identity, err = ec2HostAttestation()
+	case HostAttestationGCP:
+		attestation, identity, err = gcpHostAttestation()
+	default:
+		return nil, fmt.Errorf("Unknown host attestation source %q, valid sources are: %s, %s",
+			source, HostAttestationEC2, HostAttestationGCP)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	attestation.Source = source
+	attestation.Fingerprint = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(identity)))
+
+	return attestation, nil
+}
+
+// HostAttestationTags returns the tags that advertise an attestation
+func HostAttestationTags(attestation *api.HostAttestation) []string {
+	return []string{
+		fmt.Sprintf("attestation:source=%s", attestation.Source),
+		fmt.Sprintf("attestation:fingerprint=%s", attestation.Fingerprint),
+	}
+}
+
+// The EC2 identity document is signed by AWS, the PKCS7 signature lets the
+// control plane verify it came from the instance it claims to
+func ec2HostAttestation() (*api.HostAttestation, string, error) {
+	c, err := newAWSClient()
+	if err != nil {
+		return nil, "", err
+	}
+
+	document, err := c.GetDynamicData("instance-identity/document")
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to fetch EC2 instance identity document: %v", err)
+	}
+
+	signature, err := c.GetDynamicData("instance-identity/pkcs7")
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to fetch EC2 instance identity signature: %v", err)
+	}
+
+	identity, err := ec2HostIdentity(document)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &api.HostAttestation{
+		Document:  document,
+		Signature: signature,
+	}, identity, nil
+}
+
+// ec2HostIdentity returns the parts of an EC2 identity document that identify
+// the instance. The rest of it, like when the instance last started, changes.
+func ec2HostIdentity(document string) (string, error) {
+	var doc struct {
+		AccountID  string `json:"accountId"`
+		Region     string `json:"region"`
+		InstanceID string `json:"instanceId"`
+	}
+	if err := json.Unmarshal([]byte(document), &doc); err != nil {
+		return "", fmt.Errorf("Failed to parse EC2 instance identity document: %v", err)
+	}
+	if doc.AccountID == "" || doc.Region == "" || doc.InstanceID == "" {
+		return "", fmt.Errorf("EC2 instance identity document is missing the account, region or instance ID")
+	}
+
+	return fmt.Sprintf("account_id=%s\nregion=%s\ninstance_id=%s", doc.AccountID, doc.Region, doc.InstanceID), nil
+}
+
+// The GCP identity token is a JWT signed by Google, so it carries its own
+// signature. It's verified before its claims are trusted to identify the host.
+func gcpHostAttestation() (*api.HostAttestation, string, error) {
+	token, err := metadata.Get("instance/service-accounts/default/identity?audience=" + gcpAttestationAudience + "&format=full")
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to fetch GCP instance identity token: %v", err)
+	}
+
+	payload, err := idtoken.Validate(context.Background(), token, gcpAttestationAudience)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to verify GCP instance identity token: %v", err)
+	}
+
+	identity, err := gcpHostIdentity(payload.Claims)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &api.HostAttestation{
+		Document: token,
+	}, identity, nil
+}
+
+// gcpHostIdentity returns the claims of a GCP identity token that identify the
+// instance. The rest of them, like when the token expires, change.
+func gcpHostIdentity(claims map[string]interface{}) (string, error) {
+	google, _ := claims["google"].(map[string]interface{})
+	computeEngine, _ := google["compute_engine"].(map[string]interface{})
+
+	projectID, _ := computeEngine["project_id"].(string)
+	zone, _ := computeEngine["zone"].(string)
+	instanceID, _ := computeEngine["instance_id"].(string)
+	if projectID == "" || zone == "" || instanceID == "" {
+		return "", fmt.Errorf("GCP instance identity token is missing the project, zone or instance ID")
+	}
+
+	return fmt.Sprintf("project_id=%s\nzone=%s\ninstance_id=%s", projectID, zone, instanceID), nil
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostAttestationTags(t *testing.T) {
+	assert.Equal(t, []string{
+		"attestation:source=ec2",
+		"attestation:fingerprint=sha256:abc123",
+	}, HostAttestationTags(&api.HostAttestation{Source: "ec2", Fingerprint: "sha256:abc123"}))
+}
+
+func TestFetchHostAttestationWithUnknownSource(t *testing.T) {
+	_, err := FetchHostAttestation("tpm")
+	assert.EqualError(t, err, `Unknown host attestation source "tpm", valid sources are: ec2, gcp`)
+}
+
+func TestHostIdentityIgnoresChangingFields(t *testing.T) {
+	first, err := ec2HostIdentity(`{"accountId":"123456789012","region":"us-east-1","instanceId":"i-1234","pendingTime":"2022-07-01T00:00:00Z"}`)
+	require.NoError(t, err)
+	second, err := ec2HostIdentity(`{"accountId":"123456789012","region":"us-east-1","instanceId":"i-1234","pendingTime":"2022-07-02T00:00:00Z"}`)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	_, err = ec2HostIdentity(`{"accountId":"123456789012"}`)
+	assert.Error(t, err)
+
+	claims := func(iat int) map[string]interface{} {
+		return map[string]interface{}{
+			"iat": iat,
+			"google": map[string]interface{}{
+				"compute_engine": map[string]interface{}{
+					"project_id":  "llamas",
+					"zone":        "us-central1-a",
+					"instance_id": "1234",
+				},
+			},
+		}
+	}
+	first, err = gcpHostIdentity(claims(1))
+	require.NoError(t, err)
+	second, err = gcpHostIdentity(claims(2))
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	_, err = gcpHostIdentity(map[string]interface{}{"iat": 1})
+	assert.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"fmt"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/metrics"
+)
+
+// infraFailureAnnotation is the annotation added to a build for a job that
+// failed because of the agent or its host
+func infraFailureAnnotation(jobLabel, agentName string, failure *JobFailure) string {
+	if jobLabel == "" {
+		jobLabel = "A job"
+	}
+	return fmt.Sprintf("**%s** failed because of a problem with agent `%s`, not its command (`%s`): %s",
+		jobLabel, agentName, failure.Reason, failure.Message)
+}
+
+// reportInfraFailure logs and records a job that failed because of the agent
+// or its host, returning the exit status the job should finish with
+func (r *JobRunner) reportInfraFailure(failure *JobFailure, exitStatus string) string {
+	r.logger.Warn("Job %s failed because of the agent or its host (%s): %s", r.job.ID, failure.Reason, failure.Message)
+	r.logStreamer.Process(fmt.Sprintf("^^^ +++\n⚠️ This job failed because of the agent or its host (%s): %s\n", failure.Reason, failure.Message))
+
+	r.metrics.With(metrics.Tags{"reason": failure.Reason}).Count("jobs.infra_failure", 1)
+
+	if r.conf.AgentConfiguration.InfraFailureAnnotate {
+		_, err := r.apiClient.Annotate(r.job.ID, &api.Annotation{
+			Body:    infraFailureAnnotation(r.job.Env["BUILDKITE_LABEL"], r.agent.Name, failure),
+			Context: "infra-failure-" + r.job.ID,
+			Style:   "warning",
+		})
+		if err != nil {
+			r.logger.Warn("Failed to annotate the build with the infra failure: %v", err)
+		}
+	}
+
+	if status := r.conf.AgentConfiguration.InfraFailureExitStatus; status != 0 {
+		return fmt.Sprintf("%d", status)
+	}
+	return exitStatus
+}
@@ -65,6 +65,33 @@ func TestJobRunnerIgnoresPipelineChangesToProtectedVars(t *testing.T) {
 
 }
 
+func TestJobRunnerEnablesAllowedJobExperiments(t *testing.T) {
+	ag := &api.AgentRegisterResponse{
+		AccessToken: "llamasrock",
+	}
+
+	j := &api.Job{
+		ID:                 `my-job-id`,
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			`BUILDKITE_COMMAND`:         `echo hello world`,
+			`BUILDKITE_JOB_EXPERIMENTS`: `git-mirrors,flock-file-locks`,
+		},
+	}
+
+	cfg := agent.AgentConfiguration{
+		AllowedJobExperiments: []string{`git-mirrors`, `resolve-commit-after-checkout`},
+	}
+
+	runJob(t, ag, j, cfg, func(c *bintest.Call) {
+		if c.GetEnv("BUILDKITE_AGENT_EXPERIMENT") != `git-mirrors` {
+			t.Errorf("Expected BUILDKITE_AGENT_EXPERIMENT to be %q, got %q\n",
+				`git-mirrors`, c.GetEnv("BUILDKITE_AGENT_EXPERIMENT"))
+		}
+		c.Exit(0)
+	})
+}
+
 func runJob(t *testing.T, ag *api.AgentRegisterResponse, j *api.Job, cfg agent.AgentConfiguration, bootstrap func(c *bintest.Call)) {
 	// create a mock agent API
 	server := createTestAgentEndpoint(t, `my-job-id`)
@@ -118,6 +145,9 @@ func createTestAgentEndpoint(t *testing.T, jobID string) *httptest.Server {
 			rw.WriteHeader(http.StatusCreated)
 		case `/jobs/` + jobID + `/finish`:
 			rw.WriteHeader(http.StatusOK)
+		case `/jobs/` + jobID + `/data/keys`:
+			rw.WriteHeader(http.StatusOK)
+			fmt.Fprintf(rw, `[]`)
 		default:
 			t.Errorf("Unknown endpoint %s %s", req.Method, req.URL.Path)
 			http.Error(rw, "Not found", http.StatusNotFound)
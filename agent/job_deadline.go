@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// jobTimeout returns the job's timeout from BUILDKITE_TIMEOUT, which is a
+// number of minutes, or "false" for jobs without one
+func jobTimeout(job *api.Job) time.Duration {
+	minutes, err := strconv.Atoi(job.Env["BUILDKITE_TIMEOUT"])
+	if err != nil || minutes <= 0 {
+		return 0
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// enforceDeadline cancels the job if it's still running once it's past its
+// deadline. The bootstrap stops the job itself at the deadline, so this waits
+// for the cancel grace periods first, in case the bootstrap is stuck.
+func (r *JobRunner) enforceDeadline() {
+	grace := r.conf.AgentConfiguration.CancelGracePeriod +
+		time.Duration(r.conf.AgentConfiguration.CancelArtifactGracePeriod)*time.Second
+
+	ctx, cancel := context.WithDeadline(r.context, r.deadline.Add(grace))
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+	case <-r.process.Done():
+		return
+	}
+
+	if ctx.Err() != context.DeadlineExceeded {
+		return
+	}
+
+	r.logger.Info("Job %s is still running after its deadline of %s, canceling it", r.job.ID, r.deadline.Format(time.RFC3339))
+	r.timedOut = true
+
+	if err := r.Cancel(); err != nil {
+		r.logger.Error("Unexpected error canceling job that's past its deadline (job: %s) (err: %s)", r.job.ID, err)
+	}
+}
@@ -0,0 +1,22 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobTimeout(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"30":    30 * time.Minute,
+		"false": 0,
+		"":      0,
+		"0":     0,
+		"-5":    0,
+	} {
+		job := &api.Job{Env: map[string]string{"BUILDKITE_TIMEOUT": value}}
+		assert.Equal(t, expected, jobTimeout(job), value)
+	}
+}
@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// The job filter keys that are attributes of the job's build, rather than
+// the agent tags its step targets
+var jobFilterEnv = map[string]string{
+	"branch":       "BUILDKITE_BRANCH",
+	"pipeline":     "BUILDKITE_PIPELINE_SLUG",
+	"organization": "BUILDKITE_ORGANIZATION_SLUG",
+	"source":       "BUILDKITE_SOURCE",
+}
+
+// JobFilter is a condition a job has to meet for the agent to accept it, like
+// queue=deploy-* or branch!=main. Patterns can have * wildcards, which match
+// anything, including slashes.
+type JobFilter struct {
+	Key     string
+	Pattern string
+	Negate  bool
+
+	re *regexp.Regexp
+}
+
+// ParseJobFilters parses filters in the form "key=pattern" or "key!=pattern".
+// The keys branch, pipeline, organization and source are the job's build's,
+// and any others are the agent tags the job's step targets, like queue.
+func ParseJobFilters(exprs []string) ([]JobFilter, error) {
+	var filters []JobFilter
+
+	for _, expr := range exprs {
+		var f JobFilter
+
+		key, pattern, ok := strings.Cut(expr, "!=")
+		if ok {
+			f.Negate = true
+		} else if key, pattern, ok = strings.Cut(expr, "="); !ok {
+			return nil, fmt.Errorf("Job filter %q should be in the form key=pattern or key!=pattern", expr)
+		}
+
+		f.Key, f.Pattern = strings.TrimSpace(key), strings.TrimSpace(pattern)
+		if f.Key == "" {
+			return nil, fmt.Errorf("Job filter %q is missing a key", expr)
+		}
+
+		f.re = regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(f.Pattern), `\*`, ".*") + "$")
+		filters = append(filters, f)
+	}
+
+	return filters, nil
+}
+
+func (f JobFilter) String() string {
+	if f.Negate {
+		return f.Key + "!=" + f.Pattern
+	}
+	return f.Key + "=" + f.Pattern
+}
+
+// Match returns whether the job meets the filter, and the value of the job's
+// attribute that was checked
+func (f JobFilter) Match(job *api.Job) (bool, string) {
+	name, ok := jobFilterEnv[f.Key]
+	if !ok {
+		// The agent tags a step targets are given to its jobs like
+		// BUILDKITE_AGENT_META_DATA_QUEUE
+		name = "BUILDKITE_AGENT_META_DATA_" + strings.ToUpper(strings.ReplaceAll(f.Key, "-", "_"))
+	}
+
+	value := job.Env[name]
+	return f.re.MatchString(value) != f.Negate, value
+}
+
+// acceptsJob returns whether the job meets all of the agent's accept-jobs
+// filters, logging how each one was evaluated at debug level. Jobs that
+// don't are refused with the reason.
+func (a *AgentWorker) acceptsJob(job *api.Job) (bool, string) {
+	filters, err := ParseJobFilters(a.agentConfiguration.AcceptJobs)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	for _, f := range filters {
+		matched, value := f.Match(job)
+		a.logger.Debug("[JobFilter] Job %s: %s is %q, so %s %s", job.ID, f.Key, value, f, matchedString(matched))
+
+		if !matched {
+			return false, fmt.Sprintf("its %s is %q, which doesn't meet the filter %s", f.Key, value, f)
+		}
+	}
+
+	return true, ""
+}
+
+func matchedString(matched bool) string {
+	if matched {
+		return "matches"
+	}
+	return "doesn't match"
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseJobFilters(t *testing.T) {
+	t.Parallel()
+
+	filters, err := ParseJobFilters([]string{"queue=deploy-*", " branch != main "})
+	require.NoError(t, err)
+	require.Len(t, filters, 2)
+	assert.Equal(t, "queue=deploy-*", filters[0].String())
+	assert.Equal(t, "branch!=main", filters[1].String())
+	assert.True(t, filters[1].Negate)
+
+	_, err = ParseJobFilters([]string{"queue"})
+	assert.EqualError(t, err, `Job filter "queue" should be in the form key=pattern or key!=pattern`)
+
+	_, err = ParseJobFilters([]string{"=deploy"})
+	assert.EqualError(t, err, `Job filter "=deploy" is missing a key`)
+}
+
+func TestJobFilterMatch(t *testing.T) {
+	t.Parallel()
+
+	job := &api.Job{Env: map[string]string{
+		"BUILDKITE_BRANCH":                  "feature/deploy.v2",
+		"BUILDKITE_AGENT_META_DATA_QUEUE":   "deploy-eu",
+		"BUILDKITE_AGENT_META_DATA_GPU_SKU": "a100",
+	}}
+
+	for _, tc := range []struct {
+		filter  string
+		matches bool
+		value   string
+	}{
+		{"queue=deploy-*", true, "deploy-eu"},
+		{"queue=deploy", false, "deploy-eu"},
+		{"queue!=deploy-*", false, "deploy-eu"},
+		{"branch!=main", true, "feature/deploy.v2"},
+		{"branch=feature/*", true, "feature/deploy.v2"},
+		{"branch=feature/deploy?v2", false, "feature/deploy.v2"},
+		{"branch=*.v2", true, "feature/deploy.v2"},
+		{"gpu-sku=a*", true, "a100"},
+		{"os=linux", false, ""},
+		{"os!=linux", true, ""},
+		{"os=*", true, ""},
+	} {
+		filters, err := ParseJobFilters([]string{tc.filter})
+		require.NoError(t, err)
+
+		matches, value := filters[0].Match(job)
+		assert.Equal(t, tc.matches, matches, tc.filter)
+		assert.Equal(t, tc.value, value, tc.filter)
+	}
+}
@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/hook"
+)
+
+// The agent hooks that run as a job is assigned to an agent, before it runs
+const (
+	// Runs before the agent accepts a job, and refuses it if it fails
+	jobAssignedHook = "job-assigned"
+
+	// Runs once the agent has accepted a job
+	jobAcceptedHook = "job-accepted"
+
+	// Runs when the agent gives a job back without running it, because the
+	// job-assigned hook refused it or Buildkite didn't let it be accepted
+	jobRequeuedHook = "job-requeued"
+)
+
+// The job env that's passed on to job hooks, when Buildkite has sent it
+var jobHookEnv = []string{
+	"BUILDKITE_ORGANIZATION_SLUG",
+	"BUILDKITE_PIPELINE_SLUG",
+	"BUILDKITE_BUILD_ID",
+	"BUILDKITE_BUILD_NUMBER",
+	"BUILDKITE_BRANCH",
+	"BUILDKITE_COMMIT",
+	"BUILDKITE_STEP_KEY",
+	"BUILDKITE_LABEL",
+	"BUILDKITE_RETRY_COUNT",
+}
+
+// executeJobHook runs one of the job hooks from the agent's hooks path, if
+// there is one. The hook gets the job's ID and some of its details in the
+// environment, along with the path to a file with the whole job as JSON in
+// BUILDKITE_JOB_HOOK_JOB_FILE. It returns an error if the hook fails.
+func (a *AgentWorker) executeJobHook(name string, job *api.Job, extra map[string]string) error {
+	if a.agentConfiguration.HooksPath == "" {
+		return nil
+	}
+
+	hookPath, err := hook.Find(a.agentConfiguration.HooksPath, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	a.logger.Info("Running %s hook %q for job %s", name, hookPath, job.ID)
+
+	jobFile, err := writeJobHookFile(job)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(jobFile)
+
+	sh, err := shell.New()
+	if err != nil {
+		return err
+	}
+
+	sh.Env.Set("BUILDKITE_JOB_ID", job.ID)
+	sh.Env.Set("BUILDKITE_AGENT_NAME", a.agent.Name)
+	sh.Env.Set("BUILDKITE_JOB_HOOK_JOB_FILE", jobFile)
+	for _, name := range jobHookEnv {
+		if value, ok := job.Env[name]; ok {
+			sh.Env.Set(name, value)
+		}
+	}
+	for name, value := range extra {
+		sh.Env.Set(name, value)
+	}
+
+	sh.Writer = LogWriter{
+		l: a.logger,
+	}
+
+	if err := sh.RunWithoutPrompt(hookPath); err != nil {
+		return fmt.Errorf("The %s hook failed: %v", name, err)
+	}
+
+	a.logger.Info("Finished %s hook %q", name, hookPath)
+	return nil
+}
+
+// writeJobHookFile writes the job as JSON to a temporary file for a job hook,
+// without the job's access token
+func writeJobHookFile(job *api.Job) (string, error) {
+	redacted := *job
+	redacted.Env = make(map[string]string, len(job.Env))
+	for name, value := range job.Env {
+		if name != "BUILDKITE_AGENT_ACCESS_TOKEN" {
+			redacted.Env[name] = value
+		}
+	}
+
+	f, err := ioutil.TempFile("", "job-hook-"+job.ID+"-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(redacted); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// requeueJob runs the job-requeued hook for a job the agent isn't going to run
+func (a *AgentWorker) requeueJob(job *api.Job, reason string) {
+	if err := a.executeJobHook(jobRequeuedHook, job, map[string]string{
+		"BUILDKITE_JOB_REQUEUE_REASON": reason,
+	}); err != nil {
+		a.logger.Error("%v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestHook(t *testing.T, dir, name, script string) {
+	t.Helper()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0700))
+}
+
+func TestJobAssignedHookRefusesJob(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Hooks in this test are shell scripts")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("Unexpected request %s %s", req.Method, req.URL.Path)
+		http.Error(rw, "Not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	hooksPath := t.TempDir()
+	output := filepath.Join(t.TempDir(), "output")
+
+	writeTestHook(t, hooksPath, "job-assigned",
+		`echo "assigned $BUILDKITE_JOB_ID $BUILDKITE_PIPELINE_SLUG" >> `+output+"\n"+
+			`grep -q llamas "$BUILDKITE_JOB_HOOK_JOB_FILE" && echo "leaked token" >> `+output+"\n"+
+			"exit 1\n")
+	writeTestHook(t, hooksPath, "job-requeued", `echo "requeued $BUILDKITE_JOB_ID $BUILDKITE_JOB_REQUEUE_REASON" >> `+output+"\n")
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+	worker := NewAgentWorker(logger.Discard, &api.AgentRegisterResponse{Name: "agent", AccessToken: "alpacas"}, nil, client, AgentWorkerConfig{
+		AgentConfiguration: AgentConfiguration{HooksPath: hooksPath},
+	})
+
+	err := worker.AcceptAndRunJob(&api.Job{
+		ID: "job-1",
+		Env: map[string]string{
+			"BUILDKITE_PIPELINE_SLUG":      "my-pipeline",
+			"BUILDKITE_AGENT_ACCESS_TOKEN": "llamas",
+		},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Refused job job-1")
+
+	out, err := ioutil.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "assigned job-1 my-pipeline\nrequeued job-1 refused\n", string(out))
+}
+
+func TestJobHookIsOptional(t *testing.T) {
+	worker := NewAgentWorker(logger.Discard, &api.AgentRegisterResponse{}, nil, api.NewClient(logger.Discard, api.Config{}), AgentWorkerConfig{
+		AgentConfiguration: AgentConfiguration{HooksPath: t.TempDir()},
+	})
+
+	assert.NoError(t, worker.executeJobHook(jobAssignedHook, &api.Job{ID: "job-1"}, nil))
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// The environment variables that tell test splitting tools which share of a
+// parallel step's work the job has
+const (
+	parallelShardCountEnv    = "BUILDKITE_PARALLEL_SHARD_COUNT"
+	parallelShardIndexEnv    = "BUILDKITE_PARALLEL_SHARD_INDEX"
+	parallelShardSeedEnv     = "BUILDKITE_PARALLEL_SHARD_SEED"
+	parallelSiblingJobIDsEnv = "BUILDKITE_PARALLEL_SIBLING_JOB_IDS"
+)
+
+// shardEnv returns the job's shard count and index, which are 1 and 0
+// for jobs that aren't parallel, and a seed that's the same for all of the
+// step's jobs in a build, so they can all shuffle or hash work the same way
+func shardEnv(jobEnv map[string]string) map[string]string {
+	count, err := strconv.Atoi(jobEnv["BUILDKITE_PARALLEL_JOB_COUNT"])
+	if err != nil || count < 1 {
+		count = 1
+	}
+	index, err := strconv.Atoi(jobEnv["BUILDKITE_PARALLEL_JOB"])
+	if err != nil || index < 0 || index >= count {
+		index = 0
+	}
+
+	return map[string]string{
+		parallelShardCountEnv: strconv.Itoa(count),
+		parallelShardIndexEnv: strconv.Itoa(index),
+		parallelShardSeedEnv:  parallelShardSeed(jobEnv["BUILDKITE_BUILD_ID"], jobEnv["BUILDKITE_STEP_ID"], jobEnv["BUILDKITE_STEP_KEY"]),
+	}
+}
+
+// parallelShardSeed hashes the build and step into a number small enough for
+// any tool's --seed option
+func parallelShardSeed(buildID, stepID, stepKey string) string {
+	sum := sha256.Sum256([]byte(buildID + "/" + stepID + "/" + stepKey))
+	return strconv.FormatUint(uint64(binary.BigEndian.Uint32(sum[:4])), 10)
+}
+
+// siblingJobIDs returns the IDs of the step's other jobs, in the order of
+// their shards
+func siblingJobIDs(jobs []*api.StepJob, jobID string) string {
+	sorted := make([]*api.StepJob, 0, len(jobs))
+	for _, job := range jobs {
+		if job.ID != jobID {
+			sorted = append(sorted, job)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ParallelJob < sorted[j].ParallelJob })
+
+	ids := make([]string, 0, len(sorted))
+	for _, job := range sorted {
+		ids = append(ids, job.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+// parallelismEnv returns the job's parallelism helpers, looking up the IDs of
+// the other jobs of parallel steps. Jobs run without them if they can't be
+// looked up.
+func (r *JobRunner) parallelismEnv() map[string]string {
+	env := shardEnv(r.job.Env)
+
+	stepID := r.job.Env["BUILDKITE_STEP_ID"]
+	if env[parallelShardCountEnv] == "1" || stepID == "" {
+		return env
+	}
+
+	jobs, _, err := r.apiClient.GetStepJobs(stepID)
+	if err != nil {
+		r.logger.Warn("[JobRunner] Couldn't look up the other parallel jobs of step %s: %v", stepID, err)
+		return env
+	}
+	env[parallelSiblingJobIDsEnv] = siblingJobIDs(jobs, r.job.ID)
+
+	return env
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardEnv(t *testing.T) {
+	t.Parallel()
+
+	env := shardEnv(map[string]string{
+		"BUILDKITE_BUILD_ID":           "build-1",
+		"BUILDKITE_STEP_ID":            "step-1",
+		"BUILDKITE_PARALLEL_JOB":       "2",
+		"BUILDKITE_PARALLEL_JOB_COUNT": "4",
+	})
+	assert.Equal(t, "4", env[parallelShardCountEnv])
+	assert.Equal(t, "2", env[parallelShardIndexEnv])
+
+	// Every job of the step gets the same seed, but other builds don't
+	sibling := shardEnv(map[string]string{
+		"BUILDKITE_BUILD_ID":           "build-1",
+		"BUILDKITE_STEP_ID":            "step-1",
+		"BUILDKITE_PARALLEL_JOB":       "0",
+		"BUILDKITE_PARALLEL_JOB_COUNT": "4",
+	})
+	assert.Equal(t, env[parallelShardSeedEnv], sibling[parallelShardSeedEnv])
+	assert.NotEqual(t, env[parallelShardSeedEnv], parallelShardSeed("build-2", "step-1", ""))
+
+	single := shardEnv(map[string]string{"BUILDKITE_BUILD_ID": "build-1"})
+	assert.Equal(t, "1", single[parallelShardCountEnv])
+	assert.Equal(t, "0", single[parallelShardIndexEnv])
+}
+
+func TestSiblingJobIDs(t *testing.T) {
+	t.Parallel()
+
+	ids := siblingJobIDs([]*api.StepJob{
+		{ID: "job-c", ParallelJob: 2},
+		{ID: "job-a", ParallelJob: 0},
+		{ID: "job-b", ParallelJob: 1},
+		{ID: "job-d", ParallelJob: 3},
+	}, "job-b")
+	assert.Equal(t, "job-a,job-c,job-d", ids)
+}
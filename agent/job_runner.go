@@ -2,23 +2,27 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/hook"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/metrics"
 	"github.com/buildkite/agent/v3/process"
-	"github.com/buildkite/roko"
+	"github.com/buildkite/agent/v3/retry"
 	"github.com/buildkite/shellwords"
 )
 
@@ -54,6 +58,16 @@ type JobRunnerConfig struct {
 
 	// Whether to set debug HTTP Requests in the job
 	DebugHTTP bool
+
+	// Limits log chunk uploads, and artifact transfers by the job
+	Transfers *TransferScheduler
+
+	// The GPUs the job has been given, or nil if jobs don't get their own
+	GPUs *GPUAllocation
+
+	// Keeps the job's results when Buildkite can't be reached, or nil to keep
+	// trying to send them
+	Spool *resultSpool
 }
 
 type JobRunner struct {
@@ -91,9 +105,20 @@ type JobRunner struct {
 	// The internal log streamer
 	logStreamer *LogStreamer
 
+	// Streams the log's chunks to Buildkite, or nil to upload them one at
+	// a time
+	logStream      *api.ChunkStream
+	logStreamMutex sync.Mutex
+
 	// If the job is being cancelled
 	cancelled bool
 
+	// If the job is being cancelled because it timed out
+	timedOut bool
+
+	// When the job times out, or zero if it doesn't have a timeout
+	deadline time.Time
+
 	// If the agent is being stopped
 	stopped bool
 
@@ -105,6 +130,23 @@ type JobRunner struct {
 
 	// File containing a copy of the job env
 	envFile *os.File
+
+	// File the bootstrap writes why the job failed to
+	failureReasonFile string
+
+	// Watches for the out-of-memory killer while the bootstrap runs
+	oomWatch *OOMWatch
+
+	// What the job can upload as artifacts, or nil if it's unlimited
+	artifactQuota *ArtifactQuota
+
+	// The job's own temporary directory, and whether a tmpfs is mounted on it
+	jobTmpDir     string
+	jobTmpMounted bool
+
+	// The experiments enabled for this job, both agent-wide and opted in to
+	// by the job
+	experiments []string
 }
 
 // Initializes the job runner
@@ -120,6 +162,11 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 
 	runner.context, runner.contextCancel = context.WithCancel(context.Background())
 
+	// The job's timeout starts now, since it's about to run
+	if timeout := jobTimeout(j); timeout > 0 {
+		runner.deadline = time.Now().Add(timeout)
+	}
+
 	// Create our header times struct
 	runner.headerTimesStreamer = newHeaderTimesStreamer(l, runner.onUploadHeaderTime)
 
@@ -147,14 +194,40 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		runner.envFile = file
 	}
 
+	// Prepare a file for the bootstrap to say why the job failed in
+	if file, err := ioutil.TempFile(tempDir, fmt.Sprintf("job-failure-reason-%s", j.ID)); err != nil {
+		return runner, err
+	} else {
+		file.Close()
+		runner.failureReasonFile = file.Name()
+	}
+
+	// Keep track of what the job uploads, if its artifacts are limited
+	if c := conf.AgentConfiguration; c.ArtifactMaxTotalSize > 0 || c.ArtifactMaxFiles > 0 || c.ArtifactMaxFileSize > 0 {
+		runner.artifactQuota = &ArtifactQuota{
+			Path:         filepath.Join(tempDir, fmt.Sprintf("job-artifact-quota-%s", j.ID)),
+			MaxTotalSize: c.ArtifactMaxTotalSize,
+			MaxFiles:     c.ArtifactMaxFiles,
+			MaxFileSize:  c.ArtifactMaxFileSize,
+			Policy:       c.ArtifactQuotaPolicy,
+		}
+	}
+
+	// Give the job a temporary directory that's removed once it finishes
+	if err := runner.createJobTmpDir(); err != nil {
+		return nil, err
+	}
+
 	env, err := runner.createEnvironment()
 	if err != nil {
+		runner.cleanupJobTmpDir()
 		return nil, err
 	}
 
 	// The bootstrap-script gets parsed based on the operating system
 	cmd, err := shellwords.Split(conf.AgentConfiguration.BootstrapScript)
 	if err != nil {
+		runner.cleanupJobTmpDir()
 		return nil, fmt.Errorf("Failed to split bootstrap-script (%q) into tokens: %v",
 			conf.AgentConfiguration.BootstrapScript, err)
 	}
@@ -167,7 +240,7 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 
 	pr, pw := io.Pipe()
 
-	if experiments.IsEnabled(`ansi-timestamps`) {
+	if runner.experimentEnabled(`ansi-timestamps`) {
 		// If we have ansi-timestamps, we can skip line timestamps AND header times
 		// this is the future of timestamping
 		processWriter = process.NewPrefixer(runner.output, func() string {
@@ -212,12 +285,19 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		}()
 	}
 
+	// Lines too long for the log viewer are wrapped or truncated before
+	// they're uploaded, but the job's log file keeps them as they were
+	if c := conf.AgentConfiguration; c.LogLineMaxLength > 0 {
+		processWriter = process.NewLineLimiter(processWriter, c.LogLineMaxLength, c.LogLinePolicy)
+	}
+
 	// if agent config "EnableJobLogTmpfile" is set, we extend the processWriter to write to a temporary file.
 	// BUILDKITE_JOB_LOG_TMPFILE is an environment variable that contains the path to this temporary file.
 	var tmpFile *os.File
 	if conf.AgentConfiguration.EnableJobLogTmpfile {
 		tmpFile, err = ioutil.TempFile("", "buildkite_job_log")
 		if err != nil {
+			runner.cleanupJobTmpDir()
 			return nil, err
 		}
 		os.Setenv("BUILDKITE_JOB_LOG_TMPFILE", tmpFile.Name())
@@ -298,17 +378,42 @@ func (r *JobRunner) Run() error {
 		return err
 	}
 
+	// Stream the log if Buildkite can, falling back to uploading chunks
+	if r.job.LogStreaming && !r.conf.AgentConfiguration.NoLogStreaming {
+		if stream, err := r.apiClient.StreamChunks(r.job.ID); err != nil {
+			r.logger.Warn("Failed to stream the log, uploading it in chunks instead (%v)", err)
+		} else {
+			r.logStream = stream
+		}
+	}
+
 	// Default exit status is no exit status
 	exitStatus := ""
 	signal := ""
 	signalReason := ""
 
+	// Why the job failed, if it did
+	var failure *JobFailure
+
+	environmentCommandOkay := true
+
+	// Make sure there's enough disk space for the job before it gets part
+	// way through a checkout and fails
+	if err := r.checkDiskSpace(); err != nil {
+		environmentCommandOkay = false
+
+		r.logStreamer.Process(fmt.Sprintf("%s\n", err))
+		r.logger.WithFields(logger.EventField(logger.EventJobRefused)).Error("Refusing job: %s", err)
+
+		exitStatus = "-1"
+		signalReason = "agent_refused"
+		failure = &JobFailure{Reason: FailureReasonDiskFull, Message: err.Error()}
+	}
+
 	// Before executing the bootstrap process with the received Job env,
 	// execute the pre-bootstrap hook (if present) for it to tell us
 	// whether it is happy to proceed.
-	environmentCommandOkay := true
-
-	if hook, _ := hook.Find(r.conf.AgentConfiguration.HooksPath, "pre-bootstrap"); hook != "" {
+	if hook, _ := hook.Find(r.conf.AgentConfiguration.HooksPath, "pre-bootstrap"); environmentCommandOkay && hook != "" {
 		// Once we have a hook any failure to run it MUST be fatal to the job to guarantee a true
 		// positive result from the hook
 		okay, err := r.executePreBootstrapHook(hook)
@@ -318,7 +423,7 @@ func (r *JobRunner) Run() error {
 			// Ensure the Job UI knows why this job resulted in failure
 			r.logStreamer.Process("pre-bootstrap hook rejected this job, see the buildkite-agent logs for more details")
 			// But disclose more information in the agent logs
-			r.logger.Error("pre-bootstrap hook rejected this job: %s", err)
+			r.logger.WithFields(logger.EventField(logger.EventJobRefused)).Error("pre-bootstrap hook rejected this job: %s", err)
 
 			exitStatus = "-1"
 			signalReason = "agent_refused"
@@ -327,13 +432,17 @@ func (r *JobRunner) Run() error {
 
 	if environmentCommandOkay {
 		// Run the process. This will block until it finishes.
+		r.oomWatch = WatchOOMKills()
+		defer r.oomWatch.Close()
 		if err := r.process.Run(); err != nil {
 			// Send the error as output
 			r.logStreamer.Process(fmt.Sprintf("%s", err))
+			r.logger.WithFields(logger.EventField(logger.EventJobFailedToStart)).Error("Failed to run job %s: %v", r.job.ID, err)
 
 			// The process did not run at all, so make sure it fails
 			exitStatus = "-1"
 			signalReason = "process_run_error"
+			failure = &JobFailure{Reason: FailureReasonProcessStart, Message: err.Error()}
 		} else {
 			// Add the final output to the streamer
 			r.logStreamer.Process(r.output.String())
@@ -351,6 +460,18 @@ func (r *JobRunner) Run() error {
 				// The job was signaled because it was cancelled via the buildkite web UI
 				signalReason = `cancel`
 			}
+
+			if exitStatus != "0" {
+				failure = r.findFailure()
+			}
+		}
+	}
+
+	failureReason := ""
+	if failure != nil {
+		failureReason = failure.Reason
+		if IsInfraFailure(failure.Reason) {
+			exitStatus = r.reportInfraFailure(failure, exitStatus)
 		}
 	}
 
@@ -363,7 +484,7 @@ func (r *JobRunner) Run() error {
 
 	// Stop the log streamer. This will block until all the chunks have
 	// been uploaded
-	r.logStreamer.Stop()
+	r.stopLogStreamer()
 
 	// Warn about failed chunks
 	if count := r.logStreamer.FailedChunks(); count > 0 {
@@ -383,9 +504,27 @@ func (r *JobRunner) Run() error {
 		r.logger.Debug("[JobRunner] Deleted env file: %s", r.envFile.Name())
 	}
 
+	if r.failureReasonFile != "" {
+		if err := os.Remove(r.failureReasonFile); err != nil {
+			r.logger.Warn("[JobRunner] Error cleaning up failure reason file: %s", err)
+		}
+	}
+
+	if r.artifactQuota != nil {
+		for _, path := range []string{r.artifactQuota.Path, r.artifactQuota.Path + ".lock"} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				r.logger.Warn("[JobRunner] Error cleaning up artifact quota file: %s", err)
+			}
+		}
+	}
+
+	// Remove whatever the job left in its temp dir
+	r.cleanupJobTmpDir()
+
 	// Write some metrics about the job run
 	jobMetrics := r.metrics.With(metrics.Tags{
-		"exit_code": exitStatus,
+		"exit_code":      exitStatus,
+		"failure_reason": failureReason,
 	})
 	if exitStatus == "0" {
 		jobMetrics.Timing(`jobs.duration.success`, finishedAt.Sub(startedAt))
@@ -399,13 +538,27 @@ func (r *JobRunner) Run() error {
 	//
 	// Once we tell the API we're finished it might assign us new work, so make
 	// sure everything else is done first.
-	r.finishJob(finishedAt, exitStatus, signal, signalReason, r.logStreamer.FailedChunks())
+	r.finishJob(finishedAt, exitStatus, signal, signalReason, failureReason, r.logStreamer.FailedChunks())
 
-	r.logger.Info("Finished job %s", r.job.ID)
+	if exitStatus != "0" {
+		r.logger.WithFields(logger.EventField(logger.EventJobFailed)).Warn("Finished job %s, which failed with exit status %s", r.job.ID, exitStatus)
+	} else {
+		r.logger.Info("Finished job %s", r.job.ID)
+	}
 
 	return nil
 }
 
+// experimentEnabled returns whether the experiment is enabled for this job
+func (r *JobRunner) experimentEnabled(key string) bool {
+	for _, name := range r.experiments {
+		if name == key {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *JobRunner) CancelAndStop() error {
 	r.cancelLock.Lock()
 	r.stopped = true
@@ -430,8 +583,13 @@ func (r *JobRunner) Cancel() error {
 	if r.stopped {
 		reason = " (agent stopping)"
 	}
-	r.logger.Info("Canceling job %s with a grace period of %ds%s",
-		r.job.ID, r.conf.AgentConfiguration.CancelGracePeriod, reason)
+
+	// The job gets to upload its artifacts once it has stopped
+	gracePeriod := r.conf.AgentConfiguration.CancelGracePeriod +
+		time.Duration(r.conf.AgentConfiguration.CancelArtifactGracePeriod)*time.Second
+
+	r.logger.Info("Canceling job %s with a grace period of %s%s",
+		r.job.ID, gracePeriod, reason)
 
 	r.cancelled = true
 
@@ -442,7 +600,7 @@ func (r *JobRunner) Cancel() error {
 
 	select {
 	// Grace period for cancelling
-	case <-time.After(time.Second * time.Duration(r.conf.AgentConfiguration.CancelGracePeriod)):
+	case <-time.After(gracePeriod):
 		r.logger.Info("Job %s hasn't stopped in time, terminating", r.job.ID)
 
 		// Terminate the process as we've exceeded our context
@@ -458,8 +616,41 @@ func (r *JobRunner) Cancel() error {
 	}
 }
 
+// stopLogStreamer waits for the rest of the job's log to upload. Once the job
+// has been canceled or has timed out, it only waits for the cancel artifact
+// grace period, if there is one, so a bad connection can't hold up the agent.
+func (r *JobRunner) stopLogStreamer() {
+	r.cancelLock.Lock()
+	cancelled := r.cancelled
+	r.cancelLock.Unlock()
+
+	gracePeriod := time.Duration(r.conf.AgentConfiguration.CancelArtifactGracePeriod) * time.Second
+	if !cancelled || gracePeriod == 0 {
+		r.logStreamer.Stop()
+		r.closeLogStream()
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.logStreamer.Stop()
+		r.closeLogStream()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(gracePeriod):
+		r.logger.Warn("Gave up uploading the rest of the log for job %s after %v", r.job.ID, gracePeriod)
+	}
+}
+
 // Creates the environment variables that will be used in the process and writes a flat environment file
 func (r *JobRunner) createEnvironment() ([]string, error) {
+	// The environment policy rejects any job env that would override
+	// security-sensitive variables (LD_PRELOAD, PATH, GIT_SSH_COMMAND etc.)
+	policy := env.NewPolicy(r.conf.AgentConfiguration.EnvPolicyAllow)
+
 	// Create a clone of our jobs environment. We'll then set the
 	// environment variables provided by the agent, which will override any
 	// sent by Buildkite. The variables below should always take
@@ -474,6 +665,29 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		delete(env, `BUILDKITE_AGENT_TOKEN`)
 	}
 
+	// Strip any variables that the job isn't allowed to override
+	rejectedEnv := policy.Enforce(env)
+	for _, name := range rejectedEnv {
+		r.logger.Warn("[JobRunner] Job %s tried to override protected environment variable %s, ignoring", r.job.ID, name)
+	}
+
+	// Steps can opt in to the experiments the agent allows, on top of the
+	// ones enabled for the whole agent
+	r.experiments = experiments.Enabled()
+	jobExperiments, rejectedExperiments := experiments.FilterAllowed(env[experiments.JobEnvVar], r.conf.AgentConfiguration.AllowedJobExperiments)
+	for _, name := range rejectedExperiments {
+		r.logger.Warn("[JobRunner] Job %s opted in to experiment %s, which isn't allowed on this agent, ignoring", r.job.ID, name)
+	}
+	for _, name := range jobExperiments {
+		if !r.experimentEnabled(name) {
+			r.experiments = append(r.experiments, name)
+		}
+	}
+	sort.Strings(r.experiments)
+	if len(r.experiments) > 0 {
+		r.logger.Info("Job %s is running with experiments: %s", r.job.ID, strings.Join(r.experiments, ", "))
+	}
+
 	// Write out the job environment to a file, in k="v" format, with newlines escaped
 	// We present only the clean environment - i.e only variables configured
 	// on the job upstream - and expose the path in another environment variable.
@@ -495,6 +709,11 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	var protectedEnv = []string{
 		`BUILDKITE_AGENT_ENDPOINT`,
 		`BUILDKITE_AGENT_ACCESS_TOKEN`,
+		`BUILDKITE_API_RECORD_PATH`,
+		`BUILDKITE_API_REPLAY_PATH`,
+		`BUILDKITE_API_REQUEST_SIGNING`,
+		`BUILDKITE_API_REQUEST_SIGNING_SECRET`,
+		`BUILDKITE_API_REQUEST_SIGNING_REGION`,
 		`BUILDKITE_AGENT_DEBUG`,
 		`BUILDKITE_AGENT_PID`,
 		`BUILDKITE_BIN_PATH`,
@@ -505,19 +724,56 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		`BUILDKITE_HOOKS_PATH`,
 		`BUILDKITE_PLUGINS_PATH`,
 		`BUILDKITE_SSH_KEYSCAN`,
+		`BUILDKITE_SSH_STRICT_HOST_KEYS`,
+		`BUILDKITE_SSH_VERIFY_HOST_KEYS_WITH_DNS`,
 		`BUILDKITE_GIT_SUBMODULES`,
 		`BUILDKITE_COMMAND_EVAL`,
 		`BUILDKITE_PLUGINS_ENABLED`,
+		`BUILDKITE_ISOLATE_PLUGINS`,
+		`BUILDKITE_PLUGINS_SHARED_ENV`,
 		`BUILDKITE_LOCAL_HOOKS_ENABLED`,
+		`BUILDKITE_CHECKOUT_TYPE`,
+		`BUILDKITE_CHECKOUT_PATH_TEMPLATE`,
+		`BUILDKITE_FAILURE_REASON_FILE`,
+		`BUILDKITE_JOB_DEADLINE`,
+		`BUILDKITE_CANCEL_ARTIFACT_GRACE_PERIOD`,
+		`BUILDKITE_ENV_SCHEMA_PATH`,
+		`BUILDKITE_TOOLS_PATH`,
+		`BUILDKITE_TOOL_MIRRORS`,
+		`BUILDKITE_TOOL_CHECKSUMS`,
+		transferSlotsPathEnv,
+		transferConcurrencyEnv,
+		transferBandwidthEnv,
+		artifactQuotaPathEnv,
+		artifactMaxTotalSizeEnv,
+		artifactMaxFilesEnv,
+		artifactMaxFileSizeEnv,
+		artifactQuotaPolicyEnv,
+		artifactURLSignerEnv,
+		parallelShardCountEnv,
+		parallelShardIndexEnv,
+		parallelShardSeedEnv,
+		parallelSiblingJobIDsEnv,
+		`BUILDKITE_AGENT_GPUS`,
 		`BUILDKITE_GIT_CLONE_FLAGS`,
 		`BUILDKITE_GIT_FETCH_FLAGS`,
+		`BUILDKITE_GIT_SSH_HOSTS`,
+		`BUILDKITE_GIT_SSH_CONFIG`,
+		`BUILDKITE_GIT_HTTPS_FALLBACK`,
+		`BUILDKITE_GIT_CREDENTIAL_HELPER`,
 		`BUILDKITE_GIT_CLONE_MIRROR_FLAGS`,
 		`BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT`,
 		`BUILDKITE_GIT_CLEAN_FLAGS`,
 		`BUILDKITE_SHELL`,
+		`BUILDKITE_WSL_DISTRIBUTION`,
+		`BUILDKITE_MACOS_KEYCHAIN`,
+		`BUILDKITE_MACOS_KEYCHAIN_PASSWORD_FILE`,
+		`BUILDKITE_MACOS_PROVISIONING_PROFILES_PATH`,
 	}
 
-	var ignoredEnv []string
+	// Variables rejected by the environment policy are reported to the user
+	// alongside the protected env below
+	ignoredEnv := rejectedEnv
 
 	// Check if the user has defined any protected env
 	for _, p := range protectedEnv {
@@ -536,6 +792,36 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	env["BUILDKITE_AGENT_ENDPOINT"] = apiConfig.Endpoint
 	env["BUILDKITE_AGENT_ACCESS_TOKEN"] = apiConfig.Token
 
+	// Commands run by the job record and replay along with the agent
+	if apiConfig.RecordPath != "" {
+		env["BUILDKITE_API_RECORD_PATH"] = apiConfig.RecordPath
+	}
+	if apiConfig.ReplayPath != "" {
+		env["BUILDKITE_API_REPLAY_PATH"] = apiConfig.ReplayPath
+	}
+
+	// Commands run by the job sign their requests the same way as the agent
+	if apiConfig.RequestSigning != "" {
+		env["BUILDKITE_API_REQUEST_SIGNING"] = apiConfig.RequestSigning
+		env["BUILDKITE_API_REQUEST_SIGNING_SECRET"] = apiConfig.RequestSigningSecret
+		env["BUILDKITE_API_REQUEST_SIGNING_REGION"] = apiConfig.RequestSigningRegion
+	}
+
+	// The job's commands and git connect over the same IP family as the agent
+	if apiConfig.IPFamily != "" {
+		env["BUILDKITE_IP_FAMILY"] = apiConfig.IPFamily
+	}
+
+	// And pick their proxies with the same PAC file
+	if r.conf.AgentConfiguration.ProxyPAC != "" {
+		env["BUILDKITE_PROXY_PAC"] = r.conf.AgentConfiguration.ProxyPAC
+	}
+
+	// And cache their DNS lookups
+	if r.conf.AgentConfiguration.DNSCache {
+		env["BUILDKITE_DNS_CACHE"] = "true"
+	}
+
 	// Add agent environment variables
 	env["BUILDKITE_AGENT_DEBUG"] = fmt.Sprintf("%t", r.conf.Debug)
 	env["BUILDKITE_AGENT_DEBUG_HTTP"] = fmt.Sprintf("%t", r.conf.DebugHTTP)
@@ -561,17 +847,74 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	env["BUILDKITE_HOOKS_PATH"] = r.conf.AgentConfiguration.HooksPath
 	env["BUILDKITE_PLUGINS_PATH"] = r.conf.AgentConfiguration.PluginsPath
 	env["BUILDKITE_SSH_KEYSCAN"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKeyscan)
+	env["BUILDKITE_SSH_STRICT_HOST_KEYS"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHStrictHostKeys)
+	env["BUILDKITE_SSH_VERIFY_HOST_KEYS_WITH_DNS"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHVerifyHostKeysWithDNS)
 	env["BUILDKITE_GIT_SUBMODULES"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitSubmodules)
 	env["BUILDKITE_COMMAND_EVAL"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.CommandEval)
 	env["BUILDKITE_PLUGINS_ENABLED"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.PluginsEnabled)
+	env["BUILDKITE_ISOLATE_PLUGINS"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.IsolatePlugins)
+	env["BUILDKITE_PLUGINS_SHARED_ENV"] = strings.Join(r.conf.AgentConfiguration.PluginsSharedEnv, ",")
 	env["BUILDKITE_LOCAL_HOOKS_ENABLED"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.LocalHooksEnabled)
 	env["BUILDKITE_GIT_CLONE_FLAGS"] = r.conf.AgentConfiguration.GitCloneFlags
+	if r.conf.AgentConfiguration.CheckoutPathTemplate != "" {
+		env["BUILDKITE_CHECKOUT_PATH_TEMPLATE"] = r.conf.AgentConfiguration.CheckoutPathTemplate
+	}
+	if r.conf.AgentConfiguration.CheckoutType != "" {
+		env["BUILDKITE_CHECKOUT_TYPE"] = r.conf.AgentConfiguration.CheckoutType
+	}
 	env["BUILDKITE_GIT_FETCH_FLAGS"] = r.conf.AgentConfiguration.GitFetchFlags
+	env["BUILDKITE_GIT_SSH_HOSTS"] = strings.Join(r.conf.AgentConfiguration.GitSSHHosts, ",")
+	env["BUILDKITE_GIT_SSH_CONFIG"] = r.conf.AgentConfiguration.GitSSHConfig
+	env["BUILDKITE_GIT_HTTPS_FALLBACK"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitHTTPSFallback)
+	env["BUILDKITE_GIT_CREDENTIAL_HELPER"] = r.conf.AgentConfiguration.GitCredentialHelper
+	env["BUILDKITE_FAILURE_REASON_FILE"] = r.failureReasonFile
+	for k, v := range r.jobTmpDirEnv() {
+		env[k] = v
+	}
+	if !r.deadline.IsZero() {
+		env["BUILDKITE_JOB_DEADLINE"] = r.deadline.Format(time.RFC3339)
+	}
+	if r.conf.AgentConfiguration.EnvSchemaPath != "" {
+		env["BUILDKITE_ENV_SCHEMA_PATH"] = r.conf.AgentConfiguration.EnvSchemaPath
+	}
+	if r.conf.AgentConfiguration.ToolsPath != "" {
+		env["BUILDKITE_TOOLS_PATH"] = r.conf.AgentConfiguration.ToolsPath
+		env["BUILDKITE_TOOL_MIRRORS"] = strings.Join(r.conf.AgentConfiguration.ToolMirrors, ",")
+		env["BUILDKITE_TOOL_CHECKSUMS"] = r.conf.AgentConfiguration.ToolChecksums
+	}
+	env["BUILDKITE_CANCEL_ARTIFACT_GRACE_PERIOD"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.CancelArtifactGracePeriod)
+	for k, v := range r.conf.Transfers.Env() {
+		env[k] = v
+	}
+	for k, v := range r.artifactQuota.Env() {
+		env[k] = v
+	}
+	if r.conf.AgentConfiguration.ArtifactURLSigner != "" {
+		env[artifactURLSignerEnv] = r.conf.AgentConfiguration.ArtifactURLSigner
+	}
+	for k, v := range r.parallelismEnv() {
+		env[k] = v
+	}
+	for k, v := range r.stepOutputsEnv() {
+		env[k] = v
+	}
+	if len(r.conf.AgentConfiguration.GPUs) > 0 {
+		for k, v := range gpuEnv(r.conf.AgentConfiguration.GPUs) {
+			env[k] = v
+		}
+	}
+	for k, v := range r.conf.GPUs.Env() {
+		env[k] = v
+	}
 	env["BUILDKITE_GIT_CLONE_MIRROR_FLAGS"] = r.conf.AgentConfiguration.GitCloneMirrorFlags
 	env["BUILDKITE_GIT_CLEAN_FLAGS"] = r.conf.AgentConfiguration.GitCleanFlags
 	env["BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.GitMirrorsLockTimeout)
 	env["BUILDKITE_SHELL"] = r.conf.AgentConfiguration.Shell
-	env["BUILDKITE_AGENT_EXPERIMENT"] = strings.Join(experiments.Enabled(), ",")
+	env["BUILDKITE_WSL_DISTRIBUTION"] = r.conf.AgentConfiguration.WSLDistribution
+	env["BUILDKITE_MACOS_KEYCHAIN"] = r.conf.AgentConfiguration.MacOSKeychain
+	env["BUILDKITE_MACOS_KEYCHAIN_PASSWORD_FILE"] = r.conf.AgentConfiguration.MacOSKeychainPasswordFile
+	env["BUILDKITE_MACOS_PROVISIONING_PROFILES_PATH"] = r.conf.AgentConfiguration.MacOSProvisioningProfiles
+	env["BUILDKITE_AGENT_EXPERIMENT"] = strings.Join(r.experiments, ",")
 	env["BUILDKITE_REDACTED_VARS"] = strings.Join(r.conf.AgentConfiguration.RedactedVars, ",")
 
 	// propagate CancelSignal to bootstrap, unless it's the default SIGTERM
@@ -681,10 +1024,10 @@ func (r *JobRunner) executePreBootstrapHook(hook string) (bool, error) {
 func (r *JobRunner) startJob(startedAt time.Time) error {
 	r.job.StartedAt = startedAt.UTC().Format(time.RFC3339Nano)
 
-	return roko.NewRetrier(
-		roko.WithMaxAttempts(30),
-		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).Do(func(rtr *roko.Retrier) error {
+	return retry.NewRetrier(
+		retry.WithMaxAttempts(30),
+		retry.WithStrategy(retry.Constant(5*time.Second)),
+	).Do(func(rtr *retry.Retrier) error {
 		_, err := r.apiClient.StartJob(r.job)
 
 		if err != nil {
@@ -702,20 +1045,57 @@ func (r *JobRunner) startJob(startedAt time.Time) error {
 
 // Finishes the job in the Buildkite Agent API. This call will keep on retrying
 // forever until it finally gets a successfull response from the API.
-func (r *JobRunner) finishJob(finishedAt time.Time, exitStatus string, signal string, signalReason string, failedChunkCount int) error {
+func (r *JobRunner) finishJob(finishedAt time.Time, exitStatus string, signal string, signalReason string, failureReason string, failedChunkCount int) error {
 	r.job.FinishedAt = finishedAt.UTC().Format(time.RFC3339Nano)
 	r.job.ExitStatus = exitStatus
 	r.job.Signal = signal
 	r.job.SignalReason = signalReason
+	r.job.FailureReason = failureReason
 	r.job.ChunksFailedCount = failedChunkCount
 
-	r.logger.Debug("[JobRunner] Finishing job with exit_status=%s, signal=%s and signal_reason=%s",
-		r.job.ExitStatus, r.job.Signal, r.job.SignalReason)
+	r.logger.Debug("[JobRunner] Finishing job with exit_status=%s, signal=%s, signal_reason=%s and failure_reason=%s",
+		r.job.ExitStatus, r.job.Signal, r.job.SignalReason, r.job.FailureReason)
+
+	// Results spooled for the job have to arrive before it's finished
+	if r.conf.Spool != nil && r.conf.Spool.Pending(r.job.ID) {
+		err := r.conf.Spool.SpoolFinish(r.job)
+		if err == nil {
+			r.logger.Warn("Spooled the finish of job %s after its other results, it will be sent when Buildkite can be reached", r.job.ID)
+			return nil
+		}
+		r.logger.Warn("Failed to spool the finish of job %s (%v)", r.job.ID, err)
+	}
+
+	if r.conf.Spool == nil {
+		_, err := r.sendFinish(retry.TryForever())
+		return err
+	}
+
+	rejected, err := r.sendFinish(retry.WithMaxAttempts(spoolAfterAttempts))
+	if err == nil || rejected {
+		return err
+	}
+
+	if spoolErr := r.conf.Spool.SpoolFinish(r.job); spoolErr != nil {
+		// Without the spool, there's nothing else to do but keep trying
+		r.logger.Warn("Failed to spool the finish of job %s (%v)", r.job.ID, spoolErr)
+		_, err := r.sendFinish(retry.TryForever())
+		return err
+	}
+
+	r.logger.Warn("Spooled the finish of job %s, it will be sent when Buildkite can be reached", r.job.ID)
+	return nil
+}
+
+// Sends the finish of the job to the Agent API, reporting whether Buildkite
+// rejected it outright
+func (r *JobRunner) sendFinish(attempts retry.Option) (bool, error) {
+	rejected := false
 
-	return roko.NewRetrier(
-		roko.TryForever(),
-		roko.WithStrategy(roko.Constant(1*time.Second)),
-	).Do(func(retrier *roko.Retrier) error {
+	err := retry.NewRetrier(
+		attempts,
+		retry.WithStrategy(retry.Constant(1*time.Second)),
+	).Do(func(retrier *retry.Retrier) error {
 		response, err := r.apiClient.FinishJob(r.job)
 		if err != nil {
 			// If the API returns with a 422, that means that we
@@ -728,7 +1108,8 @@ func (r *JobRunner) finishJob(finishedAt time.Time, exitStatus string, signal st
 			// to finish the job forever so we'll just bail out and
 			// go find some more work to do.
 			if response != nil && response.StatusCode == 422 {
-				r.logger.Warn("Buildkite rejected the call to finish the job (%s)", err)
+				r.logger.WithFields(logger.EventField(logger.EventJobFinishFailed)).Warn("Buildkite rejected the call to finish the job (%s)", err)
+				rejected = true
 				retrier.Break()
 			} else {
 				r.logger.Warn("%s (%s)", err, retrier)
@@ -737,6 +1118,8 @@ func (r *JobRunner) finishJob(finishedAt time.Time, exitStatus string, signal st
 
 		return err
 	})
+
+	return rejected, err
 }
 
 func (r *JobRunner) onProcessStartCallback() {
@@ -744,6 +1127,23 @@ func (r *JobRunner) onProcessStartCallback() {
 	// to the routine wait group here.
 	r.routineWaitGroup.Add(2)
 
+	// Stop the job if it runs past its deadline
+	if !r.deadline.IsZero() {
+		r.routineWaitGroup.Add(1)
+		go func() {
+			defer r.routineWaitGroup.Done()
+			r.enforceDeadline()
+		}()
+	}
+
+	// Streamed logs don't cost a request per chunk, so they're sent sooner
+	logInterval := 1 * time.Second
+	r.logStreamMutex.Lock()
+	if r.logStream != nil {
+		logInterval = 250 * time.Millisecond
+	}
+	r.logStreamMutex.Unlock()
+
 	// Start a routine that will grab the output every few seconds and send
 	// it back to Buildkite
 	go func() {
@@ -759,7 +1159,7 @@ func (r *JobRunner) onProcessStartCallback() {
 
 			// Sleep for a bit, or until the job is finished
 			select {
-			case <-time.After(1 * time.Second):
+			case <-time.After(logInterval):
 			case <-r.context.Done():
 				return
 			case <-r.process.Done():
@@ -786,7 +1186,10 @@ func (r *JobRunner) onProcessStartCallback() {
 				// We don't really care if it fails, we'll just
 				// try again soon anyway
 				r.logger.Warn("Problem with getting job state %s (%s)", r.job.ID, err)
-			} else if jobState.State == "canceling" || jobState.State == "canceled" {
+			} else if jobState.State == "canceling" || jobState.State == "canceled" || isTimingOut(jobState.State) {
+				// Buildkite cancels jobs that run for longer than their timeout
+				r.timedOut = isTimingOut(jobState.State)
+
 				err = r.Cancel()
 				if err != nil {
 					r.logger.Error("Unexpected error canceling process as requested by server (job: %s) (err: %s)", r.job.ID, err)
@@ -806,14 +1209,18 @@ func (r *JobRunner) onProcessStartCallback() {
 }
 
 func (r *JobRunner) onUploadHeaderTime(cursor int, total int, times map[string]string) {
-	roko.NewRetrier(
-		roko.WithMaxAttempts(10),
-		roko.WithStrategy(roko.Constant(5*time.Second)),
-	).Do(func(retrier *roko.Retrier) error {
-		response, err := r.apiClient.SaveHeaderTimes(r.job.ID, &api.HeaderTimes{Times: times})
+	headerTimes := &api.HeaderTimes{Times: times}
+
+	rejected := false
+	err := retry.NewRetrier(
+		retry.WithMaxAttempts(10),
+		retry.WithStrategy(retry.Constant(5*time.Second)),
+	).Do(func(retrier *retry.Retrier) error {
+		response, err := r.apiClient.SaveHeaderTimes(r.job.ID, headerTimes)
 		if err != nil {
 			if response != nil && (response.StatusCode >= 400 && response.StatusCode <= 499) {
 				r.logger.Warn("Buildkite rejected the header times (%s)", err)
+				rejected = true
 				retrier.Break()
 			} else {
 				r.logger.Warn("%s (%s)", err, retrier)
@@ -822,10 +1229,82 @@ func (r *JobRunner) onUploadHeaderTime(cursor int, total int, times map[string]s
 
 		return err
 	})
+
+	if err != nil && !rejected && r.conf.Spool != nil {
+		if err := r.conf.Spool.SpoolHeaderTimes(r.job.ID, headerTimes); err != nil {
+			r.logger.Warn("Failed to spool header times (%v)", err)
+		}
+	}
 }
 
 // Call when a chunk is ready for upload.
 func (r *JobRunner) onUploadChunk(chunk *LogStreamerChunk) error {
+	apiChunk := &api.Chunk{
+		Data:     chunk.Data,
+		Sequence: chunk.Order,
+		Offset:   chunk.Offset,
+		Size:     chunk.Size,
+	}
+
+	if r.streamChunk(apiChunk) {
+		return nil
+	}
+
+	return r.uploadChunk(apiChunk)
+}
+
+// streamChunk sends a chunk on the job's log stream, returning false if the
+// job doesn't have one and the chunk has to be uploaded on its own. If the
+// stream fails, it's closed and the rest of the log is uploaded in chunks.
+func (r *JobRunner) streamChunk(chunk *api.Chunk) bool {
+	r.logStreamMutex.Lock()
+	stream := r.logStream
+	r.logStreamMutex.Unlock()
+
+	if stream == nil {
+		return false
+	}
+
+	err := stream.Send(chunk)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, api.ErrChunkStreamClosed):
+		return false
+	}
+
+	// The chunk is uploaded with the others Buildkite didn't acknowledge
+	r.closeLogStream()
+	return true
+}
+
+// closeLogStream finishes the job's log stream, if it has one, and uploads
+// the chunks Buildkite didn't acknowledge on their own
+func (r *JobRunner) closeLogStream() {
+	r.logStreamMutex.Lock()
+	stream := r.logStream
+	r.logStream = nil
+	r.logStreamMutex.Unlock()
+
+	if stream == nil {
+		return
+	}
+
+	unacknowledged, err := stream.Close()
+	if err != nil {
+		r.logger.Warn("The log stream failed, uploading the rest of the log in chunks (%v)", err)
+	}
+
+	for _, chunk := range unacknowledged {
+		if err := r.uploadChunk(chunk); err != nil {
+			atomic.AddInt32(&r.logStreamer.chunksFailedCount, 1)
+			r.logger.Error("Giving up on uploading chunk %d, this will result in only a partial build log on Buildkite", chunk.Sequence)
+		}
+	}
+}
+
+// uploadChunk uploads a chunk on its own
+func (r *JobRunner) uploadChunk(apiChunk *api.Chunk) error {
 	// We consider logs to be an important thing, and we shouldn't give up
 	// on sending the chunk data back to Buildkite. In the event Buildkite
 	// is having downtime or there are connection problems, we'll want to
@@ -833,21 +1312,29 @@ func (r *JobRunner) onUploadChunk(chunk *LogStreamerChunk) error {
 	//
 	// This code will retry forever until we get back a successful response
 	// from Buildkite that it's considered the chunk (a 4xx will be
-	// returned if the chunk is invalid, and we shouldn't retry on that)
-	return roko.NewRetrier(
-		roko.TryForever(),
-		roko.WithStrategy(roko.Constant(5*time.Second)),
-		roko.WithJitter(),
-	).Do(func(retrier *roko.Retrier) error {
-		response, err := r.apiClient.UploadChunk(r.job.ID, &api.Chunk{
-			Data:     chunk.Data,
-			Sequence: chunk.Order,
-			Offset:   chunk.Offset,
-			Size:     chunk.Size,
+	// returned if the chunk is invalid, and we shouldn't retry on that),
+	// unless there's a spool to keep it in until Buildkite is back.
+	attempts := retry.TryForever()
+	if r.conf.Spool != nil {
+		attempts = retry.WithMaxAttempts(spoolAfterAttempts)
+	}
+
+	rejected := false
+	err := retry.NewRetrier(
+		attempts,
+		retry.WithStrategy(retry.Constant(5*time.Second)),
+		retry.WithJitter(),
+	).Do(func(retrier *retry.Retrier) error {
+		var response *api.Response
+		err := r.conf.Transfers.Do(int64(len(apiChunk.Data)), func() error {
+			var err error
+			response, err = r.apiClient.UploadChunk(r.job.ID, apiChunk)
+			return err
 		})
 		if err != nil {
 			if response != nil && (response.StatusCode >= 400 && response.StatusCode <= 499) {
 				r.logger.Warn("Buildkite rejected the chunk upload (%s)", err)
+				rejected = true
 				retrier.Break()
 			} else {
 				r.logger.Warn("%s (%s)", err, retrier)
@@ -856,4 +1343,14 @@ func (r *JobRunner) onUploadChunk(chunk *LogStreamerChunk) error {
 
 		return err
 	})
+
+	if err != nil && !rejected && r.conf.Spool != nil {
+		if spoolErr := r.conf.Spool.SpoolChunk(r.job.ID, apiChunk); spoolErr != nil {
+			r.logger.Warn("Failed to spool chunk %d (%v)", apiChunk.Sequence, spoolErr)
+			return err
+		}
+		return nil
+	}
+
+	return err
 }
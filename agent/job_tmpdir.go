@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/dustin/go-humanize"
+)
+
+// createJobTmpDir creates the job's own temporary directory, mounting a tmpfs
+// on it if the agent is configured to. Jobs are given it as TMPDIR so that
+// nothing they leave behind outlives them.
+func (r *JobRunner) createJobTmpDir() error {
+	base := r.conf.AgentConfiguration.JobTmpPath
+	if base == "" {
+		base = os.TempDir()
+	}
+	if err := os.MkdirAll(base, 0o755); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(base, fmt.Sprintf("job-tmp-%s-", r.job.ID))
+	if err != nil {
+		return err
+	}
+
+	if size := r.conf.AgentConfiguration.JobTmpfsSize; size > 0 {
+		if err := mountTmpfs(dir, size); err != nil {
+			// The job won't run, so nothing would clean it up later
+			_ = os.Remove(dir)
+			return fmt.Errorf("Failed to mount a %s tmpfs on %s: %w", humanize.Bytes(size), dir, err)
+		}
+		r.jobTmpMounted = true
+		r.logger.Debug("[JobRunner] Mounted a %s tmpfs on %s", humanize.Bytes(size), dir)
+	}
+
+	r.jobTmpDir = dir
+	r.logger.Debug("[JobRunner] Created job temp dir: %s", dir)
+	return nil
+}
+
+// jobTmpDirEnv returns the variables that point the job at its temporary
+// directory
+func (r *JobRunner) jobTmpDirEnv() map[string]string {
+	if r.jobTmpDir == "" {
+		return nil
+	}
+
+	env := map[string]string{"TMPDIR": r.jobTmpDir}
+	if runtime.GOOS == "windows" {
+		env["TMP"] = r.jobTmpDir
+		env["TEMP"] = r.jobTmpDir
+	}
+	return env
+}
+
+// cleanupJobTmpDir removes the job's temporary directory and everything the
+// job left in it, recording how much that was
+func (r *JobRunner) cleanupJobTmpDir() {
+	if r.jobTmpDir == "" {
+		return
+	}
+
+	if size, err := dirSize(r.jobTmpDir); err == nil {
+		r.metrics.Gauge("jobs.tmpdir.size", float64(size))
+		r.logger.Debug("[JobRunner] Job left %s in its temp dir", humanize.Bytes(uint64(size)))
+	}
+
+	if r.jobTmpMounted {
+		if err := unmountTmpfs(r.jobTmpDir); err != nil {
+			r.logger.Warn("[JobRunner] Error unmounting the job's tmpfs: %s", err)
+		}
+	}
+
+	if err := removeAllWritable(r.jobTmpDir); err != nil {
+		r.logger.Warn("[JobRunner] Error cleaning up job temp dir: %s", err)
+		return
+	}
+	r.logger.Debug("[JobRunner] Deleted job temp dir: %s", r.jobTmpDir)
+}
+
+// removeAllWritable removes a directory like os.RemoveAll, first making the
+// directories in it writable, since tools like go leave read-only ones behind
+func removeAllWritable(dir string) error {
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			_ = os.Chmod(path, 0o700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
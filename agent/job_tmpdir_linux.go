@@ -0,0 +1,19 @@
+package agent
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountTmpfs mounts a tmpfs of the given size on dir, which only the agent's
+// user can use
+func mountTmpfs(dir string, size uint64) error {
+	return unix.Mount("tmpfs", dir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, fmt.Sprintf("size=%d,mode=0700", size))
+}
+
+// unmountTmpfs unmounts the tmpfs on dir, even if something still has files
+// open on it
+func unmountTmpfs(dir string) error {
+	return unix.Unmount(dir, unix.MNT_DETACH)
+}
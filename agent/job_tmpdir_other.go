@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import "errors"
+
+func mountTmpfs(dir string, size uint64) error {
+	return errors.New("Job tmpfs mounts are only supported on Linux")
+}
+
+func unmountTmpfs(dir string) error {
+	return nil
+}
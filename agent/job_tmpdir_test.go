@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobTmpDirIsRemovedWithEverythingInIt(t *testing.T) {
+	t.Parallel()
+
+	base := filepath.Join(t.TempDir(), "jobs")
+	r := &JobRunner{
+		logger:  logger.Discard,
+		metrics: metrics.NewCollector(logger.Discard, metrics.CollectorConfig{}).Scope(metrics.Tags{}),
+		job:     &api.Job{ID: "1234"},
+		conf: JobRunnerConfig{
+			AgentConfiguration: AgentConfiguration{JobTmpPath: base},
+		},
+	}
+
+	require.NoError(t, r.createJobTmpDir())
+	assert.Equal(t, base, filepath.Dir(r.jobTmpDir))
+	assert.Equal(t, r.jobTmpDir, r.jobTmpDirEnv()["TMPDIR"])
+
+	// Jobs leave all sorts behind, including read-only directories
+	readOnly := filepath.Join(r.jobTmpDir, "gomodcache", "example.com")
+	require.NoError(t, os.MkdirAll(readOnly, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(readOnly, "go.mod"), []byte("module example.com\n"), 0o444))
+	require.NoError(t, os.Chmod(readOnly, 0o555))
+
+	r.cleanupJobTmpDir()
+
+	_, err := os.Stat(r.jobTmpDir)
+	assert.True(t, os.IsNotExist(err))
+}
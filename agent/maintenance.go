@@ -0,0 +1,263 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/hook"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// The schedule for maintenance tasks that run after each job
+const maintenanceBetweenJobs = "@between-jobs"
+
+// MaintenanceTask is a maintenance hook, like pruning docker images or
+// refreshing certificates, and when to run it. It runs the
+// maintenance-<name> hook from the agent's hooks path.
+type MaintenanceTask struct {
+	Name string
+
+	// When the task runs, which is nil for tasks that run between jobs
+	schedule *cronSchedule
+
+	// When the task is next due, for scheduled tasks
+	next time.Time
+
+	// Whether the task needs to run
+	due bool
+}
+
+// ParseMaintenanceTasks parses maintenance tasks in the form "name=schedule",
+// where the schedule is a cron schedule like "0 3 * * *", @hourly, @daily and
+// so on, or @between-jobs to run after each job
+func ParseMaintenanceTasks(specs []string) ([]*MaintenanceTask, error) {
+	var tasks []*MaintenanceTask
+	seen := map[string]bool{}
+
+	for _, spec := range specs {
+		name, schedule, ok := strings.Cut(spec, "=")
+		name, schedule = strings.TrimSpace(name), strings.TrimSpace(schedule)
+		if !ok || name == "" || schedule == "" {
+			return nil, fmt.Errorf("Invalid maintenance task %q, expected name=schedule", spec)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Maintenance task %q is defined more than once", name)
+		}
+		seen[name] = true
+
+		task := &MaintenanceTask{Name: name}
+		if schedule != maintenanceBetweenJobs {
+			var err error
+			if task.schedule, err = parseCronSchedule(schedule); err != nil {
+				return nil, fmt.Errorf("Invalid maintenance task %q: %v", name, err)
+			}
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks, nil
+}
+
+// maintenanceScheduler runs maintenance tasks when they're due, once none of
+// the agent's workers are running a job. Workers stop pinging for jobs while
+// tasks are waiting to run, so maintenance doesn't race with builds.
+type maintenanceScheduler struct {
+	logger    logger.Logger
+	hooksPath string
+	tasks     []*MaintenanceTask
+
+	mu   sync.Mutex
+	idle *sync.Cond
+
+	// Whether workers have to wait for maintenance before looking for jobs
+	paused bool
+
+	// How many workers are looking for or running a job
+	busy int
+
+	// Wakes up the scheduler when between jobs tasks are due
+	wake chan struct{}
+}
+
+func newMaintenanceScheduler(l logger.Logger, hooksPath string, tasks []*MaintenanceTask) *maintenanceScheduler {
+	m := &maintenanceScheduler{
+		logger:    l,
+		hooksPath: hooksPath,
+		tasks:     tasks,
+		wake:      make(chan struct{}, 1),
+	}
+	m.idle = sync.NewCond(&m.mu)
+	return m
+}
+
+// acquire is called by a worker before it looks for a job, and returns false
+// if the worker has to wait for maintenance instead
+func (m *maintenanceScheduler) acquire() bool {
+	if m == nil {
+		return true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.paused {
+		return false
+	}
+	m.busy++
+	return true
+}
+
+// release is called by a worker once it's done looking for a job, or once the
+// job it found has finished
+func (m *maintenanceScheduler) release(ranJob bool) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.busy--
+	if m.busy == 0 {
+		m.idle.Broadcast()
+	}
+
+	if ranJob {
+		wake := false
+		for _, task := range m.tasks {
+			if task.schedule == nil {
+				task.due = true
+				wake = true
+			}
+		}
+		if wake {
+			select {
+			case m.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Run runs maintenance tasks as they become due, until the context is done
+func (m *maintenanceScheduler) Run(ctx context.Context) {
+	for {
+		now := time.Now()
+
+		m.mu.Lock()
+		var next time.Time
+		for _, task := range m.tasks {
+			if task.schedule == nil {
+				continue
+			}
+			if task.next.IsZero() {
+				task.next = task.schedule.Next(now)
+			}
+			if !task.next.After(now) {
+				task.due = true
+				task.next = task.schedule.Next(now)
+			}
+			if next.IsZero() || task.next.Before(next) {
+				next = task.next
+			}
+		}
+		m.mu.Unlock()
+
+		m.runDue(ctx)
+
+		// Without any scheduled tasks, only between jobs tasks wake it up
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = time.After(time.Until(next))
+		}
+
+		select {
+		case <-timer:
+		case <-m.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runDue pauses the workers, waits for their jobs to finish, and runs the
+// tasks that are due
+func (m *maintenanceScheduler) runDue(ctx context.Context) {
+	m.mu.Lock()
+	var due []*MaintenanceTask
+	for _, task := range m.tasks {
+		if task.due {
+			due = append(due, task)
+		}
+	}
+	if len(due) == 0 {
+		m.mu.Unlock()
+		return
+	}
+
+	m.paused = true
+	if m.busy > 0 {
+		m.logger.Info("Waiting for running jobs to finish before running maintenance")
+	}
+	for m.busy > 0 {
+		m.idle.Wait()
+	}
+	m.mu.Unlock()
+
+	// Jobs that finished while waiting only need the tasks run once, so
+	// they're only marked as done once they've run
+	defer func() {
+		m.mu.Lock()
+		for _, task := range due {
+			task.due = false
+		}
+		m.paused = false
+		m.mu.Unlock()
+	}()
+
+	for _, task := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := m.runTask(task); err != nil {
+			m.logger.Error("Maintenance task %q failed: %v", task.Name, err)
+		}
+	}
+}
+
+// runTask runs a maintenance task's hook
+func (m *maintenanceScheduler) runTask(task *MaintenanceTask) error {
+	hookPath, err := hook.Find(m.hooksPath, "maintenance-"+task.Name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("There's no maintenance-%s hook in %s", task.Name, m.hooksPath)
+		}
+		return err
+	}
+
+	sh, err := shell.New()
+	if err != nil {
+		return err
+	}
+
+	sh.Env.Set("BUILDKITE_MAINTENANCE_TASK", task.Name)
+	sh.Writer = LogWriter{
+		l: m.logger,
+	}
+
+	m.logger.Info("Running maintenance task %q", task.Name)
+	started := time.Now()
+
+	if err := sh.RunWithoutPrompt(hookPath); err != nil {
+		return err
+	}
+
+	m.logger.Info("Finished maintenance task %q in %s", task.Name, time.Since(started).Round(time.Millisecond))
+	return nil
+}
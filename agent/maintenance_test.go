@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMaintenanceTasks(t *testing.T) {
+	tasks, err := ParseMaintenanceTasks([]string{"docker-prune=0 3 * * *", "cache-gc = @between-jobs"})
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+
+	assert.Equal(t, "docker-prune", tasks[0].Name)
+	assert.NotNil(t, tasks[0].schedule)
+	assert.Equal(t, "cache-gc", tasks[1].Name)
+	assert.Nil(t, tasks[1].schedule)
+}
+
+func TestParseMaintenanceTasksErrors(t *testing.T) {
+	for spec, expected := range map[string]string{
+		"docker-prune":          `Invalid maintenance task "docker-prune", expected name=schedule`,
+		"=@daily":               `Invalid maintenance task "=@daily", expected name=schedule`,
+		"docker-prune=whenever": `Invalid maintenance task "docker-prune": Invalid schedule "whenever", expected 5 fields but got 1`,
+	} {
+		_, err := ParseMaintenanceTasks([]string{spec})
+		assert.EqualError(t, err, expected)
+	}
+
+	_, err := ParseMaintenanceTasks([]string{"a=@daily", "a=@hourly"})
+	assert.EqualError(t, err, `Maintenance task "a" is defined more than once`)
+}
+
+func TestMaintenanceWaitsForJobs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The maintenance hook in this test is a shell script")
+	}
+
+	hooksPath := t.TempDir()
+	output := filepath.Join(t.TempDir(), "output")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(hooksPath, "maintenance-cache-gc"),
+		[]byte("#!/bin/sh\necho \"$BUILDKITE_MAINTENANCE_TASK\" >> "+output+"\n"), 0700))
+
+	tasks, err := ParseMaintenanceTasks([]string{"cache-gc=@between-jobs"})
+	require.NoError(t, err)
+
+	m := newMaintenanceScheduler(logger.Discard, hooksPath, tasks)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	// Two workers are running jobs, and one finishes
+	require.True(t, m.acquire())
+	require.True(t, m.acquire())
+	m.release(true)
+
+	// Workers can't look for jobs while maintenance is waiting
+	require.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.paused
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, m.acquire())
+
+	// It doesn't run until the other job finishes
+	time.Sleep(100 * time.Millisecond)
+	assert.NoFileExists(t, output)
+
+	m.release(true)
+
+	require.Eventually(t, func() bool {
+		return m.acquire()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	out, err := ioutil.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "cache-gc\n", string(out))
+}
+
+func TestMaintenanceSchedulerIsOptional(t *testing.T) {
+	var m *maintenanceScheduler
+	assert.True(t, m.acquire())
+	m.release(true)
+}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaintenanceWindow is a period, starting on a cron schedule, during which the
+// agent finishes the jobs it's running but doesn't accept any more, so the
+// host can be patched
+type MaintenanceWindow struct {
+	spec     string
+	schedule *cronSchedule
+	duration time.Duration
+	location *time.Location
+}
+
+// ParseMaintenanceWindows parses maintenance windows in the form "schedule
+// for duration", like "0 2 * * 6 for 4h", where the schedule is in the
+// timezone given, or the host's local timezone if it's empty
+func ParseMaintenanceWindows(specs []string, timezone string) ([]*MaintenanceWindow, error) {
+	location := time.Local
+	if timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("Invalid maintenance window timezone %q: %v", timezone, err)
+		}
+	}
+
+	var windows []*MaintenanceWindow
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, " for ")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid maintenance window %q, expected \"schedule for duration\"", spec)
+		}
+
+		schedule, err := parseCronSchedule(strings.TrimSpace(spec[:i]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid maintenance window %q: %v", spec, err)
+		}
+
+		duration, err := time.ParseDuration(strings.TrimSpace(spec[i+len(" for "):]))
+		if err != nil || duration < time.Minute {
+			return nil, fmt.Errorf("Invalid maintenance window %q, the duration must be at least 1m", spec)
+		}
+
+		windows = append(windows, &MaintenanceWindow{
+			spec:     spec,
+			schedule: schedule,
+			duration: duration,
+			location: location,
+		})
+	}
+
+	return windows, nil
+}
+
+// end returns when the window that t falls in ends, or false if t isn't in
+// the window. If the window starts again before it ends, the last one that
+// has started counts.
+func (w *MaintenanceWindow) end(t time.Time) (time.Time, bool) {
+	t = t.In(w.location)
+
+	var end time.Time
+	for start := w.schedule.Next(t.Add(-w.duration)); !start.IsZero() && !start.After(t); start = w.schedule.Next(start) {
+		end = start.Add(w.duration)
+	}
+
+	return end, end.After(t)
+}
+
+// maintenanceWindowEnd returns when the maintenance windows that t falls in
+// end, or false if t isn't in any of them
+func maintenanceWindowEnd(windows []*MaintenanceWindow, t time.Time) (time.Time, bool) {
+	var end time.Time
+	for _, w := range windows {
+		if e, ok := w.end(t); ok && e.After(end) {
+			end = e
+		}
+	}
+
+	return end, !end.IsZero()
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMaintenanceWindowsErrors(t *testing.T) {
+	for spec, expected := range map[string]string{
+		"0 2 * * 6":          `Invalid maintenance window "0 2 * * 6", expected "schedule for duration"`,
+		"0 2 * * for 4h":     `Invalid maintenance window "0 2 * * for 4h": Invalid schedule "0 2 * *", expected 5 fields but got 4`,
+		"0 2 * * 6 for ages": `Invalid maintenance window "0 2 * * 6 for ages", the duration must be at least 1m`,
+		"0 2 * * 6 for 30s":  `Invalid maintenance window "0 2 * * 6 for 30s", the duration must be at least 1m`,
+	} {
+		_, err := ParseMaintenanceWindows([]string{spec}, "")
+		assert.EqualError(t, err, expected)
+	}
+
+	_, err := ParseMaintenanceWindows(nil, "Nowhere/Special")
+	assert.Error(t, err)
+}
+
+func TestMaintenanceWindowEnd(t *testing.T) {
+	windows, err := ParseMaintenanceWindows([]string{"0 2 * * 6 for 4h", "30 23 * * * for 1h"}, "UTC")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		at   string
+		end  string
+		open bool
+	}{
+		// Saturday
+		{"2022-06-04T01:59:59Z", "", false},
+		{"2022-06-04T02:00:00Z", "2022-06-04T06:00:00Z", true},
+		{"2022-06-04T05:59:59Z", "2022-06-04T06:00:00Z", true},
+		{"2022-06-04T06:00:00Z", "", false},
+		// Sunday, which only has the nightly window
+		{"2022-06-05T02:30:00Z", "", false},
+		// The nightly window crosses midnight
+		{"2022-06-05T23:45:00Z", "2022-06-06T00:30:00Z", true},
+		{"2022-06-06T00:15:00Z", "2022-06-06T00:30:00Z", true},
+	} {
+		at, _ := time.Parse(time.RFC3339, tc.at)
+		end, open := maintenanceWindowEnd(windows, at)
+		assert.Equal(t, tc.open, open, tc.at)
+		if tc.open {
+			assert.Equal(t, tc.end, end.UTC().Format(time.RFC3339), tc.at)
+		}
+	}
+}
+
+func TestMaintenanceWindowTimezone(t *testing.T) {
+	windows, err := ParseMaintenanceWindows([]string{"0 2 * * * for 1h"}, "Australia/Melbourne")
+	require.NoError(t, err)
+
+	// 2am in Melbourne is 4pm UTC in winter
+	at, _ := time.Parse(time.RFC3339, "2022-06-04T16:30:00Z")
+	end, open := maintenanceWindowEnd(windows, at)
+	assert.True(t, open)
+	assert.Equal(t, "2022-06-04T17:00:00Z", end.UTC().Format(time.RFC3339))
+
+	_, open = maintenanceWindowEnd(windows, at.Add(-12*time.Hour))
+	assert.False(t, open)
+}
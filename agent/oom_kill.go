@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OOMWatch looks for the out-of-memory killer killing processes while a job
+// runs, so that a SIGKILL can be put down to it, or not. It reads the kernel
+// log from where it was when the watch started, so only kills from while the
+// job ran are seen.
+type OOMWatch struct {
+	// Reads the kills logged since it was last called, nil if the kernel
+	// log can't be read
+	readKills func() []oomKill
+
+	// Closes the kernel log
+	close func()
+
+	// The kills read from the kernel log so far
+	kills []oomKill
+}
+
+type oomKill struct {
+	pid     int
+	message string
+}
+
+// Check returns what shows that the out-of-memory killer killed the process
+// with the given PID since the watch started, which is empty if nothing
+// does. It returns false if the killer can't be ruled out either, because the
+// kernel log couldn't be read, or because it killed other processes which
+// may have been the job's.
+func (w *OOMWatch) Check(pid int) (string, bool) {
+	if w == nil || w.readKills == nil {
+		return "", false
+	}
+
+	w.kills = append(w.kills, w.readKills()...)
+	for _, kill := range w.kills {
+		if kill.pid == pid {
+			return fmt.Sprintf("the kernel logged %q", kill.message), true
+		}
+	}
+
+	return "", len(w.kills) == 0
+}
+
+// Close stops watching for the out-of-memory killer
+func (w *OOMWatch) Close() {
+	if w != nil && w.close != nil {
+		w.close()
+		w.close = nil
+	}
+}
+
+// parseKernelOOMKill returns the message of a /dev/kmsg record and the PID it
+// says was killed, if it's the out-of-memory killer killing a process
+func parseKernelOOMKill(record string) (oomKill, bool) {
+	// Records are "priority,sequence,microseconds,flags;message", with any
+	// continuation lines after the message
+	_, message, ok := strings.Cut(record, ";")
+	if !ok {
+		return oomKill{}, false
+	}
+	message, _, _ = strings.Cut(message, "\n")
+
+	// Like "Out of memory: Killed process 4242 (ruby) total-vm:..."
+	_, rest, ok := strings.Cut(message, "Killed process ")
+	if !ok {
+		return oomKill{}, false
+	}
+	field, _, _ := strings.Cut(rest, " ")
+	pid, err := strconv.Atoi(field)
+	if err != nil {
+		return oomKill{}, false
+	}
+
+	return oomKill{pid: pid, message: message}, true
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// WatchOOMKills starts watching for the out-of-memory killer. The watch has
+// to be closed once the job has finished.
+func WatchOOMKills() *OOMWatch {
+	// Reading /dev/kmsg gives a record at a time, and seeking to the end
+	// skips the ones already logged, so they aren't read for every job
+	fd, err := unix.Open("/dev/kmsg", unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &OOMWatch{}
+	}
+	if _, err := unix.Seek(fd, 0, io.SeekEnd); err != nil {
+		unix.Close(fd)
+		return &OOMWatch{}
+	}
+
+	return &OOMWatch{
+		readKills: func() []oomKill { return readKernelOOMKills(fd) },
+		close:     func() { unix.Close(fd) },
+	}
+}
+
+// readKernelOOMKills reads the kills logged since /dev/kmsg was last read.
+// Without blocking, reading stops with EAGAIN once there are no more records.
+func readKernelOOMKills(fd int) []oomKill {
+	var kills []oomKill
+
+	buf := make([]byte, 8192)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EPIPE {
+			// Records were overwritten before they were read
+			continue
+		}
+		if err != nil || n <= 0 {
+			break
+		}
+		if kill, ok := parseKernelOOMKill(string(buf[:n])); ok {
+			kills = append(kills, kill)
+		}
+	}
+
+	return kills
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+// WatchOOMKills returns a watch that can't see the out-of-memory killer, as
+// only Linux's logs its kills
+func WatchOOMKills() *OOMWatch {
+	return &OOMWatch{}
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKernelOOMKill(t *testing.T) {
+	t.Parallel()
+
+	kill, ok := parseKernelOOMKill("3,1093,5000000,-;Memory cgroup out of memory: Killed process 4242 (ruby) total-vm:2097152kB\n SUBSYSTEM=memory\n")
+	assert.True(t, ok)
+	assert.Equal(t, oomKill{pid: 4242, message: "Memory cgroup out of memory: Killed process 4242 (ruby) total-vm:2097152kB"}, kill)
+
+	_, ok = parseKernelOOMKill("6,1094,5000001,-;eth0: link up\n")
+	assert.False(t, ok)
+}
+
+func watchWithKills(kills ...oomKill) *OOMWatch {
+	return &OOMWatch{readKills: func() []oomKill { return kills }}
+}
+
+func TestKilledFailure(t *testing.T) {
+	t.Parallel()
+
+	// Without anything to check, it's most likely the out-of-memory killer
+	failure := KilledFailure("command", 4242, nil)
+	assert.Equal(t, FailureReasonOOMKilled, failure.Reason)
+	assert.Contains(t, failure.Message, "most likely")
+
+	// A kill of the process itself is evidence
+	failure = KilledFailure("command", 4242, watchWithKills(oomKill{pid: 4242, message: "Out of memory: Killed process 4242 (ruby)"}))
+	assert.Equal(t, &JobFailure{
+		Reason:  FailureReasonOOMKilled,
+		Message: `The command was killed by the out-of-memory killer, the kernel logged "Out of memory: Killed process 4242 (ruby)"`,
+	}, failure)
+
+	// A kill of another process, which could be another job's or one of
+	// this job's children, doesn't rule it out
+	failure = KilledFailure("command", 4242, watchWithKills(oomKill{pid: 5353, message: "Out of memory: Killed process 5353 (node)"}))
+	assert.Equal(t, FailureReasonOOMKilled, failure.Reason)
+	assert.Contains(t, failure.Message, "most likely")
+
+	// With no kills at all, it wasn't the out-of-memory killer
+	failure = KilledFailure("command", 4242, watchWithKills())
+	assert.Equal(t, &JobFailure{
+		Reason:  FailureReasonKilled,
+		Message: "The command was killed (SIGKILL), but not by the out-of-memory killer",
+	}, failure)
+}
@@ -0,0 +1,162 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// configurationErrors checks a plugin's configuration against the parts of its
+// schema that cause most mistakes (unknown keys, wrong types and missing
+// required keys), and describes what's wrong in terms of the configuration
+// rather than the schema. The schema is the decoded JSON schema.
+func configurationErrors(schema map[string]interface{}, value interface{}, path []string) []string {
+	if types := schemaTypes(schema); len(types) > 0 {
+		actual := jsonType(value)
+		if !typeMatches(types, actual) {
+			return []string{fmt.Sprintf("%s should be %s, not %s", describePath(path), strings.Join(withArticles(types), " or "), withArticle(actual))}
+		}
+	}
+
+	var errs []string
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				if key, ok := r.(string); ok {
+					if _, exists := v[key]; !exists {
+						errs = append(errs, fmt.Sprintf("missing required key %q%s", key, describeParent(path)))
+					}
+				}
+			}
+		}
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if property, ok := properties[key].(map[string]interface{}); ok {
+				errs = append(errs, configurationErrors(property, v[key], append(path[:len(path):len(path)], key))...)
+			} else if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				errs = append(errs, fmt.Sprintf("unknown key %q%s%s", key, describeParent(path), describeKnownKeys(properties)))
+			}
+		}
+
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				errs = append(errs, configurationErrors(items, item, append(path[:len(path):len(path)], fmt.Sprintf("%d", i)))...)
+			}
+		}
+	}
+
+	return errs
+}
+
+// schemaTypes returns the types a schema allows, if it says
+func schemaTypes(schema map[string]interface{}) []string {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var types []string
+		for _, v := range t {
+			if s, ok := v.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// jsonType returns the JSON schema type of a decoded JSON value
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case int, int64:
+		return "integer"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// typeMatches returns whether a value of the actual type is one of the types,
+// where every integer is also a number
+func typeMatches(types []string, actual string) bool {
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func withArticle(t string) string {
+	switch t {
+	case "null":
+		return "null"
+	case "array", "object", "integer":
+		return "an " + t
+	}
+	return "a " + t
+}
+
+func withArticles(types []string) []string {
+	described := make([]string, len(types))
+	for i, t := range types {
+		described[i] = withArticle(t)
+	}
+	return described
+}
+
+func describePath(path []string) string {
+	if len(path) == 0 {
+		return "the configuration"
+	}
+	return fmt.Sprintf("%q", strings.Join(path, "."))
+}
+
+func describeParent(path []string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" in %q", strings.Join(path, "."))
+}
+
+func describeKnownKeys(properties map[string]interface{}) string {
+	if len(properties) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return fmt.Sprintf(" (expected one of %s)", strings.Join(keys, ", "))
+}
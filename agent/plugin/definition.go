@@ -1,6 +1,7 @@
 package plugin
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -86,12 +87,6 @@ func (v Validator) Validate(def *Definition, config map[string]interface{}) Vali
 		Errors: []string{},
 	}
 
-	configAsJson, err := json.Marshal(config)
-	if err != nil {
-		result.Errors = append(result.Errors, err.Error())
-		return result
-	}
-
 	var commandExistsFunc = v.commandExists
 	if commandExistsFunc == nil {
 		commandExistsFunc = commandExists
@@ -108,18 +103,51 @@ func (v Validator) Validate(def *Definition, config map[string]interface{}) Vali
 	}
 
 	// validate that the config matches the json schema we have
-	if def.Configuration != nil {
-		valErrors, err := def.Configuration.ValidateBytes(configAsJson)
-		if err != nil {
-			result.Errors = append(result.Errors, err.Error())
-		}
-		if len(valErrors) > 0 {
-			for _, err := range valErrors {
-				result.Errors = append(result.Errors, err.Error())
+	result.Errors = append(result.Errors, v.ValidateConfiguration(def, config).Errors...)
+
+	return result
+}
+
+// ValidateConfiguration validates a plugin's configuration against the schema
+// in its definition, without checking its requirements
+func (v Validator) ValidateConfiguration(def *Definition, config map[string]interface{}) ValidateResult {
+	result := ValidateResult{
+		Errors: []string{},
+	}
+
+	if def.Configuration == nil {
+		return result
+	}
+
+	configAsJson, err := json.Marshal(config)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	// Describe the common mistakes in terms of the configuration, and leave
+	// the rest of the schema to the jsonschema library
+	var schema map[string]interface{}
+	if schemaJson, err := json.Marshal(def.Configuration); err == nil && json.Unmarshal(schemaJson, &schema) == nil {
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(configAsJson))
+		decoder.UseNumber()
+		if decoder.Decode(&value) == nil {
+			if errs := configurationErrors(schema, value, nil); len(errs) > 0 {
+				result.Errors = append(result.Errors, errs...)
+				return result
 			}
 		}
 	}
 
+	valErrors, err := def.Configuration.ValidateBytes(configAsJson)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+	for _, err := range valErrors {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
 	return result
 }
 
@@ -1,6 +1,7 @@
 package plugin
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/qri-io/jsonschema"
@@ -84,7 +85,7 @@ func TestDefinitionValidatesConfiguration(t *testing.T) {
 
 	assert.False(t, res.Valid())
 	assert.Equal(t, res.Errors, []string{
-		`/: {"llamas":"always"} "alpacas" value is required`,
+		`missing required key "alpacas"`,
 	})
 }
 
@@ -115,7 +116,7 @@ func TestDefinitionWithoutAdditionalProperties(t *testing.T) {
 
 	assert.False(t, res.Valid())
 	assert.Equal(t, res.Errors, []string{
-		`/camels: "never" cannot match schema`,
+		`unknown key "camels" (expected one of alpacas)`,
 	})
 }
 
@@ -147,3 +148,50 @@ func TestDefinitionWithAdditionalProperties(t *testing.T) {
 	assert.True(t, res.Valid())
 	assert.Equal(t, res.Errors, []string{})
 }
+
+func TestDefinitionDescribesWrongTypes(t *testing.T) {
+	validator := &Validator{}
+
+	def := &Definition{
+		Configuration: jsonschema.Must(`{
+			"type": "object",
+			"properties": {
+				"llamas": {
+					"type": "string"
+				},
+				"herd": {
+					"type": "object",
+					"properties": {
+						"size": {
+							"type": "integer"
+						},
+						"names": {
+							"type": "array",
+							"items": {
+								"type": "string"
+							}
+						}
+					},
+					"additionalProperties": false
+				}
+			}
+		}`),
+	}
+
+	res := validator.ValidateConfiguration(def, map[string]interface{}{
+		"llamas": json.Number("3"),
+		"herd": map[string]interface{}{
+			"size":   "lots",
+			"names":  []interface{}{"kuzco", true},
+			"camels": "never",
+		},
+	})
+
+	assert.False(t, res.Valid())
+	assert.Equal(t, []string{
+		`unknown key "camels" in "herd" (expected one of names, size)`,
+		`"herd.names.1" should be a string, not a boolean`,
+		`"herd.size" should be an integer, not a string`,
+		`"llamas" should be a string, not an integer`,
+	}, res.Errors)
+}
@@ -271,6 +271,22 @@ func (p *Plugin) ConfigurationToEnvironment() (env.Environment, error) {
 	return env.FromSlice(envSlice), nil
 }
 
+// Source returns the location the plugin was created from, including its
+// scheme, authentication and version
+func (p *Plugin) Source() string {
+	source := p.Location
+	if p.Authentication != "" {
+		source = p.Authentication + "@" + source
+	}
+	if p.Scheme != "" {
+		source = p.Scheme + "://" + source
+	}
+	if p.Version != "" {
+		source += "#" + p.Version
+	}
+	return source
+}
+
 // Pretty name for the plugin
 func (p *Plugin) Label() string {
 	if p.Version != "" {
@@ -0,0 +1,198 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/process"
+)
+
+const (
+	// How long each attempt at a readiness check gets
+	readinessCheckTimeout = 10 * time.Second
+
+	// How long to wait before checking again after a check fails
+	readinessCheckInterval = 5 * time.Second
+)
+
+// ReadinessCheck is something the agent's host has to pass before the agent
+// accepts a job, like the Docker daemon being healthy, a license server being
+// reachable or a VPN being up
+type ReadinessCheck struct {
+	// An http:// or https:// URL that has to respond with a 2xx status, a
+	// tcp://host:port that has to accept connections, or a command that has
+	// to exit with 0
+	Target string
+
+	// The scheme of the target, or "" for a command
+	scheme string
+}
+
+// ParseReadinessChecks parses checks in the form http://..., https://...,
+// tcp://host:port, or a command run with the shell
+func ParseReadinessChecks(targets []string) ([]ReadinessCheck, error) {
+	var checks []ReadinessCheck
+
+	for _, target := range targets {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+
+		c := ReadinessCheck{Target: target}
+		if scheme, rest, ok := strings.Cut(target, "://"); ok {
+			switch strings.ToLower(scheme) {
+			case "http", "https":
+				if u, err := url.Parse(target); err != nil || u.Host == "" {
+					return nil, fmt.Errorf("Readiness check %q isn't a valid URL", target)
+				}
+				c.scheme = strings.ToLower(scheme)
+			case "tcp":
+				if _, _, err := net.SplitHostPort(rest); err != nil {
+					return nil, fmt.Errorf("Readiness check %q should be in the form tcp://host:port", target)
+				}
+				c.scheme = "tcp"
+			}
+		}
+
+		checks = append(checks, c)
+	}
+
+	return checks, nil
+}
+
+func (c ReadinessCheck) String() string {
+	return c.Target
+}
+
+// Run runs the check once, returning why it failed if it did
+func (c ReadinessCheck) Run(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	defer cancel()
+
+	switch c.scheme {
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("it responded with %s", resp.Status)
+		}
+		return nil
+
+	case "tcp":
+		var d net.Dialer
+		_, addr, _ := strings.Cut(c.Target, "://")
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	// The command runs in its own process group, so that anything it starts
+	// is killed along with it when the check times out or the agent stops
+	var output bytes.Buffer
+	conf := process.Config{
+		Path:    "/bin/sh",
+		Args:    []string{"-c", c.Target},
+		Stdout:  &output,
+		Stderr:  &output,
+		Context: ctx,
+	}
+	if runtime.GOOS == "windows" {
+		conf.Path = "cmd.exe"
+		conf.Args = []string{"/S", "/C", c.Target}
+	}
+
+	p := process.New(logger.Discard, conf)
+	if err := p.Run(); err != nil {
+		return err
+	}
+	if err := p.WaitResult(); err != nil {
+		// The end of the output usually says what's wrong
+		lines := strings.Split(string(bytes.TrimSpace(output.Bytes())), "\n")
+		if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+			return fmt.Errorf("%v: %s", err, last)
+		}
+		return err
+	}
+	return nil
+}
+
+// waitUntilReady runs the agent's readiness checks before it accepts a job,
+// checking again until they all pass, the readiness timeout is up, or the
+// agent stops. It returns the last check that failed if they didn't pass.
+func (a *AgentWorker) waitUntilReady(job *api.Job) error {
+	checks := a.readinessChecks
+	if len(checks) == 0 {
+		return nil
+	}
+
+	// Stopping the agent stops the check that's running too, so a command
+	// that hangs doesn't hold it up
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-a.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	deadline := time.Now().Add(a.agentConfiguration.ReadinessTimeout)
+	for {
+		failed, err := runReadinessChecks(ctx, checks)
+		if err == nil {
+			a.logger.Debug("[Readiness] Job %s: all %d readiness checks passed", job.ID, len(checks))
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("The agent stopped while waiting for the readiness check %s to pass", failed)
+		}
+
+		wait := readinessCheckInterval
+		if remaining := time.Until(deadline); remaining < wait {
+			wait = remaining
+		}
+		if wait <= 0 {
+			return fmt.Errorf("The readiness check %s failed: %v", failed, err)
+		}
+
+		a.logger.Warn("Readiness check %s failed for job %s, checking again in %v: %v", failed, job.ID, wait, err)
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("The agent stopped while waiting for the readiness check %s to pass", failed)
+		}
+	}
+}
+
+// runReadinessChecks runs the checks in order, returning the first that fails
+func runReadinessChecks(ctx context.Context, checks []ReadinessCheck) (ReadinessCheck, error) {
+	for _, c := range checks {
+		if err := c.Run(ctx); err != nil {
+			return c, err
+		}
+	}
+	return ReadinessCheck{}, nil
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReadinessChecks(t *testing.T) {
+	t.Parallel()
+
+	checks, err := ParseReadinessChecks([]string{"http://localhost:2375/_ping", " HTTPS://license.internal/health ", "tcp://10.0.0.1:27000", "", "curl -sf http://localhost:8080"})
+	require.NoError(t, err)
+
+	var schemes []string
+	for _, c := range checks {
+		schemes = append(schemes, c.scheme)
+	}
+	assert.Equal(t, []string{"http", "https", "tcp", ""}, schemes)
+	assert.Equal(t, "HTTPS://license.internal/health", checks[1].String())
+
+	for target, expected := range map[string]string{
+		"http:///_ping":          `Readiness check "http:///_ping" isn't a valid URL`,
+		"tcp://license.internal": `Readiness check "tcp://license.internal" should be in the form tcp://host:port`,
+	} {
+		_, err := ParseReadinessChecks([]string{target})
+		assert.EqualError(t, err, expected)
+	}
+}
+
+func TestReadinessCheckRun(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/down" {
+			http.Error(rw, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed.Close()
+
+	targets := map[string]string{
+		server.URL + "/_ping":                      "",
+		server.URL + "/down":                       "it responded with 503 Service Unavailable",
+		"tcp://" + server.Listener.Addr().String(): "",
+		"tcp://" + closed.Addr().String():          "dial tcp",
+	}
+	if runtime.GOOS != "windows" {
+		targets["true"] = ""
+		targets["echo checking; echo daemon is down >&2; exit 3"] = "exit status 3: daemon is down"
+	}
+
+	for target, expected := range targets {
+		checks, err := ParseReadinessChecks([]string{target})
+		require.NoError(t, err)
+
+		err = checks[0].Run(context.Background())
+		if expected == "" {
+			assert.NoError(t, err, target)
+		} else if assert.Error(t, err, target) {
+			assert.Contains(t, err.Error(), expected, target)
+		}
+	}
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/down" {
+			http.Error(rw, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	job := &api.Job{ID: "job-1"}
+	worker := func(timeout time.Duration, targets ...string) *AgentWorker {
+		checks, err := ParseReadinessChecks(targets)
+		require.NoError(t, err)
+
+		return &AgentWorker{
+			logger:             logger.Discard,
+			stop:               make(chan struct{}),
+			readinessChecks:    checks,
+			agentConfiguration: AgentConfiguration{ReadinessTimeout: timeout},
+		}
+	}
+
+	assert.NoError(t, worker(0).waitUntilReady(job))
+	assert.NoError(t, worker(0, server.URL+"/_ping").waitUntilReady(job))
+
+	err := worker(0, server.URL+"/_ping", server.URL+"/down").waitUntilReady(job)
+	assert.EqualError(t, err, "The readiness check "+server.URL+"/down failed: it responded with 503 Service Unavailable")
+
+	// Stopping the agent stops it waiting
+	stopped := worker(time.Hour, server.URL+"/down")
+	close(stopped.stop)
+	err = stopped.waitUntilReady(job)
+	assert.EqualError(t, err, "The agent stopped while waiting for the readiness check "+server.URL+"/down to pass")
+
+	// And stops a check that's hanging
+	if runtime.GOOS != "windows" {
+		hanging := worker(time.Hour, "sleep 60")
+		time.AfterFunc(100*time.Millisecond, func() { close(hanging.stop) })
+
+		started := time.Now()
+		err = hanging.waitUntilReady(job)
+		assert.EqualError(t, err, "The agent stopped while waiting for the readiness check sleep 60 to pass")
+		assert.Less(t, time.Since(started), 10*time.Second)
+	}
+}
@@ -0,0 +1,340 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// How many times to try sending a job's results to Buildkite before spooling
+// them
+var spoolAfterAttempts = 6
+
+// The files results are spooled to in a job's directory. Chunks and header
+// times are delivered before the job is finished.
+const (
+	spoolChunkPrefix       = "chunk-"
+	spoolHeaderTimesPrefix = "header-times-"
+	spoolFinishFile        = "finish.json"
+)
+
+// errSpoolFull is returned when spooling more results would take the spool
+// past its maximum size
+var errSpoolFull = errors.New("The spool is full")
+
+// resultSpool keeps the results of jobs that couldn't be sent to Buildkite on
+// disk, and delivers them once it's reachable again. Each agent has its own
+// directory in the spool, since only it can finish the jobs it ran, so results
+// left behind when an agent stops are only cleaned up once they're too old.
+type resultSpool struct {
+	logger logger.Logger
+
+	// The spool shared by the agent's workers, and this agent's part of it
+	root string
+	dir  string
+
+	// How long results are kept for, and how large the whole spool can get,
+	// or 0 for no limit
+	maxAge  time.Duration
+	maxSize int64
+
+	// Guards the spool's files between the job runner and delivery
+	mu sync.Mutex
+
+	// Counts files written, so they have unique names
+	seq int
+}
+
+// newResultSpool returns a spool in root for the agent with the given UUID
+func newResultSpool(l logger.Logger, root, agentUUID string, maxAge time.Duration, maxSize int64) *resultSpool {
+	return &resultSpool{
+		logger:  l,
+		root:    root,
+		dir:     filepath.Join(root, agentUUID),
+		maxAge:  maxAge,
+		maxSize: maxSize,
+	}
+}
+
+// spooledChunk is a log chunk, with the job's ID so it can be delivered
+type spooledChunk struct {
+	JobID string     `json:"job_id"`
+	Chunk *api.Chunk `json:"chunk"`
+}
+
+// spooledHeaderTimes is a batch of header times, with the job's ID so they can
+// be delivered
+type spooledHeaderTimes struct {
+	JobID string           `json:"job_id"`
+	Times *api.HeaderTimes `json:"times"`
+}
+
+// SpoolChunk saves a log chunk for delivery later
+func (s *resultSpool) SpoolChunk(jobID string, chunk *api.Chunk) error {
+	return s.write(jobID, spoolChunkPrefix, spooledChunk{JobID: jobID, Chunk: chunk})
+}
+
+// SpoolHeaderTimes saves a batch of header times for delivery later
+func (s *resultSpool) SpoolHeaderTimes(jobID string, times *api.HeaderTimes) error {
+	return s.write(jobID, spoolHeaderTimesPrefix, spooledHeaderTimes{JobID: jobID, Times: times})
+}
+
+// SpoolFinish saves a job's finish for delivery once everything else spooled
+// for it has been
+func (s *resultSpool) SpoolFinish(job *api.Job) error {
+	return s.write(job.ID, "", job)
+}
+
+// Pending returns whether any of a job's results are waiting to be delivered,
+// in which case the rest of them need spooling so they arrive in order
+func (s *resultSpool) Pending(jobID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, _ := ioutil.ReadDir(filepath.Join(s.dir, jobID))
+	return len(files) > 0
+}
+
+// write saves a result to a file in the job's directory. Files with a prefix
+// get a unique name starting with it, otherwise it's the finish file.
+func (s *resultSpool) write(jobID, prefix string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxSize > 0 {
+		size, err := dirSize(s.root)
+		if err != nil {
+			return err
+		}
+		if size+int64(len(data)) > s.maxSize {
+			return errSpoolFull
+		}
+	}
+
+	jobDir := filepath.Join(s.dir, jobID)
+	if err := os.MkdirAll(jobDir, 0700); err != nil {
+		return err
+	}
+
+	name := spoolFinishFile
+	if prefix != "" {
+		s.seq++
+		name = fmt.Sprintf("%s%020d-%010d.json", prefix, time.Now().UnixNano(), s.seq)
+	}
+
+	// Write then rename, so delivery never sees half a file
+	tmp := filepath.Join(jobDir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(jobDir, name))
+}
+
+// Deliver tries once to send every spooled result to Buildkite, removing the
+// ones it accepts or rejects. Results older than the maximum age are dropped
+// from the whole spool, including ones left behind by previous agents.
+func (s *resultSpool) Deliver(apiClient APIClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+
+	jobs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.Warn("Failed to read the spool %s: %v", s.dir, err)
+		}
+		return
+	}
+
+	for _, job := range jobs {
+		if !job.IsDir() {
+			continue
+		}
+		if err := s.deliverJob(apiClient, filepath.Join(s.dir, job.Name())); err != nil {
+			s.logger.Warn("Failed to deliver spooled results for job %s, will try again later (%v)", job.Name(), err)
+			return
+		}
+	}
+}
+
+// deliverJob sends the results spooled for a job, finishing it last
+func (s *resultSpool) deliverJob(apiClient APIClient, jobDir string) error {
+	files, err := ioutil.ReadDir(jobDir)
+	if err != nil {
+		return err
+	}
+
+	// Chunks and header times go first, in the order they were spooled, which
+	// is how their names sort once the prefix is left off
+	var names []string
+	finish := false
+	for _, f := range files {
+		switch name := f.Name(); {
+		case name == spoolFinishFile:
+			finish = true
+		case strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, "."):
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return spoolOrder(names[i]) < spoolOrder(names[j])
+	})
+	if finish {
+		names = append(names, spoolFinishFile)
+	}
+
+	for _, name := range names {
+		path := filepath.Join(jobDir, name)
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		response, err := s.deliverFile(apiClient, name, data)
+		if err != nil {
+			if response == nil || response.StatusCode < 400 || response.StatusCode > 499 {
+				return err
+			}
+			s.logger.Warn("Buildkite rejected spooled %s for job %s (%s)", name, filepath.Base(jobDir), err)
+		} else if name == spoolFinishFile {
+			s.logger.Info("Finished job %s from the spool", filepath.Base(jobDir))
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	// Only remove the job's directory when nothing more has been spooled
+	_ = os.Remove(jobDir)
+	return nil
+}
+
+// spoolOrder returns the part of a spooled file's name that orders it among
+// the job's other results
+func spoolOrder(name string) string {
+	name = strings.TrimPrefix(name, spoolChunkPrefix)
+	return strings.TrimPrefix(name, spoolHeaderTimesPrefix)
+}
+
+// deliverFile sends a spooled result to Buildkite
+func (s *resultSpool) deliverFile(apiClient APIClient, name string, data []byte) (*api.Response, error) {
+	switch {
+	case strings.HasPrefix(name, spoolChunkPrefix):
+		var c spooledChunk
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, err
+		}
+		return apiClient.UploadChunk(c.JobID, c.Chunk)
+
+	case strings.HasPrefix(name, spoolHeaderTimesPrefix):
+		var h spooledHeaderTimes
+		if err := json.Unmarshal(data, &h); err != nil {
+			return nil, err
+		}
+		return apiClient.SaveHeaderTimes(h.JobID, h.Times)
+
+	default:
+		var job api.Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			return nil, err
+		}
+		return apiClient.FinishJob(&job)
+	}
+}
+
+// prune removes the results of jobs that haven't had any spooled for longer
+// than the maximum age from the whole spool. A job's results are dropped
+// together, so none of them are delivered without the rest.
+func (s *resultSpool) prune() {
+	if s.maxAge <= 0 {
+		return
+	}
+
+	agents, _ := ioutil.ReadDir(s.root)
+	for _, a := range agents {
+		if !a.IsDir() {
+			continue
+		}
+		agentDir := filepath.Join(s.root, a.Name())
+
+		jobs, _ := ioutil.ReadDir(agentDir)
+		for _, job := range jobs {
+			if !job.IsDir() {
+				continue
+			}
+			jobDir := filepath.Join(agentDir, job.Name())
+
+			newest, err := newestModTime(jobDir)
+			if err != nil || time.Since(newest) <= s.maxAge {
+				continue
+			}
+
+			s.logger.Warn("Dropping the spooled results in %s, they're older than %s", jobDir, s.maxAge)
+			_ = os.RemoveAll(jobDir)
+		}
+
+		// Only removed once the agent has nothing left spooled
+		_ = os.Remove(agentDir)
+	}
+}
+
+// newestModTime returns when the most recently written file in a directory
+// was written, or when the directory was if it's empty
+func newestModTime(dir string) (time.Time, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if len(files) == 0 {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return info.ModTime(), nil
+	}
+
+	var newest time.Time
+	for _, f := range files {
+		if f.ModTime().After(newest) {
+			newest = f.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// dirSize returns the total size of the files in a directory
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultSpoolDeliversChunksBeforeFinishing(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var requests []string
+	online := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !online {
+			http.Error(rw, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+	spool := newResultSpool(logger.Discard, t.TempDir(), "agent-uuid", time.Hour, 0)
+
+	assert.False(t, spool.Pending("job-1"))
+	assert.NoError(t, spool.SpoolChunk("job-1", &api.Chunk{Data: "llamas", Sequence: 1, Size: 6}))
+	assert.NoError(t, spool.SpoolHeaderTimes("job-1", &api.HeaderTimes{Times: map[string]string{"0": "now"}}))
+	assert.NoError(t, spool.SpoolChunk("job-1", &api.Chunk{Data: "alpacas", Sequence: 2, Offset: 6, Size: 7}))
+	assert.NoError(t, spool.SpoolFinish(&api.Job{ID: "job-1", ExitStatus: "0"}))
+	assert.True(t, spool.Pending("job-1"))
+
+	// Nothing is lost while Buildkite can't be reached
+	spool.Deliver(client)
+	assert.True(t, spool.Pending("job-1"))
+
+	mu.Lock()
+	online = true
+	mu.Unlock()
+
+	spool.Deliver(client)
+	assert.False(t, spool.Pending("job-1"))
+	assert.Equal(t, []string{
+		"POST /jobs/job-1/chunks",
+		"POST /jobs/job-1/header_times",
+		"POST /jobs/job-1/chunks",
+		"PUT /jobs/job-1/finish",
+	}, requests)
+}
+
+func TestResultSpoolDropsRejectedResults(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, `{"message":"Job already finished"}`, http.StatusUnprocessableEntity)
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+	spool := newResultSpool(logger.Discard, t.TempDir(), "agent-uuid", time.Hour, 0)
+
+	assert.NoError(t, spool.SpoolFinish(&api.Job{ID: "job-1", ExitStatus: "0"}))
+
+	spool.Deliver(client)
+	assert.False(t, spool.Pending("job-1"))
+}
+
+func TestResultSpoolLimits(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	spool := newResultSpool(logger.Discard, root, "agent-uuid", time.Hour, 200)
+
+	assert.NoError(t, spool.SpoolChunk("job-1", &api.Chunk{Data: "llamas"}))
+	assert.Equal(t, errSpoolFull, spool.SpoolChunk("job-1", &api.Chunk{Data: string(make([]byte, 200))}))
+
+	// Results left by a previous agent are dropped once they're too old
+	old := filepath.Join(root, "old-agent-uuid", "job-2", spoolFinishFile)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(old), 0700))
+	assert.NoError(t, os.WriteFile(old, []byte(`{"id":"job-2"}`), 0600))
+	assert.NoError(t, os.Chtimes(old, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)))
+
+	// A job with anything recent spooled keeps all of its results
+	stale := filepath.Join(root, "old-agent-uuid", "job-3", spoolFinishFile)
+	recent := filepath.Join(root, "old-agent-uuid", "job-3", spoolChunkPrefix+"1.json")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(stale), 0700))
+	assert.NoError(t, os.WriteFile(stale, []byte(`{"id":"job-3"}`), 0600))
+	assert.NoError(t, os.WriteFile(recent, []byte(`{"job_id":"job-3"}`), 0600))
+	assert.NoError(t, os.Chtimes(stale, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)))
+
+	spool.prune()
+
+	_, err := os.Stat(filepath.Dir(old))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(stale)
+	assert.NoError(t, err)
+	assert.True(t, spool.Pending("job-1"))
+}
@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
+	"github.com/buildkite/agent/v3/process"
+)
+
+// RunConfig is everything needed to run agents with Run, for programs that
+// embed the agent rather than running `buildkite-agent start`
+type RunConfig struct {
+	// Where the agents log to. Defaults to discarding everything.
+	Logger logger.Logger
+
+	// How to talk to the Buildkite Agent API. The token is the agent
+	// registration token.
+	API api.Config
+
+	// What to register the agents with. %spawn in the name is replaced with
+	// the index of each agent.
+	RegisterRequest api.AgentRegisterRequest
+
+	// How many agents to run, and whether to give each one its index as its
+	// priority
+	Spawn             int
+	SpawnWithPriority bool
+
+	// How the agents run jobs. BootstrapScript must be set, usually to
+	// "buildkite-agent bootstrap" using an installed agent.
+	AgentConfiguration AgentConfiguration
+
+	// The signal to send jobs when they're cancelled. Defaults to SIGTERM.
+	CancelSignal process.Signal
+
+	// Whether jobs run with debug logging
+	Debug bool
+
+	// Where to send metrics. Defaults to not sending them.
+	Metrics *metrics.Collector
+
+	// Registrations taken over from another agent, which are used for the
+	// first agents instead of registering them again
+	Registrations []*api.AgentRegisterResponse
+
+	// How long to wait for running jobs to finish once the context is done,
+	// before cancelling them. Zero waits for as long as they take.
+	StopTimeout time.Duration
+
+	// The longest to wait before registering, so a fleet of hosts booting
+	// at once doesn't register together. Spawned agents are spread across
+	// it too. Zero registers straight away.
+	StartDelayMax time.Duration
+}
+
+// Run registers the agents with Buildkite and runs jobs until the context is
+// done, then waits for running jobs to finish and disconnects. It returns
+// when all the agents have stopped.
+//
+// It's the same as `buildkite-agent start`, except that signals, the health
+// check server and the control socket are left to the caller.
+func Run(ctx context.Context, cfg RunConfig) error {
+	l := cfg.Logger
+	if l == nil {
+		l = logger.Discard
+	}
+
+	if cfg.AgentConfiguration.BootstrapScript == "" {
+		return errors.New("A bootstrap script is required to run jobs")
+	}
+
+	if cfg.Spawn < 1 {
+		cfg.Spawn = 1
+	}
+
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.NewCollector(l, metrics.CollectorConfig{})
+	}
+
+	if buildPath := cfg.AgentConfiguration.BuildPath; buildPath != "" {
+		if err := os.MkdirAll(buildPath, 0777); err != nil {
+			return err
+		}
+	}
+
+	workers, err := RegisterWorkers(ctx, l, api.NewClient(l, cfg.API), cfg)
+	if err != nil {
+		return err
+	}
+
+	pool := NewAgentPool(workers)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- pool.Start()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	l.Info("Stopping agents, waiting for running jobs to finish...")
+	pool.Stop(true)
+
+	if cfg.StopTimeout <= 0 {
+		return <-done
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(cfg.StopTimeout):
+		l.Info("Running jobs didn't finish within %v, canceling them", cfg.StopTimeout)
+		pool.Stop(false)
+		return <-done
+	}
+}
+
+// RegisterWorkers registers cfg.Spawn agents with Buildkite using the given
+// client, and returns workers ready to run them. If there's a start delay,
+// each agent waits for its share of it before registering, and it returns
+// the context's error if the context is done first.
+func RegisterWorkers(ctx context.Context, l logger.Logger, client APIClient, cfg RunConfig) ([]*AgentWorker, error) {
+	var workers []*AgentWorker
+
+	// Spread the fleet's registrations out across hosts, and this host's
+	// agents out across the delay
+	start := time.Now()
+	delays := make([]time.Duration, cfg.Spawn)
+	if cfg.StartDelayMax > 0 {
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		delays = spawnStartDelays(hostIdentity(l), cfg.Spawn, cfg.StartDelayMax, rnd)
+	}
+
+	for i := 1; i <= cfg.Spawn; i++ {
+		registerReq, err := spawnRegisterRequest(l, cfg, i)
+		if err != nil {
+			return nil, err
+		}
+
+		var ag *api.AgentRegisterResponse
+		if i <= len(cfg.Registrations) {
+			ag = cfg.Registrations[i-1]
+			l.Info("Taking over agent %s from the running agent", ag.Name)
+		} else {
+			if delay := delays[i-1]; delay > 0 {
+				l.Info("Waiting until %v after starting to register agent %d, to spread out registrations", delay, i)
+				if err := waitForStart(ctx, start, delay); err != nil {
+					return nil, err
+				}
+			}
+
+			if cfg.Spawn == 1 {
+				l.Info("Registering agent with Buildkite...")
+			} else {
+				l.Info("Registering agent %d of %d with Buildkite...", i, cfg.Spawn)
+			}
+
+			// Register the agent with the buildkite API
+			if ag, err = Register(l, client, registerReq); err != nil {
+				return nil, err
+			}
+		}
+
+		// Create an agent worker to run the agent
+		workers = append(workers, newSpawnedWorker(l, client, cfg, ag, registerReq, i))
+	}
+
+	return workers, nil
+}
+
+// RegisterWorker registers the agent with the given spawn index with
+// Buildkite, for adding an agent to a pool that's already running
+func RegisterWorker(l logger.Logger, client APIClient, cfg RunConfig, index int) (*AgentWorker, error) {
+	registerReq, err := spawnRegisterRequest(l, cfg, index)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Info("Registering agent %d with Buildkite...", index)
+	ag, err := Register(l, client, registerReq)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSpawnedWorker(l, client, cfg, ag, registerReq, index), nil
+}
+
+// spawnRegisterRequest returns the request to register the agent with the
+// given spawn index with
+func spawnRegisterRequest(l logger.Logger, cfg RunConfig, index int) (api.AgentRegisterRequest, error) {
+	registerReq := cfg.RegisterRequest
+
+	// Each agent's name is expanded for it, so %spawn and %random differ
+	// between them
+	name, err := ExpandAgentName(cfg.RegisterRequest.Name, cfg.RegisterRequest.Tags, index)
+	if err != nil {
+		return registerReq, err
+	}
+	registerReq.Name = name
+
+	if cfg.SpawnWithPriority {
+		l.Info("Assigning priority %s for agent %d", strconv.Itoa(index), index)
+		registerReq.Priority = strconv.Itoa(index)
+	}
+
+	return registerReq, nil
+}
+
+func newSpawnedWorker(l logger.Logger, client APIClient, cfg RunConfig, ag *api.AgentRegisterResponse, registerReq api.AgentRegisterRequest, index int) *AgentWorker {
+	return NewAgentWorker(
+		l.WithFields(logger.StringField(`agent`, ag.Name)), ag, cfg.Metrics, client, AgentWorkerConfig{
+			AgentConfiguration: cfg.AgentConfiguration,
+			CancelSignal:       cfg.CancelSignal,
+			Debug:              cfg.Debug,
+			DebugHTTP:          cfg.API.DebugHTTP,
+			SpawnIndex:         index,
+			RegisterRequest:    registerReq,
+		})
+}
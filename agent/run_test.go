@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunRegistersAndStopsAgents(t *testing.T) {
+	var mu sync.Mutex
+	var names []string
+	var pings, disconnects int
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch req.URL.Path {
+		case "/register":
+			var reg api.AgentRegisterRequest
+			require.NoError(t, json.NewDecoder(req.Body).Decode(&reg))
+			names = append(names, reg.Name)
+			fmt.Fprintf(rw, `{"id":%q,"name":%q,"access_token":"alpacas","ping_interval":1,"heartbeat_interval":60}`, reg.Name, reg.Name)
+
+		case "/connect":
+			fmt.Fprint(rw, `{}`)
+
+		case "/ping":
+			pings++
+			fmt.Fprint(rw, `{}`)
+
+		case "/disconnect":
+			disconnects++
+			fmt.Fprint(rw, `{}`)
+
+		default:
+			t.Errorf("Unknown endpoint %s %s", req.Method, req.URL.Path)
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		cancel()
+	}()
+
+	err := Run(ctx, RunConfig{
+		API:                api.Config{Endpoint: server.URL, Token: "llamas"},
+		RegisterRequest:    api.AgentRegisterRequest{Name: "embedded-%spawn"},
+		Spawn:              2,
+		AgentConfiguration: AgentConfiguration{BootstrapScript: "true", BuildPath: t.TempDir()},
+	})
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.ElementsMatch(t, []string{"embedded-1", "embedded-2"}, names)
+	assert.GreaterOrEqual(t, pings, 2)
+	assert.Equal(t, 2, disconnects)
+}
+
+func TestRunRequiresBootstrapScript(t *testing.T) {
+	err := Run(context.Background(), RunConfig{})
+	assert.EqualError(t, err, "A bootstrap script is required to run jobs")
+}
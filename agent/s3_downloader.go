@@ -3,7 +3,6 @@ package agent
 import (
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -45,10 +44,21 @@ func NewS3Downloader(l logger.Logger, c S3DownloaderConfig) *S3Downloader {
 }
 
 func (d S3Downloader) Start() error {
+	client, conf, err := d.request()
+	if err != nil {
+		return err
+	}
+
+	return NewDownload(d.logger, client, conf).Start()
+}
+
+// request returns the client and the config for downloading the file from
+// its pre-signed URL
+func (d S3Downloader) request() (*http.Client, DownloadConfig, error) {
 	// Initialize the s3 client, and authenticate it
 	s3Client, err := newS3Client(d.logger, d.BucketName())
 	if err != nil {
-		return err
+		return nil, DownloadConfig{}, err
 	}
 
 	req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
@@ -58,37 +68,29 @@ func (d S3Downloader) Start() error {
 
 	signedURL, err := req.Presign(time.Hour)
 	if err != nil {
-		return fmt.Errorf("error pre-signing request: %v", err)
+		return nil, DownloadConfig{}, fmt.Errorf("error pre-signing request: %v", err)
 	}
 
 	// We can now cheat and pass the URL onto our regular downloader
-	return NewDownload(d.logger, http.DefaultClient, DownloadConfig{
+	return http.DefaultClient, DownloadConfig{
 		URL:         signedURL,
 		Path:        d.conf.Path,
 		Destination: d.conf.Destination,
 		Retries:     d.conf.Retries,
 		DebugHTTP:   d.conf.DebugHTTP,
-	}).Start()
+	}, nil
 }
 
 func (d S3Downloader) BucketFileLocation() string {
-	if d.BucketPath() != "" {
-		return strings.TrimSuffix(d.BucketPath(), "/") + "/" + strings.TrimPrefix(d.conf.Path, "/")
-	} else {
-		return d.conf.Path
-	}
+	return storageKey(d.BucketPath(), d.conf.Path)
 }
 
 func (d S3Downloader) BucketPath() string {
-	return strings.Join(d.destinationParts()[1:len(d.destinationParts())], "/")
+	_, path := splitStorageDestination(d.conf.Bucket, "s3")
+	return path
 }
 
 func (d S3Downloader) BucketName() string {
-	return d.destinationParts()[0]
-}
-
-func (d S3Downloader) destinationParts() []string {
-	trimmed := strings.TrimPrefix(d.conf.Bucket, "s3://")
-
-	return strings.Split(trimmed, "/")
+	name, _ := splitStorageDestination(d.conf.Bucket, "s3")
+	return name
 }
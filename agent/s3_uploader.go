@@ -58,12 +58,7 @@ func NewS3Uploader(l logger.Logger, c S3UploaderConfig) (*S3Uploader, error) {
 }
 
 func ParseS3Destination(destination string) (name string, path string) {
-	destinationWithNoTrailingSlash := strings.TrimSuffix(string(destination), "/")
-	destinationWithNoProtocol := strings.TrimPrefix(destinationWithNoTrailingSlash, "s3://")
-	parts := strings.Split(destinationWithNoProtocol, "/")
-	path = strings.Join(parts[1:len(parts)], "/")
-	name = parts[0]
-	return
+	return splitStorageDestination(strings.TrimSuffix(destination, "/"), "s3")
 }
 
 func (u *S3Uploader) URL(artifact *api.Artifact) string {
@@ -92,10 +87,11 @@ func (u *S3Uploader) Upload(artifact *api.Artifact) error {
 
 	// Open file from filesystem
 	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
-	f, err := os.Open(artifact.AbsolutePath)
+	f, err := openArtifact(u.logger, artifact)
 	if err != nil {
 		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
+	defer f.Close()
 
 	// Upload the file to S3.
 	u.logger.Debug("Uploading \"%s\" to bucket with permission `%s`", u.artifactPath(artifact), permission)
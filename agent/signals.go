@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/buildkite/agent/v3/process"
+)
+
+// SignalAction is what the agent does when it receives a signal
+type SignalAction string
+
+const (
+	// Cancel running jobs and disconnect straight away
+	SignalActionCancel SignalAction = "cancel"
+
+	// Stop accepting jobs and disconnect once running jobs finish. Draining
+	// an agent that's already draining cancels its jobs.
+	SignalActionDrain SignalAction = "drain"
+
+	// Log what each worker is doing and carry on
+	SignalActionDump SignalAction = "dump"
+
+	// Load the configuration again and apply the settings that can change
+	// without restarting, leaving running jobs alone
+	SignalActionReload SignalAction = "reload"
+
+	// Do nothing
+	SignalActionIgnore SignalAction = "ignore"
+)
+
+// DefaultSignalActions are the actions for signals the agent handles when
+// they aren't configured
+var DefaultSignalActions = map[process.Signal]SignalAction{
+	process.SIGHUP:  SignalActionReload,
+	process.SIGINT:  SignalActionDrain,
+	process.SIGTERM: SignalActionDrain,
+	process.SIGQUIT: SignalActionCancel,
+	process.SIGUSR1: SignalActionDump,
+}
+
+// ParseSignalActions parses signal actions in the form "signal=action", like
+// "SIGTERM=cancel", on top of the default actions
+func ParseSignalActions(specs []string) (map[process.Signal]SignalAction, error) {
+	actions := map[process.Signal]SignalAction{}
+	for sig, action := range DefaultSignalActions {
+		actions[sig] = action
+	}
+
+	for _, spec := range specs {
+		name, action, ok := strings.Cut(spec, "=")
+		name, action = strings.TrimSpace(name), strings.TrimSpace(action)
+		if !ok || name == "" || action == "" {
+			return nil, fmt.Errorf("Invalid signal action %q, expected signal=action", spec)
+		}
+
+		sig, err := process.ParseSignal(name)
+		if err != nil {
+			return nil, err
+		}
+
+		switch a := SignalAction(strings.ToLower(action)); a {
+		case SignalActionCancel, SignalActionDrain, SignalActionDump, SignalActionReload, SignalActionIgnore:
+			actions[sig] = a
+		default:
+			return nil, fmt.Errorf("Unknown action %q for %s, expected cancel, drain, dump, reload or ignore", action, sig)
+		}
+	}
+
+	return actions, nil
+}
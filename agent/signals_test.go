@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSignalActions(t *testing.T) {
+	t.Parallel()
+
+	actions, err := ParseSignalActions([]string{"sigterm=cancel", "SIGUSR2 = Dump"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[process.Signal]SignalAction{
+		process.SIGHUP:  SignalActionReload,
+		process.SIGINT:  SignalActionDrain,
+		process.SIGTERM: SignalActionCancel,
+		process.SIGQUIT: SignalActionCancel,
+		process.SIGUSR1: SignalActionDump,
+		process.SIGUSR2: SignalActionDump,
+	}, actions)
+
+	for _, tc := range []struct {
+		spec, err string
+	}{
+		{"SIGTERM", `Invalid signal action "SIGTERM", expected signal=action`},
+		{"SIGKILL=drain", `Unknown signal "SIGKILL"`},
+		{"SIGTERM=explode", `Unknown action "explode" for SIGTERM, expected cancel, drain, dump, reload or ignore`},
+	} {
+		_, err := ParseSignalActions([]string{tc.spec})
+		assert.EqualError(t, err, tc.err, tc.spec)
+	}
+}
+
+func TestAgentPoolSignalsEscalate(t *testing.T) {
+	t.Parallel()
+
+	newWorker := func() *AgentWorker {
+		return &AgentWorker{
+			logger: logger.Discard,
+			agent:  &api.AgentRegisterResponse{Name: "llama"},
+			stop:   make(chan struct{}),
+		}
+	}
+
+	pool := NewAgentPool([]*AgentWorker{newWorker(), newWorker()})
+	pool.HandleSignal(logger.Discard, SignalActionDump)
+	pool.HandleSignal(logger.Discard, SignalActionIgnore)
+	assert.False(t, pool.draining)
+
+	// Handing over counts as the first drain, so the next one escalates
+	pool.HandOver(1)
+	assert.True(t, pool.draining)
+
+	for _, worker := range pool.workers {
+		assert.True(t, worker.stopping)
+	}
+
+	pool.HandleSignal(logger.Discard, SignalActionDrain)
+	pool.HandleSignal(logger.Discard, SignalActionCancel)
+}
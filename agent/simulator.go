@@ -0,0 +1,325 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// SimulatorConfig is the configuration for a fleet of simulated agents
+type SimulatorConfig struct {
+	// How many agents to register
+	Agents int
+
+	// The name of each agent, with %n replaced by its number
+	Name string
+
+	// The tags the agents register with
+	Tags []string
+
+	// How long each job runs for, picked at random between the two
+	MinJobDuration time.Duration
+	MaxJobDuration time.Duration
+
+	// How many lines of log output each job writes every second, and how
+	// long each line is
+	LogLinesPerSecond int
+	LogLineLength     int
+
+	// The fraction of jobs, between 0 and 1, that finish with a non-zero
+	// exit status
+	FailureRate float64
+
+	// Whether each agent disconnects after running one job
+	DisconnectAfterJob bool
+}
+
+// SimulatorStats are running totals of what the simulated agents have done
+type SimulatorStats struct {
+	AgentsRegistered int64
+	JobsRun          int64
+	JobsFailed       int64
+	JobsCanceled     int64
+	ChunksUploaded   int64
+	BytesUploaded    int64
+	APIErrors        int64
+}
+
+func (s SimulatorStats) String() string {
+	return fmt.Sprintf("%d agents registered, %d jobs run (%d failed, %d canceled), %d log chunks (%d bytes) uploaded, %d API errors",
+		s.AgentsRegistered, s.JobsRun, s.JobsFailed, s.JobsCanceled, s.ChunksUploaded, s.BytesUploaded, s.APIErrors)
+}
+
+// Simulator registers virtual agents that accept jobs and pretend to run
+// them, writing generated log output for a while before finishing, without
+// running any commands. It's for load testing queues, proxies and monitoring.
+type Simulator struct {
+	logger    logger.Logger
+	apiClient APIClient
+	conf      SimulatorConfig
+	stats     SimulatorStats
+}
+
+// NewSimulator returns a Simulator that registers agents with the given
+// client, which should have a registration token
+func NewSimulator(l logger.Logger, ac APIClient, c SimulatorConfig) *Simulator {
+	if c.MaxJobDuration < c.MinJobDuration {
+		c.MaxJobDuration = c.MinJobDuration
+	}
+	if c.LogLineLength <= 0 {
+		c.LogLineLength = 80
+	}
+	return &Simulator{
+		logger:    l,
+		apiClient: ac,
+		conf:      c,
+	}
+}
+
+// Stats returns what the simulated agents have done so far
+func (s *Simulator) Stats() SimulatorStats {
+	return SimulatorStats{
+		AgentsRegistered: atomic.LoadInt64(&s.stats.AgentsRegistered),
+		JobsRun:          atomic.LoadInt64(&s.stats.JobsRun),
+		JobsFailed:       atomic.LoadInt64(&s.stats.JobsFailed),
+		JobsCanceled:     atomic.LoadInt64(&s.stats.JobsCanceled),
+		ChunksUploaded:   atomic.LoadInt64(&s.stats.ChunksUploaded),
+		BytesUploaded:    atomic.LoadInt64(&s.stats.BytesUploaded),
+		APIErrors:        atomic.LoadInt64(&s.stats.APIErrors),
+	}
+}
+
+// Run registers the agents and runs them until the context is cancelled, or
+// they've all been told to disconnect
+func (s *Simulator) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, s.conf.Agents)
+
+	for i := 1; i <= s.conf.Agents; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := s.runAgent(ctx, i); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	var failed []string
+	for err := range errs {
+		failed = append(failed, err.Error())
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d simulated agents failed: %s", len(failed), s.conf.Agents, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (s *Simulator) runAgent(ctx context.Context, i int) error {
+	name := strings.ReplaceAll(s.conf.Name, "%n", fmt.Sprintf("%d", i))
+	l := s.logger.WithFields(logger.StringField("agent", name))
+
+	registered, err := Register(l, s.apiClient, api.AgentRegisterRequest{
+		Name:              name,
+		Tags:              s.conf.Tags,
+		ScriptEvalEnabled: true,
+	})
+	if err != nil {
+		return fmt.Errorf("%s failed to register: %v", name, err)
+	}
+	atomic.AddInt64(&s.stats.AgentsRegistered, 1)
+
+	var client APIClient = s.apiClient.FromAgentRegisterResponse(registered)
+	if _, err := client.Connect(); err != nil {
+		return fmt.Errorf("%s failed to connect: %v", name, err)
+	}
+
+	defer func() {
+		if _, err := client.Disconnect(); err != nil {
+			s.apiError(l, "Failed to disconnect: %v", err)
+		}
+	}()
+
+	agentCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go s.heartbeat(agentCtx, l, client, secondsOrDefault(registered.HeartbeatInterval, 60))
+
+	pingInterval := secondsOrDefault(registered.PingInterval, 10)
+	jobStatusInterval := secondsOrDefault(registered.JobStatusInterval, 5)
+
+	for {
+		ping, _, err := client.Ping(nil)
+		if err != nil {
+			s.apiError(l, "Failed to ping: %v", err)
+		} else {
+			if ping.Action == "disconnect" {
+				l.Info("Told to disconnect")
+				return nil
+			}
+
+			if ping.Job != nil {
+				s.runJob(agentCtx, l, client, ping.Job, jobStatusInterval)
+				if s.conf.DisconnectAfterJob {
+					return nil
+				}
+				continue
+			}
+		}
+
+		select {
+		case <-time.After(pingInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *Simulator) heartbeat(ctx context.Context, l logger.Logger, client APIClient, interval time.Duration) {
+	for {
+		select {
+		case <-time.After(interval):
+			if _, _, err := client.Heartbeat(); err != nil {
+				s.apiError(l, "Failed to heartbeat: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runJob accepts a job and writes generated log output for it until it's
+// run for long enough, or it's cancelled
+func (s *Simulator) runJob(ctx context.Context, l logger.Logger, client APIClient, job *api.Job, jobStatusInterval time.Duration) {
+	accepted, _, err := client.AcceptJob(job)
+	if err != nil {
+		s.apiError(l, "Failed to accept job %s: %v", job.ID, err)
+		return
+	}
+
+	accepted.StartedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	if _, err := client.StartJob(accepted); err != nil {
+		s.apiError(l, "Failed to start job %s: %v", job.ID, err)
+		return
+	}
+
+	duration := s.jobDuration()
+	l.Info("Running simulated job %s for %v", job.ID, duration)
+
+	deadline := time.After(duration)
+	output := time.NewTicker(time.Second)
+	defer output.Stop()
+	status := time.NewTicker(jobStatusInterval)
+	defer status.Stop()
+
+	exitStatus := "0"
+	if rand.Float64() < s.conf.FailureRate {
+		exitStatus = "1"
+	}
+
+	var sequence, offset, line int
+	var signalReason string
+
+running:
+	for {
+		select {
+		case <-output.C:
+			data := s.logOutput(&line)
+			if data == "" {
+				continue
+			}
+			sequence++
+			if _, err := client.UploadChunk(accepted.ID, &api.Chunk{
+				Data:     data,
+				Sequence: sequence,
+				Offset:   offset,
+				Size:     len(data),
+			}); err != nil {
+				s.apiError(l, "Failed to upload log chunk for job %s: %v", job.ID, err)
+			} else {
+				atomic.AddInt64(&s.stats.ChunksUploaded, 1)
+				atomic.AddInt64(&s.stats.BytesUploaded, int64(len(data)))
+			}
+			offset += len(data)
+
+		case <-status.C:
+			state, _, err := client.GetJobState(accepted.ID)
+			if err != nil {
+				s.apiError(l, "Failed to get state of job %s: %v", job.ID, err)
+			} else if state.State == "canceling" || state.State == "canceled" {
+				exitStatus, signalReason = "-1", "cancel"
+				break running
+			}
+
+		case <-deadline:
+			break running
+
+		case <-ctx.Done():
+			exitStatus, signalReason = "-1", "agent_stop"
+			break running
+		}
+	}
+
+	accepted.ExitStatus = exitStatus
+	accepted.SignalReason = signalReason
+	accepted.FinishedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	if _, err := client.FinishJob(accepted); err != nil {
+		s.apiError(l, "Failed to finish job %s: %v", job.ID, err)
+		return
+	}
+
+	atomic.AddInt64(&s.stats.JobsRun, 1)
+	switch {
+	case signalReason != "":
+		atomic.AddInt64(&s.stats.JobsCanceled, 1)
+	case exitStatus != "0":
+		atomic.AddInt64(&s.stats.JobsFailed, 1)
+	}
+
+	l.Info("Finished simulated job %s with exit status %s", job.ID, exitStatus)
+}
+
+// logOutput generates a second's worth of log lines
+func (s *Simulator) logOutput(line *int) string {
+	var b strings.Builder
+	for i := 0; i < s.conf.LogLinesPerSecond; i++ {
+		*line++
+		text := fmt.Sprintf("Simulated output line %d ", *line)
+		if pad := s.conf.LogLineLength - len(text); pad > 0 {
+			text += strings.Repeat(".", pad)
+		}
+		b.WriteString(text)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func (s *Simulator) jobDuration() time.Duration {
+	spread := s.conf.MaxJobDuration - s.conf.MinJobDuration
+	if spread <= 0 {
+		return s.conf.MinJobDuration
+	}
+	return s.conf.MinJobDuration + time.Duration(rand.Int63n(int64(spread)))
+}
+
+func (s *Simulator) apiError(l logger.Logger, format string, v ...interface{}) {
+	atomic.AddInt64(&s.stats.APIErrors, 1)
+	l.Warn(format, v...)
+}
+
+func secondsOrDefault(seconds, def int) time.Duration {
+	if seconds <= 0 {
+		seconds = def
+	}
+	return time.Duration(seconds) * time.Second
+}
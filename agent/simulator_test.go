@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulatorRunsJobs(t *testing.T) {
+	var mu sync.Mutex
+	var finished []api.Job
+	var chunks, disconnects int
+	dispatched := map[string]bool{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case req.URL.Path == "/register":
+			var reg api.AgentRegisterRequest
+			require.NoError(t, json.NewDecoder(req.Body).Decode(&reg))
+			fmt.Fprintf(rw, `{"uuid":%q,"name":%q,"access_token":"alpacas","ping_interval":1,"job_status_interval":5,"heartbeat_interval":60}`, reg.Name, reg.Name)
+
+		case req.URL.Path == "/connect", req.URL.Path == "/disconnect":
+			if req.URL.Path == "/disconnect" {
+				disconnects++
+			}
+			fmt.Fprint(rw, `{}`)
+
+		case req.URL.Path == "/ping":
+			// Give each agent one job
+			agent := req.Header.Get("Authorization")
+			if dispatched[agent] {
+				fmt.Fprint(rw, `{}`)
+				return
+			}
+			dispatched[agent] = true
+			fmt.Fprintf(rw, `{"job":{"id":"job-%d"}}`, len(dispatched))
+
+		case strings.HasSuffix(req.URL.Path, "/accept"), strings.HasSuffix(req.URL.Path, "/start"):
+			id := strings.Split(req.URL.Path, "/")[2]
+			fmt.Fprintf(rw, `{"id":%q}`, id)
+
+		case strings.HasSuffix(req.URL.Path, "/chunks"):
+			chunks++
+			rw.WriteHeader(http.StatusCreated)
+
+		case strings.HasSuffix(req.URL.Path, "/finish"):
+			var job api.Job
+			require.NoError(t, json.NewDecoder(req.Body).Decode(&job))
+			finished = append(finished, job)
+			fmt.Fprint(rw, `{}`)
+
+		default:
+			t.Errorf("Unknown endpoint %s %s", req.Method, req.URL.Path)
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+
+	simulator := NewSimulator(logger.Discard, client, SimulatorConfig{
+		Agents:             1,
+		Name:               "sim-%n",
+		MinJobDuration:     1500 * time.Millisecond,
+		LogLinesPerSecond:  2,
+		DisconnectAfterJob: true,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.NoError(t, simulator.Run(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Len(t, finished, 1)
+	assert.Equal(t, "0", finished[0].ExitStatus)
+	assert.NotEmpty(t, finished[0].FinishedAt)
+	assert.GreaterOrEqual(t, chunks, 1)
+	assert.Equal(t, 1, disconnects)
+
+	stats := simulator.Stats()
+	assert.Equal(t, int64(1), stats.AgentsRegistered)
+	assert.Equal(t, int64(1), stats.JobsRun)
+	assert.Equal(t, int64(0), stats.APIErrors)
+}
+
+func TestSimulatorLogOutput(t *testing.T) {
+	s := NewSimulator(logger.Discard, nil, SimulatorConfig{LogLinesPerSecond: 3, LogLineLength: 40})
+
+	line := 0
+	output := s.logOutput(&line)
+
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, 3, line)
+	for _, l := range lines {
+		assert.Len(t, l, 40)
+	}
+}
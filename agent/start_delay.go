@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// How much of the maximum start delay is random on top of the part that comes
+// from the host's identity, for hosts cloned with the same identity
+const startDelayJitterFraction = 10
+
+// hostStartDelay returns how long the agent waits before registering, up to
+// max. Most of it comes from the host's identity, so a fleet booting at once
+// spreads out evenly, with some jitter for hosts that share an identity.
+func hostStartDelay(identity string, max time.Duration, rnd *rand.Rand) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(identity))
+	delay := time.Duration(h.Sum64() % uint64(max))
+
+	if jitter := max / startDelayJitterFraction; jitter > 0 {
+		delay += time.Duration(rnd.Int63n(int64(jitter)))
+	}
+
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// spawnStartDelays returns how long after starting each spawned agent waits
+// before registering, so none waits longer than max. Spawned agents are
+// staggered evenly across it, with the host's delay within the stagger.
+func spawnStartDelays(identity string, spawn int, max time.Duration, rnd *rand.Rand) []time.Duration {
+	if spawn < 1 {
+		spawn = 1
+	}
+
+	stagger := max / time.Duration(spawn)
+	host := hostStartDelay(identity, stagger, rnd)
+
+	delays := make([]time.Duration, spawn)
+	for i := range delays {
+		delays[i] = host + time.Duration(i)*stagger
+	}
+	return delays
+}
+
+// waitForStart waits until the delay after start has passed, returning the
+// context's error if it's done first
+func waitForStart(ctx context.Context, start time.Time, delay time.Duration) error {
+	wait := time.Until(start.Add(delay))
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostStartDelay(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(1))
+	max := time.Minute
+
+	assert.Equal(t, time.Duration(0), hostStartDelay("host-1", 0, rnd))
+
+	// The same host waits about as long each time it boots, and different
+	// hosts wait different amounts
+	first := hostStartDelay("host-1", max, rnd)
+	again := hostStartDelay("host-1", max, rnd)
+	other := hostStartDelay("host-2", max, rnd)
+
+	for _, d := range []time.Duration{first, again, other} {
+		assert.True(t, d >= 0 && d <= max, "%v isn't between 0 and %v", d, max)
+	}
+	assert.InDelta(t, float64(first), float64(again), float64(max/startDelayJitterFraction))
+	assert.NotEqual(t, first, other)
+}
+
+func TestSpawnStartDelays(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(1))
+
+	assert.Equal(t, []time.Duration{0, 0, 0}, spawnStartDelays("host-1", 3, 0, rnd))
+
+	// Each agent waits once, a quarter of the maximum after the one before,
+	// and none of them longer than the maximum
+	delays := spawnStartDelays("host-1", 4, time.Minute, rnd)
+	assert.Len(t, delays, 4)
+	assert.True(t, delays[0] >= 0 && delays[0] <= 15*time.Second, "%v isn't between 0 and 15s", delays[0])
+	for i := 1; i < len(delays); i++ {
+		assert.Equal(t, 15*time.Second, delays[i]-delays[i-1])
+	}
+	assert.True(t, delays[3] <= time.Minute, "%v is longer than a minute", delays[3])
+}
+
+func TestWaitForStartStopsWhenCancelled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, waitForStart(ctx, time.Now(), time.Hour), context.Canceled)
+
+	assert.NoError(t, waitForStart(context.Background(), time.Now(), 0))
+	assert.NoError(t, waitForStart(ctx, time.Now().Add(-time.Hour), time.Minute))
+}
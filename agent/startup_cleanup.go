@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nightlyone/lockfile"
+)
+
+// The lock files git leaves in a checkout's .git directory when it's killed
+// part way through a command, which stop every git command after it
+var gitLockFiles = []string{"index.lock", "HEAD.lock", "config.lock", "shallow.lock", "packed-refs.lock"}
+
+// The prefixes of the temp files jobs and their hooks create, which are
+// removed when they finish unless the agent or bootstrap is killed first
+var jobTempFilePrefixes = []string{
+	"buildkite-agent-bootstrap-hook-runner-",
+	"buildkite-agent-bootstrap-hook-env-before-",
+	"buildkite-agent-bootstrap-hook-env-after-",
+	"buildkite-script-",
+	"buildkite-git-ssh-config-",
+	"buildkite_job_log",
+	"job-hook-",
+	"job-env-",
+	"job-failure-reason-",
+	"job-artifact-quota-",
+}
+
+// StartupCleanupConfig is where to look for things left behind by agents
+// that crashed or were killed, and how old they must be before they're
+// removed
+type StartupCleanupConfig struct {
+	BuildPath      string
+	PluginsPath    string
+	GitMirrorsPath string
+	KnownHostsPath string
+	TempDir        string
+
+	// Git lock files and temp files younger than this could belong to
+	// another agent on the same host that's still running a job, so they're
+	// left alone. Lock files whose owner isn't running are always removed.
+	MinAge time.Duration
+}
+
+// CleanedUpFile is a file removed by the startup cleanup, and why
+type CleanedUpFile struct {
+	Path   string
+	Reason string
+}
+
+// StartupCleanupReport is what the startup cleanup removed, and what it
+// couldn't
+type StartupCleanupReport struct {
+	Removed []CleanedUpFile
+	Errors  []error
+}
+
+// CleanupStartupLeftovers removes the locks and temp files left behind by
+// agents and bootstraps that didn't get to clean up after themselves, which
+// would otherwise make jobs wait for locks nobody holds or fail git commands.
+// It runs before the agent registers, so none of them are this agent's.
+func CleanupStartupLeftovers(conf StartupCleanupConfig) StartupCleanupReport {
+	c := &startupCleanup{conf: conf, now: time.Now()}
+
+	// The locks the bootstrap takes around plugin checkouts, git mirrors and
+	// known_hosts. Locks taken with the flock experiment are released by the
+	// kernel when their owner dies, so only the pid-based ones are checked.
+	c.removeDeadLocks(conf.PluginsPath, ".lock")
+	c.removeDeadLocks(conf.GitMirrorsPath, ".clonelock")
+	c.removeDeadLocks(conf.GitMirrorsPath, ".updatelock")
+	if conf.KnownHostsPath != "" {
+		c.removeDeadLock(conf.KnownHostsPath + ".lock")
+	}
+
+	c.removeStaleGitLocks()
+	c.removeStaleTempFiles()
+
+	return c.report
+}
+
+type startupCleanup struct {
+	conf   StartupCleanupConfig
+	now    time.Time
+	report StartupCleanupReport
+}
+
+// removeDeadLocks removes the pid-based lock files with the given suffix in
+// dir whose owner isn't running
+func (c *startupCleanup) removeDeadLocks(dir, suffix string) {
+	if dir == "" {
+		return
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+suffix))
+	if err != nil {
+		c.report.Errors = append(c.report.Errors, err)
+		return
+	}
+
+	for _, path := range paths {
+		c.removeDeadLock(path)
+	}
+}
+
+func (c *startupCleanup) removeDeadLock(path string) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		c.report.Errors = append(c.report.Errors, err)
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+
+	lock, err := lockfile.New(path)
+	if err != nil {
+		c.report.Errors = append(c.report.Errors, fmt.Errorf("Failed to check lock %q: %w", path, err))
+		return
+	}
+
+	switch _, err := lock.GetOwner(); {
+	case errors.Is(err, lockfile.ErrDeadOwner):
+		c.remove(path, "the process holding the lock isn't running")
+	case errors.Is(err, lockfile.ErrInvalidPid):
+		c.remove(path, "the lock doesn't say which process holds it")
+	}
+}
+
+// removeStaleGitLocks removes old git lock files from the checkouts in the
+// build path, which are laid out as <agent>/<org>/<pipeline>
+func (c *startupCleanup) removeStaleGitLocks() {
+	if c.conf.BuildPath == "" {
+		return
+	}
+
+	dirs, _ := ioutil.ReadDir(c.conf.BuildPath)
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		for _, checkout := range checkoutDirsByLastUse(filepath.Join(c.conf.BuildPath, dir.Name())) {
+			for _, name := range gitLockFiles {
+				c.removeIfStale(filepath.Join(checkout, ".git", name), "git was stopped before it finished")
+			}
+		}
+	}
+}
+
+// removeStaleTempFiles removes old temp files created for jobs and hooks
+func (c *startupCleanup) removeStaleTempFiles() {
+	if c.conf.TempDir == "" {
+		return
+	}
+
+	files, _ := ioutil.ReadDir(c.conf.TempDir)
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+
+		for _, prefix := range jobTempFilePrefixes {
+			if strings.HasPrefix(file.Name(), prefix) {
+				c.removeIfStale(filepath.Join(c.conf.TempDir, file.Name()), "it was left behind by an earlier job")
+				break
+			}
+		}
+	}
+}
+
+// removeIfStale removes the file at path if it hasn't been modified for the
+// minimum age
+func (c *startupCleanup) removeIfStale(path, reason string) {
+	info, err := os.Lstat(path)
+	if err != nil || c.now.Sub(info.ModTime()) < c.conf.MinAge {
+		return
+	}
+
+	c.remove(path, reason)
+}
+
+func (c *startupCleanup) remove(path, reason string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		c.report.Errors = append(c.report.Errors, fmt.Errorf("Failed to remove %q: %w", path, err))
+		return
+	}
+
+	c.report.Removed = append(c.report.Removed, CleanedUpFile{Path: path, Reason: reason})
+}
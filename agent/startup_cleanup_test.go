@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanupStartupLeftovers(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Finding a pid that isn't running needs a unix command")
+	}
+
+	// A pid that was running, but isn't any more
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	deadPid := cmd.Process.Pid
+
+	dir := t.TempDir()
+	buildPath := filepath.Join(dir, "builds")
+	pluginsPath := filepath.Join(dir, "plugins")
+	mirrorsPath := filepath.Join(dir, "mirrors")
+	tempDir := filepath.Join(dir, "tmp")
+
+	old := time.Now().Add(-2 * time.Hour)
+	write := func(path, content string, modTime time.Time) string {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+		return path
+	}
+
+	deadPluginLock := write(filepath.Join(pluginsPath, "github-com-buildkite-plugins-docker.lock"), strconv.Itoa(deadPid), time.Now())
+	livePluginLock := write(filepath.Join(pluginsPath, "github-com-buildkite-plugins-ecr.lock"), strconv.Itoa(os.Getpid()), time.Now())
+	garbledMirrorLock := write(filepath.Join(mirrorsPath, "git-github-com-buildkite-agent.clonelock"), "llama", time.Now())
+	flock := write(filepath.Join(mirrorsPath, "git-github-com-buildkite-agent.updatelockf"), "", old)
+
+	staleIndexLock := write(filepath.Join(buildPath, "my-agent-1", "buildkite", "agent", ".git", "index.lock"), "", old)
+	freshIndexLock := write(filepath.Join(buildPath, "my-agent-2", "buildkite", "agent", ".git", "index.lock"), "", time.Now())
+
+	staleHookEnv := write(filepath.Join(tempDir, "buildkite-agent-bootstrap-hook-env-before-123456"), "", old)
+	freshHookEnv := write(filepath.Join(tempDir, "buildkite-agent-bootstrap-hook-env-after-123456"), "", time.Now())
+	unrelated := write(filepath.Join(tempDir, "something-else"), "", old)
+
+	report := CleanupStartupLeftovers(StartupCleanupConfig{
+		BuildPath:      buildPath,
+		PluginsPath:    pluginsPath,
+		GitMirrorsPath: mirrorsPath,
+		TempDir:        tempDir,
+		MinAge:         time.Hour,
+	})
+	assert.Empty(t, report.Errors)
+
+	var removed []string
+	for _, file := range report.Removed {
+		removed = append(removed, file.Path)
+	}
+	assert.ElementsMatch(t, []string{deadPluginLock, garbledMirrorLock, staleIndexLock, staleHookEnv}, removed)
+
+	for _, path := range removed {
+		assert.NoFileExists(t, path)
+	}
+	for _, path := range []string{livePluginLock, flock, freshIndexLock, freshHookEnv, unrelated} {
+		assert.FileExists(t, path)
+	}
+}
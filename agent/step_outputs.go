@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Step outputs are stored in the build's meta-data under keys with this
+	// prefix, followed by <step key>:<name>
+	stepOutputMetaDataPrefix = "buildkite-step-output:"
+
+	// Step outputs are given to later jobs in the build as
+	// BUILDKITE_OUTPUT_<step key>_<name>
+	stepOutputEnvPrefix = "BUILDKITE_OUTPUT_"
+)
+
+var (
+	stepOutputNameRegexp  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	stepOutputEnvReplacer = regexp.MustCompile(`[^A-Z0-9]`)
+)
+
+// StepOutputMetaDataKey returns the meta-data key that a step's output is
+// stored under. Steps need a key, since that's how the steps that depend on
+// them refer to them.
+func StepOutputMetaDataKey(stepKey, name string) (string, error) {
+	if stepKey == "" {
+		return "", errors.New("Only steps with a key can set outputs, so the steps that depend on them can find them")
+	}
+	if !stepOutputNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("Output names can only have letters, numbers, - and _, not %q", name)
+	}
+
+	return stepOutputMetaDataPrefix + stepKey + ":" + name, nil
+}
+
+// stepOutputEnvName returns the environment variable that a step output's
+// meta-data key is given to jobs as, or an empty string if the key isn't a
+// step output
+func stepOutputEnvName(metaDataKey string) string {
+	if !strings.HasPrefix(metaDataKey, stepOutputMetaDataPrefix) {
+		return ""
+	}
+
+	// Output names can't have colons in them, but step keys can
+	rest := strings.TrimPrefix(metaDataKey, stepOutputMetaDataPrefix)
+	i := strings.LastIndex(rest, ":")
+	if i < 1 || i == len(rest)-1 {
+		return ""
+	}
+
+	return stepOutputEnvPrefix + stepOutputEnvReplacer.ReplaceAllString(strings.ToUpper(rest[:i]), "_") +
+		"_" + stepOutputEnvReplacer.ReplaceAllString(strings.ToUpper(rest[i+1:]), "_")
+}
+
+// stepOutputsEnv returns the outputs that steps in the build have set so far,
+// which includes the outputs of the steps the job depends on. Jobs run
+// without them if they can't be looked up.
+func (r *JobRunner) stepOutputsEnv() map[string]string {
+	keys, _, err := r.apiClient.MetaDataKeys(r.job.ID)
+	if err != nil {
+		r.logger.Warn("[JobRunner] Couldn't look up the build's step outputs: %v", err)
+		return nil
+	}
+
+	env := map[string]string{}
+	for _, key := range keys {
+		name := stepOutputEnvName(key)
+		if name == "" {
+			continue
+		}
+
+		metaData, _, err := r.apiClient.GetMetaData(r.job.ID, key)
+		if err != nil {
+			r.logger.Warn("[JobRunner] Couldn't look up step output %s: %v", key, err)
+			continue
+		}
+		env[name] = metaData.Value
+	}
+
+	return env
+}
@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStepOutputMetaDataKey(t *testing.T) {
+	t.Parallel()
+
+	key, err := StepOutputMetaDataKey("build", "docker-image")
+	require.NoError(t, err)
+	assert.Equal(t, "buildkite-step-output:build:docker-image", key)
+
+	_, err = StepOutputMetaDataKey("", "docker-image")
+	assert.EqualError(t, err, "Only steps with a key can set outputs, so the steps that depend on them can find them")
+
+	_, err = StepOutputMetaDataKey("build", "image:tag")
+	assert.EqualError(t, err, `Output names can only have letters, numbers, - and _, not "image:tag"`)
+}
+
+func TestStepOutputEnvName(t *testing.T) {
+	t.Parallel()
+
+	for key, name := range map[string]string{
+		"buildkite-step-output:build:docker-image":  "BUILDKITE_OUTPUT_BUILD_DOCKER_IMAGE",
+		"buildkite-step-output:deploy:app:version":  "BUILDKITE_OUTPUT_DEPLOY_APP_VERSION",
+		"buildkite-step-output:build.linux:sha_sum": "BUILDKITE_OUTPUT_BUILD_LINUX_SHA_SUM",
+		"buildkite-step-output:build:":              "",
+		"buildkite-step-output::version":            "",
+		"release-version":                           "",
+	} {
+		assert.Equal(t, name, stepOutputEnvName(key), key)
+	}
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// TestTimings is how long each test file took to run in seconds, keyed by
+// the file's path
+type TestTimings map[string]float64
+
+// ParseTestTimings parses timing data, which is a JSON object of test file
+// paths to the number of seconds they took to run
+func ParseTestTimings(data []byte) (TestTimings, error) {
+	timings := TestTimings{}
+	if err := json.Unmarshal(data, &timings); err != nil {
+		return nil, fmt.Errorf("Failed to parse test timings: %v", err)
+	}
+	return timings, nil
+}
+
+// Average returns the mean duration of the files with timings, or 1 second if
+// there aren't any, so files without timings still get spread out evenly
+func (t TestTimings) Average() float64 {
+	if len(t) == 0 {
+		return 1
+	}
+	total := 0.0
+	for _, d := range t {
+		total += d
+	}
+	return total / float64(len(t))
+}
+
+// SplitTests returns the files that parallel job number job (counting from 0)
+// out of count should run. Files are packed into jobs longest first, each
+// going to the job with the least work so far, which gives the same result
+// for every job given the same inputs. Files without timing data are assumed
+// to take defaultDuration. The files are returned in the order they were given.
+func SplitTests(files []string, timings TestTimings, defaultDuration float64, job, count int) ([]string, error) {
+	if count < 1 {
+		count = 1
+	}
+	if job < 0 || job >= count {
+		return nil, fmt.Errorf("Parallel job %d is out of range for %d parallel jobs", job, count)
+	}
+
+	type testFile struct {
+		path     string
+		index    int
+		duration float64
+	}
+
+	seen := map[string]bool{}
+	var tests []testFile
+	for i, path := range files {
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		duration, ok := timings[path]
+		if !ok {
+			duration = defaultDuration
+		}
+		tests = append(tests, testFile{path: path, index: i, duration: duration})
+	}
+
+	// Longest first, and by path when they're the same so the order doesn't
+	// depend on the order the files were listed in
+	sort.SliceStable(tests, func(i, j int) bool {
+		if tests[i].duration != tests[j].duration {
+			return tests[i].duration > tests[j].duration
+		}
+		return tests[i].path < tests[j].path
+	})
+
+	totals := make([]float64, count)
+	var assigned []testFile
+	for _, test := range tests {
+		smallest := 0
+		for i := range totals {
+			if totals[i] < totals[smallest] {
+				smallest = i
+			}
+		}
+		totals[smallest] += test.duration
+
+		if smallest == job {
+			assigned = append(assigned, test)
+		}
+	}
+
+	sort.Slice(assigned, func(i, j int) bool {
+		return assigned[i].index < assigned[j].index
+	})
+
+	result := make([]string, 0, len(assigned))
+	for _, test := range assigned {
+		result = append(result, test.path)
+	}
+	return result, nil
+}
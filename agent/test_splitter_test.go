@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTestTimings(t *testing.T) {
+	timings, err := ParseTestTimings([]byte(`{"a_test.go": 1.5, "b_test.go": 3}`))
+	require.NoError(t, err)
+	assert.Equal(t, TestTimings{"a_test.go": 1.5, "b_test.go": 3}, timings)
+	assert.Equal(t, 2.25, timings.Average())
+
+	_, err = ParseTestTimings([]byte(`["a_test.go"]`))
+	assert.Error(t, err)
+}
+
+func TestSplitTestsBalancesByTimings(t *testing.T) {
+	files := []string{"a", "b", "c", "d", "e"}
+	timings := TestTimings{"a": 10, "b": 1, "c": 5, "d": 4, "e": 2}
+
+	var splits [][]string
+	for job := 0; job < 2; job++ {
+		split, err := SplitTests(files, timings, 1, job, 2)
+		require.NoError(t, err)
+		splits = append(splits, split)
+	}
+
+	// a (10) goes to job 0, then c (5), d (4) and e (2) to job 1, and b (1)
+	// to job 0, giving 11 each
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d", "e"}}, splits)
+}
+
+func TestSplitTestsIsDeterministic(t *testing.T) {
+	timings := TestTimings{}
+
+	first, err := SplitTests([]string{"a", "b", "c", "d"}, timings, 1, 1, 2)
+	require.NoError(t, err)
+
+	second, err := SplitTests([]string{"d", "c", "b", "a"}, timings, 1, 1, 2)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, first, second)
+	assert.Len(t, first, 2)
+}
+
+func TestSplitTestsCoversEveryFileOnce(t *testing.T) {
+	files := []string{"a", "b", "c", "b", "d", "e", "f", "g"}
+	timings := TestTimings{"a": 3, "c": 7}
+
+	var all []string
+	for job := 0; job < 3; job++ {
+		split, err := SplitTests(files, timings, timings.Average(), job, 3)
+		require.NoError(t, err)
+		all = append(all, split...)
+	}
+
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d", "e", "f", "g"}, all)
+}
+
+func TestSplitTestsWithoutParallelism(t *testing.T) {
+	split, err := SplitTests([]string{"a", "b"}, nil, 1, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, split)
+}
+
+func TestSplitTestsJobOutOfRange(t *testing.T) {
+	_, err := SplitTests([]string{"a"}, nil, 1, 2, 2)
+	assert.Error(t, err)
+}
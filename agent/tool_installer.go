@@ -0,0 +1,267 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retry"
+)
+
+// Tool names and versions end up in URLs and paths, so they're kept simple
+var toolSpecPattern = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*)@([A-Za-z0-9][A-Za-z0-9._+-]*)$`)
+
+// ToolSpec is a tool to install, like shellcheck@0.8.0
+type ToolSpec struct {
+	Name    string
+	Version string
+}
+
+func (t ToolSpec) String() string {
+	return t.Name + "@" + t.Version
+}
+
+// ParseToolSpec parses a tool given as name@version
+func ParseToolSpec(spec string) (ToolSpec, error) {
+	m := toolSpecPattern.FindStringSubmatch(spec)
+	if m == nil {
+		return ToolSpec{}, fmt.Errorf("%q isn't a tool, tools are given as name@version", spec)
+	}
+	return ToolSpec{Name: m[1], Version: m[2]}, nil
+}
+
+// ToolInstallerConfig is how tools are installed
+type ToolInstallerConfig struct {
+	// Where installed tools are kept, by their checksum
+	CachePath string
+
+	// The mirrors tools are downloaded from, tried in order. A mirror is
+	// either a base URL that tools are found under at
+	// {name}/{version}/{os}-{arch}/{name}, or a URL containing those
+	// placeholders.
+	Mirrors []string
+
+	// A file of the SHA-256 checksums of the tools that can be installed,
+	// with a line like `<sha256>  <name>@<version> <os>-<arch>` for each
+	ChecksumsPath string
+
+	// The platform to install tools for. Defaults to the agent's own.
+	OS   string
+	Arch string
+}
+
+// ToolInstaller downloads tools that hooks depend on into a cache, verifying
+// them against checksums the agent's operator trusts
+type ToolInstaller struct {
+	conf   ToolInstallerConfig
+	logger logger.Logger
+	client *http.Client
+}
+
+// NewToolInstaller returns a ToolInstaller
+func NewToolInstaller(l logger.Logger, c ToolInstallerConfig) *ToolInstaller {
+	if c.OS == "" {
+		c.OS = runtime.GOOS
+	}
+	if c.Arch == "" {
+		c.Arch = runtime.GOARCH
+	}
+	return &ToolInstaller{conf: c, logger: l, client: &http.Client{}}
+}
+
+// Install makes sure the tool is in the cache, downloading it if it isn't,
+// and returns its path. If sha256 is empty, the tool's checksum comes from the
+// checksums file.
+func (i *ToolInstaller) Install(ctx context.Context, tool ToolSpec, sha256sum string) (string, error) {
+	if sha256sum == "" {
+		var err error
+		if sha256sum, err = i.checksum(tool); err != nil {
+			return "", err
+		}
+	}
+	sha256sum = strings.ToLower(sha256sum)
+	if _, err := hex.DecodeString(sha256sum); err != nil || len(sha256sum) != sha256.Size*2 {
+		return "", fmt.Errorf("%q isn't a SHA-256 checksum", sha256sum)
+	}
+
+	// Tools are kept by their checksum, so a version that's been re-released
+	// with different contents is downloaded again
+	dir := filepath.Join(i.conf.CachePath, "sha256", sha256sum)
+	path := filepath.Join(dir, i.binaryName(tool))
+
+	if sum, err := fileSHA256(path); err == nil {
+		if sum == sha256sum {
+			i.logger.Debug("Using %s from the tool cache at %s", tool, path)
+			return path, nil
+		}
+		i.logger.Warn("The cached %s at %s doesn't match its checksum, downloading it again", tool, path)
+	}
+
+	if len(i.conf.Mirrors) == 0 {
+		return "", fmt.Errorf("%s isn't in the tool cache, and there are no tool mirrors to download it from", tool)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	var errs []string
+	for _, mirror := range i.conf.Mirrors {
+		url := i.mirrorURL(mirror, tool)
+		err := i.download(ctx, url, path, sha256sum)
+		if err == nil {
+			i.logger.Info("Installed %s from %s to %s", tool, url, path)
+			return path, nil
+		}
+		i.logger.Warn("Failed to download %s from %s: %v", tool, url, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", url, err))
+	}
+
+	return "", fmt.Errorf("Couldn't install %s from any mirror (%s)", tool, strings.Join(errs, "; "))
+}
+
+// checksum finds the tool's checksum for the platform in the checksums file
+func (i *ToolInstaller) checksum(tool ToolSpec) (string, error) {
+	if i.conf.ChecksumsPath == "" {
+		return "", fmt.Errorf("There's no checksum for %s, give one with --sha256 or add it to a tool checksums file", tool)
+	}
+
+	f, err := os.Open(i.conf.ChecksumsPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	platform := i.conf.OS + "-" + i.conf.Arch
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[1] == tool.String() && fields[2] == platform {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("There's no checksum for %s on %s in %s", tool, platform, i.conf.ChecksumsPath)
+}
+
+// mirrorURL returns where a mirror has the tool for the platform
+func (i *ToolInstaller) mirrorURL(mirror string, tool ToolSpec) string {
+	if !strings.Contains(mirror, "{") {
+		mirror = strings.TrimSuffix(mirror, "/") + "/{name}/{version}/{os}-{arch}/" + i.binaryName(tool)
+	}
+
+	return strings.NewReplacer(
+		"{name}", tool.Name,
+		"{version}", tool.Version,
+		"{os}", i.conf.OS,
+		"{arch}", i.conf.Arch,
+	).Replace(mirror)
+}
+
+// binaryName is the tool's file name on the platform
+func (i *ToolInstaller) binaryName(tool ToolSpec) string {
+	if i.conf.OS == "windows" {
+		return tool.Name + ".exe"
+	}
+	return tool.Name
+}
+
+// download fetches the tool to path, only putting it there if it matches the
+// checksum
+func (i *ToolInstaller) download(ctx context.Context, url, path, sha256sum string) error {
+	return retry.NewRetrier(
+		retry.WithMaxAttempts(3),
+		retry.WithStrategy(retry.Exponential(2*time.Second, 10*time.Second)),
+		retry.WithJitter(),
+	).DoWithContext(ctx, func(ctx context.Context, r *retry.Retrier) error {
+		err := i.tryDownload(ctx, url, path, sha256sum)
+		if errors.Is(err, errToolChecksumMismatch) || errors.Is(err, errToolNotFound) {
+			r.Break()
+		}
+		return err
+	})
+}
+
+var (
+	errToolChecksumMismatch = errors.New("The download doesn't match its checksum")
+	errToolNotFound         = errors.New("The mirror doesn't have it")
+)
+
+func (i *ToolInstaller) tryDownload(ctx context.Context, url, path, sha256sum string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errToolNotFound
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	// Write it next to where it goes, so it's only ever there complete
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != sha256sum {
+		return fmt.Errorf("%w (expected %s, got %s)", errToolChecksumMismatch, sha256sum, sum)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fileSHA256 returns the hex SHA-256 checksum of a file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseToolSpec(t *testing.T) {
+	t.Parallel()
+
+	tool, err := ParseToolSpec("shellcheck@0.8.0")
+	require.NoError(t, err)
+	assert.Equal(t, ToolSpec{Name: "shellcheck", Version: "0.8.0"}, tool)
+
+	for _, spec := range []string{"shellcheck", "@0.8.0", "shellcheck@", "../shellcheck@0.8.0", "shellcheck@0.8/../.."} {
+		_, err := ParseToolSpec(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestToolInstallerInstallsVerifiedTools(t *testing.T) {
+	t.Parallel()
+
+	binary := []byte("#!/bin/sh\necho hello\n")
+	sum := sha256.Sum256(binary)
+	checksum := hex.EncodeToString(sum[:])
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/tools/hello/1.0.0/linux-amd64/hello":
+			_, _ = w.Write(binary)
+		case "/tampered/hello/1.0.0/linux-amd64/hello":
+			_, _ = w.Write([]byte("#!/bin/sh\nrm -rf /\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	checksums := filepath.Join(dir, "checksums")
+	require.NoError(t, os.WriteFile(checksums, []byte(fmt.Sprintf("# Tools for hooks\n%s  hello@1.0.0 linux-amd64\n", checksum)), 0o600))
+
+	installer := NewToolInstaller(logger.Discard, ToolInstallerConfig{
+		CachePath:     filepath.Join(dir, "tools"),
+		Mirrors:       []string{server.URL + "/missing", server.URL + "/tampered", server.URL + "/tools/"},
+		ChecksumsPath: checksums,
+		OS:            "linux",
+		Arch:          "amd64",
+	})
+
+	path, err := installer.Install(context.Background(), ToolSpec{Name: "hello", Version: "1.0.0"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "tools", "sha256", checksum, "hello"), path)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, binary, data)
+
+	// Nothing but the verified tool is left in the cache
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Once it's installed, it comes from the cache
+	atomic.StoreInt32(&requests, 0)
+	_, err = installer.Install(context.Background(), ToolSpec{Name: "hello", Version: "1.0.0"}, "")
+	require.NoError(t, err)
+	assert.Zero(t, atomic.LoadInt32(&requests))
+
+	// Tools without a checksum aren't downloaded
+	_, err = installer.Install(context.Background(), ToolSpec{Name: "hello", Version: "2.0.0"}, "")
+	assert.Error(t, err)
+	assert.Zero(t, atomic.LoadInt32(&requests))
+}
+
+func TestToolInstallerMirrorTemplates(t *testing.T) {
+	t.Parallel()
+
+	installer := NewToolInstaller(logger.Discard, ToolInstallerConfig{OS: "windows", Arch: "arm64"})
+	tool := ToolSpec{Name: "jq", Version: "1.6"}
+
+	assert.Equal(t, "https://mirror.example.com/jq/1.6/windows-arm64/jq.exe", installer.mirrorURL("https://mirror.example.com/", tool))
+	assert.Equal(t, "https://mirror.example.com/jq-1.6-windows-arm64.zip", installer.mirrorURL("https://mirror.example.com/{name}-{version}-{os}-{arch}.zip", tool))
+}
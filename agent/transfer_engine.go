@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retry"
+)
+
+const (
+	// How many times an artifact upload is tried before giving up
+	uploadAttempts = 10
+
+	// How many times an artifact download is tried before giving up
+	downloadAttempts = 5
+
+	// How long to wait before trying a failed transfer again
+	transferRetryInterval = 5 * time.Second
+)
+
+// transferEngine is what `artifact upload` and `artifact download` move
+// artifacts with. It picks the backend for a destination, checks downloads
+// against the checksums the artifacts were uploaded with, and runs each
+// transfer through the agent's transfer scheduler. Uploads are retried here,
+// and downloads by Download itself. The backends' own Start methods download
+// without it, so they skip the checksums and the scheduler.
+type transferEngine struct {
+	// The logger instance to use
+	logger logger.Logger
+
+	// Limits transfers along with the agent's other transfers
+	transfers *TransferScheduler
+
+	// Whether to show HTTP debugging
+	debugHTTP bool
+}
+
+func newTransferEngine(l logger.Logger, transfers *TransferScheduler, debugHTTP bool) *transferEngine {
+	return &transferEngine{
+		logger:    l,
+		transfers: transfers,
+		debugHTTP: debugHTTP,
+	}
+}
+
+// uploader returns the uploader for an s3://, gs:// or rt:// destination, or
+// for Buildkite's artifact storage if the destination is empty
+func (e *transferEngine) uploader(destination string) (Uploader, error) {
+	var uploader Uploader
+	var err error
+
+	switch {
+	case destination == "":
+		return NewFormUploader(e.logger, FormUploaderConfig{
+			DebugHTTP: e.debugHTTP,
+		}), nil
+	case strings.HasPrefix(destination, "s3://"):
+		uploader, err = NewS3Uploader(e.logger, S3UploaderConfig{
+			Destination: destination,
+			DebugHTTP:   e.debugHTTP,
+		})
+	case strings.HasPrefix(destination, "gs://"):
+		uploader, err = NewGSUploader(e.logger, GSUploaderConfig{
+			Destination: destination,
+			DebugHTTP:   e.debugHTTP,
+		})
+	case strings.HasPrefix(destination, "rt://"):
+		uploader, err = NewArtifactoryUploader(e.logger, ArtifactoryUploaderConfig{
+			Destination: destination,
+			DebugHTTP:   e.debugHTTP,
+		})
+	default:
+		return nil, fmt.Errorf("Invalid upload destination: '%v'. Only s3://, gs:// or rt:// upload destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?", destination)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Error creating uploader: %v", err)
+	}
+
+	return uploader, nil
+}
+
+// upload uploads an artifact with the uploader, trying again if it fails.
+// Uploads run in parallel, so their retries are spread out.
+func (e *transferEngine) upload(uploader Uploader, artifact *api.Artifact) error {
+	return retry.NewRetrier(
+		retry.WithMaxAttempts(uploadAttempts),
+		retry.WithStrategy(retry.Constant(transferRetryInterval)),
+		retry.WithJitter(),
+	).Do(func(r *retry.Retrier) error {
+		err := e.transfers.Do(artifact.FileSize, func() error {
+			return uploader.Upload(artifact)
+		})
+		if err != nil {
+			e.logger.Warn("%s (%s)", err, r)
+		}
+
+		return err
+	})
+}
+
+// download downloads an artifact to its path within destination, from a URL
+// signed by signer if there is one, and otherwise from wherever it was
+// uploaded to
+func (e *transferEngine) download(artifact *api.Artifact, path string, destination string, signer *ArtifactURLSigner) error {
+	return e.transfers.Do(artifact.FileSize, func() error {
+		client, conf, err := e.downloadRequest(artifact, path, destination, signer)
+		if err != nil {
+			return err
+		}
+
+		conf.SHA1Sum = artifact.Sha1Sum
+		conf.SHA256Sum = artifact.Sha256Sum
+
+		return NewDownload(e.logger, client, conf).Start()
+	})
+}
+
+// downloadRequest works out where to download an artifact from, and the
+// client to download it with
+func (e *transferEngine) downloadRequest(artifact *api.Artifact, path string, destination string, signer *ArtifactURLSigner) (*http.Client, DownloadConfig, error) {
+	conf := DownloadConfig{
+		URL:         artifact.URL,
+		Path:        path,
+		Destination: destination,
+		Retries:     downloadAttempts,
+		DebugHTTP:   e.debugHTTP,
+	}
+
+	switch {
+	case signer != nil:
+		signed, err := signer.Sign(artifact)
+		if err != nil {
+			return nil, conf, err
+		}
+		conf.URL = signed.URL
+		conf.Headers = signed.Headers
+		return http.DefaultClient, conf, nil
+	case strings.HasPrefix(artifact.UploadDestination, "s3://"):
+		return NewS3Downloader(e.logger, S3DownloaderConfig{
+			Bucket:      artifact.UploadDestination,
+			Path:        conf.Path,
+			Destination: conf.Destination,
+			Retries:     conf.Retries,
+			DebugHTTP:   conf.DebugHTTP,
+		}).request()
+	case strings.HasPrefix(artifact.UploadDestination, "gs://"):
+		return NewGSDownloader(e.logger, GSDownloaderConfig{
+			Bucket:      artifact.UploadDestination,
+			Path:        conf.Path,
+			Destination: conf.Destination,
+			Retries:     conf.Retries,
+			DebugHTTP:   conf.DebugHTTP,
+		}).request()
+	case strings.HasPrefix(artifact.UploadDestination, "rt://"):
+		return NewArtifactoryDownloader(e.logger, ArtifactoryDownloaderConfig{
+			Repository:  artifact.UploadDestination,
+			Path:        conf.Path,
+			Destination: conf.Destination,
+			Retries:     conf.Retries,
+			DebugHTTP:   conf.DebugHTTP,
+		}).request()
+	}
+
+	return http.DefaultClient, conf, nil
+}
+
+// splitStorageDestination splits a destination like s3://bucket/some/path
+// into the bucket (or repository) and the path within it
+func splitStorageDestination(destination string, scheme string) (name string, path string) {
+	parts := strings.Split(strings.TrimPrefix(destination, scheme+"://"), "/")
+	return parts[0], strings.Join(parts[1:], "/")
+}
+
+// storageKey returns where a file is within a bucket, under the bucket path
+func storageKey(bucketPath string, path string) string {
+	if bucketPath == "" {
+		return path
+	}
+	return strings.TrimSuffix(bucketPath, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// artifactoryCredentials returns the Artifactory instance and the user to
+// upload and download with, from the environment
+func artifactoryCredentials() (url string, username string, password string, err error) {
+	url = os.Getenv("BUILDKITE_ARTIFACTORY_URL")
+	username = os.Getenv("BUILDKITE_ARTIFACTORY_USER")
+	password = os.Getenv("BUILDKITE_ARTIFACTORY_PASSWORD")
+	if url == "" || username == "" || password == "" {
+		return "", "", "", errors.New("Must set BUILDKITE_ARTIFACTORY_URL, BUILDKITE_ARTIFACTORY_USER, BUILDKITE_ARTIFACTORY_PASSWORD when using rt:// path")
+	}
+	return url, username, password, nil
+}
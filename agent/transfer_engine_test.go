@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferEngineUploader(t *testing.T) {
+	t.Parallel()
+
+	engine := newTransferEngine(logger.Discard, nil, false)
+
+	uploader, err := engine.uploader("")
+	require.NoError(t, err)
+	assert.IsType(t, &FormUploader{}, uploader)
+
+	_, err = engine.uploader("ftp://my-bucket/foo")
+	assert.EqualError(t, err, "Invalid upload destination: 'ftp://my-bucket/foo'. Only s3://, gs:// or rt:// upload destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?")
+}
+
+func TestTransferEngineDownload(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, "llamas")
+	}))
+	defer server.Close()
+
+	destination := t.TempDir()
+	engine := newTransferEngine(logger.Discard, nil, false)
+
+	// The SHA-256 is checked over the SHA-1 if there is one, and it's
+	// compared case insensitively
+	err := engine.download(&api.Artifact{
+		URL:       server.URL + "/llamas.txt",
+		Sha1Sum:   "0000000000000000000000000000000000000000",
+		Sha256Sum: "66F0D436B0469C570B3B8D7E11A681881D9A7BCD8B12D5C2DB426015D3DDFD1C",
+	}, "llamas.txt", destination, nil)
+	require.NoError(t, err)
+
+	contents, err := os.ReadFile(filepath.Join(destination, "llamas.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "llamas", string(contents))
+}
+
+func TestDownloadRemovesFilesThatDontMatchTheirChecksum(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, "alpacas")
+	}))
+	defer server.Close()
+
+	destination := t.TempDir()
+	err := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL + "/llamas.txt",
+		Path:        "llamas.txt",
+		Destination: destination,
+		Retries:     1,
+		SHA1Sum:     "93f7ee0d3c9d7c9d76a6b5a6b8e1a9cd9aa2d1b8",
+	}).Start()
+	assert.EqualError(t, err, "Downloaded file llamas.txt has a SHA-1 checksum of cfef78a7f78ba5196992f890bbd4c8655cf125a3 instead of 93f7ee0d3c9d7c9d76a6b5a6b8e1a9cd9aa2d1b8")
+
+	_, err = os.Stat(filepath.Join(destination, "llamas.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/dustin/go-humanize"
+)
+
+// Transfers at least this big log their progress as they go
+const transferProgressThreshold = 50 * 1024 * 1024
+
+// How often the progress of big transfers is logged
+var transferProgressInterval = 30 * time.Second
+
+// transferProgress logs how far through a transfer is, how fast it's going and
+// how long it has left, so that big transfers don't look like they've hung.
+//
+// Progress is only logged. It isn't served over a socket: transfers run in
+// the job's `buildkite-agent artifact` process, the agent has no job API
+// socket for that process to report to, and jobs aren't given the control
+// socket, since it can cancel jobs and drain the agent.
+type transferProgress struct {
+	logger  logger.Logger
+	name    string
+	size    int64
+	started time.Time
+
+	// How many bytes have been transferred, updated atomically
+	done int64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// startTransferProgress starts logging the progress of a transfer, returning
+// nil if it's too small to bother
+func startTransferProgress(l logger.Logger, name string, size int64) *transferProgress {
+	if size < transferProgressThreshold {
+		return nil
+	}
+
+	p := &transferProgress{
+		logger:  l,
+		name:    name,
+		size:    size,
+		started: time.Now(),
+		stop:    make(chan struct{}),
+	}
+
+	go func() {
+		t := time.NewTicker(transferProgressInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				p.logger.Info("%s", p.String())
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// Add counts n more bytes as transferred
+func (p *transferProgress) Add(n int) {
+	if p == nil || n <= 0 {
+		return
+	}
+	atomic.AddInt64(&p.done, int64(n))
+}
+
+// Stop stops logging progress
+func (p *transferProgress) Stop() {
+	if p == nil {
+		return
+	}
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// String describes how far through the transfer is
+func (p *transferProgress) String() string {
+	// Retried reads can count bytes more than once
+	done := atomic.LoadInt64(&p.done)
+	if done > p.size {
+		done = p.size
+	}
+
+	elapsed := time.Since(p.started)
+	rate := float64(done) / elapsed.Seconds()
+
+	eta := "unknown"
+	if rate > 0 {
+		eta = time.Duration(float64(p.size-done) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+
+	return fmt.Sprintf("%s: %s of %s (%.1f%%) at %s/s, %s left",
+		p.name,
+		humanize.Bytes(uint64(done)),
+		humanize.Bytes(uint64(p.size)),
+		float64(done)/float64(p.size)*100,
+		humanize.Bytes(uint64(rate)),
+		eta,
+	)
+}
+
+// progressFile is a file that counts what's read from it towards a
+// transfer's progress, which stops when the file is closed
+type progressFile struct {
+	*os.File
+	progress *transferProgress
+}
+
+// openArtifact opens an artifact's file to upload it, logging the upload's
+// progress if it's big
+func openArtifact(l logger.Logger, artifact *api.Artifact) (*progressFile, error) {
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &progressFile{
+		File:     f,
+		progress: startTransferProgress(l, "Uploading "+artifact.Path, artifact.FileSize),
+	}, nil
+}
+
+func (f *progressFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	f.progress.Add(n)
+	return n, err
+}
+
+func (f *progressFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(b, off)
+	f.progress.Add(n)
+	return n, err
+}
+
+func (f *progressFile) Close() error {
+	f.progress.Stop()
+	return f.File.Close()
+}
+
+// progressReader counts what's read from a reader towards a transfer's
+// progress
+type progressReader struct {
+	reader   io.Reader
+	progress *transferProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.progress.Add(n)
+	return n, err
+}
@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferProgressIsOnlyForBigTransfers(t *testing.T) {
+	t.Parallel()
+
+	p := startTransferProgress(logger.Discard, "Uploading small.txt", 1024)
+	assert.Nil(t, p)
+
+	// A nil progress can still be counted and stopped
+	p.Add(1024)
+	p.Stop()
+}
+
+func TestTransferProgressString(t *testing.T) {
+	t.Parallel()
+
+	p := startTransferProgress(logger.Discard, "Uploading big.tar", 200*1000*1000)
+	defer p.Stop()
+
+	p.started = time.Now().Add(-10 * time.Second)
+	p.Add(50 * 1000 * 1000)
+
+	assert.Equal(t, "Uploading big.tar: 50 MB of 200 MB (25.0%) at 5.0 MB/s, 30s left", p.String())
+
+	// Reads that are retried don't take it past the end
+	p.Add(200 * 1000 * 1000)
+	assert.Contains(t, p.String(), "(100.0%)")
+	assert.Contains(t, p.String(), "0s left")
+}
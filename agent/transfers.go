@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// The environment variables that share the agent's transfer scheduler with
+// the jobs it runs
+const (
+	transferSlotsPathEnv   = "BUILDKITE_TRANSFER_SLOTS_PATH"
+	transferConcurrencyEnv = "BUILDKITE_TRANSFER_CONCURRENCY"
+	transferBandwidthEnv   = "BUILDKITE_TRANSFER_BANDWIDTH"
+)
+
+// TransferScheduler limits how many artifact and log transfers run at once
+// across all of an agent's workers, and how much bandwidth they use between
+// them, so lots of jobs finishing at once don't time each other out.
+//
+// Transfers take one of a fixed number of slots, which are file locks so that
+// the `buildkite-agent artifact` commands jobs run share them too.
+type TransferScheduler struct {
+	path        string
+	concurrency int
+
+	// The bandwidth budget in bytes per second, shared evenly between the
+	// slots, or 0 for no limit
+	bandwidth int64
+
+	// How often to check for a free slot
+	pollInterval time.Duration
+}
+
+// NewTransferScheduler returns a scheduler that keeps its slots in path, and
+// runs up to concurrency transfers at once within bandwidth bytes per second
+func NewTransferScheduler(path string, concurrency int, bandwidth int64) *TransferScheduler {
+	return &TransferScheduler{
+		path:         path,
+		concurrency:  concurrency,
+		bandwidth:    bandwidth,
+		pollInterval: 100 * time.Millisecond,
+	}
+}
+
+// TransferSchedulerFromEnv returns the transfer scheduler of the agent running
+// the current job, or nil if it doesn't have one
+func TransferSchedulerFromEnv() *TransferScheduler {
+	path := os.Getenv(transferSlotsPathEnv)
+	concurrency, _ := strconv.Atoi(os.Getenv(transferConcurrencyEnv))
+	if path == "" || concurrency < 1 {
+		return nil
+	}
+
+	bandwidth, _ := strconv.ParseInt(os.Getenv(transferBandwidthEnv), 10, 64)
+	return NewTransferScheduler(path, concurrency, bandwidth)
+}
+
+// Env returns the environment that shares the scheduler with a job
+func (s *TransferScheduler) Env() map[string]string {
+	if s == nil {
+		return nil
+	}
+
+	return map[string]string{
+		transferSlotsPathEnv:   s.path,
+		transferConcurrencyEnv: strconv.Itoa(s.concurrency),
+		transferBandwidthEnv:   strconv.FormatInt(s.bandwidth, 10),
+	}
+}
+
+// Do runs a transfer of size bytes once a slot is free. With a bandwidth
+// budget, the slot is kept until the transfer has taken as long as its share
+// of the budget allows, so transfers stay within it on average.
+func (s *TransferScheduler) Do(size int64, transfer func() error) error {
+	if s == nil {
+		return transfer()
+	}
+
+	slot, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer slot.Unlock()
+
+	started := time.Now()
+	err = transfer()
+
+	if s.bandwidth > 0 && size > 0 {
+		share := float64(s.bandwidth) / float64(s.concurrency)
+		minimum := time.Duration(float64(size) / share * float64(time.Second))
+		if elapsed := time.Since(started); elapsed < minimum {
+			time.Sleep(minimum - elapsed)
+		}
+	}
+
+	return err
+}
+
+// acquire waits for a free slot and locks it
+func (s *TransferScheduler) acquire() (*flock.Flock, error) {
+	for {
+		for i := 0; i < s.concurrency; i++ {
+			slot := flock.New(filepath.Join(s.path, fmt.Sprintf("slot-%d", i)))
+
+			locked, err := slot.TryLock()
+			if err != nil {
+				return nil, fmt.Errorf("Failed to lock transfer slot: %v", err)
+			}
+			if locked {
+				return slot, nil
+			}
+		}
+
+		time.Sleep(s.pollInterval)
+	}
+}
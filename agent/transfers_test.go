@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferSchedulerLimitsConcurrency(t *testing.T) {
+	dir := t.TempDir()
+
+	// Like the agent and a job's artifact upload, in different processes
+	schedulers := []*TransferScheduler{
+		NewTransferScheduler(dir, 2, 0),
+		NewTransferScheduler(dir, 2, 0),
+	}
+	for _, s := range schedulers {
+		s.pollInterval = time.Millisecond
+	}
+
+	var running, most int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(s *TransferScheduler) {
+			defer wg.Done()
+			err := s.Do(0, func() error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&most)
+					if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+			assert.NoError(t, err)
+		}(schedulers[i%2])
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), most)
+}
+
+func TestTransferSchedulerPacesTransfersWithinBandwidth(t *testing.T) {
+	// Each of the two slots gets 5KB/s, so 1KB takes at least 200ms
+	s := NewTransferScheduler(t.TempDir(), 2, 10*1000)
+
+	started := time.Now()
+	require.NoError(t, s.Do(1000, func() error { return nil }))
+	assert.GreaterOrEqual(t, time.Since(started), 200*time.Millisecond)
+}
+
+func TestTransferSchedulerReturnsTransferErrors(t *testing.T) {
+	s := NewTransferScheduler(t.TempDir(), 1, 0)
+	assert.EqualError(t, s.Do(0, func() error { return errors.New("broken") }), "broken")
+
+	var none *TransferScheduler
+	assert.EqualError(t, none.Do(0, func() error { return errors.New("broken") }), "broken")
+}
+
+func TestTransferSchedulerFromEnv(t *testing.T) {
+	t.Setenv(transferSlotsPathEnv, "")
+	assert.Nil(t, TransferSchedulerFromEnv())
+
+	s := NewTransferScheduler(t.TempDir(), 3, 1024)
+	for k, v := range s.Env() {
+		t.Setenv(k, v)
+	}
+
+	fromEnv := TransferSchedulerFromEnv()
+	require.NotNil(t, fromEnv)
+	assert.Equal(t, s.path, fromEnv.path)
+	assert.Equal(t, 3, fromEnv.concurrency)
+	assert.Equal(t, int64(1024), fromEnv.bandwidth)
+}
@@ -2,19 +2,30 @@ package api
 
 // AgentRegisterRequest is a call to register on the Buildkite Agent API
 type AgentRegisterRequest struct {
-	Name               string   `json:"name"`
-	Hostname           string   `json:"hostname"`
-	OS                 string   `json:"os"`
-	Arch               string   `json:"arch"`
-	ScriptEvalEnabled  bool     `json:"script_eval_enabled"`
-	IgnoreInDispatches bool     `json:"ignore_in_dispatches"`
-	Priority           string   `json:"priority,omitempty"`
-	Version            string   `json:"version"`
-	Build              string   `json:"build"`
-	Tags               []string `json:"meta_data"`
-	PID                int      `json:"pid,omitempty"`
-	MachineID          string   `json:"machine_id,omitempty"`
-	Features           []string `json:"features"`
+	Name               string           `json:"name"`
+	Hostname           string           `json:"hostname"`
+	OS                 string           `json:"os"`
+	Arch               string           `json:"arch"`
+	ScriptEvalEnabled  bool             `json:"script_eval_enabled"`
+	IgnoreInDispatches bool             `json:"ignore_in_dispatches"`
+	Priority           string           `json:"priority,omitempty"`
+	Weight             int              `json:"weight,omitempty"`
+	Version            string           `json:"version"`
+	Build              string           `json:"build"`
+	Tags               []string         `json:"meta_data"`
+	PID                int              `json:"pid,omitempty"`
+	MachineID          string           `json:"machine_id,omitempty"`
+	Features           []string         `json:"features"`
+	Attestation        *HostAttestation `json:"attestation,omitempty"`
+}
+
+// HostAttestation is a statement about the identity and integrity of the host
+// the agent is running on, which Buildkite can verify before dispatching jobs
+type HostAttestation struct {
+	Source      string `json:"source"`
+	Document    string `json:"document"`
+	Signature   string `json:"signature,omitempty"`
+	Fingerprint string `json:"fingerprint"`
 }
 
 // AgentRegisterResponse is the response from the Buildkite Agent API
@@ -4,10 +4,11 @@ import "fmt"
 
 // Annotation represents a Buildkite Agent API Annotation
 type Annotation struct {
-	Body    string `json:"body,omitempty"`
-	Context string `json:"context,omitempty"`
-	Style   string `json:"style,omitempty"`
-	Append  bool   `json:"append,omitempty"`
+	Body     string `json:"body,omitempty"`
+	Context  string `json:"context,omitempty"`
+	Style    string `json:"style,omitempty"`
+	Append   bool   `json:"append,omitempty"`
+	Priority int    `json:"priority,omitempty"`
 }
 
 // Annotate a build in the Buildkite UI
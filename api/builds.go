@@ -0,0 +1,40 @@
+package api
+
+import (
+	"fmt"
+)
+
+// Build represents a build on the Buildkite Agent API
+type Build struct {
+	ID           string `json:"id"`
+	Number       int    `json:"number"`
+	PipelineSlug string `json:"pipeline_slug"`
+
+	// The build that triggered this one, if one did
+	TriggeredFrom *BuildTrigger `json:"triggered_from,omitempty"`
+}
+
+// BuildTrigger is the build that triggered another with a trigger step
+type BuildTrigger struct {
+	BuildID      string `json:"build_id"`
+	BuildNumber  int    `json:"build_number"`
+	PipelineSlug string `json:"pipeline_slug"`
+}
+
+// GetBuild gets a build, including the build that triggered it
+func (c *Client) GetBuild(id string) (*Build, *Response, error) {
+	u := fmt.Sprintf("builds/%s", id)
+
+	req, err := c.newRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b := new(Build)
+	resp, err := c.doRequest(req, b)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return b, resp, err
+}
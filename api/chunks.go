@@ -3,7 +3,15 @@ package api
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
 )
 
 // Chunk represents a Buildkite Agent API Chunk
@@ -38,3 +46,191 @@ func (c *Client) UploadChunk(jobId string, chunk *Chunk) (*Response, error) {
 
 	return c.doRequest(req, nil)
 }
+
+// How long to wait for Buildkite to acknowledge the last chunks on a stream
+var chunkStreamCloseTimeout = 60 * time.Second
+
+// ErrChunkStreamClosed is returned when sending a chunk on a stream that has
+// been closed. The chunk hasn't been sent, so it can be uploaded on its own.
+var ErrChunkStreamClosed = errors.New("The log stream is closed")
+
+// ChunkStream uploads log chunks over a single long-lived request, so output
+// shows up in Buildkite as soon as it's printed rather than waiting for a
+// request per chunk. Buildkite acknowledges each chunk on the response once
+// it's stored it, and the chunks it hasn't acknowledged when the stream is
+// closed are returned, so they can be uploaded on their own.
+type ChunkStream struct {
+	reader  *io.PipeReader
+	writer  *io.PipeWriter
+	encoder *json.Encoder
+	cancel  context.CancelFunc
+
+	// Only one chunk is written at a time
+	sendMutex sync.Mutex
+
+	// The chunks that haven't been acknowledged yet, why the stream failed,
+	// and whether it's been closed
+	mutex   sync.Mutex
+	pending map[int]*Chunk
+	err     error
+	closed  bool
+
+	done chan struct{}
+}
+
+// streamedChunk is how a chunk is sent on a stream, one per line, and how
+// Buildkite acknowledges it, without the data. Chunks are split by size, so
+// they can end partway through a multibyte character, and jobs can print
+// anything, so the data is sent as bytes (which are base64 encoded) rather
+// than as a string, which would replace anything that isn't valid UTF-8.
+type streamedChunk struct {
+	Sequence int    `json:"sequence"`
+	Offset   int    `json:"offset"`
+	Size     int    `json:"size"`
+	Data     []byte `json:"data,omitempty"`
+}
+
+// StreamChunks opens a stream to upload a job's log chunks over. Buildkite
+// only accepts streams for jobs it has said it can stream logs for.
+func (c *Client) StreamChunks(jobId string) (*ChunkStream, error) {
+	// Signing and recording requests need their whole body up front
+	if c.conf.RequestSigning != "" || c.conf.RecordPath != "" || c.conf.ReplayPath != "" {
+		return nil, errors.New("Logs can't be streamed when requests are signed, recorded or replayed")
+	}
+
+	// The stream lasts as long as the job, so it can't be sent with a
+	// client that times out whole requests
+	if c.client.Timeout != 0 {
+		return nil, errors.New("Logs can't be streamed with an HTTP client that has a timeout")
+	}
+
+	reader, writer := io.Pipe()
+
+	u := joinURLPath(c.conf.Endpoint, fmt.Sprintf("jobs/%s/chunks/stream", jobId))
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "POST", u, reader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	req.Header.Add("User-Agent", c.conf.UserAgent)
+	req.Header.Add("Content-Type", "application/x-ndjson")
+
+	s := &ChunkStream{
+		reader:  reader,
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+		cancel:  cancel,
+		pending: map[int]*Chunk{},
+		done:    make(chan struct{}),
+	}
+
+	c.logger.Debug("%s %s", req.Method, req.URL)
+	go s.run(c.client, req)
+
+	return s, nil
+}
+
+// run sends the stream's request and reads the acknowledgements from the
+// response, until the stream ends
+func (s *ChunkStream) run(client *http.Client, req *http.Request) {
+	defer close(s.done)
+
+	err := func() error {
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if err := checkResponse(resp); err != nil {
+			return err
+		}
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var ack streamedChunk
+			if err := decoder.Decode(&ack); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			s.mutex.Lock()
+			delete(s.pending, ack.Sequence)
+			s.mutex.Unlock()
+		}
+	}()
+
+	s.mutex.Lock()
+	if err == nil && !s.closed {
+		err = errors.New("Buildkite ended the log stream")
+	}
+	s.err = err
+	s.closed = true
+	s.mutex.Unlock()
+
+	// Chunks can't be sent once the request is done
+	s.reader.Close()
+}
+
+// Send sends a chunk on the stream. If it returns ErrChunkStreamClosed the
+// chunk wasn't sent, otherwise it's returned by Close if Buildkite hasn't
+// acknowledged it.
+func (s *ChunkStream) Send(chunk *Chunk) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return ErrChunkStreamClosed
+	}
+	s.pending[chunk.Sequence] = chunk
+	s.mutex.Unlock()
+
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+
+	return s.encoder.Encode(streamedChunk{
+		Sequence: chunk.Sequence,
+		Offset:   chunk.Offset,
+		Size:     chunk.Size,
+		Data:     []byte(chunk.Data),
+	})
+}
+
+// Close finishes the stream and waits for Buildkite to acknowledge the chunks
+// sent on it, returning the ones it didn't in order, and why the stream
+// failed, if it did
+func (s *ChunkStream) Close() ([]*Chunk, error) {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+
+	s.writer.Close()
+
+	select {
+	case <-s.done:
+	case <-time.After(chunkStreamCloseTimeout):
+		s.cancel()
+		<-s.done
+	}
+	s.cancel()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var unacknowledged []*Chunk
+	for _, chunk := range s.pending {
+		unacknowledged = append(unacknowledged, chunk)
+	}
+	sort.Slice(unacknowledged, func(i, j int) bool {
+		return unacknowledged[i].Sequence < unacknowledged[j].Sequence
+	})
+
+	// Nothing was lost if Buildkite acknowledged every chunk before the
+	// stream failed
+	if len(unacknowledged) == 0 {
+		return nil, nil
+	}
+	return unacknowledged, s.err
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestStreamChunks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/jobs/abc/chunks/stream" {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		if !checkAuthToken(t, req, "llamas") {
+			http.Error(rw, "Bad auth", http.StatusUnauthorized)
+			return
+		}
+
+		// Acknowledge every chunk but the second
+		scanner := bufio.NewScanner(req.Body)
+		for scanner.Scan() {
+			var chunk streamedChunk
+			if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+				t.Errorf("Bad chunk %q: %v", scanner.Text(), err)
+				return
+			}
+			if chunk.Sequence != 2 {
+				fmt.Fprintf(rw, `{"sequence":%d}`+"\n", chunk.Sequence)
+			}
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	stream, err := c.StreamChunks("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if err := stream.Send(&Chunk{Data: "hello\n", Sequence: i, Offset: (i - 1) * 6, Size: 6}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unacknowledged, err := stream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unacknowledged) != 1 || unacknowledged[0].Sequence != 2 {
+		t.Fatalf("Expected chunk 2 to be unacknowledged, got %v", unacknowledged)
+	}
+
+	if err := stream.Send(&Chunk{Sequence: 4}); err != ErrChunkStreamClosed {
+		t.Fatalf("Expected ErrChunkStreamClosed, got %v", err)
+	}
+}
+
+func TestStreamChunksRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "Not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	c := NewClient(logger.Discard, Config{Endpoint: server.URL})
+
+	stream, err := c.StreamChunks("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chunk is either never sent, or never acknowledged
+	if err := stream.Send(&Chunk{Data: "hello\n", Sequence: 1, Size: 6}); err == ErrChunkStreamClosed {
+		return
+	}
+
+	unacknowledged, err := stream.Close()
+	if err == nil {
+		t.Fatal("Expected the stream to fail")
+	}
+	if len(unacknowledged) != 1 || unacknowledged[0].Sequence != 1 {
+		t.Fatalf("Expected chunk 1 to be unacknowledged, got %v", unacknowledged)
+	}
+}
+
+func TestStreamChunksSendsBytes(t *testing.T) {
+	// An é is two bytes, which end up in different chunks, and the last
+	// chunk isn't UTF-8 at all
+	log := []byte("h\xc3\xa9llo\xff\xfe")
+	chunks := []*Chunk{
+		{Data: string(log[:2]), Sequence: 1, Offset: 0, Size: 2},
+		{Data: string(log[2:6]), Sequence: 2, Offset: 2, Size: 4},
+		{Data: string(log[6:]), Sequence: 3, Offset: 6, Size: 2},
+	}
+
+	received := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var data []byte
+		scanner := bufio.NewScanner(req.Body)
+		for scanner.Scan() {
+			var chunk streamedChunk
+			if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+				t.Errorf("Bad chunk %q: %v", scanner.Text(), err)
+				return
+			}
+			if len(chunk.Data) != chunk.Size {
+				t.Errorf("Chunk %d has %d bytes, but its size is %d", chunk.Sequence, len(chunk.Data), chunk.Size)
+			}
+			data = append(data, chunk.Data...)
+			fmt.Fprintf(rw, `{"sequence":%d}`+"\n", chunk.Sequence)
+		}
+		received <- data
+	}))
+	defer server.Close()
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	stream, err := c.StreamChunks("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		if err := stream.Send(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if unacknowledged, err := stream.Close(); err != nil || len(unacknowledged) != 0 {
+		t.Fatalf("Expected every chunk to be acknowledged, got %v, %v", unacknowledged, err)
+	}
+
+	if data := <-received; !bytes.Equal(data, log) {
+		t.Fatalf("Expected the stream to have %q, got %q", log, data)
+	}
+}
+
+func TestStreamChunksNeedsAClientWithoutATimeout(t *testing.T) {
+	c := NewClient(logger.Discard, Config{
+		HTTPClient: &http.Client{Timeout: time.Minute},
+	})
+
+	if _, err := c.StreamChunks("abc"); err == nil {
+		t.Fatal("Expected the stream to be refused")
+	}
+}
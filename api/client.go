@@ -4,13 +4,13 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -25,6 +25,9 @@ import (
 const (
 	defaultEndpoint  = "https://agent.buildkite.com/"
 	defaultUserAgent = "buildkite-agent/api"
+
+	// How long a request can take, including reading its response
+	requestTimeout = 60 * time.Second
 )
 
 // Config is configuration for the API Client
@@ -47,6 +50,37 @@ type Config struct {
 
 	// The http client used, leave nil for the default
 	HTTPClient *http.Client
+
+	// If set, every request and response is appended to this file, with
+	// tokens and other secrets redacted
+	RecordPath string
+
+	// If set, requests are answered from this recording instead of being
+	// sent to the API
+	ReplayPath string
+
+	// How requests are signed for an authenticated gateway in front of the
+	// API, either RequestSigningHMAC or RequestSigningAWSSigV4, or empty to
+	// not sign them
+	RequestSigning string
+
+	// The shared secret used to sign requests with HMAC
+	RequestSigningSecret string
+
+	// The AWS region of the API Gateway, for signing requests with AWS SigV4
+	RequestSigningRegion string
+
+	// Only connect to the API over this IP family, either IPFamilyIPv4 or
+	// IPFamilyIPv6, or leave empty to use both
+	IPFamily string
+
+	// Picks the proxy for each request, leave nil to use the proxy in the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Resolves the API endpoint's host with a cache, leave nil to look it
+	// up for each connection
+	DNSCache *DNSCache
 }
 
 // A Client manages communication with the Buildkite Agent API.
@@ -73,14 +107,21 @@ func NewClient(l logger.Logger, conf Config) *Client {
 
 	httpClient := conf.HTTPClient
 	if conf.HTTPClient == nil {
+		proxy := conf.Proxy
+		if proxy == nil {
+			proxy = http.ProxyFromEnvironment
+		}
+
+		dialContext := NewDialContext(conf.IPFamily)
+		if conf.DNSCache != nil {
+			dialContext = conf.DNSCache.DialContext(conf.IPFamily)
+		}
+
 		t := &http.Transport{
-			Proxy:              http.ProxyFromEnvironment,
-			DisableCompression: false,
-			DisableKeepAlives:  false,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
+			Proxy:               proxy,
+			DisableCompression:  false,
+			DisableKeepAlives:   false,
+			DialContext:         dialContext,
 			MaxIdleConns:        100,
 			IdleConnTimeout:     90 * time.Second,
 			TLSHandshakeTimeout: 30 * time.Second,
@@ -90,12 +131,29 @@ func NewClient(l logger.Logger, conf Config) *Client {
 			t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 		}
 
+		var delegate http.RoundTripper = t
+		if conf.RequestSigning != "" {
+			delegate = newSigningTransport(conf.RequestSigning, conf.RequestSigningSecret, conf.RequestSigningRegion, t)
+		}
+
+		var transport http.RoundTripper = &authenticatedTransport{
+			Token:    conf.Token,
+			Delegate: delegate,
+		}
+
+		if conf.ReplayPath != "" {
+			transport = &replayTransport{path: conf.ReplayPath}
+		}
+
+		if conf.RecordPath != "" {
+			transport = &recordingTransport{path: conf.RecordPath, delegate: transport}
+		}
+
+		// Requests time out in doRequest rather than on the client, so
+		// the client can also carry requests that stream for as long as
+		// a job runs
 		httpClient = &http.Client{
-			Timeout: 60 * time.Second,
-			Transport: &authenticatedTransport{
-				Token:    conf.Token,
-				Delegate: t,
-			},
+			Transport: transport,
 		}
 	}
 
@@ -227,6 +285,12 @@ func (c *Client) doRequest(req *http.Request, v interface{}) (*Response, error)
 		}
 	}
 
+	if _, ok := req.Context().Deadline(); !ok && c.client.Timeout == 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), requestTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
 	ts := time.Now()
 
 	c.logger.Debug("%s %s", req.Method, req.URL)
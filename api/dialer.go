@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The IP address families connections can be limited to, for debugging
+// networks where one of them is broken. The default uses both.
+const (
+	IPFamilyIPv4 = "ipv4"
+	IPFamilyIPv6 = "ipv6"
+)
+
+// happyEyeballsDelay is how long a dual-stack connection waits for the first
+// address family it tries before racing the other one (RFC 6555)
+const happyEyeballsDelay = 300 * time.Millisecond
+
+// DialNetwork returns the network to dial to only use an IP family, like tcp4
+// for ipv4, or the network unchanged for the default family
+func DialNetwork(network string, family string) (string, error) {
+	switch family {
+	case "":
+		return network, nil
+	case IPFamilyIPv4, IPFamilyIPv6:
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			return "tcp" + family[len(family)-1:], nil
+		case "udp", "udp4", "udp6":
+			return "udp" + family[len(family)-1:], nil
+		}
+		return network, nil
+	}
+	return "", fmt.Errorf("Unknown IP family %q, which can be ipv4 or ipv6", family)
+}
+
+// NewDialContext returns a DialContext for HTTP transports that only connects
+// over an IP family, or races IPv6 and IPv4 addresses for the default family,
+// so dual-stack hosts with a broken family still connect quickly
+func NewDialContext(family string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:       30 * time.Second,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: happyEyeballsDelay,
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		network, err := DialNetwork(network, family)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
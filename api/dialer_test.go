@@ -0,0 +1,73 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestDialNetwork(t *testing.T) {
+	for _, tc := range []struct {
+		network, family, want string
+	}{
+		{"tcp", "", "tcp"},
+		{"tcp", IPFamilyIPv4, "tcp4"},
+		{"tcp", IPFamilyIPv6, "tcp6"},
+		{"tcp4", IPFamilyIPv6, "tcp6"},
+		{"udp", IPFamilyIPv6, "udp6"},
+		{"unix", IPFamilyIPv4, "unix"},
+	} {
+		got, err := DialNetwork(tc.network, tc.family)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("DialNetwork(%q, %q) = %q, expected %q", tc.network, tc.family, got, tc.want)
+		}
+	}
+
+	if _, err := DialNetwork("tcp", "ipv5"); err == nil {
+		t.Error("Expected an error for an unknown IP family")
+	}
+}
+
+func TestConnectingToIPv6Endpoint(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 isn't available: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		fmt.Fprintf(rw, `{"id":"12-34-56-78-91", "name":"agent-1", "access_token":"alpacas"}`)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	for _, family := range []string{"", IPFamilyIPv6} {
+		c := NewClient(logger.Discard, Config{
+			Endpoint: server.URL,
+			Token:    "llamas",
+			IPFamily: family,
+		})
+
+		if _, _, err := c.Register(&AgentRegisterRequest{Name: "agent-1"}); err != nil {
+			t.Fatalf("Registering over %q: %v", family, err)
+		}
+	}
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+		IPFamily: IPFamilyIPv4,
+	})
+
+	if _, _, err := c.Register(&AgentRegisterRequest{Name: "agent-1"}); err == nil {
+		t.Fatal("Expected registering with an IPv6 endpoint over ipv4 to fail")
+	}
+}
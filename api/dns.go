@@ -0,0 +1,439 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// How long addresses are cached when their TTL isn't known, like for
+	// hosts in /etc/hosts
+	dnsDefaultTTL = time.Minute
+
+	// The longest addresses are cached, whatever their TTL is
+	dnsMaxTTL = time.Hour
+)
+
+// DNSCache caches the addresses of the hosts the agent connects to, like the
+// API endpoint and artifact hosts, for as long as their DNS records' TTLs
+// say they can be. A flaky resolver then only matters when the records
+// expire, and if it fails then, the expired addresses are used until it
+// answers again. When a host can't be connected to at its cached addresses,
+// it's looked up again in case it's moved.
+type DNSCache struct {
+	// Called after each lookup with how long it took, and the error if it
+	// failed, for metrics. It has to be set before the cache is used.
+	OnLookup func(host string, took time.Duration, err error)
+
+	resolver *net.Resolver
+	dialer   *net.Dialer
+
+	// Looks up a host's addresses, and the TTL its records were given with
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+	now    func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]*dnsCacheEntry
+	inflight map[string]*dnsLookup
+
+	// The lowest TTL of the answers to each name's queries, from the DNS
+	// responses the resolver reads
+	ttlMu sync.Mutex
+	ttls  map[string]time.Duration
+}
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// dnsLookup is a lookup that's in progress, which others of the same host
+// wait for rather than looking it up too
+type dnsLookup struct {
+	done  chan struct{}
+	addrs []net.IPAddr
+	err   error
+}
+
+// NewDNSCache returns an empty DNS cache
+func NewDNSCache() *DNSCache {
+	c := &DNSCache{
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		now:      time.Now,
+		entries:  map[string]*dnsCacheEntry{},
+		inflight: map[string]*dnsLookup{},
+		ttls:     map[string]time.Duration{},
+	}
+
+	// The Go resolver is used so that the TTLs can be read from the
+	// responses it gets, which net.Resolver doesn't return
+	c.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := conn.(net.PacketConn); ok {
+				return &dnsPacketConn{Conn: conn, record: c.recordTTLs}, nil
+			}
+			return &dnsStreamConn{Conn: conn, record: c.recordTTLs}, nil
+		},
+	}
+	c.lookup = c.resolve
+
+	return c
+}
+
+// resolve looks up a host with the resolver, returning the TTL of its
+// records if one was seen
+func (c *DNSCache) resolve(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+
+	c.ttlMu.Lock()
+	delete(c.ttls, name)
+	c.ttlMu.Unlock()
+
+	addrs, err := c.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	c.ttlMu.Lock()
+	ttl, ok := c.ttls[name]
+	c.ttlMu.Unlock()
+	if !ok {
+		ttl = dnsDefaultTTL
+	}
+
+	return addrs, ttl, nil
+}
+
+// recordTTLs records the lowest TTL of the answers in a DNS response, for
+// the name it's the answer to
+func (c *DNSCache) recordTTLs(msg []byte) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || !header.Response {
+		return
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	var ttl uint32
+	found := false
+	for {
+		answer, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		switch answer.Type {
+		case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeCNAME:
+			if !found || answer.TTL < ttl {
+				ttl, found = answer.TTL, true
+			}
+		}
+		if err := p.SkipAnswer(); err != nil {
+			break
+		}
+	}
+	if !found {
+		return
+	}
+
+	// Hosts are looked up with an A and an AAAA query, so it's the lower
+	// of their TTLs
+	name := strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))
+	d := time.Duration(ttl) * time.Second
+
+	c.ttlMu.Lock()
+	defer c.ttlMu.Unlock()
+	if old, ok := c.ttls[name]; !ok || d < old {
+		c.ttls[name] = d
+	}
+}
+
+// LookupIPAddr returns a host's addresses, from the cache if they haven't
+// expired. Expired addresses are returned if looking them up again fails.
+func (c *DNSCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := c.lookupIPAddr(ctx, host, false)
+	return addrs, err
+}
+
+// lookupIPAddr returns a host's addresses, and whether they came from the
+// cache. Refreshing looks them up even if they haven't expired.
+func (c *DNSCache) lookupIPAddr(ctx context.Context, host string, refresh bool) ([]net.IPAddr, bool, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, false, nil
+	}
+
+	key := strings.ToLower(host)
+
+	c.mu.Lock()
+	entry := c.entries[key]
+	if entry != nil && !refresh && c.now().Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.addrs, true, nil
+	}
+
+	// Only one lookup of a host is done at a time
+	l, waiting := c.inflight[key]
+	if !waiting {
+		l = &dnsLookup{done: make(chan struct{})}
+		c.inflight[key] = l
+	}
+	c.mu.Unlock()
+
+	if waiting {
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	} else {
+		start := c.now()
+		var ttl time.Duration
+		l.addrs, ttl, l.err = c.lookup(ctx, host)
+		if c.OnLookup != nil {
+			c.OnLookup(host, c.now().Sub(start), l.err)
+		}
+
+		c.mu.Lock()
+		if l.err == nil {
+			if ttl > dnsMaxTTL {
+				ttl = dnsMaxTTL
+			}
+			entry = &dnsCacheEntry{addrs: l.addrs, expires: c.now().Add(ttl)}
+			c.entries[key] = entry
+		}
+		delete(c.inflight, key)
+		c.mu.Unlock()
+		close(l.done)
+	}
+
+	if l.err != nil {
+		// The addresses the host had are better than none while the
+		// resolver is failing
+		if entry != nil {
+			return entry.addrs, true, nil
+		}
+		return nil, false, l.err
+	}
+
+	return l.addrs, false, nil
+}
+
+// DialContext returns a DialContext for HTTP transports that connects to
+// hosts at their cached addresses, only over an IP family if one's given.
+// Like NewDialContext's, it races IPv6 and IPv4 addresses for the default
+// family.
+func (c *DNSCache) DialContext(family string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		network, err := DialNetwork(network, family)
+		if err != nil {
+			return nil, err
+		}
+
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return c.dialer.DialContext(ctx, network, address)
+		}
+
+		addrs, cached, err := c.lookupIPAddr(ctx, host, false)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := c.dialAddrs(ctx, network, host, addrs, port)
+		if err == nil || !cached || ctx.Err() != nil {
+			return conn, err
+		}
+
+		// The host may have moved since its addresses were cached, so it's
+		// looked up again, and connected to if it has new ones
+		fresh, cached, lookupErr := c.lookupIPAddr(ctx, host, true)
+		if lookupErr != nil || cached || sameIPAddrs(fresh, addrs) {
+			return nil, err
+		}
+		return c.dialAddrs(ctx, network, host, fresh, port)
+	}
+}
+
+// dialAddrs connects to the first of a host's addresses that it can, racing
+// the first address family against the other after happyEyeballsDelay, like
+// net.Dialer does with its FallbackDelay
+func (c *DNSCache) dialAddrs(ctx context.Context, network, host string, addrs []net.IPAddr, port string) (net.Conn, error) {
+	var primaries, fallbacks []net.IPAddr
+	for _, addr := range addrs {
+		isIPv4 := addr.IP.To4() != nil
+		switch {
+		case network == "tcp4" && !isIPv4, network == "tcp6" && isIPv4:
+			continue
+		case len(primaries) == 0 || (primaries[0].IP.To4() != nil) == isIPv4:
+			primaries = append(primaries, addr)
+		default:
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	if len(primaries) == 0 {
+		return nil, fmt.Errorf("%s has no addresses to connect to over %s", host, network)
+	}
+	if len(fallbacks) == 0 {
+		return c.dialSerial(ctx, network, primaries, port)
+	}
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+
+	results := make(chan dialResult)
+	returned := make(chan struct{})
+	defer close(returned)
+
+	race := func(ctx context.Context, addrs []net.IPAddr, primary bool) {
+		conn, err := c.dialSerial(ctx, network, addrs, port)
+		select {
+		case results <- dialResult{conn: conn, err: err, primary: primary}:
+		case <-returned:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	primaryCtx, primaryCancel := context.WithCancel(ctx)
+	defer primaryCancel()
+	go race(primaryCtx, primaries, true)
+
+	fallbackTimer := time.NewTimer(happyEyeballsDelay)
+	defer fallbackTimer.Stop()
+
+	var primaryErr error
+	fallbackStarted, primaryDone, fallbackDone := false, false, false
+	startFallback := func() {
+		if !fallbackStarted {
+			fallbackStarted = true
+			go race(ctx, fallbacks, false)
+		}
+	}
+
+	for {
+		select {
+		case <-fallbackTimer.C:
+			startFallback()
+
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr, primaryDone = res.err, true
+				startFallback()
+			} else {
+				fallbackDone = true
+			}
+			if primaryDone && fallbackDone {
+				return nil, primaryErr
+			}
+		}
+	}
+}
+
+// dialSerial connects to the first of the addresses that it can
+func (c *DNSCache) dialSerial(ctx context.Context, network string, addrs []net.IPAddr, port string) (net.Conn, error) {
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := c.dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+func sameIPAddrs(a, b []net.IPAddr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].IP.Equal(b[i].IP) || a[i].Zone != b[i].Zone {
+			return false
+		}
+	}
+	return true
+}
+
+// dnsPacketConn reads DNS responses over UDP, recording their TTLs. The Go
+// resolver only uses UDP if the connection is a net.PacketConn.
+type dnsPacketConn struct {
+	net.Conn
+	record func(msg []byte)
+}
+
+func (c *dnsPacketConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == nil {
+		c.record(b[:n])
+	}
+	return n, err
+}
+
+func (c *dnsPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.Conn.(net.PacketConn).ReadFrom(b)
+	if err == nil {
+		c.record(b[:n])
+	}
+	return n, addr, err
+}
+
+func (c *dnsPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Conn.(net.PacketConn).WriteTo(b, addr)
+}
+
+// dnsStreamConn reads DNS responses over TCP, recording their TTLs. Each
+// response starts with its length in two bytes.
+type dnsStreamConn struct {
+	net.Conn
+	record func(msg []byte)
+	buf    []byte
+}
+
+func (c *dnsStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 {
+		size := int(c.buf[0])<<8 | int(c.buf[1])
+		if len(c.buf) < 2+size {
+			break
+		}
+		c.record(c.buf[2 : 2+size])
+		c.buf = c.buf[2+size:]
+	}
+	return n, err
+}
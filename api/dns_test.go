@@ -0,0 +1,222 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func dnsResponse(t *testing.T, name string, ttls ...uint32) []byte {
+	t.Helper()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Question(q); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StartAnswers(); err != nil {
+		t.Fatal(err)
+	}
+	for i, ttl := range ttls {
+		h := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+		if err := b.AResource(h, dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i + 1)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDNSCacheRecordsTTLs(t *testing.T) {
+	c := NewDNSCache()
+
+	c.recordTTLs(dnsResponse(t, "Agent.Buildkite.com.", 300, 60))
+	c.recordTTLs(dnsResponse(t, "agent.buildkite.com.", 120))
+	c.recordTTLs(dnsResponse(t, "empty.example.com."))
+	c.recordTTLs([]byte("not a dns message"))
+
+	if got, want := c.ttls["agent.buildkite.com"], time.Minute; got != want {
+		t.Errorf("TTL = %v, expected %v", got, want)
+	}
+	if _, ok := c.ttls["empty.example.com"]; ok {
+		t.Error("Expected no TTL for a response without answers")
+	}
+
+	// Over TCP, responses can be split across reads
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &dnsStreamConn{Conn: client, record: c.recordTTLs}
+
+	msg := dnsResponse(t, "artifacts.example.com.", 30)
+	go func() {
+		framed := append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+		server.Write(framed[:5])
+		server.Write(framed[5:])
+		server.Close()
+	}()
+	buf := make([]byte, 512)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+	}
+
+	if got, want := c.ttls["artifacts.example.com"], 30*time.Second; got != want {
+		t.Errorf("TTL = %v, expected %v", got, want)
+	}
+}
+
+type fakeLookup struct {
+	mu      sync.Mutex
+	addrs   map[string][]net.IPAddr
+	ttl     time.Duration
+	err     error
+	lookups int
+}
+
+func (f *fakeLookup) lookup(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups++
+	if f.err != nil {
+		return nil, 0, f.err
+	}
+	addrs, ok := f.addrs[host]
+	if !ok {
+		return nil, 0, fmt.Errorf("no such host %s", host)
+	}
+	return addrs, f.ttl, nil
+}
+
+func ipAddrs(ips ...string) []net.IPAddr {
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs
+}
+
+func TestDNSCacheRespectsTTLs(t *testing.T) {
+	now := time.Now()
+	fake := &fakeLookup{addrs: map[string][]net.IPAddr{"agent.buildkite.com": ipAddrs("192.0.2.1")}, ttl: 30 * time.Second}
+
+	var lookups []error
+	c := NewDNSCache()
+	c.lookup = fake.lookup
+	c.now = func() time.Time { return now }
+	c.OnLookup = func(host string, took time.Duration, err error) {
+		lookups = append(lookups, err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		addrs, err := c.LookupIPAddr(ctx, "agent.buildkite.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameIPAddrs(addrs, ipAddrs("192.0.2.1")) {
+			t.Fatalf("Addresses = %v", addrs)
+		}
+	}
+	if fake.lookups != 1 {
+		t.Errorf("Looked up %d times, expected once while the TTL hadn't expired", fake.lookups)
+	}
+
+	// Once they've expired, they're looked up again
+	now = now.Add(31 * time.Second)
+	fake.addrs["agent.buildkite.com"] = ipAddrs("192.0.2.2")
+	addrs, err := c.LookupIPAddr(ctx, "agent.buildkite.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameIPAddrs(addrs, ipAddrs("192.0.2.2")) {
+		t.Errorf("Addresses = %v, expected the new ones", addrs)
+	}
+
+	// If the resolver fails, the expired addresses are used
+	now = now.Add(31 * time.Second)
+	fake.err = errors.New("i/o timeout")
+	addrs, err = c.LookupIPAddr(ctx, "agent.buildkite.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameIPAddrs(addrs, ipAddrs("192.0.2.2")) {
+		t.Errorf("Addresses = %v, expected the expired ones", addrs)
+	}
+
+	// But there's nothing to use for a host that's never been looked up
+	if _, err := c.LookupIPAddr(ctx, "artifacts.example.com"); err == nil {
+		t.Error("Expected an error looking up a new host while the resolver is failing")
+	}
+
+	if len(lookups) != 4 || lookups[0] != nil || lookups[1] != nil || lookups[2] == nil || lookups[3] == nil {
+		t.Errorf("OnLookup was called with %v", lookups)
+	}
+}
+
+func TestDNSCacheLooksUpAgainWhenConnectingFails(t *testing.T) {
+	// A port that nothing's listening on, where the host used to be
+	closed, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, oldPort, _ := net.SplitHostPort(closed.Addr().String())
+	closed.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		fmt.Fprintf(rw, `{"id":"12-34-56-78-91", "name":"agent-1", "access_token":"alpacas"}`)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	// The server's port stands in for the host moving to an address it's
+	// listening on
+	fake := &fakeLookup{addrs: map[string][]net.IPAddr{"agent.test": ipAddrs("127.0.0.2")}, ttl: time.Hour}
+	c := NewDNSCache()
+	c.lookup = fake.lookup
+	c.dialer = &net.Dialer{Timeout: 5 * time.Second}
+	if _, err := c.LookupIPAddr(context.Background(), "agent.test"); err != nil {
+		t.Fatal(err)
+	}
+	fake.addrs["agent.test"] = ipAddrs("127.0.0.1")
+
+	client := NewClient(logger.Discard, Config{
+		Endpoint: "http://agent.test:" + port,
+		Token:    "llamas",
+		DNSCache: c,
+	})
+	if _, _, err := client.Register(&AgentRegisterRequest{Name: "agent-1"}); err != nil {
+		t.Fatalf("Registering: %v", err)
+	}
+	if fake.lookups != 2 {
+		t.Errorf("Looked up %d times, expected the failed connection to look the host up again", fake.lookups)
+	}
+
+	// A host that's still at its cached addresses isn't connected to again
+	dial := c.DialContext("")
+	if _, err := dial(context.Background(), "tcp", "agent.test:"+oldPort); err == nil {
+		t.Fatal("Expected connecting to a closed port to fail")
+	}
+	if fake.lookups != 3 {
+		t.Errorf("Looked up %d times, expected one more", fake.lookups)
+	}
+	if _, err := dial(context.Background(), "tcp6", "agent.test:"+port); err == nil {
+		t.Error("Expected an error connecting over IPv6 to a host with only IPv4 addresses")
+	}
+}
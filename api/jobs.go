@@ -11,9 +11,11 @@ type Job struct {
 	State              string            `json:"state,omitempty"`
 	Env                map[string]string `json:"env,omitempty"`
 	ChunksMaxSizeBytes int               `json:"chunks_max_size_bytes,omitempty"`
+	LogStreaming       bool              `json:"log_streaming,omitempty"`
 	ExitStatus         string            `json:"exit_status,omitempty"`
 	Signal             string            `json:"signal,omitempty"`
 	SignalReason       string            `json:"signal_reason,omitempty"`
+	FailureReason      string            `json:"failure_reason,omitempty"`
 	StartedAt          string            `json:"started_at,omitempty"`
 	FinishedAt         string            `json:"finished_at,omitempty"`
 	RunnableAt         string            `json:"runnable_at,omitempty"`
@@ -32,6 +34,7 @@ type jobFinishRequest struct {
 	ExitStatus        string `json:"exit_status,omitempty"`
 	Signal            string `json:"signal,omitempty"`
 	SignalReason      string `json:"signal_reason,omitempty"`
+	FailureReason     string `json:"failure_reason,omitempty"`
 	FinishedAt        string `json:"finished_at,omitempty"`
 	ChunksFailedCount int    `json:"chunks_failed_count"`
 }
@@ -115,6 +118,7 @@ func (c *Client) FinishJob(job *Job) (*Response, error) {
 		ExitStatus:        job.ExitStatus,
 		Signal:            job.Signal,
 		SignalReason:      job.SignalReason,
+		FailureReason:     job.FailureReason,
 		ChunksFailedCount: job.ChunksFailedCount,
 	})
 	if err != nil {
@@ -8,6 +8,10 @@ import (
 type MetaData struct {
 	Key   string `json:"key,omitempty"`
 	Value string `json:"value,omitempty"`
+
+	// Only set the value if the key hasn't been set yet. If it has, setting
+	// it fails with a 409 Conflict.
+	IfAbsent bool `json:"if_absent,omitempty"`
 }
 
 // MetaDataExists represents a Buildkite Agent API MetaData Exists check
@@ -8,9 +8,31 @@ type Ping struct {
 	Endpoint string `json:"endpoint,omitempty"`
 }
 
+// PingOptions are sent along with a ping to help Buildkite decide which job
+// to give the agent
+type PingOptions struct {
+	// The pipelines the agent has recently built, as "org/pipeline", most
+	// recent first. Jobs from these pipelines can reuse the agent's
+	// checkouts and caches.
+	RecentPipelines []string `url:"recent_pipelines,comma,omitempty"`
+
+	// The agent's priority and capacity weight, if they've been changed
+	// since it registered
+	Priority string `url:"priority,omitempty"`
+	Weight   int    `url:"weight,omitempty"`
+
+	// The agent's tags, if they've been changed since it registered
+	Tags []string `url:"tags,comma,omitempty"`
+}
+
 // Pings the API and returns any work the client needs to perform
-func (c *Client) Ping() (*Ping, *Response, error) {
-	req, err := c.newRequest("GET", "ping", nil)
+func (c *Client) Ping(opt *PingOptions) (*Ping, *Response, error) {
+	u, err := addOptions("ping", opt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := c.newRequest("GET", u, nil)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -10,7 +10,9 @@ type Pipeline struct {
 }
 
 // Uploads the pipeline to the Buildkite Agent API. This request doesn't use JSON,
-// but a multi-part HTTP form upload
+// but a multi-part HTTP form upload. The pipeline's UUID is also sent as the
+// request's idempotency key, so that retrying an upload doesn't add its steps
+// twice.
 func (c *Client) UploadPipeline(jobId string, pipeline *Pipeline) (*Response, error) {
 	u := fmt.Sprintf("jobs/%s/pipelines", jobId)
 
@@ -19,5 +21,9 @@ func (c *Client) UploadPipeline(jobId string, pipeline *Pipeline) (*Response, er
 		return nil, err
 	}
 
+	if pipeline.UUID != "" {
+		req.Header.Set("Idempotency-Key", pipeline.UUID)
+	}
+
 	return c.doRequest(req, nil)
 }
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The value that sensitive fields are replaced with in recordings
+const recordingRedacted = "[REDACTED]"
+
+// Fields in request and response bodies with names matching these patterns
+// are redacted from recordings. Names are upper cased before matching, so
+// access_token is matched by *_TOKEN.
+var recordingRedactedFields = []string{
+	"TOKEN",
+	"*_TOKEN",
+	"PASSWORD",
+	"*_PASSWORD",
+	"SECRET",
+	"*_SECRET",
+	"*_ACCESS_KEY",
+	"*_SECRET_KEY",
+	"*_PRIVATE_KEY",
+}
+
+// Interaction is a request to the Agent API and the response to it, as it's
+// stored in a recording. Recordings are a file with an interaction as JSON on
+// each line.
+type Interaction struct {
+	Time         time.Time       `json:"time"`
+	Method       string          `json:"method"`
+	Path         string          `json:"path"`
+	RequestBody  json.RawMessage `json:"request_body,omitempty"`
+	Status       int             `json:"status"`
+	ResponseBody json.RawMessage `json:"response_body,omitempty"`
+}
+
+// recordingTransport appends every request and response that passes through
+// it to a recording, with tokens and other secrets redacted
+type recordingTransport struct {
+	path     string
+	delegate http.RoundTripper
+	mu       sync.Mutex
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := t.delegate.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	interaction := Interaction{
+		Time:         time.Now().UTC(),
+		Method:       req.Method,
+		Path:         req.URL.RequestURI(),
+		RequestBody:  sanitizeRecordedBody(reqBody),
+		Status:       resp.StatusCode,
+		ResponseBody: sanitizeRecordedBody(respBody),
+	}
+
+	// A failure to record shouldn't fail the request
+	_ = t.write(interaction)
+
+	return resp, nil
+}
+
+func (t *recordingTransport) write(interaction Interaction) error {
+	line, err := json.Marshal(interaction)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Opened for each interaction, since the agent and the commands run by
+	// jobs can all be recording to the same file
+	f, err := os.OpenFile(t.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// replayTransport answers requests with the responses from a recording,
+// without making any network requests. Requests are matched to interactions
+// with the same method and path, in the order they were recorded. Once
+// they've all been used, the last one is used again, so that things that poll,
+// like pings and heartbeats, keep getting an answer.
+type replayTransport struct {
+	path string
+
+	once         sync.Once
+	loadErr      error
+	mu           sync.Mutex
+	interactions map[string][]Interaction
+	used         map[string]int
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.once.Do(func() {
+		t.interactions, t.loadErr = loadRecording(t.path)
+		t.used = map[string]int{}
+	})
+	if t.loadErr != nil {
+		return nil, t.loadErr
+	}
+
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	key := req.Method + " " + req.URL.RequestURI()
+
+	t.mu.Lock()
+	recorded := t.interactions[key]
+	i := t.used[key]
+	if i < len(recorded) {
+		t.used[key]++
+	} else {
+		i = len(recorded) - 1
+	}
+	t.mu.Unlock()
+
+	if i < 0 {
+		return nil, fmt.Errorf("No recorded response for %s", key)
+	}
+
+	interaction := recorded[i]
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.Status, http.StatusText(interaction.Status)),
+		StatusCode:    interaction.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(interaction.ResponseBody)),
+		ContentLength: int64(len(interaction.ResponseBody)),
+		Request:       req,
+	}, nil
+}
+
+// LoadRecording reads the interactions in a recording, in the order they
+// were recorded
+func LoadRecording(path string) ([]Interaction, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open API recording: %v", err)
+	}
+	defer f.Close()
+
+	var interactions []Interaction
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var interaction Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+			return nil, fmt.Errorf("Failed to parse API recording %s on line %d: %v", path, line, err)
+		}
+		interactions = append(interactions, interaction)
+	}
+
+	return interactions, scanner.Err()
+}
+
+func loadRecording(path string) (map[string][]Interaction, error) {
+	interactions, err := LoadRecording(path)
+	if err != nil {
+		return nil, err
+	}
+
+	byRequest := map[string][]Interaction{}
+	for _, interaction := range interactions {
+		key := interaction.Method + " " + interaction.Path
+		byRequest[key] = append(byRequest[key], interaction)
+	}
+	return byRequest, nil
+}
+
+// sanitizeRecordedBody returns a body as it should be stored in a recording.
+// JSON has its sensitive fields redacted, and anything else, like artifact
+// and log uploads, is left out entirely.
+func sanitizeRecordedBody(body []byte) json.RawMessage {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+
+	sanitized, err := json.Marshal(redactRecordedValue(v))
+	if err != nil {
+		return nil
+	}
+	return sanitized
+}
+
+func redactRecordedValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if _, ok := value.(string); ok && isRecordingRedactedField(k) {
+				v[k] = recordingRedacted
+			} else {
+				v[k] = redactRecordedValue(value)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactRecordedValue(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func isRecordingRedactedField(name string) bool {
+	name = strings.ToUpper(name)
+	for _, pattern := range recordingRedactedFields {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestRecordingAndReplayingClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case `/register`:
+			rw.WriteHeader(http.StatusOK)
+			fmt.Fprintf(rw, `{"id":"12-34-56-78-91", "name":"agent-1", "access_token":"alpacas"}`)
+
+		case `/jobs/123/data/get`:
+			http.Error(rw, `{"message":"No key found"}`, http.StatusNotFound)
+
+		default:
+			t.Errorf("Unknown endpoint %s %s", req.Method, req.URL.Path)
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	recording := filepath.Join(t.TempDir(), "api.jsonl")
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint:   server.URL,
+		Token:      "llamas",
+		RecordPath: recording,
+	})
+
+	regResp, _, err := c.Register(&AgentRegisterRequest{Name: "agent-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if regResp.AccessToken != "alpacas" {
+		t.Fatalf("Bad access token %q", regResp.AccessToken)
+	}
+
+	if _, resp, err := c.GetMetaData("123", "foo"); err == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected a 404, got %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(contents), "alpacas") || strings.Contains(string(contents), "llamas") {
+		t.Fatalf("Recording contains a token: %s", contents)
+	}
+
+	interactions, err := LoadRecording(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(interactions) != 2 {
+		t.Fatalf("Expected 2 interactions, got %d", len(interactions))
+	}
+
+	// Replay against a server that's gone
+	server.Close()
+
+	replay := NewClient(logger.Discard, Config{
+		Endpoint:   server.URL,
+		ReplayPath: recording,
+	})
+
+	regResp, _, err = replay.Register(&AgentRegisterRequest{Name: "agent-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if regResp.Name != "agent-1" || regResp.AccessToken != recordingRedacted {
+		t.Fatalf("Bad replayed response %#v", regResp)
+	}
+
+	if _, resp, err := replay.GetMetaData("123", "foo"); err == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected a replayed 404, got %v", err)
+	}
+
+	if _, _, err := replay.GetMetaData("456", "foo"); err == nil {
+		t.Fatalf("Expected an error for a request that wasn't recorded")
+	}
+}
+
+func TestRecordingRedactsSecrets(t *testing.T) {
+	body := sanitizeRecordedBody([]byte(`{"env":{"MY_API_TOKEN":"secret","BUILDKITE_REPO":"git@github.com:a/b"},"password":"hunter2","items":[{"access_token":"x"}],"count":3}`))
+
+	for _, secret := range []string{`"secret"`, `hunter2`, `"x"`} {
+		if strings.Contains(string(body), secret) {
+			t.Errorf("Expected %s to be redacted from %s", secret, body)
+		}
+	}
+
+	if !strings.Contains(string(body), "git@github.com:a/b") || !strings.Contains(string(body), `"count":3`) {
+		t.Errorf("Expected other fields to be left alone in %s", body)
+	}
+
+	if sanitizeRecordedBody([]byte("not json")) != nil {
+		t.Errorf("Expected bodies that aren't JSON to be left out")
+	}
+}
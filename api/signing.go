@@ -0,0 +1,135 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// The ways requests can be signed for gateways in front of the API
+const (
+	RequestSigningHMAC     = "hmac"
+	RequestSigningAWSSigV4 = "aws-sigv4"
+)
+
+const (
+	// The headers added to requests signed with HMAC
+	hmacSignatureHeader = "X-Buildkite-Signature"
+	hmacTimestampHeader = "X-Buildkite-Signature-Timestamp"
+
+	// The AWS service requests are signed for, which is API Gateway
+	awsSigningService = "execute-api"
+
+	// How long an AWS signature is valid for
+	awsSignatureExpiry = 5 * time.Minute
+)
+
+// signingTransport signs requests so they can pass through an authenticated
+// gateway on the way to the API. It doesn't touch the Authorization header,
+// which still carries the agent's token.
+type signingTransport struct {
+	// The signing method, one of the RequestSigning constants
+	Method string
+
+	// The shared secret for HMAC signing
+	Secret string
+
+	// The AWS region of the gateway, for AWS signing
+	Region string
+
+	// Signs requests for AWS, using the default AWS credentials
+	signer *v4.Signer
+
+	// Delegate is the underlying HTTP transport
+	Delegate http.RoundTripper
+
+	// Returns the time requests are signed at
+	now func() time.Time
+}
+
+// newSigningTransport returns a transport that signs requests with the method
+func newSigningTransport(method, secret, region string, delegate http.RoundTripper) *signingTransport {
+	t := &signingTransport{
+		Method:   method,
+		Secret:   secret,
+		Region:   region,
+		Delegate: delegate,
+		now:      time.Now,
+	}
+
+	if method == RequestSigningAWSSigV4 {
+		t.signer = v4.NewSigner(credentials.NewCredentials(&credentials.ChainProvider{
+			VerboseErrors: true,
+			Providers:     defaults.CredProviders(defaults.Config(), defaults.Handlers()),
+		}))
+	}
+
+	return t
+}
+
+// RoundTrip invoked each time a request is made
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Signatures cover the body, so it needs reading up front
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	switch t.Method {
+	case RequestSigningHMAC:
+		if t.Secret == "" {
+			return nil, fmt.Errorf("A secret is needed to sign requests with HMAC")
+		}
+		timestamp := strconv.FormatInt(t.now().Unix(), 10)
+		req.Header.Set(hmacTimestampHeader, timestamp)
+		req.Header.Set(hmacSignatureHeader, hmacSignature(t.Secret, req.Method, req.URL.RequestURI(), timestamp, body))
+
+	case RequestSigningAWSSigV4:
+		if t.Region == "" {
+			return nil, fmt.Errorf("A region is needed to sign requests for AWS")
+		}
+		// Presigning puts the signature in the query string, which leaves
+		// the Authorization header for the agent's token
+		if _, err := t.signer.Presign(req, bytes.NewReader(body), awsSigningService, t.Region, awsSignatureExpiry, t.now()); err != nil {
+			return nil, fmt.Errorf("Failed to sign request for AWS: %v", err)
+		}
+
+	default:
+		return nil, fmt.Errorf("Unknown request signing method %q", t.Method)
+	}
+
+	return t.Delegate.RoundTrip(req)
+}
+
+// CancelRequest cancels an in-flight request by closing its connection.
+func (t *signingTransport) CancelRequest(req *http.Request) {
+	cancelableTransport := t.Delegate.(canceler)
+	cancelableTransport.CancelRequest(req)
+}
+
+// hmacSignature returns the hex encoded HMAC-SHA256 of a request's method,
+// path with query, timestamp and the hex encoded SHA256 of its body, each on
+// its own line
+func hmacSignature(secret, method, uri, timestamp string, body []byte) string {
+	bodySum := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", method, uri, timestamp, hex.EncodeToString(bodySum[:]))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
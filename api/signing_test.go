@@ -0,0 +1,92 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestSigningRequestsWithHMAC(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		expected := hmacSignature("llamas", req.Method, req.URL.RequestURI(), req.Header.Get(hmacTimestampHeader), body)
+		if req.Header.Get(hmacSignatureHeader) != expected {
+			t.Errorf("Bad signature %q, expected %q", req.Header.Get(hmacSignatureHeader), expected)
+		}
+		if req.Header.Get("Authorization") != "Token alpacas" {
+			t.Errorf("Bad authorization %q", req.Header.Get("Authorization"))
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		fmt.Fprintf(rw, `{"id":"12-34-56-78-91", "name":"agent-1", "access_token":"alpacas"}`)
+	}))
+	defer server.Close()
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint:             server.URL,
+		Token:                "alpacas",
+		RequestSigning:       RequestSigningHMAC,
+		RequestSigningSecret: "llamas",
+	})
+
+	if _, _, err := c.Register(&AgentRegisterRequest{Name: "agent-1"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSigningRequestsWithAWSSigV4(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDLLAMAS")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "alpacas")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if q.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" || q.Get("X-Amz-Signature") == "" {
+			t.Errorf("Request isn't signed: %s", req.URL)
+		}
+		if !strings.HasPrefix(q.Get("X-Amz-Credential"), "AKIDLLAMAS/") || !strings.Contains(q.Get("X-Amz-Credential"), "/ap-southeast-2/execute-api/") {
+			t.Errorf("Bad credential scope %q", q.Get("X-Amz-Credential"))
+		}
+		if req.Header.Get("Authorization") != "Token alpacas" {
+			t.Errorf("Bad authorization %q", req.Header.Get("Authorization"))
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		fmt.Fprintf(rw, `{"id":"12-34-56-78-91", "name":"agent-1", "access_token":"alpacas"}`)
+	}))
+	defer server.Close()
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint:             server.URL,
+		Token:                "alpacas",
+		RequestSigning:       RequestSigningAWSSigV4,
+		RequestSigningRegion: "ap-southeast-2",
+	})
+
+	if _, _, err := c.Register(&AgentRegisterRequest{Name: "agent-1"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSigningRequestsWithAnUnknownMethodFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("Unsigned request was sent")
+	}))
+	defer server.Close()
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint:       server.URL,
+		Token:          "alpacas",
+		RequestSigning: "rot13",
+	})
+
+	if _, _, err := c.Register(&AgentRegisterRequest{Name: "agent-1"}); err == nil || !strings.Contains(err.Error(), `Unknown request signing method "rot13"`) {
+		t.Fatalf("Expected an unknown signing method error, got %v", err)
+	}
+}
@@ -53,3 +53,27 @@ func (c *Client) StepUpdate(stepIdOrKey string, stepUpdate *StepUpdate) (*Respon
 
 	return c.doRequest(req, nil)
 }
+
+// StepJob is one of the jobs of a step, like each of a parallel step's jobs
+type StepJob struct {
+	ID          string `json:"id"`
+	ParallelJob int    `json:"parallel_job"`
+}
+
+// GetStepJobs gets the jobs of a step
+func (c *Client) GetStepJobs(stepID string) ([]*StepJob, *Response, error) {
+	u := fmt.Sprintf("steps/%s/jobs", stepID)
+
+	req, err := c.newRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jobs := []*StepJob{}
+	resp, err := c.doRequest(req, &jobs)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return jobs, resp, err
+}
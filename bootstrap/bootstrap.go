@@ -9,20 +9,24 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/agent/plugin"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/hook"
 	"github.com/buildkite/agent/v3/process"
+	"github.com/buildkite/agent/v3/proxy"
 	"github.com/buildkite/agent/v3/redaction"
+	"github.com/buildkite/agent/v3/retry"
 	"github.com/buildkite/agent/v3/tracetools"
 	"github.com/buildkite/agent/v3/utils"
-	"github.com/buildkite/roko"
 	"github.com/buildkite/shellwords"
 	"github.com/pkg/errors"
 )
@@ -47,6 +51,19 @@ type Bootstrap struct {
 	// Directories to clean up at end of bootstrap
 	cleanupDirs []string
 
+	// The hooks that were looked for, and what happened when they ran
+	hookRecords []hookRecord
+
+	// Keychain and provisioning profile changes to undo at the end
+	signing macOSSigning
+
+	// The PAC file that picks the proxies for plugin clones, once it's loaded
+	proxyPAC *proxy.PAC
+
+	// Why the job failed, if it did
+	failure   *agent.JobFailure
+	failureMu sync.Mutex
+
 	// A channel to track cancellation
 	cancelCh chan struct{}
 }
@@ -73,6 +90,7 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		b.shell.PTY = b.Config.RunInPty
 		b.shell.Debug = b.Config.Debug
 		b.shell.InterruptSignal = b.Config.CancelSignal
+		b.shell.WSLDistribution = b.Config.WSLDistribution
 	}
 
 	var err error
@@ -81,13 +99,29 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 	defer stopper()
 	defer func() { span.FinishWithError(err) }()
 
+	// The pre-exit hooks still run once the job has timed out, so they can
+	// clean up
+	teardownCtx := ctx
+
+	// Everything else stops at the job's deadline
+	if !b.Config.JobDeadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, b.Config.JobDeadline)
+		defer cancel()
+	}
+
 	// Listen for cancellation
 	go func() {
 		select {
 		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				b.recordFailure(ctx, agent.FailureReasonTimeout, ctx.Err())
+				b.shell.Commentf("The job has reached its timeout, stopping it")
+			}
 			return
 
 		case <-b.cancelCh:
+			b.recordFailure(ctx, agent.FailureReasonCancelled, errCancelled)
 			b.shell.Commentf("Received cancellation signal, interrupting")
 			b.shell.Interrupt()
 		}
@@ -95,36 +129,33 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 
 	// Tear down the environment (and fire pre-exit hook) before we exit
 	defer func() {
-		if err = b.tearDown(ctx); err != nil {
+		// Let the pre-exit hook know why the job failed
+		if reason := b.failureReason(); reason != "" {
+			b.shell.Env.Set("BUILDKITE_FAILURE_REASON", reason)
+		}
+
+		if err = b.tearDown(teardownCtx); err != nil {
 			b.shell.Errorf("Error tearing down bootstrap: %v", err)
+			b.recordFailure(ctx, agent.FailureReasonHook, err)
 
 			// this gets passed back via the named return
 			exitCode = shell.GetExitCode(err)
 		}
+
+		b.writeFailure()
 	}()
 
 	// Initialize the environment, a failure here will still call the tearDown
 	if err = b.setUp(ctx); err != nil {
 		b.shell.Errorf("Error setting up bootstrap: %v", err)
+		b.recordFailure(ctx, agent.FailureReasonHook, err)
 		return shell.GetExitCode(err)
 	}
 
-	var includePhase = func(phase string) bool {
-		if len(b.Phases) == 0 {
-			return true
-		}
-		for _, include := range b.Phases {
-			if include == phase {
-				return true
-			}
-		}
-		return false
-	}
-
 	//  Execute the bootstrap phases in order
 	var phaseErr error
 
-	if includePhase(`plugin`) {
+	if b.includePhase(`plugin`) {
 		phaseErr = b.preparePlugins()
 
 		if phaseErr == nil {
@@ -132,7 +163,7 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		}
 	}
 
-	if phaseErr == nil && includePhase(`checkout`) {
+	if phaseErr == nil && b.includePhase(`checkout`) {
 		phaseErr = b.CheckoutPhase(ctx)
 	} else {
 		checkoutDir, exists := b.shell.Env.Get(`BUILDKITE_BUILD_CHECKOUT_PATH`)
@@ -141,11 +172,17 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		}
 	}
 
-	if phaseErr == nil && includePhase(`plugin`) {
+	// There's nothing to build, and the job doesn't want to fail because of it
+	if phaseErr == errJobSkipped {
+		b.shell.Commentf("Skipping the rest of the job, since what it was to build no longer exists and BUILDKITE_GIT_SKIP_MISSING_REFS is set")
+		return 0
+	}
+
+	if phaseErr == nil && b.includePhase(`plugin`) {
 		phaseErr = b.VendoredPluginPhase(ctx)
 	}
 
-	if phaseErr == nil && includePhase(`command`) {
+	if phaseErr == nil && b.includePhase(`command`) {
 		var commandErr error
 		phaseErr, commandErr = b.CommandPhase(ctx)
 		/*
@@ -173,7 +210,10 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 		}
 
 		// Only upload artifacts as part of the command phase
-		if err = b.artifactPhase(ctx); err != nil {
+		artifactCtx, cancel := b.artifactContext(ctx, teardownCtx)
+		defer cancel()
+
+		if err = b.artifactPhase(artifactCtx); err != nil {
 			b.shell.Errorf("%v", err)
 
 			if commandErr != nil {
@@ -183,6 +223,7 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 				// error reporting below.
 			} else {
 				// Only upload has errored, report its error.
+				b.recordFailure(ctx, agent.FailureReasonArtifactUpload, err)
 				return shell.GetExitCode(err)
 			}
 		}
@@ -192,6 +233,7 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 	// this won't include command failures, as we view that as more in the user space
 	if phaseErr != nil {
 		err = phaseErr
+		b.recordFailure(ctx, agent.FailureReasonHook, phaseErr)
 		b.shell.Errorf("%v", phaseErr)
 		return shell.GetExitCode(phaseErr)
 	}
@@ -203,6 +245,27 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 	return exitStatusCode
 }
 
+// artifactContext returns the context to upload artifacts with. Artifacts a
+// canceled or timed out job has already produced are still uploaded, within
+// the cancel artifact grace period if there is one.
+func (b *Bootstrap) artifactContext(ctx, teardownCtx context.Context) (context.Context, context.CancelFunc) {
+	switch reason := b.failureReason(); {
+	case ctx.Err() != nil, reason == agent.FailureReasonCancelled, reason == agent.FailureReasonTimeout:
+	default:
+		return context.WithCancel(ctx)
+	}
+
+	gracePeriod := time.Duration(b.Config.CancelArtifactGracePeriod) * time.Second
+	if gracePeriod <= 0 {
+		return context.WithCancel(teardownCtx)
+	}
+
+	if b.AutomaticArtifactUploadPaths != "" {
+		b.shell.Commentf("Uploading the job's artifacts within a %v grace period", gracePeriod)
+	}
+	return context.WithTimeout(teardownCtx, gracePeriod)
+}
+
 // Cancel interrupts any running shell processes and causes the bootstrap to stop
 func (b *Bootstrap) Cancel() error {
 	b.cancelCh <- struct{}{}
@@ -216,6 +279,10 @@ type HookConfig struct {
 	Env            env.Environment
 	SpanAttributes map[string]string
 	PluginName     string
+
+	// Keeps a plugin hook's working directory and environment changes apart
+	// from the rest of the job, when it's set
+	Isolation *pluginIsolation
 }
 
 func (b *Bootstrap) tracingImplementationSpecificHookScope(scope string) string {
@@ -260,17 +327,46 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 		if b.Debug {
 			b.shell.Commentf("Skipping %s hook, no script at \"%s\"", hookName, hookCfg.Path)
 		}
+		b.recordSkippedHook(hookCfg.Scope, hookCfg.Name, hookCfg.PluginName, hookCfg.Path, hookStatusMissing)
 		return nil
 	}
 
 	b.shell.Headerf("Running %s hook", hookName)
 
+	startedAt := time.Now()
+	var runErr error
+	var changes hook.HookScriptChanges
+	defer func() { b.recordHookRun(hookCfg, startedAt, runErr, changes.Diff) }()
+
 	redactors := b.setupRedactors()
 	defer redactors.Flush()
 
 	// We need a script to wrap the hook script so that we can snaffle the changed
 	// environment variables
-	script, err := hook.NewScriptWrapper(hook.WithHookPath(hookCfg.Path))
+	// Capture the hook's environment changes with this binary's `env dump`
+	// command, which handles values the shell builtins can't
+	shimPath, err := os.Executable()
+	if err != nil {
+		b.shell.Warningf("Couldn't find the path to buildkite-agent, multiline environment variables set by hooks may be corrupted: %v", err)
+		shimPath = ""
+	}
+
+	// Hooks that run on the other side of the WSL boundary need their paths
+	// translated. This binary can't be used to capture their environment,
+	// since WSL only shares the variables it's told about with it.
+	hookOS := runtime.GOOS
+	var toHookPath, fromHookPath func(string) string
+	if wsl, ok := b.wslHookFor(hookCfg.Path); ok {
+		hookOS, toHookPath, fromHookPath = wsl.os, wsl.toHook, wsl.fromHook
+		shimPath = ""
+	}
+
+	script, err := hook.NewScriptWrapper(
+		hook.WithHookPath(hookCfg.Path),
+		hook.WithShimPath(shimPath),
+		hook.WithOS(hookOS),
+		hook.WithPathTranslation(toHookPath, fromHookPath),
+	)
 	if err != nil {
 		b.shell.Errorf("Error creating hook script: %v", err)
 		return err
@@ -295,8 +391,26 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 		b.shell.Promptf("%s", process.FormatCommand(cleanHookPath, []string{}))
 	}
 
+	// Let the hook know how long the job has left before it times out
+	if deadline := b.Config.JobDeadline; !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining < 0 {
+			remaining = 0
+		}
+		b.shell.Env.Set("BUILDKITE_JOB_SECONDS_REMAINING", strconv.Itoa(int(remaining.Seconds())))
+	}
+
+	if hookCfg.Isolation != nil && hookCfg.Isolation.Dir != "" {
+		wd := b.shell.Getwd()
+		if err = b.shell.Chdir(hookCfg.Isolation.Dir); err != nil {
+			return err
+		}
+		defer func() { _ = b.shell.Chdir(wd) }()
+	}
+
 	// Run the wrapper script
 	if err = b.shell.RunScript(ctx, script.Path(), hookCfg.Env); err != nil {
+		runErr = err
 		exitCode := shell.GetExitCode(err)
 		b.shell.Env.Set("BUILDKITE_LAST_HOOK_EXIT_STATUS", fmt.Sprintf("%d", exitCode))
 
@@ -314,7 +428,7 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 	b.shell.Env.Set("BUILDKITE_LAST_HOOK_EXIT_STATUS", "0")
 
 	// Get changed environment
-	changes, err := script.Changes()
+	changes, err = script.Changes()
 	if err != nil {
 		// Could not compute the changes in environment or working directory
 		// for some reason...
@@ -328,6 +442,8 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 			// ...because something else happened, report it and stop the job
 			return errors.Wrapf(err, "Failed to get environment")
 		}
+	} else if hookCfg.Isolation != nil {
+		b.applyIsolatedEnvironmentChanges(changes, hookCfg.Isolation, redactors)
 	} else {
 		// Hook exited successfully (and not early!) We have an environment and
 		// wd change we can apply to our subsequent phases
@@ -404,12 +520,18 @@ func (b *Bootstrap) hasGlobalHook(name string) bool {
 
 // Returns the absolute path to a global hook, or os.ErrNotExist if none is found
 func (b *Bootstrap) globalHookPath(name string) (string, error) {
+	// Inside WSL, Windows hooks are only run if the bootstrap has a WSL
+	// distribution set
+	if runtime.GOOS != "windows" && b.WSLDistribution != "" && utils.WSLDistribution() != "" {
+		return hook.FindInWSL(b.HooksPath, name)
+	}
 	return hook.Find(b.HooksPath, name)
 }
 
 // Executes a global hook if one exists
 func (b *Bootstrap) executeGlobalHook(ctx context.Context, name string) error {
 	if !b.hasGlobalHook(name) {
+		b.recordSkippedHook("global", name, "", b.HooksPath, hookStatusMissing)
 		return nil
 	}
 	p, err := b.globalHookPath(name)
@@ -437,6 +559,7 @@ func (b *Bootstrap) hasLocalHook(name string) bool {
 // Executes a local hook
 func (b *Bootstrap) executeLocalHook(ctx context.Context, name string) error {
 	if !b.hasLocalHook(name) {
+		b.recordSkippedHook("local", name, "", filepath.Join(b.shell.Getwd(), ".buildkite", "hooks"), hookStatusMissing)
 		return nil
 	}
 
@@ -455,6 +578,7 @@ func (b *Bootstrap) executeLocalHook(ctx context.Context, name string) error {
 	}
 
 	if !localHooksEnabled {
+		b.recordSkippedHook("local", name, "", localHookPath, hookStatusDisabled)
 		return fmt.Errorf("Refusing to run %s, local hooks are disabled", localHookPath)
 	}
 
@@ -493,6 +617,35 @@ func addRepositoryHostToSSHKnownHosts(sh *shell.Shell, repository string) {
 	}
 }
 
+// trustRepositoryHost makes sure ssh will trust the repository host. In strict
+// mode that's only if the host is already known or has pinned keys, otherwise
+// ssh-keyscan adds whatever keys the host offers.
+func (b *Bootstrap) trustRepositoryHost(sh *shell.Shell, repository string) error {
+	if utils.FileExists(repository) {
+		return nil
+	}
+	if b.SSHStrictHostKeys {
+		return checkRepositoryHostIsKnown(sh, repository, b.SSHVerifyHostKeysWithDNS)
+	}
+	if b.SSHKeyscan {
+		addRepositoryHostToSSHKnownHosts(sh, repository)
+	}
+	return nil
+}
+
+// includePhase returns whether the bootstrap runs a phase
+func (b *Bootstrap) includePhase(phase string) bool {
+	if len(b.Phases) == 0 {
+		return true
+	}
+	for _, include := range b.Phases {
+		if include == phase {
+			return true
+		}
+	}
+	return false
+}
+
 // setUp is run before all the phases run. It's responsible for initializing the
 // bootstrap environment
 func (b *Bootstrap) setUp(ctx context.Context) error {
@@ -516,8 +669,20 @@ func (b *Bootstrap) setUp(ctx context.Context) error {
 		if b.BuildPath == "" {
 			return fmt.Errorf("Must set either a BUILDKITE_BUILD_PATH or a BUILDKITE_BUILD_CHECKOUT_PATH")
 		}
-		b.shell.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH",
-			filepath.Join(b.BuildPath, dirForAgentName(b.AgentName), b.OrganizationSlug, b.PipelineSlug))
+		stepKey, _ := b.shell.Env.Get("BUILDKITE_STEP_KEY")
+		var checkoutPath string
+		checkoutPath, err = expandCheckoutPath(b.CheckoutPathTemplate, checkoutPathValues{
+			Agent:    b.AgentName,
+			Org:      b.OrganizationSlug,
+			Pipeline: b.PipelineSlug,
+			Branch:   b.Branch,
+			StepKey:  stepKey,
+			Queue:    b.Queue,
+		})
+		if err != nil {
+			return err
+		}
+		b.shell.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH", filepath.Join(b.BuildPath, checkoutPath))
 	}
 
 	// The job runner sets BUILDKITE_IGNORED_ENV with any keys that were ignored
@@ -535,6 +700,11 @@ func (b *Bootstrap) setUp(ctx context.Context) error {
 		b.shell.Printf("^^^ +++")
 	}
 
+	// Experiments can be enabled per job, so show which ones this job has
+	if enabled := experiments.Enabled(); len(enabled) > 0 {
+		b.shell.Commentf("Experiments enabled 🧪: %s", strings.Join(enabled, ", "))
+	}
+
 	if b.Debug {
 		b.shell.Headerf("Buildkite environment variables")
 		for _, e := range b.shell.Env.ToSlice() {
@@ -549,6 +719,11 @@ func (b *Bootstrap) setUp(ctx context.Context) error {
 	// Disable any interactive Git/SSH prompting
 	b.shell.Env.Set("GIT_TERMINAL_PROMPT", "0")
 
+	// Get the keychain ready before any hooks run, so they can sign things
+	if err = b.setUpMacOSSigning(); err != nil {
+		return err
+	}
+
 	// It's important to do this before checking out plugins, in case you want
 	// to use the global environment hook to whitelist the plugins that are
 	// allowed to be used.
@@ -562,6 +737,12 @@ func (b *Bootstrap) tearDown(ctx context.Context) error {
 	var err error
 	defer func() { span.FinishWithError(err) }()
 
+	// This always happens last, even if the hooks fail
+	defer b.tearDownMacOSSigning()
+
+	// Report on every hook, including the pre-exit hooks
+	defer b.reportHooks()
+
 	if err = b.executeGlobalHook(ctx, "pre-exit"); err != nil {
 		return err
 	}
@@ -631,11 +812,10 @@ func (b *Bootstrap) preparePlugins() error {
 	return nil
 }
 
-func (b *Bootstrap) validatePluginCheckout(checkout *pluginCheckout) error {
-	if !b.Config.PluginValidation {
-		return nil
-	}
-
+// validatePluginCheckout checks a plugin's configuration against the schema in
+// its definition before any of its hooks run. Without plugin validation the
+// problems are only warnings, and the plugin's requirements aren't checked.
+func (b *Bootstrap) validatePluginCheckout(ctx context.Context, checkout *pluginCheckout) error {
 	if checkout.Definition == nil {
 		if b.Debug {
 			b.shell.Commentf("Parsing plugin definition for %s from %s", checkout.Plugin.Name(), checkout.CheckoutDir)
@@ -646,20 +826,40 @@ func (b *Bootstrap) validatePluginCheckout(checkout *pluginCheckout) error {
 		checkout.Definition, err = plugin.LoadDefinitionFromDir(checkout.CheckoutDir)
 
 		if err == plugin.ErrDefinitionNotFound {
-			b.shell.Warningf("Failed to find plugin definition for plugin %s", checkout.Plugin.Name())
+			if b.Config.PluginValidation {
+				b.shell.Warningf("Failed to find plugin definition for plugin %s", checkout.Plugin.Name())
+			}
 			return nil
 		} else if err != nil {
+			if !b.Config.PluginValidation {
+				b.shell.Warningf("Failed to parse plugin definition for plugin %s: %v", checkout.Plugin.Name(), err)
+				return nil
+			}
 			return err
 		}
 	}
 
 	val := &plugin.Validator{}
+
+	if !b.Config.PluginValidation {
+		result := val.ValidateConfiguration(checkout.Definition, checkout.Plugin.Configuration)
+		if !result.Valid() {
+			b.shell.Warningf("The configuration for plugin %q doesn't match its schema, so the plugin may fail:\n%s",
+				checkout.Plugin.Name(), strings.Join(result.Errors, "\n"))
+		}
+		return nil
+	}
+
 	result := val.Validate(checkout.Definition, checkout.Plugin.Configuration)
 
 	if !result.Valid() {
 		b.shell.Headerf("Plugin validation failed for %q", checkout.Plugin.Name())
+		for _, e := range result.Errors {
+			b.shell.Errorf("%s", e)
+		}
 		json, _ := json.Marshal(checkout.Plugin.Configuration)
 		b.shell.Commentf("Plugin configuration JSON is %s", json)
+		b.recordFailure(ctx, agent.FailureReasonPluginInvalid, result)
 		return result
 	}
 
@@ -677,9 +877,7 @@ func (b *Bootstrap) PluginPhase(ctx context.Context) error {
 		return nil
 	}
 
-	checkouts := []*pluginCheckout{}
-
-	// Checkout and validate plugins that aren't vendored
+	plugins := []*plugin.Plugin{}
 	for _, p := range b.plugins {
 		if p.Vendored {
 			if b.Debug {
@@ -687,18 +885,21 @@ func (b *Bootstrap) PluginPhase(ctx context.Context) error {
 			}
 			continue
 		}
+		plugins = append(plugins, p)
+	}
 
-		checkout, err := b.checkoutPlugin(p)
-		if err != nil {
-			return errors.Wrapf(err, "Failed to checkout plugin %s", p.Name())
-		}
+	// Checkout plugins that aren't vendored all at once
+	checkouts, err := b.fetchPlugins(plugins)
+	if err != nil {
+		b.recordFailure(ctx, agent.FailureReasonPluginFetch, err)
+		return err
+	}
 
-		err = b.validatePluginCheckout(checkout)
-		if err != nil {
+	// Validate them in the order they'll run in
+	for _, checkout := range checkouts {
+		if err := b.validatePluginCheckout(ctx, checkout); err != nil {
 			return err
 		}
-
-		checkouts = append(checkouts, checkout)
 	}
 
 	// Store the checkouts for future use
@@ -723,30 +924,12 @@ func (b *Bootstrap) VendoredPluginPhase(ctx context.Context) error {
 			continue
 		}
 
-		checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
-
-		pluginLocation, err := filepath.Abs(filepath.Join(checkoutPath, p.Location))
+		checkout, err := b.vendoredPluginCheckout(p)
 		if err != nil {
-			return errors.Wrapf(err, "Failed to resolve vendored plugin path for plugin %s", p.Name())
-		}
-
-		if !utils.FileExists(pluginLocation) {
-			return fmt.Errorf("Vendored plugin path %s doesn't exist", p.Location)
-		}
-
-		checkout := &pluginCheckout{
-			Plugin:      p,
-			CheckoutDir: pluginLocation,
-			HooksDir:    filepath.Join(pluginLocation, "hooks"),
-		}
-
-		// Also make sure that plugin is within this repository
-		// checkout and isn't elsewhere on the system.
-		if !strings.HasPrefix(pluginLocation, checkoutPath+string(os.PathSeparator)) {
-			return fmt.Errorf("Vendored plugin paths must be within the checked-out repository")
+			return err
 		}
 
-		err = b.validatePluginCheckout(checkout)
+		err = b.validatePluginCheckout(ctx, checkout)
 		if err != nil {
 			return err
 		}
@@ -754,11 +937,87 @@ func (b *Bootstrap) VendoredPluginPhase(ctx context.Context) error {
 		vendoredCheckouts = append(vendoredCheckouts, checkout)
 	}
 
-	// Finally append our vendored checkouts to the rest for subsequent hooks
-	b.pluginCheckouts = append(b.pluginCheckouts, vendoredCheckouts...)
+	// Finally add our vendored checkouts to the rest for subsequent hooks,
+	// which run in the order the plugins were declared in
+	b.pluginCheckouts = b.sortPluginCheckouts(append(b.pluginCheckouts, vendoredCheckouts...))
 
 	// Now we can run plugin environment hooks too
-	return b.executePluginHook(ctx, "environment", vendoredCheckouts)
+	if err := b.executePluginHook(ctx, "environment", vendoredCheckouts); err != nil {
+		return err
+	}
+
+	// The checkout has already happened, so vendored plugins' post-checkout
+	// hooks run now rather than with everything else's
+	if !b.includePhase("checkout") {
+		return nil
+	}
+	return b.executePluginHook(ctx, "post-checkout", vendoredCheckouts)
+}
+
+// vendoredPluginCheckout finds a vendored plugin in the checkout. Vendored
+// plugins have to be within the checkout, even once symlinks are followed.
+func (b *Bootstrap) vendoredPluginCheckout(p *plugin.Plugin) (*pluginCheckout, error) {
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+
+	pluginLocation, err := filepath.Abs(filepath.Join(checkoutPath, p.Location))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to resolve vendored plugin path for plugin %s", p.Name())
+	}
+
+	if !utils.FileExists(pluginLocation) {
+		return nil, fmt.Errorf("Vendored plugin path %s doesn't exist", p.Location)
+	}
+
+	realCheckoutPath, err := filepath.EvalSymlinks(checkoutPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to resolve checkout path for vendored plugin %s", p.Name())
+	}
+	realPluginLocation, err := filepath.EvalSymlinks(pluginLocation)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to resolve vendored plugin path for plugin %s", p.Name())
+	}
+
+	// Also make sure that plugin is within this repository
+	// checkout and isn't elsewhere on the system.
+	if !strings.HasPrefix(realPluginLocation, realCheckoutPath+string(os.PathSeparator)) {
+		return nil, fmt.Errorf("Vendored plugin paths must be within the checked-out repository")
+	}
+
+	if p.Version != "" {
+		b.shell.Warningf("Ignoring the version %q of vendored plugin %s, which is used as it is in the checkout", p.Version, p.Location)
+	}
+
+	checkout := &pluginCheckout{
+		Plugin:      p,
+		CheckoutDir: pluginLocation,
+		HooksDir:    filepath.Join(pluginLocation, "hooks"),
+	}
+
+	// These hooks would need to run before the plugin was checked out
+	for _, name := range []string{"pre-checkout", "checkout"} {
+		if _, err := hook.Find(checkout.HooksDir, name); err == nil {
+			b.shell.Warningf("The %s hook of vendored plugin %s won't run, since the plugin isn't available until after the checkout", name, p.Location)
+		}
+	}
+
+	return checkout, nil
+}
+
+// sortPluginCheckouts puts plugin checkouts in the order their plugins were
+// declared in
+func (b *Bootstrap) sortPluginCheckouts(checkouts []*pluginCheckout) []*pluginCheckout {
+	byPlugin := map[*plugin.Plugin]*pluginCheckout{}
+	for _, c := range checkouts {
+		byPlugin[c.Plugin] = c
+	}
+
+	sorted := make([]*pluginCheckout, 0, len(checkouts))
+	for _, p := range b.plugins {
+		if c, ok := byPlugin[p]; ok {
+			sorted = append(sorted, c)
+		}
+	}
+	return sorted
 }
 
 // Executes a named hook on plugins that have it
@@ -766,17 +1025,27 @@ func (b *Bootstrap) executePluginHook(ctx context.Context, name string, checkout
 	for _, p := range checkouts {
 		hookPath, err := hook.Find(p.HooksDir, name)
 		if errors.Is(err, os.ErrNotExist) {
+			b.recordSkippedHook("plugin", name, p.Plugin.Name(), p.HooksDir, hookStatusMissing)
 			continue // this plugin does not implement this hook
 		} else if err != nil {
 			return err
 		}
 
 		env, _ := p.ConfigurationToEnvironment()
+
+		var isolation *pluginIsolation
+		if b.IsolatePlugins {
+			if isolation, err = b.isolatePluginHook(p, name, env); err != nil {
+				return err
+			}
+		}
+
 		err = b.executeHook(ctx, HookConfig{
 			Scope:      "plugin",
 			Name:       name,
 			Path:       hookPath,
 			Env:        env,
+			Isolation:  isolation,
 			PluginName: p.Plugin.Name(),
 			SpanAttributes: map[string]string{
 				"plugin.name":        p.Plugin.Name(),
@@ -804,7 +1073,7 @@ func (b *Bootstrap) hasPluginHook(name string) bool {
 }
 
 // Checkout a given plugin to the plugins directory and return that directory
-func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
+func (b *Bootstrap) checkoutPlugin(sh *shell.Shell, p *plugin.Plugin) (*pluginCheckout, error) {
 	// Make sure we have a plugin path before trying to do anything
 	if b.PluginsPath == "" {
 		return nil, fmt.Errorf("Can't checkout plugin without a `plugins-path`")
@@ -835,7 +1104,7 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 	// Try and lock this particular plugin while we check it out (we create
 	// the file outside of the plugin directory so git clone doesn't have
 	// a cry about the directory not being empty)
-	pluginCheckoutHook, err := b.shell.LockFile(filepath.Join(b.PluginsPath, id+".lock"), time.Minute*5)
+	pluginCheckoutHook, err := sh.LockFile(filepath.Join(b.PluginsPath, id+".lock"), time.Minute*5)
 	if err != nil {
 		return nil, err
 	}
@@ -855,10 +1124,10 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 	// tradeoff is favourable for just blowing away an existing clone if we want least-hassle
 	// guarantee that the user will get the latest version of their plugin branch/tag/whatever.
 	if b.Config.PluginsAlwaysCloneFresh && utils.FileExists(pluginDirectory) {
-		b.shell.Commentf("BUILDKITE_PLUGINS_ALWAYS_CLONE_FRESH is true; removing previous checkout of plugin %s", p.Label())
+		sh.Commentf("BUILDKITE_PLUGINS_ALWAYS_CLONE_FRESH is true; removing previous checkout of plugin %s", p.Label())
 		err = os.RemoveAll(pluginDirectory)
 		if err != nil {
-			b.shell.Errorf("Oh no, something went wrong removing %s", pluginDirectory)
+			sh.Errorf("Oh no, something went wrong removing %s", pluginDirectory)
 			return nil, err
 		}
 	}
@@ -866,25 +1135,30 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 	if utils.FileExists(pluginGitDirectory) {
 		// It'd be nice to show the current commit of the plugin, so
 		// let's figure that out.
-		headCommit, err := gitRevParseInWorkingDirectory(b.shell, pluginDirectory, "--short=7", "HEAD")
+		headCommit, err := gitRevParseInWorkingDirectory(sh, pluginDirectory, "--short=7", "HEAD")
 		if err != nil {
-			b.shell.Commentf("Plugin %q already checked out (can't `git rev-parse HEAD` plugin git directory)", p.Label())
+			sh.Commentf("Plugin %q already checked out (can't `git rev-parse HEAD` plugin git directory)", p.Label())
 		} else {
-			b.shell.Commentf("Plugin %q already checked out (%s)", p.Label(), strings.TrimSpace(headCommit))
+			sh.Commentf("Plugin %q already checked out (%s)", p.Label(), strings.TrimSpace(headCommit))
 		}
 
 		return checkout, nil
 	}
 
-	b.shell.Commentf("Plugin \"%s\" will be checked out to \"%s\"", p.Location, pluginDirectory)
+	sh.Commentf("Plugin \"%s\" will be checked out to \"%s\"", p.Location, pluginDirectory)
 
 	repo, err := p.Repository()
 	if err != nil {
 		return nil, err
 	}
 
-	if b.SSHKeyscan {
-		addRepositoryHostToSSHKnownHosts(b.shell, repo)
+	if err := b.trustRepositoryHost(sh, repo); err != nil {
+		return nil, err
+	}
+
+	proxyArgs, err := b.gitProxyArgs(sh, repo)
+	if err != nil {
+		return nil, err
 	}
 
 	// Make the directory
@@ -894,20 +1168,22 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 	}
 
 	// Switch to the plugin directory
-	b.shell.Commentf("Switching to the temporary plugin directory")
-	previousWd := b.shell.Getwd()
-	if err = b.shell.Chdir(tempDir); err != nil {
+	sh.Commentf("Switching to the temporary plugin directory")
+	previousWd := sh.Getwd()
+	if err = sh.Chdir(tempDir); err != nil {
 		return nil, err
 	}
 	// Switch back to the previous working directory
-	defer b.shell.Chdir(previousWd)
-
-	// Plugin clones shouldn't use custom GitCloneFlags
-	err = roko.NewRetrier(
-		roko.WithMaxAttempts(3),
-		roko.WithStrategy(roko.Constant(2*time.Second)),
-	).Do(func(r *roko.Retrier) error {
-		return b.shell.Run("git", "clone", "-v", "--", repo, ".")
+	defer sh.Chdir(previousWd)
+
+	// Plugin clones shouldn't use custom GitCloneFlags. Many agents can be
+	// cloning the same plugin at once, so back off with jitter.
+	err = retry.NewRetrier(
+		retry.WithMaxAttempts(3),
+		retry.WithStrategy(retry.Exponential(2*time.Second, 10*time.Second)),
+		retry.WithJitter(),
+	).Do(func(r *retry.Retrier) error {
+		return sh.Run("git", gitIPFamilyArgs(b.IPFamily, append(proxyArgs, "clone", "-v", "--", repo, "."))...)
 	})
 	if err != nil {
 		return nil, err
@@ -915,13 +1191,13 @@ func (b *Bootstrap) checkoutPlugin(p *plugin.Plugin) (*pluginCheckout, error) {
 
 	// Switch to the version if we need to
 	if p.Version != "" {
-		b.shell.Commentf("Checking out `%s`", p.Version)
-		if err = b.shell.Run("git", "checkout", "-f", p.Version); err != nil {
+		sh.Commentf("Checking out `%s`", p.Version)
+		if err = sh.Run("git", "checkout", "-f", p.Version); err != nil {
 			return nil, err
 		}
 	}
 
-	b.shell.Commentf("Moving temporary plugin directory to final location")
+	sh.Commentf("Moving temporary plugin directory to final location")
 	err = os.Rename(tempDir, pluginDirectory)
 	if err != nil {
 		return nil, err
@@ -1029,11 +1305,23 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 		}
 	default:
 		if b.Config.Repository != "" {
-			err = roko.NewRetrier(
-				roko.WithMaxAttempts(3),
-				roko.WithStrategy(roko.Constant(2*time.Second)),
-			).Do(func(r *roko.Retrier) error {
-				err := b.defaultCheckoutPhase(ctx)
+			// Git, unless another checkout has been asked for
+			var checkoutType string
+			var checkout Checkout
+			if checkoutType, checkout, err = findCheckout(b.Config.CheckoutType, b.Repository); err != nil {
+				return err
+			}
+
+			err = retry.NewRetrier(
+				retry.WithMaxAttempts(3),
+				retry.WithStrategy(retry.Constant(2*time.Second)),
+			).DoWithContext(ctx, func(ctx context.Context, r *retry.Retrier) error {
+				var err error
+				if checkout != nil {
+					err = b.customCheckoutPhase(ctx, checkoutType, checkout)
+				} else {
+					err = b.defaultCheckoutPhase(ctx)
+				}
 				if err == nil {
 					return nil
 				}
@@ -1047,6 +1335,10 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 					b.shell.Warningf("Checkout was cancelled")
 					r.Break()
 
+				case isFinalGitFailure(err):
+					b.shell.Warningf("Checkout failed! %s", err)
+					r.Break()
+
 				default:
 					b.shell.Warningf("Checkout failed! %s (%s)", err, r)
 
@@ -1083,6 +1375,15 @@ func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
 				return err
 			})
 			if err != nil {
+				if isMissingRef(err) {
+					if b.GitSkipMissingRefs {
+						b.shell.Warningf("%v", err)
+						return errJobSkipped
+					}
+					b.recordFailure(ctx, agent.FailureReasonRefMissing, err)
+					return err
+				}
+				b.recordFailure(ctx, agent.FailureReasonCheckout, err)
 				return err
 			}
 		} else {
@@ -1142,7 +1443,7 @@ func hasGitCommit(sh *shell.Shell, gitDir string, commit string) bool {
 	return true
 }
 
-func (b *Bootstrap) updateGitMirror() (string, error) {
+func (b *Bootstrap) updateGitMirror(git shellRunner) (string, error) {
 	// Create a unique directory for the repository mirror
 	mirrorDir := filepath.Join(b.Config.GitMirrorsPath, dirForRepository(b.Repository))
 
@@ -1174,7 +1475,7 @@ func (b *Bootstrap) updateGitMirror() (string, error) {
 	if !utils.FileExists(mirrorDir) {
 		b.shell.Commentf("Cloning a mirror of the repository to %q", mirrorDir)
 		flags := "--mirror " + b.GitCloneMirrorFlags
-		if err := gitClone(b.shell, flags, b.Repository, mirrorDir); err != nil {
+		if err := gitClone(git, flags, b.Repository, mirrorDir); err != nil {
 			b.shell.Commentf("Removing mirror dir %q due to failed clone", mirrorDir)
 			if err := os.RemoveAll(mirrorDir); err != nil {
 				b.shell.Errorf("Failed to remove \"%s\" (%s)", mirrorDir, err)
@@ -1222,12 +1523,12 @@ func (b *Bootstrap) updateGitMirror() (string, error) {
 		b.shell.Commentf("Fetch and mirror pull request head from GitHub")
 		refspec := fmt.Sprintf("refs/pull/%s/head", b.PullRequest)
 		// Fetch the PR head from the upstream repository into the mirror.
-		if err := b.shell.Run("git", "--git-dir", mirrorDir, "fetch", "origin", refspec); err != nil {
+		if err := git.Run("git", "--git-dir", mirrorDir, "fetch", "origin", refspec); err != nil {
 			return "", err
 		}
 	} else {
 		// Fetch the build branch from the upstream repository into the mirror.
-		if err := b.shell.Run("git", "--git-dir", mirrorDir, "fetch", "origin", b.Branch); err != nil {
+		if err := git.Run("git", "--git-dir", mirrorDir, "fetch", "origin", b.Branch); err != nil {
 			return "", err
 		}
 	}
@@ -1247,8 +1548,41 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 	var err error
 	defer func() { span.FinishWithError(err) }()
 
-	if b.SSHKeyscan {
-		addRepositoryHostToSSHKnownHosts(b.shell, b.Repository)
+	// Commands that talk to the remote are retried when they fail for
+	// transient reasons, like timeouts and dropped connections
+	git := newGitNetworkRunner(ctx, b.shell)
+	git.ipFamily = b.IPFamily
+	defer func() {
+		span.AddAttributes(git.Attributes())
+		if summary := git.Summary(); summary != "" {
+			b.shell.Commentf("%s", summary)
+		}
+	}()
+
+	// Connect to the repository host the way the agent's been told to,
+	// which may mean checking out over HTTPS instead of SSH
+	removeGitTransport, err := b.configureGitTransport()
+	if err != nil {
+		return err
+	}
+	defer removeGitTransport()
+
+	// Hosts with their own known_hosts file don't get keys added to the
+	// usual one
+	if !b.hasOwnKnownHosts() {
+		if err := b.trustRepositoryHost(b.shell, b.Repository); err != nil {
+			return err
+		}
+	}
+
+	// Use any GitLab or Bitbucket tokens the job has for HTTPS checkouts,
+	// but only while checking out
+	removeGitCredentials := b.configureGitCredentials()
+	defer removeGitCredentials()
+
+	// Don't bother with a checkout that can't work
+	if err := b.checkRemoteRef(); err != nil {
+		return err
 	}
 
 	var mirrorDir string
@@ -1270,7 +1604,7 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 				mirrorDir = ""
 			}
 		} else {
-			mirrorDir, err = b.updateGitMirror()
+			mirrorDir, err = b.updateGitMirror(git)
 			if err != nil {
 				return err
 			}
@@ -1297,7 +1631,7 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 			return err
 		}
 	} else {
-		if err := gitClone(b.shell, gitCloneFlags, b.Repository, "."); err != nil {
+		if err := gitClone(git, gitCloneFlags, b.Repository, "."); err != nil {
 			return err
 		}
 	}
@@ -1320,7 +1654,7 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 	// For example, `refs/not/a/head`
 	if b.RefSpec != "" {
 		b.shell.Commentf("Fetch and checkout custom refspec")
-		if err := gitFetch(b.shell, gitFetchFlags, "origin", b.RefSpec); err != nil {
+		if err := gitFetch(git, gitFetchFlags, "origin", b.RefSpec); err != nil {
 			return err
 		}
 
@@ -1332,7 +1666,7 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		b.shell.Commentf("Fetch and checkout pull request head from GitHub")
 		refspec := fmt.Sprintf("refs/pull/%s/head", b.PullRequest)
 
-		if err := gitFetch(b.shell, gitFetchFlags, "origin", refspec); err != nil {
+		if err := gitFetch(git, gitFetchFlags, "origin", refspec); err != nil {
 			return err
 		}
 
@@ -1343,7 +1677,7 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		// need to fetch the remote head and checkout the fetched head explicitly.
 	} else if b.Commit == "HEAD" {
 		b.shell.Commentf("Fetch and checkout remote branch HEAD commit")
-		if err := gitFetch(b.shell, gitFetchFlags, "origin", b.Branch); err != nil {
+		if err := gitFetch(git, gitFetchFlags, "origin", b.Branch); err != nil {
 			return err
 		}
 
@@ -1351,18 +1685,22 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		// support fetching a specific commit so we fall back to fetching all heads
 		// and tags, hoping that the commit is included.
 	} else {
-		if err := gitFetch(b.shell, gitFetchFlags, "origin", b.Commit); err != nil {
+		if err := gitFetch(git, gitFetchFlags, "origin", b.Commit); err != nil {
 			// By default `git fetch origin` will only fetch tags which are
 			// reachable from a fetches branch. git 1.9.0+ changed `--tags` to
 			// fetch all tags in addition to the default refspec, but pre 1.9.0 it
 			// excludes the default refspec.
 			gitFetchRefspec, _ := b.shell.RunAndCapture("git", "config", "remote.origin.fetch")
-			if err := gitFetch(b.shell, gitFetchFlags, "origin", gitFetchRefspec, "+refs/tags/*:refs/tags/*"); err != nil {
+			if err := gitFetch(git, gitFetchFlags, "origin", gitFetchRefspec, "+refs/tags/*:refs/tags/*"); err != nil {
 				return err
 			}
 		}
 	}
 
+	if err := b.checkFetchedCommit(); err != nil {
+		return err
+	}
+
 	if b.Commit == "HEAD" {
 		if err := gitCheckout(b.shell, "-f", "FETCH_HEAD"); err != nil {
 			return err
@@ -1398,14 +1736,15 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 			b.shell.Warningf("Failed to enumerate git submodules: %v", err)
 		} else {
 			for _, repository := range submoduleRepos {
-				// submodules might need their fingerprints verified too
-				if b.SSHKeyscan {
-					addRepositoryHostToSSHKnownHosts(b.shell, repository)
+				// submodules might need their fingerprints verified too, but
+				// an unknown submodule host is left for ssh to refuse
+				if err := b.trustRepositoryHost(b.shell, repository); err != nil {
+					b.shell.Warningf("%v", err)
 				}
 			}
 		}
 
-		if err := b.shell.Run("git", "submodule", "update", "--init", "--recursive", "--force"); err != nil {
+		if err := git.Run("git", "submodule", "update", "--init", "--recursive", "--force"); err != nil {
 			return err
 		}
 
@@ -1538,18 +1877,42 @@ func (b *Bootstrap) CommandPhase(ctx context.Context) (error, error) {
 	span, ctx := tracetools.StartSpanFromContext(ctx, "command", b.Config.TracingBackend)
 	var err error
 	defer func() { span.FinishWithError(err) }()
+
+	// Fail before running anything if this agent can't run the step
+	if err := b.checkRequiredCapabilities(); err != nil {
+		b.recordFailure(ctx, agent.FailureReasonCapabilityMissing, err)
+		return err, nil
+	}
+
 	// Run pre-command hooks
 	if err := b.runPreCommandHooks(ctx); err != nil {
 		return err, nil
 	}
 
+	// Make sure the command has the environment it needs before running it
+	if err := b.validateEnvSchema(); err != nil {
+		b.recordFailure(ctx, agent.FailureReasonEnvInvalid, err)
+		return err, nil
+	}
+
 	// Run the actual command
+	oomWatch := agent.WatchOOMKills()
+	defer oomWatch.Close()
 	commandExitError := b.runCommand(ctx)
 	var realCommandError error
 
+	// Say whether the out-of-memory killer killed the command, rather than
+	// leave it to be worked out from an exit status of 137
+	if wasKilled(commandExitError) {
+		failure := agent.KilledFailure("command", exitedPID(commandExitError), oomWatch)
+		b.shell.Errorf("%s", failure.Message)
+		b.recordFailure(ctx, failure.Reason, errors.New(failure.Message))
+	}
+
 	// If the command returned an exit that wasn't a `exec.ExitError`
 	// (which is returned when the command is actually run, but fails),
 	// then we'll show it in the log.
+
 	if shell.IsExitError(commandExitError) {
 		if shell.IsExitSignaled(commandExitError) {
 			b.shell.Errorf("The command was interrupted by a signal")
@@ -1560,6 +1923,7 @@ func (b *Bootstrap) CommandPhase(ctx context.Context) (error, error) {
 	} else if commandExitError != nil {
 		b.shell.Errorf(commandExitError.Error())
 	}
+	b.recordFailure(ctx, agent.FailureReasonCommand, commandExitError)
 
 	// Expand the command header if the command fails for any reason
 	if commandExitError != nil {
@@ -1627,6 +1991,8 @@ func (b *Bootstrap) defaultCommandPhase(ctx context.Context) error {
 		return fmt.Errorf("No shell set for bootstrap")
 	}
 
+	shell = b.wslCommandShell(shell)
+
 	// Windows CMD.EXE is horrible and can't handle newline delimited commands. We write
 	// a batch script so that it works, but we don't like it
 	if strings.ToUpper(filepath.Base(shell[0])) == `CMD.EXE` {
@@ -1685,6 +2051,11 @@ func (b *Bootstrap) defaultCommandPhase(ctx context.Context) error {
 
 		b.shell.Headerf("Running script")
 		cmdToExec = fmt.Sprintf(".%c%s", os.PathSeparator, scriptPath)
+
+		// Scripts run in WSL need Linux style paths
+		if isWSLShell(shell) {
+			cmdToExec = "./" + filepath.ToSlash(scriptPath)
+		}
 	} else {
 		b.shell.Headerf("Running commands")
 		cmdToExec = b.Command
@@ -1725,6 +2096,13 @@ func (b *Bootstrap) defaultCommandPhase(ctx context.Context) error {
 
 // isPosixShell attempts to detect posix shells (e.g bash, sh, zsh )
 func isPosixShell(shell []string) bool {
+	if isWSLShell(shell) {
+		shell = wslShellCommand(shell)
+		if len(shell) == 0 {
+			return false
+		}
+	}
+
 	bin := filepath.Base(shell[0])
 
 	if filepath.Base(shell[0]) == `env` {
@@ -1964,4 +2342,7 @@ type pluginCheckout struct {
 	*plugin.Definition
 	CheckoutDir string
 	HooksDir    string
+
+	// Set up the first time one of the plugin's hooks runs isolated
+	isolation *pluginIsolation
 }
@@ -120,3 +120,11 @@ func TestStartTracing_Datadog(t *testing.T) {
 	assert.Equal(t, spanImpl.Span, opentracing.SpanFromContext(ctx))
 	stopper()
 }
+
+func TestIsPosixShellLooksInsideWSL(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, isPosixShell([]string{"wsl.exe", "--distribution", "Ubuntu", "--exec", "bash", "-e", "-c"}))
+	assert.False(t, isPosixShell([]string{"wsl.exe", "--distribution", "Ubuntu"}))
+	assert.False(t, isPosixShell([]string{"wsl.exe", "--exec", "pwsh", "-c"}))
+}
@@ -0,0 +1,122 @@
+package bootstrap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/v3/system"
+	"github.com/dustin/go-humanize"
+)
+
+// Steps list the capabilities they need the agent to have in this variable,
+// separated by commas, like "docker,gpu=2,disk=20GB,tool=terraform"
+const requiredCapabilitiesEnv = "BUILDKITE_REQUIRED_CAPABILITIES"
+
+// requiredCapability is a capability a step needs, with its value if it has
+// one, like the number of GPUs
+type requiredCapability struct {
+	name  string
+	value string
+}
+
+// parseRequiredCapabilities parses a step's comma separated capabilities,
+// checking that they're ones the agent knows how to check for
+func parseRequiredCapabilities(s string) ([]requiredCapability, error) {
+	var caps []requiredCapability
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(part, "=")
+		c := requiredCapability{name: strings.TrimSpace(name), value: strings.TrimSpace(value)}
+
+		switch c.name {
+		case "docker":
+		case "gpu":
+			if c.value != "" {
+				if n, err := strconv.Atoi(c.value); err != nil || n < 1 {
+					return nil, fmt.Errorf("The gpu capability needs a number of GPUs, not %q", c.value)
+				}
+			}
+		case "disk":
+			if _, err := humanize.ParseBytes(c.value); err != nil || c.value == "" {
+				return nil, fmt.Errorf("The disk capability needs an amount of free space, like disk=20GB, not %q", c.value)
+			}
+		case "tool":
+			if c.value == "" {
+				return nil, fmt.Errorf("The tool capability needs the command it requires, like tool=terraform")
+			}
+		default:
+			return nil, fmt.Errorf("Unknown capability %q, which can be docker, gpu, disk or tool", c.name)
+		}
+
+		caps = append(caps, c)
+	}
+
+	return caps, nil
+}
+
+// checkRequiredCapabilities makes sure the agent has what the step says it
+// needs in BUILDKITE_REQUIRED_CAPABILITIES, so that jobs on the wrong agent
+// fail before the command starts, saying what's missing
+func (b *Bootstrap) checkRequiredCapabilities() error {
+	required, _ := b.shell.Env.Get(requiredCapabilitiesEnv)
+	caps, err := parseRequiredCapabilities(required)
+	if err != nil {
+		return fmt.Errorf("The step's %s is invalid: %v", requiredCapabilitiesEnv, err)
+	}
+
+	var missing []string
+	for _, c := range caps {
+		if problem := b.missingCapability(c); problem != "" {
+			missing = append(missing, problem)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("This agent doesn't have the capabilities the step requires: %s", strings.Join(missing, "; "))
+	}
+
+	return nil
+}
+
+// missingCapability returns what's missing for the agent to have a
+// capability, or an empty string if it has it
+func (b *Bootstrap) missingCapability(c requiredCapability) string {
+	switch c.name {
+	case "docker", "tool":
+		command := c.value
+		if c.name == "docker" {
+			command = "docker"
+		}
+		if _, err := b.shell.AbsolutePath(command); err != nil {
+			return fmt.Sprintf("%q isn't in PATH", command)
+		}
+
+	case "gpu":
+		want := 1
+		if c.value != "" {
+			want, _ = strconv.Atoi(c.value)
+		}
+		count, _ := b.shell.Env.Get("BUILDKITE_AGENT_GPU_COUNT")
+		if have, _ := strconv.Atoi(count); have < want {
+			return fmt.Sprintf("%d GPU(s) are needed, but the agent has %d", want, have)
+		}
+
+	case "disk":
+		want, _ := humanize.ParseBytes(c.value)
+		free, err := system.DiskFree(b.shell.Getwd())
+		if err != nil {
+			return fmt.Sprintf("couldn't check the free disk space: %v", err)
+		}
+		if free < want {
+			return fmt.Sprintf("%s of free disk space is needed, but there's only %s", humanize.Bytes(want), humanize.Bytes(free))
+		}
+	}
+
+	return ""
+}
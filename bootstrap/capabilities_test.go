@@ -0,0 +1,64 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRequiredCapabilities(t *testing.T) {
+	t.Parallel()
+
+	caps, err := parseRequiredCapabilities("docker, gpu=2,disk=20GB,tool=terraform,")
+	require.NoError(t, err)
+	assert.Equal(t, []requiredCapability{
+		{name: "docker"},
+		{name: "gpu", value: "2"},
+		{name: "disk", value: "20GB"},
+		{name: "tool", value: "terraform"},
+	}, caps)
+
+	for s, msg := range map[string]string{
+		"gpu=lots":   `The gpu capability needs a number of GPUs, not "lots"`,
+		"disk":       `The disk capability needs an amount of free space, like disk=20GB, not ""`,
+		"tool":       "The tool capability needs the command it requires, like tool=terraform",
+		"kubernetes": `Unknown capability "kubernetes", which can be docker, gpu, disk or tool`,
+	} {
+		_, err := parseRequiredCapabilities(s)
+		assert.EqualError(t, err, msg, s)
+	}
+}
+
+func TestCheckRequiredCapabilities(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake tool is a shell script")
+	}
+
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "terraform"), []byte("#!/bin/sh\n"), 0o755))
+
+	b := &Bootstrap{shell: shell.NewTestShell(t)}
+	b.shell.Env = env.FromSlice([]string{"PATH=" + bin, "BUILDKITE_AGENT_GPU_COUNT=1"})
+
+	b.shell.Env.Set(requiredCapabilitiesEnv, "tool=terraform,gpu=1,disk=1B")
+	assert.NoError(t, b.checkRequiredCapabilities())
+
+	b.shell.Env.Set(requiredCapabilitiesEnv, "docker,gpu=2")
+	assert.EqualError(t, b.checkRequiredCapabilities(),
+		`This agent doesn't have the capabilities the step requires: "docker" isn't in PATH; 2 GPU(s) are needed, but the agent has 1`)
+
+	b.shell.Env.Set(requiredCapabilitiesEnv, "gpus")
+	assert.EqualError(t, b.checkRequiredCapabilities(),
+		`The step's BUILDKITE_REQUIRED_CAPABILITIES is invalid: Unknown capability "gpus", which can be docker, gpu, disk or tool`)
+
+	b.shell.Env.Remove(requiredCapabilitiesEnv)
+	assert.NoError(t, b.checkRequiredCapabilities())
+}
@@ -0,0 +1,128 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/tracetools"
+)
+
+// Checkout gets a job's source into the checkout directory. Git is built in,
+// and other source control systems can be added with RegisterCheckout, so
+// they get the same retries, tracing and hooks as a git checkout rather than
+// replacing the whole checkout hook.
+type Checkout interface {
+	// Checkout is run in the checkout directory, which exists but may hold a
+	// previous checkout. An error is retried after the directory has been
+	// removed and created again.
+	Checkout(ctx context.Context, sh *shell.Shell, conf Config) error
+}
+
+// CheckoutFunc adapts a function to the Checkout interface
+type CheckoutFunc func(ctx context.Context, sh *shell.Shell, conf Config) error
+
+func (f CheckoutFunc) Checkout(ctx context.Context, sh *shell.Shell, conf Config) error {
+	return f(ctx, sh, conf)
+}
+
+// The name of the built-in checkout
+const gitCheckoutType = "git"
+
+var (
+	checkoutsMu sync.RWMutex
+	checkouts   = map[string]Checkout{}
+
+	// Which checkout to use for repositories with a URL scheme
+	checkoutSchemes = map[string]string{}
+)
+
+// RegisterCheckout adds a checkout that can be chosen with
+// BUILDKITE_CHECKOUT_TYPE, or by the URL scheme of the repository (for
+// example "p4" for "p4://perforce:1666/depot/project"). It's meant to be
+// called from init functions in programs that embed the agent.
+func RegisterCheckout(name string, c Checkout, schemes ...string) {
+	checkoutsMu.Lock()
+	defer checkoutsMu.Unlock()
+
+	if name == gitCheckoutType {
+		panic("bootstrap: can't replace the git checkout")
+	}
+	if _, exists := checkouts[name]; exists {
+		panic(fmt.Sprintf("bootstrap: checkout %q is already registered", name))
+	}
+
+	checkouts[name] = c
+	for _, scheme := range schemes {
+		checkoutSchemes[strings.ToLower(scheme)] = name
+	}
+}
+
+// CheckoutTypes returns the names of the checkouts that can be used
+func CheckoutTypes() []string {
+	checkoutsMu.RLock()
+	defer checkoutsMu.RUnlock()
+
+	return checkoutTypes()
+}
+
+func checkoutTypes() []string {
+	types := []string{gitCheckoutType}
+	for name := range checkouts {
+		types = append(types, name)
+	}
+	sort.Strings(types[1:])
+	return types
+}
+
+// findCheckout returns the name of the checkout to use, and the checkout
+// itself, which is nil for the built-in git checkout
+func findCheckout(checkoutType, repository string) (string, Checkout, error) {
+	checkoutsMu.RLock()
+	defer checkoutsMu.RUnlock()
+
+	if checkoutType == "" {
+		// scp-like git URLs such as git@github.com:org/repo.git don't
+		// parse, and are git anyway
+		if u, err := url.Parse(repository); err == nil {
+			checkoutType = checkoutSchemes[strings.ToLower(u.Scheme)]
+		}
+	}
+
+	if checkoutType == "" || checkoutType == gitCheckoutType {
+		return gitCheckoutType, nil, nil
+	}
+
+	c, ok := checkouts[checkoutType]
+	if !ok {
+		return "", nil, fmt.Errorf("Unknown checkout type %q, this agent supports %s",
+			checkoutType, strings.Join(checkoutTypes(), ", "))
+	}
+	return checkoutType, c, nil
+}
+
+// customCheckoutPhase checks out the repository with a registered checkout
+func (b *Bootstrap) customCheckoutPhase(ctx context.Context, name string, c Checkout) error {
+	span, ctx := tracetools.StartSpanFromContext(ctx, "repo-checkout", b.Config.TracingBackend)
+	span.AddAttributes(map[string]string{
+		"checkout.type":      name,
+		"checkout.repo_name": b.Repository,
+		"checkout.commit":    b.Commit,
+	})
+	var err error
+	defer func() { span.FinishWithError(err) }()
+
+	b.shell.Commentf("Checking out %s with the %s checkout", b.Repository, name)
+
+	// Make sure the build directory exists and that we change directory into it
+	if err = b.createCheckoutDir(); err != nil {
+		return err
+	}
+
+	err = c.Checkout(ctx, b.shell, b.Config)
+	return err
+}
@@ -0,0 +1,131 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// The checkout path template that gives the same paths as before templates
+const defaultCheckoutPathTemplate = "{agent}/{org}/{pipeline}"
+
+var (
+	checkoutPathPlaceholderRegex = regexp.MustCompile(`\{([a-z_]+)\}`)
+	checkoutPathUnsafeRegex      = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+// checkoutPathLimits returns how long each directory in a templated checkout
+// path, and the whole templated path, can be before they're shortened with a
+// hash. Windows has a 260 character limit on paths unless long paths are
+// enabled, which the files in a checkout need most of.
+func checkoutPathLimits() (segment, total int) {
+	if runtime.GOOS == "windows" {
+		return 32, 96
+	}
+	return 100, 255
+}
+
+// checkoutPathValues are what a checkout path template can refer to
+type checkoutPathValues struct {
+	Agent, Org, Pipeline, Branch, StepKey, Queue string
+}
+
+// expandCheckoutPath expands a checkout path template into a path relative to
+// the build path. The template can use {agent}, {org}, {pipeline}, {branch},
+// {step_key} and {queue}, along with {branch_hash} and {step_key_hash}, which
+// are short hashes that are always safe to use in a path.
+//
+// Values are made safe for paths, and a hash is added to any that had to be
+// changed so that different values don't end up in the same directory. Names
+// that are too long are shortened the same way.
+func expandCheckoutPath(template string, values checkoutPathValues) (string, error) {
+	if template == "" {
+		template = defaultCheckoutPathTemplate
+	}
+
+	lookup := map[string]string{
+		"agent":         dirForAgentName(values.Agent),
+		"org":           safeCheckoutPathValue(values.Org),
+		"pipeline":      safeCheckoutPathValue(values.Pipeline),
+		"branch":        safeCheckoutPathValue(values.Branch),
+		"branch_hash":   shortHash(values.Branch),
+		"step_key":      safeCheckoutPathValue(values.StepKey),
+		"step_key_hash": shortHash(values.StepKey),
+		"queue":         safeCheckoutPathValue(values.Queue),
+	}
+
+	maxSegment, maxTotal := checkoutPathLimits()
+
+	var segments []string
+	for _, segment := range strings.Split(filepath.ToSlash(template), "/") {
+		if segment == "" {
+			continue
+		}
+		if segment == "." || segment == ".." {
+			return "", fmt.Errorf("Checkout path template %q can't contain %q", template, segment)
+		}
+
+		var err error
+		expanded := checkoutPathPlaceholderRegex.ReplaceAllStringFunc(segment, func(placeholder string) string {
+			value, ok := lookup[strings.Trim(placeholder, "{}")]
+			if !ok {
+				err = fmt.Errorf("Unknown placeholder %s in checkout path template %q", placeholder, template)
+			}
+			return value
+		})
+		if err != nil {
+			return "", err
+		}
+
+		// An empty value, like a step without a key, still needs a directory
+		if expanded == "" {
+			expanded = "_"
+		}
+
+		segments = append(segments, shortenCheckoutPathSegment(safeCheckoutPathValue(expanded), maxSegment))
+	}
+
+	if len(segments) == 0 {
+		return "", fmt.Errorf("Checkout path template %q is empty", template)
+	}
+
+	path := filepath.Join(segments...)
+	if len(path) > maxTotal {
+		path = shortHash(path)
+	}
+
+	return path, nil
+}
+
+// safeCheckoutPathValue replaces characters that aren't safe in paths, adding
+// a hash of the original value if it had to be changed
+func safeCheckoutPathValue(value string) string {
+	safe := checkoutPathUnsafeRegex.ReplaceAllString(value, "-")
+	if strings.Trim(safe, ".") == "" && value != "" {
+		return shortHash(value)
+	}
+	if safe != value {
+		return safe + "-" + shortHash(value)
+	}
+	return safe
+}
+
+// shortenCheckoutPathSegment truncates a directory name to max characters,
+// ending it with a hash of the full name
+func shortenCheckoutPathSegment(segment string, max int) string {
+	if len(segment) <= max {
+		return segment
+	}
+	hash := shortHash(segment)
+	return segment[:max-len(hash)-1] + "-" + hash
+}
+
+// shortHash returns the first 8 hex characters of a SHA-256 of value
+func shortHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:8]
+}
@@ -0,0 +1,81 @@
+package bootstrap
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandCheckoutPath(t *testing.T) {
+	t.Parallel()
+
+	values := checkoutPathValues{
+		Agent:    "my-agent-1",
+		Org:      "acme",
+		Pipeline: "web",
+		Branch:   "feature/login",
+		StepKey:  "test",
+		Queue:    "default",
+	}
+
+	path, err := expandCheckoutPath("", values)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("my-agent-1", "acme", "web"), path)
+
+	path, err = expandCheckoutPath("{org}/{pipeline}/{branch_hash}", values)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("acme", "web", shortHash("feature/login")), path)
+
+	path, err = expandCheckoutPath("{queue}/{pipeline}-{step_key}", values)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("default", "web-test"), path)
+
+	// Branches that only differ in unsafe characters don't collide
+	slash, err := expandCheckoutPath("{pipeline}/{branch}", values)
+	require.NoError(t, err)
+	values.Branch = "feature-login"
+	dash, err := expandCheckoutPath("{pipeline}/{branch}", values)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("web", "feature-login"), dash)
+	assert.NotEqual(t, slash, dash)
+	assert.True(t, strings.HasPrefix(slash, filepath.Join("web", "feature-login-")))
+}
+
+func TestExpandCheckoutPathLimitsLength(t *testing.T) {
+	t.Parallel()
+
+	maxSegment, maxTotal := checkoutPathLimits()
+
+	path, err := expandCheckoutPath("{org}/{branch}", checkoutPathValues{
+		Org:    "acme",
+		Branch: strings.Repeat("a", 300),
+	})
+	require.NoError(t, err)
+	assert.Len(t, filepath.Base(path), maxSegment)
+	assert.LessOrEqual(t, len(path), maxTotal)
+
+	if runtime.GOOS != "windows" {
+		b := strings.Repeat("b", 90)
+		path, err = expandCheckoutPath(strings.Repeat("{branch}/", 5), checkoutPathValues{Branch: b})
+		require.NoError(t, err)
+		assert.Equal(t, shortHash(filepath.Join(b, b, b, b, b)), path)
+	}
+}
+
+func TestExpandCheckoutPathErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := expandCheckoutPath("{org}/{nope}", checkoutPathValues{})
+	assert.EqualError(t, err, `Unknown placeholder {nope} in checkout path template "{org}/{nope}"`)
+
+	_, err = expandCheckoutPath("{org}/../{pipeline}", checkoutPathValues{})
+	assert.EqualError(t, err, `Checkout path template "{org}/../{pipeline}" can't contain ".."`)
+
+	path, err := expandCheckoutPath("{org}/{branch}", checkoutPathValues{Org: "acme", Branch: ".."})
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("acme", shortHash("..")), path)
+}
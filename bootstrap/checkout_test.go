@@ -0,0 +1,47 @@
+package bootstrap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindCheckout(t *testing.T) {
+	perforce := CheckoutFunc(func(ctx context.Context, sh *shell.Shell, conf Config) error {
+		return nil
+	})
+	RegisterCheckout("test-perforce", perforce, "test-p4")
+
+	for _, tc := range []struct {
+		checkoutType, repository, expected string
+	}{
+		{"", "git@github.com:buildkite/agent.git", "git"},
+		{"", "https://github.com/buildkite/agent.git", "git"},
+		{"", "TEST-P4://perforce:1666/depot/project", "test-perforce"},
+		{"test-perforce", "https://github.com/buildkite/agent.git", "test-perforce"},
+		{"git", "test-p4://perforce:1666/depot/project", "git"},
+	} {
+		name, c, err := findCheckout(tc.checkoutType, tc.repository)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, name, "%q %q", tc.checkoutType, tc.repository)
+		assert.Equal(t, name == "git", c == nil)
+	}
+
+	_, _, err := findCheckout("svn", "https://svn.example.com/project")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `Unknown checkout type "svn", this agent supports git, `)
+	assert.Contains(t, err.Error(), "test-perforce")
+}
+
+func TestRegisterCheckoutRejectsDuplicates(t *testing.T) {
+	noop := CheckoutFunc(func(ctx context.Context, sh *shell.Shell, conf Config) error {
+		return nil
+	})
+
+	RegisterCheckout("test-duplicate", noop)
+	assert.Panics(t, func() { RegisterCheckout("test-duplicate", noop) })
+	assert.Panics(t, func() { RegisterCheckout("git", noop) })
+}
@@ -3,6 +3,7 @@ package bootstrap
 import (
 	"reflect"
 	"strconv"
+	"time"
 
 	"log"
 
@@ -71,6 +72,26 @@ type Config struct {
 	// Should the bootstrap remove an existing checkout before running the job
 	CleanCheckout bool `env:"BUILDKITE_CLEAN_CHECKOUT"`
 
+	// Where to check out the repository within the build path, for example
+	// "{org}/{pipeline}/{branch_hash}"
+	CheckoutPathTemplate string
+
+	// Which checkout to use for the repository, if not git or the one
+	// registered for the repository's URL scheme
+	CheckoutType string `env:"BUILDKITE_CHECKOUT_TYPE"`
+
+	// Where to tell the agent why the job failed
+	FailureReasonFile string
+
+	// When the job times out, or zero if it doesn't have a timeout
+	JobDeadline time.Time
+
+	// Seconds a canceled or timed out job has to upload its artifacts
+	CancelArtifactGracePeriod int
+
+	// A file declaring the environment variables the job needs
+	EnvSchemaPath string
+
 	// Flags to pass to "git clone" command
 	GitCloneFlags string `env:"BUILDKITE_GIT_CLONE_FLAGS"`
 
@@ -95,6 +116,14 @@ type Config struct {
 	// Should we always force a fresh clone of plugins, even if we have a local checkout?
 	PluginsAlwaysCloneFresh bool `env:"BUILDKITE_PLUGINS_ALWAYS_CLONE_FRESH"`
 
+	// Whether plugin hooks run in their own working directory, with their
+	// environment changes kept to the plugin
+	IsolatePlugins bool
+
+	// The environment variables isolated plugins can change for the rest of
+	// the job
+	PluginsSharedEnv []string
+
 	// Whether to validate plugin configuration
 	PluginValidation bool
 
@@ -113,12 +142,31 @@ type Config struct {
 	// Skip updating the Git mirror before using it
 	GitMirrorsSkipUpdate bool `env:"BUILDKITE_GIT_MIRRORS_SKIP_UPDATE"`
 
+	// Pass jobs whose commit or ref no longer exists instead of failing them
+	GitSkipMissingRefs bool `env:"BUILDKITE_GIT_SKIP_MISSING_REFS"`
+
+	// SSH settings for repository hosts, like "host port=2222 identity=/path"
+	GitSSHHosts []string
+
+	// An SSH config file for git to use when checking out
+	GitSSHConfig string
+
+	// Whether to check out SSH repositories over HTTPS if SSH is blocked
+	GitHTTPSFallback bool
+
+	// The git credential helper to use for HTTPS checkouts
+	GitCredentialHelper string
+
 	// Path to the buildkite-agent binary
 	BinPath string
 
 	// Path to the global hooks
 	HooksPath string
 
+	// Whether to report on the hooks that were looked for and ran, in the log
+	// and as an artifact
+	HookReport bool `env:"BUILDKITE_HOOK_REPORT"`
+
 	// Path to the plugins directory
 	PluginsPath string
 
@@ -131,9 +179,29 @@ type Config struct {
 	// Whether ssh-keyscan is run on ssh hosts before checkout
 	SSHKeyscan bool
 
+	// Whether ssh refuses hosts that aren't already known or pinned, rather
+	// than trusting them on first use
+	SSHStrictHostKeys bool
+
+	// Whether ssh checks the keys of hosts against their SSHFP records in DNS
+	SSHVerifyHostKeysWithDNS bool
+
 	// The shell used to execute commands
 	Shell string
 
+	// On Windows, the WSL distribution to run bash hooks and commands in.
+	// Inside WSL, whether to run batch and PowerShell hooks on Windows.
+	WSLDistribution string
+
+	// On macOS, the keychain to unlock and search for code signing identities
+	MacOSKeychain string
+
+	// A file containing the password for MacOSKeychain
+	MacOSKeychainPasswordFile string
+
+	// On macOS, a directory of provisioning profiles to install for the job
+	MacOSProvisioningProfiles string
+
 	// Phases to execute, defaults to all phases
 	Phases []string
 
@@ -145,6 +213,13 @@ type Config struct {
 
 	// Backend to use for tracing. If an empty string, no tracing will occur.
 	TracingBackend string
+
+	// Only connect to the repository over this IP family, either ipv4 or
+	// ipv6, or empty to use both
+	IPFamily string
+
+	// A PAC file that picks the proxy plugins are cloned through
+	ProxyPAC string
 }
 
 // ReadFromEnvironment reads configuration from the Environment, returns a map
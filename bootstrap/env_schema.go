@@ -0,0 +1,37 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/buildkite/agent/v3/env"
+)
+
+// validateEnvSchema checks the job's environment against the schema in
+// BUILDKITE_ENV_SCHEMA, which steps can set, and the agent's schema. The
+// agent's declarations take precedence, so steps can't relax them.
+func (b *Bootstrap) validateEnvSchema() error {
+	var schema env.Schema
+
+	if stepSchema, ok := b.shell.Env.Get("BUILDKITE_ENV_SCHEMA"); ok && stepSchema != "" {
+		var err error
+		if schema, err = env.ParseSchema([]byte(stepSchema)); err != nil {
+			return fmt.Errorf("The step's BUILDKITE_ENV_SCHEMA is invalid: %v", err)
+		}
+	}
+
+	if b.EnvSchemaPath != "" {
+		data, err := ioutil.ReadFile(b.EnvSchemaPath)
+		if err != nil {
+			return fmt.Errorf("Failed to read the environment schema: %v", err)
+		}
+
+		agentSchema, err := env.ParseSchema(data)
+		if err != nil {
+			return err
+		}
+		schema = schema.Merge(agentSchema)
+	}
+
+	return schema.Validate(b.shell.Env)
+}
@@ -0,0 +1,93 @@
+package bootstrap
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/pkg/errors"
+)
+
+var errCancelled = errors.New("The job was cancelled")
+
+// recordFailure remembers why the job failed, so it can be given to the
+// pre-exit hook and reported to the agent when the bootstrap finishes. Only
+// the first failure is kept, so a command that fails because the job was
+// cancelled is reported as cancelled. Running out of disk space is reported as
+// that whatever was happening at the time.
+func (b *Bootstrap) recordFailure(ctx context.Context, reason string, err error) {
+	b.failureMu.Lock()
+	defer b.failureMu.Unlock()
+
+	if b.failure != nil || err == nil {
+		return
+	}
+
+	if ctx.Err() == context.DeadlineExceeded || errors.Cause(err) == context.DeadlineExceeded {
+		reason = agent.FailureReasonTimeout
+	} else if ctx.Err() != nil || errors.Cause(err) == context.Canceled {
+		reason = agent.FailureReasonCancelled
+	} else if agent.IsDiskFull(err) {
+		reason = agent.FailureReasonDiskFull
+	}
+
+	b.failure = &agent.JobFailure{Reason: reason, Message: err.Error()}
+}
+
+// failureReason returns why the job failed, or an empty string if it didn't
+func (b *Bootstrap) failureReason() string {
+	b.failureMu.Lock()
+	defer b.failureMu.Unlock()
+
+	if b.failure == nil {
+		return ""
+	}
+	return b.failure.Reason
+}
+
+// writeFailure writes why the job failed, if it did, to the file the agent
+// reads it from
+func (b *Bootstrap) writeFailure() {
+	b.failureMu.Lock()
+	defer b.failureMu.Unlock()
+
+	if b.failure == nil || b.Config.FailureReasonFile == "" {
+		return
+	}
+
+	if err := agent.WriteJobFailure(b.Config.FailureReasonFile, *b.failure); err != nil {
+		b.shell.Warningf("Failed to tell the agent why the job failed: %v", err)
+	}
+}
+
+// wasKilled returns whether the command was killed with SIGKILL, which the
+// agent only sends after the cancel grace period so is usually from the
+// out-of-memory killer. Shells exit with 128 plus the signal number when
+// something they run is killed.
+func wasKilled(err error) bool {
+	exitErr, ok := errors.Cause(err).(*exec.ExitError)
+	if !ok {
+		return false
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
+	}
+
+	if status.Signaled() {
+		return status.Signal() == syscall.SIGKILL
+	}
+	return runtime.GOOS != "windows" && status.ExitStatus() == 128+int(syscall.SIGKILL)
+}
+
+// exitedPID returns the PID of the command that exited with an error, or 0 if
+// it didn't run
+func exitedPID(err error) int {
+	if exitErr, ok := errors.Cause(err).(*exec.ExitError); ok {
+		return exitErr.Pid()
+	}
+	return 0
+}
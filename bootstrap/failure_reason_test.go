@@ -0,0 +1,63 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordFailureKeepsFirst(t *testing.T) {
+	b := &Bootstrap{}
+
+	b.recordFailure(context.Background(), agent.FailureReasonPluginFetch, errors.New("Failed to checkout plugin docker"))
+	b.recordFailure(context.Background(), agent.FailureReasonCheckout, errors.New("exit status 128"))
+
+	assert.Equal(t, &agent.JobFailure{
+		Reason:  agent.FailureReasonPluginFetch,
+		Message: "Failed to checkout plugin docker",
+	}, b.failure)
+}
+
+func TestRecordFailureReasonDiskFull(t *testing.T) {
+	b := &Bootstrap{}
+	b.recordFailure(context.Background(), agent.FailureReasonCheckout, errors.New("fatal: write error: No space left on device"))
+
+	assert.Equal(t, agent.FailureReasonDiskFull, b.failure.Reason)
+}
+
+func TestRecordFailureCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	b := &Bootstrap{}
+	b.recordFailure(ctx, agent.FailureReasonCheckout, errors.New("signal: interrupt"))
+
+	assert.Equal(t, agent.FailureReasonCancelled, b.failureReason())
+}
+
+func TestRecordFailureTimedOut(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	b := &Bootstrap{}
+	b.recordFailure(ctx, agent.FailureReasonCommand, errors.New("signal: killed"))
+
+	assert.Equal(t, agent.FailureReasonTimeout, b.failureReason())
+}
+
+func TestWasKilled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("There's no SIGKILL on Windows")
+	}
+
+	assert.True(t, wasKilled(exec.Command("sh", "-c", "kill -9 $$").Run()))
+	assert.True(t, wasKilled(exec.Command("sh", "-c", "exit 137").Run()))
+	assert.False(t, wasKilled(exec.Command("sh", "-c", "exit 1").Run()))
+	assert.False(t, wasKilled(errors.New("not an exit error")))
+}
@@ -0,0 +1,135 @@
+package bootstrap
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/buildkite/agent/v3/env"
+)
+
+// gitCredential is a username and password (or token) for HTTPS checkouts
+type gitCredential struct {
+	Username string
+	Password string
+}
+
+// gitCredentialProvider finds credentials for a kind of git host in the job
+// environment
+type gitCredentialProvider interface {
+	// Name is shown in the job log when the provider is used
+	Name() string
+
+	// Matches returns whether the provider handles repositories on host
+	Matches(host string) bool
+
+	// Credential returns the credential from the environment, if there is one
+	Credential(environ env.Environment) (gitCredential, bool)
+}
+
+// The providers to try for HTTPS repositories, in order
+var gitCredentialProviders = []gitCredentialProvider{
+	gitlabCredentialProvider{},
+	bitbucketCredentialProvider{},
+}
+
+// gitlabCredentialProvider uses a project, group or deploy token from
+// BUILDKITE_GITLAB_TOKEN, or a CI job token from CI_JOB_TOKEN
+type gitlabCredentialProvider struct{}
+
+func (gitlabCredentialProvider) Name() string {
+	return "GitLab"
+}
+
+func (gitlabCredentialProvider) Matches(host string) bool {
+	return strings.Contains(host, "gitlab")
+}
+
+func (gitlabCredentialProvider) Credential(environ env.Environment) (gitCredential, bool) {
+	if token, _ := environ.Get("BUILDKITE_GITLAB_TOKEN"); token != "" {
+		// Deploy tokens have their own username, but any username works for
+		// project and group access tokens
+		username, _ := environ.Get("BUILDKITE_GITLAB_USERNAME")
+		if username == "" {
+			username = "oauth2"
+		}
+		return gitCredential{Username: username, Password: token}, true
+	}
+
+	if token, _ := environ.Get("CI_JOB_TOKEN"); token != "" {
+		return gitCredential{Username: "gitlab-ci-token", Password: token}, true
+	}
+
+	return gitCredential{}, false
+}
+
+// bitbucketCredentialProvider uses a workspace, project or repository access
+// token from BUILDKITE_BITBUCKET_ACCESS_TOKEN, or an app password from
+// BUILDKITE_BITBUCKET_APP_PASSWORD along with BUILDKITE_BITBUCKET_USERNAME
+type bitbucketCredentialProvider struct{}
+
+func (bitbucketCredentialProvider) Name() string {
+	return "Bitbucket"
+}
+
+func (bitbucketCredentialProvider) Matches(host string) bool {
+	return strings.Contains(host, "bitbucket")
+}
+
+func (bitbucketCredentialProvider) Credential(environ env.Environment) (gitCredential, bool) {
+	if token, _ := environ.Get("BUILDKITE_BITBUCKET_ACCESS_TOKEN"); token != "" {
+		return gitCredential{Username: "x-token-auth", Password: token}, true
+	}
+
+	username, _ := environ.Get("BUILDKITE_BITBUCKET_USERNAME")
+	password, _ := environ.Get("BUILDKITE_BITBUCKET_APP_PASSWORD")
+	if username != "" && password != "" {
+		return gitCredential{Username: username, Password: password}, true
+	}
+
+	return gitCredential{}, false
+}
+
+// findGitCredential returns the credential to use for an HTTPS repository,
+// along with the URL prefix it applies to and the provider that found it
+func findGitCredential(repository string, environ env.Environment) (gitCredential, string, gitCredentialProvider, bool) {
+	u, err := url.Parse(repository)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return gitCredential{}, "", nil, false
+	}
+
+	// Credentials in the URL take precedence
+	if u.User != nil {
+		return gitCredential{}, "", nil, false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, provider := range gitCredentialProviders {
+		if !provider.Matches(host) {
+			continue
+		}
+		if cred, ok := provider.Credential(environ); ok {
+			return cred, fmt.Sprintf("https://%s/", u.Host), provider, true
+		}
+	}
+
+	return gitCredential{}, "", nil, false
+}
+
+// configureGitCredentials gives git commands run by the bootstrap credentials
+// for the repository, if it's an HTTPS repository on a host with a provider
+// and the job has a token for it. They're passed as an extra HTTP header in
+// GIT_CONFIG_* variables, so they're never written to disk or to the remote
+// URL. The returned function removes them again.
+func (b *Bootstrap) configureGitCredentials() func() {
+	cred, prefix, provider, ok := findGitCredential(b.Repository, b.shell.Env)
+	if !ok {
+		return func() {}
+	}
+
+	b.shell.Commentf("Using %s credentials for %s", provider.Name(), prefix)
+
+	auth := base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + cred.Password))
+	return b.addGitConfig(fmt.Sprintf("http.%s.extraHeader", prefix), "Authorization: Basic "+auth)
+}
@@ -0,0 +1,97 @@
+package bootstrap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/pkg/errors"
+)
+
+// errJobSkipped is returned by a phase when the rest of the job shouldn't run,
+// but the job shouldn't fail either
+var errJobSkipped = errors.New("The rest of the job was skipped")
+
+// missingRefError is returned when the ref or commit being built doesn't exist
+// in the repository, which is usually because its branch was force-pushed or
+// deleted, or the commit was garbage collected. Retrying won't help.
+type missingRefError struct {
+	Repository string
+	Ref        string
+}
+
+func (e *missingRefError) Error() string {
+	return fmt.Sprintf("%s doesn't exist in %s, its branch may have been force-pushed or deleted", e.Ref, e.Repository)
+}
+
+// isMissingRef returns whether a checkout failed because the ref or commit
+// being built doesn't exist
+func isMissingRef(err error) bool {
+	if ge, ok := err.(*gitError); ok {
+		err = ge.error
+	}
+	switch e := err.(type) {
+	case *missingRefError:
+		return true
+	case *gitNetworkError:
+		return e.Category == gitFailureMissingRef
+	}
+	return false
+}
+
+// remoteRefToProbe returns the ref that has to exist on the remote for the
+// checkout to work, or an empty string if it can't be known before fetching
+// (like a commit that isn't the head of a branch)
+func (b *Bootstrap) remoteRefToProbe() string {
+	switch {
+	case b.RefSpec != "":
+		return ""
+	case b.PullRequest != "false" && strings.Contains(b.PipelineProvider, "github"):
+		return fmt.Sprintf("refs/pull/%s/head", b.PullRequest)
+	case b.Commit == "HEAD" && b.Branch != "":
+		return b.Branch
+	}
+	return ""
+}
+
+// checkRemoteRef makes sure the ref being built exists on the remote before
+// doing any expensive checkout work. Failing to ask the remote isn't an error,
+// since the checkout has its own retries for that.
+func (b *Bootstrap) checkRemoteRef() error {
+	ref := b.remoteRefToProbe()
+	if ref == "" {
+		return nil
+	}
+
+	exists, err := gitRemoteRefExists(b.shell, b.Repository, ref)
+	if err != nil {
+		b.shell.Warningf("Couldn't check that %s exists in the repository: %v", ref, err)
+		return nil
+	}
+	if !exists {
+		return &missingRefError{Repository: b.Repository, Ref: ref}
+	}
+	return nil
+}
+
+// checkFetchedCommit makes sure the commit being built was fetched, so that a
+// commit that no longer exists fails clearly rather than as a checkout error
+func (b *Bootstrap) checkFetchedCommit() error {
+	if b.Commit == "HEAD" {
+		return nil
+	}
+	if _, err := b.shell.RunAndCapture("git", "rev-parse", "--verify", "--quiet", b.Commit+"^{commit}"); err != nil {
+		return &missingRefError{Repository: b.Repository, Ref: b.Commit}
+	}
+	return nil
+}
+
+// gitRemoteRefExists returns whether the remote has a ref matching the given
+// pattern, using git ls-remote, which exits with 2 if there isn't one
+func gitRemoteRefExists(sh *shell.Shell, repository, ref string) (bool, error) {
+	_, err := sh.RunAndCapture("git", "ls-remote", "--exit-code", "--", repository, ref)
+	if shell.GetExitCode(err) == 2 {
+		return false, nil
+	}
+	return err == nil, err
+}
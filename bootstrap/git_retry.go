@@ -0,0 +1,234 @@
+package bootstrap
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/retry"
+)
+
+// The reasons a git network operation can fail. Only the transient ones are
+// worth retrying.
+const (
+	gitFailureUnknown     = ""
+	gitFailureTimeout     = "timeout"
+	gitFailureServerError = "server_error"
+	gitFailureConnection  = "connection"
+	gitFailureAuth        = "auth"
+	gitFailureMissingRef  = "missing_ref"
+)
+
+// gitRetryLimits is how many times each kind of transient failure is retried
+// before giving up on the operation
+var gitRetryLimits = map[string]int{
+	gitFailureTimeout:     3,
+	gitFailureServerError: 3,
+	gitFailureConnection:  5,
+}
+
+// gitFailurePatterns recognise what went wrong from git's output. They're
+// checked in order, so permanent failures win over any transient symptoms
+// they cause, like "the remote end hung up unexpectedly".
+var gitFailurePatterns = []struct {
+	category string
+	pattern  *regexp.Regexp
+}{
+	{gitFailureAuth, regexp.MustCompile(`(?i)authentication failed|permission denied \(publickey|could not read (username|password)|repository not found|returned error: 40[13]|HTTP 40[13]`)},
+	{gitFailureMissingRef, regexp.MustCompile(`(?i)couldn't find remote ref|not our ref|unadvertised object|no such remote ref`)},
+	{gitFailureTimeout, regexp.MustCompile(`(?i)timed out|timeout`)},
+	{gitFailureServerError, regexp.MustCompile(`(?i)returned error: 5\d\d|HTTP 5\d\d|RPC failed; HTTP 5|internal server error|service unavailable|bad gateway`)},
+	{gitFailureConnection, regexp.MustCompile(`(?i)connection reset|connection refused|connection closed by|kex_exchange_identification|ssh_exchange_identification|broken pipe|early EOF|remote end hung up unexpectedly|could not resolve host|unable to access`)},
+}
+
+// gitFailureCategory returns why a git network operation failed, based on
+// what it wrote to the log
+func gitFailureCategory(output string) string {
+	for _, p := range gitFailurePatterns {
+		if p.pattern.MatchString(output) {
+			return p.category
+		}
+	}
+	return gitFailureUnknown
+}
+
+// gitNetworkError is a git network operation that failed, and why
+type gitNetworkError struct {
+	error
+	Category string
+}
+
+// isFinalGitFailure returns whether an error came from a git network
+// operation that either failed for a reason retrying won't fix, or was
+// already retried as many times as its kind of failure allows
+func isFinalGitFailure(err error) bool {
+	if isMissingRef(err) {
+		return true
+	}
+	if _, ok := err.(*unknownHostError); ok {
+		return true
+	}
+	if ge, ok := err.(*gitError); ok {
+		err = ge.error
+	}
+	_, ok := err.(*gitNetworkError)
+	return ok
+}
+
+// gitNetworkRunner runs git commands that talk to the remote, retrying the
+// ones that fail for transient reasons with an exponential backoff. It keeps
+// count of the retries for each kind of failure.
+type gitNetworkRunner struct {
+	ctx     context.Context
+	sh      *shell.Shell
+	retries map[string]int
+
+	// The IP family clones and fetches are limited to, if any
+	ipFamily string
+
+	// Replaces waiting between attempts, for tests
+	sleep func(time.Duration)
+}
+
+func newGitNetworkRunner(ctx context.Context, sh *shell.Shell) *gitNetworkRunner {
+	return &gitNetworkRunner{ctx: ctx, sh: sh, retries: map[string]int{}}
+}
+
+// Run implements shellRunner
+func (g *gitNetworkRunner) Run(command string, args ...string) error {
+	failures := map[string]int{}
+
+	opts := []retry.Option{
+		retry.TryForever(),
+		retry.WithStrategy(retry.Exponential(2*time.Second, 30*time.Second)),
+		retry.WithJitter(),
+	}
+	if g.sleep != nil {
+		opts = append(opts, retry.WithSleepFunc(g.sleep))
+	}
+
+	args = gitIPFamilyArgs(g.ipFamily, args)
+
+	return retry.NewRetrier(opts...).DoWithContext(g.ctx, func(ctx context.Context, r *retry.Retrier) error {
+		output, err := g.run(command, args...)
+		if err == nil {
+			return nil
+		}
+
+		// Leave signals and cancellation to the caller
+		if ctx.Err() != nil || shell.GetExitCode(err) == -1 {
+			r.Break()
+			return err
+		}
+
+		category := gitFailureCategory(output)
+		if category == gitFailureUnknown {
+			r.Break()
+			return err
+		}
+
+		limit, transient := gitRetryLimits[category]
+		if !transient {
+			r.Break()
+			return &gitNetworkError{error: err, Category: category}
+		}
+
+		failures[category]++
+		if failures[category] > limit {
+			g.sh.Warningf("Giving up after %d %s failures", limit, category)
+			r.Break()
+			return &gitNetworkError{error: err, Category: category}
+		}
+
+		g.retries[category]++
+		g.sh.Warningf("git failed with a transient %s error (retry %d/%d for this kind of failure)", category, failures[category], limit)
+		return &gitNetworkError{error: err, Category: category}
+	})
+}
+
+// gitIPFamilyArgs adds --ipv4 or --ipv6 after the clone or fetch subcommand
+// in a git command's arguments, which git passes on to ssh and curl too. Other
+// subcommands don't have the flags, so they're left as they are.
+func gitIPFamilyArgs(family string, args []string) []string {
+	if family == "" {
+		return args
+	}
+
+	// The subcommand is the first argument that isn't one of git's own
+	// options, or the value of one
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--git-dir" || arg == "--work-tree" || arg == "-C" || arg == "-c":
+			i++
+		case strings.HasPrefix(arg, "-"):
+		case arg == "clone" || arg == "fetch":
+			withFlag := append([]string{}, args[:i+1]...)
+			withFlag = append(withFlag, "--"+family)
+			return append(withFlag, args[i+1:]...)
+		default:
+			return args
+		}
+	}
+
+	return args
+}
+
+// run runs the command, keeping the end of its output so the failure can be
+// categorised
+func (g *gitNetworkRunner) run(command string, args ...string) (string, error) {
+	tail := &tailWriter{max: 16 * 1024}
+
+	w := g.sh.Writer
+	g.sh.Writer = io.MultiWriter(w, tail)
+	defer func() { g.sh.Writer = w }()
+
+	err := g.sh.Run(command, args...)
+	return string(tail.buf), err
+}
+
+// Attributes returns the retry counts for tracing spans
+func (g *gitNetworkRunner) Attributes() map[string]string {
+	attrs := map[string]string{}
+	for category, count := range g.retries {
+		attrs["checkout.git_retries."+category] = strconv.Itoa(count)
+	}
+	return attrs
+}
+
+// Summary describes the retries that were needed, or returns an empty string
+// if there weren't any
+func (g *gitNetworkRunner) Summary() string {
+	var categories []string
+	for category := range g.retries {
+		categories = append(categories, category)
+	}
+	if len(categories) == 0 {
+		return ""
+	}
+	sort.Strings(categories)
+
+	summary := "git network operations were retried:"
+	for _, category := range categories {
+		summary += " " + category + "=" + strconv.Itoa(g.retries[category])
+	}
+	return summary
+}
+
+// tailWriter keeps the last max bytes written to it
+type tailWriter struct {
+	buf []byte
+	max int
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
@@ -0,0 +1,118 @@
+package bootstrap
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/bintest/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitFailureCategory(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		output   string
+		category string
+	}{
+		{"fatal: unable to access 'https://github.com/org/repo.git/': Failed to connect to github.com port 443: Operation timed out", gitFailureTimeout},
+		{"error: RPC failed; HTTP 502 curl 22 The requested URL returned error: 502\nfatal: the remote end hung up unexpectedly", gitFailureServerError},
+		{"kex_exchange_identification: read: Connection reset by peer\nfatal: Could not read from remote repository.", gitFailureConnection},
+		{"fatal: early EOF\nfatal: index-pack failed", gitFailureConnection},
+		{"git@github.com: Permission denied (publickey).\nfatal: Could not read from remote repository.", gitFailureAuth},
+		{"remote: Repository not found.\nfatal: the remote end hung up unexpectedly", gitFailureAuth},
+		{"fatal: couldn't find remote ref refs/heads/nope", gitFailureMissingRef},
+		{"error: Server does not allow request for unadvertised object 1a2b3c", gitFailureMissingRef},
+		{"fatal: not a git repository", gitFailureUnknown},
+	} {
+		assert.Equal(t, tc.category, gitFailureCategory(tc.output), tc.output)
+	}
+}
+
+func newTestGitNetworkRunner(t *testing.T) (*gitNetworkRunner, *bintest.Mock) {
+	t.Helper()
+
+	sh := shell.NewTestShell(t)
+
+	git, err := bintest.NewMock("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh.Env.Set("PATH", filepath.Dir(git.Path))
+
+	runner := newGitNetworkRunner(context.Background(), sh)
+	runner.sleep = func(time.Duration) {}
+
+	return runner, git
+}
+
+func TestGitNetworkRunnerRetriesTransientFailures(t *testing.T) {
+	t.Parallel()
+
+	runner, git := newTestGitNetworkRunner(t)
+	defer git.CheckAndClose(t)
+
+	git.Expect("fetch", "origin").
+		AndWriteToStderr("fatal: unable to access 'https://example.com/repo.git/': Connection reset by peer").
+		AndExitWith(128)
+	git.Expect("fetch", "origin").
+		AndWriteToStderr("error: RPC failed; HTTP 503 curl 22 The requested URL returned error: 503").
+		AndExitWith(128)
+	git.Expect("fetch", "origin").AndExitWith(0)
+
+	assert.NoError(t, runner.Run("git", "fetch", "origin"))
+	assert.Equal(t, map[string]int{gitFailureConnection: 1, gitFailureServerError: 1}, runner.retries)
+	assert.Equal(t, "git network operations were retried: connection=1 server_error=1", runner.Summary())
+}
+
+func TestGitNetworkRunnerGivesUpAfterCategoryLimit(t *testing.T) {
+	t.Parallel()
+
+	runner, git := newTestGitNetworkRunner(t)
+	defer git.CheckAndClose(t)
+
+	for i := 0; i <= gitRetryLimits[gitFailureTimeout]; i++ {
+		git.Expect("fetch", "origin").
+			AndWriteToStderr("fatal: unable to access 'https://example.com/repo.git/': Operation timed out").
+			AndExitWith(128)
+	}
+
+	err := runner.Run("git", "fetch", "origin")
+	assert.Error(t, err)
+	assert.True(t, isFinalGitFailure(err))
+	assert.Equal(t, gitRetryLimits[gitFailureTimeout], runner.retries[gitFailureTimeout])
+}
+
+func TestGitNetworkRunnerDoesntRetryPermanentFailures(t *testing.T) {
+	t.Parallel()
+
+	runner, git := newTestGitNetworkRunner(t)
+	defer git.CheckAndClose(t)
+
+	git.Expect("clone", "--", "git@example.com:org/repo.git", ".").
+		AndWriteToStderr("git@example.com: Permission denied (publickey).").
+		AndExitWith(128).
+		Once()
+
+	err := gitClone(runner, "", "git@example.com:org/repo.git", ".")
+	assert.Error(t, err)
+	assert.True(t, isFinalGitFailure(err))
+	assert.Empty(t, runner.retries)
+}
+
+func TestGitIPFamilyArgs(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{"clone", "--ipv6", "-v", "--", "repo", "."},
+		gitIPFamilyArgs("ipv6", []string{"clone", "-v", "--", "repo", "."}))
+	assert.Equal(t, []string{"--git-dir", "/mirrors/repo", "fetch", "--ipv4", "origin", "main"},
+		gitIPFamilyArgs("ipv4", []string{"--git-dir", "/mirrors/repo", "fetch", "origin", "main"}))
+	assert.Equal(t, []string{"remote", "set-url", "origin", "fetch"},
+		gitIPFamilyArgs("ipv4", []string{"remote", "set-url", "origin", "fetch"}))
+	assert.Equal(t, []string{"-c", "protocol.version=2", "fetch", "--ipv6", "origin"},
+		gitIPFamilyArgs("ipv6", []string{"-c", "protocol.version=2", "fetch", "origin"}))
+	assert.Equal(t, []string{"fetch", "origin"}, gitIPFamilyArgs("", []string{"fetch", "origin"}))
+}
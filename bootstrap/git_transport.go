@@ -0,0 +1,241 @@
+package bootstrap
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+)
+
+// How long to wait for an SSH connection to the repository host before
+// deciding SSH is blocked and falling back to HTTPS
+var gitSSHProbeTimeout = 10 * time.Second
+
+// configureGitTransport sets up how git connects to the repository host while
+// checking out: SSH settings for hosts that need them, a fallback to HTTPS for
+// networks that block SSH, and a credential helper for HTTPS. The returned
+// function undoes it all.
+func (b *Bootstrap) configureGitTransport() (func(), error) {
+	hosts, err := agent.ParseGitSSHHosts(b.GitSSHHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	var undo []func()
+	removeAll := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+
+	if len(hosts) > 0 || b.GitSSHConfig != "" || b.SSHStrictHostKeys || b.SSHVerifyHostKeysWithDNS {
+		remove, err := b.configureGitSSH(hosts)
+		if err != nil {
+			return nil, err
+		}
+		undo = append(undo, remove)
+	}
+
+	if b.GitHTTPSFallback {
+		if httpsURL, ok := b.gitHTTPSFallback(hosts); ok {
+			repository := b.Repository
+			b.Repository = httpsURL
+			undo = append(undo, func() { b.Repository = repository })
+		}
+	}
+
+	if b.GitCredentialHelper != "" && strings.HasPrefix(b.Repository, "https://") {
+		b.shell.Commentf("Using the git credential helper %q", b.GitCredentialHelper)
+		undo = append(undo, b.addGitConfig("credential.helper", b.GitCredentialHelper))
+	}
+
+	return removeAll, nil
+}
+
+// configureGitSSH writes an SSH config with the settings for each host, which
+// git uses through GIT_SSH_COMMAND. It includes the agent's SSH config, the
+// user's and the system's, since ssh doesn't read them when it's given a
+// config file.
+func (b *Bootstrap) configureGitSSH(hosts []agent.GitSSHHost) (func(), error) {
+	if existing, ok := b.shell.Env.Get("GIT_SSH_COMMAND"); ok && existing != "" {
+		b.shell.Warningf("Not using the agent's git SSH settings, since GIT_SSH_COMMAND is already set")
+		return func() {}, nil
+	}
+
+	f, err := os.CreateTemp("", "buildkite-git-ssh-config-")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(gitSSHConfig(hosts, b.GitSSHConfig, b.sshHostKeyOptions())); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	b.shell.Env.Set("GIT_SSH_COMMAND", fmt.Sprintf("ssh -F %q", filepath.ToSlash(f.Name())))
+
+	return func() {
+		b.shell.Env.Remove("GIT_SSH_COMMAND")
+		os.Remove(f.Name())
+	}, nil
+}
+
+// sshHostKeyOptions returns the SSH options for how host keys are checked
+func (b *Bootstrap) sshHostKeyOptions() []string {
+	var options []string
+	if b.SSHStrictHostKeys {
+		options = append(options, "StrictHostKeyChecking yes")
+	}
+	if b.SSHVerifyHostKeysWithDNS {
+		options = append(options, "VerifyHostKeyDNS yes")
+	}
+	return options
+}
+
+// gitSSHConfig returns an SSH config with a block for each host, and the
+// options for all hosts. ssh uses the first value it finds for each setting,
+// so these win over included configs.
+func gitSSHConfig(hosts []agent.GitSSHHost, include string, options []string) string {
+	var sb strings.Builder
+
+	for _, h := range hosts {
+		fmt.Fprintf(&sb, "Host %s\n", h.Host)
+		if h.Port != 0 {
+			fmt.Fprintf(&sb, "  Port %d\n", h.Port)
+		}
+		if h.Identity != "" {
+			fmt.Fprintf(&sb, "  IdentityFile %q\n", filepath.ToSlash(h.Identity))
+			fmt.Fprintf(&sb, "  IdentitiesOnly yes\n")
+		}
+		if h.KnownHosts != "" {
+			fmt.Fprintf(&sb, "  UserKnownHostsFile %q\n", filepath.ToSlash(h.KnownHosts))
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("Host *\n")
+	for _, option := range options {
+		fmt.Fprintf(&sb, "  %s\n", option)
+	}
+	if include != "" {
+		fmt.Fprintf(&sb, "  Include %q\n", filepath.ToSlash(include))
+	}
+	sb.WriteString("  Include ~/.ssh/config\n")
+	fmt.Fprintf(&sb, "  Include %q\n", filepath.ToSlash(systemSSHConfig()))
+
+	return sb.String()
+}
+
+// systemSSHConfig returns where ssh reads the system-wide config from
+func systemSSHConfig() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("PROGRAMDATA"), "ssh", "ssh_config")
+	}
+	return "/etc/ssh/ssh_config"
+}
+
+// gitSSHHostFor returns the SSH settings for the repository's host, if there
+// are any
+func gitSSHHostFor(hosts []agent.GitSSHHost, repository string) (agent.GitSSHHost, bool) {
+	u, err := parseGittableURL(repository)
+	if err != nil || u.Scheme != "ssh" {
+		return agent.GitSSHHost{}, false
+	}
+
+	for _, h := range hosts {
+		if h.Host == u.Hostname() {
+			return h, true
+		}
+	}
+	return agent.GitSSHHost{}, false
+}
+
+// gitHTTPSFallback returns the HTTPS URL to check out an SSH repository from,
+// if the repository host can't be reached over SSH
+func (b *Bootstrap) gitHTTPSFallback(hosts []agent.GitSSHHost) (string, bool) {
+	u, err := parseGittableURL(b.Repository)
+	if err != nil || u.Scheme != "ssh" {
+		return "", false
+	}
+
+	// Work out where ssh would actually connect to, following any aliases, to
+	// check whether it can. The HTTPS URL uses the repository's own host, since
+	// an alias can point somewhere that only serves SSH.
+	address := resolveGitHost(b.shell, u.Hostname())
+	hostname, port, err := net.SplitHostPort(address)
+	if err != nil {
+		hostname, port = address, "22"
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	if h, ok := gitSSHHostFor(hosts, b.Repository); ok && h.Port != 0 {
+		port = strconv.Itoa(h.Port)
+	}
+
+	network, err := api.DialNetwork("tcp", b.IPFamily)
+	if err != nil {
+		b.shell.Warningf("%v", err)
+		return "", false
+	}
+
+	conn, err := net.DialTimeout(network, net.JoinHostPort(hostname, port), gitSSHProbeTimeout)
+	if err == nil {
+		conn.Close()
+		return "", false
+	}
+
+	// IPv6 addresses need their brackets back in a URL
+	host := u.Hostname()
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	httpsURL := fmt.Sprintf("https://%s/%s", host, strings.TrimPrefix(u.Path, "/"))
+	b.shell.Warningf("Couldn't connect to %s over SSH (%v), checking out from %s instead", hostname, err, httpsURL)
+
+	return httpsURL, true
+}
+
+// addGitConfig passes a config setting to the git commands run by the
+// bootstrap in GIT_CONFIG_* variables, adding to any that are already being
+// passed that way. The returned function removes it again.
+func (b *Bootstrap) addGitConfig(key, value string) func() {
+	count := 0
+	if existing, ok := b.shell.Env.Get("GIT_CONFIG_COUNT"); ok {
+		count, _ = strconv.Atoi(existing)
+	}
+
+	keyVar := fmt.Sprintf("GIT_CONFIG_KEY_%d", count)
+	valueVar := fmt.Sprintf("GIT_CONFIG_VALUE_%d", count)
+
+	b.shell.Env.Set(keyVar, key)
+	b.shell.Env.Set(valueVar, value)
+	b.shell.Env.Set("GIT_CONFIG_COUNT", strconv.Itoa(count+1))
+
+	return func() {
+		b.shell.Env.Remove(keyVar)
+		b.shell.Env.Remove(valueVar)
+		if count == 0 {
+			b.shell.Env.Remove("GIT_CONFIG_COUNT")
+		} else {
+			b.shell.Env.Set("GIT_CONFIG_COUNT", strconv.Itoa(count))
+		}
+	}
+}
+
+// hasOwnKnownHosts returns whether the repository host has a known_hosts file
+// set in its SSH settings
+func (b *Bootstrap) hasOwnKnownHosts() bool {
+	hosts, _ := agent.ParseGitSSHHosts(b.GitSSHHosts)
+	h, ok := gitSSHHostFor(hosts, b.Repository)
+	return ok && h.KnownHosts != ""
+}
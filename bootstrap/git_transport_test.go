@@ -0,0 +1,91 @@
+package bootstrap
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitSSHConfig(t *testing.T) {
+	t.Parallel()
+
+	config := gitSSHConfig([]agent.GitSSHHost{
+		{Host: "github.com", Port: 443, Identity: "/keys/github"},
+		{Host: "git.internal", KnownHosts: "/keys/known_hosts"},
+	}, "/etc/buildkite-agent/ssh_config", []string{"StrictHostKeyChecking yes", "VerifyHostKeyDNS yes"})
+
+	assert.Equal(t, `Host github.com
+  Port 443
+  IdentityFile "/keys/github"
+  IdentitiesOnly yes
+
+Host git.internal
+  UserKnownHostsFile "/keys/known_hosts"
+
+Host *
+  StrictHostKeyChecking yes
+  VerifyHostKeyDNS yes
+  Include "/etc/buildkite-agent/ssh_config"
+  Include ~/.ssh/config
+  Include "`+filepath.ToSlash(systemSSHConfig())+`"
+`, config)
+}
+
+func TestGitHTTPSFallbackWhenSSHIsBlocked(t *testing.T) {
+	t.Parallel()
+
+	// Find a port that nothing is listening on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	b := &Bootstrap{shell: shell.NewTestShell(t)}
+	b.Repository = "ssh://git@127.0.0.1/llamas/alpacas.git"
+
+	httpsURL, ok := b.gitHTTPSFallback([]agent.GitSSHHost{{Host: "127.0.0.1", Port: port}})
+	assert.True(t, ok)
+	assert.Equal(t, "https://127.0.0.1/llamas/alpacas.git", httpsURL)
+}
+
+func TestGitHTTPSFallbackWhenSSHIsReachable(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	b := &Bootstrap{shell: shell.NewTestShell(t)}
+	b.Repository = "ssh://git@127.0.0.1/llamas/alpacas.git"
+
+	_, ok := b.gitHTTPSFallback([]agent.GitSSHHost{{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}})
+	assert.False(t, ok)
+}
+
+func TestAddGitConfigAddsToExistingConfig(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{shell: shell.NewTestShell(t)}
+	b.shell.Env = env.FromSlice([]string{"GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=core.askPass", "GIT_CONFIG_VALUE_0="})
+
+	remove := b.addGitConfig("credential.helper", "store")
+	assert.Equal(t, env.FromSlice([]string{
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_0=core.askPass",
+		"GIT_CONFIG_VALUE_0=",
+		"GIT_CONFIG_KEY_1=credential.helper",
+		"GIT_CONFIG_VALUE_1=store",
+	}), b.shell.Env)
+
+	remove()
+	assert.Equal(t, env.FromSlice([]string{"GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=core.askPass", "GIT_CONFIG_VALUE_0="}), b.shell.Env)
+}
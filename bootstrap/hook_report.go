@@ -0,0 +1,172 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/env"
+)
+
+// The name of the hook report artifact
+const hookReportArtifact = "buildkite-hook-report.json"
+
+// What happened with a hook the bootstrap looked for
+const (
+	hookStatusMissing  = "missing"
+	hookStatusDisabled = "disabled"
+	hookStatusPassed   = "passed"
+	hookStatusFailed   = "failed"
+)
+
+// hookRecord is a hook the bootstrap looked for, and what happened when it
+// ran if it existed
+type hookRecord struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Plugin string `json:"plugin,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Exists bool   `json:"exists"`
+	Status string `json:"status"`
+
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	Duration   float64    `json:"duration_seconds,omitempty"`
+	ExitStatus *int       `json:"exit_status,omitempty"`
+
+	// The names of the environment variables the hook set, changed or unset
+	ChangedEnv []string `json:"changed_env,omitempty"`
+}
+
+// hookSource returns where a hook came from, using the documented names for
+// the agent and repository hooks
+func hookSource(scope string) string {
+	switch scope {
+	case "global":
+		return "agent"
+	case "local":
+		return "repository"
+	}
+	return scope
+}
+
+// recordSkippedHook records a hook that didn't run, either because it doesn't
+// exist or because it isn't allowed to
+func (b *Bootstrap) recordSkippedHook(scope, name, pluginName, path, status string) {
+	b.hookRecords = append(b.hookRecords, hookRecord{
+		Name:   name,
+		Source: hookSource(scope),
+		Plugin: pluginName,
+		Path:   path,
+		Exists: status != hookStatusMissing,
+		Status: status,
+	})
+}
+
+// recordHookRun records a hook that ran, and how it went
+func (b *Bootstrap) recordHookRun(hookCfg HookConfig, startedAt time.Time, err error, changes env.Diff) {
+	rec := hookRecord{
+		Name:      hookCfg.Name,
+		Source:    hookSource(hookCfg.Scope),
+		Plugin:    hookCfg.PluginName,
+		Path:      hookCfg.Path,
+		Exists:    true,
+		Status:    hookStatusPassed,
+		StartedAt: &startedAt,
+		Duration:  time.Since(startedAt).Seconds(),
+	}
+
+	exitStatus := 0
+	if err != nil {
+		rec.Status = hookStatusFailed
+		exitStatus = shell.GetExitCode(err)
+	}
+	rec.ExitStatus = &exitStatus
+
+	for k := range changes.Added {
+		rec.ChangedEnv = append(rec.ChangedEnv, k)
+	}
+	for k := range changes.Changed {
+		rec.ChangedEnv = append(rec.ChangedEnv, k)
+	}
+	for k := range changes.Removed {
+		rec.ChangedEnv = append(rec.ChangedEnv, k)
+	}
+	sort.Strings(rec.ChangedEnv)
+
+	b.hookRecords = append(b.hookRecords, rec)
+}
+
+// reportHooks shows the hooks that ran in the job log, and uploads a report of
+// every hook that was looked for as an artifact
+func (b *Bootstrap) reportHooks() {
+	if !b.HookReport {
+		return
+	}
+
+	b.shell.Headerf("Hook report")
+
+	missing := 0
+	for _, rec := range b.hookRecords {
+		if !rec.Exists {
+			missing++
+			continue
+		}
+
+		source := rec.Source
+		if rec.Plugin != "" {
+			source += " " + rec.Plugin
+		}
+
+		line := fmt.Sprintf("%s %s hook (%s) %s", source, rec.Name, rec.Path, rec.Status)
+		if rec.StartedAt != nil {
+			line += fmt.Sprintf(" in %.2fs", rec.Duration)
+		}
+		if rec.ExitStatus != nil && *rec.ExitStatus != 0 {
+			line += fmt.Sprintf(" with exit status %d", *rec.ExitStatus)
+		}
+		if len(rec.ChangedEnv) > 0 {
+			line += ", changing " + strings.Join(rec.ChangedEnv, ", ")
+		}
+		b.shell.Printf("%s", line)
+	}
+	if missing > 0 {
+		b.shell.Commentf("%d other hooks were looked for but didn't exist, see %s for them", missing, hookReportArtifact)
+	}
+
+	if err := b.uploadHookReport(); err != nil {
+		b.shell.Warningf("Failed to upload the hook report: %v", err)
+	}
+}
+
+// uploadHookReport uploads the hook records as a JSON artifact
+func (b *Bootstrap) uploadHookReport() error {
+	data, err := json.MarshalIndent(struct {
+		Hooks []hookRecord `json:"hooks"`
+	}{b.hookRecords}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "buildkite-hook-report-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, hookReportArtifact), data, 0600); err != nil {
+		return err
+	}
+
+	// Upload from the report's directory, so the artifact has just its name
+	sh := b.shell.WithLogger(b.shell.Logger, b.shell.Writer)
+	if err := sh.Chdir(dir); err != nil {
+		return err
+	}
+	return sh.Run("buildkite-agent", "artifact", "upload", hookReportArtifact)
+}
@@ -0,0 +1,41 @@
+package bootstrap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordingHooks(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{}
+	b.recordSkippedHook("local", "pre-command", "", "/repo/.buildkite/hooks", hookStatusMissing)
+	b.recordSkippedHook("local", "post-command", "", "/repo/.buildkite/hooks/post-command", hookStatusDisabled)
+	b.recordHookRun(HookConfig{Scope: "plugin", Name: "environment", PluginName: "docker", Path: "/plugins/docker/hooks/environment"},
+		time.Now(), &shell.ExitError{Code: 3}, env.Diff{
+			Added:   map[string]string{"LLAMAS": "1"},
+			Changed: map[string]env.DiffPair{"ALPACAS": {Old: "1", New: "2"}},
+			Removed: map[string]struct{}{"BEARS": {}},
+		})
+
+	assert.Len(t, b.hookRecords, 3)
+
+	assert.Equal(t, "repository", b.hookRecords[0].Source)
+	assert.False(t, b.hookRecords[0].Exists)
+	assert.Equal(t, hookStatusMissing, b.hookRecords[0].Status)
+
+	assert.True(t, b.hookRecords[1].Exists)
+	assert.Equal(t, hookStatusDisabled, b.hookRecords[1].Status)
+	assert.Nil(t, b.hookRecords[1].ExitStatus)
+
+	run := b.hookRecords[2]
+	assert.Equal(t, "plugin", run.Source)
+	assert.Equal(t, "docker", run.Plugin)
+	assert.Equal(t, hookStatusFailed, run.Status)
+	assert.Equal(t, 3, *run.ExitStatus)
+	assert.Equal(t, []string{"ALPACAS", "BEARS", "LLAMAS"}, run.ChangedEnv)
+}
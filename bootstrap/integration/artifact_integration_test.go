@@ -3,7 +3,9 @@ package integration
 import (
 	"io/ioutil"
 	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/buildkite/bintest/v3"
 )
@@ -105,3 +107,40 @@ func TestArtifactsUploadAfterCommandHookFails(t *testing.T) {
 
 	tester.CheckMocks(t)
 }
+
+func TestArtifactsUploadAfterTimeoutWithinGracePeriod(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The command in this test uses sleep")
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Mock out the artifact calls
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+	agent.
+		Expect("artifact", "upload", "llamas.txt").
+		AndExitWith(0)
+
+	deadline := time.Now().Add(5 * time.Second).Format(time.RFC3339)
+
+	err = tester.Run(t,
+		"BUILDKITE_ARTIFACT_PATHS=llamas.txt",
+		"BUILDKITE_COMMAND=sleep 60",
+		"BUILDKITE_JOB_DEADLINE="+deadline,
+		"BUILDKITE_CANCEL_ARTIFACT_GRACE_PERIOD=30",
+	)
+	if err == nil {
+		t.Fatal("Expected bootstrap to fail")
+	}
+
+	tester.CheckMocks(t)
+}
@@ -61,6 +61,7 @@ func TestCheckingOutGitHubPullRequestsWithGitMirrorsExperiment(t *testing.T) {
 
 	// But assert which ones are called
 	git.ExpectAll([][]interface{}{
+		{"ls-remote", "--exit-code", "--", tester.Repo.Path, "refs/pull/123/head"},
 		{"clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
 		{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
 		{"clean", "-ffxdq"},
@@ -104,6 +105,7 @@ func TestWithResolvingCommitExperiment(t *testing.T) {
 	// But assert which ones are called
 	if experiments.IsEnabled(`git-mirrors`) {
 		git.ExpectAll([][]interface{}{
+			{"ls-remote", "--exit-code", "--", tester.Repo.Path, "master"},
 			{"clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
 			{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
 			{"clean", "-fdq"},
@@ -115,6 +117,7 @@ func TestWithResolvingCommitExperiment(t *testing.T) {
 		})
 	} else {
 		git.ExpectAll([][]interface{}{
+			{"ls-remote", "--exit-code", "--", tester.Repo.Path, "master"},
 			{"clone", "-v", "--", tester.Repo.Path, "."},
 			{"clean", "-fdq"},
 			{"fetch", "-v", "--", "origin", "master"},
@@ -157,6 +160,7 @@ func TestCheckingOutLocalGitProject(t *testing.T) {
 	// But assert which ones are called
 	if experiments.IsEnabled(`git-mirrors`) {
 		git.ExpectAll([][]interface{}{
+			{"ls-remote", "--exit-code", "--", tester.Repo.Path, "master"},
 			{"clone", "--mirror", "--config", "pack.threads=35", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
 			{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
 			{"clean", "-fdq"},
@@ -167,6 +171,7 @@ func TestCheckingOutLocalGitProject(t *testing.T) {
 		})
 	} else {
 		git.ExpectAll([][]interface{}{
+			{"ls-remote", "--exit-code", "--", tester.Repo.Path, "master"},
 			{"clone", "-v", "--", tester.Repo.Path, "."},
 			{"clean", "-fdq"},
 			{"fetch", "-v", "--", "origin", "master"},
@@ -228,6 +233,7 @@ func TestCheckingOutLocalGitProjectWithSubmodules(t *testing.T) {
 	// But assert which ones are called
 	if experiments.IsEnabled(`git-mirrors`) {
 		git.ExpectAll([][]interface{}{
+			{"ls-remote", "--exit-code", "--", tester.Repo.Path, "master"},
 			{"clone", "--mirror", "-v", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
 			{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
 			{"clean", "-fdq"},
@@ -244,6 +250,7 @@ func TestCheckingOutLocalGitProjectWithSubmodules(t *testing.T) {
 		})
 	} else {
 		git.ExpectAll([][]interface{}{
+			{"ls-remote", "--exit-code", "--", tester.Repo.Path, "master"},
 			{"clone", "-v", "--", tester.Repo.Path, "."},
 			{"clean", "-fdq"},
 			{"submodule", "foreach", "--recursive", "git clean -fdq"},
@@ -312,6 +319,7 @@ func TestCheckingOutLocalGitProjectWithSubmodulesDisabled(t *testing.T) {
 	// But assert which ones are called
 	if experiments.IsEnabled(`git-mirrors`) {
 		git.ExpectAll([][]interface{}{
+			{"ls-remote", "--exit-code", "--", tester.Repo.Path, "master"},
 			{"clone", "--mirror", "-v", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
 			{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
 			{"clean", "-fdq"},
@@ -323,6 +331,7 @@ func TestCheckingOutLocalGitProjectWithSubmodulesDisabled(t *testing.T) {
 		})
 	} else {
 		git.ExpectAll([][]interface{}{
+			{"ls-remote", "--exit-code", "--", tester.Repo.Path, "master"},
 			{"clone", "-v", "--", tester.Repo.Path, "."},
 			{"clean", "-fdq"},
 			{"submodule", "foreach", "--recursive", "git clean -fdq"},
@@ -365,6 +374,7 @@ func TestCheckingOutShallowCloneOfLocalGitProject(t *testing.T) {
 	// But assert which ones are called
 	if experiments.IsEnabled(`git-mirrors`) {
 		git.ExpectAll([][]interface{}{
+			{"ls-remote", "--exit-code", "--", tester.Repo.Path, "master"},
 			{"clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
 			{"clone", "--depth=1", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
 			{"clean", "-fdq"},
@@ -375,6 +385,7 @@ func TestCheckingOutShallowCloneOfLocalGitProject(t *testing.T) {
 		})
 	} else {
 		git.ExpectAll([][]interface{}{
+			{"ls-remote", "--exit-code", "--", tester.Repo.Path, "master"},
 			{"clone", "--depth=1", "--", tester.Repo.Path, "."},
 			{"clean", "-fdq"},
 			{"fetch", "--depth=1", "--", "origin", "master"},
@@ -418,27 +429,91 @@ func TestCheckingOutWithSSHKeyscan(t *testing.T) {
 	defer tester.Close()
 
 	tester.MustMock(t, "ssh-keyscan").
-		Expect("github.com").
-		AndWriteToStdout("github.com ssh-rsa xxx=").
+		Expect("git.example.com").
+		AndWriteToStdout("git.example.com ssh-rsa xxx=").
 		AndExitWith(0)
 
 	git := tester.MustMock(t, "git")
 	git.IgnoreUnexpectedInvocations()
 
 	if experiments.IsEnabled(`git-mirrors`) {
-		git.Expect("clone", "--mirror", "-v", "--", "git@github.com:buildkite/agent.git", bintest.MatchAny()).
+		git.Expect("clone", "--mirror", "-v", "--", "git@git.example.com:buildkite/agent.git", bintest.MatchAny()).
 			AndExitWith(0)
 	} else {
-		git.Expect("clone", "-v", "--", "git@github.com:buildkite/agent.git", ".").
+		git.Expect("clone", "-v", "--", "git@git.example.com:buildkite/agent.git", ".").
 			AndExitWith(0)
 	}
 
+	env := []string{
+		`BUILDKITE_REPO=git@git.example.com:buildkite/agent.git`,
+		`BUILDKITE_SSH_KEYSCAN=true`,
+	}
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckingOutWithSSHKeyscanUsesPinnedKeys(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	tester.MustMock(t, "ssh-keyscan").
+		Expect("github.com").
+		NotCalled()
+
+	git := tester.MustMock(t, "git")
+	git.IgnoreUnexpectedInvocations()
+
 	env := []string{
 		`BUILDKITE_REPO=git@github.com:buildkite/agent.git`,
 		`BUILDKITE_SSH_KEYSCAN=true`,
 	}
 
 	tester.RunAndCheck(t, env...)
+
+	if !strings.Contains(tester.Output, `Added the pinned keys for host "github.com"`) {
+		t.Errorf("Expected the pinned keys for github.com to be added")
+	}
+}
+
+func TestCheckingOutWithStrictHostKeysRefusesUnknownHosts(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	tester.MustMock(t, "ssh-keyscan").
+		Expect("git.example.com").
+		NotCalled()
+
+	git := tester.MustMock(t, "git")
+	git.Expect("clone", bintest.MatchAny()).NotCalled()
+	git.IgnoreUnexpectedInvocations()
+
+	tester.ExpectGlobalHook("command").NotCalled()
+
+	env := []string{
+		`BUILDKITE_REPO=git@git.example.com:buildkite/agent.git`,
+		`BUILDKITE_SSH_KEYSCAN=true`,
+		`BUILDKITE_SSH_STRICT_HOST_KEYS=true`,
+	}
+
+	if err = tester.Run(t, env...); err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	if !strings.Contains(tester.Output, "git.example.com isn't a known SSH host") {
+		t.Errorf("Expected output to say the host isn't known")
+	}
+
+	tester.CheckMocks(t)
 }
 
 func TestCheckingOutWithoutSSHKeyscan(t *testing.T) {
@@ -649,6 +724,90 @@ func TestCheckoutDoesNotRetryOnHookFailure(t *testing.T) {
 	tester.CheckMocks(t)
 }
 
+func TestCheckoutFailsWithoutRetryingWhenBranchIsMissing(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	git := tester.MustMock(t, "git").PassthroughToLocalCommand()
+	git.Expect("ls-remote", "--exit-code", "--", tester.Repo.Path, "deleted-branch").Once()
+	git.IgnoreUnexpectedInvocations()
+
+	tester.ExpectGlobalHook("command").NotCalled()
+	tester.ExpectGlobalHook("pre-exit").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `BUILDKITE_FAILURE_REASON=ref_missing`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	if err = tester.Run(t, "BUILDKITE_BRANCH=deleted-branch"); err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	if !strings.Contains(tester.Output, "deleted-branch doesn't exist") {
+		t.Errorf("Expected output to say the branch doesn't exist")
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestCheckoutFailsWhenCommitIsMissing(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	tester.ExpectGlobalHook("command").NotCalled()
+	tester.ExpectGlobalHook("pre-exit").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `BUILDKITE_FAILURE_REASON=ref_missing`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	const commit = "1234567890abcdef1234567890abcdef12345678"
+	if err = tester.Run(t, "BUILDKITE_COMMIT="+commit); err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	if !strings.Contains(tester.Output, commit+" doesn't exist") {
+		t.Errorf("Expected output to say the commit doesn't exist")
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestCheckoutSkipsJobWhenBranchIsMissingAndSkippingIsEnabled(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	tester.ExpectGlobalHook("command").NotCalled()
+	tester.ExpectGlobalHook("pre-exit").Once()
+
+	tester.RunAndCheck(t, "BUILDKITE_BRANCH=deleted-branch", "BUILDKITE_GIT_SKIP_MISSING_REFS=true")
+
+	if !strings.Contains(tester.Output, "Skipping the rest of the job") {
+		t.Errorf("Expected output to say the job was skipped")
+	}
+}
+
 func TestRepositorylessCheckout(t *testing.T) {
 	t.Parallel()
 
@@ -715,6 +874,7 @@ func TestGitMirrorEnv(t *testing.T) {
 	// But assert which ones are called
 	if experiments.IsEnabled(`git-mirrors`) {
 		git.ExpectAll([][]interface{}{
+			{"ls-remote", "--exit-code", "--", tester.Repo.Path, "master"},
 			{"clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
 			{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
 			{"clean", "-fdq"},
@@ -725,6 +885,7 @@ func TestGitMirrorEnv(t *testing.T) {
 		})
 	} else {
 		git.ExpectAll([][]interface{}{
+			{"ls-remote", "--exit-code", "--", tester.Repo.Path, "master"},
 			{"clone", "-v", "--", tester.Repo.Path, "."},
 			{"clean", "-fdq"},
 			{"fetch", "-v", "--", "origin", "master"},
@@ -1,7 +1,9 @@
 package integration
 
 import (
+	"fmt"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/bintest/v3"
@@ -72,3 +74,45 @@ func TestPreExitHooksRunsAfterCommandFails(t *testing.T) {
 
 	tester.CheckMocks(t)
 }
+
+func TestCommandDoesntRunWithInvalidEnvironment(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	tester.ExpectGlobalHook("command").NotCalled()
+	tester.ExpectGlobalHook("pre-exit").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `BUILDKITE_FAILURE_REASON=env_invalid`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	err = tester.Run(t,
+		`BUILDKITE_ENV_SCHEMA={"REPLICAS": {"type": "int"}, "DEPLOY_TARGET": {}}`,
+		"REPLICAS=three",
+	)
+	if err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	for _, problem := range []string{"DEPLOY_TARGET is required, but isn't set", "REPLICAS must be an integer"} {
+		if !strings.Contains(tester.Output, problem) {
+			t.Errorf("Expected output to contain %q", problem)
+		}
+	}
+
+	tester.CheckMocks(t)
+}
@@ -1,6 +1,7 @@
 package integration
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
@@ -336,6 +337,67 @@ func TestPreExitHooksFireAfterCommandFailures(t *testing.T) {
 	tester.CheckMocks(t)
 }
 
+func TestPreExitHooksGetFailureReason(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	tester.ExpectGlobalHook("pre-exit").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `BUILDKITE_FAILURE_REASON=command_failed`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	if err = tester.Run(t, "BUILDKITE_COMMAND=false"); err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestJobDeadlineStopsCommand(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The command in this test uses sleep")
+	}
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	tester.ExpectGlobalHook("pre-exit").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `BUILDKITE_FAILURE_REASON=timed_out`, `BUILDKITE_JOB_SECONDS_REMAINING=0`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	deadline := time.Now().Add(5 * time.Second).Format(time.RFC3339)
+	started := time.Now()
+
+	if err = tester.Run(t, "BUILDKITE_COMMAND=sleep 60", "BUILDKITE_JOB_DEADLINE="+deadline); err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	if elapsed := time.Since(started); elapsed > 30*time.Second {
+		t.Fatalf("Expected the command to stop at the deadline, but it took %v", elapsed)
+	}
+
+	tester.CheckMocks(t)
+}
+
 func TestPreExitHooksFireAfterHookFailures(t *testing.T) {
 	t.Parallel()
 
@@ -504,3 +566,92 @@ func TestPreExitHooksFireAfterCancel(t *testing.T) {
 
 	tester.CheckMocks(t)
 }
+
+func TestHookReportListsHooksAndTheEnvironmentTheyChanged(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not tested on windows yet")
+	}
+
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	var script = []string{
+		"#!/bin/bash",
+		"export LLAMAS_ROCK=absolutely",
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tester.HooksDir, "environment"),
+		[]byte(strings.Join(script, "\n")), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	var report struct {
+		Hooks []struct {
+			Name       string   `json:"name"`
+			Source     string   `json:"source"`
+			Exists     bool     `json:"exists"`
+			Status     string   `json:"status"`
+			ExitStatus *int     `json:"exit_status"`
+			ChangedEnv []string `json:"changed_env"`
+		} `json:"hooks"`
+	}
+
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		Optionally().
+		AndExitWith(0)
+	agent.
+		Expect("artifact", "upload", "buildkite-hook-report.json").
+		AndExitWith(0).
+		AndCallFunc(func(c *bintest.Call) {
+			data, err := ioutil.ReadFile(filepath.Join(c.Dir, "buildkite-hook-report.json"))
+			if err != nil {
+				fmt.Fprintln(c.Stderr, err)
+				c.Exit(1)
+				return
+			}
+			if err := json.Unmarshal(data, &report); err != nil {
+				fmt.Fprintln(c.Stderr, err)
+				c.Exit(1)
+				return
+			}
+			c.Exit(0)
+		})
+
+	tester.RunAndCheck(t, "BUILDKITE_HOOK_REPORT=true")
+
+	if !strings.Contains(tester.Output, "Hook report") {
+		t.Fatalf("Expected a hook report in the output")
+	}
+	if !strings.Contains(tester.Output, "agent environment hook") || !strings.Contains(tester.Output, "changing LLAMAS_ROCK") {
+		t.Fatalf("Expected the report to show the environment hook exporting LLAMAS_ROCK")
+	}
+
+	var found, missing bool
+	for _, h := range report.Hooks {
+		if h.Source == "agent" && h.Name == "environment" {
+			found = true
+			if !h.Exists || h.Status != "passed" || h.ExitStatus == nil || *h.ExitStatus != 0 {
+				t.Errorf("Unexpected record for the environment hook: %+v", h)
+			}
+			if len(h.ChangedEnv) != 1 || h.ChangedEnv[0] != "LLAMAS_ROCK" {
+				t.Errorf("Expected the environment hook to have changed LLAMAS_ROCK, got %v", h.ChangedEnv)
+			}
+		}
+		if h.Source == "repository" && h.Name == "pre-command" && !h.Exists && h.Status == "missing" {
+			missing = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the agent environment hook in the report, got %+v", report.Hooks)
+	}
+	if !missing {
+		t.Errorf("Expected the missing repository pre-command hook in the report, got %+v", report.Hooks)
+	}
+}
@@ -13,13 +13,18 @@ import (
 )
 
 func TestMain(m *testing.M) {
-	// If we are passed "bootstrap", execute like the bootstrap cli
-	if len(os.Args) > 1 && os.Args[1] == `bootstrap` {
+	// If we are passed "bootstrap", execute like the bootstrap cli. The
+	// bootstrap also runs "env dump" on itself to capture hook environments.
+	if len(os.Args) > 1 && (os.Args[1] == `bootstrap` || os.Args[1] == `env`) {
 		app := cli.NewApp()
 		app.Name = "buildkite-agent"
 		app.Version = agent.Version()
 		app.Commands = []cli.Command{
 			clicommand.BootstrapCommand,
+			{
+				Name:        "env",
+				Subcommands: []cli.Command{clicommand.EnvDumpCommand},
+			},
 		}
 
 		if err := app.Run(os.Args); err != nil {
@@ -211,6 +211,362 @@ func TestOverlappingPluginHooks(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestIsolatedPluginsOnlyShareSharedEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not tested on windows yet")
+	}
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	mockA := tester.MustMock(t, "plugin-a")
+	pluginA := createTestPlugin(t, map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"export PLUGIN_A_PRIVATE=llamas",
+			"export SHARED_TOKEN=alpacas",
+			`pwd > "$HOOK_DIR_FILE"`,
+		},
+		"post-command": {
+			"#!/bin/bash",
+			mockA.Path + " post-command",
+		},
+	})
+
+	mockB := tester.MustMock(t, "plugin-b")
+	pluginB := createTestPlugin(t, map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			mockB.Path + " environment",
+		},
+	})
+
+	// Fails the call if the variable is set
+	notSet := func(c *bintest.Call, name string) bool {
+		for _, e := range c.Env {
+			if strings.HasPrefix(e, name+"=") {
+				fmt.Fprintf(c.Stderr, "Expected %s not to be set\n", name)
+				c.Exit(1)
+				return false
+			}
+		}
+		return true
+	}
+
+	mockA.Expect("post-command").Once().AndCallFunc(func(c *bintest.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `PLUGIN_A_PRIVATE=llamas`, `SHARED_TOKEN=alpacas`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		} else {
+			c.Exit(0)
+		}
+	})
+
+	mockB.Expect("environment").Once().AndCallFunc(func(c *bintest.Call) {
+		if !notSet(c, "PLUGIN_A_PRIVATE") {
+			return
+		}
+		for _, e := range c.Env {
+			if strings.HasPrefix(e, "BUILDKITE_PLUGINS=") && strings.Contains(e, pluginA.Path) {
+				fmt.Fprintf(c.Stderr, "Expected plugin b not to see plugin a's configuration\n")
+				c.Exit(1)
+				return
+			}
+		}
+		if err := bintest.ExpectEnv(t, c.Env, `SHARED_TOKEN=alpacas`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+			return
+		}
+		if c.Dir == tester.CheckoutDir() {
+			fmt.Fprintf(c.Stderr, "Expected plugin b not to run in the checkout\n")
+			c.Exit(1)
+			return
+		}
+		c.Exit(0)
+	})
+
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if notSet(c, "PLUGIN_A_PRIVATE") {
+			c.Exit(0)
+		}
+	})
+
+	pluginsJSON, err := json.Marshal([]*testPlugin{pluginA, pluginB})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hookDirFile := filepath.Join(t.TempDir(), "hook-dir")
+
+	env := []string{
+		`BUILDKITE_PLUGINS=` + string(pluginsJSON),
+		`BUILDKITE_ISOLATE_PLUGINS=true`,
+		`BUILDKITE_PLUGINS_SHARED_ENV=SHARED_*`,
+		`HOOK_DIR_FILE=` + hookDirFile,
+	}
+
+	tester.RunAndCheck(t, env...)
+
+	hookDir, err := ioutil.ReadFile(hookDirFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(hookDir)) == tester.CheckoutDir() {
+		t.Errorf("Expected plugin a not to run in the checkout")
+	}
+}
+
+func TestPluginConfigurationIsValidatedBeforeHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not tested on windows yet")
+	}
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name       string
+		validation string
+	}{
+		{"with plugin validation", "true"},
+		{"without plugin validation", "false"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tester.Close()
+
+			pluginMock := tester.MustMock(t, "my-plugin")
+			p := createTestPlugin(t, map[string][]string{
+				"environment": {
+					"#!/bin/bash",
+					pluginMock.Path + " environment",
+				},
+			})
+
+			// The test plugin is configured with a "settings" key that its
+			// schema doesn't allow
+			definition := strings.Join([]string{
+				"name: my-plugin",
+				"configuration:",
+				"  properties:",
+				"    image:",
+				"      type: string",
+				"  additionalProperties: false",
+			}, "\n")
+			if err := ioutil.WriteFile(filepath.Join(p.Path, "plugin.yml"), []byte(definition), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Add("."); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Commit("Add a plugin definition"); err != nil {
+				t.Fatal(err)
+			}
+			if p.versionTag, err = p.RevParse("HEAD"); err != nil {
+				t.Fatal(err)
+			}
+
+			json, err := p.ToJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := []string{
+				`BUILDKITE_PLUGINS=` + json,
+				`BUILDKITE_PLUGIN_VALIDATION=` + tc.validation,
+			}
+
+			if tc.validation == "true" {
+				pluginMock.Expect("environment").NotCalled()
+				tester.ExpectGlobalHook("command").NotCalled()
+
+				if err = tester.Run(t, env...); err == nil {
+					t.Fatal("Expected the bootstrap to fail")
+				}
+				tester.CheckMocks(t)
+			} else {
+				pluginMock.Expect("environment").Once()
+				tester.RunAndCheck(t, env...)
+			}
+
+			if !strings.Contains(tester.Output, `unknown key "settings" (expected one of image)`) {
+				t.Errorf("Expected output to describe the unknown key")
+			}
+		})
+	}
+}
+
+func TestPluginsAreFetchedTogetherAndRunInOrder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not tested on windows yet")
+	}
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	orderFile := filepath.Join(t.TempDir(), "order")
+
+	var plugins []*testPlugin
+	for _, name := range []string{"a", "b", "c"} {
+		plugins = append(plugins, createTestPlugin(t, map[string][]string{
+			"environment": {
+				"#!/bin/bash",
+				"echo " + name + ` >> "$ORDER_FILE"`,
+			},
+		}))
+	}
+
+	// The first plugin is used twice, but only needs fetching once
+	plugins = append(plugins, plugins[0])
+
+	pluginsJSON, err := json.Marshal(plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := []string{
+		`BUILDKITE_PLUGINS=` + string(pluginsJSON),
+		`ORDER_FILE=` + orderFile,
+	}
+
+	tester.RunAndCheck(t, env...)
+
+	order, err := ioutil.ReadFile(orderFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(order) != "a\nb\nc\na\n" {
+		t.Errorf("Expected the plugin hooks to run in the order they were declared, got %q", order)
+	}
+
+	if strings.Count(tester.Output, "was already checked out for an earlier plugin") != 1 {
+		t.Errorf("Expected the repeated plugin to only be fetched once")
+	}
+}
+
+func TestVendoredPluginsRunInDeclaredOrder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not tested on windows yet")
+	}
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	orderFile := filepath.Join(t.TempDir(), "order")
+
+	// Vendor a plugin in the repository being checked out
+	hooksDir := filepath.Join(tester.Repo.Path, ".buildkite", "plugins", "llamas", "hooks")
+	if err := os.MkdirAll(hooksDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"pre-checkout", "environment", "post-checkout", "pre-command"} {
+		hook := "#!/bin/bash\necho vendored-" + name + ` >> "$ORDER_FILE"` + "\n"
+		if err := ioutil.WriteFile(filepath.Join(hooksDir, name), []byte(hook), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tester.Repo.Add("."); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Repo.Commit("Vendor a plugin"); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := createTestPlugin(t, map[string][]string{
+		"pre-command": {
+			"#!/bin/bash",
+			`echo remote-pre-command >> "$ORDER_FILE"`,
+		},
+	})
+
+	remoteJSON, err := remote.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := []string{
+		`BUILDKITE_PLUGINS=[{"./.buildkite/plugins/llamas":{}},` + string(remoteJSON) + `]`,
+		`ORDER_FILE=` + orderFile,
+	}
+
+	tester.RunAndCheck(t, env...)
+
+	order, err := ioutil.ReadFile(orderFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "vendored-environment\nvendored-post-checkout\nvendored-pre-command\nremote-pre-command\n"
+	if string(order) != expected {
+		t.Errorf("Expected the plugin hooks to run as %q, got %q", expected, order)
+	}
+
+	if !strings.Contains(tester.Output, "The pre-checkout hook of vendored plugin ./.buildkite/plugins/llamas won't run") {
+		t.Errorf("Expected a warning that the vendored pre-checkout hook won't run")
+	}
+}
+
+func TestVendoredPluginsCantBeSymlinkedOutsideTheCheckout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not tested on windows yet")
+	}
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	outside := createTestPlugin(t, map[string][]string{
+		"environment": {
+			"#!/bin/bash",
+			"exit 0",
+		},
+	})
+
+	if err := os.MkdirAll(filepath.Join(tester.Repo.Path, ".buildkite"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside.Path, filepath.Join(tester.Repo.Path, ".buildkite", "outside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Repo.Add("."); err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.Repo.Commit("Symlink a plugin from outside the repository"); err != nil {
+		t.Fatal(err)
+	}
+
+	tester.ExpectGlobalHook("command").NotCalled()
+
+	if err = tester.Run(t, `BUILDKITE_PLUGINS=[{"./.buildkite/outside":{}}]`); err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	if !strings.Contains(tester.Output, "Vendored plugin paths must be within the checked-out repository") {
+		t.Errorf("Expected output to say the plugin must be within the checkout")
+	}
+
+	tester.CheckMocks(t)
+}
+
 func TestPluginCloneRetried(t *testing.T) {
 	if runtime.GOOS == `windows` {
 		t.Skip("Not passing on windows, needs investigation")
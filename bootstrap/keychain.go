@@ -0,0 +1,200 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/buildkite/agent/v3/utils"
+)
+
+// The file extensions of provisioning profiles for iOS and macOS
+var provisioningProfileExts = []string{".mobileprovision", ".provisionprofile"}
+
+// macOSSigning keeps track of what the bootstrap changed to prepare for code
+// signing, so it can be put back the way it was when the job finishes
+type macOSSigning struct {
+	// The user keychain search list before we added the job's keychain
+	originalSearchList []string
+
+	// Whether we unlocked the keychain, and need to lock it again
+	unlocked bool
+
+	// Provisioning profiles that were copied in for the job
+	installedProfiles []string
+}
+
+// setUpMacOSSigning unlocks the configured keychain, adds it to the keychain
+// search list and installs provisioning profiles, so that jobs can sign code
+// without every pipeline having to do it themselves
+func (b *Bootstrap) setUpMacOSSigning() error {
+	if b.MacOSKeychain == "" && b.MacOSProvisioningProfiles == "" {
+		return nil
+	}
+
+	if runtime.GOOS != "darwin" {
+		b.shell.Warningf("Keychain and provisioning profile options are only supported on macOS, ignoring them")
+		return nil
+	}
+
+	b.shell.Headerf("Preparing for code signing")
+
+	if b.MacOSKeychain != "" {
+		if err := b.setUpKeychain(); err != nil {
+			return err
+		}
+	}
+
+	if b.MacOSProvisioningProfiles != "" {
+		if err := b.installProvisioningProfiles(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Bootstrap) setUpKeychain() error {
+	keychain := b.MacOSKeychain
+
+	if b.MacOSKeychainPasswordFile != "" {
+		contents, err := ioutil.ReadFile(b.MacOSKeychainPasswordFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read keychain password file: %v", err)
+		}
+		password := strings.TrimRight(string(contents), "\r\n")
+
+		// Run these without the usual prompt, so the password isn't shown
+		b.shell.Promptf("security unlock-keychain -p [REDACTED] %q", keychain)
+		if err := b.shell.RunWithoutPrompt("security", "unlock-keychain", "-p", password, keychain); err != nil {
+			return fmt.Errorf("Failed to unlock keychain %q: %v", keychain, err)
+		}
+		b.signing.unlocked = true
+
+		// Let codesign use the keys without asking for permission in a
+		// dialog that nobody will ever see
+		b.shell.Promptf("security set-key-partition-list -S apple-tool:,apple:,codesign: -s -k [REDACTED] %q", keychain)
+		if err := b.shell.RunWithoutPrompt("security", "set-key-partition-list", "-S", "apple-tool:,apple:,codesign:", "-s", "-k", password, keychain); err != nil {
+			return fmt.Errorf("Failed to allow codesign to use keychain %q: %v", keychain, err)
+		}
+	}
+
+	out, err := b.shell.RunAndCapture("security", "list-keychains", "-d", "user")
+	if err != nil {
+		return fmt.Errorf("Failed to list keychains: %v", err)
+	}
+	b.signing.originalSearchList = parseKeychainList(out)
+
+	// Put the job's keychain first, so it's searched for identities before
+	// any others
+	searchList := []string{keychain}
+	for _, k := range b.signing.originalSearchList {
+		if k != keychain {
+			searchList = append(searchList, k)
+		}
+	}
+
+	args := append([]string{"list-keychains", "-d", "user", "-s"}, searchList...)
+	if err := b.shell.Run("security", args...); err != nil {
+		return fmt.Errorf("Failed to add keychain %q to the search list: %v", keychain, err)
+	}
+
+	return nil
+}
+
+func (b *Bootstrap) installProvisioningProfiles() error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+
+	dest := filepath.Join(home, "Library", "MobileDevice", "Provisioning Profiles")
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return fmt.Errorf("Failed to create provisioning profiles directory: %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(b.MacOSProvisioningProfiles)
+	if err != nil {
+		return fmt.Errorf("Failed to read provisioning profiles: %v", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !isProvisioningProfile(entry.Name()) {
+			continue
+		}
+
+		target := filepath.Join(dest, entry.Name())
+
+		// Don't touch profiles that were installed some other way
+		if utils.FileExists(target) {
+			b.shell.Commentf("Provisioning profile %s is already installed", entry.Name())
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(filepath.Join(b.MacOSProvisioningProfiles, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(target, contents, 0o644); err != nil {
+			return fmt.Errorf("Failed to install provisioning profile %s: %v", entry.Name(), err)
+		}
+
+		b.shell.Commentf("Installed provisioning profile %s", entry.Name())
+		b.signing.installedProfiles = append(b.signing.installedProfiles, target)
+	}
+
+	return nil
+}
+
+// tearDownMacOSSigning puts the keychain search list back, locks the keychain
+// and removes provisioning profiles installed for the job. Failures are only
+// warnings, since the job has already finished.
+func (b *Bootstrap) tearDownMacOSSigning() {
+	if len(b.signing.originalSearchList) > 0 {
+		args := append([]string{"list-keychains", "-d", "user", "-s"}, b.signing.originalSearchList...)
+		if err := b.shell.Run("security", args...); err != nil {
+			b.shell.Warningf("Failed to restore the keychain search list: %v", err)
+		}
+		b.signing.originalSearchList = nil
+	}
+
+	if b.signing.unlocked {
+		if err := b.shell.Run("security", "lock-keychain", b.MacOSKeychain); err != nil {
+			b.shell.Warningf("Failed to lock keychain %q: %v", b.MacOSKeychain, err)
+		}
+		b.signing.unlocked = false
+	}
+
+	for _, profile := range b.signing.installedProfiles {
+		if err := os.Remove(profile); err != nil {
+			b.shell.Warningf("Failed to remove provisioning profile %s: %v", profile, err)
+		}
+	}
+	b.signing.installedProfiles = nil
+}
+
+// parseKeychainList parses the output of `security list-keychains`, which
+// is a quoted path per line
+func parseKeychainList(out string) []string {
+	var keychains []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.Trim(strings.TrimSpace(line), `"`)
+		if line != "" {
+			keychains = append(keychains, line)
+		}
+	}
+	return keychains
+}
+
+func isProvisioningProfile(name string) bool {
+	for _, ext := range provisioningProfileExts {
+		if strings.EqualFold(filepath.Ext(name), ext) {
+			return true
+		}
+	}
+	return false
+}
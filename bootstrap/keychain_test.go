@@ -0,0 +1,30 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeychainList(t *testing.T) {
+	t.Parallel()
+
+	out := `    "/Users/llama/Library/Keychains/login.keychain-db"
+    "/Users/llama/Library/Keychains/build signing.keychain-db"
+`
+
+	assert.Equal(t, []string{
+		"/Users/llama/Library/Keychains/login.keychain-db",
+		"/Users/llama/Library/Keychains/build signing.keychain-db",
+	}, parseKeychainList(out))
+
+	assert.Empty(t, parseKeychainList(""))
+}
+
+func TestIsProvisioningProfile(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, isProvisioningProfile("App_Store.mobileprovision"))
+	assert.True(t, isProvisioningProfile("Mac.PROVISIONPROFILE"))
+	assert.False(t, isProvisioningProfile("README.md"))
+}
@@ -3,6 +3,7 @@ package bootstrap
 import (
 	"bufio"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -89,11 +90,25 @@ func (kh *knownHosts) Contains(host string) (bool, error) {
 	return false, nil
 }
 
+// Add makes sure the host is in the known_hosts file, using its pinned keys
+// if it has them and ssh-keyscan if it doesn't
 func (kh *knownHosts) Add(host string) error {
+	_, err := kh.add(host, true)
+	return err
+}
+
+// AddPinned makes sure the host is in the known_hosts file if it's already
+// there or has pinned keys, without trusting whatever keys it offers. It
+// returns whether the host is known.
+func (kh *knownHosts) AddPinned(host string) (bool, error) {
+	return kh.add(host, false)
+}
+
+func (kh *knownHosts) add(host string, keyscan bool) (bool, error) {
 	// Use a lockfile to prevent parallel processes stepping on each other
 	lock, err := kh.Shell.LockFile(kh.Path+".lock", time.Second*30)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer func() {
 		if err := lock.Unlock(); err != nil {
@@ -104,17 +119,79 @@ func (kh *knownHosts) Add(host string) error {
 	// If the keygen output already contains the host, we can skip!
 	if contains, _ := kh.Contains(host); contains {
 		kh.Shell.Commentf("Host %q already in list of known hosts at \"%s\"", host, kh.Path)
-		return nil
+		return true, nil
+	}
+
+	var entries string
+	if keys, ok := pinnedKeysFor(host); ok {
+		for _, key := range keys {
+			entries += fmt.Sprintf("%s %s\n", knownhosts.Normalize(host), key)
+		}
+		kh.Shell.Commentf("Added the pinned keys for host %q to known hosts at \"%s\"", host, kh.Path)
+	} else if keyscan {
+		// Scan the key and then write it to the known_host file
+		keyscanOutput, err := sshKeyScan(kh.Shell, host)
+		if err != nil {
+			return false, errors.Wrap(err, "Could not perform `ssh-keyscan`")
+		}
+		entries = keyscanOutput + "\n"
+		kh.Shell.Commentf("Added host %q to known hosts at \"%s\"", host, kh.Path)
+	} else {
+		return false, nil
+	}
+
+	if err := kh.append(entries); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AddMatchingSSHFP adds the keys the host offers that match its SSHFP records
+// in DNS to the known_hosts file. It returns whether any of them matched.
+func (kh *knownHosts) AddMatchingSSHFP(host string) (bool, error) {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	records, err := lookupSSHFP(hostname)
+	if err != nil {
+		return false, errors.Wrapf(err, "Could not look up the SSHFP records for %q", hostname)
+	}
+	if len(records) == 0 {
+		return false, nil
 	}
 
-	// Scan the key and then write it to the known_host file
 	keyscanOutput, err := sshKeyScan(kh.Shell, host)
 	if err != nil {
-		return errors.Wrap(err, "Could not perform `ssh-keyscan`")
+		return false, errors.Wrap(err, "Could not perform `ssh-keyscan`")
+	}
+
+	matched := matchingSSHFPKeys(keyscanOutput, records)
+	if len(matched) == 0 {
+		return false, nil
+	}
+
+	lock, err := kh.Shell.LockFile(kh.Path+".lock", time.Second*30)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := lock.Unlock(); err != nil {
+			kh.Shell.Warningf("Failed to release known_hosts file lock: %#v", err)
+		}
+	}()
+
+	if err := kh.append(strings.Join(matched, "\n") + "\n"); err != nil {
+		return false, err
 	}
 
-	kh.Shell.Commentf("Added host %q to known hosts at \"%s\"", host, kh.Path)
+	kh.Shell.Commentf("Added the keys for host %q that match its SSHFP records to known hosts at \"%s\"", host, kh.Path)
+	return true, nil
+}
 
+// append adds entries to the end of the known_hosts file
+func (kh *knownHosts) append(entries string) error {
 	// Try and open the existing hostfile in (append_only) mode
 	f, err := os.OpenFile(kh.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0700)
 	if err != nil {
@@ -122,7 +199,7 @@ func (kh *knownHosts) Add(host string) error {
 	}
 	defer f.Close()
 
-	if _, err = fmt.Fprintf(f, "%s\n", keyscanOutput); err != nil {
+	if _, err = f.WriteString(entries); err != nil {
 		return errors.Wrapf(err, "Could not write to %q", kh.Path)
 	}
 
@@ -150,3 +227,51 @@ func (kh *knownHosts) AddFromRepository(repository string) error {
 
 	return nil
 }
+
+// unknownHostError is returned when strict host key checking is on and the
+// repository host isn't a known host
+type unknownHostError struct {
+	Host string
+
+	// Whether the host's keys were checked against its SSHFP records
+	DNS bool
+}
+
+func (e *unknownHostError) Error() string {
+	if e.DNS {
+		return fmt.Sprintf("%s isn't a known SSH host, none of its keys match its SSHFP records in DNS, and strict host key checking is on. Add its keys to the agent's known_hosts file, or give it a known_hosts file of its own with --git-ssh-hosts.", e.Host)
+	}
+	return fmt.Sprintf("%s isn't a known SSH host, and strict host key checking is on. Add its keys to the agent's known_hosts file, or give it a known_hosts file of its own with --git-ssh-hosts.", e.Host)
+}
+
+// checkRepositoryHostIsKnown makes sure ssh will trust the host of an SSH
+// repository without trusting it on first use, for strict host key checking.
+// The major git hosts have their pinned keys added, but other hosts need to be
+// known already, or offer a key that matches their SSHFP records in DNS.
+func checkRepositoryHostIsKnown(sh *shell.Shell, repository string, dns bool) error {
+	u, err := parseGittableURL(repository)
+	if err != nil || u.Scheme != "ssh" {
+		return nil
+	}
+
+	kh, err := findKnownHosts(sh)
+	if err != nil {
+		return err
+	}
+
+	host := resolveGitHost(sh, u.Host)
+	known, err := kh.AddPinned(host)
+	if err != nil || known {
+		return err
+	}
+
+	if dns {
+		sh.Commentf("Host %q isn't known, checking its keys against its SSHFP records in DNS", host)
+		matched, err := kh.AddMatchingSSHFP(host)
+		if err != nil || matched {
+			return err
+		}
+	}
+
+	return &unknownHostError{Host: host, DNS: dns}
+}
@@ -0,0 +1,192 @@
+package bootstrap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The DNS record type for SSH host key fingerprints, see RFC 4255
+const typeSSHFP = dnsmessage.Type(44)
+
+// How long to wait for a DNS server to answer an SSHFP lookup
+var sshfpLookupTimeout = 5 * time.Second
+
+// The DNS servers to look up SSHFP records with, as host:port
+var sshfpResolvers = systemResolvers
+
+// The SSHFP algorithm numbers for each SSH key type, see RFC 4255, RFC 6594
+// and RFC 7479
+var sshfpAlgorithms = map[string]uint8{
+	ssh.KeyAlgoRSA:      1,
+	ssh.KeyAlgoDSA:      2,
+	ssh.KeyAlgoECDSA256: 3,
+	ssh.KeyAlgoECDSA384: 3,
+	ssh.KeyAlgoECDSA521: 3,
+	ssh.KeyAlgoED25519:  4,
+}
+
+// sshfpRecord is a fingerprint of one of a host's keys, published in DNS
+type sshfpRecord struct {
+	Algorithm   uint8
+	Type        uint8
+	Fingerprint []byte
+}
+
+// Matches returns whether the record is a fingerprint of the key
+func (r sshfpRecord) Matches(key ssh.PublicKey) bool {
+	if algorithm, ok := sshfpAlgorithms[key.Type()]; !ok || algorithm != r.Algorithm {
+		return false
+	}
+
+	switch r.Type {
+	case 1:
+		sum := sha1.Sum(key.Marshal())
+		return bytes.Equal(sum[:], r.Fingerprint)
+	case 2:
+		sum := sha256.Sum256(key.Marshal())
+		return bytes.Equal(sum[:], r.Fingerprint)
+	default:
+		return false
+	}
+}
+
+// matchingSSHFPKeys returns the lines of ssh-keyscan output with a key that
+// matches one of the records
+func matchingSSHFPKeys(keyscanOutput string, records []sshfpRecord) []string {
+	var matched []string
+	for _, line := range strings.Split(keyscanOutput, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[1] + " " + fields[2]))
+		if err != nil {
+			continue
+		}
+
+		for _, r := range records {
+			if r.Matches(key) {
+				matched = append(matched, line)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// lookupSSHFP returns the SSHFP records for a hostname, trying each of the
+// DNS servers in turn
+func lookupSSHFP(hostname string) ([]sshfpRecord, error) {
+	resolvers := sshfpResolvers()
+	if len(resolvers) == 0 {
+		return nil, fmt.Errorf("No DNS servers to look up the SSHFP records for %s with", hostname)
+	}
+
+	var err error
+	for _, resolver := range resolvers {
+		var records []sshfpRecord
+		if records, err = querySSHFP(resolver, hostname); err == nil {
+			return records, nil
+		}
+	}
+	return nil, err
+}
+
+// querySSHFP asks a DNS server for the SSHFP records for a hostname
+func querySSHFP(server, hostname string) ([]sshfpRecord, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(hostname, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	query, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: typeSSHFP, Class: dnsmessage.ClassINET},
+		},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("udp", server, sshfpLookupTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(sshfpLookupTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var response dnsmessage.Message
+	if err := response.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	if response.ID != id {
+		return nil, fmt.Errorf("%s answered a different query", server)
+	}
+
+	switch response.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s couldn't look up the SSHFP records for %s (%s)", server, hostname, response.RCode)
+	}
+
+	var records []sshfpRecord
+	for _, answer := range response.Answers {
+		body, ok := answer.Body.(*dnsmessage.UnknownResource)
+		if !ok || answer.Header.Type != typeSSHFP || len(body.Data) < 3 {
+			continue
+		}
+		records = append(records, sshfpRecord{
+			Algorithm:   body.Data[0],
+			Type:        body.Data[1],
+			Fingerprint: body.Data[2:],
+		})
+	}
+	return records, nil
+}
+
+// systemResolvers returns the DNS servers in /etc/resolv.conf
+func systemResolvers() []string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var resolvers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			resolvers = append(resolvers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return resolvers
+}
@@ -1,14 +1,21 @@
 package bootstrap
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/bintest/v3"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestAddingToKnownHosts(t *testing.T) {
@@ -86,3 +93,173 @@ usage: ssh [-1246AaCfgKkMNnqsTtVvXxYy] [-b bind_address] [-c cipher_spec]
 		})
 	}
 }
+
+func TestPinnedHostKeysMatchPublishedFingerprints(t *testing.T) {
+	t.Parallel()
+
+	var testCases = []struct {
+		Host         string
+		Fingerprints []string
+	}{
+		{"github.com", []string{
+			"SHA256:+DiY3wvvV6TuJJhbpZisF/zLDA0zPMSvHdkr4UvCOqU",
+			"SHA256:p2QAMXNIC1TJYWeIOttrVc98/R1BUFWu3/LiyKgUfQM",
+			"SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s",
+		}},
+		{"gitlab.com", []string{
+			"SHA256:eUXGGm1YGsMAS7vkcx6JOJdOGHPem5gQp4taiCfCLB8",
+			"SHA256:HbW3g8zUjNSksFbqTiUWPWg2Bq1x8xdGUrliXFzSnUw",
+			"SHA256:ROQFvPThGrW4RuWLoL9tq9I9zJ42fK4XywyRtbOz/EQ",
+		}},
+		{"bitbucket.org", []string{
+			"SHA256:ybgmFkzwOSotHTHLJgHO0QN8L0xErw6vd0VhFA9m3SM",
+			"SHA256:FC73VB6C4OQLSCrjEayhMp9UMxS97caD/Yyi2bhW/J0",
+			"SHA256:46OSHA1Rmj8E8ERTC6xkNcmGOw9oFxYr0WF6zWW8l1E",
+		}},
+	}
+
+	for _, tc := range testCases {
+		keys, ok := pinnedKeysFor(tc.Host)
+		if !ok {
+			t.Fatalf("No pinned keys for %q", tc.Host)
+		}
+
+		var fingerprints []string
+		for _, key := range keys {
+			pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+			if err != nil {
+				t.Fatalf("Pinned key for %q doesn't parse: %v", tc.Host, err)
+			}
+			fingerprints = append(fingerprints, ssh.FingerprintSHA256(pub))
+		}
+
+		assert.Equal(t, tc.Fingerprints, fingerprints, tc.Host)
+	}
+}
+
+func TestAddingPinnedHostToKnownHostsDoesNotKeyscan(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+
+	keyscan, err := bintest.NewMock("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyscan.CheckAndClose(t)
+
+	keyscan.Expect().NotCalled()
+	sh.Env.Set("PATH", filepath.Dir(keyscan.Path))
+
+	f, err := ioutil.TempFile("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	defer os.RemoveAll(f.Name())
+
+	kh := knownHosts{Shell: sh, Path: f.Name()}
+
+	for _, host := range []string{"github.com", "ssh.github.com:443"} {
+		if err := kh.Add(host); err != nil {
+			t.Fatal(err)
+		}
+
+		exists, err := kh.Contains(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, exists, host)
+	}
+}
+
+func TestAddingUnpinnedHostWithoutKeyscan(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+
+	f, err := ioutil.TempFile("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	defer os.RemoveAll(f.Name())
+
+	kh := knownHosts{Shell: sh, Path: f.Name()}
+
+	known, err := kh.AddPinned("git.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, known)
+
+	known, err = kh.AddPinned("gitlab.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, known)
+}
+
+func TestSSHFPRecordsMatchHostKeys(t *testing.T) {
+	t.Parallel()
+
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _, _, err := ssh.ParseAuthorizedKey([]byte(githubHostKeys[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(key.Marshal())
+	record := sshfpRecord{Algorithm: 4, Type: 2, Fingerprint: sum[:]}
+
+	// Serve the record from a DNS server of our own
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil {
+			return
+		}
+		response, _ := (&dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true},
+			Questions: query.Questions,
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: typeSSHFP, Class: dnsmessage.ClassINET},
+				Body:   &dnsmessage.UnknownResource{Type: typeSSHFP, Data: append([]byte{record.Algorithm, record.Type}, record.Fingerprint...)},
+			}},
+		}).Pack()
+		_, _ = conn.WriteTo(response, addr)
+	}()
+
+	records, err := querySSHFP(conn.LocalAddr().String(), "git.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []sshfpRecord{record}, records)
+
+	keyscanOutput := strings.Join([]string{
+		"# git.example.com:22 SSH-2.0-OpenSSH_8.9",
+		"git.example.com " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(other))),
+		"git.example.com " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+	}, "\n")
+
+	assert.Equal(t, []string{
+		"git.example.com " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+	}, matchingSSHFPKeys(keyscanOutput, records))
+}
@@ -0,0 +1,420 @@
+// Package localapi is a stand-in for the Buildkite Agent API, which lets the
+// bootstrap run jobs without a connection to Buildkite. Meta-data is kept in
+// memory, artifacts are stored in a local directory, and annotations and
+// pipeline uploads are written out instead of being sent anywhere.
+package localapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	zglob "github.com/mattn/go-zglob"
+)
+
+// Config is the configuration for a local API server
+type Config struct {
+	// The directory artifacts are uploaded to and downloaded from
+	ArtifactsPath string
+
+	// Where annotations, pipeline uploads and step updates are written
+	Output io.Writer
+}
+
+// Server serves enough of the Agent API for the commands a job runs, like
+// `buildkite-agent meta-data` and `buildkite-agent artifact`
+type Server struct {
+	conf     Config
+	logger   logger.Logger
+	listener net.Listener
+	server   *http.Server
+
+	mu        sync.Mutex
+	metaData  map[string]string
+	artifacts map[string]*api.Artifact
+	nextID    int
+}
+
+// New returns a local API server. It doesn't listen for requests until it's
+// started.
+func New(l logger.Logger, c Config) *Server {
+	if c.Output == nil {
+		c.Output = os.Stdout
+	}
+	return &Server{
+		conf:      c,
+		logger:    l,
+		metaData:  map[string]string{},
+		artifacts: map[string]*api.Artifact{},
+	}
+}
+
+// Start listens on a random port on the loopback interface, and returns the
+// endpoint to give the API client
+func (s *Server) Start() (string, error) {
+	if s.conf.ArtifactsPath != "" {
+		if err := os.MkdirAll(s.conf.ArtifactsPath, 0o777); err != nil {
+			return "", fmt.Errorf("Failed to create artifacts directory: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	s.listener = listener
+
+	s.server = &http.Server{Handler: s.routes()}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("Local API server stopped: %v", err)
+		}
+	}()
+
+	return s.Endpoint(), nil
+}
+
+// Endpoint is the base URL of the API
+func (s *Server) Endpoint() string {
+	return fmt.Sprintf("http://%s/v3", s.listener.Addr())
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/jobs/", s.handleJob)
+	mux.HandleFunc("/v3/builds/", s.handleBuild)
+	mux.HandleFunc("/v3/steps/", s.handleStep)
+	mux.HandleFunc("/v3/ping", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"action": "idle"})
+	})
+	mux.HandleFunc("/uploads", s.handleUpload)
+	mux.Handle("/artifacts/", http.StripPrefix("/artifacts/", http.HandlerFunc(s.handleArtifactDownload)))
+	return mux
+}
+
+// handleJob serves /v3/jobs/<id>/...
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v3/jobs/"), "/", 2)
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	jobID, action := parts[0], parts[1]
+
+	switch {
+	case action == "data/set" && r.Method == http.MethodPost:
+		var m api.MetaData
+		if !readJSON(w, r, &m) {
+			return
+		}
+		s.mu.Lock()
+		_, exists := s.metaData[m.Key]
+		if !exists || !m.IfAbsent {
+			s.metaData[m.Key] = m.Value
+		}
+		s.mu.Unlock()
+		if exists && m.IfAbsent {
+			writeError(w, http.StatusConflict, fmt.Sprintf("Key \"%s\" has already been set", m.Key))
+			return
+		}
+		writeJSON(w, http.StatusOK, m)
+
+	case action == "data/get" && r.Method == http.MethodPost:
+		var m api.MetaData
+		if !readJSON(w, r, &m) {
+			return
+		}
+		s.mu.Lock()
+		value, ok := s.metaData[m.Key]
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("No key \"%s\" found", m.Key))
+			return
+		}
+		writeJSON(w, http.StatusOK, api.MetaData{Key: m.Key, Value: value})
+
+	case action == "data/exists" && r.Method == http.MethodPost:
+		var m api.MetaData
+		if !readJSON(w, r, &m) {
+			return
+		}
+		s.mu.Lock()
+		_, ok := s.metaData[m.Key]
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, api.MetaDataExists{Exists: ok})
+
+	case action == "data/keys" && r.Method == http.MethodPost:
+		s.mu.Lock()
+		keys := make([]string, 0, len(s.metaData))
+		for k := range s.metaData {
+			keys = append(keys, k)
+		}
+		s.mu.Unlock()
+		sort.Strings(keys)
+		writeJSON(w, http.StatusOK, keys)
+
+	case action == "annotations" && r.Method == http.MethodPost:
+		var a api.Annotation
+		if !readJSON(w, r, &a) {
+			return
+		}
+		context := a.Context
+		if context == "" {
+			context = "default"
+		}
+		fmt.Fprintf(s.conf.Output, "~~~ Annotation (context: %s, style: %s, append: %t)\n%s\n", context, a.Style, a.Append, a.Body)
+		writeJSON(w, http.StatusCreated, a)
+
+	case strings.HasPrefix(action, "annotations/") && r.Method == http.MethodDelete:
+		fmt.Fprintf(s.conf.Output, "~~~ Removed annotation (context: %s)\n", strings.TrimPrefix(action, "annotations/"))
+		w.WriteHeader(http.StatusOK)
+
+	case action == "pipelines" && r.Method == http.MethodPost:
+		var p api.Pipeline
+		if !readJSON(w, r, &p) {
+			return
+		}
+		pipeline, _ := json.MarshalIndent(p.Pipeline, "", "  ")
+		fmt.Fprintf(s.conf.Output, "~~~ Pipeline upload (replace: %t)\n%s\n", p.Replace, pipeline)
+		writeJSON(w, http.StatusCreated, p)
+
+	case action == "artifacts" && r.Method == http.MethodPost:
+		s.createArtifacts(w, r, jobID)
+
+	case action == "artifacts" && r.Method == http.MethodPut:
+		var req api.ArtifactBatchUpdateRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%s %s isn't supported by the local API", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) createArtifacts(w http.ResponseWriter, r *http.Request, jobID string) {
+	if s.conf.ArtifactsPath == "" {
+		writeError(w, http.StatusUnprocessableEntity, "No local artifacts path has been configured")
+		return
+	}
+
+	var batch api.ArtifactBatch
+	if !readJSON(w, r, &batch) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	resp := api.ArtifactBatchCreateResponse{
+		ID: fmt.Sprintf("local-batch-%d", s.nextID),
+		UploadInstructions: &api.ArtifactUploadInstructions{
+			Data: map[string]string{"key": "${artifact:path}"},
+		},
+	}
+	resp.UploadInstructions.Action.URL = "http://" + s.listener.Addr().String()
+	resp.UploadInstructions.Action.Method = http.MethodPost
+	resp.UploadInstructions.Action.Path = "/uploads"
+	resp.UploadInstructions.Action.FileInput = "file"
+
+	for _, artifact := range batch.Artifacts {
+		s.nextID++
+		artifact.ID = fmt.Sprintf("local-artifact-%d", s.nextID)
+		artifact.JobID = jobID
+		artifact.CreatedAt = time.Now().UTC()
+		artifact.URL = s.artifactURL(artifact.Path)
+		s.artifacts[artifact.Path] = artifact
+		resp.ArtifactIDs = append(resp.ArtifactIDs, artifact.ID)
+	}
+
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Uploads must be POSTed")
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer file.Close()
+
+	dest, ok := s.artifactFilePath(r.FormValue("key"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid artifact path")
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o777); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, file); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) handleArtifactDownload(w http.ResponseWriter, r *http.Request) {
+	path, ok := s.artifactFilePath(r.URL.Path)
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// handleBuild serves /v3/builds/<id>/artifacts/search, which finds artifacts
+// in the local artifacts directory, so ones from earlier runs can be
+// downloaded too
+func (s *Server) handleBuild(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v3/builds/"), "/", 2)
+	if len(parts) != 2 || parts[1] != "artifacts/search" || r.Method != http.MethodGet {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%s %s isn't supported by the local API", r.Method, r.URL.Path))
+		return
+	}
+
+	artifacts, err := s.searchArtifacts(r.URL.Query().Get("query"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, artifacts)
+}
+
+func (s *Server) searchArtifacts(query string) ([]*api.Artifact, error) {
+	artifacts := []*api.Artifact{}
+	if s.conf.ArtifactsPath == "" {
+		return artifacts, nil
+	}
+
+	err := filepath.Walk(s.conf.ArtifactsPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.conf.ArtifactsPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if query != "" {
+			if matched, _ := zglob.Match(query, rel); !matched {
+				return nil
+			}
+		}
+
+		s.mu.Lock()
+		artifact, ok := s.artifacts[rel]
+		s.mu.Unlock()
+
+		if !ok {
+			artifact = &api.Artifact{
+				ID:        "local-" + rel,
+				Path:      rel,
+				FileSize:  info.Size(),
+				CreatedAt: info.ModTime().UTC(),
+				URL:       s.artifactURL(rel),
+			}
+		}
+		artifacts = append(artifacts, artifact)
+		return nil
+	})
+
+	return artifacts, err
+}
+
+// handleStep serves /v3/steps/<id>, which can only be updated, since there
+// isn't a build to get step attributes from
+func (s *Server) handleStep(w http.ResponseWriter, r *http.Request) {
+	step := strings.TrimPrefix(r.URL.Path, "/v3/steps/")
+	if r.Method != http.MethodPut || strings.Contains(step, "/") {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%s %s isn't supported by the local API", r.Method, r.URL.Path))
+		return
+	}
+
+	var update api.StepUpdate
+	if !readJSON(w, r, &update) {
+		return
+	}
+	fmt.Fprintf(s.conf.Output, "~~~ Step update (step: %s, attribute: %s, append: %t)\n%s\n", step, update.Attribute, update.Append, update.Value)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) artifactURL(path string) string {
+	return "http://" + s.listener.Addr().String() + "/artifacts/" + (&url.URL{Path: path}).EscapedPath()
+}
+
+// artifactFilePath returns where an artifact is stored, making sure it's
+// inside the artifacts directory
+func (s *Server) artifactFilePath(path string) (string, bool) {
+	if s.conf.ArtifactsPath == "" || path == "" {
+		return "", false
+	}
+
+	root, err := filepath.Abs(s.conf.ArtifactsPath)
+	if err != nil {
+		return "", false
+	}
+
+	dest := filepath.Join(root, filepath.FromSlash(path))
+	if !strings.HasPrefix(dest, root+string(filepath.Separator)) {
+		return "", false
+	}
+	return dest, true
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
@@ -0,0 +1,126 @@
+package localapi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) (*Server, *api.Client, *bytes.Buffer) {
+	t.Helper()
+
+	out := &bytes.Buffer{}
+	server := New(logger.Discard, Config{
+		ArtifactsPath: filepath.Join(t.TempDir(), "artifacts"),
+		Output:        out,
+	})
+
+	endpoint, err := server.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: endpoint, Token: "local"})
+	return server, client, out
+}
+
+func TestMetaData(t *testing.T) {
+	_, client, _ := newTestServer(t)
+
+	_, resp, err := client.GetMetaData("job", "foo")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	_, err = client.SetMetaData("job", &api.MetaData{Key: "foo", Value: "bar"})
+	require.NoError(t, err)
+
+	m, _, err := client.GetMetaData("job", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", m.Value)
+
+	exists, _, err := client.ExistsMetaData("job", "foo")
+	require.NoError(t, err)
+	assert.True(t, exists.Exists)
+
+	keys, _, err := client.MetaDataKeys("job")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, keys)
+}
+
+func TestMetaDataSetIfAbsent(t *testing.T) {
+	_, client, _ := newTestServer(t)
+
+	_, err := client.SetMetaData("job", &api.MetaData{Key: "winner", Value: "first", IfAbsent: true})
+	require.NoError(t, err)
+
+	resp, err := client.SetMetaData("job", &api.MetaData{Key: "winner", Value: "second", IfAbsent: true})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	m, _, err := client.GetMetaData("job", "winner")
+	require.NoError(t, err)
+	assert.Equal(t, "first", m.Value)
+}
+
+func TestAnnotationsAreWrittenToOutput(t *testing.T) {
+	_, client, out := newTestServer(t)
+
+	_, err := client.Annotate("job", &api.Annotation{Body: "All tests passed", Style: "success", Context: "tests"})
+	require.NoError(t, err)
+
+	assert.Contains(t, out.String(), "context: tests, style: success")
+	assert.Contains(t, out.String(), "All tests passed")
+}
+
+func TestArtifactsRoundTrip(t *testing.T) {
+	server, client, _ := newTestServer(t)
+
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "report.txt"), []byte("llamas"), 0o644))
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	uploader := agent.NewArtifactUploader(logger.Discard, client, agent.ArtifactUploaderConfig{
+		JobID: "job",
+		Paths: "report.txt",
+	})
+	require.NoError(t, uploader.Upload())
+
+	contents, err := ioutil.ReadFile(filepath.Join(server.conf.ArtifactsPath, "report.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "llamas", string(contents))
+
+	artifacts, _, err := client.SearchArtifacts("build", &api.ArtifactSearchOptions{Query: "*.txt"})
+	require.NoError(t, err)
+	require.Len(t, artifacts, 1)
+	assert.Equal(t, "report.txt", artifacts[0].Path)
+
+	resp, err := http.Get(artifacts[0].URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "llamas", string(body))
+}
+
+func TestArtifactPathsStayInsideArtifactsPath(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	_, ok := server.artifactFilePath("../../etc/passwd")
+	assert.False(t, ok)
+
+	path, ok := server.artifactFilePath("pkg/app.tar.gz")
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join("pkg", "app.tar.gz"), path[len(path)-len(filepath.Join("pkg", "app.tar.gz")):])
+}
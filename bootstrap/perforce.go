@@ -0,0 +1,168 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+)
+
+func init() {
+	RegisterCheckout("perforce", CheckoutFunc(perforceCheckout), "p4", "p4+ssl")
+}
+
+// The options for the client workspaces the agent creates. allwrite and
+// clobber mean a build that modifies files doesn't break the next sync.
+const perforceClientOptions = "allwrite clobber nocompress unlocked nomodtime rmdir"
+
+var perforceClientNameRegex = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// perforceRepository is where a repository like
+// p4://perforce.example.com:1666/depot/project is
+type perforceRepository struct {
+	// The server, in P4PORT format
+	Port string
+
+	// The depot path, like //depot/project
+	Path string
+}
+
+func parsePerforceRepository(repository string) (perforceRepository, error) {
+	u, err := url.Parse(repository)
+	if err != nil {
+		return perforceRepository{}, fmt.Errorf("Invalid Perforce repository %q: %v", repository, err)
+	}
+
+	port := u.Host
+	if port == "" {
+		return perforceRepository{}, fmt.Errorf("Perforce repository %q is missing the server", repository)
+	}
+	if strings.EqualFold(u.Scheme, "p4+ssl") {
+		port = "ssl:" + port
+	}
+
+	path := strings.TrimSuffix(strings.Trim(u.Path, "/"), "/...")
+	if path == "" {
+		return perforceRepository{}, fmt.Errorf("Perforce repository %q is missing the depot path", repository)
+	}
+
+	return perforceRepository{Port: port, Path: "//" + path}, nil
+}
+
+// perforceClientName expands a client workspace name template, replacing
+// %agent, %org and %pipeline, and removing characters Perforce doesn't allow
+func perforceClientName(template string, conf Config) string {
+	if template == "" {
+		template = "buildkite-%agent-%org-%pipeline"
+	}
+
+	name := strings.NewReplacer(
+		"%agent", conf.AgentName,
+		"%org", conf.OrganizationSlug,
+		"%pipeline", conf.PipelineSlug,
+	).Replace(template)
+
+	return perforceClientNameRegex.ReplaceAllString(name, "-")
+}
+
+// perforceClientSpec returns the spec for a client workspace rooted in the
+// checkout directory. The view maps the whole depot path unless one is given,
+// where each line can use %client for the name of the workspace.
+func perforceClientSpec(name, root, depotPath, view string) string {
+	if strings.TrimSpace(view) == "" {
+		view = depotPath + "/... //%client/..."
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Client:\t%s\n\n", name)
+	fmt.Fprintf(&b, "Root:\t%s\n\n", root)
+	fmt.Fprintf(&b, "Options:\t%s\n\n", perforceClientOptions)
+	fmt.Fprintf(&b, "LineEnd:\tlocal\n\n")
+	fmt.Fprintf(&b, "View:\n")
+	for _, line := range strings.Split(view, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			fmt.Fprintf(&b, "\t%s\n", strings.ReplaceAll(line, "%client", name))
+		}
+	}
+
+	return b.String()
+}
+
+// perforceRevision is what to sync the workspace to. BUILDKITE_COMMIT is
+// the changelist number, or HEAD for the latest.
+func perforceRevision(commit string) string {
+	if commit == "" || commit == "HEAD" {
+		return "#head"
+	}
+	return "@" + commit
+}
+
+// perforceCheckout syncs a Perforce client workspace in the checkout
+// directory to the changelist being built. It's configured from the job
+// environment:
+//
+//	BUILDKITE_PERFORCE_USER    the user to sync as, instead of P4USER
+//	BUILDKITE_PERFORCE_TICKET  a login ticket for the user
+//	BUILDKITE_PERFORCE_CLIENT  a template for the workspace name
+//	BUILDKITE_PERFORCE_VIEW    the workspace view, one mapping per line
+//
+// P4PORT, P4USER and P4CLIENT are left set for the rest of the job, but the
+// ticket is only used during the checkout.
+func perforceCheckout(ctx context.Context, sh *shell.Shell, conf Config) error {
+	repo, err := parsePerforceRepository(conf.Repository)
+	if err != nil {
+		return err
+	}
+
+	template, _ := sh.Env.Get("BUILDKITE_PERFORCE_CLIENT")
+	view, _ := sh.Env.Get("BUILDKITE_PERFORCE_VIEW")
+	client := perforceClientName(template, conf)
+
+	sh.Env.Set("P4PORT", repo.Port)
+	sh.Env.Set("P4CLIENT", client)
+	if user, _ := sh.Env.Get("BUILDKITE_PERFORCE_USER"); user != "" {
+		sh.Env.Set("P4USER", user)
+	}
+
+	// A ticket can be used in place of a password
+	if ticket, _ := sh.Env.Get("BUILDKITE_PERFORCE_TICKET"); ticket != "" {
+		sh.Env.Set("P4PASSWD", ticket)
+		defer sh.Env.Remove("P4PASSWD")
+
+		sh.Commentf("Checking the Perforce login ticket")
+		if err := sh.Run("p4", "login", "-s"); err != nil {
+			return fmt.Errorf("Perforce rejected the login ticket: %v", err)
+		}
+	}
+
+	sh.Commentf("Updating client workspace %s for %s on %s", client, repo.Path, repo.Port)
+	spec := perforceClientSpec(client, sh.Getwd(), repo.Path, view)
+	if err := sh.WithStdin(strings.NewReader(spec)).Run("p4", "client", "-i"); err != nil {
+		return err
+	}
+
+	// Like git clean, this removes files that aren't in the depot and
+	// restores any that were changed or deleted by an earlier build
+	if err := sh.Run("p4", "clean"); err != nil {
+		return err
+	}
+
+	if err := sh.Run("p4", "sync", fmt.Sprintf("//%s/...%s", client, perforceRevision(conf.Commit))); err != nil {
+		return err
+	}
+
+	// Let the job know which changelist it got, since it could have been
+	// the latest
+	changelist, err := sh.RunAndCapture("p4", "-ztag", "-F", "%change%", "changes", "-m1", fmt.Sprintf("//%s/...#have", client))
+	if err != nil {
+		sh.Warningf("Failed to find the synced changelist: %v", err)
+	} else if changelist = strings.TrimSpace(changelist); changelist != "" {
+		sh.Commentf("Synced to changelist %s", changelist)
+		sh.Env.Set("BUILDKITE_PERFORCE_CHANGELIST", changelist)
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package bootstrap
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/bintest/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePerforceRepository(t *testing.T) {
+	t.Parallel()
+
+	repo, err := parsePerforceRepository("p4://perforce.example.com:1666/depot/firmware/...")
+	require.NoError(t, err)
+	assert.Equal(t, perforceRepository{Port: "perforce.example.com:1666", Path: "//depot/firmware"}, repo)
+
+	repo, err = parsePerforceRepository("p4+ssl://perforce.example.com:1666/depot/firmware")
+	require.NoError(t, err)
+	assert.Equal(t, perforceRepository{Port: "ssl:perforce.example.com:1666", Path: "//depot/firmware"}, repo)
+
+	_, err = parsePerforceRepository("p4://perforce.example.com:1666")
+	assert.Error(t, err)
+}
+
+func TestPerforceClientName(t *testing.T) {
+	t.Parallel()
+
+	conf := Config{AgentName: "builder 1", OrganizationSlug: "acme", PipelineSlug: "firmware"}
+	assert.Equal(t, "buildkite-builder-1-acme-firmware", perforceClientName("", conf))
+	assert.Equal(t, "ci_firmware", perforceClientName("ci_%pipeline", conf))
+}
+
+func TestPerforceClientSpec(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "Client:\tws\n\nRoot:\t/builds/ws\n\n"+
+		"Options:\tallwrite clobber nocompress unlocked nomodtime rmdir\n\n"+
+		"LineEnd:\tlocal\n\nView:\n\t//depot/firmware/... //ws/...\n",
+		perforceClientSpec("ws", "/builds/ws", "//depot/firmware", ""))
+
+	spec := perforceClientSpec("ws", "/builds/ws", "//depot/firmware", "//depot/firmware/src/... //%client/src/...\n\n-//depot/firmware/src/big/... //%client/src/big/...")
+	assert.Contains(t, spec, "View:\n\t//depot/firmware/src/... //ws/src/...\n\t-//depot/firmware/src/big/... //ws/src/big/...\n")
+}
+
+func TestPerforceRevision(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "#head", perforceRevision("HEAD"))
+	assert.Equal(t, "@12345", perforceRevision("12345"))
+}
+
+func TestPerforceCheckout(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+
+	p4, err := bintest.NewMock("p4")
+	require.NoError(t, err)
+	defer p4.CheckAndClose(t)
+
+	sh.Env.Set("PATH", filepath.Dir(p4.Path))
+	sh.Env.Set("BUILDKITE_PERFORCE_USER", "builder")
+	sh.Env.Set("BUILDKITE_PERFORCE_TICKET", "0123456789ABCDEF")
+
+	p4.Expect("login", "-s").AndCallFunc(func(c *bintest.Call) {
+		assert.Contains(t, c.Env, "P4PASSWD=0123456789ABCDEF")
+		assert.Contains(t, c.Env, "P4USER=builder")
+		assert.Contains(t, c.Env, "P4PORT=perforce:1666")
+		c.Exit(0)
+	})
+	p4.Expect("client", "-i").AndExitWith(0)
+	p4.Expect("clean").AndExitWith(0)
+	p4.Expect("sync", "//buildkite-agent-acme-firmware/...@42").AndExitWith(0)
+	p4.Expect("-ztag", "-F", "%change%", "changes", "-m1", "//buildkite-agent-acme-firmware/...#have").
+		AndWriteToStdout("42\n").
+		AndExitWith(0)
+
+	err = perforceCheckout(context.Background(), sh, Config{
+		Repository:       "p4://perforce:1666/depot/firmware",
+		Commit:           "42",
+		AgentName:        "agent",
+		OrganizationSlug: "acme",
+		PipelineSlug:     "firmware",
+	})
+	require.NoError(t, err)
+
+	changelist, _ := sh.Env.Get("BUILDKITE_PERFORCE_CHANGELIST")
+	assert.Equal(t, "42", changelist)
+
+	client, _ := sh.Env.Get("P4CLIENT")
+	assert.Equal(t, "buildkite-agent-acme-firmware", client)
+
+	_, hasPassword := sh.Env.Get("P4PASSWD")
+	assert.False(t, hasPassword)
+}
@@ -0,0 +1,84 @@
+package bootstrap
+
+import (
+	"sync"
+
+	"github.com/buildkite/agent/v3/agent/plugin"
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/pkg/errors"
+)
+
+// How many plugins are checked out at once
+var pluginFetchConcurrency = 4
+
+// pluginFetch is the checkout of a plugin that's fetched in the background
+type pluginFetch struct {
+	checkout *pluginCheckout
+	err      error
+	log      *shell.BufferedLogger
+}
+
+// fetchPlugins checks out plugins concurrently, fetching each distinct plugin
+// only once, even if it's used more than once with different configuration.
+// The output of each fetch is shown in the order the plugins were declared once
+// they've all finished, and the checkouts are returned in that order too. When
+// fetches fail, the error is for the first of them in that order.
+func (b *Bootstrap) fetchPlugins(plugins []*plugin.Plugin) ([]*pluginCheckout, error) {
+	fetches := make([]*pluginFetch, len(plugins))
+	first := map[string]int{}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, pluginFetchConcurrency)
+
+	for i, p := range plugins {
+		// Plugins with the same identifier are checked out to the same place
+		if id, err := p.Identifier(); err == nil {
+			if j, ok := first[id]; ok {
+				fetches[i] = fetches[j]
+				continue
+			}
+			first[id] = i
+		}
+
+		fetch := &pluginFetch{log: &shell.BufferedLogger{}}
+		fetches[i] = fetch
+
+		wg.Add(1)
+		go func(p *plugin.Plugin) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			sh := b.shell.WithLogger(fetch.log, fetch.log)
+			fetch.checkout, fetch.err = b.checkoutPlugin(sh, p)
+		}(p)
+	}
+
+	wg.Wait()
+
+	checkouts := make([]*pluginCheckout, 0, len(plugins))
+	shown := map[*pluginFetch]bool{}
+
+	for i, p := range plugins {
+		fetch := fetches[i]
+
+		if shown[fetch] {
+			b.shell.Commentf("Plugin %q was already checked out for an earlier plugin", p.Label())
+		} else {
+			fetch.log.Replay(b.shell.Logger, b.shell.Writer)
+			shown[fetch] = true
+		}
+
+		if fetch.err != nil {
+			return nil, errors.Wrapf(fetch.err, "Failed to checkout plugin %s", p.Name())
+		}
+
+		checkouts = append(checkouts, &pluginCheckout{
+			Plugin:      p,
+			CheckoutDir: fetch.checkout.CheckoutDir,
+			HooksDir:    fetch.checkout.HooksDir,
+		})
+	}
+
+	return checkouts, nil
+}
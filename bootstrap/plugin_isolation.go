@@ -0,0 +1,114 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/hook"
+	"github.com/buildkite/agent/v3/redaction"
+)
+
+// Plugin hooks for these phases run in the checkout even when plugins are
+// isolated, since doing something with the checkout is what they're for
+var pluginHooksInCheckout = map[string]bool{
+	"checkout": true,
+	"command":  true,
+}
+
+// pluginIsolation keeps a plugin's hooks apart from the rest of the job
+type pluginIsolation struct {
+	// Where the plugin's hooks run, or empty to run them where the job is
+	Dir string
+
+	// The environment changes made by the plugin's hooks that aren't shared
+	// with the rest of the job, which only its later hooks see
+	Env env.Environment
+}
+
+// isolatePluginHook returns the isolation for running a plugin's hook, and adds
+// the plugin's own environment to the hook's. The hook sees the plugin's own
+// entry in BUILDKITE_PLUGINS rather than every plugin's configuration.
+func (b *Bootstrap) isolatePluginHook(p *pluginCheckout, name string, hookEnv env.Environment) (*pluginIsolation, error) {
+	if p.isolation == nil {
+		dir, err := ioutil.TempDir("", "buildkite-plugin-")
+		if err != nil {
+			return nil, err
+		}
+		b.cleanupDirs = append(b.cleanupDirs, dir)
+		p.isolation = &pluginIsolation{Dir: dir, Env: env.New()}
+	}
+
+	for k, v := range p.isolation.Env {
+		if !hookEnv.Exists(k) {
+			hookEnv.Set(k, v)
+		}
+	}
+
+	plugins, err := json.Marshal([]map[string]interface{}{
+		{p.Plugin.Source(): p.Plugin.Configuration},
+	})
+	if err != nil {
+		return nil, err
+	}
+	hookEnv.Set("BUILDKITE_PLUGINS", string(plugins))
+
+	if pluginHooksInCheckout[name] {
+		return &pluginIsolation{Env: p.isolation.Env}, nil
+	}
+	return p.isolation, nil
+}
+
+// isSharedPluginEnv returns whether an isolated plugin's changes to an
+// environment variable apply to the rest of the job. Shared names can end in a
+// * to share every variable starting with the rest of the name.
+func (b *Bootstrap) isSharedPluginEnv(name string) bool {
+	for _, shared := range b.PluginsSharedEnv {
+		if prefix := strings.TrimSuffix(shared, "*"); prefix != shared {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == shared {
+			return true
+		}
+	}
+	return false
+}
+
+// applyIsolatedEnvironmentChanges applies the changes an isolated plugin's hook
+// made to shared variables to the job, and keeps the rest for the plugin. The
+// hook's working directory doesn't carry over.
+func (b *Bootstrap) applyIsolatedEnvironmentChanges(changes hook.HookScriptChanges, isolation *pluginIsolation, redactors redaction.RedactorMux) {
+	shared := env.Diff{
+		Added:   map[string]string{},
+		Changed: map[string]env.DiffPair{},
+		Removed: map[string]struct{}{},
+	}
+
+	for k, v := range changes.Diff.Added {
+		if b.isSharedPluginEnv(k) {
+			shared.Added[k] = v
+		} else {
+			isolation.Env.Set(k, v)
+		}
+	}
+	for k, v := range changes.Diff.Changed {
+		if b.isSharedPluginEnv(k) {
+			shared.Changed[k] = v
+		} else {
+			isolation.Env.Set(k, v.New)
+		}
+	}
+	// A plugin can't unset the job's variables for just itself, so removing
+	// one that isn't shared only forgets the plugin's own value
+	for k := range changes.Diff.Removed {
+		if b.isSharedPluginEnv(k) {
+			shared.Removed[k] = struct{}{}
+		} else {
+			isolation.Env.Remove(k)
+		}
+	}
+
+	b.applyEnvironmentChanges(hook.HookScriptChanges{Diff: shared}, redactors)
+}
@@ -0,0 +1,24 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSharedPluginEnv(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{}
+	b.PluginsSharedEnv = []string{"DOCKER_*", "AWS_REGION"}
+
+	for name, shared := range map[string]bool{
+		"DOCKER_HOST":        true,
+		"DOCKER_":            true,
+		"AWS_REGION":         true,
+		"AWS_REGION_DEFAULT": false,
+		"LLAMAS":             false,
+	} {
+		assert.Equal(t, shared, b.isSharedPluginEnv(name), name)
+	}
+}
@@ -0,0 +1,41 @@
+package bootstrap
+
+import (
+	"net/url"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/proxy"
+)
+
+// gitProxyArgs returns the git options to clone a repository through the
+// proxy the PAC file picks for it. Only HTTP(S) repositories use a proxy, and
+// DIRECT turns off any that git would otherwise use.
+func (b *Bootstrap) gitProxyArgs(sh *shell.Shell, repository string) ([]string, error) {
+	if b.ProxyPAC == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(repository)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, nil
+	}
+
+	if b.proxyPAC == nil {
+		if b.proxyPAC, err = proxy.Load(b.ProxyPAC); err != nil {
+			return nil, err
+		}
+	}
+
+	proxyURL, err := b.proxyPAC.ProxyForURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL == nil {
+		sh.Commentf("Connecting to %s directly, as the PAC file says to", u.Hostname())
+		return []string{"-c", "http.proxy="}, nil
+	}
+
+	sh.Commentf("Connecting to %s through the proxy %s, as the PAC file says to", u.Hostname(), proxyURL)
+	return []string{"-c", "http.proxy=" + proxyURL.String()}, nil
+}
@@ -0,0 +1,41 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitProxyArgs(t *testing.T) {
+	t.Parallel()
+
+	pac := filepath.Join(t.TempDir(), "proxy.pac")
+	require.NoError(t, os.WriteFile(pac, []byte(`
+		function FindProxyForURL(url, host) {
+			if (dnsDomainIs(host, ".corp.example")) return "DIRECT";
+			return "PROXY proxy.corp.example:3128";
+		}`), 0o600))
+
+	b := &Bootstrap{Config: Config{ProxyPAC: pac}}
+	sh := shell.NewTestShell(t)
+
+	args, err := b.gitProxyArgs(sh, "https://github.com/buildkite-plugins/docker-buildkite-plugin.git")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-c", "http.proxy=http://proxy.corp.example:3128"}, args)
+
+	args, err = b.gitProxyArgs(sh, "https://git.corp.example/plugins/deploy-buildkite-plugin.git")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-c", "http.proxy="}, args)
+
+	args, err = b.gitProxyArgs(sh, "git@github.com:buildkite-plugins/docker-buildkite-plugin.git")
+	require.NoError(t, err)
+	assert.Empty(t, args)
+
+	args, err = (&Bootstrap{}).gitProxyArgs(sh, "https://github.com/buildkite-plugins/docker-buildkite-plugin.git")
+	require.NoError(t, err)
+	assert.Empty(t, args)
+}
@@ -5,3 +5,7 @@ import "time"
 func Round(d time.Duration) time.Duration {
 	return round(d)
 }
+
+func WithWSLEnv(environ []string) []string {
+	return withWSLEnv(environ)
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"sync"
 	"testing"
 )
 
@@ -197,3 +198,77 @@ func (l *LoggerStreamer) Output() error {
 
 	return nil
 }
+
+// BufferedLogger is a Logger that keeps everything logged and written to it,
+// so that output from work done in the background can be shown in order later
+type BufferedLogger struct {
+	mu      sync.Mutex
+	entries []bufferedEntry
+}
+
+type bufferedEntry struct {
+	kind string
+	msg  string
+	raw  []byte
+}
+
+func (bl *BufferedLogger) add(e bufferedEntry) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.entries = append(bl.entries, e)
+}
+
+func (bl *BufferedLogger) Write(b []byte) (int, error) {
+	bl.add(bufferedEntry{kind: "raw", raw: append([]byte{}, b...)})
+	return len(b), nil
+}
+
+func (bl *BufferedLogger) Printf(format string, v ...interface{}) {
+	bl.add(bufferedEntry{kind: "print", msg: fmt.Sprintf(format, v...)})
+}
+
+func (bl *BufferedLogger) Headerf(format string, v ...interface{}) {
+	bl.add(bufferedEntry{kind: "header", msg: fmt.Sprintf(format, v...)})
+}
+
+func (bl *BufferedLogger) Commentf(format string, v ...interface{}) {
+	bl.add(bufferedEntry{kind: "comment", msg: fmt.Sprintf(format, v...)})
+}
+
+func (bl *BufferedLogger) Errorf(format string, v ...interface{}) {
+	bl.add(bufferedEntry{kind: "error", msg: fmt.Sprintf(format, v...)})
+}
+
+func (bl *BufferedLogger) Warningf(format string, v ...interface{}) {
+	bl.add(bufferedEntry{kind: "warning", msg: fmt.Sprintf(format, v...)})
+}
+
+func (bl *BufferedLogger) Promptf(format string, v ...interface{}) {
+	bl.add(bufferedEntry{kind: "prompt", msg: fmt.Sprintf(format, v...)})
+}
+
+// Replay logs everything that was logged to the logger, and writes everything
+// that was written to it to w
+func (bl *BufferedLogger) Replay(logger Logger, w io.Writer) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	for _, e := range bl.entries {
+		switch e.kind {
+		case "raw":
+			_, _ = w.Write(e.raw)
+		case "print":
+			logger.Printf("%s", e.msg)
+		case "header":
+			logger.Headerf("%s", e.msg)
+		case "comment":
+			logger.Commentf("%s", e.msg)
+		case "error":
+			logger.Errorf("%s", e.msg)
+		case "warning":
+			logger.Warningf("%s", e.msg)
+		case "prompt":
+			logger.Promptf("%s", e.msg)
+		}
+	}
+}
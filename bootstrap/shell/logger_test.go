@@ -73,3 +73,34 @@ func TestLoggerStreamer(t *testing.T) {
 		t.Fatalf("Expected %q, got %q", expected.String(), actual)
 	}
 }
+
+func TestBufferedLoggerReplaysInOrder(t *testing.T) {
+	b := &bytes.Buffer{}
+	l := &shell.WriterLogger{Writer: b, Ansi: false}
+
+	buffered := &shell.BufferedLogger{}
+	buffered.Headerf("Testing header: %q", "llamas")
+	buffered.Commentf("Testing comment: %q", "llamas")
+	fmt.Fprint(buffered, "Cloning into '.'...\n")
+	buffered.Warningf("Testing warning: %q", "llamas")
+
+	if b.Len() != 0 {
+		t.Fatalf("Expected nothing to be written before replaying, got %q", b.String())
+	}
+
+	buffered.Replay(l, b)
+
+	expected := &bytes.Buffer{}
+
+	fmt.Fprintln(expected, `~~~ Testing header: "llamas"`)
+	fmt.Fprintln(expected, `# Testing comment: "llamas"`)
+	fmt.Fprintln(expected, `Cloning into '.'...`)
+	fmt.Fprintln(expected, `⚠️ Warning: Testing warning: "llamas"`)
+	fmt.Fprintln(expected, `^^^ +++`)
+
+	actual := b.String()
+
+	if actual != expected.String() {
+		t.Fatalf("Expected %q, got %q", expected.String(), actual)
+	}
+}
@@ -69,6 +69,9 @@ type Shell struct {
 
 	// The signal to use to interrupt the command
 	InterruptSignal process.Signal
+
+	// The WSL distribution to run bash scripts in, when running on Windows
+	WSLDistribution string
 }
 
 // New returns a new Shell
@@ -117,6 +120,24 @@ func (s *Shell) WithStdin(r io.Reader) *Shell {
 	}
 }
 
+// WithLogger returns a copy of the Shell that logs to logger and writes the
+// output of commands to w, for running commands alongside the Shell without
+// their output getting mixed up. The copy shares the Shell's environment.
+func (s *Shell) WithLogger(logger Logger, w io.Writer) *Shell {
+	s.cmdLock.Lock()
+	defer s.cmdLock.Unlock()
+	return &Shell{
+		Logger:          logger,
+		Env:             s.Env,
+		Writer:          w,
+		Debug:           s.Debug,
+		wd:              s.wd,
+		ctx:             s.ctx,
+		InterruptSignal: s.InterruptSignal,
+		WSLDistribution: s.WSLDistribution,
+	}
+}
+
 // Getwd returns the current working directory of the shell
 func (s *Shell) Getwd() string {
 	return s.wd
@@ -360,9 +381,18 @@ func (s *Shell) RunScript(ctx context.Context, path string, extra env.Environmen
 
 	var isBash = filepath.Ext(path) == "" || filepath.Ext(path) == ".sh"
 	var isWindows = runtime.GOOS == "windows"
-	var isPwsh = filepath.Ext(path) == ".ps1"
+	var isPwsh = strings.EqualFold(filepath.Ext(path), ".ps1")
+
+	wslCommand, wslArgs, isWSL := s.wslScriptCommand(path)
 
 	switch {
+	case isWSL:
+		if s.Debug {
+			s.Commentf("Attempting to run %s across the WSL boundary with %s", path, wslCommand)
+		}
+		command = wslCommand
+		args = wslArgs
+
 	case isWindows && isBash:
 		if s.Debug {
 			s.Commentf("Attempting to run %s with Bash for Windows", path)
@@ -380,8 +410,11 @@ func (s *Shell) RunScript(ctx context.Context, path string, extra env.Environmen
 		if s.Debug {
 			s.Commentf("Attempting to run %s with Powershell", path)
 		}
+		// The default execution policy on Windows doesn't allow scripts to
+		// run at all, so bypass it for this process only. Skipping profiles
+		// keeps hooks from depending on the agent user's setup.
 		command = "powershell.exe"
-		args = []string{"-file", path}
+		args = []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", path}
 
 	case !isWindows && isBash:
 		bashPath, err := s.AbsolutePath("bash")
@@ -407,6 +440,10 @@ func (s *Shell) RunScript(ctx context.Context, path string, extra env.Environmen
 	customEnv := currentEnv.Merge(extra)
 	cmd.Env = customEnv.ToSlice()
 
+	if crossesWSLBoundary(cmd.Path) {
+		cmd.Env = withWSLEnv(cmd.Env)
+	}
+
 	return s.executeCommand(ctx, cmd, s.Writer, executeFlags{
 		Stdout: true,
 		Stderr: true,
@@ -448,6 +485,10 @@ func (s *Shell) buildCommand(ctx context.Context, name string, arg ...string) (*
 		`PWD=`+s.wd,
 	)
 
+	if crossesWSLBoundary(absPath) {
+		cfg.Env = withWSLEnv(cfg.Env)
+	}
+
 	return &command{Config: cfg, cancel: cancel}, nil
 }
 
@@ -0,0 +1,156 @@
+package shell
+
+import (
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/utils"
+)
+
+// Variables that hold paths, which WSL translates between Windows and Linux
+// conventions as they're shared
+var wslPathEnvVars = map[string]bool{
+	"BUILDKITE_BIN_PATH":            true,
+	"BUILDKITE_BUILD_CHECKOUT_PATH": true,
+	"BUILDKITE_BUILD_PATH":          true,
+	"BUILDKITE_CONFIG_PATH":         true,
+	"BUILDKITE_ENV_FILE":            true,
+	"BUILDKITE_GIT_MIRRORS_PATH":    true,
+	"BUILDKITE_HOOKS_PATH":          true,
+	"BUILDKITE_PLUGINS_PATH":        true,
+}
+
+// Variables that belong to the operating system on either side, which would
+// break things if they were shared
+var wslLocalEnvVars = map[string]bool{
+	"ALLUSERSPROFILE":        true,
+	"APPDATA":                true,
+	"COMMONPROGRAMFILES":     true,
+	"COMPUTERNAME":           true,
+	"COMSPEC":                true,
+	"HOME":                   true,
+	"HOMEDRIVE":              true,
+	"HOMEPATH":               true,
+	"HOSTNAME":               true,
+	"HOSTTYPE":               true,
+	"LANG":                   true,
+	"LOCALAPPDATA":           true,
+	"LOGNAME":                true,
+	"NAME":                   true,
+	"NUMBER_OF_PROCESSORS":   true,
+	"OLDPWD":                 true,
+	"OS":                     true,
+	"PATH":                   true,
+	"PATHEXT":                true,
+	"PROCESSOR_ARCHITECTURE": true,
+	"PROGRAMDATA":            true,
+	"PROGRAMFILES":           true,
+	"PSMODULEPATH":           true,
+	"PUBLIC":                 true,
+	"PWD":                    true,
+	"SHELL":                  true,
+	"SHLVL":                  true,
+	"SYSTEMDRIVE":            true,
+	"SYSTEMROOT":             true,
+	"TEMP":                   true,
+	"TERM":                   true,
+	"TMP":                    true,
+	"TMPDIR":                 true,
+	"USER":                   true,
+	"USERNAME":               true,
+	"USERPROFILE":            true,
+	"WINDIR":                 true,
+	"WSLENV":                 true,
+	"WSL_DISTRO_NAME":        true,
+	"WSL_INTEROP":            true,
+	"_":                      true,
+}
+
+// crossesWSLBoundary returns whether running the executable at path moves
+// between Windows and a WSL distribution, in either direction
+func crossesWSLBoundary(path string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(filepath.Base(path), "wsl.exe")
+	}
+	return utils.WSLDistribution() != "" && strings.EqualFold(filepath.Ext(path), ".exe")
+}
+
+// withWSLEnv returns the environment with WSLENV set so that the job's
+// variables are shared with a process on the other side of the WSL boundary.
+// Without it, WSL only passes on a handful of its own variables.
+func withWSLEnv(environ []string) []string {
+	e := env.FromSlice(environ)
+
+	// Keep anything that's already shared, along with its flags
+	var shared []string
+	seen := map[string]bool{}
+	if existing, ok := e.Get("WSLENV"); ok && existing != "" {
+		shared = strings.Split(existing, ":")
+		for _, entry := range shared {
+			name, _, _ := strings.Cut(entry, "/")
+			seen[strings.ToUpper(name)] = true
+		}
+	}
+
+	var names []string
+	for _, entry := range environ {
+		name, _, _ := strings.Cut(entry, "=")
+		if name == "" || strings.ContainsAny(name, ":/()") || wslLocalEnvVars[strings.ToUpper(name)] || seen[strings.ToUpper(name)] {
+			continue
+		}
+		seen[strings.ToUpper(name)] = true
+
+		if wslPathEnvVars[strings.ToUpper(name)] {
+			name += "/p"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	e.Set("WSLENV", strings.Join(append(shared, names...), ":"))
+
+	return e.ToSlice()
+}
+
+// Runs the script at the Windows path it's given, from inside WSL
+const wslRunScript = `script="$(wslpath -u -- "$1")" && exec "$script"`
+
+// wslScriptCommand returns the command and arguments to run a script on the
+// other side of the WSL boundary, if it needs to be. On Windows, that's bash
+// scripts when a WSL distribution is set. Inside WSL, it's batch and
+// PowerShell scripts, which need Windows to run them.
+func (s *Shell) wslScriptCommand(path string) (string, []string, bool) {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	if runtime.GOOS == "windows" {
+		if s.WSLDistribution == "" || (ext != "" && ext != ".sh") {
+			return "", nil, false
+		}
+
+		// The distribution translates the path itself, and it's passed as
+		// an argument so that spaces and quotes in it are left alone
+		return "wsl.exe", []string{"--distribution", s.WSLDistribution, "--exec", "bash", "-c", wslRunScript, "bash", path}, true
+	}
+
+	distribution := utils.WSLDistribution()
+	if distribution == "" {
+		return "", nil, false
+	}
+
+	windowsPath, ok := utils.WSLPathToWindows(path, distribution)
+	if !ok {
+		return "", nil, false
+	}
+
+	switch ext {
+	case ".bat", ".cmd":
+		return "cmd.exe", []string{"/S", "/C", windowsPath}, true
+	case ".ps1":
+		return "powershell.exe", []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", windowsPath}, true
+	}
+
+	return "", nil, false
+}
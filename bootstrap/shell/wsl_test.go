@@ -0,0 +1,29 @@
+package shell_test
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithWSLEnvSharesJobVariables(t *testing.T) {
+	t.Parallel()
+
+	environ := shell.WithWSLEnv([]string{
+		"PATH=/usr/bin",
+		"BUILDKITE_BUILD_CHECKOUT_PATH=C:\\builds\\llamas",
+		"LLAMAS=rock",
+		"ProgramFiles(x86)=C:\\Program Files (x86)",
+		"WSLENV=USERPROFILE/pu",
+	})
+
+	wslenv, _ := env.FromSlice(environ).Get("WSLENV")
+	assert.Equal(t, "USERPROFILE/pu:BUILDKITE_BUILD_CHECKOUT_PATH/p:LLAMAS", wslenv)
+
+	// Doing it again doesn't share anything twice
+	environ = shell.WithWSLEnv(environ)
+	wslenv, _ = env.FromSlice(environ).Get("WSLENV")
+	assert.Equal(t, "USERPROFILE/pu:BUILDKITE_BUILD_CHECKOUT_PATH/p:LLAMAS", wslenv)
+}
@@ -2,6 +2,7 @@ package bootstrap
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -9,7 +10,7 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
-	"github.com/buildkite/roko"
+	"github.com/buildkite/agent/v3/retry"
 )
 
 var (
@@ -23,21 +24,27 @@ func sshKeyScan(sh *shell.Shell, host string) (string, error) {
 	}
 
 	sshKeyScanPath := filepath.Join(toolsDir, "ssh-keyscan")
-	hostParts := strings.Split(host, ":")
 	sshKeyScanOutput := ""
 
-	err = roko.NewRetrier(
-		roko.WithMaxAttempts(3),
-		roko.WithStrategy(roko.Constant(sshKeyscanRetryInterval)),
-	).Do(func(r *roko.Retrier) error {
+	// IPv6 addresses are bracketed when they have a port, but ssh-keyscan
+	// wants them bare
+	hostname, port, splitErr := net.SplitHostPort(host)
+	if splitErr != nil {
+		hostname, port = strings.Trim(host, "[]"), ""
+	}
+
+	err = retry.NewRetrier(
+		retry.WithMaxAttempts(3),
+		retry.WithStrategy(retry.Constant(sshKeyscanRetryInterval)),
+	).Do(func(r *retry.Retrier) error {
 		// `ssh-keyscan` needs `-p` when scanning a host with a port
 		var sshKeyScanCommand string
-		if len(hostParts) == 2 {
-			sshKeyScanCommand = fmt.Sprintf("ssh-keyscan -p %q %q", hostParts[1], hostParts[0])
-			sshKeyScanOutput, err = sh.RunAndCapture(sshKeyScanPath, "-p", hostParts[1], hostParts[0])
+		if port != "" {
+			sshKeyScanCommand = fmt.Sprintf("ssh-keyscan -p %q %q", port, hostname)
+			sshKeyScanOutput, err = sh.RunAndCapture(sshKeyScanPath, "-p", port, hostname)
 		} else {
-			sshKeyScanCommand = fmt.Sprintf("ssh-keyscan %q", host)
-			sshKeyScanOutput, err = sh.RunAndCapture(sshKeyScanPath, host)
+			sshKeyScanCommand = fmt.Sprintf("ssh-keyscan %q", hostname)
+			sshKeyScanOutput, err = sh.RunAndCapture(sshKeyScanPath, hostname)
 		}
 
 		if err != nil {
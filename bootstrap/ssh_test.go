@@ -78,6 +78,30 @@ func TestSSHKeyscanWithHostAndPortReturnsOutput(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestSSHKeyscanWithIPv6HostAndPortReturnsOutput(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+
+	keyScan, err := bintest.NewMock("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyScan.CheckAndClose(t)
+
+	sh.Env.Set("PATH", filepath.Dir(keyScan.Path))
+
+	keyScan.
+		Expect("-p", "2222", "2001:db8::1").
+		AndWriteToStdout("[2001:db8::1]:2222 ssh-rsa xxx=").
+		AndExitWith(0)
+
+	keyScanOutput, err := sshKeyScan(sh, "[2001:db8::1]:2222")
+
+	assert.Equal(t, keyScanOutput, "[2001:db8::1]:2222 ssh-rsa xxx=")
+	assert.NoError(t, err)
+}
+
 func TestSSHKeyscanRetriesOnExit1(t *testing.T) {
 	t.Parallel()
 
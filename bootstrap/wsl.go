@@ -0,0 +1,106 @@
+package bootstrap
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/buildkite/agent/v3/utils"
+)
+
+// wslHook describes how a hook runs when it's on the other side of the WSL
+// boundary from the bootstrap
+type wslHook struct {
+	// The operating system the hook's wrapper script is written for
+	os string
+
+	// Translate paths into and out of the hook's environment
+	toHook, fromHook func(string) string
+}
+
+// wslHookFor returns how to run a hook across the WSL boundary, if it needs
+// to be. Bash hooks on a Windows agent with a WSL distribution configured run
+// in that distribution, and batch and PowerShell hooks found by an agent
+// running inside WSL run on Windows.
+func (b *Bootstrap) wslHookFor(hookPath string) (wslHook, bool) {
+	ext := strings.ToLower(filepath.Ext(hookPath))
+
+	if runtime.GOOS == "windows" {
+		if b.WSLDistribution == "" || (ext != "" && ext != ".sh") {
+			return wslHook{}, false
+		}
+
+		distribution := b.WSLDistribution
+		return wslHook{
+			os: "linux",
+			toHook: func(path string) string {
+				if p, ok := utils.WindowsPathToWSL(path); ok {
+					return p
+				}
+				return path
+			},
+			fromHook: func(path string) string {
+				if p, ok := utils.WSLPathToWindows(path, distribution); ok {
+					return p
+				}
+				return path
+			},
+		}, true
+	}
+
+	distribution := utils.WSLDistribution()
+	if distribution == "" || (ext != ".bat" && ext != ".cmd" && ext != ".ps1") {
+		return wslHook{}, false
+	}
+
+	return wslHook{
+		os: "windows",
+		toHook: func(path string) string {
+			if p, ok := utils.WSLPathToWindows(path, distribution); ok {
+				return p
+			}
+			return path
+		},
+		fromHook: func(path string) string {
+			if p, ok := utils.WindowsPathToWSL(path); ok {
+				return p
+			}
+			return path
+		},
+	}, true
+}
+
+// wslCommandShell returns the shell to run the command phase with. On Windows
+// with a WSL distribution configured, commands run with bash inside it,
+// unless the shell has been set to something other than the default CMD.
+func (b *Bootstrap) wslCommandShell(shell []string) []string {
+	if runtime.GOOS != "windows" || b.WSLDistribution == "" {
+		return shell
+	}
+
+	if isWSLShell(shell) {
+		return shell
+	}
+
+	if strings.EqualFold(filepath.Base(shell[0]), "cmd.exe") {
+		shell = []string{"bash", "-e", "-c"}
+	}
+
+	return append([]string{"wsl.exe", "--distribution", b.WSLDistribution, "--exec"}, shell...)
+}
+
+// isWSLShell returns whether the shell runs commands inside WSL
+func isWSLShell(shell []string) bool {
+	return strings.EqualFold(filepath.Base(shell[0]), "wsl.exe")
+}
+
+// wslShellCommand returns the shell that wsl.exe runs inside the distribution,
+// or nil if it doesn't specify one
+func wslShellCommand(shell []string) []string {
+	for i, arg := range shell {
+		if arg == "--exec" || arg == "-e" || arg == "--" {
+			return shell[i+1:]
+		}
+	}
+	return nil
+}
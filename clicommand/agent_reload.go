@@ -0,0 +1,190 @@
+package clicommand
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/urfave/cli"
+)
+
+// The options that can change while the agent is running, when it reloads its
+// configuration. Everything else needs a restart.
+var reloadableAgentOptions = map[string]bool{
+	"tags":      true,
+	"log-level": true,
+	"debug":     true,
+	"spawn":     true,
+	"priority":  true,
+}
+
+// agentReloader loads the agent's configuration again, like it was loaded
+// when the agent started, and applies the options that changed and can be
+// changed to the running agents
+type agentReloader struct {
+	logger logger.Logger
+	cli    *cli.Context
+	pool   *agent.AgentPool
+
+	// The environment the agent started with, before its configuration was
+	// removed from it
+	environ env.Environment
+
+	// The configuration as it was loaded, before the agent changed anything
+	cfg AgentStartConfig
+
+	// How new agents are registered, which is kept up to date with the
+	// reloaded tags and priority
+	runConfig *agent.RunConfig
+
+	// The tags the agent found for itself, like cloud meta-data, which are
+	// kept along with the configured ones
+	fetchedTags []string
+}
+
+// Reload loads the configuration again and applies any changes that can be
+// made without a restart. The running agents and their jobs carry on as they
+// were if the configuration can't be loaded.
+func (r *agentReloader) Reload() {
+	r.logger.Info("Reloading the agent's configuration...")
+
+	cfg := AgentStartConfig{}
+	loader := cliconfig.Loader{
+		CLI:                    r.cli,
+		Config:                 &cfg,
+		DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		LookupEnv:              r.environ.Get,
+		CheckUnknownKeys:       true,
+	}
+
+	warnings, err := loader.Load()
+	if err != nil {
+		r.logger.Error("Failed to reload the configuration, leaving it as it was: %v", err)
+		return
+	}
+	for _, warning := range warnings {
+		r.logger.Warn("%s", warning)
+	}
+
+	changed := changedConfigOptions(r.cfg, cfg)
+	if len(changed) == 0 {
+		r.logger.Info("The configuration hasn't changed")
+		return
+	}
+
+	conf, err := r.reloadConfig(cfg, changed)
+	if err != nil {
+		r.logger.Error("Not reloading the configuration: %v", err)
+		return
+	}
+
+	before, after := configDumpValues(&r.cfg), configDumpValues(&cfg)
+	for _, name := range changed {
+		if reloadableAgentOptions[name] {
+			r.logger.Info("Changed %s from %v to %v", name, before[name], after[name])
+		} else {
+			r.logger.Warn("The agent needs to restart to change %s from %v to %v", name, before[name], after[name])
+		}
+	}
+
+	// The reloaded options are kept, and the others stay as they were until
+	// the agent restarts
+	r.cfg.Tags = cfg.Tags
+	r.cfg.LogLevel = cfg.LogLevel
+	r.cfg.Debug = cfg.Debug
+	r.cfg.Spawn = cfg.Spawn
+	r.cfg.Priority = cfg.Priority
+
+	if conf.LogLevel != nil {
+		r.logger.SetLevel(*conf.LogLevel)
+	}
+	if conf.Tags != nil {
+		r.runConfig.RegisterRequest.Tags = conf.Tags
+	}
+	if conf.Priority != nil {
+		r.runConfig.RegisterRequest.Priority = cfg.Priority
+	}
+
+	if err := r.pool.Reload(r.logger, conf); err != nil {
+		r.logger.Error("%v", err)
+	}
+}
+
+// reloadConfig returns the changes to make to the running agents, checking
+// the new values the same way as when the agent starts
+func (r *agentReloader) reloadConfig(cfg AgentStartConfig, changed []string) (agent.ReloadConfig, error) {
+	var conf agent.ReloadConfig
+
+	for _, name := range changed {
+		switch name {
+		case "tags":
+			conf.Tags = append(append([]string{}, cfg.Tags...), r.fetchedTags...)
+
+		case "log-level", "debug":
+			level := logger.DEBUG
+			if !cfg.Debug {
+				var err error
+				if level, err = logger.LevelFromString(cfg.LogLevel); err != nil {
+					return conf, err
+				}
+			}
+			conf.LogLevel = &level
+
+		case "spawn":
+			if cfg.Spawn < 1 {
+				return conf, fmt.Errorf("The agent needs to spawn at least 1 agent, not %d", cfg.Spawn)
+			}
+			if cfg.Spawn > 1 && r.cfg.AcquireJob != "" {
+				return conf, fmt.Errorf("You can't spawn multiple agents and acquire a job at the same time")
+			}
+			conf.Spawn = cfg.Spawn
+
+		case "priority":
+			if r.cfg.SpawnWithPriority {
+				r.logger.Warn("The priority is ignored, because each agent is given its spawn index as its priority")
+				continue
+			}
+
+			// Buildkite compares priorities as numbers, and agents without
+			// one have a priority of 0
+			priority := 0
+			if cfg.Priority != "" {
+				var err error
+				if priority, err = strconv.Atoi(cfg.Priority); err != nil {
+					return conf, fmt.Errorf("The agent priority must be a whole number, not %q", cfg.Priority)
+				}
+			}
+			conf.Priority = &priority
+		}
+	}
+
+	return conf, nil
+}
+
+// changedConfigOptions returns the names of the options that are different
+// between two configs, in order. Deprecated options that have been renamed
+// are left out, because they're loaded into their new names.
+func changedConfigOptions(before, after interface{}) []string {
+	b := reflect.Indirect(reflect.ValueOf(before))
+	a := reflect.Indirect(reflect.ValueOf(after))
+	t := b.Type()
+
+	var changed []string
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("cli")
+		if name == "" || t.Field(i).Tag.Get("deprecated-and-renamed-to") != "" {
+			continue
+		}
+		if !reflect.DeepEqual(b.Field(i).Interface(), a.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,50 @@
+package clicommand
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangedConfigOptions(t *testing.T) {
+	t.Parallel()
+
+	before := AgentStartConfig{Tags: []string{"queue=default"}, Spawn: 1, LogLevel: "notice"}
+	after := AgentStartConfig{Tags: []string{"queue=deploy"}, Spawn: 1, LogLevel: "info", BuildPath: "/builds"}
+
+	assert.Equal(t, []string{"build-path", "log-level", "tags"}, changedConfigOptions(&before, &after))
+	assert.Empty(t, changedConfigOptions(&before, &before))
+}
+
+func TestAgentReloaderReloadConfig(t *testing.T) {
+	t.Parallel()
+
+	r := &agentReloader{
+		logger:      logger.Discard,
+		cfg:         AgentStartConfig{Spawn: 1},
+		fetchedTags: []string{"hostname=llama"},
+	}
+
+	conf, err := r.reloadConfig(AgentStartConfig{
+		Tags:     []string{"queue=deploy"},
+		Spawn:    3,
+		Priority: "7",
+		Debug:    true,
+	}, []string{"debug", "priority", "spawn", "tags"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"queue=deploy", "hostname=llama"}, conf.Tags)
+	assert.Equal(t, 3, conf.Spawn)
+	require.NotNil(t, conf.Priority)
+	assert.Equal(t, 7, *conf.Priority)
+	require.NotNil(t, conf.LogLevel)
+	assert.Equal(t, logger.DEBUG, *conf.LogLevel)
+
+	_, err = r.reloadConfig(AgentStartConfig{Priority: "high"}, []string{"priority"})
+	assert.EqualError(t, err, `The agent priority must be a whole number, not "high"`)
+
+	_, err = r.reloadConfig(AgentStartConfig{LogLevel: "loud"}, []string{"log-level"})
+	assert.Error(t, err)
+}
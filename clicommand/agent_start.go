@@ -3,15 +3,17 @@ package clicommand
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -20,6 +22,7 @@ import (
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/hook"
 	"github.com/buildkite/agent/v3/logger"
@@ -28,6 +31,7 @@ import (
 	"github.com/buildkite/agent/v3/tracetools"
 	"github.com/buildkite/agent/v3/utils"
 	"github.com/buildkite/shellwords"
+	"github.com/dustin/go-humanize"
 	"github.com/urfave/cli"
 	"golang.org/x/exp/maps"
 )
@@ -45,9 +49,32 @@ Description:
 
    The agent will run any jobs within a PTY (pseudo terminal) if available.
 
+   Sending the agent a SIGHUP loads its configuration again, and changes its
+   tags, log level, spawn count and priority without stopping running jobs.
+   Other options need the agent to restart.
+
+   The token and the API request signing secret can be read from a file or
+   another environment variable, rather than being in the configuration or the
+   command line, by setting them to file://<path> or env://<name>.
+
+   Options are taken from the command line first, then environment variables,
+   then the configuration files. With more than one --config, the files are
+   merged in order, so options in later files override the same options in
+   earlier ones, and a selected --config-profile applies on top of them all.
+   Without --config, the first of the default configuration files that exists
+   is loaded.
+
+   The configuration file can be encrypted with age, to the identities in the
+   file given by --config-identity, or with an AWS KMS key if its name ends in
+   .kms. It's decrypted in memory, and is in the format of its name without the
+   .age or .kms. AWS KMS is the only key management service that's supported.
+
 Example:
 
-   $ buildkite-agent start --token xxx`
+   $ buildkite-agent start --token xxx
+   $ buildkite-agent start --token file:///run/secrets/buildkite-agent-token
+   $ buildkite-agent start --config agent.cfg.age --config-identity /etc/buildkite-agent/key.txt
+   $ buildkite-agent start --config /etc/buildkite-agent/base.cfg --config /etc/buildkite-agent/gpu.cfg`
 
 // Adding config requires changes in a few different spots
 // - The AgentStartConfig struct with a cli parameter
@@ -56,56 +83,119 @@ Example:
 // - Into clicommand/bootstrap.go to read it from the env into the bootstrap config
 
 type AgentStartConfig struct {
-	Config                      string   `cli:"config"`
-	Name                        string   `cli:"name"`
-	Priority                    string   `cli:"priority"`
-	AcquireJob                  string   `cli:"acquire-job"`
-	DisconnectAfterJob          bool     `cli:"disconnect-after-job"`
-	DisconnectAfterIdleTimeout  int      `cli:"disconnect-after-idle-timeout"`
-	BootstrapScript             string   `cli:"bootstrap-script" normalize:"commandpath"`
-	CancelGracePeriod           int      `cli:"cancel-grace-period"`
-	EnableJobLogTmpfile         bool     `cli:"enable-job-log-tmpfile"`
-	BuildPath                   string   `cli:"build-path" normalize:"filepath" validate:"required"`
-	HooksPath                   string   `cli:"hooks-path" normalize:"filepath"`
-	PluginsPath                 string   `cli:"plugins-path" normalize:"filepath"`
-	Shell                       string   `cli:"shell"`
-	Tags                        []string `cli:"tags" normalize:"list"`
-	TagsFromEC2MetaData         bool     `cli:"tags-from-ec2-meta-data"`
-	TagsFromEC2MetaDataPaths    []string `cli:"tags-from-ec2-meta-data-paths" normalize:"list"`
-	TagsFromEC2Tags             bool     `cli:"tags-from-ec2-tags"`
-	TagsFromGCPMetaData         bool     `cli:"tags-from-gcp-meta-data"`
-	TagsFromGCPMetaDataPaths    []string `cli:"tags-from-gcp-meta-data-paths" normalize:"list"`
-	TagsFromGCPLabels           bool     `cli:"tags-from-gcp-labels"`
-	TagsFromHost                bool     `cli:"tags-from-host"`
-	WaitForEC2TagsTimeout       string   `cli:"wait-for-ec2-tags-timeout"`
-	WaitForEC2MetaDataTimeout   string   `cli:"wait-for-ec2-meta-data-timeout"`
-	WaitForGCPLabelsTimeout     string   `cli:"wait-for-gcp-labels-timeout"`
-	GitCloneFlags               string   `cli:"git-clone-flags"`
-	GitCloneMirrorFlags         string   `cli:"git-clone-mirror-flags"`
-	GitCleanFlags               string   `cli:"git-clean-flags"`
-	GitFetchFlags               string   `cli:"git-fetch-flags"`
-	GitMirrorsPath              string   `cli:"git-mirrors-path" normalize:"filepath"`
-	GitMirrorsLockTimeout       int      `cli:"git-mirrors-lock-timeout"`
-	GitMirrorsSkipUpdate        bool     `cli:"git-mirrors-skip-update"`
-	NoGitSubmodules             bool     `cli:"no-git-submodules"`
-	NoSSHKeyscan                bool     `cli:"no-ssh-keyscan"`
-	NoCommandEval               bool     `cli:"no-command-eval"`
-	NoLocalHooks                bool     `cli:"no-local-hooks"`
-	NoPlugins                   bool     `cli:"no-plugins"`
-	NoPluginValidation          bool     `cli:"no-plugin-validation"`
-	NoPTY                       bool     `cli:"no-pty"`
-	NoFeatureReporting          bool     `cli:"no-feature-reporting"`
-	TimestampLines              bool     `cli:"timestamp-lines"`
-	HealthCheckAddr             string   `cli:"health-check-addr"`
-	MetricsDatadog              bool     `cli:"metrics-datadog"`
-	MetricsDatadogHost          string   `cli:"metrics-datadog-host"`
-	MetricsDatadogDistributions bool     `cli:"metrics-datadog-distributions"`
-	TracingBackend              string   `cli:"tracing-backend"`
-	Spawn                       int      `cli:"spawn"`
-	SpawnWithPriority           bool     `cli:"spawn-with-priority"`
-	LogFormat                   string   `cli:"log-format"`
-	CancelSignal                string   `cli:"cancel-signal"`
-	RedactedVars                []string `cli:"redacted-vars" normalize:"list"`
+	Config                      []string      `cli:"config" normalize:"list"`
+	ConfigProfile               string        `cli:"config-profile"`
+	ConfigIdentity              string        `cli:"config-identity"`
+	NoConfigEnvExpansion        bool          `cli:"no-config-env-expansion"`
+	StrictConfig                bool          `cli:"strict-config"`
+	Name                        string        `cli:"name"`
+	Priority                    string        `cli:"priority"`
+	Weight                      int           `cli:"weight" validate:"min:0"`
+	AcquireJob                  string        `cli:"acquire-job"`
+	AcceptJobs                  []string      `cli:"accept-jobs" normalize:"list"`
+	ReadinessChecks             []string      `cli:"readiness-checks" normalize:"list"`
+	ReadinessTimeout            time.Duration `cli:"readiness-timeout"`
+	DisconnectAfterJob          bool          `cli:"disconnect-after-job"`
+	DisconnectAfterIdleTimeout  int           `cli:"disconnect-after-idle-timeout"`
+	BootstrapScript             string        `cli:"bootstrap-script" normalize:"commandpath"`
+	CancelGracePeriod           time.Duration `cli:"cancel-grace-period"`
+	CancelArtifactGracePeriod   int           `cli:"cancel-artifact-grace-period"`
+	EnableJobLogTmpfile         bool          `cli:"enable-job-log-tmpfile"`
+	NoLogStreaming              bool          `cli:"no-log-streaming"`
+	LogLineMaxLength            int           `cli:"log-line-max-length" validate:"min:0"`
+	LogLinePolicy               string        `cli:"log-line-policy" validate:"oneof:wrap|truncate"`
+	BuildPath                   string        `cli:"build-path" normalize:"filepath" validate:"required"`
+	HooksPath                   string        `cli:"hooks-path" normalize:"filepath"`
+	PluginsPath                 string        `cli:"plugins-path" normalize:"filepath"`
+	Shell                       string        `cli:"shell"`
+	WSLDistribution             string        `cli:"wsl-distribution"`
+	MacOSKeychain               string        `cli:"macos-keychain"`
+	MacOSKeychainPasswordFile   string        `cli:"macos-keychain-password-file" normalize:"filepath"`
+	MacOSProvisioningProfiles   string        `cli:"macos-provisioning-profiles-path" normalize:"filepath"`
+	DiskMinFreeSpace            string        `cli:"disk-min-free-space"`
+	DiskCleanupCheckouts        bool          `cli:"disk-cleanup-checkouts"`
+	StartupCleanupAge           int           `cli:"startup-cleanup-age"`
+	ClockSkewThreshold          int           `cli:"clock-skew-threshold"`
+	ReregisterAttempts          int           `cli:"reregister-attempts"`
+	CacheAffinity               int           `cli:"cache-affinity"`
+	Maintenance                 []string      `cli:"maintenance" normalize:"list"`
+	MaintenanceWindows          []string      `cli:"maintenance-windows" normalize:"list"`
+	MaintenanceTimezone         string        `cli:"maintenance-timezone"`
+	InfraFailureExitStatus      int           `cli:"infra-failure-exit-status"`
+	InfraFailureAnnotate        bool          `cli:"infra-failure-annotate"`
+	TransferConcurrency         int           `cli:"transfer-concurrency" validate:"required-if:transfer-bandwidth"`
+	TransferBandwidth           string        `cli:"transfer-bandwidth"`
+	ArtifactMaxTotalSize        string        `cli:"artifact-max-total-size"`
+	ArtifactMaxFiles            int           `cli:"artifact-max-files"`
+	ArtifactMaxFileSize         string        `cli:"artifact-max-file-size"`
+	ArtifactQuotaPolicy         string        `cli:"artifact-quota-policy"`
+	ArtifactURLSigner           string        `cli:"artifact-url-signer"`
+	SpoolPath                   string        `cli:"spool-path" normalize:"filepath"`
+	SpoolMaxAge                 string        `cli:"spool-max-age"`
+	SpoolMaxSize                string        `cli:"spool-max-size"`
+	Tags                        []string      `cli:"tags" normalize:"list"`
+	TagsFromEC2MetaData         bool          `cli:"tags-from-ec2-meta-data"`
+	TagsFromEC2MetaDataPaths    []string      `cli:"tags-from-ec2-meta-data-paths" normalize:"list"`
+	TagsFromEC2Tags             bool          `cli:"tags-from-ec2-tags"`
+	TagsFromGCPMetaData         bool          `cli:"tags-from-gcp-meta-data"`
+	TagsFromGCPMetaDataPaths    []string      `cli:"tags-from-gcp-meta-data-paths" normalize:"list"`
+	TagsFromGCPLabels           bool          `cli:"tags-from-gcp-labels"`
+	TagsFromHost                bool          `cli:"tags-from-host"`
+	TagsFromGPUs                bool          `cli:"tags-from-gpus"`
+	GPUsPerJob                  int           `cli:"gpus-per-job"`
+	HostAttestation             string        `cli:"host-attestation"`
+	WaitForEC2TagsTimeout       string        `cli:"wait-for-ec2-tags-timeout"`
+	WaitForEC2MetaDataTimeout   string        `cli:"wait-for-ec2-meta-data-timeout"`
+	WaitForGCPLabelsTimeout     string        `cli:"wait-for-gcp-labels-timeout"`
+	CheckoutType                string        `cli:"checkout-type"`
+	CheckoutPathTemplate        string        `cli:"checkout-path-template"`
+	GitCloneFlags               string        `cli:"git-clone-flags"`
+	GitCloneMirrorFlags         string        `cli:"git-clone-mirror-flags"`
+	GitCleanFlags               string        `cli:"git-clean-flags"`
+	GitFetchFlags               string        `cli:"git-fetch-flags"`
+	GitSSHHosts                 []string      `cli:"git-ssh-hosts" normalize:"list"`
+	GitSSHConfig                string        `cli:"git-ssh-config" normalize:"filepath"`
+	GitHTTPSFallback            bool          `cli:"git-https-fallback"`
+	GitCredentialHelper         string        `cli:"git-credential-helper"`
+	GitMirrorsPath              string        `cli:"git-mirrors-path" normalize:"filepath"`
+	GitMirrorsLockTimeout       int           `cli:"git-mirrors-lock-timeout"`
+	GitMirrorsSkipUpdate        bool          `cli:"git-mirrors-skip-update"`
+	NoGitSubmodules             bool          `cli:"no-git-submodules"`
+	NoSSHKeyscan                bool          `cli:"no-ssh-keyscan"`
+	SSHStrictHostKeys           bool          `cli:"ssh-strict-host-keys"`
+	SSHVerifyHostKeysWithDNS    bool          `cli:"ssh-verify-host-keys-with-dns"`
+	NoCommandEval               bool          `cli:"no-command-eval"`
+	NoLocalHooks                bool          `cli:"no-local-hooks"`
+	NoPlugins                   bool          `cli:"no-plugins"`
+	NoPluginValidation          bool          `cli:"no-plugin-validation"`
+	IsolatePlugins              bool          `cli:"isolate-plugins"`
+	PluginsSharedEnv            []string      `cli:"plugins-shared-env" normalize:"list"`
+	NoPTY                       bool          `cli:"no-pty"`
+	NoFeatureReporting          bool          `cli:"no-feature-reporting"`
+	TimestampLines              bool          `cli:"timestamp-lines"`
+	HealthCheckAddr             string        `cli:"health-check-addr"`
+	ControlSocket               string        `cli:"control-socket" validate:"required-if:take-over"`
+	TakeOver                    bool          `cli:"take-over"`
+	MetricsDatadog              bool          `cli:"metrics-datadog"`
+	MetricsDatadogHost          string        `cli:"metrics-datadog-host"`
+	MetricsDatadogDistributions bool          `cli:"metrics-datadog-distributions"`
+	TracingBackend              string        `cli:"tracing-backend"`
+	Spawn                       int           `cli:"spawn"`
+	SpawnWithPriority           bool          `cli:"spawn-with-priority"`
+	StartDelayMax               time.Duration `cli:"start-delay-max"`
+	LogFormat                   string        `cli:"log-format"`
+	WindowsEventLog             bool          `cli:"windows-event-log"`
+	CancelSignal                string        `cli:"cancel-signal"`
+	SignalActions               []string      `cli:"signal-actions" normalize:"list"`
+	RedactedVars                []string      `cli:"redacted-vars" normalize:"list"`
+	EnvPolicyAllow              []string      `cli:"env-policy-allow" normalize:"list"`
+	EnvSchemaPath               string        `cli:"env-schema-path" normalize:"filepath"`
+	ToolsPath                   string        `cli:"tools-path" normalize:"filepath"`
+	ToolMirrors                 []string      `cli:"tool-mirrors" normalize:"list"`
+	ToolChecksums               string        `cli:"tool-checksums" normalize:"filepath"`
+	JobTmpPath                  string        `cli:"job-tmp-path" normalize:"filepath"`
+	JobTmpfsSize                string        `cli:"job-tmpfs-size"`
+	AllowedJobExperiments       []string      `cli:"allowed-job-experiments" normalize:"list"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
@@ -115,10 +205,18 @@ type AgentStartConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP bool   `cli:"debug-http"`
-	Token     string `cli:"token" validate:"required"`
-	Endpoint  string `cli:"endpoint" validate:"required"`
-	NoHTTP2   bool   `cli:"no-http2"`
+	DebugHTTP               bool   `cli:"debug-http"`
+	Token                   string `cli:"token" validate:"required" secret:"true"`
+	Endpoint                string `cli:"endpoint" validate:"required"`
+	NoHTTP2                 bool   `cli:"no-http2"`
+	APIRecordPath           string `cli:"api-record-path" normalize:"filepath"`
+	APIReplayPath           string `cli:"api-replay-path" normalize:"filepath"`
+	APIRequestSigning       string `cli:"api-request-signing" validate:"oneof:hmac|aws-sigv4"`
+	APIRequestSigningSecret string `cli:"api-request-signing-secret" secret:"true"`
+	APIRequestSigningRegion string `cli:"api-request-signing-region"`
+	IPFamily                string `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                string `cli:"proxy-pac"`
+	DNSCache                bool   `cli:"dns-cache"`
 
 	// Deprecated
 	NoSSHFingerprintVerification bool     `cli:"no-automatic-ssh-fingerprint-verification" deprecated-and-renamed-to:"NoSSHKeyscan"`
@@ -162,6 +260,10 @@ func (asc AgentStartConfig) Features() []string {
 		features = append(features, "disconnect-after-idle")
 	}
 
+	if asc.HostAttestation != "" {
+		features = append(features, "host-attestation")
+	}
+
 	if asc.NoPlugins {
 		features = append(features, "no-plugins")
 	}
@@ -193,54 +295,79 @@ func DefaultShell() string {
 
 func DefaultConfigFilePaths() (paths []string) {
 	// Toggle beetwen windows and *nix paths
+	var dirs []string
 	if runtime.GOOS == "windows" {
-		paths = []string{
-			"C:\\buildkite-agent\\buildkite-agent.cfg",
-			"$USERPROFILE\\AppData\\Local\\buildkite-agent\\buildkite-agent.cfg",
-			"$USERPROFILE\\AppData\\Local\\BuildkiteAgent\\buildkite-agent.cfg",
+		dirs = []string{
+			"C:\\buildkite-agent",
+			"$USERPROFILE\\AppData\\Local\\buildkite-agent",
+			"$USERPROFILE\\AppData\\Local\\BuildkiteAgent",
 		}
 	} else {
-		paths = []string{
-			"$HOME/.buildkite-agent/buildkite-agent.cfg",
+		dirs = []string{
+			"$HOME/.buildkite-agent",
 		}
 
 		// For Apple Silicon Macs, prioritise the `/opt/homebrew` path over `/usr/local`
 		if runtime.GOOS == "darwin" && runtime.GOARCH == "arm64" {
-			paths = append(paths, "/opt/homebrew/etc/buildkite-agent/buildkite-agent.cfg")
+			dirs = append(dirs, "/opt/homebrew/etc/buildkite-agent")
 		}
 
-		paths = append(paths, "/usr/local/etc/buildkite-agent/buildkite-agent.cfg", "/etc/buildkite-agent/buildkite-agent.cfg")
+		dirs = append(dirs, "/usr/local/etc/buildkite-agent", "/etc/buildkite-agent")
 	}
 
-	// Also check to see if there's a buildkite-agent.cfg in the folder
-	// that the binary is running in.
+	// Also check to see if there's a config file in the folder that the
+	// binary is running in.
 	exePath, err := os.Executable()
 	if err == nil {
 		pathToBinary, err := filepath.Abs(filepath.Dir(exePath))
 		if err == nil {
-			pathToRelativeConfig := filepath.Join(pathToBinary, "buildkite-agent.cfg")
-			paths = append([]string{pathToRelativeConfig}, paths...)
+			dirs = append([]string{pathToBinary}, dirs...)
+		}
+	}
+
+	// In each directory, buildkite-agent.cfg is used ahead of YAML, TOML and
+	// JSON config
+	for _, dir := range dirs {
+		for _, name := range configFileNames {
+			paths = append(paths, filepath.Join(dir, name))
 		}
 	}
 
 	return
 }
 
+// The names config files are found by in each of the default directories
+var configFileNames = []string{
+	"buildkite-agent.cfg",
+	"buildkite-agent.yaml",
+	"buildkite-agent.yml",
+	"buildkite-agent.toml",
+	"buildkite-agent.json",
+}
+
 var AgentStartCommand = cli.Command{
 	Name:        "start",
 	Usage:       "Starts a Buildkite agent",
 	Description: StartDescription,
 	Flags: []cli.Flag{
-		cli.StringFlag{
+		cli.StringSliceFlag{
 			Name:   "config",
-			Value:  "",
-			Usage:  "Path to a configuration file",
+			Value:  &cli.StringSlice{},
+			Usage:  "Path to a configuration file, either of key=value lines, YAML (if it ends in .yml or .yaml), TOML (if it ends in .toml) or JSON (if it ends in .json), where nested keys are joined with dashes. Given more than once, or as a comma-separated list, the files are merged in order, with options in later files overriding the same options in earlier ones",
 			EnvVar: "BUILDKITE_AGENT_CONFIG",
 		},
+		ConfigProfileFlag,
+		ConfigIdentityFlag,
+		NoConfigEnvExpansionFlag,
+		cli.BoolFlag{
+			Name:   "strict-config",
+			Usage:  "Fail to start if the configuration file has options the agent doesn't have, like typos, rather than warning about them",
+			EnvVar: "BUILDKITE_AGENT_STRICT_CONFIG",
+		},
 		cli.StringFlag{
 			Name:   "name",
 			Value:  "",
-			Usage:  "The name of the agent",
+			Usage:  "The name of the agent, which can include the placeholders " + agent.AgentNamePlaceholders(),
 			EnvVar: "BUILDKITE_AGENT_NAME",
 		},
 		cli.StringFlag{
@@ -249,12 +376,36 @@ var AgentStartCommand = cli.Command{
 			Usage:  "The priority of the agent (higher priorities are assigned work first)",
 			EnvVar: "BUILDKITE_AGENT_PRIORITY",
 		},
+		cli.IntFlag{
+			Name:   "weight",
+			Value:  0,
+			Usage:  "How much work the agent can take on relative to other agents, for example 2 for a host twice the size. Defaults to letting Buildkite decide",
+			EnvVar: "BUILDKITE_AGENT_WEIGHT",
+		},
 		cli.StringFlag{
 			Name:   "acquire-job",
 			Value:  "",
 			Usage:  "Start this agent and only run the specified job, disconnecting after it's finished",
 			EnvVar: "BUILDKITE_AGENT_ACQUIRE_JOB",
 		},
+		cli.StringSliceFlag{
+			Name:   "accept-jobs",
+			Value:  &cli.StringSlice{},
+			Usage:  "Only run jobs that meet all of these filters, as a comma-separated list of key=pattern or key!=pattern (for example, \"queue=deploy-*,branch!=main\"). The keys branch, pipeline, organization and source are the job's build's, any others are the agent tags the job's step targets, and patterns can have * wildcards. Other jobs are refused, leaving them for another agent",
+			EnvVar: "BUILDKITE_AGENT_ACCEPT_JOBS",
+		},
+		cli.StringSliceFlag{
+			Name:   "readiness-checks",
+			Value:  &cli.StringSlice{},
+			Usage:  "Checks the host has to pass before the agent accepts each job, as a comma-separated list of http:// or https:// URLs that have to respond with a 2xx status, tcp://host:port addresses that have to accept connections, or commands that have to exit with 0 (for example, \"docker info,tcp://license.internal:27000\"). Jobs are refused, leaving them for another agent, if the checks don't pass within --readiness-timeout",
+			EnvVar: "BUILDKITE_AGENT_READINESS_CHECKS",
+		},
+		cli.StringFlag{
+			Name:   "readiness-timeout",
+			Value:  "1m",
+			Usage:  "How long the agent waits for failing readiness checks to pass before refusing a job, as a duration like 30s or a number of seconds",
+			EnvVar: "BUILDKITE_AGENT_READINESS_TIMEOUT",
+		},
 		cli.BoolFlag{
 			Name:   "disconnect-after-job",
 			Usage:  "Disconnect the agent after running exactly one job. When used in conjunction with the ′--spawn′ flag, each worker booted will run exactly one job",
@@ -266,23 +417,194 @@ var AgentStartCommand = cli.Command{
 			Usage:  "The maximum idle time in seconds to wait for a job before disconnecting. The default of 0 means no timeout",
 			EnvVar: "BUILDKITE_AGENT_DISCONNECT_AFTER_IDLE_TIMEOUT",
 		},
-		cli.IntFlag{
+		cli.StringFlag{
 			Name:   "cancel-grace-period",
-			Value:  10,
-			Usage:  "The number of seconds a canceled or timed out job is given to gracefully terminate and upload its artifacts",
+			Value:  "10s",
+			Usage:  "How long a canceled or timed out job is given to gracefully terminate and upload its artifacts, as a duration like 30s or a number of seconds",
 			EnvVar: "BUILDKITE_CANCEL_GRACE_PERIOD",
 		},
+		cli.IntFlag{
+			Name:   "cancel-artifact-grace-period",
+			Value:  0,
+			Usage:  "The number of seconds a canceled or timed out job is given to upload the artifacts it has already produced and the rest of its log, on top of --cancel-grace-period",
+			EnvVar: "BUILDKITE_CANCEL_ARTIFACT_GRACE_PERIOD",
+		},
 		cli.BoolFlag{
 			Name:   "enable-job-log-tmpfile",
 			Usage:  "Store the job logs in a temporary file ′BUILDKITE_JOB_LOG_TMPFILE′ that is accessible during the job and removed at the end of the job",
 			EnvVar: "BUILDKITE_ENABLE_JOB_LOG_TMPFILE",
 		},
+		cli.BoolFlag{
+			Name:   "no-log-streaming",
+			Usage:  "Upload job logs in chunks, even when Buildkite can stream them as they're printed",
+			EnvVar: "BUILDKITE_NO_LOG_STREAMING",
+		},
+		cli.IntFlag{
+			Name:   "log-line-max-length",
+			Value:  0,
+			Usage:  "The longest a line of a job's log can be, in bytes, before it's handled with --log-line-policy, so that huge lines like minified JavaScript don't break the log viewer. 0 doesn't limit them",
+			EnvVar: "BUILDKITE_LOG_LINE_MAX_LENGTH",
+		},
+		cli.StringFlag{
+			Name:   "log-line-policy",
+			Value:  process.LongLinesWrap,
+			Usage:  "What to do with lines longer than --log-line-max-length, either \"wrap\" them onto continuation lines, or \"truncate\" them",
+			EnvVar: "BUILDKITE_LOG_LINE_POLICY",
+		},
 		cli.StringFlag{
 			Name:   "shell",
 			Value:  DefaultShell(),
 			Usage:  "The shell command used to interpret build commands, e.g /bin/bash -e -c",
 			EnvVar: "BUILDKITE_SHELL",
 		},
+		cli.StringFlag{
+			Name:   "wsl-distribution",
+			Value:  "",
+			Usage:  "On Windows, the WSL distribution to run bash hooks and build commands in, translating paths between them. Inside WSL, set it to the distribution to run batch and PowerShell hooks on Windows too",
+			EnvVar: "BUILDKITE_WSL_DISTRIBUTION",
+		},
+		cli.StringFlag{
+			Name:   "macos-keychain",
+			Value:  "",
+			Usage:  "On macOS, a keychain to unlock and add to the search list for each job, then lock again afterwards",
+			EnvVar: "BUILDKITE_MACOS_KEYCHAIN",
+		},
+		cli.StringFlag{
+			Name:   "macos-keychain-password-file",
+			Value:  "",
+			Usage:  "A file containing the password to unlock the macos-keychain with",
+			EnvVar: "BUILDKITE_MACOS_KEYCHAIN_PASSWORD_FILE",
+		},
+		cli.StringFlag{
+			Name:   "macos-provisioning-profiles-path",
+			Value:  "",
+			Usage:  "On macOS, a directory of provisioning profiles to install for each job, and remove afterwards",
+			EnvVar: "BUILDKITE_MACOS_PROVISIONING_PROFILES_PATH",
+		},
+		cli.StringFlag{
+			Name:   "disk-min-free-space",
+			Value:  "",
+			Usage:  "The free disk space (for example, \"5GB\") the build, plugins and temp paths need before a job will run. If there's less, the disk-cleanup hook runs, and the job is refused if that doesn't free up enough",
+			EnvVar: "BUILDKITE_DISK_MIN_FREE_SPACE",
+		},
+		cli.BoolFlag{
+			Name:   "disk-cleanup-checkouts",
+			Usage:  "When there isn't enough free disk space for a job, remove the least recently used checkouts until there is",
+			EnvVar: "BUILDKITE_DISK_CLEANUP_CHECKOUTS",
+		},
+		cli.IntFlag{
+			Name:   "startup-cleanup-age",
+			Value:  3600,
+			Usage:  "When the agent starts, remove locks whose owner isn't running, and git lock files and job temp files left behind by crashed runs that are at least this many seconds old. 0 disables the cleanup",
+			EnvVar: "BUILDKITE_STARTUP_CLEANUP_AGE",
+		},
+		cli.IntFlag{
+			Name:   "clock-skew-threshold",
+			Value:  30,
+			Usage:  "Warn when the system clock differs from Buildkite's by more than this many seconds. 0 disables the check",
+			EnvVar: "BUILDKITE_CLOCK_SKEW_THRESHOLD",
+		},
+		cli.IntFlag{
+			Name:   "reregister-attempts",
+			Value:  3,
+			Usage:  "How many times to try registering again if Buildkite revokes the agent's session. 0 exits instead",
+			EnvVar: "BUILDKITE_REREGISTER_ATTEMPTS",
+		},
+		cli.IntFlag{
+			Name:   "cache-affinity",
+			Value:  0,
+			Usage:  "Ask Buildkite to prefer jobs from the pipelines this agent has most recently built, reporting up to this many of them. 0 disables it",
+			EnvVar: "BUILDKITE_CACHE_AFFINITY",
+		},
+		cli.StringSliceFlag{
+			Name:   "maintenance",
+			Value:  &cli.StringSlice{},
+			Usage:  "Maintenance tasks to run while the agent isn't running jobs, as a comma-separated list of name=schedule (for example, \"docker-prune=0 3 * * *\" or \"cache-gc=@between-jobs\"). Each runs the maintenance-<name> hook, on a cron schedule (using ranges rather than lists), @hourly, @daily, @weekly, or @between-jobs to run after each job",
+			EnvVar: "BUILDKITE_MAINTENANCE",
+		},
+		cli.StringSliceFlag{
+			Name:   "maintenance-windows",
+			Value:  &cli.StringSlice{},
+			Usage:  "Maintenance windows when the agent finishes its running jobs but doesn't accept any more, as a comma-separated list of \"schedule for duration\" (for example, \"0 2 * * 6 for 4h\"), on a cron schedule using ranges rather than lists. The agent accepts jobs again once they end",
+			EnvVar: "BUILDKITE_MAINTENANCE_WINDOWS",
+		},
+		cli.StringFlag{
+			Name:   "maintenance-timezone",
+			Value:  "",
+			Usage:  "The timezone of the maintenance window schedules, like \"Australia/Melbourne\", which defaults to the host's",
+			EnvVar: "BUILDKITE_MAINTENANCE_TIMEZONE",
+		},
+		cli.IntFlag{
+			Name:   "infra-failure-exit-status",
+			Value:  0,
+			Usage:  "The exit status to finish jobs with when they fail because of the agent or its host, such as a failed checkout or running out of memory, so retry rules can target them. 0 keeps the job's own exit status",
+			EnvVar: "BUILDKITE_INFRA_FAILURE_EXIT_STATUS",
+		},
+		cli.BoolFlag{
+			Name:   "infra-failure-annotate",
+			Usage:  "Annotate the build when a job fails because of the agent or its host",
+			EnvVar: "BUILDKITE_INFRA_FAILURE_ANNOTATE",
+		},
+		cli.IntFlag{
+			Name:   "transfer-concurrency",
+			Value:  0,
+			Usage:  "The most artifact uploads, artifact downloads and log uploads to run at once across all spawned agents and their jobs, unlimited by default",
+			EnvVar: "BUILDKITE_TRANSFER_CONCURRENCY",
+		},
+		cli.StringFlag{
+			Name:   "transfer-bandwidth",
+			Value:  "",
+			Usage:  "The bandwidth per second (for example, \"50MB\") that artifact and log transfers share between them on average. Requires --transfer-concurrency",
+			EnvVar: "BUILDKITE_TRANSFER_BANDWIDTH",
+		},
+		cli.StringFlag{
+			Name:   "artifact-max-total-size",
+			Value:  "",
+			Usage:  "The most (for example, \"5GB\") each job can upload as artifacts in total, unlimited by default",
+			EnvVar: "BUILDKITE_ARTIFACT_MAX_TOTAL_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "artifact-max-files",
+			Value:  0,
+			Usage:  "The most artifacts each job can upload, unlimited by default",
+			EnvVar: "BUILDKITE_ARTIFACT_MAX_FILES",
+		},
+		cli.StringFlag{
+			Name:   "artifact-max-file-size",
+			Value:  "",
+			Usage:  "The biggest (for example, \"500MB\") a single artifact can be, unlimited by default",
+			EnvVar: "BUILDKITE_ARTIFACT_MAX_FILE_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "artifact-quota-policy",
+			Value:  agent.ArtifactQuotaFail,
+			Usage:  "What to do when an artifact upload goes over the job's artifact limits, either \"fail\" to fail the upload without uploading anything, or \"truncate\" to upload what fits and skip the rest",
+			EnvVar: "BUILDKITE_ARTIFACT_QUOTA_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "artifact-url-signer",
+			Value:  "",
+			Usage:  "An http(s):// endpoint or a command that artifact download gets pre-signed URLs to download artifacts from, instead of using the agent's own cloud credentials",
+			EnvVar: "BUILDKITE_ARTIFACT_URL_SIGNER",
+		},
+		cli.StringFlag{
+			Name:   "spool-path",
+			Value:  "",
+			Usage:  "A directory to keep job results, log chunks and header times in when Buildkite can't be reached at the end of a job, which are sent once it can be. By default the agent keeps trying to send them",
+			EnvVar: "BUILDKITE_SPOOL_PATH",
+		},
+		cli.DurationFlag{
+			Name:   "spool-max-age",
+			Value:  time.Hour * 24,
+			Usage:  "How long spooled job results are kept for before they're dropped",
+			EnvVar: "BUILDKITE_SPOOL_MAX_AGE",
+		},
+		cli.StringFlag{
+			Name:   "spool-max-size",
+			Value:  "1GB",
+			Usage:  "How large the spool can get (for example, \"500MB\"), after which job results are sent without it",
+			EnvVar: "BUILDKITE_SPOOL_MAX_SIZE",
+		},
 		cli.StringSliceFlag{
 			Name:   "tags",
 			Value:  &cli.StringSlice{},
@@ -294,6 +616,23 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Include tags from the host (hostname, machine-id, os)",
 			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_HOST",
 		},
+		cli.BoolFlag{
+			Name:   "tags-from-gpus",
+			Usage:  "Include tags from the host's NVIDIA and AMD GPUs (gpu-count, gpu-vendor, gpu-model, gpu-driver, gpu-mig-devices)",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_GPUS",
+		},
+		cli.IntFlag{
+			Name:   "gpus-per-job",
+			Value:  0,
+			Usage:  "Give each job this many of the host's GPUs (or MIG partitions) to itself, locked across all the agents on the host, and only look for jobs when enough are free. 0 lets jobs share them",
+			EnvVar: "BUILDKITE_GPUS_PER_JOB",
+		},
+		cli.StringFlag{
+			Name:   "host-attestation",
+			Value:  "",
+			Usage:  "Attest the identity of this host when registering, and add its fingerprint as tags. Either \"ec2\" or \"gcp\", which use the signed instance identity",
+			EnvVar: "BUILDKITE_AGENT_HOST_ATTESTATION",
+		},
 		cli.StringSliceFlag{
 			Name:   "tags-from-ec2-meta-data",
 			Value:  &cli.StringSlice{},
@@ -346,6 +685,18 @@ var AgentStartCommand = cli.Command{
 			EnvVar: "BUILDKITE_AGENT_WAIT_FOR_GCP_LABELS_TIMEOUT",
 			Value:  time.Second * 10,
 		},
+		cli.StringFlag{
+			Name:   "checkout-path-template",
+			Value:  "",
+			Usage:  "Where to check out each job's repository within the build path, using {agent}, {org}, {pipeline}, {branch}, {branch_hash}, {step_key}, {step_key_hash} and {queue}. Defaults to \"{agent}/{org}/{pipeline}\"",
+			EnvVar: "BUILDKITE_CHECKOUT_PATH_TEMPLATE",
+		},
+		cli.StringFlag{
+			Name:   "checkout-type",
+			Value:  "",
+			Usage:  "Which checkout to use for repositories, if the agent has more than git. Defaults to git, or the checkout registered for the repository's URL scheme",
+			EnvVar: "BUILDKITE_CHECKOUT_TYPE",
+		},
 		cli.StringFlag{
 			Name:   "git-clone-flags",
 			Value:  "-v",
@@ -364,6 +715,29 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Flags to pass to \"git fetch\" command",
 			EnvVar: "BUILDKITE_GIT_FETCH_FLAGS",
 		},
+		cli.StringSliceFlag{
+			Name:   "git-ssh-hosts",
+			Value:  &cli.StringSlice{},
+			Usage:  "SSH settings for repository hosts, as a comma-separated list of a host followed by any of port=, identity= and known-hosts= (for example, \"github.com port=443 identity=/etc/buildkite-agent/github_key\")",
+			EnvVar: "BUILDKITE_GIT_SSH_HOSTS",
+		},
+		cli.StringFlag{
+			Name:   "git-ssh-config",
+			Value:  "",
+			Usage:  "An SSH config file to use when checking out, on top of the usual one",
+			EnvVar: "BUILDKITE_GIT_SSH_CONFIG",
+		},
+		cli.BoolFlag{
+			Name:   "git-https-fallback",
+			Usage:  "Check out SSH repositories over HTTPS if their host can't be reached over SSH, for networks that block SSH",
+			EnvVar: "BUILDKITE_GIT_HTTPS_FALLBACK",
+		},
+		cli.StringFlag{
+			Name:   "git-credential-helper",
+			Value:  "",
+			Usage:  "The git credential helper to use for HTTPS checkouts (for example, \"store --file=/etc/buildkite-agent/git-credentials\")",
+			EnvVar: "BUILDKITE_GIT_CREDENTIAL_HELPER",
+		},
 		cli.StringFlag{
 			Name:   "git-clone-mirror-flags",
 			Value:  "-v",
@@ -421,6 +795,16 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Start an HTTP server on this addr:port that returns whether the agent is healthy, disabled by default",
 			EnvVar: "BUILDKITE_AGENT_HEALTH_CHECK_ADDR",
 		},
+		cli.StringFlag{
+			Name:   "control-socket",
+			Usage:  "Listen for \"buildkite-agent ctl\" commands on this unix socket (or named pipe on Windows), disabled by default",
+			EnvVar: "BUILDKITE_AGENT_CONTROL_SOCKET",
+		},
+		cli.BoolFlag{
+			Name:   "take-over",
+			Usage:  "Take over the registrations, control socket and health check of the agent already listening on --control-socket, which stops once its running jobs have finished. The new agent keeps the running agent's name, tags and queue position",
+			EnvVar: "BUILDKITE_TAKE_OVER",
+		},
 		cli.BoolFlag{
 			Name:   "no-pty",
 			Usage:  "Do not run jobs within a pseudo terminal",
@@ -431,6 +815,16 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Don't automatically run ssh-keyscan before checkout",
 			EnvVar: "BUILDKITE_NO_SSH_KEYSCAN",
 		},
+		cli.BoolFlag{
+			Name:   "ssh-strict-host-keys",
+			Usage:  "Refuse to check out from SSH hosts that aren't already known, other than the major git hosts whose keys are pinned, instead of trusting them on first use",
+			EnvVar: "BUILDKITE_SSH_STRICT_HOST_KEYS",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-verify-host-keys-with-dns",
+			Usage:  "Check SSH host keys against the host's SSHFP records in DNS, which must be signed with DNSSEC",
+			EnvVar: "BUILDKITE_SSH_VERIFY_HOST_KEYS_WITH_DNS",
+		},
 		cli.BoolFlag{
 			Name:   "no-command-eval",
 			Usage:  "Don't allow this agent to run arbitrary console commands, including plugins",
@@ -446,6 +840,17 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Don't validate plugin configuration and requirements",
 			EnvVar: "BUILDKITE_NO_PLUGIN_VALIDATION",
 		},
+		cli.BoolFlag{
+			Name:   "isolate-plugins",
+			Usage:  "Run each plugin's hooks in a working directory of its own, keeping the environment variables they set to the plugin unless they're shared",
+			EnvVar: "BUILDKITE_ISOLATE_PLUGINS",
+		},
+		cli.StringSliceFlag{
+			Name:   "plugins-shared-env",
+			Value:  &cli.StringSlice{},
+			Usage:  "Environment variables isolated plugins can set for the rest of the job, where a name ending in * shares every variable starting with it",
+			EnvVar: "BUILDKITE_PLUGINS_SHARED_ENV",
+		},
 		cli.BoolFlag{
 			Name:   "no-local-hooks",
 			Usage:  "Don't allow local hooks to be run from checked out repositories",
@@ -483,6 +888,11 @@ var AgentStartCommand = cli.Command{
 			EnvVar: "BUILDKITE_LOG_FORMAT",
 			Value:  "text",
 		},
+		cli.BoolFlag{
+			Name:   "windows-event-log",
+			Usage:  "On Windows, also write the agent's logs to the Windows Event Log as the buildkite-agent source, with event IDs for agent connections, disconnections and job failures",
+			EnvVar: "BUILDKITE_AGENT_WINDOWS_EVENT_LOG",
+		},
 		cli.IntFlag{
 			Name:   "spawn",
 			Usage:  "The number of agents to spawn in parallel",
@@ -494,12 +904,71 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Assign priorities to every spawned agent (when using --spawn) equal to the agent's index",
 			EnvVar: "BUILDKITE_AGENT_SPAWN_WITH_PRIORITY",
 		},
+		cli.DurationFlag{
+			Name:   "start-delay-max",
+			Usage:  "Wait up to this long before registering, by an amount that depends on the host, so a fleet booting at once doesn't register together. Spawned agents are staggered across it, each waiting once",
+			EnvVar: "BUILDKITE_AGENT_START_DELAY_MAX",
+		},
 		cli.StringFlag{
 			Name:   "cancel-signal",
 			Usage:  "The signal to use for cancellation",
 			EnvVar: "BUILDKITE_CANCEL_SIGNAL",
 			Value:  "SIGTERM",
 		},
+		cli.StringSliceFlag{
+			Name:   "signal-actions",
+			Value:  &cli.StringSlice{},
+			Usage:  "What the agent does when it receives a signal, as a comma-separated list of signal=action, where the action is cancel (cancel running jobs and stop), drain (stop once running jobs finish, and cancel them on a second drain), dump (log what each agent is doing and carry on), reload (load the configuration again and apply the tags, log level, spawn count and priority without stopping running jobs) or ignore. Defaults to SIGHUP=reload,SIGINT=drain,SIGTERM=drain,SIGQUIT=cancel,SIGUSR1=dump",
+			EnvVar: "BUILDKITE_SIGNAL_ACTIONS",
+		},
+		cli.StringSliceFlag{
+			Name:   "env-policy-allow",
+			Value:  &cli.StringSlice{},
+			Usage:  "A comma-separated list of protected environment variable names (or patterns) that jobs are still allowed to set, e.g \"PATH,DOCKER_HOST\"",
+			EnvVar: "BUILDKITE_ENV_POLICY_ALLOW",
+		},
+		cli.StringFlag{
+			Name:   "env-schema-path",
+			Value:  "",
+			Usage:  "A YAML or JSON file declaring the environment variables jobs on this agent need, with their types and patterns, which are checked before the command runs",
+			EnvVar: "BUILDKITE_ENV_SCHEMA_PATH",
+		},
+		cli.StringFlag{
+			Name:   "tools-path",
+			Value:  "",
+			Usage:  "Directory where \"buildkite-agent tool install\" keeps the tools that jobs install",
+			EnvVar: "BUILDKITE_TOOLS_PATH",
+		},
+		cli.StringSliceFlag{
+			Name:   "tool-mirrors",
+			Value:  &cli.StringSlice{},
+			Usage:  "A comma-separated list of URLs that \"buildkite-agent tool install\" downloads tools from, tried in order. Tools are found under {name}/{version}/{os}-{arch}/{name}, or at a URL with those placeholders",
+			EnvVar: "BUILDKITE_TOOL_MIRRORS",
+		},
+		cli.StringFlag{
+			Name:   "tool-checksums",
+			Value:  "",
+			Usage:  "A file of the SHA-256 checksums of the tools jobs can install, with a line like \"<sha256>  <name>@<version> <os>-<arch>\" for each",
+			EnvVar: "BUILDKITE_TOOL_CHECKSUMS",
+		},
+		cli.StringFlag{
+			Name:   "job-tmp-path",
+			Value:  "",
+			Usage:  "Directory where each job's own temporary directory is created, which jobs are given as TMPDIR and is removed once they finish. Defaults to the system's temporary directory",
+			EnvVar: "BUILDKITE_JOB_TMP_PATH",
+		},
+		cli.StringFlag{
+			Name:   "job-tmpfs-size",
+			Value:  "",
+			Usage:  "Mount a tmpfs of this size (for example, \"2GB\") on each job's temporary directory. Only supported on Linux, when the agent runs as root",
+			EnvVar: "BUILDKITE_JOB_TMPFS_SIZE",
+		},
+		cli.StringSliceFlag{
+			Name:   "allowed-job-experiments",
+			Value:  &cli.StringSlice{},
+			Usage:  "A comma-separated list of experiments that steps can opt in to by setting BUILDKITE_JOB_EXPERIMENTS",
+			EnvVar: "BUILDKITE_AGENT_ALLOWED_JOB_EXPERIMENTS",
+		},
 		cli.StringFlag{
 			Name:   "tracing-backend",
 			Usage:  `Enable tracing for build jobs by specifying a backend, "datadog" or "opentelemetry"`,
@@ -512,6 +981,14 @@ var AgentStartCommand = cli.Command{
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		APIRecordPathFlag,
+		APIReplayPathFlag,
+		APIRequestSigningFlag,
+		APIRequestSigningSecretFlag,
+		APIRequestSigningRegionFlag,
+		IPFamilyFlag,
+		ProxyPACFlag,
+		DNSCacheFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -575,6 +1052,7 @@ var AgentStartCommand = cli.Command{
 			CLI:                    c,
 			Config:                 &cfg,
 			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+			CheckUnknownKeys:       true,
 		}
 
 		// Load the configuration
@@ -584,6 +1062,11 @@ var AgentStartCommand = cli.Command{
 			os.Exit(1)
 		}
 
+		// Keep the configuration as it was loaded, and the environment it
+		// was loaded from, to compare with when it's reloaded
+		loadedCfg := cfg
+		environ := env.FromSlice(os.Environ())
+
 		l := CreateLogger(cfg)
 
 		// Show warnings now we have a logger
@@ -591,6 +1074,21 @@ var AgentStartCommand = cli.Command{
 			l.Warn("%s", warning)
 		}
 
+		// Show where the options that aren't defaults were set from, for
+		// working out why one has the value it does
+		sources := loader.Sources()
+		names := maps.Keys(sources)
+		sort.Strings(names)
+		for _, name := range names {
+			switch sources[name] {
+			case cliconfig.SourceDefault:
+			case cliconfig.SourceConfigFile:
+				l.Debug("The config option %s is set in the config file %s", name, loader.File.PathOf(name))
+			default:
+				l.Debug("The config option %s is set by its %s", name, sources[name])
+			}
+		}
+
 		// Setup any global configuration options
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
@@ -601,6 +1099,9 @@ var AgentStartCommand = cli.Command{
 			fmt.Printf("%s", err)
 			os.Exit(1)
 		}
+		for _, name := range loader.SecretEnvNames {
+			os.Unsetenv(name)
+		}
 
 		// Check if git-mirrors are enabled
 		if experiments.IsEnabled(`git-mirrors`) {
@@ -694,11 +1195,104 @@ var AgentStartCommand = cli.Command{
 			DatadogDistributions: cfg.MetricsDatadogDistributions,
 		})
 
+		// Resolver flakiness otherwise only shows up as requests timing out
+		if dnsCache != nil {
+			dnsMetrics := mc.Scope(metrics.Tags{})
+			logLookup := dnsCache.OnLookup
+			dnsCache.OnLookup = func(host string, took time.Duration, err error) {
+				logLookup(host, took, err)
+				tags := metrics.Tags{"host": host}
+				dnsMetrics.Timing("dns.lookup.duration", took, tags)
+				if err != nil {
+					dnsMetrics.Count("dns.lookup.failures", 1, tags)
+				}
+			}
+		}
+
 		// Sense check supported tracing backends, we don't want bootstrapped jobs to silently have no tracing
 		if _, has := tracetools.ValidTracingBackends[cfg.TracingBackend]; !has {
 			l.Fatal("The given tracing backend %q is not supported. Valid backends are: %q", cfg.TracingBackend, maps.Keys(tracetools.ValidTracingBackends))
 		}
 
+		var diskMinFreeSpace uint64
+		if cfg.DiskMinFreeSpace != "" {
+			diskMinFreeSpace, err = humanize.ParseBytes(cfg.DiskMinFreeSpace)
+			if err != nil {
+				l.Fatal("The given minimum free disk space %q is not valid: %v", cfg.DiskMinFreeSpace, err)
+			}
+		}
+
+		if cfg.CancelArtifactGracePeriod < 0 {
+			l.Fatal("The cancel artifact grace period can't be negative")
+		}
+
+		if cfg.TransferConcurrency < 0 {
+			l.Fatal("The transfer concurrency can't be negative")
+		}
+
+		var transferBandwidth uint64
+		if cfg.TransferBandwidth != "" {
+			transferBandwidth, err = humanize.ParseBytes(cfg.TransferBandwidth)
+			if err != nil {
+				l.Fatal("The given transfer bandwidth %q is not valid: %v", cfg.TransferBandwidth, err)
+			}
+		}
+
+		var artifactMaxTotalSize, artifactMaxFileSize uint64
+		if cfg.ArtifactMaxTotalSize != "" {
+			artifactMaxTotalSize, err = humanize.ParseBytes(cfg.ArtifactMaxTotalSize)
+			if err != nil {
+				l.Fatal("The given artifact max total size %q is not valid: %v", cfg.ArtifactMaxTotalSize, err)
+			}
+		}
+		if cfg.ArtifactMaxFileSize != "" {
+			artifactMaxFileSize, err = humanize.ParseBytes(cfg.ArtifactMaxFileSize)
+			if err != nil {
+				l.Fatal("The given artifact max file size %q is not valid: %v", cfg.ArtifactMaxFileSize, err)
+			}
+		}
+		if cfg.ArtifactMaxFiles < 0 {
+			l.Fatal("The artifact max files can't be negative")
+		}
+		if err := agent.ValidateArtifactQuotaPolicy(cfg.ArtifactQuotaPolicy); err != nil {
+			l.Fatal("%v", err)
+		}
+
+		var jobTmpfsSize uint64
+		if cfg.JobTmpfsSize != "" {
+			jobTmpfsSize, err = humanize.ParseBytes(cfg.JobTmpfsSize)
+			if err != nil {
+				l.Fatal("The given job tmpfs size %q is not valid: %v", cfg.JobTmpfsSize, err)
+			}
+		}
+
+		var spoolMaxAge time.Duration
+		var spoolMaxSize uint64
+		if cfg.SpoolPath != "" {
+			if t := cfg.SpoolMaxAge; t != "" {
+				spoolMaxAge, err = time.ParseDuration(t)
+				if err != nil {
+					l.Fatal("Failed to parse spool max age: %v", err)
+				}
+			}
+			if cfg.SpoolMaxSize != "" {
+				spoolMaxSize, err = humanize.ParseBytes(cfg.SpoolMaxSize)
+				if err != nil {
+					l.Fatal("The given spool max size %q is not valid: %v", cfg.SpoolMaxSize, err)
+				}
+			}
+		}
+
+		// The host's GPUs, for tags and for jobs to be given their own
+		var gpus []agent.GPU
+		if cfg.TagsFromGPUs || cfg.GPUsPerJob > 0 {
+			gpus = agent.DetectGPUs(l)
+			l.Info("Found %d GPUs", len(gpus))
+		}
+		if cfg.GPUsPerJob < 0 {
+			l.Fatal("The number of GPUs per job can't be negative")
+		}
+
 		// AgentConfiguration is the runtime configuration for an agent
 		agentConf := agent.AgentConfiguration{
 			BootstrapScript:            cfg.BootstrapScript,
@@ -708,30 +1302,86 @@ var AgentStartCommand = cli.Command{
 			GitMirrorsSkipUpdate:       cfg.GitMirrorsSkipUpdate,
 			HooksPath:                  cfg.HooksPath,
 			PluginsPath:                cfg.PluginsPath,
+			CheckoutType:               cfg.CheckoutType,
+			CheckoutPathTemplate:       cfg.CheckoutPathTemplate,
 			GitCloneFlags:              cfg.GitCloneFlags,
 			GitCloneMirrorFlags:        cfg.GitCloneMirrorFlags,
 			GitCleanFlags:              cfg.GitCleanFlags,
 			GitFetchFlags:              cfg.GitFetchFlags,
+			GitSSHHosts:                cfg.GitSSHHosts,
+			GitSSHConfig:               cfg.GitSSHConfig,
+			GitHTTPSFallback:           cfg.GitHTTPSFallback,
+			GitCredentialHelper:        cfg.GitCredentialHelper,
 			GitSubmodules:              !cfg.NoGitSubmodules,
 			SSHKeyscan:                 !cfg.NoSSHKeyscan,
+			SSHStrictHostKeys:          cfg.SSHStrictHostKeys,
+			SSHVerifyHostKeysWithDNS:   cfg.SSHVerifyHostKeysWithDNS,
 			CommandEval:                !cfg.NoCommandEval,
 			PluginsEnabled:             !cfg.NoPlugins,
 			PluginValidation:           !cfg.NoPluginValidation,
+			IsolatePlugins:             cfg.IsolatePlugins,
+			PluginsSharedEnv:           cfg.PluginsSharedEnv,
 			LocalHooksEnabled:          !cfg.NoLocalHooks,
 			RunInPty:                   !cfg.NoPTY,
 			TimestampLines:             cfg.TimestampLines,
+			HealthCheckAddr:            cfg.HealthCheckAddr,
 			DisconnectAfterJob:         cfg.DisconnectAfterJob,
 			DisconnectAfterIdleTimeout: cfg.DisconnectAfterIdleTimeout,
 			CancelGracePeriod:          cfg.CancelGracePeriod,
+			CancelArtifactGracePeriod:  cfg.CancelArtifactGracePeriod,
 			EnableJobLogTmpfile:        cfg.EnableJobLogTmpfile,
+			NoLogStreaming:             cfg.NoLogStreaming,
+			LogLineMaxLength:           cfg.LogLineMaxLength,
+			LogLinePolicy:              cfg.LogLinePolicy,
 			Shell:                      cfg.Shell,
+			WSLDistribution:            cfg.WSLDistribution,
+			MacOSKeychain:              cfg.MacOSKeychain,
+			MacOSKeychainPasswordFile:  cfg.MacOSKeychainPasswordFile,
+			MacOSProvisioningProfiles:  cfg.MacOSProvisioningProfiles,
+			DiskMinFreeSpace:           diskMinFreeSpace,
+			DiskCleanupCheckouts:       cfg.DiskCleanupCheckouts,
+			ClockSkewThreshold:         cfg.ClockSkewThreshold,
+			ReregisterAttempts:         cfg.ReregisterAttempts,
+			CacheAffinity:              cfg.CacheAffinity,
+			MaintenanceTasks:           cfg.Maintenance,
+			MaintenanceWindows:         cfg.MaintenanceWindows,
+			MaintenanceTimezone:        cfg.MaintenanceTimezone,
+			InfraFailureExitStatus:     cfg.InfraFailureExitStatus,
+			InfraFailureAnnotate:       cfg.InfraFailureAnnotate,
+			TransferConcurrency:        cfg.TransferConcurrency,
+			TransferBandwidth:          int64(transferBandwidth),
+			ArtifactMaxTotalSize:       artifactMaxTotalSize,
+			ArtifactMaxFiles:           cfg.ArtifactMaxFiles,
+			ArtifactMaxFileSize:        artifactMaxFileSize,
+			ArtifactQuotaPolicy:        cfg.ArtifactQuotaPolicy,
+			ArtifactURLSigner:          cfg.ArtifactURLSigner,
+			SpoolPath:                  cfg.SpoolPath,
+			SpoolMaxAge:                spoolMaxAge,
+			SpoolMaxSize:               int64(spoolMaxSize),
 			RedactedVars:               cfg.RedactedVars,
+			EnvPolicyAllow:             cfg.EnvPolicyAllow,
+			EnvSchemaPath:              cfg.EnvSchemaPath,
+			ToolsPath:                  cfg.ToolsPath,
+			ToolMirrors:                cfg.ToolMirrors,
+			ToolChecksums:              cfg.ToolChecksums,
+			JobTmpPath:                 cfg.JobTmpPath,
+			JobTmpfsSize:               jobTmpfsSize,
+			GPUs:                       gpus,
+			GPUsPerJob:                 cfg.GPUsPerJob,
+			AllowedJobExperiments:      cfg.AllowedJobExperiments,
 			AcquireJob:                 cfg.AcquireJob,
+			AcceptJobs:                 cfg.AcceptJobs,
+			ReadinessChecks:            cfg.ReadinessChecks,
+			ReadinessTimeout:           cfg.ReadinessTimeout,
+			ProxyPAC:                   cfg.ProxyPAC,
+			DNSCache:                   cfg.DNSCache,
 			TracingBackend:             cfg.TracingBackend,
 		}
 
-		if loader.File != nil {
-			agentConf.ConfigPath = loader.File.Path
+		// When several config files were merged, jobs get the path to the
+		// one whose options take precedence
+		if len(loader.Files) > 0 {
+			agentConf.ConfigPath = loader.Files[len(loader.Files)-1].Path
 		}
 
 		if cfg.LogFormat == `text` {
@@ -757,14 +1407,17 @@ var AgentStartCommand = cli.Command{
 		l.Notice("The agent source code can be found here: https://github.com/buildkite/agent")
 		l.Notice("For questions and support, email us at: hello@buildkite.com")
 
-		if agentConf.ConfigPath != "" {
-			l.WithFields(logger.StringField(`path`, agentConf.ConfigPath)).Info("Configuration loaded")
+		if loader.File != nil {
+			l.WithFields(logger.StringField(`path`, loader.File.Path)).Info("Configuration loaded")
 		}
 
 		l.Debug("Bootstrap command: %s", agentConf.BootstrapScript)
 		l.Debug("Build path: %s", agentConf.BuildPath)
 		l.Debug("Hooks directory: %s", agentConf.HooksPath)
 		l.Debug("Plugins directory: %s", agentConf.PluginsPath)
+		if agentConf.ToolsPath != "" {
+			l.Debug("Tools directory: %s", agentConf.ToolsPath)
+		}
 
 		if !agentConf.SSHKeyscan {
 			l.Info("Automatic ssh-keyscan has been disabled")
@@ -795,6 +1448,11 @@ var AgentStartCommand = cli.Command{
 			l.Fatal("Failed to parse cancel-signal: %v", err)
 		}
 
+		signalActions, err := agent.ParseSignalActions(cfg.SignalActions)
+		if err != nil {
+			l.Fatal("Failed to parse signal-actions: %v", err)
+		}
+
 		// confirm the BuildPath is exists. The bootstrap is going to write to it when a job executes,
 		// so we may as well check that'll work now and fail early if it's a problem
 		if !utils.FileExists(agentConf.BuildPath) {
@@ -805,6 +1463,47 @@ var AgentStartCommand = cli.Command{
 			}
 		}
 
+		if cfg.StartupCleanupAge > 0 {
+			cleanupStartupLeftovers(l, agentConf, time.Duration(cfg.StartupCleanupAge)*time.Second)
+		}
+
+		// Buildkite compares priorities as numbers
+		if cfg.Priority != "" {
+			if _, err := strconv.Atoi(cfg.Priority); err != nil {
+				l.Fatal("The agent priority must be a whole number, not %q", cfg.Priority)
+			}
+		}
+
+		if _, err := agent.ParseMaintenanceTasks(cfg.Maintenance); err != nil {
+			l.Fatal("%v", err)
+		}
+
+		if _, err := agent.ParseMaintenanceWindows(cfg.MaintenanceWindows, cfg.MaintenanceTimezone); err != nil {
+			l.Fatal("%v", err)
+		}
+
+		if _, err := agent.ParseJobFilters(cfg.AcceptJobs); err != nil {
+			l.Fatal("%v", err)
+		}
+
+		if _, err := agent.ParseReadinessChecks(cfg.ReadinessChecks); err != nil {
+			l.Fatal("%v", err)
+		}
+
+		if _, err := agent.ParseGitSSHHosts(cfg.GitSSHHosts); err != nil {
+			l.Fatal("%v", err)
+		}
+
+		if cfg.EnvSchemaPath != "" {
+			data, err := os.ReadFile(cfg.EnvSchemaPath)
+			if err != nil {
+				l.Fatal("Failed to read the environment schema: %v", err)
+			}
+			if _, err := env.ParseSchema(data); err != nil {
+				l.Fatal("%v", err)
+			}
+		}
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, `Token`))
 
@@ -812,6 +1511,7 @@ var AgentStartCommand = cli.Command{
 		registerReq := api.AgentRegisterRequest{
 			Name:              cfg.Name,
 			Priority:          cfg.Priority,
+			Weight:            cfg.Weight,
 			ScriptEvalEnabled: !cfg.NoCommandEval,
 			Tags: agent.FetchTags(l, agent.FetchTagsConfig{
 				Tags:                      cfg.Tags,
@@ -833,61 +1533,117 @@ var AgentStartCommand = cli.Command{
 			Features:           cfg.Features(),
 		}
 
+		if cfg.TagsFromGPUs {
+			registerReq.Tags = append(registerReq.Tags, agent.GPUTags(gpus)...)
+		}
+
+		// Attest the identity of the host so the control plane can restrict
+		// jobs to verified hosts. If it was asked for, we can't register
+		// without it.
+		if cfg.HostAttestation != "" {
+			l.Info("Fetching %s host attestation...", cfg.HostAttestation)
+
+			attestation, err := agent.FetchHostAttestation(cfg.HostAttestation)
+			if err != nil {
+				l.Fatal("Failed to attest host: %v", err)
+			}
+
+			l.Info("Host attestation fingerprint is %s", attestation.Fingerprint)
+			registerReq.Attestation = attestation
+			registerReq.Tags = append(registerReq.Tags, agent.HostAttestationTags(attestation)...)
+		}
+
 		// Spawning multiple agents doesn't work if the agent is being
 		// booted in acquisition mode
 		if cfg.Spawn > 1 && cfg.AcquireJob != "" {
 			l.Fatal("You can't spawn multiple agents and acquire a job at the same time")
 		}
 
-		var workers []*agent.AgentWorker
-
-		for i := 1; i <= cfg.Spawn; i++ {
-			if cfg.Spawn == 1 {
-				l.Info("Registering agent with Buildkite...")
-			} else {
-				l.Info("Registering agent %d of %d with Buildkite...", i, cfg.Spawn)
+		// Take over from a running agent, so it's replaced without dropping
+		// out of the queue
+		var handover *agent.Handover
+		if cfg.TakeOver {
+			if cfg.AcquireJob != "" {
+				l.Fatal("You can't take over from a running agent and acquire a job at the same time")
 			}
 
-			// Handle per-spawn name interpolation, replacing %spawn with the spawn index
-			registerReq.Name = strings.ReplaceAll(cfg.Name, "%spawn", strconv.Itoa(i))
+			l.Info("Taking over from the agent on control socket %s...", cfg.ControlSocket)
 
-			if cfg.SpawnWithPriority {
-				l.Info("Assigning priority %s for agent %d", strconv.Itoa(i), i)
-				registerReq.Priority = strconv.Itoa(i)
-			}
-
-			// Register the agent with the buildkite API
-			ag, err := agent.Register(l, client, registerReq)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			handover, err = agent.RequestHandover(ctx, cfg.ControlSocket, cfg.Spawn)
+			cancel()
 			if err != nil {
-				l.Fatal("%s", err)
+				l.Warn("Couldn't take over from a running agent, starting normally: %v", err)
 			}
+		}
 
-			// Create an agent worker to run the agent
-			workers = append(workers,
-				agent.NewAgentWorker(
-					l.WithFields(logger.StringField(`agent`, ag.Name)), ag, mc, client, agent.AgentWorkerConfig{
-						AgentConfiguration: agentConf,
-						CancelSignal:       cancelSig,
-						Debug:              cfg.Debug,
-						DebugHTTP:          cfg.DebugHTTP,
-						SpawnIndex:         i,
-					}))
+		var registrations []*api.AgentRegisterResponse
+		handoverListeners := map[string]net.Listener{}
+		if handover != nil {
+			registrations = handover.Agents
+			handoverListeners = handover.Listeners
 		}
 
-		// Setup the agent pool that spawns agent workers
+		runConfig := agent.RunConfig{
+			RegisterRequest:    registerReq,
+			Spawn:              cfg.Spawn,
+			SpawnWithPriority:  cfg.SpawnWithPriority,
+			AgentConfiguration: agentConf,
+			CancelSignal:       cancelSig,
+			Debug:              cfg.Debug,
+			Metrics:            mc,
+			API:                client.Config(),
+			Registrations:      registrations,
+			StartDelayMax:      cfg.StartDelayMax,
+		}
+
+		// Until the pool handles signals, they stop the agent waiting to
+		// register
+		registerCtx, stopRegistering := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		workers, err := agent.RegisterWorkers(registerCtx, l, client, runConfig)
+		stopRegistering()
+		if errors.Is(err, context.Canceled) {
+			l.Info("Stopped before registering")
+			return
+		}
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Setup the agent pool that spawns agent workers, and more of them
+		// if the spawn count is reloaded
 		pool := agent.NewAgentPool(workers)
+		pool.SetSpawner(func(index int) (*agent.AgentWorker, error) {
+			return agent.RegisterWorker(l, client, runConfig, index)
+		})
 
-		// Agent-wide shutdown hook. Once per agent, for all workers on the agent.
-		defer agentShutdownHook(l, cfg)
+		reloader := &agentReloader{
+			logger:      l,
+			cli:         c,
+			pool:        pool,
+			environ:     environ,
+			cfg:         loadedCfg,
+			runConfig:   &runConfig,
+			fetchedTags: append([]string{}, registerReq.Tags[len(cfg.Tags):]...),
+		}
+
+		// Agent-wide shutdown hook. Once per agent, for all workers on the
+		// agent, unless another agent has taken over.
+		defer func() {
+			if !pool.HandedOver() {
+				agentShutdownHook(l, cfg)
+			}
+		}()
 
 		// Handle process signals
-		signals := handlePoolSignals(l, pool)
+		signals := handlePoolSignals(l, pool, signalActions, reloader.Reload)
 		defer close(signals)
 
 		l.Info("Starting %d Agent(s)", cfg.Spawn)
 		l.Info("You can press Ctrl-C to stop the agents")
 
 		// Determine the health check listening address and port for this agent
+		var healthCheckListener net.Listener
 		if cfg.HealthCheckAddr != "" {
 			http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 				if r.URL.Path != "/" {
@@ -897,13 +1653,39 @@ var AgentStartCommand = cli.Command{
 				}
 			})
 
-			go func() {
-				l.Notice("Starting HTTP health check server on %v", cfg.HealthCheckAddr)
-				err := http.ListenAndServe(cfg.HealthCheckAddr, nil)
-				if err != nil {
+			healthCheckListener = handoverListeners[agent.HandoverHealthCheckListener]
+			if healthCheckListener == nil {
+				if healthCheckListener, err = net.Listen("tcp", cfg.HealthCheckAddr); err != nil {
 					l.Error("Could not start health check server: %v", err)
 				}
-			}()
+			}
+
+			if healthCheckListener != nil {
+				go func() {
+					l.Notice("Starting HTTP health check server on %v", cfg.HealthCheckAddr)
+					err := http.Serve(healthCheckListener, nil)
+
+					// The listener is closed once it's handed over
+					if err != nil && !pool.HandedOver() {
+						l.Error("Could not start health check server: %v", err)
+					}
+				}()
+			}
+		}
+
+		// Start the control socket, so the agent can be managed locally
+		if cfg.ControlSocket != "" {
+			controlServer := agent.NewControlServer(l, pool, cfg.ControlSocket)
+			if ln := handoverListeners[agent.HandoverControlListener]; ln != nil {
+				controlServer.StartWithListener(ln)
+			} else if err := controlServer.Start(); err != nil {
+				l.Fatal("%s", err)
+			}
+			defer controlServer.Stop()
+
+			if healthCheckListener != nil {
+				controlServer.AddHandoverListener(agent.HandoverHealthCheckListener, healthCheckListener)
+			}
 		}
 
 		// Start the agent pool
@@ -913,43 +1695,67 @@ var AgentStartCommand = cli.Command{
 	},
 }
 
-func handlePoolSignals(l logger.Logger, pool *agent.AgentPool) chan os.Signal {
+// handlePoolSignals does what each signal's action asks of the pool, reloading
+// the configuration with reload. The same actions apply on every platform and
+// however many agents are spawned, but Windows only delivers SIGINT (Ctrl-C)
+// and SIGTERM.
+func handlePoolSignals(l logger.Logger, pool *agent.AgentPool, actions map[process.Signal]agent.SignalAction, reload func()) chan os.Signal {
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt,
-		syscall.SIGHUP,
-		syscall.SIGTERM,
-		syscall.SIGINT,
-		syscall.SIGQUIT)
+	for sig := range actions {
+		signal.Notify(signals, syscall.Signal(sig))
+	}
 
 	go func() {
-		var interruptCount int
-
 		for sig := range signals {
-			l.Debug("Received signal `%v`", sig)
-
-			switch sig {
-			case syscall.SIGQUIT:
-				l.Debug("Received signal `%s`", sig.String())
-				pool.Stop(false)
-			case syscall.SIGTERM, syscall.SIGINT:
-				l.Debug("Received signal `%s`", sig.String())
-				if interruptCount == 0 {
-					interruptCount++
-					l.Info("Received CTRL-C, send again to forcefully kill the agent(s)")
-					pool.Stop(true)
-				} else {
-					l.Info("Forcefully stopping running jobs and stopping the agent(s)")
-					pool.Stop(false)
-				}
-			default:
+			s, ok := sig.(syscall.Signal)
+			if !ok {
 				l.Debug("Ignoring signal `%s`", sig.String())
+				continue
+			}
+
+			action := actions[process.Signal(s)]
+			l.Debug("Received signal `%s`, action is %s", sig.String(), action)
+
+			if action == agent.SignalActionReload {
+				reload()
+				continue
 			}
+			pool.HandleSignal(l, action)
 		}
 	}()
 
 	return signals
 }
 
+// cleanupStartupLeftovers removes the locks and temp files left behind by
+// earlier runs of the agent that crashed or were killed, and logs what it
+// removed
+func cleanupStartupLeftovers(l logger.Logger, conf agent.AgentConfiguration, minAge time.Duration) {
+	knownHostsPath, err := utils.ExpandHome("~/.ssh/known_hosts")
+	if err != nil {
+		knownHostsPath = ""
+	}
+
+	report := agent.CleanupStartupLeftovers(agent.StartupCleanupConfig{
+		BuildPath:      conf.BuildPath,
+		PluginsPath:    conf.PluginsPath,
+		GitMirrorsPath: conf.GitMirrorsPath,
+		KnownHostsPath: knownHostsPath,
+		TempDir:        os.TempDir(),
+		MinAge:         minAge,
+	})
+
+	for _, file := range report.Removed {
+		l.Info("Removed %s, because %s", file.Path, file.Reason)
+	}
+	for _, err := range report.Errors {
+		l.Warn("%v", err)
+	}
+	if len(report.Removed) > 0 {
+		l.Info("Cleaned up %d file(s) left behind by earlier runs of the agent", len(report.Removed))
+	}
+}
+
 // agentShutdownHook looks for an agent-shutdown hook script in the hooks path
 // and executes it if found. Output (stdout + stderr) is streamed into the main
 // agent logger. Exit status failure is logged but ignored.
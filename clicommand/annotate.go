@@ -1,13 +1,16 @@
 package clicommand
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
+	"unicode"
 
+	"github.com/buildkite/agent/v3/retry"
 	"github.com/buildkite/agent/v3/stdin"
-	"github.com/buildkite/roko"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
@@ -41,19 +44,44 @@ Description:
    You can also update only the style of an existing annotation by omitting the
    body entirely and providing a new style value.
 
+   Annotations with a higher priority (from 1 to 10, 3 by default) are shown
+   above the others.
+
+   When appending would make an annotation too large, Buildkite rejects it.
+   With --replace-if-larger, the annotation is replaced with the new body
+   instead.
+
 Example:
 
    $ buildkite-agent annotate "All tests passed! :rocket:"
    $ cat annotation.md | buildkite-agent annotate --style "warning"
    $ buildkite-agent annotate --style "success" --context "junit"
+   $ buildkite-agent annotate "Deploy failed" --style "error" --priority 10
    $ ./script/dynamic_annotation_generator | buildkite-agent annotate --style "success"`
 
+// The styles annotations can have
+var annotationStyles = []string{"success", "info", "warning", "error"}
+
+const (
+	// The largest annotation body Buildkite accepts
+	maxAnnotationBodySize = 1024 * 1024
+
+	// The longest annotation context Buildkite accepts
+	maxAnnotationContextLength = 100
+
+	// The range of annotation priorities
+	minAnnotationPriority = 1
+	maxAnnotationPriority = 10
+)
+
 type AnnotateConfig struct {
-	Body    string `cli:"arg:0" label:"annotation body"`
-	Style   string `cli:"style"`
-	Context string `cli:"context"`
-	Append  bool   `cli:"append"`
-	Job     string `cli:"job" validate:"required"`
+	Body            string `cli:"arg:0" label:"annotation body"`
+	Style           string `cli:"style"`
+	Context         string `cli:"context"`
+	Append          bool   `cli:"append"`
+	ReplaceIfLarger bool   `cli:"replace-if-larger"`
+	Priority        int    `cli:"priority"`
+	Job             string `cli:"job" validate:"required"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
@@ -63,10 +91,18 @@ type AnnotateConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP               bool   `cli:"debug-http"`
+	AgentAccessToken        string `cli:"agent-access-token" validate:"required"`
+	Endpoint                string `cli:"endpoint" validate:"required"`
+	NoHTTP2                 bool   `cli:"no-http2"`
+	APIRecordPath           string `cli:"api-record-path" normalize:"filepath"`
+	APIReplayPath           string `cli:"api-replay-path" normalize:"filepath"`
+	APIRequestSigning       string `cli:"api-request-signing" validate:"oneof:hmac|aws-sigv4"`
+	APIRequestSigningSecret string `cli:"api-request-signing-secret"`
+	APIRequestSigningRegion string `cli:"api-request-signing-region"`
+	IPFamily                string `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                string `cli:"proxy-pac"`
+	DNSCache                bool   `cli:"dns-cache"`
 }
 
 var AnnotateCommand = cli.Command{
@@ -89,6 +125,17 @@ var AnnotateCommand = cli.Command{
 			Usage:  "Append to the body of an existing annotation",
 			EnvVar: "BUILDKITE_ANNOTATION_APPEND",
 		},
+		cli.BoolFlag{
+			Name:   "replace-if-larger",
+			Usage:  "When appending would make the annotation too large, replace it with the new body instead. Requires --append",
+			EnvVar: "BUILDKITE_ANNOTATION_REPLACE_IF_LARGER",
+		},
+		cli.IntFlag{
+			Name:   "priority",
+			Value:  0,
+			Usage:  "The priority of the annotation, from 1 to 10, where higher priority annotations are shown first. Defaults to 3",
+			EnvVar: "BUILDKITE_ANNOTATION_PRIORITY",
+		},
 		cli.StringFlag{
 			Name:   "job",
 			Value:  "",
@@ -101,6 +148,14 @@ var AnnotateCommand = cli.Command{
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		APIRecordPathFlag,
+		APIReplayPathFlag,
+		APIRequestSigningFlag,
+		APIRequestSigningSecretFlag,
+		APIRequestSigningRegionFlag,
+		IPFamilyFlag,
+		ProxyPACFlag,
+		DNSCacheFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -147,28 +202,42 @@ var AnnotateCommand = cli.Command{
 			body = string(stdin[:])
 		}
 
+		// Check the annotation before Buildkite does, to give a better error
+		if err := validateAnnotation(cfg, body); err != nil {
+			l.Fatal("%s", err)
+		}
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
 
 		// Create the annotation we'll send to the Buildkite API
 		annotation := &api.Annotation{
-			Body:    body,
-			Style:   cfg.Style,
-			Context: cfg.Context,
-			Append:  cfg.Append,
+			Body:     body,
+			Style:    cfg.Style,
+			Context:  cfg.Context,
+			Append:   cfg.Append,
+			Priority: cfg.Priority,
 		}
 
 		// Retry the annotation a few times before giving up
-		err = roko.NewRetrier(
-			roko.WithMaxAttempts(5),
-			roko.WithStrategy(roko.Constant(1*time.Second)),
-			roko.WithJitter(),
-		).Do(func(r *roko.Retrier) error {
+		err = retry.NewRetrier(
+			retry.WithMaxAttempts(5),
+			retry.WithStrategy(retry.Constant(1*time.Second)),
+			retry.WithJitter(),
+		).Do(func(r *retry.Retrier) error {
 			// Attempt to create the annotation
 			resp, err := client.Annotate(cfg.Job, annotation)
 
+			// Appending was rejected, which is most likely because the
+			// annotation would be too large, so replace it instead
+			if resp != nil && resp.StatusCode == 422 && annotation.Append && cfg.ReplaceIfLarger {
+				l.Warn("Buildkite rejected appending to the annotation (%s), replacing it instead", err)
+				annotation.Append = false
+				resp, err = client.Annotate(cfg.Job, annotation)
+			}
+
 			// Don't bother retrying if the response was one of these statuses
-			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400 || resp.StatusCode == 422) {
 				r.Break()
 				return err
 			}
@@ -189,3 +258,43 @@ var AnnotateCommand = cli.Command{
 		l.Debug("Successfully annotated build")
 	},
 }
+
+// validateAnnotation checks an annotation's options and body against what
+// Buildkite accepts
+func validateAnnotation(cfg AnnotateConfig, body string) error {
+	if cfg.Style != "" {
+		valid := false
+		for _, style := range annotationStyles {
+			if cfg.Style == style {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("Unknown annotation style %q, expected one of %s", cfg.Style, strings.Join(annotationStyles, ", "))
+		}
+	}
+
+	if cfg.Priority != 0 && (cfg.Priority < minAnnotationPriority || cfg.Priority > maxAnnotationPriority) {
+		return fmt.Errorf("The annotation priority must be from %d to %d, not %d", minAnnotationPriority, maxAnnotationPriority, cfg.Priority)
+	}
+
+	if len(cfg.Context) > maxAnnotationContextLength {
+		return fmt.Errorf("The annotation context %q is longer than %d characters", cfg.Context, maxAnnotationContextLength)
+	}
+	for _, r := range cfg.Context {
+		// Contexts are part of the URL used to remove annotations
+		if r == '/' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("The annotation context %q can't contain slashes or whitespace", cfg.Context)
+		}
+	}
+
+	if len(body) > maxAnnotationBodySize {
+		return fmt.Errorf("The annotation body is %d bytes, which is more than the %d bytes an annotation can have", len(body), maxAnnotationBodySize)
+	}
+
+	if cfg.ReplaceIfLarger && !cfg.Append {
+		return errors.New("--replace-if-larger only applies when appending with --append")
+	}
+
+	return nil
+}
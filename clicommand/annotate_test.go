@@ -0,0 +1,33 @@
+package clicommand
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAnnotation(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  AnnotateConfig
+		body string
+		err  string
+	}{
+		{cfg: AnnotateConfig{Style: "success", Context: "junit", Priority: 10}, body: "All good"},
+		{cfg: AnnotateConfig{Append: true, ReplaceIfLarger: true}, body: "More"},
+		{cfg: AnnotateConfig{Style: "danger"}, err: `Unknown annotation style "danger", expected one of success, info, warning, error`},
+		{cfg: AnnotateConfig{Priority: 11}, err: "The annotation priority must be from 1 to 10, not 11"},
+		{cfg: AnnotateConfig{Context: "test results"}, err: `The annotation context "test results" can't contain slashes or whitespace`},
+		{cfg: AnnotateConfig{Context: "tests/unit"}, err: `The annotation context "tests/unit" can't contain slashes or whitespace`},
+		{cfg: AnnotateConfig{Context: strings.Repeat("a", 101)}, err: "is longer than 100 characters"},
+		{body: strings.Repeat("a", maxAnnotationBodySize+1), err: "more than the 1048576 bytes an annotation can have"},
+		{cfg: AnnotateConfig{ReplaceIfLarger: true}, err: "--replace-if-larger only applies when appending with --append"},
+	} {
+		err := validateAnnotation(tc.cfg, tc.body)
+		if tc.err == "" {
+			assert.NoError(t, err)
+		} else if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), tc.err)
+		}
+	}
+}
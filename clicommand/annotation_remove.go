@@ -7,7 +7,7 @@ import (
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
-	"github.com/buildkite/roko"
+	"github.com/buildkite/agent/v3/retry"
 	"github.com/urfave/cli"
 )
 
@@ -39,10 +39,18 @@ type AnnotationRemoveConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP               bool   `cli:"debug-http"`
+	AgentAccessToken        string `cli:"agent-access-token" validate:"required"`
+	Endpoint                string `cli:"endpoint" validate:"required"`
+	NoHTTP2                 bool   `cli:"no-http2"`
+	APIRecordPath           string `cli:"api-record-path" normalize:"filepath"`
+	APIReplayPath           string `cli:"api-replay-path" normalize:"filepath"`
+	APIRequestSigning       string `cli:"api-request-signing" validate:"oneof:hmac|aws-sigv4"`
+	APIRequestSigningSecret string `cli:"api-request-signing-secret"`
+	APIRequestSigningRegion string `cli:"api-request-signing-region"`
+	IPFamily                string `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                string `cli:"proxy-pac"`
+	DNSCache                bool   `cli:"dns-cache"`
 }
 
 var AnnotationRemoveCommand = cli.Command{
@@ -68,6 +76,14 @@ var AnnotationRemoveCommand = cli.Command{
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		APIRecordPathFlag,
+		APIReplayPathFlag,
+		APIRequestSigningFlag,
+		APIRequestSigningSecretFlag,
+		APIRequestSigningRegionFlag,
+		IPFamilyFlag,
+		ProxyPACFlag,
+		DNSCacheFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -102,11 +118,11 @@ var AnnotationRemoveCommand = cli.Command{
 		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
 
 		// Retry the removal a few times before giving up
-		err = roko.NewRetrier(
-			roko.WithMaxAttempts(5),
-			roko.WithStrategy(roko.Constant(1*time.Second)),
-			roko.WithJitter(),
-		).Do(func(r *roko.Retrier) error {
+		err = retry.NewRetrier(
+			retry.WithMaxAttempts(5),
+			retry.WithStrategy(retry.Constant(1*time.Second)),
+			retry.WithJitter(),
+		).Do(func(r *retry.Retrier) error {
 			// Attempt to remove the annotation
 			resp, err := client.AnnotationRemove(cfg.Job, cfg.Context)
 
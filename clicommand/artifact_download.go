@@ -45,14 +45,32 @@ Example:
 
    $ buildkite-agent artifact download "pkg/*.tar.gz" . --step "tests" --build xxx
 
-   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)`
+   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)
+
+   To download artifacts from the build that triggered this one, such as from
+   a deploy pipeline triggered by the pipeline that built the artifacts:
+
+   $ buildkite-agent artifact download "pkg/*.tar.gz" . --from-triggered-build
+
+   Or, from the closest build of a pipeline through the builds that triggered
+   this one:
+
+   $ buildkite-agent artifact download "pkg/*.tar.gz" . --pipeline app
+
+   To download artifacts from private storage through your own service, which
+   signs URLs to them, rather than with cloud credentials on the agent:
+
+   $ buildkite-agent artifact download "pkg/*.tar.gz" . --url-signer https://signer.example.com/sign`
 
 type ArtifactDownloadConfig struct {
 	Query              string `cli:"arg:0" label:"artifact search query" validate:"required"`
 	Destination        string `cli:"arg:1" label:"artifact download path" validate:"required"`
 	Step               string `cli:"step"`
 	Build              string `cli:"build" validate:"required"`
+	Pipeline           string `cli:"pipeline"`
+	FromTriggeredBuild bool   `cli:"from-triggered-build"`
 	IncludeRetriedJobs bool   `cli:"include-retried-jobs"`
+	URLSigner          string `cli:"url-signer"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
@@ -62,10 +80,18 @@ type ArtifactDownloadConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP               bool   `cli:"debug-http"`
+	AgentAccessToken        string `cli:"agent-access-token" validate:"required"`
+	Endpoint                string `cli:"endpoint" validate:"required"`
+	NoHTTP2                 bool   `cli:"no-http2"`
+	APIRecordPath           string `cli:"api-record-path" normalize:"filepath"`
+	APIReplayPath           string `cli:"api-replay-path" normalize:"filepath"`
+	APIRequestSigning       string `cli:"api-request-signing" validate:"oneof:hmac|aws-sigv4"`
+	APIRequestSigningSecret string `cli:"api-request-signing-secret"`
+	APIRequestSigningRegion string `cli:"api-request-signing-region"`
+	IPFamily                string `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                string `cli:"proxy-pac"`
+	DNSCache                bool   `cli:"dns-cache"`
 }
 
 var ArtifactDownloadCommand = cli.Command{
@@ -84,17 +110,40 @@ var ArtifactDownloadCommand = cli.Command{
 			EnvVar: "BUILDKITE_BUILD_ID",
 			Usage:  "The build that the artifacts were uploaded to",
 		},
+		cli.StringFlag{
+			Name:  "pipeline",
+			Value: "",
+			Usage: "Download from the closest build of this pipeline (by slug), starting at the build and going up through the builds that triggered it",
+		},
+		cli.BoolFlag{
+			Name:  "from-triggered-build",
+			Usage: "Download from the build that triggered the build, rather than the build itself",
+		},
 		cli.BoolFlag{
 			Name:   "include-retried-jobs",
 			EnvVar: "BUILDKITE_AGENT_INCLUDE_RETRIED_JOBS",
 			Usage:  "Include artifacts from retried jobs in the search",
 		},
+		cli.StringFlag{
+			Name:   "url-signer",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_URL_SIGNER",
+			Usage:  "Get pre-signed URLs to download artifacts from, from an http(s):// endpoint the artifacts are POSTed to as JSON, or a command given them as JSON on stdin, which respond with JSON like {\"url\": \"...\", \"headers\": {...}}",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		APIRecordPathFlag,
+		APIReplayPathFlag,
+		APIRequestSigningFlag,
+		APIRequestSigningSecretFlag,
+		APIRequestSigningRegionFlag,
+		IPFamilyFlag,
+		ProxyPACFlag,
+		DNSCacheFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -128,14 +177,38 @@ var ArtifactDownloadCommand = cli.Command{
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
 
+		// Find the build to download from
+		buildID, err := agent.ResolveArtifactBuild(client, agent.ArtifactBuildSelector{
+			BuildID:               cfg.Build,
+			FromTriggeredBuild:    cfg.FromTriggeredBuild,
+			Pipeline:              cfg.Pipeline,
+			JobBuildID:            os.Getenv("BUILDKITE_BUILD_ID"),
+			JobPipelineSlug:       os.Getenv("BUILDKITE_PIPELINE_SLUG"),
+			TriggeredFromBuildID:  os.Getenv("BUILDKITE_TRIGGERED_FROM_BUILD_ID"),
+			TriggeredFromPipeline: os.Getenv("BUILDKITE_TRIGGERED_FROM_BUILD_PIPELINE_SLUG"),
+		})
+		if err != nil {
+			l.Fatal("Failed to find the build to download artifacts from: %s", err)
+		}
+		if buildID != cfg.Build {
+			l.Info("Downloading artifacts from build %s", buildID)
+		}
+
+		var urlSigner *agent.ArtifactURLSigner
+		if cfg.URLSigner != "" {
+			urlSigner = &agent.ArtifactURLSigner{Signer: cfg.URLSigner}
+		}
+
 		// Setup the downloader
 		downloader := agent.NewArtifactDownloader(l, client, agent.ArtifactDownloaderConfig{
 			Query:              cfg.Query,
 			Destination:        cfg.Destination,
-			BuildID:            cfg.Build,
+			BuildID:            buildID,
 			Step:               cfg.Step,
 			IncludeRetriedJobs: cfg.IncludeRetriedJobs,
 			DebugHTTP:          cfg.DebugHTTP,
+			Transfers:          agent.TransferSchedulerFromEnv(),
+			URLSigner:          urlSigner,
 		})
 
 		// Download the artifacts
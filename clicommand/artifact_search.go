@@ -60,10 +60,18 @@ type ArtifactSearchConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP               bool   `cli:"debug-http"`
+	AgentAccessToken        string `cli:"agent-access-token" validate:"required"`
+	Endpoint                string `cli:"endpoint" validate:"required"`
+	NoHTTP2                 bool   `cli:"no-http2"`
+	APIRecordPath           string `cli:"api-record-path" normalize:"filepath"`
+	APIReplayPath           string `cli:"api-replay-path" normalize:"filepath"`
+	APIRequestSigning       string `cli:"api-request-signing" validate:"oneof:hmac|aws-sigv4"`
+	APIRequestSigningSecret string `cli:"api-request-signing-secret"`
+	APIRequestSigningRegion string `cli:"api-request-signing-region"`
+	IPFamily                string `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                string `cli:"proxy-pac"`
+	DNSCache                bool   `cli:"dns-cache"`
 }
 
 var ArtifactSearchCommand = cli.Command{
@@ -121,6 +129,14 @@ Format specifiers:
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		APIRecordPathFlag,
+		APIReplayPathFlag,
+		APIRequestSigningFlag,
+		APIRequestSigningSecretFlag,
+		APIRequestSigningRegionFlag,
+		IPFamilyFlag,
+		ProxyPACFlag,
+		DNSCacheFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -3,6 +3,7 @@ package clicommand
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
@@ -28,10 +29,20 @@ Description:
    environment variable.  Otherwise, artifacts are uploaded to a
    Buildkite-managed Amazon S3 bucket, where they’re retained for six months.
 
+   With --follow or --follow-until, the paths are watched for files that are
+   still to be written, like screenshots taken during a test run. Each file
+   is uploaded once it's gone unchanged for --follow-settle, and the files
+   left when watching stops are uploaded the way they are.
+
 Example:
 
    $ buildkite-agent artifact upload "log/**/*.log"
 
+   You can upload screenshots as a test run in the background takes them,
+   stopping once it writes tmp/done:
+
+   $ buildkite-agent artifact upload --follow-until tmp/done "tmp/screenshots/*.png" &
+
    You can also upload directly to Amazon S3 if you'd like to host your own artifacts:
 
    $ export BUILDKITE_S3_ACCESS_KEY_ID=xxx
@@ -76,13 +87,24 @@ type ArtifactUploadConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP               bool   `cli:"debug-http"`
+	AgentAccessToken        string `cli:"agent-access-token" validate:"required"`
+	Endpoint                string `cli:"endpoint" validate:"required"`
+	NoHTTP2                 bool   `cli:"no-http2"`
+	APIRecordPath           string `cli:"api-record-path" normalize:"filepath"`
+	APIReplayPath           string `cli:"api-replay-path" normalize:"filepath"`
+	APIRequestSigning       string `cli:"api-request-signing" validate:"oneof:hmac|aws-sigv4"`
+	APIRequestSigningSecret string `cli:"api-request-signing-secret"`
+	APIRequestSigningRegion string `cli:"api-request-signing-region"`
+	IPFamily                string `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                string `cli:"proxy-pac"`
+	DNSCache                bool   `cli:"dns-cache"`
 
 	// Uploader flags
-	FollowSymlinks bool `cli:"follow-symlinks"`
+	FollowSymlinks bool          `cli:"follow-symlinks"`
+	Follow         time.Duration `cli:"follow"`
+	FollowUntil    string        `cli:"follow-until" normalize:"filepath"`
+	FollowSettle   time.Duration `cli:"follow-settle"`
 }
 
 var ArtifactUploadCommand = cli.Command{
@@ -102,12 +124,38 @@ var ArtifactUploadCommand = cli.Command{
 			Usage:  "A specific Content-Type to set for the artifacts (otherwise detected)",
 			EnvVar: "BUILDKITE_ARTIFACT_CONTENT_TYPE",
 		},
+		cli.StringFlag{
+			Name:   "follow",
+			Value:  "",
+			Usage:  "Keep watching the paths for this long, uploading files as they're written, as a duration like 10m or a number of seconds",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_FOLLOW",
+		},
+		cli.StringFlag{
+			Name:   "follow-until",
+			Value:  "",
+			Usage:  "Keep watching the paths until this file exists, uploading files as they're written",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_FOLLOW_UNTIL",
+		},
+		cli.StringFlag{
+			Name:   "follow-settle",
+			Value:  "2s",
+			Usage:  "How long a file has to go unchanged while following before it's uploaded",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_FOLLOW_SETTLE",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		APIRecordPathFlag,
+		APIReplayPathFlag,
+		APIRequestSigningFlag,
+		APIRequestSigningSecretFlag,
+		APIRequestSigningRegionFlag,
+		IPFamilyFlag,
+		ProxyPACFlag,
+		DNSCacheFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -150,10 +198,19 @@ var ArtifactUploadCommand = cli.Command{
 			ContentType:    cfg.ContentType,
 			DebugHTTP:      cfg.DebugHTTP,
 			FollowSymlinks: cfg.FollowSymlinks,
+			Transfers:      agent.TransferSchedulerFromEnv(),
+			Quota:          agent.ArtifactQuotaFromEnv(),
+			Follow:         cfg.Follow,
+			FollowUntil:    cfg.FollowUntil,
+			FollowSettle:   cfg.FollowSettle,
 		})
 
-		// Upload the artifacts
-		if err := uploader.Upload(); err != nil {
+		// Upload the artifacts, watching for more if we've been asked to
+		upload := uploader.Upload
+		if cfg.Follow > 0 || cfg.FollowUntil != "" {
+			upload = uploader.Follow
+		}
+		if err := upload(); err != nil {
 			l.Fatal("Failed to upload artifacts: %s", err)
 		}
 	},
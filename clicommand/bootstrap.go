@@ -3,16 +3,21 @@ package clicommand
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"runtime"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/buildkite/agent/v3/bootstrap"
+	"github.com/buildkite/agent/v3/bootstrap/localapi"
 	"github.com/buildkite/agent/v3/cliconfig"
 	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/process"
+	"github.com/pborman/uuid"
 	"github.com/urfave/cli"
 )
 
@@ -36,11 +41,19 @@ Description:
    The bootstrap is also responsible for executing hooks around the phases.
    See https://buildkite.com/docs/agent/v3/hooks for more details.
 
+   With --standalone, the bootstrap runs without Buildkite at all. Commands like
+   meta-data, artifact and annotate talk to a stand-in for the Agent API in the
+   bootstrap process instead, and job details that would come from Buildkite,
+   like the job ID, get placeholder values. This is useful for debugging jobs
+   locally, or for running them from another scheduler.
+
 Example:
 
    $ eval $(curl -s -H "Authorization: Bearer xxx" \
      "https://api.buildkite.com/v2/organizations/[org]/pipelines/[proj]/builds/[build]/jobs/[job]/env.txt" | sed 's/^/export /')
-   $ buildkite-agent bootstrap --build-path builds`
+   $ buildkite-agent bootstrap --build-path builds
+   $ buildkite-agent bootstrap --standalone --phases command --command "make test" \
+     --repository . --branch main --build-path builds`
 
 type BootstrapConfig struct {
 	Command                      string   `cli:"command"`
@@ -54,6 +67,8 @@ type BootstrapConfig struct {
 	PullRequest                  string   `cli:"pullrequest"`
 	GitSubmodules                bool     `cli:"git-submodules"`
 	SSHKeyscan                   bool     `cli:"ssh-keyscan"`
+	SSHStrictHostKeys            bool     `cli:"ssh-strict-host-keys"`
+	SSHVerifyHostKeysWithDNS     bool     `cli:"ssh-verify-host-keys-with-dns"`
 	AgentName                    string   `cli:"agent" validate:"required"`
 	Queue                        string   `cli:"queue"`
 	OrganizationSlug             string   `cli:"organization" validate:"required"`
@@ -62,6 +77,12 @@ type BootstrapConfig struct {
 	AutomaticArtifactUploadPaths string   `cli:"artifact-upload-paths"`
 	ArtifactUploadDestination    string   `cli:"artifact-upload-destination"`
 	CleanCheckout                bool     `cli:"clean-checkout"`
+	CheckoutType                 string   `cli:"checkout-type"`
+	CheckoutPathTemplate         string   `cli:"checkout-path-template"`
+	FailureReasonFile            string   `cli:"failure-reason-file" normalize:"filepath"`
+	JobDeadline                  string   `cli:"job-deadline"`
+	CancelArtifactGracePeriod    int      `cli:"cancel-artifact-grace-period"`
+	EnvSchemaPath                string   `cli:"env-schema-path" normalize:"filepath"`
 	GitCloneFlags                string   `cli:"git-clone-flags"`
 	GitFetchFlags                string   `cli:"git-fetch-flags"`
 	GitCloneMirrorFlags          string   `cli:"git-clone-mirror-flags"`
@@ -69,25 +90,41 @@ type BootstrapConfig struct {
 	GitMirrorsPath               string   `cli:"git-mirrors-path" normalize:"filepath"`
 	GitMirrorsLockTimeout        int      `cli:"git-mirrors-lock-timeout"`
 	GitMirrorsSkipUpdate         bool     `cli:"git-mirrors-skip-update"`
+	GitSkipMissingRefs           bool     `cli:"git-skip-missing-refs"`
+	GitSSHHosts                  []string `cli:"git-ssh-hosts" normalize:"list"`
+	GitSSHConfig                 string   `cli:"git-ssh-config" normalize:"filepath"`
+	GitHTTPSFallback             bool     `cli:"git-https-fallback"`
+	GitCredentialHelper          string   `cli:"git-credential-helper"`
 	BinPath                      string   `cli:"bin-path" normalize:"filepath"`
 	BuildPath                    string   `cli:"build-path" normalize:"filepath"`
 	HooksPath                    string   `cli:"hooks-path" normalize:"filepath"`
+	HookReport                   bool     `cli:"hook-report"`
 	PluginsPath                  string   `cli:"plugins-path" normalize:"filepath"`
 	CommandEval                  bool     `cli:"command-eval"`
 	PluginsEnabled               bool     `cli:"plugins-enabled"`
 	PluginValidation             bool     `cli:"plugin-validation"`
 	PluginsAlwaysCloneFresh      bool     `cli:"plugins-always-clone-fresh"`
+	IsolatePlugins               bool     `cli:"isolate-plugins"`
+	PluginsSharedEnv             []string `cli:"plugins-shared-env" normalize:"list"`
 	LocalHooksEnabled            bool     `cli:"local-hooks-enabled"`
 	PTY                          bool     `cli:"pty"`
 	LogLevel                     string   `cli:"log-level"`
 	Debug                        bool     `cli:"debug"`
 	Shell                        string   `cli:"shell"`
+	WSLDistribution              string   `cli:"wsl-distribution"`
+	MacOSKeychain                string   `cli:"macos-keychain"`
+	MacOSKeychainPasswordFile    string   `cli:"macos-keychain-password-file" normalize:"filepath"`
+	MacOSProvisioningProfiles    string   `cli:"macos-provisioning-profiles-path" normalize:"filepath"`
 	Experiments                  []string `cli:"experiment" normalize:"list"`
 	Phases                       []string `cli:"phases" normalize:"list"`
 	Profile                      string   `cli:"profile"`
 	CancelSignal                 string   `cli:"cancel-signal"`
 	RedactedVars                 []string `cli:"redacted-vars" normalize:"list"`
 	TracingBackend               string   `cli:"tracing-backend"`
+	IPFamily                     string   `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                     string   `cli:"proxy-pac"`
+	Standalone                   bool     `cli:"standalone"`
+	StandaloneArtifactsPath      string   `cli:"standalone-artifacts-path" normalize:"filepath"`
 }
 
 var BootstrapCommand = cli.Command{
@@ -196,6 +233,42 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Whether or not the bootstrap should remove the existing repository before running the command",
 			EnvVar: "BUILDKITE_CLEAN_CHECKOUT",
 		},
+		cli.StringFlag{
+			Name:   "checkout-path-template",
+			Value:  "",
+			Usage:  "Where to check out the repository within the build path, for example \"{org}/{pipeline}/{branch_hash}\"",
+			EnvVar: "BUILDKITE_CHECKOUT_PATH_TEMPLATE",
+		},
+		cli.StringFlag{
+			Name:   "failure-reason-file",
+			Value:  "",
+			Usage:  "A file to tell the agent why the job failed in",
+			EnvVar: "BUILDKITE_FAILURE_REASON_FILE",
+		},
+		cli.StringFlag{
+			Name:   "job-deadline",
+			Value:  "",
+			Usage:  "When the job times out, as an RFC3339 time. Hooks and the command are stopped once it's passed",
+			EnvVar: "BUILDKITE_JOB_DEADLINE",
+		},
+		cli.IntFlag{
+			Name:   "cancel-artifact-grace-period",
+			Value:  0,
+			Usage:  "Seconds a canceled or timed out job has to upload its artifacts, or 0 to leave it to the agent",
+			EnvVar: "BUILDKITE_CANCEL_ARTIFACT_GRACE_PERIOD",
+		},
+		cli.StringFlag{
+			Name:   "env-schema-path",
+			Value:  "",
+			Usage:  "A YAML or JSON file declaring the environment variables the job needs, which are checked before the command runs",
+			EnvVar: "BUILDKITE_ENV_SCHEMA_PATH",
+		},
+		cli.StringFlag{
+			Name:   "checkout-type",
+			Value:  "",
+			Usage:  "Which checkout to use for the repository, if not git or the one for the repository's URL scheme",
+			EnvVar: "BUILDKITE_CHECKOUT_TYPE",
+		},
 		cli.StringFlag{
 			Name:   "git-clone-flags",
 			Value:  "-v",
@@ -237,6 +310,34 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Skip updating the Git mirror",
 			EnvVar: "BUILDKITE_GIT_MIRRORS_SKIP_UPDATE",
 		},
+		cli.BoolFlag{
+			Name:   "git-skip-missing-refs",
+			Usage:  "Pass the job without running it if the commit or ref to build no longer exists, instead of failing it",
+			EnvVar: "BUILDKITE_GIT_SKIP_MISSING_REFS",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-ssh-hosts",
+			Value:  &cli.StringSlice{},
+			Usage:  "SSH settings for repository hosts, as a comma-separated list of a host followed by any of port=, identity= and known-hosts=",
+			EnvVar: "BUILDKITE_GIT_SSH_HOSTS",
+		},
+		cli.StringFlag{
+			Name:   "git-ssh-config",
+			Value:  "",
+			Usage:  "An SSH config file to use when checking out",
+			EnvVar: "BUILDKITE_GIT_SSH_CONFIG",
+		},
+		cli.BoolFlag{
+			Name:   "git-https-fallback",
+			Usage:  "Check out SSH repositories over HTTPS if their host can't be reached over SSH",
+			EnvVar: "BUILDKITE_GIT_HTTPS_FALLBACK",
+		},
+		cli.StringFlag{
+			Name:   "git-credential-helper",
+			Value:  "",
+			Usage:  "The git credential helper to use for HTTPS checkouts",
+			EnvVar: "BUILDKITE_GIT_CREDENTIAL_HELPER",
+		},
 		cli.StringFlag{
 			Name:   "bin-path",
 			Value:  "",
@@ -255,6 +356,11 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Directory where the hook scripts are found",
 			EnvVar: "BUILDKITE_HOOKS_PATH",
 		},
+		cli.BoolFlag{
+			Name:   "hook-report",
+			Usage:  "Report which hooks ran, where they came from, how long they took and which environment variables they changed, in the log and as an artifact",
+			EnvVar: "BUILDKITE_HOOK_REPORT",
+		},
 		cli.StringFlag{
 			Name:   "plugins-path",
 			Value:  "",
@@ -281,6 +387,17 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Always make a new clone of plugin source, even if already present",
 			EnvVar: "BUILDKITE_PLUGINS_ALWAYS_CLONE_FRESH",
 		},
+		cli.BoolFlag{
+			Name:   "isolate-plugins",
+			Usage:  "Run each plugin's hooks in a working directory of its own, keeping the environment variables they set to the plugin unless they're shared",
+			EnvVar: "BUILDKITE_ISOLATE_PLUGINS",
+		},
+		cli.StringSliceFlag{
+			Name:   "plugins-shared-env",
+			Value:  &cli.StringSlice{},
+			Usage:  "Environment variables isolated plugins can set for the rest of the job",
+			EnvVar: "BUILDKITE_PLUGINS_SHARED_ENV",
+		},
 		cli.BoolTFlag{
 			Name:   "local-hooks-enabled",
 			Usage:  "Allow local hooks to be run",
@@ -291,6 +408,16 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Automatically run ssh-keyscan before checkout",
 			EnvVar: "BUILDKITE_SSH_KEYSCAN",
 		},
+		cli.BoolFlag{
+			Name:   "ssh-strict-host-keys",
+			Usage:  "Refuse SSH hosts that aren't already known or pinned, instead of trusting them on first use",
+			EnvVar: "BUILDKITE_SSH_STRICT_HOST_KEYS",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-verify-host-keys-with-dns",
+			Usage:  "Check SSH host keys against the host's SSHFP records in DNS",
+			EnvVar: "BUILDKITE_SSH_VERIFY_HOST_KEYS_WITH_DNS",
+		},
 		cli.BoolTFlag{
 			Name:   "git-submodules",
 			Usage:  "Enable git submodules",
@@ -307,6 +434,26 @@ var BootstrapCommand = cli.Command{
 			EnvVar: "BUILDKITE_SHELL",
 			Value:  DefaultShell(),
 		},
+		cli.StringFlag{
+			Name:   "wsl-distribution",
+			Usage:  "On Windows, the WSL distribution to run bash hooks and build commands in. Inside WSL, set it to the distribution to run batch and PowerShell hooks on Windows too",
+			EnvVar: "BUILDKITE_WSL_DISTRIBUTION",
+		},
+		cli.StringFlag{
+			Name:   "macos-keychain",
+			Usage:  "On macOS, the keychain to unlock and add to the search list for the job",
+			EnvVar: "BUILDKITE_MACOS_KEYCHAIN",
+		},
+		cli.StringFlag{
+			Name:   "macos-keychain-password-file",
+			Usage:  "A file containing the password to unlock the macos-keychain with",
+			EnvVar: "BUILDKITE_MACOS_KEYCHAIN_PASSWORD_FILE",
+		},
+		cli.StringFlag{
+			Name:   "macos-provisioning-profiles-path",
+			Usage:  "On macOS, a directory of provisioning profiles to install for the job",
+			EnvVar: "BUILDKITE_MACOS_PROVISIONING_PROFILES_PATH",
+		},
 		cli.StringSliceFlag{
 			Name:   "phases",
 			Usage:  "The specific phases to execute. The order they're defined is irrelevant.",
@@ -329,6 +476,19 @@ var BootstrapCommand = cli.Command{
 			EnvVar: "BUILDKITE_TRACING_BACKEND",
 			Value:  "",
 		},
+		cli.BoolFlag{
+			Name:   "standalone",
+			Usage:  "Run the job without Buildkite, using a local stand-in for the Agent API. Meta-data is kept in memory, artifacts are stored in a local directory, and annotations are written to the job output",
+			EnvVar: "BUILDKITE_BOOTSTRAP_STANDALONE",
+		},
+		cli.StringFlag{
+			Name:   "standalone-artifacts-path",
+			Value:  "",
+			Usage:  "Where artifacts are stored when running standalone. Defaults to a new temporary directory",
+			EnvVar: "BUILDKITE_BOOTSTRAP_STANDALONE_ARTIFACTS_PATH",
+		},
+		IPFamilyFlag,
+		ProxyPACFlag,
 		DebugFlag,
 		LogLevelFlag,
 		ExperimentsFlag,
@@ -338,6 +498,12 @@ var BootstrapCommand = cli.Command{
 		// The configuration will be loaded into this struct
 		cfg := BootstrapConfig{}
 
+		// Standalone jobs don't come from Buildkite, so fill in the
+		// details that would, before they're checked for
+		if c.Bool("standalone") {
+			setStandaloneDefaults(c)
+		}
+
 		loader := cliconfig.Loader{CLI: c, Config: &cfg}
 		warnings, err := loader.Load()
 		if err != nil {
@@ -382,6 +548,21 @@ var BootstrapCommand = cli.Command{
 			l.Fatal("Failed to parse cancel-signal: %v", err)
 		}
 
+		var jobDeadline time.Time
+		if cfg.JobDeadline != "" {
+			if jobDeadline, err = time.Parse(time.RFC3339, cfg.JobDeadline); err != nil {
+				l.Fatal("Failed to parse job-deadline: %v", err)
+			}
+		}
+
+		if cfg.Standalone {
+			closeAPI, err := startLocalAPI(l, cfg)
+			if err != nil {
+				l.Fatal("Failed to start the local API: %v", err)
+			}
+			defer closeAPI()
+		}
+
 		// Configure the bootstraper
 		bootstrap := bootstrap.New(bootstrap.Config{
 			AgentName:                    cfg.AgentName,
@@ -390,21 +571,34 @@ var BootstrapCommand = cli.Command{
 			BinPath:                      cfg.BinPath,
 			Branch:                       cfg.Branch,
 			BuildPath:                    cfg.BuildPath,
+			CancelArtifactGracePeriod:    cfg.CancelArtifactGracePeriod,
 			CancelSignal:                 cancelSig,
+			CheckoutPathTemplate:         cfg.CheckoutPathTemplate,
+			CheckoutType:                 cfg.CheckoutType,
 			CleanCheckout:                cfg.CleanCheckout,
 			Command:                      cfg.Command,
 			CommandEval:                  cfg.CommandEval,
 			Commit:                       cfg.Commit,
 			Debug:                        cfg.Debug,
+			EnvSchemaPath:                cfg.EnvSchemaPath,
+			FailureReasonFile:            cfg.FailureReasonFile,
 			GitCleanFlags:                cfg.GitCleanFlags,
 			GitCloneFlags:                cfg.GitCloneFlags,
 			GitCloneMirrorFlags:          cfg.GitCloneMirrorFlags,
+			GitCredentialHelper:          cfg.GitCredentialHelper,
 			GitFetchFlags:                cfg.GitFetchFlags,
+			GitHTTPSFallback:             cfg.GitHTTPSFallback,
 			GitMirrorsLockTimeout:        cfg.GitMirrorsLockTimeout,
 			GitMirrorsPath:               cfg.GitMirrorsPath,
 			GitMirrorsSkipUpdate:         cfg.GitMirrorsSkipUpdate,
+			GitSkipMissingRefs:           cfg.GitSkipMissingRefs,
+			GitSSHConfig:                 cfg.GitSSHConfig,
+			GitSSHHosts:                  cfg.GitSSHHosts,
 			GitSubmodules:                cfg.GitSubmodules,
+			HookReport:                   cfg.HookReport,
 			HooksPath:                    cfg.HooksPath,
+			IsolatePlugins:               cfg.IsolatePlugins,
+			JobDeadline:                  jobDeadline,
 			JobID:                        cfg.JobID,
 			LocalHooksEnabled:            cfg.LocalHooksEnabled,
 			OrganizationSlug:             cfg.OrganizationSlug,
@@ -415,6 +609,7 @@ var BootstrapCommand = cli.Command{
 			Plugins:                      cfg.Plugins,
 			PluginsEnabled:               cfg.PluginsEnabled,
 			PluginsAlwaysCloneFresh:      cfg.PluginsAlwaysCloneFresh,
+			PluginsSharedEnv:             cfg.PluginsSharedEnv,
 			PluginsPath:                  cfg.PluginsPath,
 			PullRequest:                  cfg.PullRequest,
 			Queue:                        cfg.Queue,
@@ -423,9 +618,17 @@ var BootstrapCommand = cli.Command{
 			Repository:                   cfg.Repository,
 			RunInPty:                     runInPty,
 			SSHKeyscan:                   cfg.SSHKeyscan,
+			SSHStrictHostKeys:            cfg.SSHStrictHostKeys,
+			SSHVerifyHostKeysWithDNS:     cfg.SSHVerifyHostKeysWithDNS,
 			Shell:                        cfg.Shell,
+			WSLDistribution:              cfg.WSLDistribution,
+			MacOSKeychain:                cfg.MacOSKeychain,
+			MacOSKeychainPasswordFile:    cfg.MacOSKeychainPasswordFile,
+			MacOSProvisioningProfiles:    cfg.MacOSProvisioningProfiles,
 			Tag:                          cfg.Tag,
 			TracingBackend:               cfg.TracingBackend,
+			IPFamily:                     cfg.IPFamily,
+			ProxyPAC:                     cfg.ProxyPAC,
 		})
 
 		ctx, cancel := context.WithCancel(context.Background())
@@ -486,3 +689,66 @@ var BootstrapCommand = cli.Command{
 		os.Exit(exitCode)
 	},
 }
+
+// standaloneDefaults are the values used for job details that would normally
+// come from Buildkite, when running standalone
+var standaloneDefaults = []struct {
+	flag, envVar, value string
+}{
+	{"job", "BUILDKITE_JOB_ID", uuid.New()},
+	{"agent", "BUILDKITE_AGENT_NAME", "local"},
+	{"organization", "BUILDKITE_ORGANIZATION_SLUG", "local"},
+	{"pipeline", "BUILDKITE_PIPELINE_SLUG", "local"},
+	{"pipeline-provider", "BUILDKITE_PIPELINE_PROVIDER", "local"},
+	{"commit", "BUILDKITE_COMMIT", "HEAD"},
+}
+
+func setStandaloneDefaults(c *cli.Context) {
+	for _, d := range standaloneDefaults {
+		if c.String(d.flag) != "" {
+			continue
+		}
+		_ = c.Set(d.flag, d.value)
+
+		// Commands run by the job need them too
+		os.Setenv(d.envVar, d.value)
+	}
+
+	if os.Getenv("BUILDKITE_BUILD_ID") == "" {
+		os.Setenv("BUILDKITE_BUILD_ID", uuid.New())
+	}
+}
+
+// startLocalAPI starts a local stand-in for the Agent API, and points the
+// commands that the job runs at it
+func startLocalAPI(l logger.Logger, cfg BootstrapConfig) (func(), error) {
+	artifactsPath := cfg.StandaloneArtifactsPath
+	if artifactsPath == "" {
+		dir, err := ioutil.TempDir("", "buildkite-artifacts")
+		if err != nil {
+			return nil, err
+		}
+		artifactsPath = dir
+	}
+
+	server := localapi.New(l, localapi.Config{
+		ArtifactsPath: artifactsPath,
+		Output:        os.Stdout,
+	})
+
+	endpoint, err := server.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	l.Info("Running standalone with a local API at %s, storing artifacts in %s", endpoint, artifactsPath)
+
+	os.Setenv("BUILDKITE_AGENT_ENDPOINT", endpoint)
+	os.Setenv("BUILDKITE_AGENT_ACCESS_TOKEN", "local")
+
+	return func() {
+		if err := server.Close(); err != nil {
+			l.Warn("Failed to stop the local API: %v", err)
+		}
+	}, nil
+}
@@ -0,0 +1,403 @@
+package clicommand
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/tracetools"
+	"github.com/urfave/cli"
+	"golang.org/x/exp/maps"
+)
+
+var CompletionHelpDescription = `Usage:
+
+   buildkite-agent completion <shell> [options...]
+
+Description:
+
+   Prints a completion script for the given shell, one of bash, zsh, fish or
+   powershell. The script is generated from the commands and flags of this
+   version of the agent, so it should be regenerated after upgrading.
+
+   Where flags have a known set of values, those are completed too. Queue
+   names are taken from the tags in the agent configuration file.
+
+Example:
+
+   $ buildkite-agent completion bash > /etc/bash_completion.d/buildkite-agent
+   $ buildkite-agent completion zsh > "${fpath[1]}/_buildkite-agent"
+   $ buildkite-agent completion fish > ~/.config/fish/completions/buildkite-agent.fish
+   $ buildkite-agent completion powershell >> $PROFILE`
+
+type CompletionConfig struct {
+	Shell  string `cli:"arg:0" label:"shell" validate:"required"`
+	Config string `cli:"config"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var CompletionCommand = cli.Command{
+	Name:        "completion",
+	Usage:       "Print a shell completion script for the agent",
+	Description: CompletionHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to a configuration file to read queue names from",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := CompletionConfig{}
+
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		values := completionFlagValues(loader.File)
+		commands := completionCommands(nil, c.App.Commands, values)
+
+		// The root of the tree is the binary itself
+		root := completionCommand{}
+		for _, cmd := range c.App.Commands {
+			if !cmd.Hidden {
+				root.Words = append(root.Words, cmd.Name)
+			}
+		}
+		commands = append([]completionCommand{root}, commands...)
+
+		switch cfg.Shell {
+		case "bash":
+			writeBashCompletion(os.Stdout, c.App.Name, commands)
+		case "zsh":
+			writeZshCompletion(os.Stdout, c.App.Name, commands)
+		case "fish":
+			writeFishCompletion(os.Stdout, c.App.Name, commands)
+		case "powershell":
+			writePowerShellCompletion(os.Stdout, c.App.Name, commands)
+		default:
+			l.Fatal("Unsupported shell %q, must be one of bash, zsh, fish or powershell", cfg.Shell)
+		}
+	},
+}
+
+// completionCommand is a command (or command group) and the words that can
+// follow it, which are either subcommand names or flags
+type completionCommand struct {
+	Path  []string
+	Words []string
+	Flags []completionFlag
+}
+
+type completionFlag struct {
+	Name   string
+	Usage  string
+	Values []string
+}
+
+// completionFlagValues returns the values that can be completed for flags,
+// keyed by flag name
+func completionFlagValues(file *cliconfig.File) map[string][]string {
+	values := map[string][]string{
+		"log-level":       {"debug", "info", "notice", "warn", "error", "fatal"},
+		"log-format":      {"text", "json"},
+		"cancel-signal":   {"SIGTERM", "SIGINT", "SIGQUIT", "SIGKILL", "SIGHUP", "SIGUSR1", "SIGUSR2"},
+		"tracing-backend": maps.Keys(tracetools.ValidTracingBackends),
+		"phases":          {"plugin", "checkout", "command"},
+	}
+
+	// Offer the queues from the config file as tags, so they don't need to
+	// be remembered
+	if file != nil {
+		var queues []string
+		for _, tag := range strings.Split(file.Config["tags"], ",") {
+			if strings.HasPrefix(strings.TrimSpace(tag), "queue=") {
+				queues = append(queues, strings.TrimSpace(tag))
+			}
+		}
+		if len(queues) > 0 {
+			values["tags"] = queues
+		}
+	}
+
+	for name := range values {
+		// An empty tracing backend isn't something anyone types
+		values[name] = filterEmpty(values[name])
+		sort.Strings(values[name])
+	}
+
+	return values
+}
+
+func filterEmpty(s []string) []string {
+	var result []string
+	for _, v := range s {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// completionCommands walks the command tree and returns every command in it
+func completionCommands(parent []string, commands []cli.Command, values map[string][]string) []completionCommand {
+	var result []completionCommand
+
+	for _, cmd := range commands {
+		if cmd.Hidden {
+			continue
+		}
+
+		path := append(append([]string{}, parent...), cmd.Name)
+		cc := completionCommand{Path: path}
+
+		for _, sub := range cmd.Subcommands {
+			if !sub.Hidden {
+				cc.Words = append(cc.Words, sub.Name)
+			}
+		}
+
+		for _, flag := range cmd.Flags {
+			// use golang reflection to find the Usage and Hidden values on flags
+			v := reflect.Indirect(reflect.ValueOf(flag))
+			if hidden := v.FieldByName("Hidden"); hidden.IsValid() && hidden.Bool() {
+				continue
+			}
+
+			name := strings.TrimSpace(strings.Split(flag.GetName(), ",")[0])
+			usage := ""
+			if u := v.FieldByName("Usage"); u.IsValid() {
+				usage = u.String()
+			}
+
+			cc.Words = append(cc.Words, "--"+name)
+			cc.Flags = append(cc.Flags, completionFlag{Name: name, Usage: usage, Values: values[name]})
+		}
+
+		result = append(result, cc)
+		result = append(result, completionCommands(path, cmd.Subcommands, values)...)
+	}
+
+	return result
+}
+
+func completionFunctionName(appName string) string {
+	return "_" + strings.ReplaceAll(appName, "-", "_")
+}
+
+const bashCompletionTemplate = `# bash completion for %[1]s
+%[2]s() {
+    local cur prev cmd word paths opts
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+    paths=%[3]s
+
+    # Work out which command is being completed, ignoring flags and their values
+    cmd=""
+    for word in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do
+        if [[ "$paths" == *" ${cmd:+${cmd}:}${word} "* ]]; then
+            cmd="${cmd:+${cmd}:}${word}"
+        fi
+    done
+
+    case "${cmd}@${prev}" in
+%[4]s    esac
+
+    case "$cmd" in
+%[5]s    esac
+
+    COMPREPLY=($(compgen -W "$opts" -- "$cur"))
+}
+complete -o default -F %[2]s %[1]s
+`
+
+func writeBashCompletion(w io.Writer, appName string, commands []completionCommand) {
+	var paths []string
+	var valueCases, wordCases strings.Builder
+
+	for _, cmd := range commands {
+		path := strings.Join(cmd.Path, ":")
+		if path != "" {
+			paths = append(paths, path)
+		}
+
+		fmt.Fprintf(&wordCases, "        %s) opts=%s ;;\n", bashQuote(path), bashQuote(strings.Join(cmd.Words, " ")))
+
+		for _, flag := range cmd.Flags {
+			if len(flag.Values) > 0 {
+				fmt.Fprintf(&valueCases, "        %s) COMPREPLY=($(compgen -W %s -- \"$cur\")); return ;;\n",
+					bashQuote(path+"@--"+flag.Name), bashQuote(strings.Join(flag.Values, " ")))
+			}
+		}
+	}
+
+	fmt.Fprintf(w, bashCompletionTemplate, appName, completionFunctionName(appName),
+		bashQuote(" "+strings.Join(paths, " ")+" "), valueCases.String(), wordCases.String())
+}
+
+// bashQuote single quotes a string, so nothing in it is expanded by bash
+func bashQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func writeZshCompletion(w io.Writer, appName string, commands []completionCommand) {
+	// zsh can run bash completion functions natively, which saves maintaining
+	// two copies of the command walking logic
+	fmt.Fprintf(w, "#compdef %s\n", appName)
+	fmt.Fprintf(w, "autoload -U +X bashcompinit && bashcompinit\n")
+	writeBashCompletion(w, appName, commands)
+}
+
+const fishCompletionTemplate = `# fish completion for %[1]s
+function __%[2]s_command
+    set -l paths %[3]s
+    set -l cmd
+    for word in (commandline -opc)[2..-1]
+        set -l candidate (string join ':' $cmd $word)
+        if contains -- $candidate $paths
+            set cmd $cmd $word
+        end
+    end
+    string join ':' $cmd
+end
+
+function __%[2]s_using
+    set -l cmd (__%[2]s_command)
+    test "$cmd" = "$argv[1]"
+end
+
+complete -c %[1]s -f
+`
+
+func writeFishCompletion(w io.Writer, appName string, commands []completionCommand) {
+	name := strings.ReplaceAll(appName, "-", "_")
+
+	var paths []string
+	for _, cmd := range commands {
+		if len(cmd.Path) > 0 {
+			paths = append(paths, fishQuote(strings.Join(cmd.Path, ":")))
+		}
+	}
+
+	fmt.Fprintf(w, fishCompletionTemplate, appName, name, strings.Join(paths, " "))
+
+	for _, cmd := range commands {
+		condition := fishQuote(fmt.Sprintf("__%s_using %s", name, strings.Join(cmd.Path, ":")))
+
+		for _, word := range cmd.Words {
+			if !strings.HasPrefix(word, "--") {
+				fmt.Fprintf(w, "complete -c %s -n %s -a %s\n", appName, condition, fishQuote(word))
+			}
+		}
+
+		for _, flag := range cmd.Flags {
+			fmt.Fprintf(w, "complete -c %s -n %s -l %s", appName, condition, flag.Name)
+			if flag.Usage != "" {
+				fmt.Fprintf(w, " -d %s", fishQuote(flag.Usage))
+			}
+			if len(flag.Values) > 0 {
+				fmt.Fprintf(w, " -x -a %s", fishQuote(strings.Join(flag.Values, " ")))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+const powerShellCompletionTemplate = `# powershell completion for %[1]s
+Register-ArgumentCompleter -Native -CommandName '%[1]s' -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+
+    $words = @{
+%[2]s    }
+    $values = @{
+%[3]s    }
+
+    # Work out which command is being completed, ignoring flags and their values
+    $elements = $commandAst.CommandElements | Select-Object -Skip 1 | ForEach-Object { $_.ToString() }
+    if ($wordToComplete -ne '') { $elements = $elements | Select-Object -SkipLast 1 }
+    $cmd = ''
+    $prev = ''
+    foreach ($element in $elements) {
+        $candidate = if ($cmd -eq '') { $element } else { "${cmd}:${element}" }
+        if ($words.ContainsKey($candidate)) { $cmd = $candidate }
+        $prev = $element
+    }
+
+    $completions = $words[$cmd]
+    if ($values.ContainsKey("${cmd}@${prev}")) { $completions = $values["${cmd}@${prev}"] }
+
+    $completions | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+`
+
+func writePowerShellCompletion(w io.Writer, appName string, commands []completionCommand) {
+	var words, values strings.Builder
+
+	for _, cmd := range commands {
+		path := strings.Join(cmd.Path, ":")
+		fmt.Fprintf(&words, "        %s = @(%s)\n", powerShellQuote(path), powerShellList(cmd.Words))
+
+		for _, flag := range cmd.Flags {
+			if len(flag.Values) > 0 {
+				fmt.Fprintf(&values, "        %s = @(%s)\n", powerShellQuote(path+"@--"+flag.Name), powerShellList(flag.Values))
+			}
+		}
+	}
+
+	fmt.Fprintf(w, powerShellCompletionTemplate, appName, words.String(), values.String())
+}
+
+func powerShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func powerShellList(s []string) string {
+	quoted := make([]string, len(s))
+	for i, v := range s {
+		quoted[i] = powerShellQuote(v)
+	}
+	return strings.Join(quoted, ", ")
+}
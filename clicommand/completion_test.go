@@ -0,0 +1,93 @@
+package clicommand
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+var completionTestCommands = []cli.Command{
+	{
+		Name: "artifact",
+		Subcommands: []cli.Command{
+			{
+				Name: "upload",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "job", Usage: "Which job's artifacts"},
+					cli.BoolFlag{Name: "secret", Hidden: true},
+					LogLevelFlag,
+				},
+			},
+		},
+	},
+	{
+		Name:   "hidden",
+		Hidden: true,
+	},
+}
+
+func TestCompletionCommands(t *testing.T) {
+	commands := completionCommands(nil, completionTestCommands, map[string][]string{
+		"log-level": {"debug", "info"},
+	})
+
+	assert.Equal(t, []completionCommand{
+		{
+			Path:  []string{"artifact"},
+			Words: []string{"upload"},
+		},
+		{
+			Path:  []string{"artifact", "upload"},
+			Words: []string{"--job", "--log-level"},
+			Flags: []completionFlag{
+				{Name: "job", Usage: "Which job's artifacts"},
+				{Name: "log-level", Usage: LogLevelFlag.Usage, Values: []string{"debug", "info"}},
+			},
+		},
+	}, commands)
+}
+
+func TestCompletionFlagValuesIncludesQueuesFromConfig(t *testing.T) {
+	values := completionFlagValues(&cliconfig.File{
+		Config: map[string]string{"tags": "queue=deploy, os=linux,queue=build"},
+	})
+
+	assert.Equal(t, []string{"queue=build", "queue=deploy"}, values["tags"])
+	assert.NotContains(t, values["tracing-backend"], "")
+}
+
+func TestWriteBashCompletion(t *testing.T) {
+	commands := completionCommands(nil, completionTestCommands, map[string][]string{
+		"log-level": {"debug", "info"},
+	})
+
+	var buf bytes.Buffer
+	writeBashCompletion(&buf, "buildkite-agent", commands)
+
+	out := buf.String()
+	assert.Contains(t, out, `paths=' artifact artifact:upload '`)
+	assert.Contains(t, out, `'artifact:upload') opts='--job --log-level' ;;`)
+	assert.Contains(t, out, `'artifact:upload@--log-level') COMPREPLY=($(compgen -W 'debug info' -- "$cur")); return ;;`)
+	assert.Contains(t, out, "complete -o default -F _buildkite_agent buildkite-agent")
+}
+
+func TestWriteFishCompletion(t *testing.T) {
+	commands := completionCommands(nil, completionTestCommands, nil)
+
+	var buf bytes.Buffer
+	writeFishCompletion(&buf, "buildkite-agent", commands)
+
+	out := buf.String()
+	assert.Contains(t, out, `complete -c buildkite-agent -n '__buildkite_agent_using artifact' -a 'upload'`)
+	assert.Contains(t, out, `complete -c buildkite-agent -n '__buildkite_agent_using artifact:upload' -l job -d 'Which job\'s artifacts'`)
+}
+
+func TestBashQuote(t *testing.T) {
+	assert.Equal(t, `'$HOME'`, bashQuote("$HOME"))
+	assert.Equal(t, "'`id`'", bashQuote("`id`"))
+	assert.Equal(t, `'it'\''s'`, bashQuote("it's"))
+	assert.Equal(t, `''`, bashQuote(""))
+}
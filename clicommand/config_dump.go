@@ -0,0 +1,253 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/yaml"
+	"github.com/urfave/cli"
+)
+
+var ConfigDumpHelpDescription = `Usage:
+
+   buildkite-agent config dump [options...] <command> [command options...]
+
+Description:
+
+   Loads the configuration of a command the same way the command would, from
+   its flags, environment variables and configuration file, and prints the
+   result, so you can see exactly what the command would run with.
+
+   Secrets like tokens and passwords are masked.
+
+   The commands that can be dumped are: start, bootstrap, doctor,
+   artifact upload, artifact download and pipeline upload.
+
+Example:
+
+   $ buildkite-agent config dump start
+   $ buildkite-agent config dump --format yaml start --config-profile linux
+   $ buildkite-agent config dump artifact upload "*.log"`
+
+type ConfigDumpConfig struct {
+	Format string `cli:"format"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+// configCommand is a command whose configuration the config commands can
+// load and describe
+type configCommand struct {
+	command cli.Command
+
+	// Returns a pointer to the command's config struct
+	config func() interface{}
+
+	// Whether the command reads the default config files
+	defaultConfigFiles bool
+}
+
+var configCommands = map[string]configCommand{
+	"start":             {AgentStartCommand, func() interface{} { return &AgentStartConfig{} }, true},
+	"bootstrap":         {BootstrapCommand, func() interface{} { return &BootstrapConfig{} }, false},
+	"doctor":            {DoctorCommand, func() interface{} { return &DoctorConfig{} }, true},
+	"artifact upload":   {ArtifactUploadCommand, func() interface{} { return &ArtifactUploadConfig{} }, false},
+	"artifact download": {ArtifactDownloadCommand, func() interface{} { return &ArtifactDownloadConfig{} }, false},
+	"pipeline upload":   {PipelineUploadCommand, func() interface{} { return &PipelineUploadConfig{} }, false},
+}
+
+// What masked secrets are shown as
+const configDumpMasked = "[REDACTED]"
+
+var ConfigDumpCommand = cli.Command{
+	Name:        "dump",
+	Usage:       "Print the configuration a command would run with",
+	Description: ConfigDumpHelpDescription,
+	// Everything after the command's name is for that command
+	SkipArgReorder: true,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Value: "json",
+			Usage: "The format to print the configuration in, either json or yaml",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := ConfigDumpConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		if cfg.Format != "json" && cfg.Format != "yaml" {
+			l.Fatal("Invalid format %q, must be either json or yaml", cfg.Format)
+		}
+
+		name, args, target, ok := findConfigCommand(c.Args())
+		if !ok {
+			l.Fatal("Give a command to dump the configuration of, one of: %s", strings.Join(configCommandNames(), ", "))
+		}
+
+		// Parse the command's flags as the command itself would
+		set := flag.NewFlagSet(name, flag.ContinueOnError)
+		for _, f := range target.command.Flags {
+			f.Apply(set)
+		}
+		if err := set.Parse(args); err != nil {
+			l.Fatal("Failed to parse the options for %s: %v", name, err)
+		}
+
+		targetCtx := cli.NewContext(c.App, set, nil)
+		targetCtx.Command = target.command
+
+		targetCfg := target.config()
+		targetLoader := cliconfig.Loader{CLI: targetCtx, Config: targetCfg}
+		if target.defaultConfigFiles {
+			targetLoader.DefaultConfigFilePaths = DefaultConfigFilePaths()
+		}
+
+		warnings, err = targetLoader.Load()
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+		if targetLoader.File != nil {
+			l.Info("Loaded configuration file %s", targetLoader.File.Path)
+		}
+
+		values := configDumpValues(targetCfg)
+
+		var out []byte
+		if cfg.Format == "yaml" {
+			out, err = yaml.Marshal(configDumpYAML(values))
+		} else {
+			out, err = json.MarshalIndent(values, "", "  ")
+			out = append(out, '\n')
+		}
+		if err != nil {
+			l.Fatal("Failed to encode configuration: %v", err)
+		}
+
+		if _, err := os.Stdout.Write(out); err != nil {
+			l.Fatal("Failed to write configuration: %v", err)
+		}
+	},
+}
+
+// findConfigCommand finds the command named by the first one or two args,
+// returning its name and the args that are left for it
+func findConfigCommand(args []string) (string, []string, configCommand, bool) {
+	if len(args) >= 2 {
+		name := args[0] + " " + args[1]
+		if target, ok := configCommands[name]; ok {
+			return name, args[2:], target, true
+		}
+	}
+	if len(args) >= 1 {
+		if target, ok := configCommands[args[0]]; ok {
+			return args[0], args[1:], target, true
+		}
+	}
+	return "", nil, configCommand{}, false
+}
+
+// configCommandNames returns the sorted names of the commands the config
+// commands know about
+func configCommandNames() []string {
+	names := make([]string, 0, len(configCommands))
+	for name := range configCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configDumpValues returns the values of a config struct's options, keyed by
+// the names they're given in config files, with secrets masked. Positional
+// arguments aren't options, so they're left out.
+func configDumpValues(cfg interface{}) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, field := range cliconfig.Fields(cfg) {
+		name := field.CLIName()
+		if name == "" || strings.HasPrefix(name, "arg:") {
+			continue
+		}
+
+		fv := reflect.ValueOf(field.Struct).Elem().FieldByIndex(field.Index)
+		value := fv.Interface()
+		switch {
+		case isSecretConfigOption(name) && !fv.IsZero():
+			value = configDumpMasked
+		case field.Type == reflect.TypeOf(time.Duration(0)):
+			value = value.(time.Duration).String()
+		}
+		values[name] = value
+	}
+
+	return values
+}
+
+// isSecretConfigOption returns whether an option's value is a secret, rather
+// than the path to one
+func isSecretConfigOption(name string) bool {
+	if strings.HasSuffix(name, "-file") || strings.HasSuffix(name, "-path") {
+		return false
+	}
+	for _, secret := range []string{"token", "secret", "password"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// configDumpYAML orders the values by name, as JSON objects are
+func configDumpYAML(values map[string]interface{}) yaml.MapSlice {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := make(yaml.MapSlice, 0, len(names))
+	for _, name := range names {
+		items = append(items, yaml.MapItem{Key: name, Value: values[name]})
+	}
+	return items
+}
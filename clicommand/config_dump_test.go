@@ -0,0 +1,50 @@
+package clicommand
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigDumpValues(t *testing.T) {
+	cfg := struct {
+		Path                    string        `cli:"arg:0"`
+		Token                   string        `cli:"token"`
+		APIRequestSigningSecret string        `cli:"api-request-signing-secret"`
+		KeychainPasswordFile    string        `cli:"macos-keychain-password-file"`
+		CancelGracePeriod       time.Duration `cli:"cancel-grace-period"`
+		Tags                    []string      `cli:"tags"`
+		Internal                string
+	}{
+		Path:                 "*.log",
+		Token:                "xxx",
+		KeychainPasswordFile: "/etc/keychain-password",
+		CancelGracePeriod:    10 * time.Second,
+		Tags:                 []string{"queue=default"},
+		Internal:             "hidden",
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"token":                        "[REDACTED]",
+		"api-request-signing-secret":   "",
+		"macos-keychain-password-file": "/etc/keychain-password",
+		"cancel-grace-period":          "10s",
+		"tags":                         []string{"queue=default"},
+	}, configDumpValues(&cfg))
+}
+
+func TestFindConfigDumpCommand(t *testing.T) {
+	name, args, _, ok := findConfigCommand([]string{"artifact", "upload", "*.log"})
+	assert.True(t, ok)
+	assert.Equal(t, "artifact upload", name)
+	assert.Equal(t, []string{"*.log"}, args)
+
+	name, args, _, ok = findConfigCommand([]string{"start", "--token", "xxx"})
+	assert.True(t, ok)
+	assert.Equal(t, "start", name)
+	assert.Equal(t, []string{"--token", "xxx"}, args)
+
+	_, _, _, ok = findConfigCommand([]string{"artifact"})
+	assert.False(t, ok)
+}
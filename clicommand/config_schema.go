@@ -0,0 +1,229 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var ConfigSchemaHelpDescription = `Usage:
+
+   buildkite-agent config schema [command] [options...]
+
+Description:
+
+   Prints a JSON Schema of the options in a command's configuration file,
+   which is "start" if no command is given. Each option has its type,
+   description and default, and says whether it's deprecated, which
+   environment variable sets it, and how the command validates it.
+
+   The schema describes YAML and JSON configuration files, which can also
+   have nested sections and profiles that aren't checked as strictly.
+
+Example:
+
+   $ buildkite-agent config schema > buildkite-agent.schema.json
+   $ buildkite-agent config schema bootstrap`
+
+type ConfigSchemaConfig struct {
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var ConfigSchemaCommand = cli.Command{
+	Name:        "schema",
+	Usage:       "Print a JSON Schema of a command's configuration",
+	Description: ConfigSchemaHelpDescription,
+	Flags: []cli.Flag{
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := ConfigSchemaConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		args := c.Args()
+		if len(args) == 0 {
+			args = []string{"start"}
+		}
+
+		name, rest, target, ok := findConfigCommand(args)
+		if !ok || len(rest) > 0 {
+			l.Fatal("Unknown command %q, must be one of: %s", strings.Join(args, " "), strings.Join(configCommandNames(), ", "))
+		}
+
+		out, err := json.MarshalIndent(configSchema(name, target), "", "  ")
+		if err != nil {
+			l.Fatal("Failed to encode schema: %v", err)
+		}
+		fmt.Println(string(out))
+	},
+}
+
+// configSchema returns a JSON Schema of the options in a command's config
+// struct, described by its flags
+func configSchema(name string, target configCommand) map[string]interface{} {
+	flags := map[string]reflect.Value{}
+	for _, f := range target.command.Flags {
+		v := reflect.Indirect(reflect.ValueOf(f))
+		if v.Kind() != reflect.Struct {
+			continue
+		}
+		if n := v.FieldByName("Name"); n.IsValid() {
+			// Flags can have short aliases, like "name, n"
+			flagName, _, _ := strings.Cut(n.String(), ",")
+			flags[flagName] = v
+		}
+	}
+
+	properties := map[string]interface{}{}
+
+	for _, field := range cliconfig.Fields(target.config()) {
+		optionName := field.CLIName()
+		if optionName == "" || strings.HasPrefix(optionName, "arg:") {
+			continue
+		}
+
+		property := configSchemaType(field.Type)
+
+		var description []string
+		if flag, ok := flags[optionName]; ok {
+			if usage := flag.FieldByName("Usage"); usage.IsValid() && usage.String() != "" {
+				description = append(description, strings.TrimSuffix(usage.String(), "."))
+			}
+			if env := flag.FieldByName("EnvVar"); env.IsValid() && env.String() != "" {
+				property["x-env-var"] = env.String()
+			}
+			if def, ok := configSchemaDefault(flag); ok {
+				property["default"] = def
+			}
+		}
+
+		// A default in the field's tag is used instead of the flag's
+		if def, ok, err := field.Default(); ok && err == nil {
+			if d, isDuration := def.(time.Duration); isDuration {
+				def = d.String()
+			}
+			property["default"] = def
+		}
+
+		if renamedTo := field.Tag.Get("deprecated-and-renamed-to"); renamedTo != "" {
+			property["deprecated"] = true
+			if renamed, ok := reflect.TypeOf(field.Struct).Elem().FieldByName(renamedTo); ok {
+				description = append(description, fmt.Sprintf("Renamed to %s", field.Prefix+renamed.Tag.Get("cli")))
+			}
+		}
+		if deprecation := field.Tag.Get("deprecated"); deprecation != "" {
+			property["deprecated"] = true
+			description = append(description, "Deprecated: "+strings.TrimSuffix(deprecation, "."))
+		}
+
+		if rules := field.Tag.Get("validate"); rules != "" {
+			property["x-validate"] = cliconfig.SplitValidationRules(rules)
+		}
+
+		if len(description) > 0 {
+			property["description"] = strings.Join(description, ". ")
+		}
+		properties[optionName] = property
+	}
+
+	properties["profiles"] = map[string]interface{}{
+		"type":                 "object",
+		"description":          "Named sets of options that override the others when selected with --config-profile",
+		"additionalProperties": map[string]interface{}{"type": "object"},
+	}
+
+	return map[string]interface{}{
+		"$schema":    "https://json-schema.org/draft/2020-12/schema",
+		"title":      fmt.Sprintf("buildkite-agent %s configuration", name),
+		"type":       "object",
+		"properties": properties,
+	}
+}
+
+// configSchemaType returns the JSON Schema type of a config field. Lists can
+// also be given as comma separated strings, maps as comma separated key=value
+// pairs, and durations as a number of seconds.
+func configSchemaType(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return map[string]interface{}{"type": []string{"string", "integer"}}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  []string{"array", "string"},
+			"items": map[string]interface{}{"type": "string"},
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 []string{"object", "string"},
+			"additionalProperties": map[string]interface{}{"type": "string"},
+		}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+// configSchemaDefault returns a flag's default value, if it has one that isn't
+// the zero value
+func configSchemaDefault(flag reflect.Value) (interface{}, bool) {
+	// BoolT flags default to true, and don't have a value
+	if flag.Type() == reflect.TypeOf(cli.BoolTFlag{}) {
+		return true, true
+	}
+
+	value := flag.FieldByName("Value")
+	if !value.IsValid() || value.IsZero() {
+		return nil, false
+	}
+
+	if d, ok := value.Interface().(time.Duration); ok {
+		return d.String(), true
+	}
+
+	switch value.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64, reflect.Float64:
+		return value.Interface(), true
+	}
+	return nil, false
+}
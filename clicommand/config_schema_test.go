@@ -0,0 +1,64 @@
+package clicommand
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+type configSchemaTestConfig struct {
+	Path              string            `cli:"arg:0"`
+	Token             string            `cli:"token" validate:"required"`
+	CancelGracePeriod time.Duration     `cli:"cancel-grace-period"`
+	Spawn             int               `cli:"spawn"`
+	Tags              []string          `cli:"tags" normalize:"list"`
+	Env               map[string]string `cli:"env"`
+	NoPTY             bool              `cli:"no-pty"`
+	MetaData          []string          `cli:"meta-data" deprecated-and-renamed-to:"Tags"`
+	DisconnectAfter   bool              `cli:"disconnect-after" deprecated:"Use --disconnect-after-job."`
+	Queue             string            `cli:"queue" default:"default"`
+	HeartbeatInterval time.Duration     `cli:"heartbeat-interval" default:"1m"`
+}
+
+func TestConfigSchema(t *testing.T) {
+	schema := configSchema("test", configCommand{
+		command: cli.Command{Flags: []cli.Flag{
+			cli.StringFlag{Name: "token", Usage: "Your account agent token", EnvVar: "BUILDKITE_AGENT_TOKEN"},
+			cli.StringFlag{Name: "cancel-grace-period", Value: "10s"},
+			cli.IntFlag{Name: "spawn", Value: 1},
+			cli.StringSliceFlag{Name: "tags", Value: &cli.StringSlice{}},
+			cli.BoolTFlag{Name: "no-pty"},
+		}},
+		config: func() interface{} { return &configSchemaTestConfig{} },
+	})
+
+	assert.Equal(t, "buildkite-agent test configuration", schema["title"])
+
+	properties := schema["properties"].(map[string]interface{})
+	assert.NotContains(t, properties, "arg:0")
+	assert.Equal(t, map[string]interface{}{
+		"type":        "string",
+		"description": "Your account agent token",
+		"x-env-var":   "BUILDKITE_AGENT_TOKEN",
+		"x-validate":  []string{"required"},
+	}, properties["token"])
+	assert.Equal(t, map[string]interface{}{
+		"type":    []string{"string", "integer"},
+		"default": "10s",
+	}, properties["cancel-grace-period"])
+	assert.Equal(t, map[string]interface{}{"type": "integer", "default": 1}, properties["spawn"])
+	assert.Equal(t, map[string]interface{}{"type": "boolean", "default": true}, properties["no-pty"])
+	assert.Equal(t, []string{"array", "string"}, properties["tags"].(map[string]interface{})["type"])
+	assert.Equal(t, []string{"object", "string"}, properties["env"].(map[string]interface{})["type"])
+	assert.Equal(t, map[string]interface{}{
+		"type":        []string{"array", "string"},
+		"items":       map[string]interface{}{"type": "string"},
+		"deprecated":  true,
+		"description": "Renamed to tags",
+	}, properties["meta-data"])
+	assert.Equal(t, "Deprecated: Use --disconnect-after-job", properties["disconnect-after"].(map[string]interface{})["description"])
+	assert.Equal(t, map[string]interface{}{"type": "string", "default": "default"}, properties["queue"])
+	assert.Equal(t, "1m0s", properties["heartbeat-interval"].(map[string]interface{})["default"])
+}
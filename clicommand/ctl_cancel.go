@@ -0,0 +1,95 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var CtlCancelHelpDescription = `Usage:
+
+   buildkite-agent ctl cancel <job> [options...]
+
+Description:
+
+   Cancels a job running on this host, in the same way as canceling it in
+   Buildkite: the job is interrupted, and terminated if it hasn't stopped
+   within the agent's cancel grace period.
+
+   The agent must have been started with --control-socket, and the same path
+   must be passed to this command (or set in the configuration file).
+
+Example:
+
+   $ buildkite-agent ctl cancel 0183c5f5-2bd4-4e3b-9d10-0e3f07ad4a3c`
+
+type CtlCancelConfig struct {
+	Job           string `cli:"arg:0" label:"job ID" validate:"required"`
+	Config        string `cli:"config"`
+	ControlSocket string `cli:"control-socket" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var CtlCancelCommand = cli.Command{
+	Name:        "cancel",
+	Usage:       "Cancel a job on a running agent",
+	Description: CtlCancelHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to a configuration file",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		ControlSocketFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := CtlCancelConfig{}
+
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		message, err := agent.NewControlClient(cfg.ControlSocket).CancelJob(cfg.Job)
+		if err != nil {
+			l.Fatal("Failed to cancel job: %s", err)
+		}
+
+		l.Info("%s", message)
+	},
+}
@@ -0,0 +1,99 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var CtlDebugHelpDescription = `Usage:
+
+   buildkite-agent ctl debug <on|off> [options...]
+
+Description:
+
+   Turns debug logging on or off for a running agent without restarting
+   it. Turning it off goes back to the log level the agent was started with.
+
+   The agent must have been started with --control-socket, and the same path
+   must be passed to this command (or set in the configuration file).
+
+Example:
+
+   $ buildkite-agent ctl debug on
+   $ buildkite-agent ctl debug off`
+
+type CtlDebugConfig struct {
+	State         string `cli:"arg:0" label:"on or off" validate:"required"`
+	Config        string `cli:"config"`
+	ControlSocket string `cli:"control-socket" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var CtlDebugCommand = cli.Command{
+	Name:        "debug",
+	Usage:       "Turn debug logging on or off on a running agent",
+	Description: CtlDebugHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to a configuration file",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		ControlSocketFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := CtlDebugConfig{}
+
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		if cfg.State != "on" && cfg.State != "off" {
+			l.Fatal("Invalid state %q, must be either on or off", cfg.State)
+		}
+
+		message, err := agent.NewControlClient(cfg.ControlSocket).SetDebug(cfg.State == "on")
+		if err != nil {
+			l.Fatal("Failed to set debug logging: %s", err)
+		}
+
+		l.Info("%s", message)
+	},
+}
@@ -0,0 +1,94 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var CtlDrainHelpDescription = `Usage:
+
+   buildkite-agent ctl drain [options...]
+
+Description:
+
+   Stops a running agent from accepting new jobs, and disconnects it once
+   its running jobs have finished. This is the same as sending the agent
+   SIGTERM once.
+
+   The agent must have been started with --control-socket, and the same path
+   must be passed to this command (or set in the configuration file).
+
+Example:
+
+   $ buildkite-agent ctl drain`
+
+type CtlDrainConfig struct {
+	Config        string `cli:"config"`
+	ControlSocket string `cli:"control-socket" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var CtlDrainCommand = cli.Command{
+	Name:        "drain",
+	Usage:       "Stop a running agent once its jobs finish",
+	Description: CtlDrainHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to a configuration file",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		ControlSocketFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := CtlDrainConfig{}
+
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		message, err := agent.NewControlClient(cfg.ControlSocket).Drain()
+		if err != nil {
+			l.Fatal("Failed to drain agent: %s", err)
+		}
+
+		l.Info("%s", message)
+	},
+}
@@ -0,0 +1,104 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var CtlJobsHelpDescription = `Usage:
+
+   buildkite-agent ctl jobs [options...]
+
+Description:
+
+   Lists the jobs that the agents of a running "buildkite-agent start" are
+   running, with the name of the agent running each one.
+
+   The agent must have been started with --control-socket, and the same path
+   must be passed to this command (or set in the configuration file).
+
+Example:
+
+   $ buildkite-agent ctl jobs --control-socket /var/run/buildkite-agent.sock`
+
+type CtlJobsConfig struct {
+	Config        string `cli:"config"`
+	ControlSocket string `cli:"control-socket" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var CtlJobsCommand = cli.Command{
+	Name:        "jobs",
+	Usage:       "List the jobs a running agent is running",
+	Description: CtlJobsHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to a configuration file",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		ControlSocketFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := CtlJobsConfig{}
+
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		jobs, err := agent.NewControlClient(cfg.ControlSocket).RunningJobs()
+		if err != nil {
+			l.Fatal("Failed to list jobs: %s", err)
+		}
+
+		if len(jobs) == 0 {
+			fmt.Println("No jobs are running")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "JOB\tAGENT\tPIPELINE\tLABEL\tSTARTED")
+		for _, job := range jobs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", job.ID, job.Agent, job.Pipeline, job.Label, job.StartedAt)
+		}
+		w.Flush()
+	},
+}
@@ -0,0 +1,117 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var CtlSchedulingHelpDescription = `Usage:
+
+   buildkite-agent ctl scheduling <priority|weight> <value> [options...]
+
+Description:
+
+   Changes the priority or capacity weight of a running agent without
+   restarting it. Buildkite assigns work to agents with higher priorities
+   first, and gives agents with higher weights a bigger share of the work.
+
+   The new value is sent to Buildkite with the agent's next ping, and is kept
+   if the agent has to register again, but goes back to the configured value
+   when the agent restarts.
+
+   The agent must have been started with --control-socket, and the same path
+   must be passed to this command (or set in the configuration file).
+
+Example:
+
+   $ buildkite-agent ctl scheduling priority 10
+   $ buildkite-agent ctl scheduling weight 2`
+
+type CtlSchedulingConfig struct {
+	Setting       string `cli:"arg:0" label:"priority or weight" validate:"required"`
+	Value         string `cli:"arg:1" label:"value" validate:"required"`
+	Config        string `cli:"config"`
+	ControlSocket string `cli:"control-socket" validate:"required"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var CtlSchedulingCommand = cli.Command{
+	Name:        "scheduling",
+	Usage:       "Change the priority or weight of a running agent",
+	Description: CtlSchedulingHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to a configuration file",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		ControlSocketFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := CtlSchedulingConfig{}
+
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		value, err := strconv.Atoi(cfg.Value)
+		if err != nil {
+			l.Fatal("Invalid %s %q, must be a whole number", cfg.Setting, cfg.Value)
+		}
+
+		var req agent.ControlSchedulingRequest
+		switch cfg.Setting {
+		case "priority":
+			req.Priority = &value
+		case "weight":
+			req.Weight = &value
+		default:
+			l.Fatal("Invalid setting %q, must be either priority or weight", cfg.Setting)
+		}
+
+		message, err := agent.NewControlClient(cfg.ControlSocket).SetScheduling(req)
+		if err != nil {
+			l.Fatal("Failed to change the agent's %s: %s", cfg.Setting, err)
+		}
+
+		l.Info("%s", message)
+	},
+}
@@ -0,0 +1,405 @@
+package clicommand
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/system"
+	"github.com/urfave/cli"
+)
+
+var DoctorHelpDescription = `Usage:
+
+   buildkite-agent doctor [options...]
+
+Description:
+
+   Checks this host for common problems that stop the agent from running
+   jobs: whether the Buildkite API can be reached (and how quickly), whether
+   the system clock has drifted, whether git, ssh and docker are usable,
+   whether there's enough free disk space in the build and plugin paths, and
+   whether the agent hooks are valid scripts.
+
+   The agent configuration file is read in the same way as "buildkite-agent
+   start", so paths are checked as the agent would use them.
+
+   The command exits with a status of 1 if any check fails. Use --format json
+   for a machine-readable report, for example when sweeping a fleet.
+
+Example:
+
+   $ buildkite-agent doctor
+   $ buildkite-agent doctor --format json`
+
+// The amount of free disk space below which the disk checks will fail
+const doctorMinFreeDisk = 1024 * 1024 * 1024
+
+// How far the local clock can drift from Buildkite's before we complain
+const doctorMaxClockSkew = 30 * time.Second
+
+type DoctorConfig struct {
+	Config               []string `cli:"config" normalize:"list"`
+	ConfigProfile        string   `cli:"config-profile"`
+	ConfigIdentity       string   `cli:"config-identity"`
+	NoConfigEnvExpansion bool     `cli:"no-config-env-expansion"`
+	BuildPath            string   `cli:"build-path" normalize:"filepath"`
+	HooksPath            string   `cli:"hooks-path" normalize:"filepath"`
+	PluginsPath          string   `cli:"plugins-path" normalize:"filepath"`
+	Format               string   `cli:"format"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	Endpoint string `cli:"endpoint" validate:"required"`
+}
+
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+type doctorCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type doctorReport struct {
+	Passed bool          `json:"passed"`
+	Checks []doctorCheck `json:"checks"`
+}
+
+var DoctorCommand = cli.Command{
+	Name:        "doctor",
+	Usage:       "Check this host for common problems",
+	Description: DoctorHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:   "config",
+			Value:  &cli.StringSlice{},
+			Usage:  "Path to a configuration file, which can be given more than once to merge the files in order",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		ConfigProfileFlag,
+		ConfigIdentityFlag,
+		NoConfigEnvExpansionFlag,
+		cli.StringFlag{
+			Name:   "build-path",
+			Value:  "",
+			Usage:  "Path to where the builds will run from",
+			EnvVar: "BUILDKITE_BUILD_PATH",
+		},
+		cli.StringFlag{
+			Name:   "hooks-path",
+			Value:  "",
+			Usage:  "Directory where the hook scripts are found",
+			EnvVar: "BUILDKITE_HOOKS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "plugins-path",
+			Value:  "",
+			Usage:  "Directory where the plugins are saved to",
+			EnvVar: "BUILDKITE_PLUGINS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "format",
+			Value:  "text",
+			Usage:  "The format to output the report in, either text or json",
+			EnvVar: "BUILDKITE_AGENT_DOCTOR_FORMAT",
+		},
+
+		// API Flags
+		EndpointFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := DoctorConfig{}
+
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		if cfg.Format != "text" && cfg.Format != "json" {
+			l.Fatal("Invalid format %q, must be either text or json", cfg.Format)
+		}
+
+		report := runDoctorChecks(cfg)
+
+		if cfg.Format == "json" {
+			out, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				l.Fatal("Failed to encode report: %v", err)
+			}
+			fmt.Println(string(out))
+		} else {
+			for _, check := range report.Checks {
+				fmt.Printf("[%s] %s: %s\n", strings.ToUpper(check.Status), check.Name, check.Message)
+			}
+		}
+
+		if !report.Passed {
+			os.Exit(1)
+		}
+	},
+}
+
+func runDoctorChecks(cfg DoctorConfig) doctorReport {
+	var checks []doctorCheck
+
+	checks = append(checks, doctorCheckAPI(cfg.Endpoint)...)
+	checks = append(checks,
+		doctorCheckCommand("git", "git", "--version"),
+		doctorCheckCommand("ssh", "ssh", "-V"),
+		doctorCheckDocker(),
+		doctorCheckDisk("build-path", cfg.BuildPath),
+		doctorCheckDisk("plugins-path", cfg.PluginsPath),
+	)
+	checks = append(checks, doctorCheckHooks(cfg.HooksPath)...)
+
+	report := doctorReport{Passed: true, Checks: checks}
+	for _, check := range checks {
+		if check.Status == doctorFail {
+			report.Passed = false
+		}
+	}
+
+	return report
+}
+
+// doctorCheckAPI checks that the API endpoint responds, and uses the Date
+// header of the response to check for clock skew. Any response (even a 401)
+// shows that the endpoint is reachable.
+func doctorCheckAPI(endpoint string) []doctorCheck {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	start := time.Now()
+	resp, err := client.Get(strings.TrimSuffix(endpoint, "/") + "/ping")
+	latency := time.Since(start)
+	if err != nil {
+		return []doctorCheck{
+			{Name: "api", Status: doctorFail, Message: fmt.Sprintf("Couldn't reach %s: %v", endpoint, err)},
+			{Name: "clock-skew", Status: doctorSkip, Message: "The API couldn't be reached"},
+		}
+	}
+	resp.Body.Close()
+
+	checks := []doctorCheck{
+		{Name: "api", Status: doctorPass, Message: fmt.Sprintf("%s responded in %v", endpoint, latency.Round(time.Millisecond))},
+	}
+
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return append(checks, doctorCheck{Name: "clock-skew", Status: doctorSkip, Message: "The API response didn't include a valid Date header"})
+	}
+
+	// The Date header is only accurate to the second, and was generated
+	// somewhere during the request
+	skew := time.Until(serverTime.Add(latency / 2)).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+
+	if skew > doctorMaxClockSkew {
+		return append(checks, doctorCheck{Name: "clock-skew", Status: doctorFail, Message: fmt.Sprintf("The local clock is %v away from Buildkite's", skew)})
+	}
+	return append(checks, doctorCheck{Name: "clock-skew", Status: doctorPass, Message: fmt.Sprintf("The local clock is within %v of Buildkite's", doctorMaxClockSkew)})
+}
+
+// doctorCheckCommand checks that a command is in the PATH, and reports its version
+func doctorCheckCommand(name string, command string, args ...string) doctorCheck {
+	path, err := exec.LookPath(command)
+	if err != nil {
+		return doctorCheck{Name: name, Status: doctorFail, Message: fmt.Sprintf("%s couldn't be found in the PATH", command)}
+	}
+
+	// ssh prints its version to stderr
+	out, err := exec.Command(path, args...).CombinedOutput()
+	if err != nil {
+		return doctorCheck{Name: name, Status: doctorFail, Message: fmt.Sprintf("%s %s failed: %v", path, strings.Join(args, " "), err)}
+	}
+
+	return doctorCheck{Name: name, Status: doctorPass, Message: strings.TrimSpace(string(out))}
+}
+
+// doctorCheckDocker checks that the docker daemon socket can be connected to.
+// Docker is optional, so not being able to find it is only a warning.
+func doctorCheckDocker() doctorCheck {
+	network, address := "unix", "/var/run/docker.sock"
+
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		scheme, rest, ok := strings.Cut(host, "://")
+		if !ok || (scheme != "unix" && scheme != "tcp") {
+			return doctorCheck{Name: "docker", Status: doctorSkip, Message: fmt.Sprintf("Can't check DOCKER_HOST=%s", host)}
+		}
+		network, address = scheme, rest
+	} else if runtime.GOOS == "windows" {
+		return doctorCheck{Name: "docker", Status: doctorSkip, Message: "Checking the docker named pipe isn't supported"}
+	}
+
+	conn, err := net.DialTimeout(network, address, 5*time.Second)
+	if err != nil {
+		return doctorCheck{Name: "docker", Status: doctorWarn, Message: fmt.Sprintf("Couldn't connect to the docker daemon at %s: %v", address, err)}
+	}
+	conn.Close()
+
+	return doctorCheck{Name: "docker", Status: doctorPass, Message: fmt.Sprintf("Connected to the docker daemon at %s", address)}
+}
+
+// doctorCheckDisk checks that the filesystem that holds path has enough free
+// space. The path may not have been created yet, so we check the closest
+// parent that exists.
+func doctorCheckDisk(name string, path string) doctorCheck {
+	if path == "" {
+		return doctorCheck{Name: name, Status: doctorSkip, Message: fmt.Sprintf("No %s configured", name)}
+	}
+
+	dir := path
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	free, err := system.DiskFree(dir)
+	if err != nil {
+		return doctorCheck{Name: name, Status: doctorWarn, Message: fmt.Sprintf("Couldn't check free space in %s: %v", path, err)}
+	}
+
+	message := fmt.Sprintf("%d MiB free in %s", free/1024/1024, path)
+	if free < doctorMinFreeDisk {
+		return doctorCheck{Name: name, Status: doctorFail, Message: message}
+	}
+	return doctorCheck{Name: name, Status: doctorPass, Message: message}
+}
+
+// doctorCheckHooks checks the syntax of each hook in the hooks path that bash
+// runs using `bash -n`. Windows hooks, and scripts for other interpreters,
+// are skipped.
+func doctorCheckHooks(hooksPath string) []doctorCheck {
+	if hooksPath == "" {
+		return []doctorCheck{{Name: "hooks", Status: doctorSkip, Message: "No hooks-path configured"}}
+	}
+
+	files, err := ioutil.ReadDir(hooksPath)
+	if err != nil {
+		return []doctorCheck{{Name: "hooks", Status: doctorFail, Message: fmt.Sprintf("Couldn't read hooks-path: %v", err)}}
+	}
+
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		return []doctorCheck{{Name: "hooks", Status: doctorSkip, Message: "bash couldn't be found in the PATH"}}
+	}
+
+	var checks []doctorCheck
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		// Hooks bash runs don't have an extension, which rules out
+		// Windows hooks and files that aren't hooks at all
+		if filepath.Ext(file.Name()) != "" {
+			continue
+		}
+
+		name := "hook " + file.Name()
+		path := filepath.Join(hooksPath, file.Name())
+		if interpreter := scriptInterpreter(path); interpreter != "" && interpreter != "bash" && interpreter != "sh" {
+			checks = append(checks, doctorCheck{Name: name, Status: doctorSkip, Message: fmt.Sprintf("Runs with %s, not bash", interpreter)})
+			continue
+		}
+
+		out, err := exec.Command(bash, "-n", path).CombinedOutput()
+		if err != nil {
+			checks = append(checks, doctorCheck{Name: name, Status: doctorFail, Message: strings.TrimSpace(string(out))})
+		} else {
+			checks = append(checks, doctorCheck{Name: name, Status: doctorPass, Message: "Valid syntax"})
+		}
+	}
+
+	if len(checks) == 0 {
+		return []doctorCheck{{Name: "hooks", Status: doctorSkip, Message: fmt.Sprintf("No hooks found in %s", hooksPath)}}
+	}
+
+	return checks
+}
+
+// scriptInterpreter returns the name of the interpreter in a script's
+// shebang, like python3 for `#!/usr/bin/env python3`, or "" if it doesn't
+// have one
+func scriptInterpreter(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	if !strings.HasPrefix(line, "#!") {
+		return ""
+	}
+
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return ""
+	}
+
+	// env runs the first of its arguments that isn't an option
+	if filepath.Base(fields[0]) == "env" {
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				return filepath.Base(field)
+			}
+		}
+	}
+
+	return filepath.Base(fields[0])
+}
@@ -0,0 +1,88 @@
+package clicommand
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoctorCheckAPI(t *testing.T) {
+	t.Run("with an accurate clock", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v3/ping", r.URL.Path)
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer server.Close()
+
+		checks := doctorCheckAPI(server.URL + "/v3")
+		require.Len(t, checks, 2)
+		assert.Equal(t, doctorPass, checks[0].Status)
+		assert.Equal(t, doctorPass, checks[1].Status)
+	})
+
+	t.Run("with a skewed clock", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+		}))
+		defer server.Close()
+
+		checks := doctorCheckAPI(server.URL)
+		require.Len(t, checks, 2)
+		assert.Equal(t, doctorPass, checks[0].Status)
+		assert.Equal(t, doctorFail, checks[1].Status)
+	})
+
+	t.Run("with an unreachable endpoint", func(t *testing.T) {
+		checks := doctorCheckAPI("http://127.0.0.1:1")
+		require.Len(t, checks, 2)
+		assert.Equal(t, doctorFail, checks[0].Status)
+		assert.Equal(t, doctorSkip, checks[1].Status)
+	})
+}
+
+func TestDoctorCheckHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook syntax checking requires bash")
+	}
+
+	hooksPath, err := ioutil.TempDir("", "doctor-hooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(hooksPath)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(hooksPath, "environment"), []byte("export LLAMAS=rock\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(hooksPath, "pre-command"), []byte("if true; then\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(hooksPath, "pre-exit.bat"), []byte("@echo off\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(hooksPath, "post-command.ps1"), []byte("Write-Host 'done'\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(hooksPath, "pre-exit"), []byte("#!/usr/bin/env python3\nprint('bye')\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(hooksPath, "post-checkout"), []byte("#!/bin/bash\nset -euo pipefail\n"), 0755))
+
+	checks := doctorCheckHooks(hooksPath)
+	require.Len(t, checks, 4)
+	assert.Equal(t, "hook environment", checks[0].Name)
+	assert.Equal(t, doctorPass, checks[0].Status)
+	assert.Equal(t, "hook post-checkout", checks[1].Name)
+	assert.Equal(t, doctorPass, checks[1].Status)
+	assert.Equal(t, "hook pre-command", checks[2].Name)
+	assert.Equal(t, doctorFail, checks[2].Status)
+	assert.Equal(t, "hook pre-exit", checks[3].Name)
+	assert.Equal(t, doctorSkip, checks[3].Status)
+	assert.Equal(t, "Runs with python3, not bash", checks[3].Message)
+}
+
+func TestDoctorCheckDiskUsesExistingParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctor-disk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	check := doctorCheckDisk("build-path", filepath.Join(dir, "does", "not", "exist"))
+	assert.NotEqual(t, doctorWarn, check.Status, check.Message)
+	assert.NotEqual(t, doctorSkip, check.Status, check.Message)
+}
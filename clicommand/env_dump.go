@@ -0,0 +1,99 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/urfave/cli"
+)
+
+var EnvDumpHelpDescription = `Usage:
+
+   buildkite-agent env dump [options...]
+
+Description:
+
+   Prints the environment of the current process. Unlike the output of "env"
+   or "export -p", values containing newlines, quotes and other unusual
+   characters are preserved exactly, so it's safe for wrapper tooling to
+   capture and restore.
+
+   The default format is a JSON object of keys and values. The
+   null-delimited format prints KEY=VALUE entries each terminated by a NUL
+   byte, like "env -0".
+
+   The bootstrap uses this to capture the environment changes made by hooks.
+
+Example:
+
+   $ buildkite-agent env dump
+   $ buildkite-agent env dump --format null-delimited | xargs -0 -n1`
+
+// This runs before and after every hook, so it deliberately doesn't take the
+// experiment or profile flags, which would otherwise be picked up from the
+// job environment
+type EnvDumpConfig struct {
+	Format string `cli:"format"`
+
+	// Global flags
+	Debug    bool   `cli:"debug"`
+	LogLevel string `cli:"log-level"`
+	NoColor  bool   `cli:"no-color"`
+}
+
+var EnvDumpCommand = cli.Command{
+	Name:        "dump",
+	Usage:       "Print the environment of the current process",
+	Description: EnvDumpHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Value: env.DumpFormatJSON,
+			Usage: "The format to print the environment in, either json or null-delimited",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := EnvDumpConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		out, err := env.FromSlice(os.Environ()).Dump(cfg.Format)
+		if err != nil {
+			l.Fatal("Failed to dump environment: %v", err)
+		}
+
+		// NUL terminated entries can be consumed as they are, but JSON is
+		// nicer to read with a trailing newline
+		if cfg.Format == env.DumpFormatJSON {
+			out = append(out, '\n')
+		}
+
+		if _, err := os.Stdout.Write(out); err != nil {
+			l.Fatal("Failed to write environment: %v", err)
+		}
+	},
+}
@@ -0,0 +1,106 @@
+package clicommand
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/interpolate"
+	"github.com/urfave/cli"
+)
+
+var EnvInterpolateHelpDescription = `Usage:
+
+   buildkite-agent env interpolate [file] [options...]
+
+Description:
+
+   Interpolates environment variables into a template and prints the result.
+   The template is read from the given file, or from STDIN if no file (or
+   "-") is given.
+
+   Interpolation uses the environment of the current process and works the
+   same way as it does for "buildkite-agent pipeline upload", so $VAR, ${VAR},
+   ${VAR:-default}, ${VAR?error} and substrings like ${VAR:0:7} are all
+   supported, and $$ can be used to escape a literal $.
+
+Example:
+
+   $ buildkite-agent env interpolate template.yml > config.yml
+   $ echo 'Deploying ${BUILDKITE_COMMIT:0:7}' | buildkite-agent env interpolate`
+
+type EnvInterpolateConfig struct {
+	File string `cli:"arg:0" label:"template file"`
+
+	// Global flags
+	Debug    bool   `cli:"debug"`
+	LogLevel string `cli:"log-level"`
+	NoColor  bool   `cli:"no-color"`
+}
+
+var EnvInterpolateCommand = cli.Command{
+	Name:        "interpolate",
+	Usage:       "Interpolate environment variables into a template",
+	Description: EnvInterpolateHelpDescription,
+	Flags: []cli.Flag{
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := EnvInterpolateConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		var input io.Reader = os.Stdin
+		if cfg.File != "" && cfg.File != "-" {
+			f, err := os.Open(cfg.File)
+			if err != nil {
+				l.Fatal("Failed to open template: %v", err)
+			}
+			defer f.Close()
+			input = f
+		}
+
+		if err := interpolateTemplate(env.FromSlice(os.Environ()), input, os.Stdout); err != nil {
+			l.Fatal("Failed to interpolate template: %v", err)
+		}
+	},
+}
+
+// interpolateTemplate reads a template from r, interpolates the environment
+// into it and writes the result to w
+func interpolateTemplate(environ env.Environment, r io.Reader, w io.Writer) error {
+	template, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	out, err := interpolate.Interpolate(environ, string(template))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, out)
+	return err
+}
@@ -0,0 +1,30 @@
+package clicommand
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterpolateTemplate(t *testing.T) {
+	environ := env.FromSlice([]string{"BUILDKITE_COMMIT=1a2b3c4d5e6f", "TARGET=staging"})
+	template := "Deploying ${BUILDKITE_COMMIT:0:7} to $TARGET for $${USER} (${REGION:-us-east-1})\n"
+
+	out := new(bytes.Buffer)
+	if err := interpolateTemplate(environ, strings.NewReader(template), out); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Deploying 1a2b3c4 to staging for ${USER} (us-east-1)\n", out.String())
+}
+
+func TestInterpolateTemplateWithMissingRequiredVariable(t *testing.T) {
+	out := new(bytes.Buffer)
+	err := interpolateTemplate(env.New(), strings.NewReader("${TARGET?must be set}"), out)
+
+	assert.Error(t, err)
+	assert.Empty(t, out.String())
+}
@@ -3,14 +3,17 @@ package clicommand
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/proxy"
 	"github.com/oleiade/reflections"
 	"github.com/urfave/cli"
 )
@@ -65,12 +68,94 @@ var ProfileFlag = cli.StringFlag{
 	EnvVar: "BUILDKITE_AGENT_PROFILE",
 }
 
+var ConfigProfileFlag = cli.StringFlag{
+	Name:   "config-profile",
+	Value:  "",
+	Usage:  "The name of a profile section in the configuration file to load, on top of the keys outside of any section",
+	EnvVar: "BUILDKITE_AGENT_CONFIG_PROFILE",
+}
+
+var ConfigIdentityFlag = cli.StringFlag{
+	Name:   "config-identity",
+	Value:  "",
+	Usage:  "What decrypts an encrypted configuration file: a file of age identities for files encrypted with age, or the AWS KMS key for files ending in .kms. AWS KMS is the only key management service supported",
+	EnvVar: "BUILDKITE_AGENT_CONFIG_IDENTITY",
+}
+
+var NoConfigEnvExpansionFlag = cli.BoolFlag{
+	Name:   "no-config-env-expansion",
+	Usage:  "Don't expand environment variables written as ${VAR} in configuration file values, where $$ is a literal $. Variables that aren't set expand to nothing, or are an error with --strict-config",
+	EnvVar: "BUILDKITE_AGENT_NO_CONFIG_ENV_EXPANSION",
+}
+
+var ControlSocketFlag = cli.StringFlag{
+	Name:   "control-socket",
+	Value:  "",
+	Usage:  "Path to the agent's control socket (or named pipe on Windows), for managing the running agent",
+	EnvVar: "BUILDKITE_AGENT_CONTROL_SOCKET",
+}
+
 var DebugHTTPFlag = cli.BoolFlag{
 	Name:   "debug-http",
 	Usage:  "Enable HTTP debug mode, which dumps all request and response bodies to the log",
 	EnvVar: "BUILDKITE_AGENT_DEBUG_HTTP",
 }
 
+var APIRecordPathFlag = cli.StringFlag{
+	Name:   "api-record-path",
+	Value:  "",
+	Usage:  "Append every request to the Agent API and its response to this file, with secrets redacted, so they can be replayed later",
+	EnvVar: "BUILDKITE_API_RECORD_PATH",
+}
+
+var APIReplayPathFlag = cli.StringFlag{
+	Name:   "api-replay-path",
+	Value:  "",
+	Usage:  "Answer requests to the Agent API from a file recorded with --api-record-path, instead of sending them",
+	EnvVar: "BUILDKITE_API_REPLAY_PATH",
+}
+
+var APIRequestSigningFlag = cli.StringFlag{
+	Name:   "api-request-signing",
+	Value:  "",
+	Usage:  "Sign requests to the Agent API for an authenticated gateway in front of it, with either \"hmac\" or \"aws-sigv4\"",
+	EnvVar: "BUILDKITE_API_REQUEST_SIGNING",
+}
+
+var APIRequestSigningSecretFlag = cli.StringFlag{
+	Name:   "api-request-signing-secret",
+	Value:  "",
+	Usage:  "The shared secret used to sign requests to the Agent API with hmac",
+	EnvVar: "BUILDKITE_API_REQUEST_SIGNING_SECRET",
+}
+
+var APIRequestSigningRegionFlag = cli.StringFlag{
+	Name:   "api-request-signing-region",
+	Value:  "",
+	Usage:  "The AWS region of the API Gateway requests to the Agent API are signed for with aws-sigv4",
+	EnvVar: "BUILDKITE_API_REQUEST_SIGNING_REGION",
+}
+
+var IPFamilyFlag = cli.StringFlag{
+	Name:   "ip-family",
+	Value:  "",
+	Usage:  "Only connect over this IP family, either \"ipv4\" or \"ipv6\", for debugging networks where the other one is broken. By default both are used, trying them in parallel",
+	EnvVar: "BUILDKITE_IP_FAMILY",
+}
+
+var ProxyPACFlag = cli.StringFlag{
+	Name:   "proxy-pac",
+	Value:  "",
+	Usage:  "A proxy auto-config (PAC) file to pick the proxy for each host the agent connects to, as a path or URL, or \"wpad\" to discover the network's. The proxies FindProxyForURL returns are tried in order, skipping ones that can't be connected to",
+	EnvVar: "BUILDKITE_PROXY_PAC",
+}
+
+var DNSCacheFlag = cli.BoolFlag{
+	Name:   "dns-cache",
+	Usage:  "Cache the addresses of the hosts the agent connects to for as long as their DNS records allow, using the expired ones if the resolver fails, and looking a host up again if it can't be connected to",
+	EnvVar: "BUILDKITE_DNS_CACHE",
+}
+
 var NoColorFlag = cli.BoolFlag{
 	Name:   "no-color",
 	Usage:  "Don't show colors in logging",
@@ -102,13 +187,14 @@ func CreateLogger(cfg interface{}) logger.Logger {
 		}
 	}
 
-	// Create a logger based on the type
+	// Create a printer based on the type
+	var printer logger.Printer
 	switch logFormat {
 	case `text`, ``:
-		printer := logger.NewTextPrinter(os.Stderr)
+		textPrinter := logger.NewTextPrinter(os.Stderr)
 
 		// Show agent fields as a prefix
-		printer.IsPrefixFn = func(field logger.Field) bool {
+		textPrinter.IsPrefixFn = func(field logger.Field) bool {
 			switch field.Key() {
 			case "agent", "hook":
 				return true
@@ -117,24 +203,47 @@ func CreateLogger(cfg interface{}) logger.Logger {
 			}
 		}
 
+		// Event IDs are for monitoring tools rather than people
+		textPrinter.IsVisibleFn = func(field logger.Field) bool {
+			return !logger.IsEventField(field)
+		}
+
 		// Turn off color if a NoColor option is present
 		noColor, err := reflections.GetField(cfg, "NoColor")
 		if noColor == true && err == nil {
-			printer.Colors = false
+			textPrinter.Colors = false
 		} else {
-			printer.Colors = true
+			textPrinter.Colors = true
 		}
 
-		l = logger.NewConsoleLogger(printer, os.Exit)
+		printer = textPrinter
 	case `json`:
-		l = logger.NewConsoleLogger(logger.NewJSONPrinter(os.Stdout), os.Exit)
+		printer = logger.NewJSONPrinter(os.Stdout)
 	default:
 		fmt.Printf("Unknown log-format of %q, try text or json\n", logFormat)
 		os.Exit(1)
 	}
 
+	// Also write to the Windows Event Log if a WindowsEventLog option is
+	// present
+	var eventLogErr error
+	if eventLog, err := reflections.GetField(cfg, "WindowsEventLog"); eventLog == true && err == nil {
+		eventLogPrinter, err := logger.NewEventLogPrinter("buildkite-agent")
+		if err != nil {
+			eventLogErr = err
+		} else {
+			printer = logger.MultiPrinter{printer, eventLogPrinter}
+		}
+	}
+
+	l = logger.NewConsoleLogger(printer, os.Exit)
+
 	l.SetLevel(logger.NOTICE)
 
+	if eventLogErr != nil {
+		l.Warn("Failed to open the Windows Event Log, not writing to it: %v", eventLogErr)
+	}
+
 	err := handleLogLevelFlag(l, cfg)
 	if err != nil {
 		l.Warn("Error when setting log level: %v. Defaulting log level to NOTICE", err)
@@ -158,6 +267,12 @@ func HandleProfileFlag(l logger.Logger, cfg interface{}) func() {
 	return func() {}
 }
 
+// The PAC file loaded by HandleGlobalFlags, if the command was given one
+var proxyPAC *proxy.PAC
+
+// The DNS cache HandleGlobalFlags set up, if the command was asked for one
+var dnsCache *api.DNSCache
+
 func HandleGlobalFlags(l logger.Logger, cfg interface{}) func() {
 	// Enable experiments
 	experimentNames, err := reflections.GetField(cfg, "Experiments")
@@ -171,6 +286,47 @@ func HandleGlobalFlags(l logger.Logger, cfg interface{}) func() {
 		}
 	}
 
+	// Connections other than the API client's, like artifact transfers,
+	// use the default transport
+	ipFamily, err := reflections.GetField(cfg, "IPFamily")
+	if ipFamily != "" && err == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.DialContext = api.NewDialContext(ipFamily.(string))
+		http.DefaultTransport = t
+		l.Debug("Only connecting over %s", ipFamily)
+	}
+
+	// The DNS cache is shared by the API client and the default transport
+	cacheDNS, err := reflections.GetField(cfg, "DNSCache")
+	if cacheDNS == true && err == nil {
+		family, _ := ipFamily.(string)
+		dnsCache = api.NewDNSCache()
+		dnsCache.OnLookup = func(host string, took time.Duration, err error) {
+			if err != nil {
+				l.Debug("Looking up %s failed after %v: %v", host, took, err)
+			}
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.DialContext = dnsCache.DialContext(family)
+		http.DefaultTransport = t
+		l.Debug("Caching DNS lookups")
+	}
+
+	// A PAC file picks the proxies for the API client, and for everything
+	// else that uses the default transport
+	pacLocation, err := reflections.GetField(cfg, "ProxyPAC")
+	if pacLocation != "" && err == nil {
+		pac, err := proxy.Load(pacLocation.(string))
+		if err != nil {
+			l.Fatal("%v", err)
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = pac.Proxy
+		http.DefaultTransport = t
+		proxyPAC = pac
+		l.Debug("Using the proxies from the PAC file %s", pac.Location)
+	}
+
 	// Handle profiling flag
 	return HandleProfileFlag(l, cfg)
 }
@@ -240,5 +396,41 @@ func loadAPIClientConfig(cfg interface{}, tokenField string) api.Config {
 		conf.DisableHTTP2 = noHTTP2.(bool)
 	}
 
+	recordPath, err := reflections.GetField(cfg, "APIRecordPath")
+	if recordPath != "" && err == nil {
+		conf.RecordPath = recordPath.(string)
+	}
+
+	replayPath, err := reflections.GetField(cfg, "APIReplayPath")
+	if replayPath != "" && err == nil {
+		conf.ReplayPath = replayPath.(string)
+	}
+
+	signing, err := reflections.GetField(cfg, "APIRequestSigning")
+	if signing != "" && err == nil {
+		conf.RequestSigning = signing.(string)
+	}
+
+	signingSecret, err := reflections.GetField(cfg, "APIRequestSigningSecret")
+	if signingSecret != "" && err == nil {
+		conf.RequestSigningSecret = signingSecret.(string)
+	}
+
+	signingRegion, err := reflections.GetField(cfg, "APIRequestSigningRegion")
+	if signingRegion != "" && err == nil {
+		conf.RequestSigningRegion = signingRegion.(string)
+	}
+
+	ipFamily, err := reflections.GetField(cfg, "IPFamily")
+	if ipFamily != "" && err == nil {
+		conf.IPFamily = ipFamily.(string)
+	}
+
+	if proxyPAC != nil {
+		conf.Proxy = proxyPAC.Proxy
+	}
+
+	conf.DNSCache = dnsCache
+
 	return conf
 }
@@ -1,28 +1,34 @@
 package clicommand
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
-	"github.com/buildkite/roko"
+	"github.com/buildkite/agent/v3/retry"
 	"github.com/urfave/cli"
 )
 
 var MetaDataExistsHelpDescription = `Usage:
 
-   buildkite-agent meta-data exists <key> [options...]
+   buildkite-agent meta-data exists <key> [key...] [options...]
 
 Description:
 
    The command exits with a status of 0 if the key has been set, or it will
    exit with a status of 100 if the key doesn't exist.
 
+   Given more than one key, it prints a JSON object of whether each key exists,
+   and exits with a status of 100 unless they all do.
+
 Example:
 
-   $ buildkite-agent meta-data exists "foo"`
+   $ buildkite-agent meta-data exists "foo"
+   $ buildkite-agent meta-data exists "shard-1" "shard-2" "shard-3"
+   {"shard-1":true,"shard-2":false,"shard-3":true}`
 
 type MetaDataExistsConfig struct {
 	Key string `cli:"arg:0" label:"meta-data key" validate:"required"`
@@ -36,10 +42,18 @@ type MetaDataExistsConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP               bool   `cli:"debug-http"`
+	AgentAccessToken        string `cli:"agent-access-token" validate:"required"`
+	Endpoint                string `cli:"endpoint" validate:"required"`
+	NoHTTP2                 bool   `cli:"no-http2"`
+	APIRecordPath           string `cli:"api-record-path" normalize:"filepath"`
+	APIReplayPath           string `cli:"api-replay-path" normalize:"filepath"`
+	APIRequestSigning       string `cli:"api-request-signing" validate:"oneof:hmac|aws-sigv4"`
+	APIRequestSigningSecret string `cli:"api-request-signing-secret"`
+	APIRequestSigningRegion string `cli:"api-request-signing-region"`
+	IPFamily                string `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                string `cli:"proxy-pac"`
+	DNSCache                bool   `cli:"dns-cache"`
 }
 
 var MetaDataExistsCommand = cli.Command{
@@ -59,6 +73,14 @@ var MetaDataExistsCommand = cli.Command{
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		APIRecordPathFlag,
+		APIReplayPathFlag,
+		APIRequestSigningFlag,
+		APIRequestSigningSecretFlag,
+		APIRequestSigningRegionFlag,
+		IPFamilyFlag,
+		ProxyPACFlag,
+		DNSCacheFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -92,31 +114,48 @@ var MetaDataExistsCommand = cli.Command{
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
 
-		// Find the meta data value
-		var exists *api.MetaDataExists
-		var resp *api.Response
-
-		err = roko.NewRetrier(
-			roko.WithMaxAttempts(10),
-			roko.WithStrategy(roko.Constant(5*time.Second)),
-		).Do(func(r *roko.Retrier) error {
-			exists, resp, err = client.ExistsMetaData(cfg.Job, cfg.Key)
-			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
-				r.Break()
-			}
+		// Find out whether each of the keys exists
+		results := map[string]bool{}
+		allExist := true
+
+		for _, key := range c.Args() {
+			var exists *api.MetaDataExists
+			var resp *api.Response
+
+			err = retry.NewRetrier(
+				retry.WithMaxAttempts(10),
+				retry.WithStrategy(retry.Constant(5*time.Second)),
+			).Do(func(r *retry.Retrier) error {
+				exists, resp, err = client.ExistsMetaData(cfg.Job, key)
+				if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+					r.Break()
+				}
+				if err != nil {
+					l.Warn("%s (%s)", err, r)
+				}
+
+				return err
+			})
+
 			if err != nil {
-				l.Warn("%s (%s)", err, r)
+				l.Fatal("Failed to see if meta-data %q exists: %s", key, err)
 			}
 
-			return err
-		})
+			results[key] = exists.Exists
+			allExist = allExist && exists.Exists
+		}
 
-		if err != nil {
-			l.Fatal("Failed to see if meta-data exists: %s", err)
+		// With more than one key, say which of them exist
+		if len(c.Args()) > 1 {
+			out, err := json.Marshal(results)
+			if err != nil {
+				l.Fatal("Failed to encode meta-data results: %s", err)
+			}
+			fmt.Println(string(out))
 		}
 
 		// If the meta data didn't exist, exit with an error.
-		if !exists.Exists {
+		if !allExist {
 			os.Exit(100)
 		}
 	},
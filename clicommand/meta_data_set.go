@@ -8,7 +8,7 @@ import (
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
-	"github.com/buildkite/roko"
+	"github.com/buildkite/agent/v3/retry"
 	"github.com/urfave/cli"
 )
 
@@ -23,16 +23,22 @@ Description:
    You can supply the value as an argument to the command, or pipe in a file or
    script output.
 
+   With --if-absent, the value is only set if the key hasn't been set yet, so
+   the first job to set it wins. The command exits with a status of 100 if the
+   key had already been set, leaving its value as it was.
+
 Example:
 
    $ buildkite-agent meta-data set "foo" "bar"
    $ buildkite-agent meta-data set "foo" < ./tmp/meta-data-value
-   $ ./script/meta-data-generator | buildkite-agent meta-data set "foo"`
+   $ ./script/meta-data-generator | buildkite-agent meta-data set "foo"
+   $ buildkite-agent meta-data set --if-absent "release-owner" "$BUILDKITE_JOB_ID"`
 
 type MetaDataSetConfig struct {
-	Key   string `cli:"arg:0" label:"meta-data key" validate:"required"`
-	Value string `cli:"arg:1" label:"meta-data value"`
-	Job   string `cli:"job" validate:"required"`
+	Key      string `cli:"arg:0" label:"meta-data key" validate:"required"`
+	Value    string `cli:"arg:1" label:"meta-data value"`
+	Job      string `cli:"job" validate:"required"`
+	IfAbsent bool   `cli:"if-absent"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
@@ -42,10 +48,18 @@ type MetaDataSetConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP               bool   `cli:"debug-http"`
+	AgentAccessToken        string `cli:"agent-access-token" validate:"required"`
+	Endpoint                string `cli:"endpoint" validate:"required"`
+	NoHTTP2                 bool   `cli:"no-http2"`
+	APIRecordPath           string `cli:"api-record-path" normalize:"filepath"`
+	APIReplayPath           string `cli:"api-replay-path" normalize:"filepath"`
+	APIRequestSigning       string `cli:"api-request-signing" validate:"oneof:hmac|aws-sigv4"`
+	APIRequestSigningSecret string `cli:"api-request-signing-secret"`
+	APIRequestSigningRegion string `cli:"api-request-signing-region"`
+	IPFamily                string `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                string `cli:"proxy-pac"`
+	DNSCache                bool   `cli:"dns-cache"`
 }
 
 var MetaDataSetCommand = cli.Command{
@@ -59,12 +73,24 @@ var MetaDataSetCommand = cli.Command{
 			Usage:  "Which job's build should the meta-data be set on",
 			EnvVar: "BUILDKITE_JOB_ID",
 		},
+		cli.BoolFlag{
+			Name:  "if-absent",
+			Usage: "Only set the value if the key hasn't been set yet, exiting with a status of 100 if it has",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		APIRecordPathFlag,
+		APIReplayPathFlag,
+		APIRequestSigningFlag,
+		APIRequestSigningSecretFlag,
+		APIRequestSigningRegionFlag,
+		IPFamilyFlag,
+		ProxyPACFlag,
+		DNSCacheFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -111,20 +137,39 @@ var MetaDataSetCommand = cli.Command{
 
 		// Create the meta data to set
 		metaData := &api.MetaData{
-			Key:   cfg.Key,
-			Value: cfg.Value,
+			Key:      cfg.Key,
+			Value:    cfg.Value,
+			IfAbsent: cfg.IfAbsent,
 		}
 
 		// Set the meta data
-		err = roko.NewRetrier(
-			roko.WithMaxAttempts(10),
-			roko.WithStrategy(roko.Constant(5*time.Second)),
-		).Do(func(r *roko.Retrier) error {
+		var alreadySet, failedBefore bool
+		err = retry.NewRetrier(
+			retry.WithMaxAttempts(10),
+			retry.WithStrategy(retry.Constant(5*time.Second)),
+		).Do(func(r *retry.Retrier) error {
 			resp, err := client.SetMetaData(cfg.Job, metaData)
+			if resp != nil && resp.StatusCode == 409 && cfg.IfAbsent {
+				if !failedBefore {
+					alreadySet = true
+					return nil
+				}
+
+				// An attempt that failed may still have set it, in which
+				// case it has the value we sent
+				existing, _, err := client.GetMetaData(cfg.Job, cfg.Key)
+				if err != nil {
+					l.Warn("%s (%s)", err, r)
+					return err
+				}
+				alreadySet = existing.Value != cfg.Value
+				return nil
+			}
 			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
 				r.Break()
 			}
 			if err != nil {
+				failedBefore = true
 				l.Warn("%s (%s)", err, r)
 			}
 
@@ -134,5 +179,11 @@ var MetaDataSetCommand = cli.Command{
 		if err != nil {
 			l.Fatal("Failed to set meta-data: %s", err)
 		}
+
+		// Another job got there first
+		if alreadySet {
+			l.Info("Meta-data %q has already been set, so it wasn't changed", cfg.Key)
+			os.Exit(100)
+		}
 	},
 }
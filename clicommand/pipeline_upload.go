@@ -1,9 +1,11 @@
 package clicommand
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
@@ -17,8 +19,8 @@ import (
 	"github.com/buildkite/agent/v3/cliconfig"
 	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/redaction"
+	"github.com/buildkite/agent/v3/retry"
 	"github.com/buildkite/agent/v3/stdin"
-	"github.com/buildkite/roko"
 	"github.com/urfave/cli"
 )
 
@@ -45,6 +47,10 @@ Description:
    You can also pipe build pipelines to the command allowing you to create
    scripts that generate dynamic pipelines.
 
+   Each upload is identified by a hash of the job and the pipeline, so if an
+   upload is retried, by the command itself or by running it again, the same
+   steps are never added to the build twice.
+
 Example:
 
    $ buildkite-agent pipeline upload
@@ -68,10 +74,18 @@ type PipelineUploadConfig struct {
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP               bool   `cli:"debug-http"`
+	AgentAccessToken        string `cli:"agent-access-token" validate:"required"`
+	Endpoint                string `cli:"endpoint" validate:"required"`
+	NoHTTP2                 bool   `cli:"no-http2"`
+	APIRecordPath           string `cli:"api-record-path" normalize:"filepath"`
+	APIReplayPath           string `cli:"api-replay-path" normalize:"filepath"`
+	APIRequestSigning       string `cli:"api-request-signing" validate:"oneof:hmac|aws-sigv4"`
+	APIRequestSigningSecret string `cli:"api-request-signing-secret"`
+	APIRequestSigningRegion string `cli:"api-request-signing-region"`
+	IPFamily                string `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                string `cli:"proxy-pac"`
+	DNSCache                bool   `cli:"dns-cache"`
 }
 
 var PipelineUploadCommand = cli.Command{
@@ -111,6 +125,14 @@ var PipelineUploadCommand = cli.Command{
 		EndpointFlag,
 		NoHTTP2Flag,
 		DebugHTTPFlag,
+		APIRecordPathFlag,
+		APIReplayPathFlag,
+		APIRequestSigningFlag,
+		APIRequestSigningSecretFlag,
+		APIRequestSigningRegionFlag,
+		IPFamilyFlag,
+		ProxyPACFlag,
+		DNSCacheFlag,
 
 		// Global flags
 		NoColorFlag,
@@ -297,18 +319,30 @@ var PipelineUploadCommand = cli.Command{
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
 
-		// Generate a UUID that will identify this pipeline change. We
-		// do this outside of the retry loop because we want this UUID
-		// to be the same for each attempt at updating the pipeline.
-		uuid := api.NewUUID()
+		// The UUID that identifies this pipeline change comes from the job
+		// and the pipeline, so it's the same for each attempt at updating
+		// the pipeline, even if the whole command is run again
+		serialisedPipeline, err := result.MarshalJSON()
+		if err != nil {
+			l.Fatal("Couldn't serialize the %q pipeline: %v", src, err)
+		}
+		uuid := pipelineUploadUUID(cfg.Job, serialisedPipeline, cfg.Replace)
+		l.Debug("Uploading pipeline with idempotency key %s", uuid)
 
 		// Retry the pipeline upload a few times before giving up
-		err = roko.NewRetrier(
-			roko.WithMaxAttempts(60),
-			roko.WithStrategy(roko.Constant(5*time.Second)),
-		).Do(func(r *roko.Retrier) error {
+		err = retry.NewRetrier(
+			retry.WithMaxAttempts(60),
+			retry.WithStrategy(retry.Constant(5*time.Second)),
+		).Do(func(r *retry.Retrier) error {
 			_, err = client.UploadPipeline(cfg.Job, &api.Pipeline{UUID: uuid, Pipeline: result, Replace: cfg.Replace})
 			if err != nil {
+				// An earlier attempt got through, even though we didn't
+				// hear back, so the steps are already there
+				if apierr, ok := err.(*api.ErrorResponse); ok && apierr.Response.StatusCode == http.StatusConflict {
+					l.Info("This pipeline has already been uploaded")
+					return nil
+				}
+
 				l.Warn("%s (%s)", err, r)
 
 				// 422 responses will always fail no need to retry
@@ -330,3 +364,18 @@ var PipelineUploadCommand = cli.Command{
 		l.Info("Successfully uploaded and parsed pipeline config")
 	},
 }
+
+// pipelineUploadUUID returns the UUID that identifies a pipeline upload. It's
+// a hash of the job and what's being uploaded, so that retrying the same
+// upload, even from a new process, can't add the steps twice.
+func pipelineUploadUUID(jobID string, pipeline []byte, replace bool) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%t\x00", jobID, replace)
+	h.Write(pipeline)
+	sum := h.Sum(nil)
+
+	// Format it like a name-based (version 5) UUID
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
@@ -0,0 +1,25 @@
+package clicommand
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineUploadUUID(t *testing.T) {
+	t.Parallel()
+
+	pipeline := []byte(`{"steps":[{"command":"make test"}]}`)
+	uuid := pipelineUploadUUID("job-1", pipeline, false)
+
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), uuid)
+
+	// Retrying the same upload gives the same UUID
+	assert.Equal(t, uuid, pipelineUploadUUID("job-1", pipeline, false))
+
+	// But anything else about it is a different upload
+	assert.NotEqual(t, uuid, pipelineUploadUUID("job-2", pipeline, false))
+	assert.NotEqual(t, uuid, pipelineUploadUUID("job-1", pipeline, true))
+	assert.NotEqual(t, uuid, pipelineUploadUUID("job-1", []byte(`{"steps":[{"command":"make lint"}]}`), false))
+}
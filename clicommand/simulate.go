@@ -0,0 +1,244 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var SimulateHelpDescription = `Usage:
+
+   buildkite-agent simulate [options...]
+
+Description:
+
+   Registers a fleet of simulated agents, which accept jobs and pretend to run
+   them. Instead of running the job's command, each agent writes generated log
+   output for a while, then finishes the job.
+
+   This is for load testing queues, proxies and monitoring before scaling up
+   real agents. Jobs sent to simulated agents don't really run, so make sure
+   they're tagged so that only test pipelines target them.
+
+   The simulation runs until it's interrupted, or for as long as --duration.
+
+Example:
+
+   $ buildkite-agent simulate --token xxx --agents 100 --tags "queue=load-test" \
+       --min-job-duration 30s --max-job-duration 5m --log-lines-per-second 20`
+
+type SimulateConfig struct {
+	Agents             int      `cli:"agents"`
+	Name               string   `cli:"name"`
+	Tags               []string `cli:"tags" normalize:"list"`
+	Duration           string   `cli:"duration"`
+	MinJobDuration     string   `cli:"min-job-duration"`
+	MaxJobDuration     string   `cli:"max-job-duration"`
+	LogLinesPerSecond  int      `cli:"log-lines-per-second"`
+	LogLineLength      int      `cli:"log-line-length"`
+	FailurePercent     int      `cli:"failure-percent"`
+	DisconnectAfterJob bool     `cli:"disconnect-after-job"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP               bool   `cli:"debug-http"`
+	Token                   string `cli:"token" validate:"required"`
+	Endpoint                string `cli:"endpoint" validate:"required"`
+	NoHTTP2                 bool   `cli:"no-http2"`
+	APIRecordPath           string `cli:"api-record-path" normalize:"filepath"`
+	APIReplayPath           string `cli:"api-replay-path" normalize:"filepath"`
+	APIRequestSigning       string `cli:"api-request-signing" validate:"oneof:hmac|aws-sigv4"`
+	APIRequestSigningSecret string `cli:"api-request-signing-secret"`
+	APIRequestSigningRegion string `cli:"api-request-signing-region"`
+	IPFamily                string `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                string `cli:"proxy-pac"`
+	DNSCache                bool   `cli:"dns-cache"`
+}
+
+var SimulateCommand = cli.Command{
+	Name:        "simulate",
+	Usage:       "Registers simulated agents that pretend to run jobs, for load testing",
+	Description: SimulateHelpDescription,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:   "agents",
+			Value:  10,
+			Usage:  "The number of simulated agents to register",
+			EnvVar: "BUILDKITE_SIMULATE_AGENTS",
+		},
+		cli.StringFlag{
+			Name:   "name",
+			Value:  "simulated-agent-%n",
+			Usage:  "The name of each simulated agent, where %n is replaced with its number",
+			EnvVar: "BUILDKITE_SIMULATE_NAME",
+		},
+		cli.StringSliceFlag{
+			Name:   "tags",
+			Value:  &cli.StringSlice{},
+			Usage:  "A comma-separated list of tags for the simulated agents",
+			EnvVar: "BUILDKITE_SIMULATE_TAGS",
+		},
+		cli.StringFlag{
+			Name:   "duration",
+			Value:  "",
+			Usage:  "How long to run the simulation for (for example, \"1h\"). Runs until interrupted if not set",
+			EnvVar: "BUILDKITE_SIMULATE_DURATION",
+		},
+		cli.StringFlag{
+			Name:   "min-job-duration",
+			Value:  "10s",
+			Usage:  "The shortest time a simulated job runs for",
+			EnvVar: "BUILDKITE_SIMULATE_MIN_JOB_DURATION",
+		},
+		cli.StringFlag{
+			Name:   "max-job-duration",
+			Value:  "1m",
+			Usage:  "The longest time a simulated job runs for",
+			EnvVar: "BUILDKITE_SIMULATE_MAX_JOB_DURATION",
+		},
+		cli.IntFlag{
+			Name:   "log-lines-per-second",
+			Value:  10,
+			Usage:  "How many lines of log output each simulated job writes every second",
+			EnvVar: "BUILDKITE_SIMULATE_LOG_LINES_PER_SECOND",
+		},
+		cli.IntFlag{
+			Name:   "log-line-length",
+			Value:  80,
+			Usage:  "How long each line of simulated log output is",
+			EnvVar: "BUILDKITE_SIMULATE_LOG_LINE_LENGTH",
+		},
+		cli.IntFlag{
+			Name:   "failure-percent",
+			Value:  0,
+			Usage:  "The percentage of simulated jobs that fail",
+			EnvVar: "BUILDKITE_SIMULATE_FAILURE_PERCENT",
+		},
+		cli.BoolFlag{
+			Name:   "disconnect-after-job",
+			Usage:  "Disconnect each simulated agent after it has run a job",
+			EnvVar: "BUILDKITE_SIMULATE_DISCONNECT_AFTER_JOB",
+		},
+
+		// API Flags
+		AgentRegisterTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		APIRecordPathFlag,
+		APIReplayPathFlag,
+		APIRequestSigningFlag,
+		APIRequestSigningSecretFlag,
+		APIRequestSigningRegionFlag,
+		IPFamilyFlag,
+		ProxyPACFlag,
+		DNSCacheFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := SimulateConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		if cfg.Agents < 1 {
+			l.Fatal("At least one simulated agent is needed")
+		}
+
+		if cfg.FailurePercent < 0 || cfg.FailurePercent > 100 {
+			l.Fatal("The failure percentage must be between 0 and 100")
+		}
+
+		minJobDuration, err := time.ParseDuration(cfg.MinJobDuration)
+		if err != nil {
+			l.Fatal("Failed to parse min-job-duration: %v", err)
+		}
+
+		maxJobDuration, err := time.ParseDuration(cfg.MaxJobDuration)
+		if err != nil {
+			l.Fatal("Failed to parse max-job-duration: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		if cfg.Duration != "" {
+			duration, err := time.ParseDuration(cfg.Duration)
+			if err != nil {
+				l.Fatal("Failed to parse duration: %v", err)
+			}
+			ctx, cancel = context.WithTimeout(ctx, duration)
+			defer cancel()
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+
+		go func() {
+			sig := <-signals
+			l.Info("Received %v, stopping the simulation...", sig)
+			cancel()
+		}()
+
+		client := api.NewClient(l, loadAPIClientConfig(cfg, `Token`))
+
+		simulator := agent.NewSimulator(l, client, agent.SimulatorConfig{
+			Agents:             cfg.Agents,
+			Name:               cfg.Name,
+			Tags:               cfg.Tags,
+			MinJobDuration:     minJobDuration,
+			MaxJobDuration:     maxJobDuration,
+			LogLinesPerSecond:  cfg.LogLinesPerSecond,
+			LogLineLength:      cfg.LogLineLength,
+			FailureRate:        float64(cfg.FailurePercent) / 100,
+			DisconnectAfterJob: cfg.DisconnectAfterJob,
+		})
+
+		l.Info("Starting %d simulated agents", cfg.Agents)
+
+		err = simulator.Run(ctx)
+
+		l.Info("Simulation finished: %s", simulator.Stats())
+
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+	},
+}
@@ -0,0 +1,299 @@
+package clicommand
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retry"
+	"github.com/buildkite/agent/v3/stdin"
+	"github.com/urfave/cli"
+)
+
+var SplitHelpDescription = `Usage:
+
+   buildkite-agent split [files...] [options...]
+
+Description:
+
+   Splits a list of test files between the parallel jobs of a step, and prints
+   the ones the current job should run, one per line.
+
+   Files are given as arguments, or piped in one per line. They're balanced
+   using how long each one took to run before, so that every job finishes at
+   around the same time. Every job in the step gets the same split, as long as
+   they're given the same files and timings.
+
+   Timings are a JSON object of file paths to the number of seconds they took,
+   and can be read from a file, build meta-data or an artifact. Files without
+   timings are assumed to take the average time of the others.
+
+Example:
+
+   $ buildkite-agent split spec/**/*_spec.rb --timings-meta-data-key "rspec-timings"
+   $ find test -name '*_test.py' | buildkite-agent split --timings tmp/timings.json
+   $ buildkite-agent split $(ls tests) --timings-artifact "timings.json" --build "$PREVIOUS_BUILD_ID"`
+
+type SplitConfig struct {
+	Timings            string `cli:"timings" normalize:"filepath"`
+	TimingsMetaDataKey string `cli:"timings-meta-data-key"`
+	TimingsArtifact    string `cli:"timings-artifact"`
+	Build              string `cli:"build"`
+	Job                string `cli:"job"`
+	ParallelJob        int    `cli:"parallel-job"`
+	ParallelJobCount   int    `cli:"parallel-job-count"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP               bool   `cli:"debug-http"`
+	AgentAccessToken        string `cli:"agent-access-token"`
+	Endpoint                string `cli:"endpoint" validate:"required"`
+	NoHTTP2                 bool   `cli:"no-http2"`
+	APIRecordPath           string `cli:"api-record-path" normalize:"filepath"`
+	APIReplayPath           string `cli:"api-replay-path" normalize:"filepath"`
+	APIRequestSigning       string `cli:"api-request-signing" validate:"oneof:hmac|aws-sigv4"`
+	APIRequestSigningSecret string `cli:"api-request-signing-secret"`
+	APIRequestSigningRegion string `cli:"api-request-signing-region"`
+	IPFamily                string `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                string `cli:"proxy-pac"`
+	DNSCache                bool   `cli:"dns-cache"`
+}
+
+var SplitCommand = cli.Command{
+	Name:        "split",
+	Usage:       "Splits test files between parallel jobs using their timings",
+	Description: SplitHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "timings",
+			Value: "",
+			Usage: "A file with the timings of each test file",
+		},
+		cli.StringFlag{
+			Name:  "timings-meta-data-key",
+			Value: "",
+			Usage: "The build meta-data key to read timings from",
+		},
+		cli.StringFlag{
+			Name:  "timings-artifact",
+			Value: "",
+			Usage: "The path of an artifact to read timings from",
+		},
+		cli.StringFlag{
+			Name:   "build",
+			Value:  "",
+			EnvVar: "BUILDKITE_BUILD_ID",
+			Usage:  "The build that the timings artifact was uploaded to",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job's build the timings meta-data should be read from",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+		cli.IntFlag{
+			Name:   "parallel-job",
+			Value:  0,
+			Usage:  "The index of this parallel job, starting from 0",
+			EnvVar: "BUILDKITE_PARALLEL_JOB",
+		},
+		cli.IntFlag{
+			Name:   "parallel-job-count",
+			Value:  1,
+			Usage:  "The number of parallel jobs to split the files between",
+			EnvVar: "BUILDKITE_PARALLEL_JOB_COUNT",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		APIRecordPathFlag,
+		APIReplayPathFlag,
+		APIRequestSigningFlag,
+		APIRequestSigningSecretFlag,
+		APIRequestSigningRegionFlag,
+		IPFamilyFlag,
+		ProxyPACFlag,
+		DNSCacheFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := SplitConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		files := []string(c.Args())
+		if len(files) == 0 && stdin.IsReadable() {
+			l.Info("Reading test files from STDIN")
+
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				if file := strings.TrimSpace(scanner.Text()); file != "" {
+					files = append(files, file)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				l.Fatal("Failed to read test files from STDIN: %s", err)
+			}
+		}
+
+		if len(files) == 0 {
+			l.Fatal("No test files were given to split")
+		}
+
+		timings, err := loadSplitTimings(l, cfg)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		if len(timings) == 0 {
+			l.Warn("No test timings were found, so files will be split evenly by count")
+		}
+
+		split, err := agent.SplitTests(files, timings, timings.Average(), cfg.ParallelJob, cfg.ParallelJobCount)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		l.Debug("Parallel job %d of %d will run %d of %d test files", cfg.ParallelJob+1, cfg.ParallelJobCount, len(split), len(files))
+
+		for _, file := range split {
+			fmt.Println(file)
+		}
+	},
+}
+
+// loadSplitTimings reads the timing data from wherever the options say it is,
+// if anywhere
+func loadSplitTimings(l logger.Logger, cfg SplitConfig) (agent.TestTimings, error) {
+	switch {
+	case cfg.Timings != "":
+		data, err := ioutil.ReadFile(cfg.Timings)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read test timings: %v", err)
+		}
+		return agent.ParseTestTimings(data)
+
+	case cfg.TimingsMetaDataKey != "":
+		if cfg.AgentAccessToken == "" || cfg.Job == "" {
+			return nil, fmt.Errorf("An agent access token and job are needed to read timings from meta-data")
+		}
+
+		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		var metaData *api.MetaData
+		var resp *api.Response
+		err := retry.NewRetrier(
+			retry.WithMaxAttempts(10),
+			retry.WithStrategy(retry.Constant(5*time.Second)),
+		).Do(func(r *retry.Retrier) error {
+			var err error
+			metaData, resp, err = client.GetMetaData(cfg.Job, cfg.TimingsMetaDataKey)
+			// Don't bother retrying if the response was one of these statuses
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+				r.Break()
+				return err
+			}
+			if err != nil {
+				l.Warn("%s (%s)", err, r)
+			}
+			return err
+		})
+
+		// Missing timings shouldn't stop the tests from running, there just
+		// won't be any the first time
+		if resp != nil && resp.StatusCode == 404 {
+			l.Warn("No meta-data exists with key `%s`", cfg.TimingsMetaDataKey)
+			return agent.TestTimings{}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get test timings from meta-data: %v", err)
+		}
+
+		return agent.ParseTestTimings([]byte(metaData.Value))
+
+	case cfg.TimingsArtifact != "":
+		if cfg.AgentAccessToken == "" || cfg.Build == "" {
+			return nil, fmt.Errorf("An agent access token and build are needed to read timings from an artifact")
+		}
+
+		dir, err := ioutil.TempDir("", "buildkite-split")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+		downloader := agent.NewArtifactDownloader(l, client, agent.ArtifactDownloaderConfig{
+			Query:       cfg.TimingsArtifact,
+			Destination: dir,
+			BuildID:     cfg.Build,
+			DebugHTTP:   cfg.DebugHTTP,
+			Transfers:   agent.TransferSchedulerFromEnv(),
+		})
+
+		if err := downloader.Download(); err != nil {
+			l.Warn("Failed to download test timings artifact: %s", err)
+			return agent.TestTimings{}, nil
+		}
+
+		var path string
+		_ = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err == nil && path == "" && info.Mode().IsRegular() {
+				path = p
+			}
+			return nil
+		})
+		if path == "" {
+			l.Warn("No artifact matched `%s`", cfg.TimingsArtifact)
+			return agent.TestTimings{}, nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read test timings: %v", err)
+		}
+		return agent.ParseTestTimings(data)
+	}
+
+	return agent.TestTimings{}, nil
+}
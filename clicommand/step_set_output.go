@@ -0,0 +1,172 @@
+package clicommand
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/retry"
+	"github.com/urfave/cli"
+)
+
+var StepSetOutputHelpDescription = `Usage:
+
+   buildkite-agent step set-output <name>[=<value>] [options...]
+
+Description:
+
+   Set an output of the current step, for the steps that depend on it to use.
+
+   Jobs that start after the output is set have it in their environment as
+   BUILDKITE_OUTPUT_<step key>_<name>, upper-cased, with anything that isn't
+   a letter or number replaced with an underscore. Only steps with a key can
+   set outputs, and output names can only have letters, numbers, - and _.
+
+   Outputs are stored in the build's meta-data. If more than one job of the
+   step sets the same output, the last one to set it wins.
+
+   You can supply the value after an equals sign, or pipe in a file or script
+   output.
+
+Example:
+
+   $ buildkite-agent step set-output "image=registry.example.com/app:$BUILDKITE_COMMIT"
+   $ buildkite-agent step set-output "version" < ./VERSION
+
+   # In a step that depends on the "build" step
+   $ docker run "$BUILDKITE_OUTPUT_BUILD_IMAGE"`
+
+type StepSetOutputConfig struct {
+	Output string `cli:"arg:0" label:"output" validate:"required"`
+	Job    string `cli:"job" validate:"required"`
+	Step   string `cli:"step"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+
+	// API config
+	DebugHTTP               bool   `cli:"debug-http"`
+	AgentAccessToken        string `cli:"agent-access-token" validate:"required"`
+	Endpoint                string `cli:"endpoint" validate:"required"`
+	NoHTTP2                 bool   `cli:"no-http2"`
+	APIRecordPath           string `cli:"api-record-path" normalize:"filepath"`
+	APIReplayPath           string `cli:"api-replay-path" normalize:"filepath"`
+	APIRequestSigning       string `cli:"api-request-signing" validate:"oneof:hmac|aws-sigv4"`
+	APIRequestSigningSecret string `cli:"api-request-signing-secret"`
+	APIRequestSigningRegion string `cli:"api-request-signing-region"`
+	IPFamily                string `cli:"ip-family" validate:"oneof:ipv4|ipv6"`
+	ProxyPAC                string `cli:"proxy-pac"`
+	DNSCache                bool   `cli:"dns-cache"`
+}
+
+var StepSetOutputCommand = cli.Command{
+	Name:        "set-output",
+	Usage:       "Set an output of the step for the steps that depend on it",
+	Description: StepSetOutputHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job's build the output should be set on",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+		cli.StringFlag{
+			Name:   "step",
+			Value:  "",
+			Usage:  "The key of the step the output is from",
+			EnvVar: "BUILDKITE_STEP_KEY",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DebugHTTPFlag,
+		APIRecordPathFlag,
+		APIReplayPathFlag,
+		APIRequestSigningFlag,
+		APIRequestSigningSecretFlag,
+		APIRequestSigningRegionFlag,
+		IPFamilyFlag,
+		ProxyPACFlag,
+		DNSCacheFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := StepSetOutputConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		// Read the value from STDIN if it wasn't given after the name
+		name, value, hasValue := strings.Cut(cfg.Output, "=")
+		if !hasValue {
+			l.Info("Reading the output's value from STDIN")
+
+			input, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				l.Fatal("Failed to read from STDIN: %s", err)
+			}
+			value = string(input)
+		}
+
+		key, err := agent.StepOutputMetaDataKey(cfg.Step, name)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Create the API client
+		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		// Set the output as meta-data
+		err = retry.NewRetrier(
+			retry.WithMaxAttempts(10),
+			retry.WithStrategy(retry.Constant(5*time.Second)),
+		).Do(func(r *retry.Retrier) error {
+			resp, err := client.SetMetaData(cfg.Job, &api.MetaData{Key: key, Value: value})
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+				r.Break()
+			}
+			if err != nil {
+				l.Warn("%s (%s)", err, r)
+			}
+
+			return err
+		})
+
+		if err != nil {
+			l.Fatal("Failed to set step output: %s", err)
+		}
+	},
+}
@@ -0,0 +1,120 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var ToolInstallHelpDescription = `Usage:
+
+   buildkite-agent tool install <name>@<version> [options...]
+
+Description:
+
+   Installs a tool that a hook or command depends on into the agent's tool
+   cache, and prints its path.
+
+   Tools are downloaded from the mirrors the agent is configured with, and are
+   only installed if they match their SHA-256 checksum, which comes from the
+   agent's tool checksums file or from --sha256. Installed tools are kept by
+   their checksum, so once a tool is installed it isn't downloaded again.
+
+Example:
+
+   $ shellcheck="$(buildkite-agent tool install shellcheck@0.8.0)"
+   $ "$shellcheck" scripts/*.sh`
+
+type ToolInstallConfig struct {
+	Tool          string   `cli:"arg:0" label:"tool" validate:"required"`
+	SHA256        string   `cli:"sha256"`
+	ToolsPath     string   `cli:"tools-path" normalize:"filepath" validate:"required"`
+	ToolMirrors   []string `cli:"tool-mirrors" normalize:"list"`
+	ToolChecksums string   `cli:"tool-checksums" normalize:"filepath"`
+
+	// Global flags
+	Debug    bool   `cli:"debug"`
+	LogLevel string `cli:"log-level"`
+	NoColor  bool   `cli:"no-color"`
+}
+
+var ToolInstallCommand = cli.Command{
+	Name:        "install",
+	Usage:       "Install a tool into the agent's tool cache and print its path",
+	Description: ToolInstallHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "sha256",
+			Value: "",
+			Usage: "The SHA-256 checksum the tool must match, instead of the one in the agent's tool checksums file",
+		},
+		cli.StringFlag{
+			Name:   "tools-path",
+			Value:  "",
+			Usage:  "Directory where installed tools are kept",
+			EnvVar: "BUILDKITE_TOOLS_PATH",
+		},
+		cli.StringSliceFlag{
+			Name:   "tool-mirrors",
+			Value:  &cli.StringSlice{},
+			Usage:  "A comma-separated list of URLs to download tools from, tried in order",
+			EnvVar: "BUILDKITE_TOOL_MIRRORS",
+		},
+		cli.StringFlag{
+			Name:   "tool-checksums",
+			Value:  "",
+			Usage:  "A file of the SHA-256 checksums of the tools that can be installed",
+			EnvVar: "BUILDKITE_TOOL_CHECKSUMS",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := ToolInstallConfig{}
+
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		tool, err := agent.ParseToolSpec(cfg.Tool)
+		if err != nil {
+			l.Fatal("%v", err)
+		}
+
+		installer := agent.NewToolInstaller(l, agent.ToolInstallerConfig{
+			CachePath:     cfg.ToolsPath,
+			Mirrors:       cfg.ToolMirrors,
+			ChecksumsPath: cfg.ToolChecksums,
+		})
+
+		path, err := installer.Install(context.Background(), tool, cfg.SHA256)
+		if err != nil {
+			l.Fatal("Failed to install %s: %v", tool, err)
+		}
+
+		// The path is all that goes to stdout, so hooks can capture it
+		fmt.Println(path)
+	},
+}
@@ -0,0 +1,65 @@
+package cliconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+// expandEnv replaces ${VAR} in a config file value with the value of the
+// environment variable, or nothing if it isn't set, unless strict is true.
+// $$ is a literal $, and any other $, like in $VAR, is left as it is, so
+// values written before expansion was added keep their meaning.
+func expandEnv(value string, lookup func(string) (string, bool), strict bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+
+		switch value[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+			continue
+		case '{':
+		default:
+			b.WriteByte('$')
+			continue
+		}
+
+		end := strings.IndexByte(value[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("has an unterminated ${ in %q", value)
+		}
+		name := value[i+2 : i+end]
+		if !isEnvName(name) {
+			return "", fmt.Errorf("has an invalid environment variable name %q", name)
+		}
+		i += end
+
+		envValue, ok := lookup(name)
+		if !ok && strict {
+			return "", fmt.Errorf("refers to the environment variable ${%s}, which isn't set", name)
+		}
+		b.WriteString(envValue)
+	}
+
+	return b.String(), nil
+}
+
+func isEnvNameStart(c byte) bool {
+	return c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func isEnvName(name string) bool {
+	if name == "" || !isEnvNameStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if c := name[i]; !isEnvNameStart(c) && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package cliconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandEnv(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		value, ok := map[string]string{
+			"TOKEN": "abc123",
+			"HOME":  "/home/buildkite",
+			"EMPTY": "",
+		}[name]
+		return value, ok
+	}
+
+	for _, tc := range []struct {
+		value string
+		want  string
+	}{
+		{"${TOKEN}", "abc123"},
+		{"${HOME}/builds", "/home/buildkite/builds"},
+		{"x${EMPTY}y", "xy"},
+		{"x${MISSING}y", "xy"},
+		{"$HOME/builds", "$HOME/builds"},
+		{"pa$word", "pa$word"},
+		{"$$TOKEN", "$TOKEN"},
+		{"$${HOME}", "${HOME}"},
+		{"100$", "100$"},
+		{"$1 and $-", "$1 and $-"},
+		{"no variables", "no variables"},
+	} {
+		got, err := expandEnv(tc.value, lookup, false)
+		assert.NoError(t, err, tc.value)
+		assert.Equal(t, tc.want, got, tc.value)
+	}
+
+	for _, tc := range []struct {
+		value  string
+		strict bool
+		err    string
+	}{
+		{"${MISSING}", true, "refers to the environment variable ${MISSING}, which isn't set"},
+		{"${HOME", false, `has an unterminated ${ in "${HOME"`},
+		{"${HO-ME}", false, `has an invalid environment variable name "HO-ME"`},
+	} {
+		_, err := expandEnv(tc.value, lookup, tc.strict)
+		assert.EqualError(t, err, tc.err, tc.value)
+	}
+}
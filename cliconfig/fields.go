@@ -0,0 +1,92 @@
+package cliconfig
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Field is an option of a command's config struct. Options can be grouped in
+// structs nested in the config, like an S3Config embedded in it.
+type Field struct {
+	reflect.StructField
+
+	// A pointer to the struct the field is in
+	Struct interface{}
+
+	// What's put in front of the field's cli name, from the cli tags of the
+	// structs it's nested in, like "s3-"
+	Prefix string
+}
+
+// CLIName returns the field's option name, with the prefix of the structs
+// it's nested in, or an empty string if it isn't an option. Positional
+// arguments don't have a prefix.
+func (f Field) CLIName() string {
+	name := f.Tag.Get("cli")
+	if name == "" || argCliNameRegexp.MatchString(name) {
+		return name
+	}
+	return f.Prefix + name
+}
+
+// Default returns the value of the field's default tag, converted to the
+// field's type like a config file value is, and whether it has one
+func (f Field) Default() (interface{}, bool, error) {
+	def, ok := f.Tag.Lookup("default")
+	if !ok {
+		return nil, false, nil
+	}
+
+	var value interface{}
+	var err error
+	if f.Type.String() == durationType {
+		value, err = parseDuration(def)
+	} else {
+		value, err = convertConfigFileValue(def, f.Type.Kind())
+	}
+	if err != nil {
+		name := f.CLIName()
+		if name == "" {
+			name = f.Name
+		}
+		return nil, true, fmt.Errorf("The default of the config option `%s` %v", name, err)
+	}
+
+	return value, true, nil
+}
+
+// Fields returns the exported fields of a config struct, which has to be
+// given as a pointer, recursing into the structs nested in it. A nested
+// struct with a cli tag prefixes its options with it and a dash, and one
+// without a tag adds its options as they are. Like unexported fields,
+// embedded structs of unexported types are skipped.
+func Fields(config interface{}) []Field {
+	return structFields(reflect.ValueOf(config), "")
+}
+
+func structFields(ptr reflect.Value, prefix string) []Field {
+	v := ptr.Elem()
+	t := v.Type()
+
+	var fields []Field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if f.Type.Kind() == reflect.Struct {
+			nested := prefix
+			if name := f.Tag.Get("cli"); name != "" {
+				nested += strings.TrimSuffix(name, "-") + "-"
+			}
+			fields = append(fields, structFields(v.Field(i).Addr(), nested)...)
+			continue
+		}
+
+		fields = append(fields, Field{StructField: f, Struct: ptr.Interface(), Prefix: prefix})
+	}
+
+	return fields
+}
@@ -2,8 +2,11 @@ package cliconfig
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/buildkite/agent/v3/utils"
@@ -13,13 +16,35 @@ type File struct {
 	// The path to the file
 	Path string
 
+	// The name of the profile to load from the file. Keys outside of any
+	// profile section are always loaded, and profile keys override them.
+	Profile string
+
+	// What decrypts the file if it's encrypted: a file of age identities
+	// for files encrypted with age, or the AWS KMS key for files ending in
+	// .kms, which is optional for symmetric keys
+	Identity string
+
 	// A map of key/values that was loaded from the file
 	Config map[string]string
+
+	// The profile sections defined in the file, and their key/values
+	Profiles map[string]map[string]string
+
+	// The profile each profile inherits from, if any
+	profileParents map[string]string
+
+	// For files merged from several, the file each key of the config and
+	// of each profile was set in
+	keyPaths        map[string]string
+	profileKeyPaths map[string]map[string]string
 }
 
 func (f *File) Load() error {
 	// Set the default config
 	f.Config = map[string]string{}
+	f.Profiles = map[string]map[string]string{}
+	f.profileParents = map[string]string{}
 
 	// Figure out the absolute path
 	absolutePath, err := f.AbsolutePath()
@@ -27,37 +52,230 @@ func (f *File) Load() error {
 		return err
 	}
 
-	// Open the file
-	file, err := os.Open(absolutePath)
+	// Read the whole file, it's parsed according to its format
+	data, err := os.ReadFile(absolutePath)
+	if err != nil {
+		return err
+	}
+
+	// Encrypted files are decrypted in memory, and are in the format of
+	// their name without the .age or .kms
+	data, formatPath, err := f.decrypt(data, absolutePath)
+	if err != nil {
+		return err
+	}
+
+	switch fileFormat(formatPath) {
+	case formatYAML:
+		err = f.loadYAML(data)
+	case formatTOML:
+		err = f.loadTOML(data)
+	case formatJSON:
+		err = f.loadJSON(data)
+	default:
+		err = f.loadKeyValue(data)
+	}
 	if err != nil {
 		return err
 	}
 
-	// Make sure the config file is closed when this function finishes
-	defer file.Close()
+	if f.Profile != "" {
+		return f.applyProfile(f.Profile)
+	}
+
+	return nil
+}
+
+// The formats config files can be written in
+const (
+	formatKeyValue = "key=value"
+	formatYAML     = "yaml"
+	formatTOML     = "toml"
+	formatJSON     = "json"
+)
+
+// decrypt returns the contents of the config file decrypted if it's
+// encrypted, and the path to tell its format from
+func (f *File) decrypt(data []byte, path string) ([]byte, string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	switch {
+	case ext == ".kms":
+		plaintext, err := decryptKMS(data, f.Identity)
+		if err != nil {
+			return nil, "", fmt.Errorf("The config file %s couldn't be decrypted with AWS KMS: %v", f.Path, err)
+		}
+		return plaintext, strings.TrimSuffix(path, filepath.Ext(path)), nil
+
+	case ext == ".age" || isAgeEncrypted(data):
+		if f.Identity == "" {
+			return nil, "", fmt.Errorf("The config file %s is encrypted with age, so it needs --config-identity to decrypt it", f.Path)
+		}
+		plaintext, err := decryptAge(data, f.Identity)
+		if err != nil {
+			return nil, "", fmt.Errorf("The config file %s couldn't be decrypted with age: %v", f.Path, err)
+		}
+		if ext == ".age" {
+			path = strings.TrimSuffix(path, filepath.Ext(path))
+		}
+		return plaintext, path, nil
+	}
+
+	return data, path, nil
+}
+
+// fileFormat returns the format of a config file, from its extension
+func fileFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	case ".json":
+		return formatJSON
+	default:
+		return formatKeyValue
+	}
+}
 
+// loadKeyValue loads a config file of key=value lines, with profile sections
+func (f *File) loadKeyValue(data []byte) error {
 	// Get all the lines in the file
 	var lines []string
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	for scanner.Scan() {
 		lines = append(lines, scanner.Text())
 	}
 
-	// Parse each line
+	// Parse each line, keys before the first profile section go into the
+	// base config
+	section := f.Config
 	for _, fullLine := range lines {
-		if !isIgnoredLine(fullLine) {
-			key, value, err := parseLine(fullLine)
-			if err != nil {
-				return err
+		if isIgnoredLine(fullLine) {
+			continue
+		}
+
+		if name, parent, ok := parseProfileHeader(fullLine); ok {
+			if _, exists := f.Profiles[name]; exists {
+				return fmt.Errorf("Profile %q is defined more than once", name)
+			}
+			section = map[string]string{}
+			f.Profiles[name] = section
+			if parent != "" {
+				f.profileParents[name] = parent
+			}
+			continue
+		}
+
+		key, value, err := parseLine(fullLine)
+		if err != nil {
+			return err
+		}
+
+		section[key] = value
+	}
+
+	return nil
+}
+
+// applyProfile merges the named profile, and any profiles it inherits from,
+// over the base config
+func (f *File) applyProfile(name string) error {
+	var chain []string
+	seen := map[string]bool{}
+
+	for profile := name; profile != ""; profile = f.profileParents[profile] {
+		if _, ok := f.Profiles[profile]; !ok {
+			if profile == name {
+				return fmt.Errorf("Profile %q isn't defined in %s", profile, f.Path)
 			}
+			return fmt.Errorf("Profile %q inherits from %q, which isn't defined in %s", chain[len(chain)-1], profile, f.Path)
+		}
+		if seen[profile] {
+			return fmt.Errorf("Profile %q has an inheritance cycle", name)
+		}
+		seen[profile] = true
+		chain = append(chain, profile)
+	}
 
+	// Apply the most distant ancestor first, so closer profiles win
+	for i := len(chain) - 1; i >= 0; i-- {
+		for key, value := range f.Profiles[chain[i]] {
 			f.Config[key] = value
+			if path, ok := f.profileKeyPaths[chain[i]][key]; ok {
+				f.keyPaths[key] = path
+			}
 		}
 	}
 
 	return nil
 }
 
+// mergeFiles merges loaded config files in order. Keys in later files
+// override the same keys in earlier ones, and profile sections with the same
+// name are merged key by key the same way. The profile is then applied to the
+// result.
+func mergeFiles(files []*File, profile string) (*File, error) {
+	merged := &File{
+		Profile:         profile,
+		Config:          map[string]string{},
+		Profiles:        map[string]map[string]string{},
+		profileParents:  map[string]string{},
+		keyPaths:        map[string]string{},
+		profileKeyPaths: map[string]map[string]string{},
+	}
+
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path)
+
+		for key, value := range f.Config {
+			merged.Config[key] = value
+			merged.keyPaths[key] = f.Path
+		}
+
+		for name, section := range f.Profiles {
+			if _, ok := merged.Profiles[name]; !ok {
+				merged.Profiles[name] = map[string]string{}
+				merged.profileKeyPaths[name] = map[string]string{}
+			}
+			for key, value := range section {
+				merged.Profiles[name][key] = value
+				merged.profileKeyPaths[name][key] = f.Path
+			}
+		}
+
+		for name, parent := range f.profileParents {
+			merged.profileParents[name] = parent
+		}
+	}
+
+	// A comma-separated list, the way they're given to --config
+	merged.Path = strings.Join(paths, ",")
+
+	if profile != "" {
+		if err := merged.applyProfile(profile); err != nil {
+			return nil, err
+		}
+	}
+
+	return merged, nil
+}
+
+// PathOf returns the path to the file that the key was set in, which is one
+// of the files merged together if there were several
+func (f File) PathOf(key string) string {
+	if path, ok := f.keyPaths[key]; ok {
+		return path
+	}
+	for _, keys := range f.profileKeyPaths {
+		if path, ok := keys[key]; ok {
+			return path
+		}
+	}
+	return f.Path
+}
+
 func (f File) AbsolutePath() (string, error) {
 	return utils.NormalizeFilePath(f.Path)
 }
@@ -150,6 +368,22 @@ func parseLine(line string) (key string, value string, err error) {
 	return
 }
 
+// parseProfileHeader parses a profile section header, either `[name]` or
+// `[name : parent]` for a profile that inherits from another
+func parseProfileHeader(line string) (name string, parent string, ok bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+		return "", "", false
+	}
+
+	name = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "["), "]"))
+	if n, p, found := strings.Cut(name, ":"); found {
+		name, parent = strings.TrimSpace(n), strings.TrimSpace(p)
+	}
+
+	return name, parent, name != ""
+}
+
 func isIgnoredLine(line string) bool {
 	trimmedLine := strings.Trim(line, " \n\t")
 	return len(trimmedLine) == 0 || strings.HasPrefix(trimmedLine, "#")
@@ -0,0 +1,77 @@
+package cliconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/buildkite/agent/v3/utils"
+)
+
+// Config files can be encrypted with age (https://age-encryption.org), like
+// with:
+//
+//	age --encrypt --recipient age1... --output agent.cfg.age agent.cfg
+//
+// and are decrypted in memory with a file of the matching identities, like
+// the ones age-keygen writes.
+
+// ageVersionLine starts every age file that isn't armored
+const ageVersionLine = "age-encryption.org/v1"
+
+// isAgeEncrypted returns whether a config file is encrypted with age
+func isAgeEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageVersionLine+"\n")) ||
+		bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(armor.Header))
+}
+
+// decryptAge decrypts an age file, armored or not, with the identities in the
+// identity file
+func decryptAge(data []byte, identityPath string) ([]byte, error) {
+	identities, err := loadAgeIdentities(identityPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var src io.Reader = bytes.NewReader(data)
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); bytes.HasPrefix(trimmed, []byte(armor.Header)) {
+		src = armor.NewReader(bytes.NewReader(trimmed))
+	}
+
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, fmt.Errorf("None of the identities in %s can decrypt it", identityPath)
+		}
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+// loadAgeIdentities reads the identities from an identity file, which has one
+// AGE-SECRET-KEY-1... per line, and comments starting with #
+func loadAgeIdentities(path string) ([]age.Identity, error) {
+	absolutePath, err := utils.NormalizeFilePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(absolutePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a file of age identities: %v", path, err)
+	}
+
+	return identities, nil
+}
@@ -0,0 +1,111 @@
+package cliconfig
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The age fixtures were encrypted with the age CLI, to the identity in
+// age-identity.txt
+func ageFixture(name string) string {
+	return filepath.Join("..", "test", "fixtures", "config", name)
+}
+
+func TestFileLoadAgeEncrypted(t *testing.T) {
+	file := File{
+		Path:     ageFixture("buildkite-agent.cfg.age"),
+		Profile:  "linux",
+		Identity: ageFixture("age-identity.txt"),
+	}
+	require.NoError(t, file.Load())
+
+	assert.Equal(t, map[string]string{
+		"token":      "base-token",
+		"tags":       "queue=linux,os=linux",
+		"build-path": "/var/lib/buildkite/builds",
+	}, file.Config)
+
+	// The format comes from the name without the .age
+	file = File{
+		Path:     ageFixture("buildkite-agent.yaml.age"),
+		Identity: ageFixture("age-identity.txt"),
+	}
+	require.NoError(t, file.Load())
+	assert.Equal(t, "queue=default,os=linux", file.Config["tags"])
+
+	// Armored files are decrypted too, even without the .age
+	file = File{
+		Path:     ageFixture("buildkite-agent-armored.cfg"),
+		Identity: ageFixture("age-identity.txt"),
+	}
+	require.NoError(t, file.Load())
+	assert.Equal(t, "base-token", file.Config["token"])
+}
+
+func TestFileLoadAgeEncryptedErrors(t *testing.T) {
+	path := ageFixture("buildkite-agent.cfg.age")
+	err := (&File{Path: path}).Load()
+	assert.EqualError(t, err, fmt.Sprintf("The config file %s is encrypted with age, so it needs --config-identity to decrypt it", path))
+
+	otherPath := ageFixture("other-age-identity.txt")
+	err = (&File{Path: path, Identity: otherPath}).Load()
+	assert.EqualError(t, err, fmt.Sprintf("The config file %s couldn't be decrypted with age: None of the identities in %s can decrypt it", path, otherPath))
+
+	notIdentityPath := writeConfigFileNamed(t, "not-a-key.txt", "token=llamas\n")
+	err = (&File{Path: path, Identity: notIdentityPath}).Load()
+	assert.ErrorContains(t, err, fmt.Sprintf("The config file %s couldn't be decrypted with age: %s isn't a file of age identities", path, notIdentityPath))
+
+	encrypted, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	identityPath := ageFixture("age-identity.txt")
+	for name, tampered := range map[string][]byte{
+		"payload":   append(append([]byte{}, encrypted[:len(encrypted)-1]...), encrypted[len(encrypted)-1]^1),
+		"truncated": encrypted[:len(encrypted)-10],
+		"header":    bytes.Replace(encrypted, []byte(ageVersionLine+"\n"), []byte(ageVersionLine+"\n-> X25519 AAAA\n\n"), 1),
+	} {
+		path := writeConfigFileNamed(t, "buildkite-agent.cfg.age", string(tampered))
+		assert.Error(t, (&File{Path: path, Identity: identityPath}).Load(), name)
+	}
+}
+
+func TestFileLoadKMSEncrypted(t *testing.T) {
+	defer func(original func(string, string, []byte) ([]byte, error)) { kmsDecrypt = original }(kmsDecrypt)
+
+	var region, keyID string
+	kmsDecrypt = func(r string, k string, ciphertext []byte) ([]byte, error) {
+		region, keyID = r, k
+		if string(ciphertext) != "encrypted" {
+			return nil, fmt.Errorf("unexpected ciphertext %q", ciphertext)
+		}
+		return []byte(yamlConfig), nil
+	}
+
+	// The ciphertext can be base64 encoded, the way the AWS CLI outputs it
+	path := writeConfigFileNamed(t, "buildkite-agent.yml.kms", base64.StdEncoding.EncodeToString([]byte("encrypted"))+"\n")
+	file := File{Path: path, Identity: "arn:aws:kms:ap-southeast-2:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"}
+	require.NoError(t, file.Load())
+
+	assert.Equal(t, "queue=default,os=linux", file.Config["tags"])
+	assert.Equal(t, "ap-southeast-2", region)
+	assert.Equal(t, file.Identity, keyID)
+
+	// Or not, and the key's optional
+	file = File{Path: writeConfigFileNamed(t, "buildkite-agent.yml.kms", "encrypted")}
+	require.NoError(t, file.Load())
+	assert.Equal(t, "", region)
+	assert.Equal(t, "", keyID)
+
+	kmsDecrypt = func(string, string, []byte) ([]byte, error) {
+		return nil, fmt.Errorf("AccessDeniedException: not allowed")
+	}
+	err := (&File{Path: path}).Load()
+	assert.EqualError(t, err, fmt.Sprintf("The config file %s couldn't be decrypted with AWS KMS: AccessDeniedException: not allowed", path))
+}
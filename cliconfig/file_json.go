@@ -0,0 +1,22 @@
+package cliconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// loadJSON loads a JSON config file, see loadNested
+func (f *File) loadJSON(data []byte) error {
+	var doc map[string]interface{}
+
+	// Numbers are kept as they're written, rather than becoming floats
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("Failed to parse %s as JSON: %v", f.Path, err)
+	}
+
+	items, _ := nestedItems(doc)
+	return f.loadNested(items)
+}
@@ -0,0 +1,64 @@
+package cliconfig
+
+import (
+	"bytes"
+	"encoding/base64"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// Config files can be encrypted with an AWS KMS key, like with:
+//
+//	aws kms encrypt --key-id alias/agent-config --plaintext fileb://agent.cfg \
+//	  --query CiphertextBlob --output text > agent.cfg.kms
+//
+// The ciphertext can be base64 encoded or not. KMS limits what it encrypts to
+// 4 KiB, which is plenty for a config file.
+
+// kmsDecrypt decrypts a ciphertext with KMS, in the region if there is one. It
+// can be replaced in tests.
+var kmsDecrypt = func(region string, keyID string, ciphertext []byte) ([]byte, error) {
+	config := aws.NewConfig()
+	if region != "" {
+		config = config.WithRegion(region)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	input := &kms.DecryptInput{CiphertextBlob: ciphertext}
+	if keyID != "" {
+		input.KeyId = aws.String(keyID)
+	}
+
+	output, err := kms.New(sess).Decrypt(input)
+	if err != nil {
+		return nil, err
+	}
+
+	return output.Plaintext, nil
+}
+
+// decryptKMS decrypts a config file encrypted with an AWS KMS key. The key
+// can be given as its ID, alias or ARN, and it's in the ARN's region if it's
+// an ARN. Otherwise the region comes from the environment or the AWS config.
+func decryptKMS(data []byte, keyID string) ([]byte, error) {
+	if decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data))); err == nil {
+		data = decoded
+	}
+
+	var region string
+	if parsed, err := arn.Parse(keyID); err == nil && parsed.Region != "" {
+		region = parsed.Region
+	}
+
+	return kmsDecrypt(region, keyID, data)
+}
@@ -0,0 +1,129 @@
+package cliconfig
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+// loadNested loads the config options in a document with nested sections,
+// like a YAML or JSON config file. A section is only a way of writing options
+// with a common prefix: its keys are joined onto the section's name with
+// dashes, so `git: {clone-flags: -v}` sets git-clone-flags, the same as
+// `git-clone-flags: -v` would, and `experiment: {enabled: [...]}` sets
+// experiment-enabled rather than experiment. Lists are joined with commas.
+// Profiles are given under `profiles`, and can inherit from another profile
+// with `inherits`.
+func (f *File) loadNested(doc yaml.MapSlice) error {
+	for _, item := range doc {
+		key := fmt.Sprint(item.Key)
+		if key != "profiles" {
+			if err := flattenNested(f.Config, key, item.Value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		profiles, ok := nestedItems(item.Value)
+		if !ok {
+			return fmt.Errorf("The profiles in %s must be a map of profile names to their config", f.Path)
+		}
+
+		for _, profile := range profiles {
+			name := fmt.Sprint(profile.Key)
+			if _, exists := f.Profiles[name]; exists {
+				return fmt.Errorf("Profile %q is defined more than once", name)
+			}
+
+			section, ok := nestedItems(profile.Value)
+			if !ok {
+				return fmt.Errorf("Profile %q in %s must be a map of config options", name, f.Path)
+			}
+
+			config := map[string]string{}
+			for _, item := range section {
+				key := fmt.Sprint(item.Key)
+				if key == "inherits" {
+					f.profileParents[name] = fmt.Sprint(item.Value)
+					continue
+				}
+				if err := flattenNested(config, key, item.Value); err != nil {
+					return err
+				}
+			}
+			f.Profiles[name] = config
+		}
+	}
+
+	return nil
+}
+
+// flattenNested sets the config options in a nested value, joining nested
+// keys onto key with dashes
+func flattenNested(config map[string]string, key string, value interface{}) error {
+	if items, ok := nestedItems(value); ok {
+		for _, item := range items {
+			if err := flattenNested(config, key+"-"+fmt.Sprint(item.Key), item.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, exists := config[key]; exists {
+		return fmt.Errorf("The config option `%s` is set more than once", key)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		config[key] = ""
+
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if _, ok := nestedItems(item); ok {
+				return fmt.Errorf("The config option `%s` can only be a list of strings, numbers or booleans", key)
+			}
+			if _, ok := item.([]interface{}); ok {
+				return fmt.Errorf("The config option `%s` can only be a list of strings, numbers or booleans", key)
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		config[key] = strings.Join(items, ",")
+
+	default:
+		config[key] = fmt.Sprint(v)
+	}
+
+	return nil
+}
+
+// nestedItems returns the items of a map, however it was decoded
+func nestedItems(value interface{}) (yaml.MapSlice, bool) {
+	switch m := value.(type) {
+	case yaml.MapSlice:
+		return m, true
+	case map[interface{}]interface{}:
+		items := make(yaml.MapSlice, 0, len(m))
+		for k, v := range m {
+			items = append(items, yaml.MapItem{Key: k, Value: v})
+		}
+		return items, true
+	case map[string]interface{}:
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		items := make(yaml.MapSlice, 0, len(m))
+		for _, k := range keys {
+			items = append(items, yaml.MapItem{Key: k, Value: m[k]})
+		}
+		return items, true
+	default:
+		return nil, false
+	}
+}
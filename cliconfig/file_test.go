@@ -0,0 +1,388 @@
+package cliconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const profilesConfig = `token="base-token"
+tags="queue=default"
+build-path="/var/lib/buildkite/builds"
+
+[linux]
+tags="queue=linux,os=linux"
+
+[deploy : linux]
+token="deploy-token"
+tags="queue=deploy,os=linux"
+`
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	return writeConfigFileNamed(t, "buildkite-agent.cfg", contents)
+}
+
+func writeConfigFileNamed(t *testing.T, name, contents string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "cliconfig")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+
+	return path
+}
+
+func TestFileLoadWithoutProfileIgnoresProfileSections(t *testing.T) {
+	file := File{Path: writeConfigFile(t, profilesConfig)}
+	require.NoError(t, file.Load())
+
+	assert.Equal(t, map[string]string{
+		"token":      "base-token",
+		"tags":       "queue=default",
+		"build-path": "/var/lib/buildkite/builds",
+	}, file.Config)
+	assert.Len(t, file.Profiles, 2)
+}
+
+func TestFileLoadWithProfileInheritsFromParentsAndBase(t *testing.T) {
+	file := File{Path: writeConfigFile(t, profilesConfig), Profile: "deploy"}
+	require.NoError(t, file.Load())
+
+	assert.Equal(t, map[string]string{
+		"token":      "deploy-token",
+		"tags":       "queue=deploy,os=linux",
+		"build-path": "/var/lib/buildkite/builds",
+	}, file.Config)
+}
+
+func TestFileLoadWithUnknownProfile(t *testing.T) {
+	file := File{Path: writeConfigFile(t, profilesConfig), Profile: "windows"}
+	assert.ErrorContains(t, file.Load(), `Profile "windows" isn't defined`)
+}
+
+func TestFileLoadWithMissingParentProfile(t *testing.T) {
+	file := File{Path: writeConfigFile(t, "[deploy : linux]\ntoken=x\n"), Profile: "deploy"}
+	assert.ErrorContains(t, file.Load(), `Profile "deploy" inherits from "linux"`)
+}
+
+func TestFileLoadWithProfileCycle(t *testing.T) {
+	file := File{Path: writeConfigFile(t, "[a : b]\ntoken=x\n[b : a]\ntoken=y\n"), Profile: "a"}
+	assert.ErrorContains(t, file.Load(), "inheritance cycle")
+}
+
+func TestFileLoadWithDuplicateProfile(t *testing.T) {
+	file := File{Path: writeConfigFile(t, "[a]\ntoken=x\n[a]\ntoken=y\n")}
+	assert.ErrorContains(t, file.Load(), "defined more than once")
+}
+
+const yamlConfig = `token: base-token
+tags:
+  - queue=default
+  - os=linux
+build-path: /var/lib/buildkite/builds
+no-color: true
+git:
+  clone-flags: -v --depth=1
+  mirrors:
+    path: /var/lib/buildkite/git-mirrors
+
+profiles:
+  deploy:
+    token: deploy-token
+  canary:
+    inherits: deploy
+    tags: [queue=canary]
+`
+
+func TestFileLoadYAML(t *testing.T) {
+	file := File{Path: writeConfigFileNamed(t, "buildkite-agent.yaml", yamlConfig)}
+	require.NoError(t, file.Load())
+
+	assert.Equal(t, map[string]string{
+		"token":            "base-token",
+		"tags":             "queue=default,os=linux",
+		"build-path":       "/var/lib/buildkite/builds",
+		"no-color":         "true",
+		"git-clone-flags":  "-v --depth=1",
+		"git-mirrors-path": "/var/lib/buildkite/git-mirrors",
+	}, file.Config)
+}
+
+func TestFileLoadYAMLWithProfile(t *testing.T) {
+	file := File{Path: writeConfigFileNamed(t, "buildkite-agent.yml", yamlConfig), Profile: "canary"}
+	require.NoError(t, file.Load())
+
+	assert.Equal(t, "deploy-token", file.Config["token"])
+	assert.Equal(t, "queue=canary", file.Config["tags"])
+	assert.Equal(t, "/var/lib/buildkite/builds", file.Config["build-path"])
+}
+
+func TestFileLoadYAMLWithOptionSetTwice(t *testing.T) {
+	file := File{Path: writeConfigFileNamed(t, "buildkite-agent.yaml", "git-clone-flags: -v\ngit:\n  clone-flags: -q\n")}
+	assert.ErrorContains(t, file.Load(), "`git-clone-flags` is set more than once")
+}
+
+func TestFileLoadYAMLWithInvalidYAML(t *testing.T) {
+	file := File{Path: writeConfigFileNamed(t, "buildkite-agent.yaml", "token: [unclosed\n")}
+	assert.ErrorContains(t, file.Load(), "as YAML")
+}
+
+const tomlConfig = `# The agent's config
+token = "base-token"
+tags = [
+  "queue=default",
+  'os=linux', # literal strings too
+]
+build-path = "/var/lib/buildkite/builds"
+no-color = true
+disconnect-after-idle-timeout = 1_800
+
+[git]
+clone-flags = "-v --depth=1"
+mirrors.path = "/var/lib/buildkite/git-mirrors"
+
+[profiles.deploy]
+token = "deploy-token"
+
+[profiles.canary]
+inherits = "deploy"
+tags = ["queue=canary"]
+`
+
+func TestFileLoadTOML(t *testing.T) {
+	file := File{Path: writeConfigFileNamed(t, "buildkite-agent.toml", tomlConfig)}
+	require.NoError(t, file.Load())
+
+	assert.Equal(t, map[string]string{
+		"token":                         "base-token",
+		"tags":                          "queue=default,os=linux",
+		"build-path":                    "/var/lib/buildkite/builds",
+		"no-color":                      "true",
+		"disconnect-after-idle-timeout": "1800",
+		"git-clone-flags":               "-v --depth=1",
+		"git-mirrors-path":              "/var/lib/buildkite/git-mirrors",
+	}, file.Config)
+}
+
+func TestFileLoadTOMLWithProfile(t *testing.T) {
+	file := File{Path: writeConfigFileNamed(t, "buildkite-agent.toml", tomlConfig), Profile: "canary"}
+	require.NoError(t, file.Load())
+
+	assert.Equal(t, "deploy-token", file.Config["token"])
+	assert.Equal(t, "queue=canary", file.Config["tags"])
+	assert.Equal(t, "/var/lib/buildkite/builds", file.Config["build-path"])
+}
+
+func TestFileLoadTOMLStrings(t *testing.T) {
+	file := File{Path: writeConfigFileNamed(t, "buildkite-agent.toml", `basic = "tab\there \"quoted\" \u00e9"
+literal = 'C:\buildkite-agent\builds'
+multi = """
+one
+two"""
+"quoted.key" = "x"
+`)}
+	require.NoError(t, file.Load())
+
+	assert.Equal(t, map[string]string{
+		"basic":      "tab\there \"quoted\" é",
+		"literal":    `C:\buildkite-agent\builds`,
+		"multi":      "one\ntwo",
+		"quoted.key": "x",
+	}, file.Config)
+}
+
+// Examples from the TOML v1.0.0 spec, and the config options they set
+func TestFileLoadTOMLSpecExamples(t *testing.T) {
+	for contents, expected := range map[string]map[string]string{
+		// Keys
+		`"127.0.0.1" = "value"
+"character encoding" = "value"
+"ʎǝʞ" = "value"
+'key2' = "value"
+'quoted "value"' = "value"`: {
+			"127.0.0.1":          "value",
+			"character encoding": "value",
+			"ʎǝʞ":                "value",
+			"key2":               "value",
+			`quoted "value"`:     "value",
+		},
+		`name = "Orange"
+physical.color = "orange"
+physical.shape = "round"
+site."google.com" = true`: {
+			"name":            "Orange",
+			"physical-color":  "orange",
+			"physical-shape":  "round",
+			"site-google.com": "true",
+		},
+		`fruit.name = "banana"     # this is best practice
+fruit. color = "yellow"    # same as fruit.color
+fruit . flavor = "banana"   # same as fruit.flavor`: {
+			"fruit-name":   "banana",
+			"fruit-color":  "yellow",
+			"fruit-flavor": "banana",
+		},
+
+		// Strings
+		`str1 = """
+Roses are red
+Violets are blue"""
+str2 = """
+The quick brown \
+
+
+  fox jumps over \
+    the lazy dog."""
+winpath  = 'C:\Users\nodejs\templates'
+regex    = '<\i\c*\s*>'`: {
+			"str1":    "Roses are red\nViolets are blue",
+			"str2":    "The quick brown fox jumps over the lazy dog.",
+			"winpath": `C:\Users\nodejs\templates`,
+			"regex":   `<\i\c*\s*>`,
+		},
+
+		// Numbers
+		`int1 = +99
+int5 = 1_000
+hex1 = 0xDEADBEEF
+oct1 = 0o01234567
+bin1 = 0b11010110
+flt2 = 3.1415
+flt4 = 5e+22
+flt9 = -0.0
+sf1 = inf`: {
+			"int1": "99",
+			"int5": "1000",
+			"hex1": "3735928559",
+			"oct1": "342391",
+			"bin1": "214",
+			"flt2": "3.1415",
+			"flt4": "50000000000000000000000",
+			"flt9": "-0",
+			"sf1":  "+Inf",
+		},
+
+		// Dates and times
+		`odt1 = 1979-05-27T07:32:00Z
+odt2 = 1979-05-27T00:32:00-07:00
+ldt1 = 1979-05-27T07:32:00
+ld1 = 1979-05-27
+lt1 = 07:32:00`: {
+			"odt1": "1979-05-27T07:32:00Z",
+			"odt2": "1979-05-27T00:32:00-07:00",
+			"ldt1": "1979-05-27T07:32:00",
+			"ld1":  "1979-05-27",
+			"lt1":  "07:32:00",
+		},
+
+		// Arrays
+		`integers = [ 1, 2, 3 ]
+colors = [ "red", "yellow", "green" ]
+numbers = [ 0.1, 0.2, 0.5, 1, 2, 5 ]
+integers3 = [
+  1,
+  2, # this is ok
+]`: {
+			"integers":  "1,2,3",
+			"colors":    "red,yellow,green",
+			"numbers":   "0.1,0.2,0.5,1,2,5",
+			"integers3": "1,2",
+		},
+
+		// Tables and inline tables
+		`[table-1]
+key1 = "some string"
+key2 = 123
+
+[dog."tater.man"]
+type.name = "pug"
+
+[ j . "ʞ" . 'l' ]
+key = "value"`: {
+			"table-1-key1":            "some string",
+			"table-1-key2":            "123",
+			"dog-tater.man-type-name": "pug",
+			"j-ʞ-l-key":               "value",
+		},
+		`name = { first = "Tom", last = "Preston-Werner" }
+point = { x = 1, y = 2 }
+animal = { type.name = "pug" }`: {
+			"name-first":       "Tom",
+			"name-last":        "Preston-Werner",
+			"point-x":          "1",
+			"point-y":          "2",
+			"animal-type-name": "pug",
+		},
+	} {
+		file := File{Path: writeConfigFileNamed(t, "buildkite-agent.toml", contents)}
+		if assert.NoError(t, file.Load(), contents) {
+			assert.Equal(t, expected, file.Config, contents)
+		}
+	}
+}
+
+func TestFileLoadTOMLErrors(t *testing.T) {
+	for contents, message := range map[string]string{
+		"token = \"unterminated\n":         "line 1",
+		"\n\ntoken \"x\"\n":                "line 3",
+		"token = \"a\"\ntoken = \"b\"\n":   "line 2",
+		"[git]\nx = 1\n[git]\n":            "line 3",
+		"token = \"a\" junk\n":             "line 1",
+		"[[plugins]]\nname = \"docker\"\n": "The config option `plugins` can only be a list of strings, numbers or booleans",
+		"tags = [[\"a\"], [\"b\"]]\n":      "The config option `tags` can only be a list of strings, numbers or booleans",
+	} {
+		file := File{Path: writeConfigFileNamed(t, "buildkite-agent.toml", contents)}
+		assert.ErrorContains(t, file.Load(), message, contents)
+	}
+}
+
+const jsonConfig = `{
+  "token": "base-token",
+  "tags": ["queue=default", "os=linux"],
+  "no-color": true,
+  "disconnect-after-idle-timeout": 1800,
+  "cancel-grace-period": null,
+  "experiment": {"enabled": ["ansi-timestamps", "git-mirrors"]},
+  "git": {"clone-flags": "-v --depth=1"},
+  "profiles": {
+    "deploy": {"token": "deploy-token"},
+    "canary": {"inherits": "deploy", "tags": ["queue=canary"]}
+  }
+}`
+
+func TestFileLoadJSON(t *testing.T) {
+	file := File{Path: writeConfigFileNamed(t, "buildkite-agent.json", jsonConfig)}
+	require.NoError(t, file.Load())
+
+	assert.Equal(t, map[string]string{
+		"token":                         "base-token",
+		"tags":                          "queue=default,os=linux",
+		"no-color":                      "true",
+		"disconnect-after-idle-timeout": "1800",
+		"cancel-grace-period":           "",
+		"experiment-enabled":            "ansi-timestamps,git-mirrors",
+		"git-clone-flags":               "-v --depth=1",
+	}, file.Config)
+}
+
+func TestFileLoadJSONWithProfile(t *testing.T) {
+	file := File{Path: writeConfigFileNamed(t, "buildkite-agent.json", jsonConfig), Profile: "canary"}
+	require.NoError(t, file.Load())
+
+	assert.Equal(t, "deploy-token", file.Config["token"])
+	assert.Equal(t, "queue=canary", file.Config["tags"])
+}
+
+func TestFileLoadJSONWithInvalidJSON(t *testing.T) {
+	file := File{Path: writeConfigFileNamed(t, "buildkite-agent.json", `{"token": `)}
+	assert.ErrorContains(t, file.Load(), "as JSON")
+}
@@ -0,0 +1,65 @@
+package cliconfig
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// loadTOML loads a TOML config file, see loadNested. Tables are nested
+// sections, so `clone-flags` in `[git]` sets git-clone-flags, and profiles
+// are the tables under `profiles`.
+func (f *File) loadTOML(data []byte) error {
+	var doc map[string]interface{}
+	if _, err := toml.Decode(string(data), &doc); err != nil {
+		return fmt.Errorf("Failed to parse %s as TOML: %v", f.Path, err)
+	}
+
+	items, _ := nestedItems(tomlValue(doc))
+	return f.loadNested(items)
+}
+
+// tomlValue converts the values TOML has that YAML and JSON don't into the
+// strings they're written as
+func tomlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = tomlValue(item)
+		}
+		return v
+
+	case []map[string]interface{}:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			items = append(items, tomlValue(item))
+		}
+		return items
+
+	case []interface{}:
+		for i, item := range v {
+			v[i] = tomlValue(item)
+		}
+		return v
+
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+
+	case time.Time:
+		// Dates and times without an offset are given in a zone named
+		// after which they are
+		switch v.Location().String() {
+		case "datetime-local":
+			return v.Format("2006-01-02T15:04:05.999999999")
+		case "date-local":
+			return v.Format("2006-01-02")
+		case "time-local":
+			return v.Format("15:04:05.999999999")
+		}
+		return v.Format(time.RFC3339Nano)
+	}
+
+	return value
+}
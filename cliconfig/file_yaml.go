@@ -0,0 +1,17 @@
+package cliconfig
+
+import (
+	"fmt"
+
+	"github.com/buildkite/yaml"
+)
+
+// loadYAML loads a YAML config file, see loadNested
+func (f *File) loadYAML(data []byte) error {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("Failed to parse %s as YAML: %v", f.Path, err)
+	}
+
+	return f.loadNested(doc)
+}
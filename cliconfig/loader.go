@@ -5,8 +5,11 @@ import (
 	"os"
 	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/utils"
@@ -24,30 +27,124 @@ type Loader struct {
 	// The logger used
 	Logger logger.Logger
 
-	// A slice of paths to files that should be used as config files
+	// A slice of paths to files that should be used as config files. The
+	// first one that exists is loaded, when no config files are given with
+	// --config.
 	DefaultConfigFilePaths []string
 
-	// The file that was used when loading this configuration
+	// The file that was used when loading this configuration, which is the
+	// files merged together when there are several
 	File *File
+
+	// The files that were loaded, in the order they're merged
+	Files []*File
+
+	// Looks up environment variables. Defaults to os.LookupEnv, but can be
+	// a snapshot of the environment, for loading the config again after
+	// the environment has changed.
+	LookupEnv func(string) (string, bool)
+
+	// The environment variables that options were read from with env://
+	// values. Commands that start other processes should remove them from
+	// the environment, like the ones options are set from.
+	SecretEnvNames []string
+
+	// Whether to report keys in the config file that aren't options of the
+	// command, as warnings, or as an error with the strict-config option.
+	// The file is shared between commands, so only a command that has all
+	// of the options the file can set should check it.
+	CheckUnknownKeys bool
+
+	// Validation rules registered with RegisterValidator, and normalizations
+	// registered with RegisterNormalizer
+	validators  map[string]ValidatorFunc
+	normalizers map[string]NormalizerFunc
+
+	// What's put in front of the cli names of the fields in Config, when
+	// it's a struct nested in the command's config
+	prefix string
+
+	// Where each option's value came from, keyed by its cli name
+	sources map[string]Source
+}
+
+// Source is where the value of a config option came from
+type Source string
+
+const (
+	SourceDefault    Source = "default"
+	SourceFlag       Source = "flag"
+	SourceEnv        Source = "environment variable"
+	SourceConfigFile Source = "config file"
+)
+
+// Sources returns where the value of each of the command's options came from
+// when it was loaded, keyed by the option's cli name. Positional arguments
+// aren't options, so they're left out.
+func (l Loader) Sources() map[string]Source {
+	return l.sources
+}
+
+// ValidatorFunc checks the value of a config option for a `validate:` rule,
+// returning an error that describes the problem if it's not valid. The label
+// is what the option is called in errors.
+type ValidatorFunc func(label string, value interface{}) error
+
+// NormalizerFunc changes the value of a config option for a `normalize:` rule,
+// returning the new value, which must be the same type as the option, or an
+// error if the value can't be normalized
+type NormalizerFunc func(value interface{}) (interface{}, error)
+
+// The validation rules every loader has, besides required and required-if
+var builtinValidators = map[string]ValidatorFunc{
+	"file-exists": validateFileExists,
+}
+
+// The built-in validation rules that take an argument after their name, like
+// min:1 or oneof:a|b|c
+var builtinArgValidators = map[string]func(label string, arg string, value interface{}) error{
+	"regex": validateRegex,
+	"oneof": validateOneOf,
+	"min":   validateMin,
+	"max":   validateMax,
 }
 
 var argCliNameRegexp = regexp.MustCompile(`arg:(\d+)`)
 
+// RegisterValidator adds a rule that fields can use in their `validate:` tag,
+// replacing any built-in rule with the same name
+func (l *Loader) RegisterValidator(name string, fn ValidatorFunc) {
+	if l.validators == nil {
+		l.validators = map[string]ValidatorFunc{}
+	}
+	l.validators[name] = fn
+}
+
+// RegisterNormalizer adds a normalization that fields can use in their
+// `normalize:` tag, replacing any built-in normalization with the same name
+func (l *Loader) RegisterNormalizer(name string, fn NormalizerFunc) {
+	if l.normalizers == nil {
+		l.normalizers = map[string]NormalizerFunc{}
+	}
+	l.normalizers[name] = fn
+}
+
 // Loads the config from the CLI and config files that are present and returns
 // any warnings or errors
 func (l *Loader) Load() (warnings []string, err error) {
-	// Try and find a config file, either passed in the command line using
-	// --config, or in one of the default configuration file paths.
-	if l.CLI.String("config") != "" {
-		file := File{Path: l.CLI.String("config")}
-
-		// Because this file was passed in manually, we should throw an error
-		// if it doesn't exist.
-		if file.Exists() {
-			l.File = &file
-		} else {
-			absolutePath, _ := file.AbsolutePath()
-			return warnings, fmt.Errorf("A configuration file could not be found at: %q", absolutePath)
+	// Try and find the config files, either passed in the command line
+	// using --config, or in one of the default configuration file paths.
+	if paths := l.configFilePaths(); len(paths) > 0 {
+		for _, path := range paths {
+			file := File{Path: path}
+
+			// Because this file was passed in manually, we should throw
+			// an error if it doesn't exist.
+			if !file.Exists() {
+				absolutePath, _ := file.AbsolutePath()
+				return warnings, fmt.Errorf("A configuration file could not be found at: %q", absolutePath)
+			}
+			l.Files = append(l.Files, &file)
 		}
 	} else if len(l.DefaultConfigFilePaths) > 0 {
 		for _, path := range l.DefaultConfigFilePaths {
@@ -56,118 +153,345 @@ func (l *Loader) Load() (warnings []string, err error) {
 			// If the config file exists, save it to the loader and
 			// don't bother checking the others.
 			if file.Exists() {
-				l.File = &file
+				l.Files = []*File{&file}
 				break
 			}
 		}
 	}
 
-	// If a file was found, then we should load it
-	if l.File != nil {
-		// Attempt to load the config file we've found
-		if err := l.File.Load(); err != nil {
+	// A profile can only be selected from a config file
+	profile := l.CLI.String("config-profile")
+	if profile != "" && len(l.Files) == 0 {
+		return warnings, fmt.Errorf("The config profile %q was selected, but no configuration file was found", profile)
+	}
+
+	// If files were found, then we should load them, and merge them in
+	// order, so later files override earlier ones
+	if len(l.Files) > 0 {
+		for _, file := range l.Files {
+			file.Identity = l.CLI.String("config-identity")
+
+			// Attempt to load the config file we've found
+			if err := file.Load(); err != nil {
+				return warnings, err
+			}
+		}
+
+		// Later files override earlier ones
+		if l.File, err = mergeFiles(l.Files, profile); err != nil {
 			return warnings, err
 		}
 	}
 
+	l.sources = map[string]Source{}
+
 	// Now it's onto actually setting the fields. We start by getting all
-	// the fields from the configuration interface
-	var fields []string
-	fields, _ = reflections.Fields(l.Config)
+	// the fields from the configuration interface, including the ones in
+	// nested structs
+	fields := Fields(l.Config)
 
 	// Loop through each of the fields, and look for tags and handle them
 	// appropriately
-	for _, fieldName := range fields {
+	for _, field := range fields {
+		fieldName := field.Name
+
+		// The field's struct is the config as far as it's concerned
+		fl := l.forField(field)
+
 		// Start by loading the value from the CLI context if the tag
 		// exists
-		cliName, _ := reflections.GetFieldTag(l.Config, fieldName, "cli")
+		cliName := field.CLIName()
 		if cliName != "" {
 			// Load the value from the CLI Context
-			err := l.setFieldValueFromCLI(fieldName, cliName)
+			err := fl.setFieldValueFromCLI(fieldName, cliName)
+			if err != nil {
+				return warnings, err
+			}
+
+			// Secrets can be read from a file or another environment
+			// variable, rather than being in the config itself, if
+			// they're tagged as secret
+			envName, err := fl.resolveSecretValue(fieldName, cliName)
 			if err != nil {
 				return warnings, err
 			}
+			if envName != "" {
+				l.SecretEnvNames = append(l.SecretEnvNames, envName)
+			}
 		}
 
 		// Are there any normalizations we need to make?
-		normalization, _ := reflections.GetFieldTag(l.Config, fieldName, "normalize")
+		normalization, _ := reflections.GetFieldTag(fl.Config, fieldName, "normalize")
 		if normalization != "" {
 			// Apply the normalization
-			err := l.normalizeField(fieldName, normalization)
+			err := fl.normalizeField(fieldName, normalization)
 			if err != nil {
 				return warnings, err
 			}
 		}
 
 		// Check for field rename deprecations
-		renamedToFieldName, _ := reflections.GetFieldTag(l.Config, fieldName, "deprecated-and-renamed-to")
+		renamedToFieldName, _ := reflections.GetFieldTag(fl.Config, fieldName, "deprecated-and-renamed-to")
 		if renamedToFieldName != "" {
 			// If the deprecated field's value isn't empty, then we
 			// log a message, and set the proper config for them.
-			if !l.fieldValueIsEmpty(fieldName) {
-				renamedFieldCliName, _ := reflections.GetFieldTag(l.Config, renamedToFieldName, "cli")
+			if !fl.fieldValueIsEmpty(fieldName) {
+				renamedFieldCliName := fl.cliName(renamedToFieldName)
 				if renamedFieldCliName != "" {
 					warnings = append(warnings,
 						fmt.Sprintf("The config option `%s` has been renamed to `%s`. Please update your configuration.", cliName, renamedFieldCliName))
 				}
 
-				value, _ := reflections.GetField(l.Config, fieldName)
+				value, _ := reflections.GetField(fl.Config, fieldName)
 
 				// Error if they specify the deprecated version and the new version
-				if !l.fieldValueIsEmpty(renamedToFieldName) {
-					renamedFieldValue, _ := reflections.GetField(l.Config, renamedToFieldName)
+				if !fl.fieldValueIsEmpty(renamedToFieldName) {
+					renamedFieldValue, _ := reflections.GetField(fl.Config, renamedToFieldName)
 					return warnings, fmt.Errorf("Can't set config option `%s=%v` because `%s=%v` has already been set", cliName, value, renamedFieldCliName, renamedFieldValue)
 				}
 
 				// Set the proper config based on the deprecated value
 				if value != nil {
-					err := reflections.SetField(l.Config, renamedToFieldName, value)
+					err := reflections.SetField(fl.Config, renamedToFieldName, value)
 					if err != nil {
 						return warnings, fmt.Errorf("Could not set value `%s` to field `%s` (%s)", value, renamedToFieldName, err)
 					}
+					if renamedFieldCliName != "" {
+						l.sources[renamedFieldCliName] = l.sources[cliName]
+					}
 				}
 			}
 		}
 
 		// Check for field deprecation
-		deprecationError, _ := reflections.GetFieldTag(l.Config, fieldName, "deprecated")
+		deprecationError, _ := reflections.GetFieldTag(fl.Config, fieldName, "deprecated")
 		if deprecationError != "" {
 			// If the deprecated field's value isn't empty, then we
 			// return the deprecation error message.
-			if !l.fieldValueIsEmpty(fieldName) {
+			if !fl.fieldValueIsEmpty(fieldName) {
 				warnings = append(warnings,
 					fmt.Sprintf("The config option `%s` has been deprecated: %s", cliName, deprecationError))
 			}
 		}
 
 		// Perform validations
-		validationRules, _ := reflections.GetFieldTag(l.Config, fieldName, "validate")
+		validationRules, _ := reflections.GetFieldTag(fl.Config, fieldName, "validate")
 		if validationRules != "" {
-			// Determine the label for the field
-			label, _ := reflections.GetFieldTag(l.Config, fieldName, "label")
-			if label == "" {
-				// Use the cli name if it exists, but if it
-				// doesn't, just default to the structs field
-				// name. Not great, but works!
-				if cliName != "" {
-					label = cliName
-				} else {
-					label = fieldName
-				}
-			}
-
 			// Validate the fieid, and if it fails, return its
 			// error.
-			err := l.validateField(fieldName, label, validationRules)
+			err := fl.validateField(fieldName, fl.fieldLabel(fieldName), validationRules)
 			if err != nil {
 				return warnings, err
 			}
 		}
 	}
 
+	// Whether an option is required can depend on options after it, so
+	// required-if rules are checked once they've all been loaded
+	for _, field := range fields {
+		fieldName := field.Name
+		fl := l.forField(field)
+
+		validationRules := field.Tag.Get("validate")
+		for _, rule := range SplitValidationRules(validationRules) {
+			if name, other, _ := strings.Cut(rule, ":"); name == "required-if" {
+				if err := fl.validateRequiredIf(fieldName, fl.fieldLabel(fieldName), other, fields); err != nil {
+					return warnings, err
+				}
+			}
+		}
+	}
+
+	// Typos in the config file would otherwise be silently ignored
+	if l.CheckUnknownKeys && l.File != nil {
+		var unknown []string
+		unknownKeys := l.unknownConfigKeys()
+		for _, key := range unknownKeys {
+			if suggestion := closestConfigOption(key, fields); suggestion != "" {
+				key = fmt.Sprintf("`%s` (did you mean `%s`?)", key, suggestion)
+			} else {
+				key = fmt.Sprintf("`%s`", key)
+			}
+			unknown = append(unknown, key)
+		}
+
+		if len(unknown) > 0 && l.strictConfig() {
+			return warnings, fmt.Errorf("The config file %s has options this command doesn't have: %s", l.File.Path, strings.Join(unknown, ", "))
+		}
+		for i, key := range unknown {
+			warnings = append(warnings, fmt.Sprintf("The config option %s in %s isn't an option of this command, so it's ignored", key, l.File.PathOf(unknownKeys[i])))
+		}
+	}
+
 	return warnings, nil
 }
 
+// configFilePaths returns the config files given with --config, which can be
+// given more than once, or as a comma-separated list
+func (l Loader) configFilePaths() []string {
+	values := l.CLI.StringSlice("config")
+	if len(values) == 0 {
+		values = []string{l.CLI.String("config")}
+	}
+
+	var paths []string
+	for _, value := range values {
+		for _, path := range strings.Split(value, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// unknownConfigKeys returns the keys in the config file, including the ones
+// in profiles that aren't selected, that aren't options of the command
+func (l Loader) unknownConfigKeys() []string {
+	known := map[string]bool{}
+	for _, field := range Fields(l.Config) {
+		if cliName := field.CLIName(); cliName != "" {
+			known[cliName] = true
+		}
+	}
+
+	seen := map[string]bool{}
+	var unknown []string
+	check := func(key string) {
+		key = strings.ReplaceAll(key, ".", "-")
+		if !known[key] && !seen[key] {
+			seen[key] = true
+			unknown = append(unknown, key)
+		}
+	}
+
+	for key := range l.File.Config {
+		check(key)
+	}
+	for _, profile := range l.File.Profiles {
+		for key := range profile {
+			check(key)
+		}
+	}
+
+	sort.Strings(unknown)
+	return unknown
+}
+
+// closestConfigOption returns the option that an unknown key is most likely
+// a typo of, or an empty string if none of them are close
+func closestConfigOption(key string, fields []Field) string {
+	closest, closestDistance := "", len(key)/3+1
+	for _, field := range fields {
+		cliName := field.CLIName()
+		if cliName == "" || argCliNameRegexp.MatchString(cliName) {
+			continue
+		}
+		if d := editDistance(key, cliName); d < closestDistance {
+			closest, closestDistance = cliName, d
+		}
+	}
+	return closest
+}
+
+// editDistance returns the number of characters that need inserting,
+// deleting, changing or swapping with their neighbour to turn one string into
+// the other
+func editDistance(a, b string) int {
+	rows := make([][]int, len(a)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(b)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			rows[i][j] = minInt(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				rows[i][j] = minInt(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+
+	return rows[len(a)][len(b)]
+}
+
+func minInt(first int, rest ...int) int {
+	for _, n := range rest {
+		if n < first {
+			first = n
+		}
+	}
+	return first
+}
+
+// The prefixes of values that are read from somewhere else
+const (
+	secretFilePrefix = "file://"
+	secretEnvPrefix  = "env://"
+)
+
+// resolveSecretValue replaces an option with a `secret:"true"` tag that's set
+// to file://<path> with the contents of the file, and one that's set to
+// env://<name> with the value of the environment variable, returning the name
+// of the variable if it was read from one. Options without the tag are left
+// as they are, so values that happen to start with file:// aren't read.
+func (l Loader) resolveSecretValue(fieldName string, cliName string) (string, error) {
+	if secret, _ := reflections.GetFieldTag(l.Config, fieldName, "secret"); secret != "true" {
+		return "", nil
+	}
+
+	value, _ := reflections.GetField(l.Config, fieldName)
+	s, ok := value.(string)
+	if !ok {
+		return "", nil
+	}
+
+	var resolved, envName string
+	switch {
+	case strings.HasPrefix(s, secretFilePrefix):
+		path := strings.TrimPrefix(s, secretFilePrefix)
+
+		// file:///C:/secrets/token is C:/secrets/token on Windows
+		if runtime.GOOS == "windows" && len(path) > 2 && path[0] == '/' && path[2] == ':' {
+			path = path[1:]
+		}
+
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("The config option `%s` couldn't be read from %s: %v", cliName, path, err)
+		}
+
+		// Secret files usually end with a newline that isn't part of
+		// the secret
+		resolved = strings.TrimRight(string(contents), "\r\n")
+
+	case strings.HasPrefix(s, secretEnvPrefix):
+		envName = strings.TrimPrefix(s, secretEnvPrefix)
+
+		var set bool
+		if resolved, set = l.lookupEnv(envName); !set {
+			return "", fmt.Errorf("The config option `%s` is read from $%s, which isn't set", cliName, envName)
+		}
+
+	default:
+		return "", nil
+	}
+
+	if err := reflections.SetField(l.Config, fieldName, resolved); err != nil {
+		return "", err
+	}
+
+	return envName, nil
+}
+
 func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 	// Get the kind of field we need to set
 	fieldKind, err := reflections.GetFieldKind(l.Config, fieldName)
@@ -175,7 +499,12 @@ func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 		return fmt.Errorf(`Failed to get the type of struct field %s`, fieldName)
 	}
 
+	// Durations are a kind of int64, so they're told apart by their type
+	fieldType, _ := reflections.GetFieldType(l.Config, fieldName)
+	isDuration := fieldType == durationType
+
 	var value interface{}
+	source := SourceDefault
 
 	// See the if the cli option is using the arg format (arg:1)
 	argMatch := argCliNameRegexp.FindStringSubmatch(cliName)
@@ -199,11 +528,18 @@ func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 		if value == nil {
 			envName, err := reflections.GetFieldTag(l.Config, fieldName, "env")
 			if err == nil {
-				if envValue, envSet := os.LookupEnv(envName); envSet {
+				if envValue, envSet := l.lookupEnv(envName); envSet {
 					value = envValue
 				}
 			}
 		}
+
+		// And if it's not there either, from the field's default
+		if value == nil {
+			if value, err = l.fieldDefault(fieldName); err != nil {
+				return err
+			}
+		}
 	} else {
 		// If the cli name didn't have the special format, then we need to
 		// either load from the context's flags, or from a config file.
@@ -212,36 +548,81 @@ func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 		// by the configuration file
 		if l.File != nil {
 			if configFileValue, ok := l.File.Config[cliName]; ok {
+				// Expand environment variables in the value, unless
+				// that's been turned off
+				if l.expandsEnv() {
+					if configFileValue, err = expandEnv(configFileValue, l.lookupEnv, l.strictConfig()); err != nil {
+						return fmt.Errorf("The config option `%s` in %s %v", cliName, l.File.PathOf(cliName), err)
+					}
+				}
+
 				// Convert the config file value to its correct type
-				if fieldKind == reflect.String {
-					value = configFileValue
-				} else if fieldKind == reflect.Slice {
-					value = strings.Split(configFileValue, ",")
-				} else if fieldKind == reflect.Bool {
-					value, _ = strconv.ParseBool(configFileValue)
-				} else if fieldKind == reflect.Int {
-					value, _ = strconv.Atoi(configFileValue)
+				if isDuration {
+					value, err = parseDuration(configFileValue)
 				} else {
-					return fmt.Errorf("Unable to convert string to type %s", fieldKind)
+					value, err = convertConfigFileValue(configFileValue, fieldKind)
+				}
+				if err != nil {
+					return fmt.Errorf("The config option `%s` in %s %v", cliName, l.File.PathOf(cliName), err)
 				}
+				source = SourceConfigFile
+			}
+		}
+
+		// If nothing sets the option, the field's default is used
+		// rather than the flag's
+		if value == nil && !l.cliValueIsSet(cliName) {
+			if value, err = l.fieldDefault(fieldName); err != nil {
+				return err
 			}
 		}
 
 		// If a value hasn't been found in a config file, but there
 		// _is_ one provided by the CLI context, then use that.
 		if value == nil || l.cliValueIsSet(cliName) {
-			if fieldKind == reflect.String {
+			if isDuration {
+				// Duration flags can be string flags, to take a number
+				// of seconds too
+				if value, err = parseDuration(l.CLI.String(cliName)); err != nil {
+					return fmt.Errorf("The config option `%s` %v", cliName, err)
+				}
+			} else if fieldKind == reflect.String {
 				value = l.CLI.String(cliName)
 			} else if fieldKind == reflect.Slice {
 				value = l.CLI.StringSlice(cliName)
+			} else if fieldKind == reflect.Map {
+				cliValue, err := parseMap(l.CLI.StringSlice(cliName))
+				if err != nil {
+					return fmt.Errorf("The config option `%s` %v", cliName, err)
+				}
+
+				// Entries on the command line are merged into the
+				// ones from the config file, replacing any with the
+				// same key
+				fileValue, _ := value.(map[string]string)
+				value = mergeMaps(fileValue, cliValue)
 			} else if fieldKind == reflect.Bool {
 				value = l.CLI.Bool(cliName)
 			} else if fieldKind == reflect.Int {
 				value = l.CLI.Int(cliName)
+			} else if fieldKind == reflect.Int64 {
+				value = l.CLI.Int64(cliName)
+			} else if fieldKind == reflect.Uint {
+				value = l.CLI.Uint(cliName)
+			} else if fieldKind == reflect.Uint64 {
+				value = l.CLI.Uint64(cliName)
+			} else if fieldKind == reflect.Float64 {
+				value = l.CLI.Float64(cliName)
 			} else {
 				return fmt.Errorf("Unable to handle type: %s", fieldKind)
 			}
+
+			if l.cliValueIsSet(cliName) {
+				source = l.cliValueSource(cliName, value, fieldKind, isDuration)
+			}
 		}
+
+		l.sources[cliName] = source
 	}
 
 	// Set the value to the cfg
@@ -255,6 +636,31 @@ func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 	return nil
 }
 
+// expandsEnv returns whether environment variables in config file values are
+// expanded, which can be turned off on the command line or in the file itself
+func (l Loader) expandsEnv() bool {
+	if l.CLI.Bool("no-config-env-expansion") {
+		return false
+	}
+	off, _ := strconv.ParseBool(l.File.Config["no-config-env-expansion"])
+	return !off
+}
+
+func (l Loader) strictConfig() bool {
+	if l.CLI.Bool("strict-config") {
+		return true
+	}
+	strict, _ := strconv.ParseBool(l.File.Config["strict-config"])
+	return strict
+}
+
+func (l Loader) lookupEnv(name string) (string, bool) {
+	if l.LookupEnv != nil {
+		return l.LookupEnv(name)
+	}
+	return os.LookupEnv(name)
+}
+
 func (l Loader) Errorf(format string, v ...interface{}) error {
 	suffix := fmt.Sprintf(" See: `%s %s --help`", l.CLI.App.Name, l.CLI.Command.Name)
 
@@ -276,7 +682,8 @@ func (l Loader) cliValueIsSet(cliName string) bool {
 				if envVarStr, ok := envVar.(string); ok {
 					envVarStr = strings.TrimSpace(string(envVarStr))
 
-					return os.Getenv(envVarStr) != ""
+					envValue, _ := l.lookupEnv(envVarStr)
+					return envValue != ""
 				}
 			}
 		}
@@ -285,6 +692,54 @@ func (l Loader) cliValueIsSet(cliName string) bool {
 	return false
 }
 
+// cliValueSource returns whether an option that's set on the CLI context was
+// given as a flag or with its environment variable. The context doesn't say,
+// so it's from the environment variable if that has the same value, which
+// is the case unless a flag overrode it.
+func (l Loader) cliValueSource(cliName string, value interface{}, fieldKind reflect.Kind, isDuration bool) Source {
+	for _, flag := range l.CLI.Command.Flags {
+		name, _ := reflections.GetField(flag, "Name")
+		envVar, _ := reflections.GetField(flag, "EnvVar")
+		envVarStr, ok := envVar.(string)
+		if name != cliName || !ok || envVarStr == "" {
+			continue
+		}
+
+		// Flags can have a list of environment variables, and the
+		// first that's set is used
+		for _, envName := range strings.Split(envVarStr, ",") {
+			envValue, _ := l.lookupEnv(strings.TrimSpace(envName))
+			if envValue == "" {
+				continue
+			}
+
+			var envParsed interface{}
+			switch {
+			case isDuration:
+				envParsed, _ = parseDuration(envValue)
+			case fieldKind == reflect.Slice || fieldKind == reflect.Map:
+				// Map values are merged into the config file's, so
+				// their entries are compared
+				value = l.CLI.StringSlice(cliName)
+				var items []string
+				for _, item := range strings.Split(envValue, ",") {
+					items = append(items, strings.TrimSpace(item))
+				}
+				envParsed = items
+			default:
+				envParsed, _ = convertConfigFileValue(envValue, fieldKind)
+			}
+
+			if reflect.DeepEqual(value, envParsed) {
+				return SourceEnv
+			}
+			return SourceFlag
+		}
+	}
+
+	return SourceFlag
+}
+
 func (l Loader) fieldValueIsEmpty(fieldName string) bool {
 	// We need to use the field kind to determine the type of empty test.
 	value, _ := reflections.GetField(l.Config, fieldName)
@@ -292,13 +747,19 @@ func (l Loader) fieldValueIsEmpty(fieldName string) bool {
 
 	if fieldKind == reflect.String {
 		return value == ""
-	} else if fieldKind == reflect.Slice {
+	} else if fieldKind == reflect.Slice || fieldKind == reflect.Map {
 		v := reflect.ValueOf(value)
 		return v.Len() == 0
 	} else if fieldKind == reflect.Bool {
 		return value == false
 	} else if fieldKind == reflect.Int {
 		return value == 0
+	} else if fieldKind == reflect.Int64 {
+		return reflect.ValueOf(value).Int() == 0
+	} else if fieldKind == reflect.Uint || fieldKind == reflect.Uint64 {
+		return reflect.ValueOf(value).Uint() == 0
+	} else if fieldKind == reflect.Float64 {
+		return value == 0.0
 	} else {
 		panic(fmt.Sprintf("Can't determine empty-ness for field type %s", fieldKind))
 	}
@@ -306,55 +767,292 @@ func (l Loader) fieldValueIsEmpty(fieldName string) bool {
 	return false
 }
 
-func (l Loader) validateField(fieldName string, label string, validationRules string) error {
-	// Split up the validation rules
-	rules := strings.Split(validationRules, ",")
+// fieldDefault returns the value of a field's default tag, or nil if it
+// doesn't have one
+func (l Loader) fieldDefault(fieldName string) (interface{}, error) {
+	structField, _ := reflect.TypeOf(l.Config).Elem().FieldByName(fieldName)
+	value, _, err := Field{StructField: structField, Struct: l.Config, Prefix: l.prefix}.Default()
+	return value, err
+}
+
+// forField returns a copy of the loader for the struct a field is in, so
+// that its fields can be looked up by name
+func (l Loader) forField(field Field) Loader {
+	l.Config = field.Struct
+	l.prefix = field.Prefix
+	return l
+}
 
+// cliName returns the option name of one of the fields in Config, with the
+// prefix of the struct it's nested in
+func (l Loader) cliName(fieldName string) string {
+	name, _ := reflections.GetFieldTag(l.Config, fieldName, "cli")
+	if name == "" || argCliNameRegexp.MatchString(name) {
+		return name
+	}
+	return l.prefix + name
+}
+
+// fieldLabel returns what a field is called in validation errors
+func (l Loader) fieldLabel(fieldName string) string {
+	label, _ := reflections.GetFieldTag(l.Config, fieldName, "label")
+	if label == "" {
+		// Use the cli name if it exists, but if it
+		// doesn't, just default to the structs field
+		// name. Not great, but works!
+		label = l.cliName(fieldName)
+		if label == "" {
+			label = fieldName
+		}
+	}
+	return label
+}
+
+func (l Loader) validateField(fieldName string, label string, validationRules string) error {
 	// Loop through each rule, and perform it
-	for _, rule := range rules {
+	for _, rule := range SplitValidationRules(validationRules) {
 		if rule == "required" {
 			if l.fieldValueIsEmpty(fieldName) {
 				return l.Errorf("Missing %s.", label)
 			}
-		} else if rule == "file-exists" {
-			value, _ := reflections.GetField(l.Config, fieldName)
+			continue
+		}
 
-			// Make sure the value is converted to a string
-			if valueAsString, ok := value.(string); ok {
-				// Return an error if the path doesn't exist
-				if _, err := os.Stat(valueAsString); err != nil {
-					return fmt.Errorf("Could not find %s located at %s", label, value)
-				}
+		// Checked by Load once all the fields have been loaded
+		if strings.HasPrefix(rule, "required-if:") {
+			continue
+		}
+
+		value, _ := reflections.GetField(l.Config, fieldName)
+
+		validator, ok := l.validators[rule]
+		if !ok {
+			validator, ok = builtinValidators[rule]
+		}
+		if ok {
+			if err := validator(label, value); err != nil {
+				return err
 			}
-		} else {
+			continue
+		}
+
+		// Rules like min:1 take an argument after their name
+		name, arg, _ := strings.Cut(rule, ":")
+		argValidator, ok := builtinArgValidators[name]
+		if !ok {
 			return fmt.Errorf("Unknown config validation rule `%s`", rule)
 		}
+		if err := argValidator(label, arg, value); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (l Loader) normalizeField(fieldName string, normalization string) error {
-	if normalization == "filepath" {
-		value, _ := reflections.GetField(l.Config, fieldName)
-		fieldKind, _ := reflections.GetFieldKind(l.Config, fieldName)
+// validateRequiredIf checks a required-if:<option> rule, which makes a field
+// required when another option of the command is set. In a nested struct,
+// the other option can be named without the struct's prefix.
+func (l Loader) validateRequiredIf(fieldName string, label string, other string, fields []Field) error {
+	for _, otherField := range fields {
+		cliName := otherField.CLIName()
+		if cliName != other && cliName != l.prefix+other {
+			continue
+		}
 
-		// Make sure we're normalizing a string field
-		if fieldKind != reflect.String {
-			return fmt.Errorf("filepath normalization only works on string fields")
+		if !l.forField(otherField).fieldValueIsEmpty(otherField.Name) && l.fieldValueIsEmpty(fieldName) {
+			return l.Errorf("Missing %s, which is required when %s is set.", label, cliName)
 		}
+		return nil
+	}
 
-		// Normalize the field to be a filepath
-		if valueAsString, ok := value.(string); ok {
-			normalizedPath, err := utils.NormalizeFilePath(valueAsString)
-			if err != nil {
-				return err
+	return fmt.Errorf("The required-if rule for %s refers to `%s`, which isn't an option of this command", label, other)
+}
+
+// SplitValidationRules splits up a field's comma separated validation rules.
+// A regex rule's pattern can have commas in it, so it has to be the last
+// rule, and takes the rest of them.
+func SplitValidationRules(validationRules string) []string {
+	var rules []string
+	for rest := validationRules; rest != ""; {
+		if strings.HasPrefix(rest, "regex:") {
+			rules = append(rules, rest)
+			break
+		}
+
+		var rule string
+		rule, rest, _ = strings.Cut(rest, ",")
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// validateRegex checks that a string field, or each string in a list, matches
+// a regular expression. Empty values are left to the required rule.
+func validateRegex(label string, pattern string, value interface{}) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("The validation rule for %s has an invalid regex: %v", label, err)
+	}
+
+	for _, s := range validationStrings(value) {
+		if s != "" && !re.MatchString(s) {
+			return fmt.Errorf("The %s %q must match the pattern `%s`", label, s, pattern)
+		}
+	}
+
+	return nil
+}
+
+// validateOneOf checks that a string field, or each string in a list, is one
+// of the | separated options. Empty values are left to the required rule.
+func validateOneOf(label string, options string, value interface{}) error {
+	allowed := strings.Split(options, "|")
+
+	for _, s := range validationStrings(value) {
+		if s == "" {
+			continue
+		}
+
+		found := false
+		for _, option := range allowed {
+			if s == option {
+				found = true
+				break
 			}
+		}
+		if !found {
+			return fmt.Errorf("The %s %q must be one of: %s", label, s, strings.Join(allowed, ", "))
+		}
+	}
+
+	return nil
+}
+
+// validateMin checks that a number or duration field is at least the given
+// value
+func validateMin(label string, min string, value interface{}) error {
+	n, limit, err := validationNumbers(label, "min", min, value)
+	if err != nil {
+		return err
+	}
+
+	if n < limit {
+		return fmt.Errorf("The %s must be at least %s, not %v", label, min, value)
+	}
+
+	return nil
+}
+
+// validateMax checks that a number or duration field is at most the given
+// value
+func validateMax(label string, max string, value interface{}) error {
+	n, limit, err := validationNumbers(label, "max", max, value)
+	if err != nil {
+		return err
+	}
+
+	if n > limit {
+		return fmt.Errorf("The %s must be at most %s, not %v", label, max, value)
+	}
+
+	return nil
+}
+
+// validationStrings returns the strings to check in a string or string list
+// field
+func validationStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	}
+	return nil
+}
 
-			if err := reflections.SetField(l.Config, fieldName, normalizedPath); err != nil {
+// validationNumbers returns a number or duration field's value and the limit
+// it's compared with as floats, parsing the limit the same way as the field
+func validationNumbers(label string, rule string, limit string, value interface{}) (float64, float64, error) {
+	if d, ok := value.(time.Duration); ok {
+		l, err := parseDuration(limit)
+		if err != nil {
+			return 0, 0, fmt.Errorf("The %s rule for %s has an invalid duration: %v", rule, label, err)
+		}
+		return float64(d), float64(l), nil
+	}
+
+	var n float64
+	switch v := reflect.ValueOf(value); v.Kind() {
+	case reflect.Int, reflect.Int64:
+		n = float64(v.Int())
+	case reflect.Uint, reflect.Uint64:
+		n = float64(v.Uint())
+	case reflect.Float64:
+		n = v.Float()
+	default:
+		return 0, 0, fmt.Errorf("The %s rule for %s only works with numbers and durations", rule, label)
+	}
+
+	l, err := strconv.ParseFloat(limit, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("The %s rule for %s has an invalid number: %q", rule, label, limit)
+	}
+
+	return n, l, nil
+}
+
+// validateFileExists checks that a string field is the path to a file that
+// exists
+func validateFileExists(label string, value interface{}) error {
+	// Make sure the value is converted to a string
+	if valueAsString, ok := value.(string); ok {
+		// Return an error if the path doesn't exist
+		if _, err := os.Stat(valueAsString); err != nil {
+			return fmt.Errorf("Could not find %s located at %s", label, value)
+		}
+	}
+
+	return nil
+}
+
+// normalizeField applies each of a field's comma separated normalizations in
+// turn
+func (l Loader) normalizeField(fieldName string, normalizations string) error {
+	for _, normalization := range strings.Split(normalizations, ",") {
+		normalizer, ok := l.normalizers[normalization]
+		if !ok {
+			if err := l.normalizeFieldBuiltin(fieldName, normalization); err != nil {
 				return err
 			}
+			continue
 		}
+
+		value, _ := reflections.GetField(l.Config, fieldName)
+		normalized, err := normalizer(value)
+		if err != nil {
+			name := l.cliName(fieldName)
+			if name == "" {
+				name = fieldName
+			}
+			return fmt.Errorf("The config option `%s` %v", name, err)
+		}
+		if err := reflections.SetField(l.Config, fieldName, normalized); err != nil {
+			return fmt.Errorf("Could not set the normalized value of %s (%s)", fieldName, err)
+		}
+	}
+
+	return nil
+}
+
+func (l Loader) normalizeFieldBuiltin(fieldName string, normalization string) error {
+	if normalization == "filepath" {
+		// Normalize the field to be a filepath
+		return l.normalizePathField(fieldName, normalization, utils.NormalizeFilePath)
+	} else if normalization == "winpath" {
+		// Normalize the field to be a filepath that's safe to hand to the
+		// Windows APIs even when it's very long
+		return l.normalizePathField(fieldName, normalization, utils.NormalizeWindowsPath)
 	} else if normalization == "commandpath" {
 		value, _ := reflections.GetField(l.Config, fieldName)
 		fieldKind, _ := reflections.GetFieldKind(l.Config, fieldName)
@@ -410,3 +1108,150 @@ func (l Loader) normalizeField(fieldName string, normalization string) error {
 
 	return nil
 }
+
+// normalizePathField normalizes a string field with the normalization's path
+// style, like utils.NormalizeFilePath for filepath
+func (l Loader) normalizePathField(fieldName string, normalization string, normalize func(string) (string, error)) error {
+	value, _ := reflections.GetField(l.Config, fieldName)
+	fieldKind, _ := reflections.GetFieldKind(l.Config, fieldName)
+
+	// Make sure we're normalizing a string field
+	if fieldKind != reflect.String {
+		return fmt.Errorf("%s normalization only works on string fields", normalization)
+	}
+
+	if valueAsString, ok := value.(string); ok {
+		normalizedPath, err := normalize(valueAsString)
+		if err != nil {
+			return err
+		}
+
+		if err := reflections.SetField(l.Config, fieldName, normalizedPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The type of time.Duration fields
+var durationType = reflect.TypeOf(time.Duration(0)).String()
+
+// parseDuration parses a duration like 30s or 1m30s, or a number of seconds,
+// which is what options that are now durations used to take. Empty values
+// are no time at all.
+func parseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("must be a duration like 30s or 5m, or a number of seconds, not %q", value)
+	}
+	return d, nil
+}
+
+// parseMap parses the entries of a map option, each of which is one or more
+// comma separated key=value pairs, so `--tags a=1 --tags b=2` and
+// `tags="a=1,b=2"` give the same map. Later entries replace earlier ones with
+// the same key.
+func parseMap(entries []string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, entry := range entries {
+		for _, pair := range strings.Split(entry, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+
+			key, value, ok := strings.Cut(pair, "=")
+			key = strings.TrimSpace(key)
+			if !ok || key == "" {
+				return nil, fmt.Errorf("must be key=value pairs, not %q", pair)
+			}
+			m[key] = strings.TrimSpace(value)
+		}
+	}
+	return m, nil
+}
+
+// mergeMaps returns a map with the entries of base, replaced or added to by
+// the entries of overrides
+func mergeMaps(base, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(overrides))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
+// convertConfigFileValue converts a value from a config file to the kind of
+// the field it's for. Empty values are the field's zero value.
+func convertConfigFileValue(value string, kind reflect.Kind) (interface{}, error) {
+	switch kind {
+	case reflect.String:
+		return value, nil
+	case reflect.Slice:
+		return strings.Split(value, ","), nil
+	case reflect.Map:
+		return parseMap([]string{value})
+	case reflect.Bool:
+		if value == "" {
+			return false, nil
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("must be true or false, not %q", value)
+		}
+		return b, nil
+	case reflect.Int:
+		if value == "" {
+			return 0, nil
+		}
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("must be a whole number, not %q", value)
+		}
+		return i, nil
+	case reflect.Int64:
+		if value == "" {
+			return int64(0), nil
+		}
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be a whole number, not %q", value)
+		}
+		return i, nil
+	case reflect.Uint, reflect.Uint64:
+		var u uint64
+		if value != "" {
+			var err error
+			if u, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("must be a whole number that isn't negative, not %q", value)
+			}
+		}
+		if kind == reflect.Uint {
+			return uint(u), nil
+		}
+		return u, nil
+	case reflect.Float64:
+		if value == "" {
+			return 0.0, nil
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be a number, not %q", value)
+		}
+		return f, nil
+	default:
+		return nil, fmt.Errorf("can't be converted to type %s", kind)
+	}
+}
@@ -0,0 +1,784 @@
+package cliconfig
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+)
+
+func TestConvertConfigFileValue(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		kind  reflect.Kind
+		want  interface{}
+	}{
+		{"queue=default,os=linux", reflect.Slice, []string{"queue=default", "os=linux"}},
+		{"true", reflect.Bool, true},
+		{"", reflect.Bool, false},
+		{"1800", reflect.Int, 1800},
+		{"", reflect.Int, 0},
+		{"10737418240", reflect.Int64, int64(10737418240)},
+		{"", reflect.Int64, int64(0)},
+		{"4096", reflect.Uint, uint(4096)},
+		{"18446744073709551615", reflect.Uint64, uint64(18446744073709551615)},
+		{"", reflect.Uint64, uint64(0)},
+		{"0.25", reflect.Float64, 0.25},
+		{"", reflect.Float64, 0.0},
+	} {
+		got, err := convertConfigFileValue(tc.value, tc.kind)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, got)
+	}
+
+	for _, tc := range []struct {
+		value string
+		kind  reflect.Kind
+	}{
+		{"yes please", reflect.Bool},
+		{"1.5", reflect.Int},
+		{"lots", reflect.Int64},
+		{"-1", reflect.Uint},
+		{"-1", reflect.Uint64},
+		{"half", reflect.Float64},
+		{"1", reflect.Map},
+	} {
+		_, err := convertConfigFileValue(tc.value, tc.kind)
+		assert.Error(t, err, tc.value)
+	}
+}
+
+func TestLoaderRegisterValidator(t *testing.T) {
+	cfg := struct {
+		Endpoint string `cli:"endpoint" validate:"url"`
+		Path     string `cli:"path" validate:"file-exists"`
+	}{
+		Endpoint: "not a url",
+		Path:     "/does/not/exist",
+	}
+
+	l := &Loader{Config: &cfg}
+
+	err := l.validateField("Endpoint", "endpoint", "url")
+	assert.EqualError(t, err, "Unknown config validation rule `url`")
+
+	l.RegisterValidator("url", func(label string, value interface{}) error {
+		if s, _ := value.(string); !strings.Contains(s, "://") {
+			return fmt.Errorf("%s must be a URL, not %q", label, s)
+		}
+		return nil
+	})
+
+	err = l.validateField("Endpoint", "endpoint", "url")
+	assert.EqualError(t, err, `endpoint must be a URL, not "not a url"`)
+
+	cfg.Endpoint = "https://agent.buildkite.com/v3"
+	assert.NoError(t, l.validateField("Endpoint", "endpoint", "url"))
+
+	err = l.validateField("Path", "path", "file-exists")
+	assert.EqualError(t, err, "Could not find path located at /does/not/exist")
+
+	// Registered rules replace the built-in ones
+	l.RegisterValidator("file-exists", func(label string, value interface{}) error { return nil })
+	assert.NoError(t, l.validateField("Path", "path", "file-exists"))
+}
+
+func TestLoaderValidatesWithArgRules(t *testing.T) {
+	cfg := struct {
+		Signing string        `cli:"signing"`
+		Tags    []string      `cli:"tags"`
+		Weight  int           `cli:"weight"`
+		Ratio   float64       `cli:"ratio"`
+		Timeout time.Duration `cli:"timeout"`
+	}{
+		Signing: "md5",
+		Tags:    []string{"queue=default", "nope"},
+		Weight:  -1,
+		Ratio:   1.5,
+		Timeout: 2 * time.Hour,
+	}
+
+	l := &Loader{Config: &cfg}
+
+	err := l.validateField("Signing", "signing", "oneof:hmac|aws-sigv4")
+	assert.EqualError(t, err, `The signing "md5" must be one of: hmac, aws-sigv4`)
+
+	err = l.validateField("Tags", "tags", "regex:^[a-z]+=[a-z,]+$")
+	assert.EqualError(t, err, `The tags "nope" must match the pattern `+"`^[a-z]+=[a-z,]+$`")
+
+	err = l.validateField("Weight", "weight", "min:0")
+	assert.EqualError(t, err, "The weight must be at least 0, not -1")
+
+	err = l.validateField("Ratio", "ratio", "min:0,max:1")
+	assert.EqualError(t, err, "The ratio must be at most 1, not 1.5")
+
+	err = l.validateField("Timeout", "timeout", "max:1h")
+	assert.EqualError(t, err, "The timeout must be at most 1h, not 2h0m0s")
+
+	err = l.validateField("Signing", "signing", "min:1")
+	assert.EqualError(t, err, "The min rule for signing only works with numbers and durations")
+
+	cfg.Signing = ""
+	cfg.Tags = []string{"queue=default,deploy"}
+	cfg.Weight = 0
+	cfg.Ratio = 0.5
+	cfg.Timeout = 30 * time.Minute
+	assert.NoError(t, l.validateField("Signing", "signing", "oneof:hmac|aws-sigv4"))
+	assert.NoError(t, l.validateField("Tags", "tags", "regex:^[a-z]+=[a-z,]+$"))
+	assert.NoError(t, l.validateField("Weight", "weight", "min:0"))
+	assert.NoError(t, l.validateField("Ratio", "ratio", "min:0,max:1"))
+	assert.NoError(t, l.validateField("Timeout", "timeout", "max:1h"))
+}
+
+func TestSplitValidationRules(t *testing.T) {
+	assert.Equal(t, []string{"required", "min:1"}, SplitValidationRules("required,min:1"))
+	assert.Equal(t, []string{"required", "regex:^a{1,3}$"}, SplitValidationRules("required,regex:^a{1,3}$"))
+	assert.Empty(t, SplitValidationRules(""))
+}
+
+func TestLoaderValidatesRequiredIf(t *testing.T) {
+	type config struct {
+		SigningKeyPath   string `cli:"signing-key-path" validate:"required-if:signing-jwks-key-id"`
+		SigningJWKSKeyID string `cli:"signing-jwks-key-id"`
+	}
+
+	load := func(keyPath, keyID string) error {
+		app := cli.NewApp()
+		app.Name = "buildkite-agent"
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("signing-key-path", keyPath, "")
+		set.String("signing-jwks-key-id", keyID, "")
+		ctx := cli.NewContext(app, set, nil)
+		ctx.Command = cli.Command{Name: "upload"}
+
+		_, err := (&Loader{CLI: ctx, Config: &config{}}).Load()
+		return err
+	}
+
+	assert.NoError(t, load("", ""))
+	assert.NoError(t, load("key.json", "my-key"))
+	assert.NoError(t, load("key.json", ""))
+	assert.EqualError(t, load("", "my-key"),
+		"Missing signing-key-path, which is required when signing-jwks-key-id is set. See: `buildkite-agent upload --help`")
+
+	var cfg struct {
+		SigningKeyPath string `cli:"signing-key-path" validate:"required-if:signing-jwks-key-id"`
+	}
+	l := &Loader{CLI: cli.NewContext(cli.NewApp(), flag.NewFlagSet("test", flag.ContinueOnError), nil), Config: &cfg}
+	_, err := l.Load()
+	assert.EqualError(t, err, "The required-if rule for signing-key-path refers to `signing-jwks-key-id`, which isn't an option of this command")
+}
+
+func TestParseDuration(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"30s":   30 * time.Second,
+		"1m30s": 90 * time.Second,
+		"10":    10 * time.Second,
+		"":      0,
+	} {
+		got, err := parseDuration(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, want, got, value)
+	}
+
+	_, err := parseDuration("soon")
+	assert.EqualError(t, err, `must be a duration like 30s or 5m, or a number of seconds, not "soon"`)
+}
+
+func TestLoaderLoadsDurations(t *testing.T) {
+	cfg := struct {
+		Config            string        `cli:"config"`
+		CancelGracePeriod time.Duration `cli:"cancel-grace-period"`
+		Timeout           time.Duration `cli:"timeout"`
+	}{}
+
+	path := filepath.Join(t.TempDir(), "buildkite-agent.cfg")
+	if err := os.WriteFile(path, []byte("cancel-grace-period=45\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	app := cli.NewApp()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("config", path, "")
+	set.String("cancel-grace-period", "10s", "")
+	set.Duration("timeout", time.Minute, "")
+	if err := set.Parse([]string{"--timeout", "90s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	l := Loader{CLI: cli.NewContext(app, set, nil), Config: &cfg}
+	_, err := l.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 45*time.Second, cfg.CancelGracePeriod)
+	assert.Equal(t, 90*time.Second, cfg.Timeout)
+}
+
+func TestParseMap(t *testing.T) {
+	got, err := parseMap([]string{"queue=default,os=linux", " arch = arm64 ", "os=darwin", ""})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"queue": "default", "os": "darwin", "arch": "arm64"}, got)
+
+	_, err = parseMap([]string{"queue"})
+	assert.EqualError(t, err, `must be key=value pairs, not "queue"`)
+
+	_, err = parseMap([]string{"=default"})
+	assert.Error(t, err)
+}
+
+func TestLoaderMergesMaps(t *testing.T) {
+	cfg := struct {
+		Config    string            `cli:"config"`
+		Tags      map[string]string `cli:"tags" validate:"required"`
+		PluginEnv map[string]string `cli:"plugin-env"`
+	}{}
+
+	path := filepath.Join(t.TempDir(), "buildkite-agent.cfg")
+	if err := os.WriteFile(path, []byte("tags=\"queue=default,os=linux\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	app := cli.NewApp()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("config", path, "")
+	set.Var(&cli.StringSlice{}, "tags", "")
+	set.Var(&cli.StringSlice{}, "plugin-env", "")
+	if err := set.Parse([]string{"--tags", "queue=deploy", "--tags", "arch=arm64"}); err != nil {
+		t.Fatal(err)
+	}
+
+	l := Loader{CLI: cli.NewContext(app, set, nil), Config: &cfg}
+	_, err := l.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"queue": "deploy", "os": "linux", "arch": "arm64"}, cfg.Tags)
+	assert.Empty(t, cfg.PluginEnv)
+}
+
+func TestLoaderLoadsFloats(t *testing.T) {
+	cfg := struct {
+		Config         string  `cli:"config"`
+		SampleRate     float64 `cli:"sample-rate" validate:"required"`
+		LoadThreshold  float64 `cli:"load-threshold"`
+		ErrorThreshold float64 `cli:"error-threshold"`
+	}{}
+
+	path := filepath.Join(t.TempDir(), "buildkite-agent.cfg")
+	if err := os.WriteFile(path, []byte("sample-rate=0.1\nload-threshold=2.5\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	app := cli.NewApp()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("config", path, "")
+	set.Float64("sample-rate", 1, "")
+	set.Float64("load-threshold", 0, "")
+	set.Float64("error-threshold", 0.5, "")
+	if err := set.Parse([]string{"--load-threshold", "4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	l := Loader{CLI: cli.NewContext(app, set, nil), Config: &cfg}
+	_, err := l.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 0.1, cfg.SampleRate)
+	assert.Equal(t, 4.0, cfg.LoadThreshold)
+	assert.Equal(t, 0.5, cfg.ErrorThreshold)
+}
+
+func TestLoaderLooksUpEnvironmentSnapshot(t *testing.T) {
+	type config struct {
+		Config    string `cli:"config"`
+		Queue     string `cli:"queue"`
+		BuildPath string `cli:"build-path"`
+	}
+
+	path := filepath.Join(t.TempDir(), "buildkite-agent.cfg")
+	if err := os.WriteFile(path, []byte("queue=file\nbuild-path=\"${AGENT_HOME}/builds\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queue was set from the environment when the command started, and
+	// the variable has since been unset
+	app := cli.NewApp()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("config", path, "")
+	set.String("queue", "env", "")
+	set.String("build-path", "", "")
+	ctx := cli.NewContext(app, set, nil)
+	ctx.Command = cli.Command{Flags: []cli.Flag{
+		cli.StringFlag{Name: "queue", EnvVar: "LOADER_TEST_QUEUE"},
+	}}
+
+	t.Setenv("AGENT_HOME", "/home/agent")
+
+	var cfg config
+	l := Loader{CLI: ctx, Config: &cfg}
+	_, err := l.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "file", cfg.Queue)
+	assert.Equal(t, "/home/agent/builds", cfg.BuildPath)
+
+	snapshot := map[string]string{"LOADER_TEST_QUEUE": "env", "AGENT_HOME": "/opt/agent"}
+	cfg = config{}
+	l = Loader{CLI: ctx, Config: &cfg, LookupEnv: func(name string) (string, bool) {
+		value, ok := snapshot[name]
+		return value, ok
+	}}
+	_, err = l.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "env", cfg.Queue)
+	assert.Equal(t, "/opt/agent/builds", cfg.BuildPath)
+}
+
+func TestLoaderResolvesSecretValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := struct {
+		Token    string `cli:"token" secret:"true"`
+		Secret   string `cli:"secret" secret:"true"`
+		Missing  string `cli:"missing" secret:"true"`
+		Value    string `cli:"arg:0"`
+		Endpoint string `cli:"endpoint"`
+	}{
+		Token:    "file://" + filepath.ToSlash(path),
+		Secret:   "env://LOADER_TEST_SECRET",
+		Missing:  "env://LOADER_TEST_MISSING",
+		Value:    "env://LOADER_TEST_SECRET",
+		Endpoint: "file:///etc/hostname",
+	}
+	if runtime.GOOS == "windows" {
+		cfg.Token = "file:///" + filepath.ToSlash(path)
+	}
+
+	l := Loader{Config: &cfg, LookupEnv: func(name string) (string, bool) {
+		if name == "LOADER_TEST_SECRET" {
+			return "env-secret", true
+		}
+		return "", false
+	}}
+
+	envName, err := l.resolveSecretValue("Token", "token")
+	assert.NoError(t, err)
+	assert.Equal(t, "", envName)
+	assert.Equal(t, "file-token", cfg.Token)
+
+	envName, err = l.resolveSecretValue("Secret", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "LOADER_TEST_SECRET", envName)
+	assert.Equal(t, "env-secret", cfg.Secret)
+
+	_, err = l.resolveSecretValue("Missing", "missing")
+	assert.EqualError(t, err, "The config option `missing` is read from $LOADER_TEST_MISSING, which isn't set")
+
+	// Options that aren't tagged as secret are left alone
+	for field, name := range map[string]string{"Value": "arg:0", "Endpoint": "endpoint"} {
+		envName, err = l.resolveSecretValue(field, name)
+		assert.NoError(t, err)
+		assert.Equal(t, "", envName)
+	}
+	assert.Equal(t, "env://LOADER_TEST_SECRET", cfg.Value)
+	assert.Equal(t, "file:///etc/hostname", cfg.Endpoint)
+
+	cfg.Token = "file:///does/not/exist"
+	_, err = l.resolveSecretValue("Token", "token")
+	assert.ErrorContains(t, err, "The config option `token` couldn't be read from /does/not/exist")
+}
+
+func TestLoaderRegisterNormalizer(t *testing.T) {
+	cfg := struct {
+		Shell    string   `cli:"shell" normalize:"trim,lowercase"`
+		Endpoint string   `cli:"endpoint" normalize:"url"`
+		Hooks    []string `cli:"hooks" normalize:"list,lowercase"`
+	}{
+		Shell:    "  BASH ",
+		Endpoint: "not a url",
+		Hooks:    []string{"Pre-Command,Post-Command"},
+	}
+
+	l := &Loader{Config: &cfg}
+
+	err := l.normalizeField("Shell", "trim,lowercase")
+	assert.EqualError(t, err, "Unknown normalization `trim`")
+
+	l.RegisterNormalizer("trim", func(value interface{}) (interface{}, error) {
+		return strings.TrimSpace(value.(string)), nil
+	})
+	l.RegisterNormalizer("lowercase", func(value interface{}) (interface{}, error) {
+		switch v := value.(type) {
+		case string:
+			return strings.ToLower(v), nil
+		case []string:
+			lower := make([]string, len(v))
+			for i := range v {
+				lower[i] = strings.ToLower(v[i])
+			}
+			return lower, nil
+		}
+		return nil, fmt.Errorf("can't be made lowercase")
+	})
+	l.RegisterNormalizer("url", func(value interface{}) (interface{}, error) {
+		if s := value.(string); !strings.Contains(s, "://") {
+			return nil, fmt.Errorf("must be a URL, not %q", s)
+		}
+		return value, nil
+	})
+
+	assert.NoError(t, l.normalizeField("Shell", "trim,lowercase"))
+	assert.Equal(t, "bash", cfg.Shell)
+
+	// Built-in and registered normalizations run in the order they are given
+	assert.NoError(t, l.normalizeField("Hooks", "list,lowercase"))
+	assert.Equal(t, []string{"pre-command", "post-command"}, cfg.Hooks)
+
+	err = l.normalizeField("Endpoint", "url")
+	assert.EqualError(t, err, "The config option `endpoint` must be a URL, not \"not a url\"")
+}
+
+func TestLoaderReportsUnknownConfigKeys(t *testing.T) {
+	type config struct {
+		Config       string `cli:"config"`
+		StrictConfig bool   `cli:"strict-config"`
+		Token        string `cli:"token"`
+		Tags         string `cli:"tags"`
+		BuildPath    string `cli:"build-path"`
+	}
+
+	path := writeConfigFile(t, profilesConfig+"tgas=\"queue=typo\"\n\n[windows]\nbuild-pth=\"C:\\\\builds\"\nllamas=true\n")
+
+	load := func(strict bool) (config, []string, error) {
+		app := cli.NewApp()
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("config", path, "")
+		set.Bool("strict-config", strict, "")
+		ctx := cli.NewContext(app, set, nil)
+		ctx.Command = cli.Command{Name: "start"}
+
+		var cfg config
+		l := Loader{CLI: ctx, Config: &cfg, CheckUnknownKeys: true}
+		warnings, err := l.Load()
+		return cfg, warnings, err
+	}
+
+	cfg, warnings, err := load(false)
+	require.NoError(t, err)
+	assert.Equal(t, "base-token", cfg.Token)
+	assert.Equal(t, []string{
+		"The config option `build-pth` (did you mean `build-path`?) in " + path + " isn't an option of this command, so it's ignored",
+		"The config option `llamas` in " + path + " isn't an option of this command, so it's ignored",
+		"The config option `tgas` (did you mean `tags`?) in " + path + " isn't an option of this command, so it's ignored",
+	}, warnings)
+
+	_, _, err = load(true)
+	assert.EqualError(t, err, "The config file "+path+" has options this command doesn't have: "+
+		"`build-pth` (did you mean `build-path`?), `llamas`, `tgas` (did you mean `tags`?)")
+}
+
+type testS3Config struct {
+	Region string `cli:"region" validate:"required-if:bucket"`
+	Bucket string `cli:"bucket"`
+	ACL    string `cli:"acl" validate:"oneof:private|public-read"`
+}
+
+type testUploadConfig struct {
+	Paths   string       `cli:"arg:0" label:"upload paths" validate:"required"`
+	Timeout int          `cli:"timeout"`
+	S3      testS3Config `cli:"s3"`
+	RetryTestConfig
+}
+
+type RetryTestConfig struct {
+	RetryCount int `cli:"retry-count"`
+}
+
+func TestFields(t *testing.T) {
+	var names []string
+	for _, field := range Fields(&testUploadConfig{}) {
+		names = append(names, field.CLIName())
+	}
+	assert.Equal(t, []string{"arg:0", "timeout", "s3-region", "s3-bucket", "s3-acl", "retry-count"}, names)
+}
+
+func TestLoaderLoadsNestedStructs(t *testing.T) {
+	load := func(cfg *testUploadConfig, args []string, options map[string]string) ([]string, error) {
+		app := cli.NewApp()
+		app.Name = "buildkite-agent"
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("config", "", "")
+		for _, name := range []string{"timeout", "s3-region", "s3-bucket", "s3-acl", "retry-count"} {
+			set.String(name, options[name], "")
+		}
+		require.NoError(t, set.Parse(args))
+		ctx := cli.NewContext(app, set, nil)
+		ctx.Command = cli.Command{Name: "upload"}
+
+		return (&Loader{CLI: ctx, Config: cfg, CheckUnknownKeys: true}).Load()
+	}
+
+	var cfg testUploadConfig
+	_, err := load(&cfg, []string{"*.log"}, map[string]string{
+		"timeout":     "30",
+		"s3-region":   "us-east-1",
+		"s3-bucket":   "artifacts",
+		"s3-acl":      "private",
+		"retry-count": "3",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, testUploadConfig{
+		Paths:           "*.log",
+		Timeout:         30,
+		S3:              testS3Config{Region: "us-east-1", Bucket: "artifacts", ACL: "private"},
+		RetryTestConfig: RetryTestConfig{RetryCount: 3},
+	}, cfg)
+
+	_, err = load(&testUploadConfig{}, []string{"*.log"}, map[string]string{"s3-bucket": "artifacts"})
+	assert.EqualError(t, err, "Missing s3-region, which is required when s3-bucket is set. See: `buildkite-agent upload --help`")
+
+	_, err = load(&testUploadConfig{}, []string{"*.log"}, map[string]string{"s3-acl": "everyone"})
+	assert.EqualError(t, err, `The s3-acl "everyone" must be one of: private, public-read`)
+
+	path := writeConfigFile(t, "s3-regoin=\"us-east-1\"\nretry-count=\"2\"\n")
+	cfg = testUploadConfig{}
+	warnings, err := load(&cfg, []string{"--config", path, "*.log"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, cfg.RetryCount)
+	assert.Equal(t, []string{
+		"The config option `s3-regoin` (did you mean `s3-region`?) in " + path + " isn't an option of this command, so it's ignored",
+	}, warnings)
+}
+
+func TestLoaderRecordsSources(t *testing.T) {
+	type config struct {
+		Config      string        `cli:"config"`
+		Token       string        `cli:"token"`
+		Queue       string        `cli:"queue"`
+		Tags        []string      `cli:"tags"`
+		BuildPath   string        `cli:"build-path"`
+		Name        string        `cli:"name"`
+		Timeout     time.Duration `cli:"timeout"`
+		MetaData    []string      `cli:"meta-data" deprecated-and-renamed-to:"Tags"`
+		Path        string        `cli:"arg:0"`
+		NotAnOption string
+	}
+
+	path := writeConfigFile(t, "build-path=\"/var/builds\"\nqueue=\"file\"\nmeta-data=\"os=linux\"\n")
+
+	// Environment variables are applied to the flag set as the flags'
+	// values, like urfave/cli does
+	env := map[string]string{
+		"LOADER_TEST_QUEUE":   "env",
+		"LOADER_TEST_TIMEOUT": "30",
+		"LOADER_TEST_TOKEN":   "env-token",
+	}
+	app := cli.NewApp()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("config", "", "")
+	set.String("token", "", "")
+	set.String("queue", env["LOADER_TEST_QUEUE"], "")
+	set.Var(&cli.StringSlice{}, "tags", "")
+	set.String("build-path", "", "")
+	set.String("name", "agent-%n", "")
+	set.String("timeout", env["LOADER_TEST_TIMEOUT"], "")
+	set.Var(&cli.StringSlice{}, "meta-data", "")
+	require.NoError(t, set.Parse([]string{"--config", path, "--token", "flag-token", "pipeline.yml"}))
+	ctx := cli.NewContext(app, set, nil)
+	ctx.Command = cli.Command{Flags: []cli.Flag{
+		cli.StringFlag{Name: "token", EnvVar: "LOADER_TEST_TOKEN"},
+		cli.StringFlag{Name: "queue", EnvVar: "LOADER_TEST_QUEUE"},
+		cli.StringFlag{Name: "timeout", EnvVar: "LOADER_TEST_TIMEOUT"},
+	}}
+
+	var cfg config
+	l := Loader{CLI: ctx, Config: &cfg, LookupEnv: func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}}
+	_, err := l.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "flag-token", cfg.Token)
+	assert.Equal(t, "env", cfg.Queue)
+	assert.Equal(t, 30*time.Second, cfg.Timeout)
+
+	assert.Equal(t, map[string]Source{
+		"config":     SourceFlag,
+		"token":      SourceFlag,
+		"queue":      SourceEnv,
+		"tags":       SourceConfigFile,
+		"build-path": SourceConfigFile,
+		"name":       SourceDefault,
+		"timeout":    SourceEnv,
+		"meta-data":  SourceConfigFile,
+	}, l.Sources())
+}
+
+func TestLoaderUsesDefaultTags(t *testing.T) {
+	type config struct {
+		Config   string        `cli:"config"`
+		Queue    string        `cli:"queue" default:"default"`
+		Spawn    int           `cli:"spawn" default:"1"`
+		Tags     []string      `cli:"tags" default:"os=linux,arch=amd64"`
+		Timeout  time.Duration `cli:"timeout" default:"1m"`
+		Priority int           `cli:"priority"`
+		Path     string        `cli:"arg:0" default:"."`
+	}
+
+	path := writeConfigFile(t, "spawn=4\n")
+
+	load := func(args ...string) (config, map[string]Source, error) {
+		app := cli.NewApp()
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("config", "", "")
+		set.String("queue", "from-flag-default", "")
+		set.Int("spawn", 2, "")
+		set.Var(&cli.StringSlice{}, "tags", "")
+		set.String("timeout", "", "")
+		set.Int("priority", 5, "")
+		require.NoError(t, set.Parse(args))
+		ctx := cli.NewContext(app, set, nil)
+		ctx.Command = cli.Command{Flags: []cli.Flag{
+			cli.StringFlag{Name: "queue", EnvVar: "LOADER_TEST_QUEUE"},
+		}}
+
+		var cfg config
+		l := Loader{CLI: ctx, Config: &cfg, LookupEnv: func(name string) (string, bool) { return "", false }}
+		_, err := l.Load()
+		return cfg, l.Sources(), err
+	}
+
+	// Defaults are used instead of the flags' when nothing sets the options
+	cfg, sources, err := load()
+	require.NoError(t, err)
+	assert.Equal(t, config{
+		Queue:    "default",
+		Spawn:    1,
+		Tags:     []string{"os=linux", "arch=amd64"},
+		Timeout:  time.Minute,
+		Priority: 5,
+		Path:     ".",
+	}, cfg)
+	assert.Equal(t, SourceDefault, sources["queue"])
+
+	// But not when something does
+	cfg, sources, err = load("--config", path, "--queue", "deploy", "pipeline.yml")
+	require.NoError(t, err)
+	assert.Equal(t, "deploy", cfg.Queue)
+	assert.Equal(t, 4, cfg.Spawn)
+	assert.Equal(t, "pipeline.yml", cfg.Path)
+	assert.Equal(t, SourceFlag, sources["queue"])
+	assert.Equal(t, SourceConfigFile, sources["spawn"])
+
+	var invalid struct {
+		Spawn int `cli:"spawn" default:"lots"`
+	}
+	l := Loader{CLI: cli.NewContext(cli.NewApp(), flag.NewFlagSet("test", flag.ContinueOnError), nil), Config: &invalid}
+	_, err = l.Load()
+	assert.EqualError(t, err, `The default of the config option `+"`spawn`"+` must be a whole number, not "lots"`)
+}
+
+func TestLoaderLoadsInt64AndUintFields(t *testing.T) {
+	type config struct {
+		Config         string `cli:"config"`
+		MaxLogBytes    int64  `cli:"max-log-bytes" validate:"min:1024"`
+		TimeoutMillis  int64  `cli:"timeout-millis" default:"30000"`
+		Workers        uint   `cli:"workers" validate:"required"`
+		MaxUploadBytes uint64 `cli:"max-upload-bytes"`
+	}
+
+	path := writeConfigFile(t, "max-upload-bytes=10737418240\n")
+
+	load := func(args ...string) (config, error) {
+		app := cli.NewApp()
+		app.Name = "buildkite-agent"
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("config", path, "")
+		set.Int64("max-log-bytes", 0, "")
+		set.Int64("timeout-millis", 0, "")
+		set.Uint("workers", 0, "")
+		set.Uint64("max-upload-bytes", 0, "")
+		require.NoError(t, set.Parse(args))
+		ctx := cli.NewContext(app, set, nil)
+		ctx.Command = cli.Command{Name: "start"}
+
+		var cfg config
+		_, err := (&Loader{CLI: ctx, Config: &cfg}).Load()
+		return cfg, err
+	}
+
+	cfg, err := load("--max-log-bytes", "5368709120", "--workers", "4")
+	require.NoError(t, err)
+	assert.Equal(t, config{
+		Config:         path,
+		MaxLogBytes:    5368709120,
+		TimeoutMillis:  30000,
+		Workers:        4,
+		MaxUploadBytes: 10737418240,
+	}, cfg)
+
+	_, err = load("--max-log-bytes", "512", "--workers", "4")
+	assert.EqualError(t, err, "The max-log-bytes must be at least 1024, not 512")
+
+	_, err = load("--max-log-bytes", "2048")
+	assert.EqualError(t, err, "Missing workers. See: `buildkite-agent start --help`")
+}
+
+func TestLoaderMergesConfigFiles(t *testing.T) {
+	type config struct {
+		Config    []string `cli:"config" normalize:"list"`
+		Token     string   `cli:"token"`
+		Tags      string   `cli:"tags"`
+		BuildPath string   `cli:"build-path"`
+		Priority  int      `cli:"priority"`
+	}
+
+	base := writeConfigFileNamed(t, "base.cfg", "priority=1\n"+profilesConfig)
+	override := writeConfigFileNamed(t, "override.yml", "build-path: /mnt/builds\npriority: high\nprofiles:\n  linux:\n    token: linux-token\n")
+
+	load := func(configs flag.Value, profile string) (config, error) {
+		app := cli.NewApp()
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.Var(configs, "config", "")
+		set.String("config-profile", profile, "")
+
+		var cfg config
+		l := Loader{CLI: cli.NewContext(app, set, nil), Config: &cfg}
+		_, err := l.Load()
+		return cfg, err
+	}
+
+	// Errors name the file the option was set in
+	_, err := load(&cli.StringSlice{base, override}, "linux")
+	assert.EqualError(t, err, "The config option `priority` in "+override+" must be a whole number, not \"high\"")
+
+	// Later files override earlier ones, and profiles are merged across them
+	override = writeConfigFileNamed(t, "override.yml", "build-path: /mnt/builds\npriority: 2\nprofiles:\n  linux:\n    token: linux-token\n")
+	cfg, err := load(&cli.StringSlice{base, override}, "linux")
+	require.NoError(t, err)
+	assert.Equal(t, config{
+		Config:    []string{base, override},
+		Token:     "linux-token",
+		Tags:      "queue=linux,os=linux",
+		BuildPath: "/mnt/builds",
+		Priority:  2,
+	}, cfg)
+
+	// The files can be given as a comma-separated list, and the order's
+	// what matters
+	cfg, err = load(&cli.StringSlice{override + "," + base}, "")
+	require.NoError(t, err)
+	assert.Equal(t, "base-token", cfg.Token)
+	assert.Equal(t, "/var/lib/buildkite/builds", cfg.BuildPath)
+	assert.Equal(t, 1, cfg.Priority)
+
+	_, err = load(&cli.StringSlice{base, filepath.Join(t.TempDir(), "missing.cfg")}, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,64 @@
+package env
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The formats an environment can be dumped in and restored from
+const (
+	// A JSON object of string keys and values
+	DumpFormatJSON = "json"
+
+	// KEY=VALUE entries each terminated by a NUL byte, like `env -0` and
+	// /proc/<pid>/environ. NUL can't appear in environment variables, so
+	// this is unambiguous and easy to consume from shell tools.
+	DumpFormatNullDelimited = "null-delimited"
+)
+
+// DumpFormats are the formats that Dump and Restore support
+var DumpFormats = []string{DumpFormatJSON, DumpFormatNullDelimited}
+
+// Dump serializes the complete environment in the given format, preserving
+// values with newlines and other characters that FromExport can't handle
+func (e Environment) Dump(format string) ([]byte, error) {
+	switch format {
+	case DumpFormatJSON:
+		return e.ToJSON()
+	case DumpFormatNullDelimited:
+		return e.ToNullDelimited(), nil
+	default:
+		return nil, fmt.Errorf("Unknown environment format %q, must be one of %s", format, strings.Join(DumpFormats, ", "))
+	}
+}
+
+// Restore creates a new environment from data written by Dump in the given
+// format
+func Restore(data []byte, format string) (Environment, error) {
+	switch format {
+	case DumpFormatJSON:
+		return FromJSON(data)
+	case DumpFormatNullDelimited:
+		return FromNullDelimited(data), nil
+	default:
+		return nil, fmt.Errorf("Unknown environment format %q, must be one of %s", format, strings.Join(DumpFormats, ", "))
+	}
+}
+
+// FromNullDelimited creates a new environment from KEY=VALUE entries that are
+// each terminated by a NUL byte
+func FromNullDelimited(data []byte) Environment {
+	entries := strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+	return FromSlice(entries)
+}
+
+// ToNullDelimited returns the environment as sorted KEY=VALUE entries that are
+// each terminated by a NUL byte
+func (e Environment) ToNullDelimited() []byte {
+	var b strings.Builder
+	for _, entry := range e.ToSlice() {
+		b.WriteString(entry)
+		b.WriteByte(0)
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,51 @@
+package env
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpAndRestoreRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	env := FromSlice([]string{})
+	env.Set("MULTILINE", "one\ntwo\r\nthree\n")
+	env.Set("QUOTES", `it's "quoted" \ =ok`)
+	env.Set("EQUALS", "a=b=c")
+	env.Set("EMPTY", "")
+
+	for _, format := range DumpFormats {
+		format := format
+		t.Run(format, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := env.Dump(format)
+			require.NoError(t, err)
+
+			restored, err := Restore(data, format)
+			require.NoError(t, err)
+
+			assert.Equal(t, env, restored)
+		})
+	}
+}
+
+func TestToNullDelimited(t *testing.T) {
+	t.Parallel()
+
+	env := FromSlice([]string{"LLAMAS=rock", "ALPACAS=are\nok"})
+
+	assert.Equal(t, "ALPACAS=are\nok\x00LLAMAS=rock\x00", string(env.ToNullDelimited()))
+}
+
+func TestDumpAndRestoreRejectUnknownFormats(t *testing.T) {
+	t.Parallel()
+
+	_, err := New().Dump("yaml")
+	assert.Error(t, err)
+
+	_, err = Restore([]byte{}, "yaml")
+	assert.Error(t, err)
+}
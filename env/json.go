@@ -0,0 +1,31 @@
+package env
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// The byte order mark that PowerShell 5 puts at the start of UTF-8 files
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// FromJSON creates a new environment from a JSON object of string keys and
+// values, as written by `buildkite-agent env dump`. Unlike FromExport, this
+// preserves values containing newlines, quotes and any other characters.
+func FromJSON(data []byte) (Environment, error) {
+	var vars map[string]string
+	if err := json.Unmarshal(bytes.TrimPrefix(data, utf8BOM), &vars); err != nil {
+		return nil, err
+	}
+
+	env := make(Environment, len(vars))
+	for k, v := range vars {
+		env.Set(k, v)
+	}
+
+	return env, nil
+}
+
+// ToJSON returns the environment as a JSON object, with the keys sorted
+func (e Environment) ToJSON() ([]byte, error) {
+	return json.Marshal(map[string]string(e))
+}
@@ -0,0 +1,43 @@
+package env
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONRoundTripsUnusualValues(t *testing.T) {
+	t.Parallel()
+
+	env := FromSlice([]string{})
+	env.Set("MULTILINE", "one\ntwo\r\nthree\n")
+	env.Set("QUOTES", `it's "quoted" \ =ok`)
+	env.Set("EMPTY", "")
+	env.Set("BASH_FUNC_llamas%%", "() {  echo rock\n}")
+
+	data, err := env.ToJSON()
+	require.NoError(t, err)
+
+	restored, err := FromJSON(data)
+	require.NoError(t, err)
+
+	assert.Equal(t, env, restored)
+}
+
+func TestFromJSONIgnoresByteOrderMark(t *testing.T) {
+	t.Parallel()
+
+	env, err := FromJSON([]byte("\xEF\xBB\xBF{\"LLAMAS\":\"rock\"}\r\n"))
+	require.NoError(t, err)
+
+	value, _ := env.Get("LLAMAS")
+	assert.Equal(t, "rock", value)
+}
+
+func TestFromJSONReturnsErrorForInvalidJSON(t *testing.T) {
+	t.Parallel()
+
+	_, err := FromJSON([]byte("LLAMAS=rock"))
+	assert.Error(t, err)
+}
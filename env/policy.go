@@ -0,0 +1,101 @@
+package env
+
+import (
+	"path"
+	"sort"
+)
+
+// DefaultProtectedVars are environment variables that a job shouldn't be able
+// to override, because doing so would let it change how the agent, git or
+// docker behave on the host. Entries are glob patterns as used by path.Match.
+var DefaultProtectedVars = []string{
+	// Dynamic linker injection
+	`LD_PRELOAD`,
+	`LD_LIBRARY_PATH`,
+	`LD_AUDIT`,
+	`DYLD_INSERT_LIBRARIES`,
+	`DYLD_LIBRARY_PATH`,
+	`DYLD_FRAMEWORK_PATH`,
+
+	// Binary and shell startup resolution
+	`PATH`,
+	`BASH_ENV`,
+	`ENV`,
+
+	// Git transport and execution
+	`GIT_SSH`,
+	`GIT_SSH_COMMAND`,
+	`GIT_PROXY_COMMAND`,
+	`GIT_EXEC_PATH`,
+	`GIT_TEMPLATE_DIR`,
+	`GIT_CONFIG_*`,
+
+	// Docker daemon and credentials
+	`DOCKER_HOST`,
+	`DOCKER_CONFIG`,
+	`DOCKER_CERT_PATH`,
+	`DOCKER_TLS_VERIFY`,
+
+	// Agent internals that are only meant to be set by the agent itself
+	`BUILDKITE_BOOTSTRAP_PHASES`,
+	`BUILDKITE_AGENT_PROFILE`,
+	`BUILDKITE_CANCEL_SIGNAL`,
+	`BUILDKITE_PTY`,
+	`BUILDKITE_TRACING_BACKEND`,
+}
+
+// Policy decides which environment variables a job is allowed to set. Any
+// variable matching one of the Protected patterns is rejected, unless it
+// also matches one of the Allowed patterns.
+type Policy struct {
+	Protected []string
+	Allowed   []string
+}
+
+// NewPolicy returns a Policy protecting DefaultProtectedVars, with the given
+// patterns allowed as exceptions
+func NewPolicy(allowed []string) Policy {
+	return Policy{
+		Protected: DefaultProtectedVars,
+		Allowed:   allowed,
+	}
+}
+
+// IsProtected returns whether the policy rejects the given variable name
+func (p Policy) IsProtected(name string) bool {
+	return matchesAny(p.Protected, name) && !matchesAny(p.Allowed, name)
+}
+
+// Enforce removes any variables rejected by the policy from the given map,
+// and returns a sorted list of the names that were removed
+func (p Policy) Enforce(vars map[string]string) []string {
+	var rejected []string
+
+	for name := range vars {
+		if p.IsProtected(name) {
+			rejected = append(rejected, name)
+		}
+	}
+
+	for _, name := range rejected {
+		delete(vars, name)
+	}
+
+	sort.Strings(rejected)
+
+	return rejected
+}
+
+func matchesAny(patterns []string, name string) bool {
+	name = normalizeKeyName(name)
+
+	for _, pattern := range patterns {
+		// path.ErrBadPattern is the only error returned by path.Match, and a
+		// bad pattern can't match anything
+		if matched, _ := path.Match(normalizeKeyName(pattern), name); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,39 @@
+package env
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyEnforceRemovesProtectedVars(t *testing.T) {
+	t.Parallel()
+
+	vars := map[string]string{
+		"LD_PRELOAD":            "/tmp/evil.so",
+		"PATH":                  "/tmp/bin",
+		"GIT_SSH_COMMAND":       "ssh -o ProxyCommand=evil",
+		"GIT_CONFIG_GLOBAL":     "/tmp/gitconfig",
+		"BUILDKITE_MESSAGE":     "hello",
+		"MY_APPLICATION_SECRET": "llamas",
+	}
+
+	rejected := NewPolicy(nil).Enforce(vars)
+
+	assert.Equal(t, []string{"GIT_CONFIG_GLOBAL", "GIT_SSH_COMMAND", "LD_PRELOAD", "PATH"}, rejected)
+	assert.Equal(t, map[string]string{
+		"BUILDKITE_MESSAGE":     "hello",
+		"MY_APPLICATION_SECRET": "llamas",
+	}, vars)
+}
+
+func TestPolicyAllowedExceptions(t *testing.T) {
+	t.Parallel()
+
+	policy := NewPolicy([]string{"PATH", "DOCKER_*"})
+
+	assert.False(t, policy.IsProtected("PATH"))
+	assert.False(t, policy.IsProtected("DOCKER_HOST"))
+	assert.True(t, policy.IsProtected("LD_PRELOAD"))
+	assert.False(t, policy.IsProtected("BUILDKITE_BRANCH"))
+}
@@ -0,0 +1,150 @@
+package env
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+// The types an environment variable can be declared as
+const (
+	SchemaTypeString = "string"
+	SchemaTypeInt    = "int"
+	SchemaTypeNumber = "number"
+	SchemaTypeBool   = "bool"
+	SchemaTypeURL    = "url"
+)
+
+// Schema declares the environment variables a job needs, by name, so they can
+// be checked before its command runs
+type Schema map[string]*VarSchema
+
+// VarSchema is what an environment variable has to look like. Variables are
+// required unless they're optional, and are strings unless they have a type.
+type VarSchema struct {
+	Type     string `yaml:"type,omitempty" json:"type,omitempty"`
+	Pattern  string `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+	Optional bool   `yaml:"optional,omitempty" json:"optional,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// ParseSchema parses a schema written in YAML or JSON, like:
+//
+//	DEPLOY_TARGET:
+//	  pattern: ^(staging|production)$
+//	REPLICAS:
+//	  type: int
+func ParseSchema(data []byte) (Schema, error) {
+	var s Schema
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("Invalid environment schema: %v", err)
+	}
+
+	for name, v := range s {
+		if v == nil {
+			v = &VarSchema{}
+			s[name] = v
+		}
+
+		switch v.Type {
+		case "":
+			v.Type = SchemaTypeString
+		case SchemaTypeString, SchemaTypeInt, SchemaTypeNumber, SchemaTypeBool, SchemaTypeURL:
+		default:
+			return nil, fmt.Errorf("Invalid environment schema: %s has unknown type %q", name, v.Type)
+		}
+
+		if v.Pattern != "" {
+			var err error
+			if v.pattern, err = regexp.Compile(v.Pattern); err != nil {
+				return nil, fmt.Errorf("Invalid environment schema: %s has an invalid pattern: %v", name, err)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// Merge returns a schema with the variables from both schemas, where other's
+// declarations replace this one's
+func (s Schema) Merge(other Schema) Schema {
+	merged := Schema{}
+	for name, v := range s {
+		merged[name] = v
+	}
+	for name, v := range other {
+		merged[name] = v
+	}
+	return merged
+}
+
+// Validate checks the environment against the schema, and returns an error
+// describing every variable that doesn't match it
+func (s Schema) Validate(e Environment) error {
+	var problems []string
+
+	for name, v := range s {
+		value, ok := e.Get(name)
+		if !ok || value == "" {
+			if !v.Optional {
+				problems = append(problems, fmt.Sprintf("%s is required, but isn't set", name))
+			}
+			continue
+		}
+
+		if problem := v.check(value); problem != "" {
+			problems = append(problems, fmt.Sprintf("%s %s", name, problem))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.Strings(problems)
+	return &SchemaError{Problems: problems}
+}
+
+// check returns what's wrong with a value, or an empty string if it's valid.
+// Values aren't included, since they could be secrets.
+func (v *VarSchema) check(value string) string {
+	switch v.Type {
+	case SchemaTypeInt:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "must be an integer"
+		}
+	case SchemaTypeNumber:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "must be a number"
+		}
+	case SchemaTypeBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "must be true or false"
+		}
+	case SchemaTypeURL:
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			return "must be a URL"
+		}
+	}
+
+	if v.pattern != nil && !v.pattern.MatchString(value) {
+		return fmt.Sprintf("must match %s", v.Pattern)
+	}
+
+	return ""
+}
+
+// SchemaError is returned for environments that don't match their schema
+type SchemaError struct {
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return "The job's environment doesn't match its schema:\n  " + strings.Join(e.Problems, "\n  ")
+}
@@ -0,0 +1,85 @@
+package env
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	t.Parallel()
+
+	schema, err := ParseSchema([]byte(`
+DEPLOY_TARGET:
+  pattern: ^(staging|production)$
+REPLICAS:
+  type: int
+ENDPOINT:
+  type: url
+DRY_RUN:
+  type: bool
+  optional: true
+RATIO:
+  type: number
+  optional: true
+`))
+	require.NoError(t, err)
+
+	assert.NoError(t, schema.Validate(FromSlice([]string{
+		"DEPLOY_TARGET=staging",
+		"REPLICAS=3",
+		"ENDPOINT=https://example.com/deploy",
+	})))
+
+	err = schema.Validate(FromSlice([]string{
+		"DEPLOY_TARGET=qa",
+		"REPLICAS=three",
+		"DRY_RUN=maybe",
+		"RATIO=0.5",
+	}))
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		"DEPLOY_TARGET must match ^(staging|production)$",
+		"DRY_RUN must be true or false",
+		"ENDPOINT is required, but isn't set",
+		"REPLICAS must be an integer",
+	}, err.(*SchemaError).Problems)
+}
+
+func TestParseSchemaAcceptsJSON(t *testing.T) {
+	t.Parallel()
+
+	schema, err := ParseSchema([]byte(`{"REPLICAS": {"type": "int"}, "TOKEN": null}`))
+	require.NoError(t, err)
+
+	assert.Equal(t, SchemaTypeInt, schema["REPLICAS"].Type)
+	assert.Equal(t, SchemaTypeString, schema["TOKEN"].Type)
+	assert.EqualError(t, schema.Validate(New()),
+		"The job's environment doesn't match its schema:\n  REPLICAS is required, but isn't set\n  TOKEN is required, but isn't set")
+}
+
+func TestParseSchemaErrors(t *testing.T) {
+	t.Parallel()
+
+	for data, expected := range map[string]string{
+		`REPLICAS: {type: integer}`: `Invalid environment schema: REPLICAS has unknown type "integer"`,
+		`NAME: {pattern: "("}`:      "Invalid environment schema: NAME has an invalid pattern: error parsing regexp: missing closing ): `(`",
+	} {
+		_, err := ParseSchema([]byte(data))
+		assert.EqualError(t, err, expected)
+	}
+}
+
+func TestSchemaMergePrefersOther(t *testing.T) {
+	t.Parallel()
+
+	step, err := ParseSchema([]byte(`{"REPLICAS": {"optional": true}, "REGION": {}}`))
+	require.NoError(t, err)
+	agent, err := ParseSchema([]byte(`{"REPLICAS": {"type": "int"}}`))
+	require.NoError(t, err)
+
+	merged := step.Merge(agent)
+	assert.False(t, merged["REPLICAS"].Optional)
+	assert.Contains(t, merged, "REGION")
+}
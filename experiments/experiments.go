@@ -1,5 +1,15 @@
 package experiments
 
+import (
+	"sort"
+	"strings"
+)
+
+// JobEnvVar is the environment variable a step can set to a comma separated
+// list of experiments to opt in to for just that job. Only experiments the
+// agent has been configured to allow are enabled.
+const JobEnvVar = "BUILDKITE_JOB_EXPERIMENTS"
+
 var experiments = make(map[string]bool)
 
 // Enable a particular experiment in the agent
@@ -17,7 +27,7 @@ func IsEnabled(key string) bool {
 	return experiments[key] // map[T]bool returns false for missing keys
 }
 
-// Enabled returns the keys of all the enabled experiments
+// Enabled returns the keys of all the enabled experiments, sorted
 func Enabled() []string {
 	var keys []string
 	for key, enabled := range experiments {
@@ -25,5 +35,33 @@ func Enabled() []string {
 			keys = append(keys, key)
 		}
 	}
+	sort.Strings(keys)
 	return keys
 }
+
+// FilterAllowed splits a comma separated list of requested experiments into
+// those that are in the allowlist, and those that aren't
+func FilterAllowed(requested string, allowlist []string) (allowed []string, rejected []string) {
+	for _, key := range strings.Split(requested, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+
+		if contains(allowlist, key) {
+			allowed = append(allowed, key)
+		} else {
+			rejected = append(rejected, key)
+		}
+	}
+	return allowed, rejected
+}
+
+func contains(list []string, key string) bool {
+	for _, item := range list {
+		if item == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+package experiments
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterAllowed(t *testing.T) {
+	allowed, rejected := FilterAllowed(" git-mirrors,, ansi-timestamps ,flock-file-locks", []string{"git-mirrors", "flock-file-locks"})
+
+	assert.Equal(t, []string{"git-mirrors", "flock-file-locks"}, allowed)
+	assert.Equal(t, []string{"ansi-timestamps"}, rejected)
+}
+
+func TestFilterAllowedWithNothingRequested(t *testing.T) {
+	allowed, rejected := FilterAllowed("", []string{"git-mirrors"})
+
+	assert.Empty(t, allowed)
+	assert.Empty(t, rejected)
+}
@@ -3,7 +3,10 @@ module github.com/buildkite/agent/v3
 go 1.18
 
 require (
+	filippo.io/age v1.0.0
+	github.com/BurntSushi/toml v1.2.1
 	github.com/DataDog/datadog-go/v5 v5.1.1
+	github.com/Microsoft/go-winio v0.5.1
 	github.com/aws/aws-sdk-go v1.44.56
 	github.com/buildkite/bintest/v3 v3.1.0
 	github.com/buildkite/interpolate v0.0.0-20200526001904-07f35b4ae251
@@ -11,6 +14,8 @@ require (
 	github.com/buildkite/yaml v0.0.0-20210326113714-4a3f40911396
 	github.com/creack/pty v1.1.18
 	github.com/denisbrodbeck/machineid v1.0.0
+	github.com/dop251/goja v0.0.0-20230605162241-28ee0ee714f3
+	github.com/dustin/go-humanize v1.0.0
 	github.com/gofrs/flock v0.8.1
 	github.com/google/go-querystring v0.0.0-20170111101155-53e6ce116135
 	github.com/mattn/go-zglob v0.0.0-20180803001819-2ea3427bfa53
@@ -26,6 +31,7 @@ require (
 	github.com/stretchr/testify v1.7.3
 	github.com/urfave/cli v1.22.9
 	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+	golang.org/x/net v0.0.0-20220624214902-1bab6f366d9e
 	golang.org/x/oauth2 v0.0.0-20220622183110-fd043fe589d2
 	golang.org/x/sys v0.0.0-20220624220833-87e55d714810
 	google.golang.org/api v0.86.0
@@ -34,7 +40,6 @@ require (
 
 require (
 	cloud.google.com/go/compute v1.7.0
-	github.com/buildkite/roko v1.0.0
 	go.opentelemetry.io/contrib/propagators/aws v1.7.0
 	go.opentelemetry.io/contrib/propagators/b3 v1.7.0
 	go.opentelemetry.io/contrib/propagators/jaeger v1.7.0
@@ -51,18 +56,19 @@ require (
 	github.com/DataDog/datadog-agent/pkg/obfuscate v0.0.0-20211129110424-6491aa3bf583 // indirect
 	github.com/DataDog/datadog-go v4.8.2+incompatible // indirect
 	github.com/DataDog/sketches-go v1.2.1 // indirect
-	github.com/Microsoft/go-winio v0.5.1 // indirect
 	github.com/cenkalti/backoff/v4 v4.1.3 // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.0-20190314233015-f79a8a8ca69d // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dgraph-io/ristretto v0.1.0 // indirect
-	github.com/dustin/go-humanize v1.0.0 // indirect
+	github.com/dlclark/regexp2 v1.7.0 // indirect
 	github.com/go-logr/logr v1.2.3 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
 	github.com/golang/glog v1.0.0 // indirect
 	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/googleapis/enterprise-certificate-proxy v0.1.0 // indirect
 	github.com/googleapis/gax-go/v2 v2.4.0 // indirect
@@ -83,9 +89,8 @@ require (
 	go.opentelemetry.io/proto/otlp v0.16.0 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
-	golang.org/x/net v0.0.0-20220624214902-1bab6f366d9e // indirect
 	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211 // indirect
-	golang.org/x/text v0.3.7 // indirect
+	golang.org/x/text v0.3.8 // indirect
 	golang.org/x/time v0.0.0-20211116232009-f0f3c7e86c11 // indirect
 	golang.org/x/tools v0.1.8-0.20211029000441-d6a9af8af023 // indirect
 	golang.org/x/xerrors v0.0.0-20220609144429-65e65417b02f // indirect
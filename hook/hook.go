@@ -26,3 +26,18 @@ func Find(hookDir string, name string) (string, error) {
 	// For example, os.IfNotExist(err) does not handle wrapped errors.
 	return "", os.ErrNotExist
 }
+
+// FindInWSL is Find for a bootstrap inside WSL that's been told to run
+// Windows hooks, which it can through interop. It falls back to a batch or
+// PowerShell hook if there isn't a native one.
+func FindInWSL(hookDir string, name string) (string, error) {
+	if p, err := Find(hookDir, name); err == nil {
+		return p, nil
+	}
+	for _, ext := range []string{".bat", ".cmd", ".ps1"} {
+		if p := filepath.Join(hookDir, name+ext); utils.FileExists(p) {
+			return p, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
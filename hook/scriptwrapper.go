@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"text/template"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
@@ -28,11 +29,11 @@ SET > "{{.AfterEnvFileName}}"
 EXIT %BUILDKITE_HOOK_EXIT_STATUS%`
 
 	powershellScript = `$ErrorActionPreference = "STOP"
-Get-ChildItem Env: | Foreach-Object {"$($_.Name)=$($_.Value)"} | Set-Content "{{.BeforeEnvFileName}}"
-{{.PathToHook}}
+Get-ChildItem Env: | Foreach-Object {"$($_.Name)=$($_.Value)"} | Set-Content {{pwshQuote .BeforeEnvFileName}}
+& {{pwshQuote .PathToHook}}
 if ($LASTEXITCODE -eq $null) {$Env:BUILDKITE_HOOK_EXIT_STATUS = 0} else {$Env:BUILDKITE_HOOK_EXIT_STATUS = $LASTEXITCODE}
 $Env:BUILDKITE_HOOK_WORKING_DIR = $PWD | Select-Object -ExpandProperty Path
-Get-ChildItem Env: | Foreach-Object {"$($_.Name)=$($_.Value)"} | Set-Content "{{.AfterEnvFileName}}"
+Get-ChildItem Env: | Foreach-Object {"$($_.Name)=$($_.Value)"} | Set-Content {{pwshQuote .AfterEnvFileName}}
 exit $Env:BUILDKITE_HOOK_EXIT_STATUS`
 
 	bashScript = `export -p > "{{.BeforeEnvFileName}}"
@@ -40,19 +41,59 @@ exit $Env:BUILDKITE_HOOK_EXIT_STATUS`
 export BUILDKITE_HOOK_EXIT_STATUS=$?
 export BUILDKITE_HOOK_WORKING_DIR=$PWD
 export -p > "{{.AfterEnvFileName}}"
+exit $BUILDKITE_HOOK_EXIT_STATUS`
+
+	// These versions capture the environment with `buildkite-agent env dump`,
+	// which unlike `export -p` and friends can't be confused by values that
+	// contain newlines or other unusual characters
+	batchShimScript = `@echo off
+SETLOCAL ENABLEDELAYEDEXPANSION
+CALL "{{.ShimPath}}" env dump --format json > "{{.BeforeEnvFileName}}"
+CALL "{{.PathToHook}}"
+SET BUILDKITE_HOOK_EXIT_STATUS=!ERRORLEVEL!
+SET BUILDKITE_HOOK_WORKING_DIR=%CD%
+CALL "{{.ShimPath}}" env dump --format json > "{{.AfterEnvFileName}}"
+EXIT %BUILDKITE_HOOK_EXIT_STATUS%`
+
+	powershellShimScript = `$ErrorActionPreference = "STOP"
+& {{pwshQuote .ShimPath}} env dump --format json | Set-Content -Encoding UTF8 {{pwshQuote .BeforeEnvFileName}}
+& {{pwshQuote .PathToHook}}
+if ($LASTEXITCODE -eq $null) {$Env:BUILDKITE_HOOK_EXIT_STATUS = 0} else {$Env:BUILDKITE_HOOK_EXIT_STATUS = $LASTEXITCODE}
+$Env:BUILDKITE_HOOK_WORKING_DIR = $PWD | Select-Object -ExpandProperty Path
+& {{pwshQuote .ShimPath}} env dump --format json | Set-Content -Encoding UTF8 {{pwshQuote .AfterEnvFileName}}
+exit $Env:BUILDKITE_HOOK_EXIT_STATUS`
+
+	bashShimScript = `"{{.ShimPath}}" env dump --format json > "{{.BeforeEnvFileName}}"
+. "{{.PathToHook}}"
+export BUILDKITE_HOOK_EXIT_STATUS=$?
+export BUILDKITE_HOOK_WORKING_DIR=$PWD
+"{{.ShimPath}}" env dump --format json > "{{.AfterEnvFileName}}"
 exit $BUILDKITE_HOOK_EXIT_STATUS`
 )
 
 var (
+	// PowerShell expands variables in double quoted strings, so paths are
+	// single quoted, which only needs quotes themselves to be escaped
+	pwshFuncs = template.FuncMap{
+		"pwshQuote": func(s string) string {
+			return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+		},
+	}
+
 	batchScriptTmpl      = template.Must(template.New("batch").Parse(batchScript))
-	powershellScriptTmpl = template.Must(template.New("pwsh").Parse(powershellScript))
+	powershellScriptTmpl = template.Must(template.New("pwsh").Funcs(pwshFuncs).Parse(powershellScript))
 	bashScriptTmpl       = template.Must(template.New("bash").Parse(bashScript))
+
+	batchShimScriptTmpl      = template.Must(template.New("batch-shim").Parse(batchShimScript))
+	powershellShimScriptTmpl = template.Must(template.New("pwsh-shim").Funcs(pwshFuncs).Parse(powershellShimScript))
+	bashShimScriptTmpl       = template.Must(template.New("bash-shim").Parse(bashShimScript))
 )
 
 type scriptTemplateInput struct {
 	BeforeEnvFileName string
 	AfterEnvFileName  string
 	PathToHook        string
+	ShimPath          string
 }
 
 type HookScriptChanges struct {
@@ -93,7 +134,10 @@ type scriptWrapperOpt func(*ScriptWrapper)
 // after it
 type ScriptWrapper struct {
 	hookPath      string
+	shimPath      string
 	os            string
+	toHookPath    func(string) string
+	fromHookPath  func(string) string
 	scriptFile    *os.File
 	beforeEnvFile *os.File
 	afterEnvFile  *os.File
@@ -105,6 +149,29 @@ func WithHookPath(path string) scriptWrapperOpt {
 	}
 }
 
+// WithShimPath sets the path to a buildkite-agent binary that's used to dump
+// the environment before and after the hook. Without it, the environment is
+// captured with the shell's own builtins, which mangle multiline values.
+func WithShimPath(path string) scriptWrapperOpt {
+	return func(wrap *ScriptWrapper) {
+		wrap.shimPath = path
+	}
+}
+
+// WithPathTranslation sets functions that translate paths into and out of the
+// environment the hook runs in, for when that's not the bootstrap's own, like
+// a WSL distribution
+func WithPathTranslation(toHook, fromHook func(string) string) scriptWrapperOpt {
+	return func(wrap *ScriptWrapper) {
+		if toHook != nil {
+			wrap.toHookPath = toHook
+		}
+		if fromHook != nil {
+			wrap.fromHookPath = fromHook
+		}
+	}
+}
+
 func WithOS(os string) scriptWrapperOpt {
 	return func(wrap *ScriptWrapper) {
 		wrap.os = os
@@ -115,7 +182,9 @@ func WithOS(os string) scriptWrapperOpt {
 // Writes temporary files to the filesystem.
 func NewScriptWrapper(opts ...scriptWrapperOpt) (*ScriptWrapper, error) {
 	wrap := &ScriptWrapper{
-		os: runtime.GOOS,
+		os:           runtime.GOOS,
+		toHookPath:   func(path string) string { return path },
+		fromHookPath: func(path string) string { return path },
 	}
 
 	for _, o := range opts {
@@ -135,7 +204,7 @@ func NewScriptWrapper(opts ...scriptWrapperOpt) (*ScriptWrapper, error) {
 
 	// we use bash hooks for scripts with no extension, otherwise on windows
 	// we probably need a .bat extension
-	if filepath.Ext(wrap.hookPath) == ".ps1" {
+	if strings.EqualFold(filepath.Ext(wrap.hookPath), ".ps1") {
 		isPwshHook = true
 		scriptFileName += ".ps1"
 	} else if filepath.Ext(wrap.hookPath) == "" {
@@ -175,19 +244,25 @@ func NewScriptWrapper(opts ...scriptWrapperOpt) (*ScriptWrapper, error) {
 	}
 
 	tmplInput := scriptTemplateInput{
-		BeforeEnvFileName: wrap.beforeEnvFile.Name(),
-		AfterEnvFileName:  wrap.afterEnvFile.Name(),
-		PathToHook:        absolutePathToHook,
+		BeforeEnvFileName: wrap.toHookPath(wrap.beforeEnvFile.Name()),
+		AfterEnvFileName:  wrap.toHookPath(wrap.afterEnvFile.Name()),
+		PathToHook:        wrap.toHookPath(absolutePathToHook),
+		ShimPath:          wrap.toHookPath(wrap.shimPath),
+	}
+
+	batchTmpl, powershellTmpl, bashTmpl := batchScriptTmpl, powershellScriptTmpl, bashScriptTmpl
+	if wrap.shimPath != "" {
+		batchTmpl, powershellTmpl, bashTmpl = batchShimScriptTmpl, powershellShimScriptTmpl, bashShimScriptTmpl
 	}
 
 	// Create the hook runner code
 	buf := &bytes.Buffer{}
 	if isWindows && !isBashHook && !isPwshHook {
-		batchScriptTmpl.Execute(buf, tmplInput)
+		batchTmpl.Execute(buf, tmplInput)
 	} else if isWindows && isPwshHook {
-		powershellScriptTmpl.Execute(buf, tmplInput)
+		powershellTmpl.Execute(buf, tmplInput)
 	} else {
-		bashScriptTmpl.Execute(buf, tmplInput)
+		bashTmpl.Execute(buf, tmplInput)
 	}
 	script := buf.String()
 
@@ -230,8 +305,27 @@ func (wrap *ScriptWrapper) Changes() (HookScriptChanges, error) {
 		return HookScriptChanges{}, fmt.Errorf("Failed to read \"%s\" (%s)", wrap.afterEnvFile.Name(), err)
 	}
 
-	beforeEnv := env.FromExport(string(beforeEnvContents))
-	afterEnv := env.FromExport(string(afterEnvContents))
+	var beforeEnv, afterEnv env.Environment
+	if wrap.shimPath != "" {
+		// If the hook exited early, the after environment will never have
+		// been written
+		if len(bytes.TrimSpace(afterEnvContents)) == 0 {
+			return HookScriptChanges{}, &HookExitError{hookPath: wrap.hookPath}
+		}
+
+		beforeEnv, err = env.FromJSON(beforeEnvContents)
+		if err != nil {
+			return HookScriptChanges{}, fmt.Errorf("Failed to parse \"%s\" (%s)", wrap.beforeEnvFile.Name(), err)
+		}
+
+		afterEnv, err = env.FromJSON(afterEnvContents)
+		if err != nil {
+			return HookScriptChanges{}, fmt.Errorf("Failed to parse \"%s\" (%s)", wrap.afterEnvFile.Name(), err)
+		}
+	} else {
+		beforeEnv = env.FromExport(string(beforeEnvContents))
+		afterEnv = env.FromExport(string(afterEnvContents))
+	}
 
 	if afterEnv.Length() == 0 {
 		return HookScriptChanges{}, &HookExitError{hookPath: wrap.hookPath}
@@ -250,6 +344,10 @@ func (wrap *ScriptWrapper) Changes() (HookScriptChanges, error) {
 		}
 	}
 
+	if afterWd != "" {
+		afterWd = wrap.fromHookPath(afterWd)
+	}
+
 	diff.Remove(hookExitStatusEnv)
 	diff.Remove(hookWorkingDirEnv)
 
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
@@ -14,6 +15,22 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+func TestMain(m *testing.M) {
+	// When the tests use the test binary as the env shim, act like
+	// `buildkite-agent env dump`
+	if len(os.Args) > 2 && os.Args[1] == "env" && os.Args[2] == "dump" {
+		out, err := env.FromSlice(os.Environ()).ToJSON()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
 func TestRunningHookDetectsChangedEnvironment(t *testing.T) {
 	t.Parallel()
 
@@ -123,16 +140,47 @@ func TestHookScriptsAreGeneratedCorrectlyOnWindowsPowershell(t *testing.T) {
 	defer wrapper.Close()
 
 	scriptTemplate := `$ErrorActionPreference = "STOP"
-Get-ChildItem Env: | Foreach-Object {"$($_.Name)=$($_.Value)"} | Set-Content "%s"
-%s
+Get-ChildItem Env: | Foreach-Object {"$($_.Name)=$($_.Value)"} | Set-Content '%s'
+& '%s'
 if ($LASTEXITCODE -eq $null) {$Env:BUILDKITE_HOOK_EXIT_STATUS = 0} else {$Env:BUILDKITE_HOOK_EXIT_STATUS = $LASTEXITCODE}
 $Env:BUILDKITE_HOOK_WORKING_DIR = $PWD | Select-Object -ExpandProperty Path
-Get-ChildItem Env: | Foreach-Object {"$($_.Name)=$($_.Value)"} | Set-Content "%s"
+Get-ChildItem Env: | Foreach-Object {"$($_.Name)=$($_.Value)"} | Set-Content '%s'
 exit $Env:BUILDKITE_HOOK_EXIT_STATUS`
 
 	assertScriptLike(t, scriptTemplate, hookFile.Name(), wrapper)
 }
 
+func TestPowershellHookPathsAreQuotedLiterally(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "it's $HOME")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hookPath := filepath.Join(dir, "environment.ps1")
+	assert.NoError(t, ioutil.WriteFile(hookPath, []byte(`Write-Output "Hello There!"`), 0o600))
+
+	wrapper, err := NewScriptWrapper(
+		WithHookPath(hookPath),
+		WithShimPath(`C:\Program Files\it's\buildkite-agent.exe`),
+		WithOS("windows"),
+	)
+	assert.NoError(t, err)
+	defer wrapper.Close()
+
+	contents, err := ioutil.ReadFile(wrapper.Path())
+	assert.NoError(t, err)
+
+	assert.Contains(t, string(contents), "& '"+strings.ReplaceAll(hookPath, "'", "''")+"'\n")
+	assert.Contains(t, string(contents), `& 'C:\Program Files\it''s\buildkite-agent.exe' env dump --format json`)
+
+	// The environment files are in the temp dir, which can have anything in
+	// its path too
+	for _, f := range []string{wrapper.beforeEnvFile.Name(), wrapper.afterEnvFile.Name()} {
+		assert.Contains(t, string(contents), "Set-Content -Encoding UTF8 '"+strings.ReplaceAll(f, "'", "''")+"'\n")
+	}
+}
+
 func TestHookScriptsAreGeneratedCorrectlyOnUnix(t *testing.T) {
 	t.Parallel()
 
@@ -227,7 +275,59 @@ func TestRunningHookDetectsChangedWorkingDirectory(t *testing.T) {
 	}
 }
 
-func newTestScriptWrapper(t *testing.T, script []string) *ScriptWrapper {
+func TestRunningHookWithShimPreservesUnusualValues(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Multiline values can't be set from batch scripts")
+	}
+
+	ctx := context.Background()
+	script := []string{
+		"#!/bin/bash",
+		"export MULTILINE=$'line one\\nline two\\n'",
+		"export QUOTES=\"it's \\\"quoted\\\" \\\\ =ok\"",
+		"llamas() { echo rock; }",
+		"export -f llamas",
+	}
+
+	wrapper := newTestScriptWrapper(t, script, WithShimPath(os.Args[0]))
+	defer wrapper.Close()
+
+	sh := shell.NewTestShell(t)
+
+	if err := sh.RunScript(ctx, wrapper.Path(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := wrapper.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "line one\nline two\n", changes.Diff.Added["MULTILINE"])
+	assert.Equal(t, `it's "quoted" \ =ok`, changes.Diff.Added["QUOTES"])
+	assert.Equal(t, "() {  echo rock\n}", changes.Diff.Added["BASH_FUNC_llamas%%"])
+}
+
+func TestHookWithShimThatExitsEarlyReturnsHookExitError(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Early exit is only tested with bash")
+	}
+
+	wrapper := newTestScriptWrapper(t, []string{"#!/bin/bash", "exit 3"}, WithShimPath(os.Args[0]))
+	defer wrapper.Close()
+
+	sh := shell.NewTestShell(t)
+	_ = sh.RunScript(context.Background(), wrapper.Path(), nil)
+
+	_, err := wrapper.Changes()
+	assert.IsType(t, &HookExitError{}, err)
+}
+
+func newTestScriptWrapper(t *testing.T, script []string, opts ...scriptWrapperOpt) *ScriptWrapper {
 	hookName := "hookwrapper"
 	if runtime.GOOS == "windows" {
 		hookName += ".bat"
@@ -243,7 +343,7 @@ func newTestScriptWrapper(t *testing.T, script []string) *ScriptWrapper {
 
 	hookFile.Close()
 
-	wrapper, err := NewScriptWrapper(WithHookPath(hookFile.Name()))
+	wrapper, err := NewScriptWrapper(append([]scriptWrapperOpt{WithHookPath(hookFile.Name())}, opts...)...)
 	assert.NoError(t, err)
 
 	return wrapper
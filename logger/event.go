@@ -0,0 +1,64 @@
+package logger
+
+// Event IDs identify log messages that monitoring tools might want to alert
+// on, such as in the Windows Event Log. Messages without one use the ID for
+// their level.
+const (
+	EventInfo    = 1
+	EventWarning = 2
+	EventError   = 3
+
+	EventAgentConnected        = 100
+	EventAgentConnectFailed    = 101
+	EventAgentDisconnected     = 102
+	EventAgentDisconnectFailed = 103
+	EventAgentSessionRevoked   = 104
+	EventAgentHeartbeatFailed  = 105
+
+	EventJobFailed        = 200
+	EventJobRefused       = 201
+	EventJobFailedToStart = 202
+	EventJobFinishFailed  = 203
+)
+
+// The key of the field with a message's event ID
+const eventIDKey = "event_id"
+
+// EventField returns a field with a message's event ID
+func EventField(id int) Field {
+	return IntField(eventIDKey, id)
+}
+
+// IsEventField returns whether a field is an event ID, which printers for
+// people can leave out
+func IsEventField(f Field) bool {
+	return f.Key() == eventIDKey
+}
+
+// eventID returns the event ID of a message, or the ID for its level
+func eventID(level Level, fields Fields) uint32 {
+	for _, f := range fields.Get(eventIDKey) {
+		if g, ok := f.(GenericField); ok {
+			if id, ok := g.value.(int); ok {
+				return uint32(id)
+			}
+		}
+	}
+
+	switch level {
+	case WARN:
+		return EventWarning
+	case ERROR, FATAL:
+		return EventError
+	}
+	return EventInfo
+}
+
+// MultiPrinter prints to each of its printers
+type MultiPrinter []Printer
+
+func (p MultiPrinter) Print(level Level, msg string, fields Fields) {
+	for _, printer := range p {
+		printer.Print(level, msg, fields)
+	}
+}
@@ -0,0 +1,38 @@
+package logger
+
+import (
+	"testing"
+)
+
+type recordingPrinter struct {
+	ids []uint32
+}
+
+func (p *recordingPrinter) Print(level Level, msg string, fields Fields) {
+	p.ids = append(p.ids, eventID(level, fields))
+}
+
+func TestEventIDs(t *testing.T) {
+	a, b := &recordingPrinter{}, &recordingPrinter{}
+
+	l := NewConsoleLogger(MultiPrinter{a, b}, func(int) {})
+	l.SetLevel(DEBUG)
+
+	l.Info("Llamas")
+	l.Warn("Alpacas")
+	l.Error("Camels")
+	l.WithFields(EventField(EventAgentConnected)).Info("Connected")
+	l.WithFields(StringField("agent", "llama"), EventField(EventJobFailed)).Warn("Failed")
+
+	expected := []uint32{EventInfo, EventWarning, EventError, EventAgentConnected, EventJobFailed}
+	for _, p := range []*recordingPrinter{a, b} {
+		if len(p.ids) != len(expected) {
+			t.Fatalf("Expected %v, got %v", expected, p.ids)
+		}
+		for i := range expected {
+			if p.ids[i] != expected[i] {
+				t.Fatalf("Expected %v, got %v", expected, p.ids)
+			}
+		}
+	}
+}
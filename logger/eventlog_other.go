@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package logger
+
+import "errors"
+
+// EventLogPrinter writes messages to the Windows Event Log, which is only
+// available on Windows
+type EventLogPrinter struct{}
+
+// NewEventLogPrinter returns an error, since there's no Windows Event Log
+func NewEventLogPrinter(source string) (*EventLogPrinter, error) {
+	return nil, errors.New("The Windows Event Log is only available on Windows")
+}
+
+func (p *EventLogPrinter) Print(level Level, msg string, fields Fields) {}
@@ -0,0 +1,63 @@
+//go:build windows
+// +build windows
+
+package logger
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// EventLogPrinter writes messages to the Windows Event Log, with event IDs so
+// monitoring tools can alert on them. Debug messages are left out.
+type EventLogPrinter struct {
+	log *eventlog.Log
+}
+
+// NewEventLogPrinter returns a printer that writes to the Windows Event Log as
+// the source, registering the source if it isn't already (which needs
+// Administrator rights the first time)
+func NewEventLogPrinter(source string) (*EventLogPrinter, error) {
+	err := eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil && !strings.Contains(err.Error(), "registry key already exists") {
+		return nil, err
+	}
+
+	log, err := eventlog.Open(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EventLogPrinter{log: log}, nil
+}
+
+func (p *EventLogPrinter) Print(level Level, msg string, fields Fields) {
+	if level == DEBUG {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, field := range fields {
+		if IsEventField(field) {
+			continue
+		}
+		b.WriteString("\r\n")
+		b.WriteString(field.Key())
+		b.WriteString("=")
+		b.WriteString(field.String())
+	}
+
+	id := eventID(level, fields)
+
+	// There's nowhere else to report failing to write to the event log
+	switch level {
+	case WARN:
+		_ = p.log.Warning(id, b.String())
+	case ERROR, FATAL:
+		_ = p.log.Error(id, b.String())
+	default:
+		_ = p.log.Info(id, b.String())
+	}
+}
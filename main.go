@@ -99,12 +99,51 @@ func main() {
 		},
 		{
 			Name:  "step",
-			Usage: "Get or update an attribute of a build step",
+			Usage: "Get or update an attribute of a build step, or set its outputs",
 			Subcommands: []cli.Command{
 				clicommand.StepGetCommand,
 				clicommand.StepUpdateCommand,
+				clicommand.StepSetOutputCommand,
 			},
 		},
+		{
+			Name:  "ctl",
+			Usage: "Manage a running agent through its control socket",
+			Subcommands: []cli.Command{
+				clicommand.CtlJobsCommand,
+				clicommand.CtlCancelCommand,
+				clicommand.CtlDebugCommand,
+				clicommand.CtlDrainCommand,
+				clicommand.CtlSchedulingCommand,
+			},
+		},
+		{
+			Name:  "env",
+			Usage: "Inspect the job environment",
+			Subcommands: []cli.Command{
+				clicommand.EnvDumpCommand,
+				clicommand.EnvInterpolateCommand,
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Inspect the agent's configuration",
+			Subcommands: []cli.Command{
+				clicommand.ConfigDumpCommand,
+				clicommand.ConfigSchemaCommand,
+			},
+		},
+		{
+			Name:  "tool",
+			Usage: "Install tools that jobs depend on",
+			Subcommands: []cli.Command{
+				clicommand.ToolInstallCommand,
+			},
+		},
+		clicommand.SimulateCommand,
+		clicommand.SplitCommand,
+		clicommand.DoctorCommand,
+		clicommand.CompletionCommand,
 		clicommand.BootstrapCommand,
 	}
 
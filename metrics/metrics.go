@@ -129,6 +129,20 @@ func (s *Scope) Count(name string, value int64, tags ...Tags) {
 	}
 }
 
+// Gauge records the current value of something.
+func (s *Scope) Gauge(name string, value float64, tags ...Tags) {
+	if s.c.client == nil {
+		return
+	}
+
+	mergedTags := s.mergeTags(tags...).StringSlice()
+	s.c.logger.Debug("Metrics gauge %s=%v %v", name, value, mergedTags)
+
+	if err := s.c.client.Gauge(name, value, mergedTags, 1); err != nil {
+		s.c.logger.Error("Metrics gauge failed: %v", err)
+	}
+}
+
 func (s *Scope) mergeTags(tagsSlice ...Tags) Tags {
 	merged := Tags{}
 	for k, v := range s.Tags {
@@ -0,0 +1,201 @@
+package process
+
+import (
+	"bytes"
+	"io"
+	"unicode/utf8"
+)
+
+// What a LineLimiter does with the rest of a line that's too long
+const (
+	// The rest of the line is wrapped onto continuation lines
+	LongLinesWrap = "wrap"
+
+	// The rest of the line is dropped
+	LongLinesTruncate = "truncate"
+)
+
+const (
+	// Starts the continuation lines of a wrapped line
+	LineContinuationMarker = "↳ "
+
+	// Ends a line that was truncated
+	LineTruncatedMarker = "… [line truncated]"
+
+	// The longest escape sequence that a line isn't cut in the middle of,
+	// like a color or a timestamp
+	maxEscapeSequenceLength = 64
+)
+
+// LineLimiter limits the length of the lines written through it, so that the
+// log viewer doesn't choke on lines megabytes long, like minified JavaScript
+// or base64 blobs. Lines aren't cut in the middle of a UTF-8 character or an
+// escape sequence, and wrapped lines are broken after a space near the end if
+// there's one. A carriage return starts the line again, like it does in a
+// terminal, so progress bars that redraw themselves aren't one long line.
+type LineLimiter struct {
+	w      io.Writer
+	max    int
+	policy string
+
+	// How many bytes of the current line have been written
+	length int
+
+	// Whether the rest of the current line is being dropped
+	dropping bool
+
+	// An escape sequence at the end of the last write that hadn't finished,
+	// which is held back until the next write finishes it
+	escape []byte
+}
+
+// NewLineLimiter returns a LineLimiter that writes to w, doing what the policy
+// says with lines longer than max bytes, either LongLinesWrap or
+// LongLinesTruncate
+func NewLineLimiter(w io.Writer, max int, policy string) *LineLimiter {
+	// Continuation lines need room for more than the marker
+	if min := 2 * len(LineContinuationMarker); max < min {
+		max = min
+	}
+
+	return &LineLimiter{
+		w:      w,
+		max:    max,
+		policy: policy,
+	}
+}
+
+func (l *LineLimiter) Write(data []byte) (int, error) {
+	in := data
+	if len(l.escape) > 0 {
+		in = append(l.escape, data...)
+	}
+
+	in, escape := splitUnfinishedEscape(in)
+	l.escape = append([]byte(nil), escape...)
+
+	out := make([]byte, 0, len(in))
+
+	for rest := in; len(rest) > 0; {
+		line := rest
+		if i := bytes.IndexAny(rest, "\r\n"); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+
+		// The newline or carriage return that ends the line, if it's
+		// ended in this write
+		content, end := line, []byte(nil)
+		if last := len(line) - 1; line[last] == '\n' || line[last] == '\r' {
+			content, end = line[:last], line[last:]
+		}
+
+		for {
+			if l.dropping {
+				if end != nil {
+					out = append(out, end...)
+					l.dropping, l.length = false, 0
+				}
+				break
+			}
+
+			room := l.max - l.length
+			if len(content) <= room {
+				out = append(out, content...)
+				l.length += len(content)
+				if end != nil {
+					out = append(out, end...)
+					l.length = 0
+				}
+				break
+			}
+
+			cut := l.cutPoint(content, room)
+			out = append(out, content[:cut]...)
+			content = content[cut:]
+
+			if l.policy == LongLinesTruncate {
+				out = append(out, LineTruncatedMarker...)
+				l.dropping = true
+				continue
+			}
+
+			out = append(out, '\n')
+			out = append(out, LineContinuationMarker...)
+			l.length = len(LineContinuationMarker)
+		}
+	}
+
+	if _, err := l.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// cutPoint returns where to cut the rest of a line that's too long, with
+// room for that many more bytes of it
+func (l *LineLimiter) cutPoint(content []byte, room int) int {
+	cut := room
+
+	// Don't split a UTF-8 character
+	for i := 0; i < utf8.UTFMax && cut > 0 && !utf8.RuneStart(content[cut]); i++ {
+		cut--
+	}
+
+	// Or an escape sequence
+	if esc := bytes.LastIndexByte(content[:cut], '\x1b'); esc >= 0 && cut-esc <= maxEscapeSequenceLength && !escapeSequenceEnds(content[esc+1:cut]) {
+		cut = esc
+	}
+
+	// Wrapped lines break after a space if there's one near the end
+	if l.policy != LongLinesTruncate {
+		if space := bytes.LastIndexByte(content[:cut], ' '); space >= 0 && cut-(space+1) <= l.max/8 {
+			cut = space + 1
+		}
+	}
+
+	// A continuation line always gets some of the line, so wrapping gets
+	// through it
+	if cut == 0 && l.length <= len(LineContinuationMarker) {
+		cut = room
+	}
+
+	return cut
+}
+
+// splitUnfinishedEscape splits an escape sequence that hasn't finished off the
+// end of data, so it isn't cut by the end of a write. Ones too long to be
+// worth keeping whole, or that a line ends in, are left where they are.
+func splitUnfinishedEscape(data []byte) (rest []byte, escape []byte) {
+	esc := bytes.LastIndexByte(data, '\x1b')
+	if esc < 0 || len(data)-esc > maxEscapeSequenceLength ||
+		bytes.ContainsAny(data[esc:], "\r\n") || escapeSequenceEnds(data[esc+1:]) {
+		return data, nil
+	}
+	return data[:esc], data[esc:]
+}
+
+// escapeSequenceEnds returns whether an escape sequence is complete, given
+// what's after its escape character
+func escapeSequenceEnds(seq []byte) bool {
+	if len(seq) == 0 {
+		return false
+	}
+
+	switch seq[0] {
+	case '[':
+		// Control sequences like colors end with a letter or one of @[\]^_`{|}~
+		for _, c := range seq[1:] {
+			if c >= 0x40 && c <= 0x7e {
+				return true
+			}
+		}
+		return false
+	case '_', ']':
+		// Application commands, like timestamps, and operating system
+		// commands end with a bell
+		return bytes.IndexByte(seq, '\a') >= 0
+	}
+
+	return true
+}
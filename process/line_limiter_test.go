@@ -0,0 +1,130 @@
+package process_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/process"
+)
+
+func TestLineLimiter(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   string
+		max      int
+		input    []string
+		expected string
+	}{
+		{
+			name:     "short lines",
+			policy:   process.LongLinesWrap,
+			max:      10,
+			input:    []string{"alpacas\nllamas\n"},
+			expected: "alpacas\nllamas\n",
+		},
+		{
+			name:     "wrap",
+			policy:   process.LongLinesWrap,
+			max:      10,
+			input:    []string{"abcdefghijklmnopqrstuvwxyz\nok\n"},
+			expected: "abcdefghij\n↳ klmnop\n↳ qrstuv\n↳ wxyz\nok\n",
+		},
+		{
+			name:     "wrap across writes",
+			policy:   process.LongLinesWrap,
+			max:      10,
+			input:    []string{"abcdef", "ghijkl", "mn\n"},
+			expected: "abcdefghij\n↳ klmn\n",
+		},
+		{
+			name:     "wrap after a space",
+			policy:   process.LongLinesWrap,
+			max:      16,
+			input:    []string{"the quick brown fox jumps\n"},
+			expected: "the quick brown \n↳ fox jumps\n",
+		},
+		{
+			name:     "wrap without splitting characters",
+			policy:   process.LongLinesWrap,
+			max:      10,
+			input:    []string{"abcdefghié\n"},
+			expected: "abcdefghi\n↳ é\n",
+		},
+		{
+			name:     "wrap without splitting escape sequences",
+			policy:   process.LongLinesWrap,
+			max:      10,
+			input:    []string{"abcdefg\x1b[31mred\x1b[0m\n"},
+			expected: "abcdefg\n↳ \x1b[31mr\n↳ ed\x1b[0m\n",
+		},
+		{
+			name:     "wrap without splitting escape sequences across writes",
+			policy:   process.LongLinesWrap,
+			max:      10,
+			input:    []string{"abcdefg\x1b[3", "1mred\x1b[0m\n"},
+			expected: "abcdefg\n↳ \x1b[31mr\n↳ ed\x1b[0m\n",
+		},
+		{
+			name:     "carriage returns start the line again",
+			policy:   process.LongLinesWrap,
+			max:      10,
+			input:    []string{"[====    ]", "\r[======  ]\r", "[========]\r\n"},
+			expected: "[====    ]\r[======  ]\r[========]\r\n",
+		},
+		{
+			name:     "truncate",
+			policy:   process.LongLinesTruncate,
+			max:      10,
+			input:    []string{"abcdefghijklmnopqrstuvwxyz\nok\n", "abcdefghij", "klmnop\n"},
+			expected: "abcdefghij… [line truncated]\nok\nabcdefghij… [line truncated]\n",
+		},
+		{
+			name:     "truncate until a carriage return",
+			policy:   process.LongLinesTruncate,
+			max:      10,
+			input:    []string{"abcdefghijklmnop\rabc\n"},
+			expected: "abcdefghij… [line truncated]\rabc\n",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			out := &bytes.Buffer{}
+			l := process.NewLineLimiter(out, tc.max, tc.policy)
+			for _, input := range tc.input {
+				n, err := l.Write([]byte(input))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != len(input) {
+					t.Fatalf("Short write: %d vs expected %d", n, len(input))
+				}
+			}
+
+			if actual := out.String(); actual != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestLineLimiterWrapsHugeLines(t *testing.T) {
+	t.Parallel()
+
+	out := &bytes.Buffer{}
+	l := process.NewLineLimiter(out, 1024, process.LongLinesWrap)
+	if _, err := l.Write([]byte(strings.Repeat("QUFB", 1024*1024) + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		if len(line) > 1024 {
+			t.Fatalf("Line is %d bytes long", len(line))
+		}
+	}
+	if got := strings.Count(out.String(), "\n"); got < 4096 {
+		t.Errorf("Expected the line to be wrapped at least 4096 times, got %d", got)
+	}
+}
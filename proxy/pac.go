@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net"
+	"path"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+// PAC files are JavaScript, run with goja, and have the functions from the
+// original Netscape spec to call. The date and time ones (weekdayRange,
+// dateRange and timeRange) aren't defined, so files that use them fail with
+// a ReferenceError rather than picking a proxy by the wrong rules.
+
+// defineFunctions defines the functions PAC files can call in vm
+func (p *PAC) defineFunctions(vm *goja.Runtime) error {
+	functions := map[string]interface{}{
+		"isPlainHostName": func(host string) bool {
+			return !strings.Contains(host, ".")
+		},
+
+		"dnsDomainIs": func(host, domain string) bool {
+			return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain))
+		},
+
+		"localHostOrDomainIs": func(host, hostdom string) bool {
+			host, hostdom = strings.ToLower(host), strings.ToLower(hostdom)
+			if host == hostdom {
+				return true
+			}
+			return !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+".")
+		},
+
+		"dnsDomainLevels": func(host string) int {
+			return strings.Count(host, ".")
+		},
+
+		// Unlike in path.Match, * and ? match slashes too
+		"shExpMatch": func(str, shexp string) bool {
+			matched, _ := path.Match(strings.ReplaceAll(shexp, "/", "\x00"), strings.ReplaceAll(str, "/", "\x00"))
+			return matched
+		},
+
+		"isResolvable": func(host string) bool {
+			ips, err := p.lookupIP(host)
+			return err == nil && len(ips) > 0
+		},
+
+		// Returns null if the host can't be resolved, and prefers IPv4
+		// addresses like browsers do
+		"dnsResolve": func(host string) interface{} {
+			ips, err := p.lookupIP(host)
+			if err != nil || len(ips) == 0 {
+				return nil
+			}
+			for _, ip := range ips {
+				if ip.To4() != nil {
+					return ip.String()
+				}
+			}
+			return ips[0].String()
+		},
+
+		"isInNet": func(host, pattern, mask string) bool {
+			ip := net.ParseIP(host)
+			if ip == nil {
+				ips, err := p.lookupIP(host)
+				if err != nil || len(ips) == 0 {
+					return false
+				}
+				ip = ips[0]
+			}
+			patternIP, maskIP := net.ParseIP(pattern).To4(), net.ParseIP(mask).To4()
+			if ip.To4() == nil || patternIP == nil || maskIP == nil {
+				return false
+			}
+			return ip.To4().Mask(net.IPMask(maskIP)).Equal(patternIP.Mask(net.IPMask(maskIP)))
+		},
+
+		"myIpAddress": func() string {
+			return p.myIP()
+		},
+
+		"convert_addr": func(addr string) uint32 {
+			ip := net.ParseIP(addr).To4()
+			if ip == nil {
+				return 0
+			}
+			return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+		},
+
+		// There's nowhere to show alerts, so they're ignored
+		"alert": func(goja.FunctionCall) goja.Value {
+			return goja.Undefined()
+		},
+	}
+
+	for name, fn := range functions {
+		if err := vm.Set(name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+// Package proxy picks the proxy for each request from a proxy auto-config
+// (PAC) file, for networks that need different proxies for different hosts
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// WPADURL is where web proxy auto-discovery looks for the network's PAC file
+const WPADURL = "http://wpad/wpad.dat"
+
+const (
+	// How long FindProxyForURL can run before it's stopped, so a PAC file
+	// that loops forever doesn't hang every request
+	findProxyTimeout = 5 * time.Second
+
+	// How long to wait to connect to a proxy when checking it's up
+	proxyDialTimeout = 5 * time.Second
+
+	// How long a proxy is known to be up or down for before it's checked
+	// again
+	proxyCheckInterval = time.Minute
+)
+
+// PAC is a loaded proxy auto-config file
+type PAC struct {
+	// Where the PAC file was loaded from
+	Location string
+
+	// JavaScript runtimes can't be used by more than one goroutine at a time,
+	// so calls to FindProxyForURL are one at a time
+	mu              sync.Mutex
+	vm              *goja.Runtime
+	findProxyForURL goja.Callable
+
+	// Looks up a host's addresses, for dnsResolve, isInNet and isResolvable
+	lookupIP func(host string) ([]net.IP, error)
+
+	// Returns the address of this host, for myIpAddress
+	myIP func() string
+
+	// Connects to a proxy, to check it's up
+	dial func(network, address string) (net.Conn, error)
+
+	// When each proxy was last checked, and whether it was up
+	checksMu sync.Mutex
+	checks   map[string]proxyCheck
+}
+
+type proxyCheck struct {
+	at time.Time
+	up bool
+}
+
+// Load loads a PAC file from a path or an http(s) URL, or discovers the
+// network's with WPAD if the location is "wpad"
+func Load(location string) (*PAC, error) {
+	if location == "wpad" {
+		location = WPADURL
+	}
+
+	var src []byte
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		src, err = fetch(location)
+	} else {
+		src, err = ioutil.ReadFile(location)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load the PAC file %s: %v", location, err)
+	}
+
+	pac, err := Parse(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("The PAC file %s is invalid: %v", location, err)
+	}
+	pac.Location = location
+
+	return pac, nil
+}
+
+// fetch downloads a PAC file, which is always done without a proxy
+func fetch(location string) ([]byte, error) {
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{Proxy: nil},
+	}
+
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Parse parses the source of a PAC file, which has to define a
+// FindProxyForURL function
+func Parse(src string) (*PAC, error) {
+	p := &PAC{
+		vm:       goja.New(),
+		lookupIP: net.LookupIP,
+		myIP:     myIPAddress,
+		dial: func(network, address string) (net.Conn, error) {
+			return net.DialTimeout(network, address, proxyDialTimeout)
+		},
+		checks: map[string]proxyCheck{},
+	}
+	if err := p.defineFunctions(p.vm); err != nil {
+		return nil, err
+	}
+
+	// Global variables are set once, when the file is loaded
+	if _, err := p.run(func() (goja.Value, error) { return p.vm.RunScript("proxy.pac", src) }); err != nil {
+		return nil, err
+	}
+
+	fn, ok := goja.AssertFunction(p.vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, fmt.Errorf("FindProxyForURL isn't defined")
+	}
+	p.findProxyForURL = fn
+
+	return p, nil
+}
+
+// run runs some of the PAC file, stopping it if it takes too long
+func (p *PAC) run(f func() (goja.Value, error)) (goja.Value, error) {
+	timer := time.AfterFunc(findProxyTimeout, func() {
+		p.vm.Interrupt(fmt.Sprintf("Took longer than %v", findProxyTimeout))
+	})
+	defer func() {
+		timer.Stop()
+		p.vm.ClearInterrupt()
+	}()
+	return f()
+}
+
+// FindProxy returns what the PAC file's FindProxyForURL gives for a URL, like
+// "PROXY proxy.example.com:8080; DIRECT"
+func (p *PAC) FindProxy(u *url.URL) (string, error) {
+	// Like browsers, only the scheme and host of https URLs are given to the
+	// PAC file, since the rest is meant to be private
+	target := u.String()
+	if u.Scheme == "https" {
+		target = (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}).String()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result, err := p.run(func() (goja.Value, error) {
+		return p.findProxyForURL(goja.Undefined(), p.vm.ToValue(target), p.vm.ToValue(u.Hostname()))
+	})
+	if err != nil {
+		return "", fmt.Errorf("FindProxyForURL failed for %s: %v", u.Hostname(), err)
+	}
+	if goja.IsUndefined(result) || goja.IsNull(result) {
+		return "", nil
+	}
+	return result.String(), nil
+}
+
+// ProxyForURL returns the proxy to connect to a URL through, or nil to
+// connect directly. Like browsers, it goes down the proxies the PAC file
+// gives until it finds one that's up, and connects directly if it gets to a
+// DIRECT. If none of them are up, the first is used anyway.
+func (p *PAC) ProxyForURL(u *url.URL) (*url.URL, error) {
+	result, err := p.FindProxy(u)
+	if err != nil {
+		return nil, err
+	}
+
+	proxies, err := ParseProxies(result)
+	if err != nil {
+		return nil, err
+	}
+	if len(proxies) == 0 {
+		return nil, nil
+	}
+
+	for _, proxy := range proxies {
+		if proxy == nil || p.up(proxy) {
+			return proxy, nil
+		}
+	}
+	return proxies[0], nil
+}
+
+// Proxy returns the proxy for a request, for http.Transport's Proxy, see
+// ProxyForURL
+func (p *PAC) Proxy(req *http.Request) (*url.URL, error) {
+	return p.ProxyForURL(req.URL)
+}
+
+// up returns whether a proxy can be connected to, checking at most once every
+// proxyCheckInterval
+func (p *PAC) up(proxy *url.URL) bool {
+	p.checksMu.Lock()
+	defer p.checksMu.Unlock()
+
+	if check, ok := p.checks[proxy.Host]; ok && time.Since(check.at) < proxyCheckInterval {
+		return check.up
+	}
+
+	conn, err := p.dial("tcp", proxy.Host)
+	if err == nil {
+		conn.Close()
+	}
+	p.checks[proxy.Host] = proxyCheck{at: time.Now(), up: err == nil}
+
+	return err == nil
+}
+
+// ParseProxies returns the proxies in a FindProxyForURL result, in order, with
+// nil for each DIRECT
+func ParseProxies(result string) ([]*url.URL, error) {
+	var proxies []*url.URL
+
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		scheme := ""
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			proxies = append(proxies, nil)
+			continue
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		default:
+			return nil, fmt.Errorf("Unknown proxy type %q in %q", fields[0], result)
+		}
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Expected a host and port after %s in %q", fields[0], result)
+		}
+		proxies = append(proxies, &url.URL{Scheme: scheme, Host: fields[1]})
+	}
+
+	return proxies, nil
+}
+
+// myIPAddress returns the address this host connects to the internet from.
+// Dialing UDP doesn't send anything, it just picks the route.
+func myIPAddress() string {
+	conn, err := net.Dial("udp", "192.0.2.1:80")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const corporatePAC = `
+// Internal hosts go direct, everything else through the proxy
+var proxy = "PROXY proxy.corp.example:3128";
+
+function isInternal(host) {
+	return dnsDomainIs(host, ".corp.example") || shExpMatch(host, "10.*");
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+
+	if (isPlainHostName(host) || isInternal(host))
+		return "DIRECT";
+
+	/* Artifacts go through their own proxy */
+	if (shExpMatch(url, "*.s3.amazonaws.com/*")) {
+		return "HTTPS artifacts-proxy.corp.example:443; DIRECT";
+	} else if (isInNet(host, "192.168.0.0", "255.255.0.0")) {
+		return "SOCKS socks.corp.example:1080";
+	}
+
+	if (url.substring(0, 5) == "http:" && host.indexOf("buildkite") >= 0)
+		return "DIRECT";
+
+	return proxy + "; DIRECT";
+}
+`
+
+func findProxy(t *testing.T, pac *PAC, rawURL string) string {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	require.NoError(t, err)
+
+	result, err := pac.FindProxy(u)
+	require.NoError(t, err)
+	return result
+}
+
+func TestPACFindsProxyForURL(t *testing.T) {
+	t.Parallel()
+
+	pac, err := Parse(corporatePAC)
+	require.NoError(t, err)
+	pac.lookupIP = func(host string) ([]net.IP, error) {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+
+	for rawURL, want := range map[string]string{
+		"https://agent.buildkite.com/v3/ping":                  "PROXY proxy.corp.example:3128; DIRECT",
+		"http://agent.buildkite.com/v3/ping":                   "DIRECT",
+		"https://git.corp.example/org/repo.git":                "DIRECT",
+		"https://GIT.CORP.EXAMPLE/org/repo.git":                "DIRECT",
+		"http://intranet/":                                     "DIRECT",
+		"http://10.0.0.4:8080/":                                "DIRECT",
+		"http://bucket.s3.amazonaws.com/artifacts/log.txt":     "HTTPS artifacts-proxy.corp.example:443; DIRECT",
+		"https://bucket.s3.amazonaws.com/artifacts/secret.txt": "HTTPS artifacts-proxy.corp.example:443; DIRECT",
+		"http://192.168.4.20/":                                 "SOCKS socks.corp.example:1080",
+	} {
+		assert.Equal(t, want, findProxy(t, pac, rawURL), rawURL)
+	}
+}
+
+func TestPACResolvesHosts(t *testing.T) {
+	t.Parallel()
+
+	pac, err := Parse(`
+		function FindProxyForURL(url, host) {
+			if (!isResolvable(host)) return "PROXY outside:8080";
+			if (isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0")) return "DIRECT";
+			return "PROXY " + myIpAddress() + ":8080";
+		}`)
+	require.NoError(t, err)
+	pac.lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "internal.example":
+			return []net.IP{net.ParseIP("10.1.2.3")}, nil
+		case "external.example":
+			return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("203.0.113.7")}, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	pac.myIP = func() string { return "10.9.9.9" }
+
+	assert.Equal(t, "DIRECT", findProxy(t, pac, "https://internal.example/"))
+	assert.Equal(t, "PROXY 10.9.9.9:8080", findProxy(t, pac, "https://external.example/"))
+	assert.Equal(t, "PROXY outside:8080", findProxy(t, pac, "https://unknown.example/"))
+}
+
+func TestParseRejectsInvalidPACFiles(t *testing.T) {
+	t.Parallel()
+
+	for src, msg := range map[string]string{
+		`function findProxy(url, host) { return "DIRECT"; }`:                              "FindProxyForURL isn't defined",
+		`var FindProxyForURL = "DIRECT";`:                                                 "FindProxyForURL isn't defined",
+		`function FindProxyForURL(url, host) { return "DIRECT"`:                           "SyntaxError",
+		`var x = weekdayRange("MON", "FRI"); function FindProxyForURL(u, h) { return x }`: "ReferenceError: weekdayRange is not defined",
+	} {
+		_, err := Parse(src)
+		assert.ErrorContains(t, err, msg, src)
+	}
+}
+
+func TestPACStopsFindProxyForURLThatRunsForever(t *testing.T) {
+	t.Parallel()
+
+	pac, err := Parse(`function FindProxyForURL(url, host) { for (;;) {} }`)
+	require.NoError(t, err)
+
+	_, err = pac.FindProxy(&url.URL{Scheme: "https", Host: "example.com"})
+	assert.ErrorContains(t, err, "Took longer than "+findProxyTimeout.String())
+}
+
+func TestPACFailsOverToTheNextProxy(t *testing.T) {
+	t.Parallel()
+
+	pac, err := Parse(`
+		function FindProxyForURL(url, host) {
+			if (host == "all-down.example") return "PROXY down:3128; PROXY also-down:3128";
+			return "PROXY down:3128; SOCKS up:1080; DIRECT";
+		}`)
+	require.NoError(t, err)
+
+	var dialed []string
+	up := map[string]bool{"up:1080": true}
+	pac.dial = func(network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		if !up[address] {
+			return nil, fmt.Errorf("dial %s %s: connection refused", network, address)
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	proxyURL, err := pac.ProxyForURL(&url.URL{Scheme: "https", Host: "example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "socks5://up:1080", proxyURL.String())
+
+	// Once up:1080 is down too, it's DIRECT
+	up["up:1080"] = false
+	pac.checks = map[string]proxyCheck{}
+	proxyURL, err = pac.ProxyForURL(&url.URL{Scheme: "https", Host: "example.com"})
+	require.NoError(t, err)
+	assert.Nil(t, proxyURL)
+
+	// If they're all down, the first is used anyway
+	proxyURL, err = pac.ProxyForURL(&url.URL{Scheme: "https", Host: "all-down.example"})
+	require.NoError(t, err)
+	assert.Equal(t, "http://down:3128", proxyURL.String())
+
+	// Proxies aren't checked again until proxyCheckInterval has passed
+	assert.Equal(t, []string{"down:3128", "up:1080", "down:3128", "up:1080", "also-down:3128"}, dialed)
+}
+
+func TestParseProxies(t *testing.T) {
+	t.Parallel()
+
+	for result, want := range map[string][]string{
+		"PROXY proxy:3128; DIRECT":          {"http://proxy:3128", ""},
+		"HTTPS proxy:443":                   {"https://proxy:443"},
+		"SOCKS5 socks:1080; PROXY b:3128; ": {"socks5://socks:1080", "http://b:3128"},
+		"DIRECT":                            {""},
+		"":                                  nil,
+	} {
+		proxies, err := ParseProxies(result)
+		require.NoError(t, err, result)
+
+		var got []string
+		for _, proxy := range proxies {
+			if proxy == nil {
+				got = append(got, "")
+			} else {
+				got = append(got, proxy.String())
+			}
+		}
+		assert.Equal(t, want, got, result)
+	}
+
+	_, err := ParseProxies("PROXY a:3128; FTP proxy:21")
+	assert.EqualError(t, err, `Unknown proxy type "FTP" in "PROXY a:3128; FTP proxy:21"`)
+
+	_, err = ParseProxies("PROXY")
+	assert.EqualError(t, err, `Expected a host and port after PROXY in "PROXY"`)
+}
+
+func TestLoadPAC(t *testing.T) {
+	t.Parallel()
+
+	src := `function FindProxyForURL(url, host) { return "PROXY proxy:3128"; }`
+
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	require.NoError(t, os.WriteFile(path, []byte(src), 0o600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/proxy.pac" {
+			http.NotFound(rw, req)
+			return
+		}
+		fmt.Fprint(rw, src)
+	}))
+	defer server.Close()
+
+	for _, location := range []string{path, server.URL + "/proxy.pac"} {
+		pac, err := Load(location)
+		require.NoError(t, err, location)
+		assert.Equal(t, location, pac.Location)
+
+		req, err := http.NewRequest("GET", "https://agent.buildkite.com/v3/ping", nil)
+		require.NoError(t, err)
+
+		proxyURL, err := pac.Proxy(req)
+		require.NoError(t, err)
+		assert.Equal(t, "http://proxy:3128", proxyURL.String())
+	}
+
+	_, err := Load(server.URL + "/missing.pac")
+	assert.EqualError(t, err, "Couldn't load the PAC file "+server.URL+"/missing.pac: 404 Not Found")
+}
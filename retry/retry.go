@@ -0,0 +1,319 @@
+// Package retry provides a Retrier for retrying operations that can fail
+// transiently, like API requests, artifact transfers and git operations.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A Strategy decides how long to wait before the next attempt, given the
+// number of attempts that have already been made
+type Strategy struct {
+	wait func(attempts int) time.Duration
+
+	// Why the strategy can't be used, if it can't
+	err error
+}
+
+// Constant returns a strategy that always waits the same interval
+func Constant(interval time.Duration) Strategy {
+	if interval < 0 {
+		return Strategy{err: errors.New("Constant retry strategies can't have a negative interval")}
+	}
+
+	return Strategy{wait: func(int) time.Duration {
+		return interval
+	}}
+}
+
+// Exponential returns a strategy that waits base, then doubles the wait after
+// each attempt, up to max. A max of 0 means there's no limit.
+func Exponential(base, max time.Duration) Strategy {
+	if base <= 0 {
+		return Strategy{err: errors.New("Exponential retry strategies must have a positive base")}
+	}
+
+	return Strategy{wait: func(attempts int) time.Duration {
+		interval := time.Duration(float64(base) * math.Pow(2, float64(attempts-1)))
+
+		// Guard against overflow as well as the limit
+		if max > 0 && (interval > max || interval <= 0) {
+			return max
+		}
+		return interval
+	}}
+}
+
+// An Option configures a Retrier
+type Option func(*Retrier)
+
+// WithMaxAttempts sets the maximum number of attempts the Retrier will make
+func WithMaxAttempts(maxAttempts int) Option {
+	return func(r *Retrier) {
+		r.maxAttempts = maxAttempts
+	}
+}
+
+// TryForever makes the Retrier keep trying until the operation succeeds, it
+// calls Break, or the context is done
+func TryForever() Option {
+	return func(r *Retrier) {
+		r.forever = true
+	}
+}
+
+// WithStrategy sets how long the Retrier waits between attempts
+func WithStrategy(strategy Strategy) Option {
+	return func(r *Retrier) {
+		r.strategy = strategy
+	}
+}
+
+// WithJitter adds a random amount of up to a second to each wait, so that
+// retries running in parallel (say, across a fleet of agents) don't all hit
+// the same service at once
+func WithJitter() Option {
+	return func(r *Retrier) {
+		r.jitter = true
+	}
+}
+
+// WithAttemptTimeout limits how long each attempt can take. The limit is
+// applied to the context passed to the operation by DoWithContext.
+func WithAttemptTimeout(timeout time.Duration) Option {
+	return func(r *Retrier) {
+		r.attemptTimeout = timeout
+	}
+}
+
+// WithRetryIf sets a predicate that decides whether an error is worth
+// retrying. Errors it returns false for are returned straight away.
+func WithRetryIf(retryable func(error) bool) Option {
+	return func(r *Retrier) {
+		r.retryable = retryable
+	}
+}
+
+// WithOnRetry sets a function that's called after each failed attempt that
+// will be retried, with the attempt number, its error and how long the
+// Retrier will wait. It's useful for logging and metrics.
+func WithOnRetry(onRetry func(attempt int, err error, wait time.Duration)) Option {
+	return func(r *Retrier) {
+		r.onRetry = onRetry
+	}
+}
+
+// WithSleepFunc sets the function used to wait between attempts, which is
+// only really useful for testing
+func WithSleepFunc(sleep func(time.Duration)) Option {
+	return func(r *Retrier) {
+		r.sleep = func(ctx context.Context, d time.Duration) error {
+			sleep(d)
+			return ctx.Err()
+		}
+	}
+}
+
+var (
+	jitterRand      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterRandMutex sync.Mutex
+)
+
+const jitterInterval = time.Second
+
+// Retrier retries an operation until it succeeds or it runs out of attempts
+type Retrier struct {
+	maxAttempts    int
+	forever        bool
+	strategy       Strategy
+	jitter         bool
+	attemptTimeout time.Duration
+	retryable      func(error) bool
+	onRetry        func(int, error, time.Duration)
+	sleep          func(context.Context, time.Duration) error
+
+	attempts  int
+	breakNext bool
+
+	// Why the options don't make sense, if they don't, which is returned
+	// instead of making any attempts
+	err error
+}
+
+// NewRetrier returns a Retrier configured with the given options. If the
+// options don't make sense, Do and DoWithContext return an error saying why
+// without making any attempts.
+func NewRetrier(opts ...Option) *Retrier {
+	r := &Retrier{
+		strategy: Constant(0),
+		sleep:    sleepContext,
+	}
+
+	for _, o := range opts {
+		o(r)
+	}
+
+	r.err = r.validate()
+
+	return r
+}
+
+func (r *Retrier) validate() error {
+	if r.strategy.err != nil {
+		return r.strategy.err
+	}
+
+	if r.maxAttempts < 0 {
+		return errors.New("Retriers must have a positive max attempt count")
+	}
+
+	if r.maxAttempts == 0 && !r.forever {
+		return errors.New("Retriers must either run forever, or have a maximum attempt count")
+	}
+
+	if r.forever && r.wait(1) == 0 {
+		return errors.New("Retriers that run forever must wait between attempts")
+	}
+
+	return nil
+}
+
+// wait returns how long the strategy waits after the given number of attempts
+func (r *Retrier) wait(attempts int) time.Duration {
+	if r.strategy.wait == nil {
+		return 0
+	}
+	return r.strategy.wait(attempts)
+}
+
+// Break stops the Retrier from making any more attempts after the current one
+func (r *Retrier) Break() {
+	r.breakNext = true
+}
+
+// AttemptCount returns the number of attempts that have finished
+func (r *Retrier) AttemptCount() int {
+	return r.attempts
+}
+
+// String describes the current attempt and what happens if it fails, for
+// including in log messages
+func (r *Retrier) String() string {
+	str := fmt.Sprintf("Attempt %d/", r.attempts+1)
+
+	if r.forever {
+		str += "∞"
+	} else {
+		str += fmt.Sprintf("%d", r.maxAttempts)
+	}
+
+	if wait := r.wait(r.attempts + 1); wait > 0 {
+		str += fmt.Sprintf(" Retrying in %s", wait)
+	} else {
+		str += " Retrying immediately"
+	}
+
+	return str
+}
+
+// Do calls the operation until it succeeds or the Retrier gives up, and
+// returns the last error
+func (r *Retrier) Do(callback func(*Retrier) error) error {
+	return r.DoWithContext(context.Background(), func(_ context.Context, r *Retrier) error {
+		return callback(r)
+	})
+}
+
+// DoWithContext is like Do, but stops retrying once ctx is done. The context
+// passed to the operation is limited by the attempt timeout, if one is set.
+func (r *Retrier) DoWithContext(ctx context.Context, callback func(context.Context, *Retrier) error) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	for {
+		err := r.attempt(ctx, callback)
+		if err == nil {
+			return nil
+		}
+
+		r.attempts++
+
+		if r.shouldGiveUp(err) {
+			return err
+		}
+
+		// Don't wait for an attempt that can never happen
+		if ctx.Err() != nil {
+			return err
+		}
+
+		wait := r.wait(r.attempts) + r.jitterDuration()
+		if r.onRetry != nil {
+			r.onRetry(r.attempts, err, wait)
+		}
+
+		if sleepErr := r.sleep(ctx, wait); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+func (r *Retrier) attempt(ctx context.Context, callback func(context.Context, *Retrier) error) error {
+	if r.attemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.attemptTimeout)
+		defer cancel()
+	}
+
+	return callback(ctx, r)
+}
+
+func (r *Retrier) shouldGiveUp(err error) bool {
+	if r.breakNext {
+		return true
+	}
+
+	if r.retryable != nil && !r.retryable(err) {
+		return true
+	}
+
+	if r.forever {
+		return false
+	}
+
+	return r.attempts >= r.maxAttempts
+}
+
+func (r *Retrier) jitterDuration() time.Duration {
+	if !r.jitter {
+		return 0
+	}
+
+	jitterRandMutex.Lock()
+	defer jitterRandMutex.Unlock()
+
+	return time.Duration(jitterRand.Int63n(int64(jitterInterval)))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
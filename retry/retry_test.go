@@ -0,0 +1,229 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errTest = errors.New("nope")
+
+type recordingSleep struct {
+	sleeps []time.Duration
+}
+
+func (s *recordingSleep) sleep(d time.Duration) {
+	s.sleeps = append(s.sleeps, d)
+}
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	t.Parallel()
+
+	s := &recordingSleep{}
+	calls := 0
+
+	err := NewRetrier(
+		WithMaxAttempts(5),
+		WithStrategy(Constant(5*time.Second)),
+		WithSleepFunc(s.sleep),
+	).Do(func(r *Retrier) error {
+		calls++
+		if calls < 3 {
+			return errTest
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []time.Duration{5 * time.Second, 5 * time.Second}, s.sleeps)
+}
+
+func TestDoGivesUpAfterMaxAttempts(t *testing.T) {
+	t.Parallel()
+
+	s := &recordingSleep{}
+	calls := 0
+
+	err := NewRetrier(
+		WithMaxAttempts(3),
+		WithStrategy(Constant(time.Second)),
+		WithSleepFunc(s.sleep),
+	).Do(func(r *Retrier) error {
+		calls++
+		return errTest
+	})
+
+	assert.Equal(t, errTest, err)
+	assert.Equal(t, 3, calls)
+	assert.Len(t, s.sleeps, 2)
+}
+
+func TestDoStopsOnBreak(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	err := NewRetrier(
+		WithMaxAttempts(10),
+		WithSleepFunc(func(time.Duration) {}),
+	).Do(func(r *Retrier) error {
+		calls++
+		r.Break()
+		return errTest
+	})
+
+	assert.Equal(t, errTest, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestExponentialStrategy(t *testing.T) {
+	t.Parallel()
+
+	s := &recordingSleep{}
+	_ = NewRetrier(
+		WithMaxAttempts(6),
+		WithStrategy(Exponential(time.Second, 10*time.Second)),
+		WithSleepFunc(s.sleep),
+	).Do(func(r *Retrier) error {
+		return errTest
+	})
+
+	assert.Equal(t, []time.Duration{
+		1 * time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+	}, s.sleeps)
+}
+
+func TestJitterIsLessThanASecond(t *testing.T) {
+	t.Parallel()
+
+	s := &recordingSleep{}
+	_ = NewRetrier(
+		WithMaxAttempts(20),
+		WithStrategy(Constant(time.Second)),
+		WithJitter(),
+		WithSleepFunc(s.sleep),
+	).Do(func(r *Retrier) error {
+		return errTest
+	})
+
+	for _, d := range s.sleeps {
+		assert.GreaterOrEqual(t, d, time.Second)
+		assert.Less(t, d, 2*time.Second)
+	}
+}
+
+func TestRetryIf(t *testing.T) {
+	t.Parallel()
+
+	permanent := errors.New("permanent")
+	calls := 0
+
+	err := NewRetrier(
+		WithMaxAttempts(10),
+		WithRetryIf(func(err error) bool { return err != permanent }),
+		WithSleepFunc(func(time.Duration) {}),
+	).Do(func(r *Retrier) error {
+		calls++
+		if calls == 2 {
+			return permanent
+		}
+		return errTest
+	})
+
+	assert.Equal(t, permanent, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestOnRetry(t *testing.T) {
+	t.Parallel()
+
+	var attempts []int
+	_ = NewRetrier(
+		WithMaxAttempts(3),
+		WithStrategy(Constant(time.Second)),
+		WithSleepFunc(func(time.Duration) {}),
+		WithOnRetry(func(attempt int, err error, wait time.Duration) {
+			assert.Equal(t, errTest, err)
+			assert.Equal(t, time.Second, wait)
+			attempts = append(attempts, attempt)
+		}),
+	).Do(func(r *Retrier) error {
+		return errTest
+	})
+
+	// The last attempt isn't retried, so there's no hook for it
+	assert.Equal(t, []int{1, 2}, attempts)
+}
+
+func TestDoWithContextStopsWhenContextIsDone(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+
+	start := time.Now()
+	err := NewRetrier(
+		TryForever(),
+		WithStrategy(Constant(time.Hour)),
+	).DoWithContext(ctx, func(ctx context.Context, r *Retrier) error {
+		calls++
+		go cancel()
+		return errTest
+	})
+
+	assert.Equal(t, errTest, err)
+	assert.Equal(t, 1, calls)
+	assert.Less(t, time.Since(start), time.Minute)
+}
+
+func TestDoWithContextAppliesAttemptTimeout(t *testing.T) {
+	t.Parallel()
+
+	err := NewRetrier(
+		WithMaxAttempts(2),
+		WithAttemptTimeout(10*time.Millisecond),
+	).DoWithContext(context.Background(), func(ctx context.Context, r *Retrier) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestString(t *testing.T) {
+	t.Parallel()
+
+	r := NewRetrier(WithMaxAttempts(3), WithStrategy(Constant(5*time.Second)))
+	assert.Equal(t, "Attempt 1/3 Retrying in 5s", r.String())
+
+	r = NewRetrier(TryForever(), WithStrategy(Constant(time.Second)))
+	assert.Equal(t, "Attempt 1/∞ Retrying in 1s", r.String())
+}
+
+func TestDoReturnsErrorForInvalidOptions(t *testing.T) {
+	t.Parallel()
+
+	for _, opts := range [][]Option{
+		{},
+		{TryForever()},
+		{WithMaxAttempts(-1)},
+		{WithMaxAttempts(3), WithStrategy(Constant(-time.Second))},
+		{WithMaxAttempts(3), WithStrategy(Exponential(0, time.Second))},
+	} {
+		calls := 0
+		err := NewRetrier(opts...).Do(func(*Retrier) error {
+			calls++
+			return nil
+		})
+
+		assert.Error(t, err)
+		assert.Equal(t, 0, calls)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package system
+
+import "golang.org/x/sys/unix"
+
+// DiskFree returns the number of bytes available to unprivileged users on the
+// filesystem containing path
+func DiskFree(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
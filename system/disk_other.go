@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+package system
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// DiskFree isn't supported on this operating system
+func DiskFree(path string) (uint64, error) {
+	return 0, fmt.Errorf("Checking free disk space isn't supported on %s", runtime.GOOS)
+}
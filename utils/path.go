@@ -23,7 +23,7 @@ func NormalizeCommand(commandPath string) (string, error) {
 
 	// expand env and home directory
 	var err error
-	commandPath, err = ExpandHome(os.ExpandEnv(commandPath))
+	commandPath, err = ExpandHome(expandPathEnv(commandPath))
 	if err != nil {
 		return "", err
 	}
@@ -44,6 +44,10 @@ func NormalizeCommand(commandPath string) (string, error) {
 // Normalizes a path and returns an clean absolute version. It correctly
 // expands environment variables inside paths, converts "~/" into the users
 // home directory, and replaces "./" with the current working directory.
+//
+// On Windows, it also expands %VAR% style variables, and handles UNC paths,
+// drive relative paths like "D:builds" and \\?\ long path prefixes, which
+// filepath.Abs gets wrong.
 func NormalizeFilePath(path string) (string, error) {
 	// don't normalize empty strings
 	if path == "" {
@@ -52,11 +56,20 @@ func NormalizeFilePath(path string) (string, error) {
 
 	// expand env and home directory
 	var err error
-	path, err = ExpandHome(os.ExpandEnv(path))
+	path, err = ExpandHome(expandPathEnv(path))
 	if err != nil {
 		return "", err
 	}
 
+	if isWindows() {
+		workingDir, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+
+		return windowsAbs(path, workingDir, os.LookupEnv), nil
+	}
+
 	// make sure its absolute
 	absolutePath, err := filepath.Abs(path)
 	if err != nil {
@@ -66,6 +79,14 @@ func NormalizeFilePath(path string) (string, error) {
 	return absolutePath, nil
 }
 
+// expandPathEnv expands $VAR and ${VAR} in a path, and on Windows %VAR% too
+func expandPathEnv(path string) string {
+	if isWindows() {
+		path = ExpandWindowsEnv(path, os.LookupEnv)
+	}
+	return os.ExpandEnv(path)
+}
+
 // ExpandHome expands the path to include the home directory if the path
 // is prefixed with `~`. If it isn't prefixed with `~`, the path is
 // returned as-is.
@@ -31,3 +31,17 @@ func TestNormalizeWindowsBackslashAbsolutePath(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, drive+`\`, fp)
 }
+
+func TestNormalizeWindowsPercentEnvVars(t *testing.T) {
+	fp, err := NormalizeFilePath(`%SystemDrive%\buildkite-agent`)
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getenv("SystemDrive")+`\buildkite-agent`, fp)
+}
+
+func TestNormalizeWindowsUNCPath(t *testing.T) {
+	t.Parallel()
+
+	fp, err := NormalizeFilePath(`//server/share/builds/../buildkite-agent`)
+	assert.NoError(t, err)
+	assert.Equal(t, `\\server\share\buildkite-agent`, fp)
+}
@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+const (
+	// The prefix that tells Windows APIs to skip path parsing, which lifts the
+	// MAX_PATH limit
+	windowsLongPathPrefix = `\\?\`
+
+	// The long path form of \\server\share
+	windowsLongUNCPrefix = `\\?\UNC\`
+
+	// Windows' MAX_PATH, which includes the terminating NUL
+	windowsMaxPath = 260
+)
+
+var windowsEnvVarRegex = regexp.MustCompile(`%([^%=\s]+)%`)
+
+// ExpandWindowsEnv replaces %VAR% references in a string with the values
+// from lookupEnv. References to unset variables are left as they are, which
+// is what cmd.exe does.
+func ExpandWindowsEnv(s string, lookupEnv func(string) (string, bool)) string {
+	return windowsEnvVarRegex.ReplaceAllStringFunc(s, func(match string) string {
+		if value, ok := lookupEnv(match[1 : len(match)-1]); ok {
+			return value
+		}
+		return match
+	})
+}
+
+// NormalizeWindowsPath is like NormalizeFilePath, but on Windows it also
+// adds the \\?\ long path prefix to paths that would otherwise be too long
+// for the Windows APIs. Elsewhere it's the same as NormalizeFilePath.
+func NormalizeWindowsPath(path string) (string, error) {
+	path, err := NormalizeFilePath(path)
+	if err != nil || !isWindows() {
+		return path, err
+	}
+
+	return addWindowsLongPathPrefix(path), nil
+}
+
+// windowsAbs returns a clean absolute version of a Windows path, relative to
+// workingDir. It follows the Windows rules whatever the current OS is, so
+// that it can be tested anywhere:
+//
+// "builds" => "C:\agent\builds"
+// "\builds" => "C:\builds"
+// "D:builds" => "D:\agent\builds" (using the "=D:" variable set by cmd.exe)
+// "//server/share/builds/../x" => "\\server\share\x"
+// "\\?\c:\builds\." => "\\?\C:\builds"
+func windowsAbs(path, workingDir string, lookupEnv func(string) (string, bool)) string {
+	path = strings.ReplaceAll(path, "/", `\`)
+	workingDir = strings.ReplaceAll(workingDir, "/", `\`)
+
+	// Keep the long path prefix, but take it off while we work on the rest
+	prefix := ""
+	if strings.HasPrefix(path, windowsLongUNCPrefix) {
+		prefix = windowsLongUNCPrefix
+		path = `\\` + path[len(windowsLongUNCPrefix):]
+	} else if strings.HasPrefix(path, windowsLongPathPrefix) {
+		prefix = windowsLongPathPrefix
+		path = path[len(windowsLongPathPrefix):]
+	}
+
+	volume, rest := splitWindowsVolume(path)
+
+	switch {
+	case volume == "" && strings.HasPrefix(rest, `\`):
+		// Rooted paths without a volume are on the working dir's volume
+		volume, _ = splitWindowsVolume(workingDir)
+
+	case volume == "":
+		volume, rest = splitWindowsVolume(workingDir + `\` + rest)
+
+	case !strings.HasPrefix(rest, `\`) && !strings.HasPrefix(volume, `\\`):
+		// Drive relative paths (C:builds) are relative to the current
+		// directory on that drive, which cmd.exe keeps in "=C:". If there
+		// isn't one, it's the working dir if that's on the same drive,
+		// otherwise the root of the drive.
+		driveDir := volume + `\`
+		if dir, ok := lookupEnv("=" + volume); ok && dir != "" {
+			driveDir = dir
+		} else if wdVolume, _ := splitWindowsVolume(workingDir); strings.EqualFold(wdVolume, volume) {
+			driveDir = workingDir
+		}
+		_, driveRest := splitWindowsVolume(strings.ReplaceAll(driveDir, "/", `\`))
+		rest = driveRest + `\` + rest
+	}
+
+	if len(volume) == 2 && volume[1] == ':' {
+		volume = strings.ToUpper(volume)
+	}
+
+	cleaned := volume + cleanWindowsPath(rest)
+
+	if prefix == windowsLongUNCPrefix {
+		return windowsLongUNCPrefix + strings.TrimPrefix(cleaned, `\\`)
+	}
+	return prefix + cleaned
+}
+
+// splitWindowsVolume splits a path into its volume (C: or \\server\share) and
+// the rest of the path
+func splitWindowsVolume(path string) (volume, rest string) {
+	if len(path) >= 2 && path[1] == ':' && isASCIILetter(path[0]) {
+		return path[:2], path[2:]
+	}
+
+	if strings.HasPrefix(path, `\\`) {
+		parts := strings.SplitN(path[2:], `\`, 3)
+		if len(parts) >= 2 && parts[0] != "" && parts[1] != "" {
+			volume = `\\` + parts[0] + `\` + parts[1]
+			return volume, path[len(volume):]
+		}
+	}
+
+	return "", path
+}
+
+// cleanWindowsPath resolves the . and .. elements in a path below a volume,
+// and always returns a rooted path
+func cleanWindowsPath(path string) string {
+	var elems []string
+	for _, elem := range strings.Split(path, `\`) {
+		switch elem {
+		case "", ".":
+		case "..":
+			// You can't go above the root
+			if len(elems) > 0 {
+				elems = elems[:len(elems)-1]
+			}
+		default:
+			elems = append(elems, elem)
+		}
+	}
+
+	return `\` + strings.Join(elems, `\`)
+}
+
+func addWindowsLongPathPrefix(path string) string {
+	if len(path) < windowsMaxPath || strings.HasPrefix(path, windowsLongPathPrefix) {
+		return path
+	}
+
+	if strings.HasPrefix(path, `\\`) {
+		return windowsLongUNCPrefix + path[2:]
+	}
+	return windowsLongPathPrefix + path
+}
+
+func isASCIILetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isWindows() bool {
+	return runtime.GOOS == "windows"
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWindowsAbs(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{`=D:`: `D:\cache`}
+	lookupEnv := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	for _, tc := range []struct {
+		path, expected string
+	}{
+		{`builds`, `C:\agent\builds`},
+		{`.\builds\..\plugins`, `C:\agent\plugins`},
+		{`\builds`, `C:\builds`},
+		{`c:/programdata/buildkite-agent/`, `C:\programdata\buildkite-agent`},
+		{`C:\..\..\builds`, `C:\builds`},
+		{`C:builds`, `C:\agent\builds`},
+		{`D:builds`, `D:\cache\builds`},
+		{`E:builds`, `E:\builds`},
+		{`\\server\share\builds\..\x`, `\\server\share\x`},
+		{`//server/share/builds`, `\\server\share\builds`},
+		{`\\?\c:\builds\.`, `\\?\C:\builds`},
+		{`\\?\UNC\server\share\builds\..\x`, `\\?\UNC\server\share\x`},
+	} {
+		assert.Equal(t, tc.expected, windowsAbs(tc.path, `C:\agent`, lookupEnv), tc.path)
+	}
+}
+
+func TestWindowsAbsWithUNCWorkingDir(t *testing.T) {
+	t.Parallel()
+
+	noEnv := func(string) (string, bool) { return "", false }
+
+	assert.Equal(t, `\\server\share\agent\builds`, windowsAbs(`builds`, `\\server\share\agent`, noEnv))
+	assert.Equal(t, `\\server\share\builds`, windowsAbs(`\builds`, `\\server\share\agent`, noEnv))
+}
+
+func TestExpandWindowsEnv(t *testing.T) {
+	t.Parallel()
+
+	lookupEnv := func(key string) (string, bool) {
+		if key == "ProgramData" {
+			return `C:\ProgramData`, true
+		}
+		return "", false
+	}
+
+	assert.Equal(t, `C:\ProgramData\buildkite-agent`, ExpandWindowsEnv(`%ProgramData%\buildkite-agent`, lookupEnv))
+	assert.Equal(t, `%NOPE%\buildkite-agent`, ExpandWindowsEnv(`%NOPE%\buildkite-agent`, lookupEnv))
+	assert.Equal(t, `100% %`, ExpandWindowsEnv(`100% %`, lookupEnv))
+}
+
+func TestAddWindowsLongPathPrefix(t *testing.T) {
+	t.Parallel()
+
+	long := strings.Repeat(`\builds`, 40)
+
+	assert.Equal(t, `C:\builds`, addWindowsLongPathPrefix(`C:\builds`))
+	assert.Equal(t, `\\?\C:`+long, addWindowsLongPathPrefix(`C:`+long))
+	assert.Equal(t, `\\?\UNC\server\share`+long, addWindowsLongPathPrefix(`\\server\share`+long))
+	assert.Equal(t, `\\?\C:`+long, addWindowsLongPathPrefix(`\\?\C:`+long))
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"os"
+	"runtime"
+	"strings"
+)
+
+// The prefixes Windows uses to expose the filesystems of WSL distributions
+var wslUNCPrefixes = []string{`\\wsl$\`, `\\wsl.localhost\`}
+
+// WindowsPathToWSL translates an absolute Windows path to the path a WSL
+// distribution sees it as, so "C:\builds\x" becomes "/mnt/c/builds/x", and
+// "\\wsl$\Ubuntu\home\x" becomes "/home/x". Paths that can't be translated,
+// like relative paths or other network shares, are returned with false.
+func WindowsPathToWSL(path string) (string, bool) {
+	path = strings.ReplaceAll(path, "/", `\`)
+	path = strings.TrimPrefix(path, windowsLongPathPrefix)
+
+	if len(path) >= 2 && path[1] == ':' && isASCIILetter(path[0]) {
+		if len(path) > 2 && path[2] != '\\' {
+			// Drive relative paths depend on state we don't have
+			return path, false
+		}
+		rest := strings.ReplaceAll(strings.TrimPrefix(path[2:], `\`), `\`, "/")
+		return strings.TrimSuffix("/mnt/"+strings.ToLower(path[:1])+"/"+rest, "/"), true
+	}
+
+	for _, prefix := range wslUNCPrefixes {
+		if len(path) > len(prefix) && strings.EqualFold(path[:len(prefix)], prefix) {
+			_, rest, _ := strings.Cut(path[len(prefix):], `\`)
+			return "/" + strings.ReplaceAll(rest, `\`, "/"), true
+		}
+	}
+
+	return path, false
+}
+
+// WSLPathToWindows translates an absolute path inside a WSL distribution to
+// the path Windows sees it as, so "/mnt/c/builds/x" becomes "C:\builds\x",
+// and "/home/x" becomes "\\wsl$\<distribution>\home\x". Relative paths are
+// returned with false.
+func WSLPathToWindows(path, distribution string) (string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return path, false
+	}
+
+	if rest := strings.TrimPrefix(path, "/mnt/"); rest != path && len(rest) >= 1 && isASCIILetter(rest[0]) &&
+		(len(rest) == 1 || rest[1] == '/') {
+		return strings.ToUpper(rest[:1]) + `:\` + strings.ReplaceAll(strings.TrimPrefix(rest[1:], "/"), "/", `\`), true
+	}
+
+	if distribution == "" {
+		return path, false
+	}
+
+	return `\\wsl$\` + distribution + strings.ReplaceAll(path, "/", `\`), true
+}
+
+// NativeWSLPath translates a path from the other side of the WSL boundary
+// into one the current process can use. On Windows, that means WSL style
+// "/mnt/c/" paths, and inside WSL, it means Windows style paths. Anything
+// else is returned as it is.
+func NativeWSLPath(path string) string {
+	if runtime.GOOS == "windows" {
+		if strings.HasPrefix(path, "/mnt/") {
+			if p, ok := WSLPathToWindows(path, ""); ok {
+				return p
+			}
+		}
+		return path
+	}
+
+	if WSLDistribution() != "" {
+		if p, ok := WindowsPathToWSL(path); ok {
+			return p
+		}
+	}
+
+	return path
+}
+
+// WSLDistribution returns the name of the WSL distribution the current process
+// is running in, or an empty string if it's not running in WSL
+func WSLDistribution() string {
+	return os.Getenv("WSL_DISTRO_NAME")
+}
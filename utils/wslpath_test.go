@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWindowsPathToWSL(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		path, expected string
+		ok             bool
+	}{
+		{`C:\builds\llamas`, `/mnt/c/builds/llamas`, true},
+		{`d:/builds`, `/mnt/d/builds`, true},
+		{`C:\`, `/mnt/c`, true},
+		{`\\?\C:\builds`, `/mnt/c/builds`, true},
+		{`\\wsl$\Ubuntu\home\llama`, `/home/llama`, true},
+		{`\\wsl.localhost\Ubuntu\home\llama`, `/home/llama`, true},
+		{`C:builds`, `C:builds`, false},
+		{`builds\llamas`, `builds\llamas`, false},
+		{`\\server\share\builds`, `\\server\share\builds`, false},
+	} {
+		path, ok := WindowsPathToWSL(tc.path)
+		assert.Equal(t, tc.expected, path, tc.path)
+		assert.Equal(t, tc.ok, ok, tc.path)
+	}
+}
+
+func TestWSLPathToWindows(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		path, distribution, expected string
+		ok                           bool
+	}{
+		{`/mnt/c/builds/llamas`, "Ubuntu", `C:\builds\llamas`, true},
+		{`/mnt/d`, "", `D:\`, true},
+		{`/home/llama`, "Ubuntu", `\\wsl$\Ubuntu\home\llama`, true},
+		{`/home/llama`, "", `/home/llama`, false},
+		{`/mnt/wsl/llama`, "Ubuntu", `\\wsl$\Ubuntu\mnt\wsl\llama`, true},
+		{`builds/llamas`, "Ubuntu", `builds/llamas`, false},
+	} {
+		path, ok := WSLPathToWindows(tc.path, tc.distribution)
+		assert.Equal(t, tc.expected, path, tc.path)
+		assert.Equal(t, tc.ok, ok, tc.path)
+	}
+}